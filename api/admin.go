@@ -0,0 +1,859 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/events"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+const (
+	// defaultReporterStatsWindow is the window of the reporter stats unless
+	// another one is given.
+	defaultReporterStatsWindow = 30 * 24 * time.Hour
+)
+
+var (
+	// errAdminRequired is the error returned when a request to an admin
+	// endpoint is made with an API key that's not an admin key.
+	errAdminRequired = errors.New("this endpoint requires an admin API key")
+
+	// errReblockUnavailable is the error returned when hashes are queued to be
+	// blocked again but there's no blocker to block them, which is the case
+	// when the blocker is running in aggregator mode.
+	errReblockUnavailable = errors.New("reblocking is not supported by this blocker, it doesn't block hashes")
+
+	// errAuditUnavailable is the error returned when the audit report is
+	// requested but audits are not enabled.
+	errAuditUnavailable = errors.New("audits are not enabled on this blocker")
+
+	// errHashNotFound is the error returned when the details of a hash are
+	// requested that's not in the database.
+	errHashNotFound = errors.New("hash not found")
+
+	// errIdentityNotFound is the error returned when an identity is unblocked
+	// that's not blocked.
+	errIdentityNotFound = errors.New("identity is not blocked")
+)
+
+type (
+	// ReblockPOST describes a request to the /admin/reblock endpoint. All
+	// hashes added from the given time, up until the optional end time, are
+	// sent to skyd again. If tags are given only the hashes that carry one of
+	// them are sent.
+	ReblockPOST struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+		Tags []string  `json:"tags,omitempty"`
+	}
+
+	// ReblockResponse is the response of the /admin/reblock endpoint, it
+	// holds the number of hashes that will be sent to skyd again.
+	ReblockResponse struct {
+		Hashes int `json:"hashes"`
+	}
+
+	// ArchiveResponse is the response of the /admin/archive endpoint, it
+	// holds the number of reverted skylinks that were archived because they
+	// got reverted before the cutoff.
+	ArchiveResponse struct {
+		Archived int       `json:"archived"`
+		Before   time.Time `json:"before"`
+	}
+
+	// BlockedSkylinkGET is the response of the /admin/block/:hash endpoint,
+	// it holds the state of a blocked skylink along with the history of its
+	// lifecycle, which helps debugging why it's in that state.
+	BlockedSkylinkGET struct {
+		Hash                 database.Hash    `json:"hash"`
+		Namespace            string           `json:"namespace"`
+		Tags                 []string         `json:"tags"`
+		Severity             string           `json:"severity,omitempty"`
+		Source               string           `json:"source,omitempty"`
+		Deleted              bool             `json:"deleted"`
+		DeletedAt            *time.Time       `json:"deletedAt,omitempty"`
+		Failed               bool             `json:"failed"`
+		FailureClass         string           `json:"failureClass,omitempty"`
+		FailureReason        string           `json:"failureReason,omitempty"`
+		Invalid              bool             `json:"invalid"`
+		Reverted             bool             `json:"reverted"`
+		RevertedTags         []string         `json:"revertedTags,omitempty"`
+		SkippedAllowListed   bool             `json:"skippedAllowListed"`
+		AllowListed          bool             `json:"allowlisted"`
+		AllowListDescription string           `json:"allowlistDescription,omitempty"`
+		ContentMissing       bool             `json:"contentMissing"`
+		CallbackAttempts     int              `json:"callbackAttempts"`
+		TimestampAdded       time.Time        `json:"timestampAdded"`
+		TimestampBlocked     *time.Time       `json:"timestampBlocked,omitempty"`
+		TimestampReverted    *time.Time       `json:"timestampReverted,omitempty"`
+		Events               []database.Event `json:"events"`
+	}
+
+	// PendingGET is the response of the /blocklist/pending endpoint, it holds
+	// a page of the skylinks that were reported but that await the next
+	// sweep of the blocker.
+	PendingGET struct {
+		Entries []PendingHash `json:"entries"`
+		HasMore bool          `json:"hasmore"`
+	}
+
+	// PendingHash is a hash that awaits the next sweep of the blocker, its age
+	// is the amount of time it's been waiting in nanoseconds. Hashes that got
+	// allowlisted since they were reported are flagged, along with the
+	// description of their allowlist entry.
+	PendingHash struct {
+		Hash                 database.Hash `json:"hash"`
+		Tags                 []string      `json:"tags"`
+		AllowListed          bool          `json:"allowlisted"`
+		AllowListDescription string        `json:"allowlistDescription,omitempty"`
+		TimestampAdded       time.Time     `json:"timestampAdded"`
+		Age                  time.Duration `json:"age"`
+	}
+
+	// BlockResetPOST describes a request to the /admin/block/:hash/reset
+	// endpoint. If BumpTimestamp is true the time the skylink was added is
+	// set to now, which makes the next sweep of every blocker in the cluster
+	// pick it up, not only the one that served the request.
+	BlockResetPOST struct {
+		BumpTimestamp bool `json:"bumpTimestamp"`
+	}
+
+	// AllowListHitsGET is the response of the /admin/allowlist/hits
+	// endpoint, it holds the allowlisted skylinks that got reported within
+	// the allowlist hit window, most reported first.
+	AllowListHitsGET struct {
+		Hits []AllowListHit `json:"hits"`
+	}
+
+	// AllowListHit holds the number of times an allowlisted skylink got
+	// reported, by how many distinct reporters, and when it was last
+	// reported.
+	AllowListHit struct {
+		Hash      database.Hash `json:"hash"`
+		Hits      int           `json:"hits"`
+		Reporters int           `json:"reporters"`
+		LastHit   time.Time     `json:"lastHit"`
+	}
+
+	// ReporterStatsGET is the response of the /admin/stats/reporters
+	// endpoint, it holds the stats of the reporters that reported skylinks
+	// within the window, suspicious reporters first.
+	ReporterStatsGET struct {
+		Window    string          `json:"window"`
+		Source    string          `json:"source,omitempty"`
+		Reporters []ReporterStats `json:"reporters"`
+	}
+
+	// ReporterStats holds the stats of a reporter, identified by their sub
+	// or MySkyID, by tag. A reporter is suspicious if the stats of one of
+	// its tags exceed the suspicion thresholds.
+	ReporterStats struct {
+		Reporter   string             `json:"reporter"`
+		Suspicious bool               `json:"suspicious"`
+		Tags       []ReporterTagStats `json:"tags"`
+	}
+
+	// ReporterTagStats holds the number of skylinks a reporter reported with
+	// a tag, the fraction of those that turned out to be bogus because
+	// they're invalid or got reverted, and the median time between them.
+	ReporterTagStats struct {
+		Tag            string        `json:"tag"`
+		Reports        int           `json:"reports"`
+		Invalid        int           `json:"invalid"`
+		Reverted       int           `json:"reverted"`
+		BogusRatio     float64       `json:"bogusRatio"`
+		MedianInterval time.Duration `json:"medianInterval"`
+		Suspicious     bool          `json:"suspicious"`
+	}
+
+	// BlockedIdentityPOST describes a request to the /admin/identities
+	// endpoint, it blocks the MySkyID for the given reason.
+	BlockedIdentityPOST struct {
+		MySkyID string `json:"myskyid"`
+		Reason  string `json:"reason"`
+	}
+
+	// BlockedIdentitiesGET is the response of the /admin/identities
+	// endpoint, it holds all blocked identities, most recently blocked first.
+	BlockedIdentitiesGET struct {
+		Identities []BlockedIdentity `json:"identities"`
+	}
+
+	// BlockedIdentity is a MySkyID that's blocked from reporting skylinks
+	// through the /powblock endpoint, reports attributed to it are flagged.
+	BlockedIdentity struct {
+		MySkyID        string    `json:"myskyid"`
+		Reason         string    `json:"reason"`
+		TimestampAdded time.Time `json:"timestampAdded"`
+	}
+
+	// ServersGET is the response of the /admin/servers endpoint, it holds
+	// the latest block timestamp of every blocker sharing the database,
+	// sorted by server UID.
+	ServersGET struct {
+		Servers []Server `json:"servers"`
+	}
+
+	// Server holds the latest block timestamp of a blocker and the time it
+	// was last updated, which is zero if it was stored before that was kept
+	// track of. Blockers that stop updating it are pruned after a while.
+	Server struct {
+		ServerUID   string    `json:"serverUID"`
+		LatestBlock time.Time `json:"latestBlock"`
+		LastUpdated time.Time `json:"lastUpdated"`
+	}
+
+	// UnblockPOST describes a request to the /unblock endpoint. The skylink
+	// is identified by its hash or by the skylink itself. If tags are given
+	// only those are reverted, the skylink stays blocked for the others.
+	UnblockPOST struct {
+		Hash    database.Hash `json:"hash"`
+		Skylink skylink       `json:"skylink"`
+		Tags    []string      `json:"tags,omitempty"`
+	}
+)
+
+// requireAdmin wraps the given handler so it's only served to requests that
+// carry an admin API key in the Skynet-Api-Key header. Requests without a key
+// or with an unknown key are rejected with a 401, requests with a key that's
+// not an admin key with a 403.
+func (api *API) requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !api.checkAdmin(w, r) {
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// checkAdmin returns true if the given request carries an admin API key, if it
+// doesn't the error is written to the response and it returns false.
+func (api *API) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	apiKey, exists := api.staticAPIKeys[r.Header.Get(APIKeyHeader)]
+	if !exists {
+		WriteError(w, errUnknownAPIKey, http.StatusUnauthorized)
+		return false
+	}
+	if !apiKey.Admin {
+		WriteError(w, errAdminRequired, http.StatusForbidden)
+		return false
+	}
+	api.staticLogger.WithField("key_id", apiKey.ID).WithField("path", r.URL.Path).Info("admin request")
+	return true
+}
+
+// adminReblockPOST queues the hashes that were added within the requested time
+// range to be sent to skyd again, regardless of whether they were blocked
+// before. It's meant to replay the blocklist after skyd lost it, e.g. after a
+// data wipe. Hashes that are invalid, that failed to get blocked or that were
+// soft-deleted are not sent, failed hashes are handled by the retry loop.
+func (api *API) adminReblockPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Protect against large bodies.
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
+	defer b.Close()
+
+	// Parse the request.
+	var body ReblockPOST
+	err := json.NewDecoder(b).Decode(&body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.From.IsZero() {
+		WriteError(w, errors.New("'from' is required"), http.StatusBadRequest)
+		return
+	}
+	if !body.To.IsZero() && !body.To.After(body.From) {
+		WriteError(w, errors.New("'to' has to be after 'from'"), http.StatusBadRequest)
+		return
+	}
+
+	// Make sure there's a blocker to queue the hashes with.
+	api.staticMu.Lock()
+	reblockFn := api.reblockFn
+	api.staticMu.Unlock()
+	if reblockFn == nil {
+		WriteError(w, errReblockUnavailable, http.StatusBadRequest)
+		return
+	}
+
+	// Fetch the hashes.
+	var opts []database.QueryOption
+	if !body.To.IsZero() {
+		opts = append(opts, database.AddedBefore(body.To.UTC()))
+	}
+	if len(body.Tags) > 0 {
+		opts = append(opts, database.WithTags(body.Tags...))
+	}
+	hashes, err := api.staticDB.HashesToBlock(r.Context(), body.From.UTC(), opts...)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to find hashes"), http.StatusInternalServerError)
+		return
+	}
+
+	// Queue them.
+	reblockFn(hashes)
+	api.staticLogger.WithField("hashes", len(hashes)).Info("queued hashes to be blocked again")
+	skyapi.WriteJSON(w, ReblockResponse{Hashes: len(hashes)})
+}
+
+// adminArchivePOST moves the reverted skylinks that were removed from skyd's
+// blocklist, and that got reverted longer ago than the age given by the 'age'
+// parameter, to the archive. The age defaults to the configured archive age.
+// The archive is only read when a hash gets reported again, which restores
+// it. It's safe to call again if it fails halfway.
+func (api *API) adminArchivePOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	age := api.staticConfig.archiveAge()
+	if ageStr := r.URL.Query().Get("age"); ageStr != "" {
+		var err error
+		age, err = parseDuration(ageStr)
+		if err != nil || age <= 0 {
+			WriteError(w, fmt.Errorf("invalid value for 'age' parameter, '%v' is not a positive duration", ageStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before := database.Now().Add(-age)
+	archived, err := api.staticDB.ArchiveReverted(r.Context(), before)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to archive reverted skylinks"), http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.WithField("archived", archived).Infof("archived skylinks reverted before %v", before.Format(time.RFC3339))
+	skyapi.WriteJSON(w, ArchiveResponse{Archived: archived, Before: before})
+}
+
+// adminAuditGET returns the state of the auditor, which holds the report of
+// the last audit of skyd's blocklist against the database.
+func (api *API) adminAuditGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	api.staticMu.Lock()
+	auditFn := api.auditFn
+	api.staticMu.Unlock()
+	if auditFn == nil {
+		WriteError(w, errAuditUnavailable, http.StatusBadRequest)
+		return
+	}
+	skyapi.WriteJSON(w, auditFn())
+}
+
+// blocklistPendingGET returns a page of the skylinks that were reported but
+// that await the next sweep of the blocker, along with the amount of time
+// they've been waiting. The results are sorted on the 'timestamp_added' field,
+// oldest first unless the caller requests to see the newest results first.
+func (api *API) blocklistPendingGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sort, offset, limit, err := parseListParameters(r.URL.Query(), api.staticConfig.limits().MaxPageSize)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	docs, more, err := api.staticDB.PendingHashes(r.Context(), sort, offset, limit)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to fetch pending hashes"), http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([]database.Hash, len(docs))
+	for i, doc := range docs {
+		hashes[i] = doc.Hash
+	}
+	allowListed, err := api.findAllowListed(r.Context(), hashes)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	entries := make([]PendingHash, len(docs))
+	for i, doc := range docs {
+		allowListEntry, isAllowListed := allowListed[doc.Hash]
+		entries[i] = PendingHash{
+			Hash:                 doc.Hash,
+			Tags:                 doc.Tags,
+			AllowListed:          isAllowListed,
+			AllowListDescription: allowListEntry.Description,
+			TimestampAdded:       doc.TimestampAdded,
+			Age:                  now.Sub(doc.TimestampAdded),
+		}
+	}
+	skyapi.WriteJSON(w, PendingGET{
+		Entries: entries,
+		HasMore: more,
+	})
+}
+
+// adminBlockGET returns the state of the blocked skylink with the given hash,
+// including the skylinks that were soft-deleted, along with its lifecycle
+// events and whether the hash got allowlisted.
+func (api *API) adminBlockGET(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hash, err := database.HashFromString(ps.ByName("hash"))
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	doc, err := api.staticDB.FindByHash(r.Context(), hash, database.IncludeDeleted())
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to find hash"), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	allowListed, err := api.findAllowListed(r.Context(), []database.Hash{hash})
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := newBlockedSkylinkGET(doc)
+	if allowListEntry, exists := allowListed[hash]; exists {
+		resp.AllowListed = true
+		resp.AllowListDescription = allowListEntry.Description
+	}
+	skyapi.WriteJSON(w, resp)
+}
+
+// findAllowListed returns the allow list entries of the given hashes, keyed by
+// hash, hashes that aren't allowlisted are left out. It looks them all up in a
+// single query.
+func (api *API) findAllowListed(ctx context.Context, hashes []database.Hash) (map[database.Hash]database.AllowListedSkylink, error) {
+	docs, err := api.staticDB.FindAllowListed(ctx, hashes)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find allowlisted hashes")
+	}
+	allowListed := make(map[database.Hash]database.AllowListedSkylink, len(docs))
+	for _, doc := range docs {
+		allowListed[doc.Hash] = doc
+	}
+	return allowListed, nil
+}
+
+// adminBlockResetPOST resets the processing state of the blocked skylink with
+// the given hash and queues it to be blocked again, which lets support retry a
+// skylink that failed to get blocked or that skyd rejected as invalid. The
+// reset is recorded as an event on the skylink, the response holds its new
+// state.
+func (api *API) adminBlockResetPOST(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hash, err := database.HashFromString(ps.ByName("hash"))
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Protect against large bodies.
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
+	defer b.Close()
+
+	// Parse the request, the body is optional.
+	var body BlockResetPOST
+	err = json.NewDecoder(b).Decode(&body)
+	if err != nil && err != io.EOF {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Reset the skylink.
+	keyID := api.staticAPIKeys[r.Header.Get(APIKeyHeader)].ID
+	detail := fmt.Sprintf("reset by admin key '%v'", keyID)
+	err = api.staticDB.ResetBlockedSkylink(r.Context(), hash, body.BumpTimestamp, detail)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to reset hash"), http.StatusInternalServerError)
+		return
+	}
+
+	// Queue it to be blocked again, blockers without a reblock queue pick it
+	// up on their next sweep if the timestamp was bumped.
+	api.staticMu.Lock()
+	reblockFn := api.reblockFn
+	api.staticMu.Unlock()
+	if reblockFn != nil {
+		reblockFn([]database.Hash{hash})
+	}
+	api.staticLogger.WithField("hash", hash.String()).WithField("key_id", keyID).Info("reset hash")
+
+	doc, err := api.staticDB.FindByHash(r.Context(), hash)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to find hash"), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	skyapi.WriteJSON(w, newBlockedSkylinkGET(doc))
+}
+
+// adminBlockDELETE soft-deletes the blocked skylink with the given hash. The
+// skylink is kept for auditing purposes but is excluded from the blocklist, if
+// skyd blocked it already the block loop removes it from skyd's blocklist. The
+// deletion is recorded as an event on the skylink, the response holds its new
+// state.
+func (api *API) adminBlockDELETE(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hash, err := database.HashFromString(ps.ByName("hash"))
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Delete the skylink.
+	keyID := api.staticAPIKeys[r.Header.Get(APIKeyHeader)].ID
+	detail := fmt.Sprintf("deleted by admin key '%v'", keyID)
+	err = api.staticDB.SoftDelete(r.Context(), hash, detail)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to delete hash"), http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.WithField("hash", hash.String()).WithField("key_id", keyID).Info("deleted hash")
+	api.managedPublish(events.Event{
+		Type:   events.BlockDeleted,
+		Hashes: []database.Hash{hash},
+	})
+
+	doc, err := api.staticDB.FindByHash(r.Context(), hash, database.IncludeDeleted())
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to find hash"), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	skyapi.WriteJSON(w, newBlockedSkylinkGET(doc))
+}
+
+// unblockPOST reverts the given tags of a blocked skylink, or all of them if no
+// tags are given. The skylink is only unblocked once none of its tags remain,
+// the block loop then removes it from skyd's blocklist.
+func (api *API) unblockPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Protect against large bodies.
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
+	defer b.Close()
+
+	// Parse the request.
+	var body UnblockPOST
+	err := json.NewDecoder(b).Decode(&body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	body.Tags = database.NormalizeTags(body.Tags)
+
+	// Resolve the hash.
+	h, err := api.resolveHash(BlockPOST{Hash: body.Hash, Skylink: body.Skylink})
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to resolve hash"), resolveErrorCode(err))
+		return
+	}
+	hash := database.Hash{Hash: h}
+
+	// Assert the skylink carries the given tags, reverting a tag that was
+	// reverted already is a no-op.
+	doc, err := api.staticDB.FindByHash(r.Context(), hash)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to find hash"), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	carried := make(map[string]struct{})
+	for _, tag := range append(doc.Tags, doc.RevertedTags...) {
+		carried[tag] = struct{}{}
+	}
+	for _, tag := range body.Tags {
+		if _, exists := carried[tag]; !exists {
+			WriteError(w, fmt.Errorf("the skylink doesn't carry tag '%v'", tag), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Revert the tags, the skylink is published as reverted once it loses
+	// its last tag.
+	wasReverted := doc.Reverted
+	keyID := api.staticAPIKeys[r.Header.Get(APIKeyHeader)].ID
+	detail := fmt.Sprintf("reverted by admin key '%v'", keyID)
+	if len(body.Tags) > 0 {
+		detail = fmt.Sprintf("%v reverted by admin key '%v'", strings.Join(body.Tags, ", "), keyID)
+	}
+	doc, err = api.staticDB.RevertTags(r.Context(), hash, body.Tags, detail)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		WriteError(w, errHashNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to revert tags"), http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.
+		WithField("hash", hash.String()).
+		WithField("key_id", keyID).
+		WithField("tags", body.Tags).
+		WithField("reverted", doc.Reverted).
+		Info("reverted tags")
+	if doc.Reverted && !wasReverted {
+		api.managedPublish(events.Event{
+			Type:   events.BlockReverted,
+			Hashes: []database.Hash{hash},
+		})
+	}
+	skyapi.WriteJSON(w, newBlockedSkylinkGET(doc))
+}
+
+// adminIdentitiesGET returns all blocked identities.
+func (api *API) adminIdentitiesGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	docs, err := api.staticDB.BlockedIdentities(r.Context())
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to fetch blocked identities"), http.StatusInternalServerError)
+		return
+	}
+	identities := make([]BlockedIdentity, len(docs))
+	for i, doc := range docs {
+		identities[i] = BlockedIdentity{
+			MySkyID:        doc.MySkyID,
+			Reason:         doc.Reason,
+			TimestampAdded: doc.TimestampAdded,
+		}
+	}
+	skyapi.WriteJSON(w, BlockedIdentitiesGET{Identities: identities})
+}
+
+// adminServersGET returns the latest block timestamp of every blocker that
+// shares the database.
+func (api *API) adminServersGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	docs, err := api.staticDB.LatestBlockTimestamps(r.Context())
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to fetch latest block timestamps"), http.StatusInternalServerError)
+		return
+	}
+	servers := make([]Server, len(docs))
+	for i, doc := range docs {
+		servers[i] = Server{
+			ServerUID:   doc.ServerUID,
+			LatestBlock: doc.Timestamp,
+			LastUpdated: doc.LastUpdated,
+		}
+	}
+	skyapi.WriteJSON(w, ServersGET{Servers: servers})
+}
+
+// adminIdentitiesPOST blocks a MySkyID. Proofs of work created by a blocked
+// MySkyID are rejected, reports attributed to it through any other route are
+// tagged and their severity is raised. Blocking a MySkyID that's blocked
+// already updates the reason.
+//
+// NOTE: this is a policy of the blocker, it doesn't stop the MySkyID from
+// publishing content.
+func (api *API) adminIdentitiesPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Protect against large bodies.
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
+	defer b.Close()
+
+	// Parse the request.
+	var body BlockedIdentityPOST
+	err := json.NewDecoder(b).Decode(&body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	mySkyID, err := parseMySkyID(body.MySkyID)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(body.Reason)
+	if reason == "" {
+		WriteError(w, errors.New("'reason' is required"), http.StatusBadRequest)
+		return
+	}
+
+	// Block the identity.
+	err = api.staticDB.BlockIdentity(r.Context(), mySkyID, reason)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to block identity"), http.StatusInternalServerError)
+		return
+	}
+	keyID := api.staticAPIKeys[r.Header.Get(APIKeyHeader)].ID
+	api.staticLogger.
+		WithField("myskyid", mySkyID).
+		WithField("key_id", keyID).
+		WithField("reason", reason).
+		Info("blocked identity")
+	skyapi.WriteSuccess(w)
+}
+
+// adminIdentitiesDELETE unblocks the given MySkyID, reports that were flagged
+// while it was blocked keep their tags.
+func (api *API) adminIdentitiesDELETE(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mySkyID, err := parseMySkyID(ps.ByName("myskyid"))
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.UnblockIdentity(r.Context(), mySkyID)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		WriteError(w, errIdentityNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to unblock identity"), http.StatusInternalServerError)
+		return
+	}
+	keyID := api.staticAPIKeys[r.Header.Get(APIKeyHeader)].ID
+	api.staticLogger.WithField("myskyid", mySkyID).WithField("key_id", keyID).Info("unblocked identity")
+	skyapi.WriteSuccess(w)
+}
+
+// adminAllowListHitsGET returns the allowlisted skylinks that got reported
+// within the allowlist hit window, along with how often they got reported. An
+// allowlisted skylink that keeps getting reported indicates the allow list is
+// wrong, or that someone is probing it. The number of skylinks returned can
+// be limited using the 'limit' parameter.
+func (api *API) adminAllowListHitsGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	maxPageSize := api.staticConfig.limits().MaxPageSize
+	limit := maxPageSize
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			WriteError(w, fmt.Errorf("invalid value for 'limit' parameter, must be between 1 and %v", maxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	docs, err := api.staticDB.AllowListHits(r.Context(), limit)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to fetch allowlist hits"), http.StatusInternalServerError)
+		return
+	}
+	hits := make([]AllowListHit, len(docs))
+	for i, doc := range docs {
+		hits[i] = AllowListHit{
+			Hash:      doc.Hash,
+			Hits:      doc.Hits,
+			Reporters: doc.Reporters,
+			LastHit:   doc.LastHit,
+		}
+	}
+	skyapi.WriteJSON(w, AllowListHitsGET{Hits: hits})
+}
+
+// adminReporterStatsGET returns the stats of the reporters that reported
+// skylinks within the window given by the 'window' parameter, which defaults to
+// 30 days. The 'source' parameter limits the stats to the reports from that
+// source, e.g. 'pow'. Reporters that file bogus reports, e.g. to get a
+// competitor's content blocked, stand out by the fraction of their reports that
+// turned out to be invalid or got reverted.
+func (api *API) adminReporterStatsGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	window := defaultReporterStatsWindow
+	if windowStr := query.Get("window"); windowStr != "" {
+		var err error
+		window, err = parseDuration(windowStr)
+		if err != nil || window <= 0 {
+			WriteError(w, fmt.Errorf("invalid value for 'window' parameter, '%v' is not a positive duration", windowStr), http.StatusBadRequest)
+			return
+		}
+	}
+	source := query.Get("source")
+	switch source {
+	case "", database.SourceAPI, database.SourcePoW, database.SourceSync:
+	default:
+		WriteError(w, fmt.Errorf("invalid value for 'source' parameter, can only be '%v', '%v' or '%v'", database.SourceAPI, database.SourcePoW, database.SourceSync), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := api.staticDB.ReporterStats(r.Context(), database.Now().Add(-window), source)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to fetch reporter stats"), http.StatusInternalServerError)
+		return
+	}
+	skyapi.WriteJSON(w, ReporterStatsGET{
+		Window:    window.String(),
+		Source:    source,
+		Reporters: newReporterStats(stats, api.staticConfig.suspicion()),
+	})
+}
+
+// newReporterStats groups the given stats, which are sorted by reporter, by
+// reporter and flags the ones that exceed the given thresholds. Suspicious
+// reporters come first, the order is kept otherwise.
+func newReporterStats(stats []database.ReporterTagStats, thresholds database.SuspicionThresholds) []ReporterStats {
+	reporters := make([]ReporterStats, 0)
+	for _, s := range stats {
+		if len(reporters) == 0 || reporters[len(reporters)-1].Reporter != s.Reporter {
+			reporters = append(reporters, ReporterStats{Reporter: s.Reporter})
+		}
+		reporter := &reporters[len(reporters)-1]
+		suspicious := thresholds.Suspicious(s)
+		reporter.Tags = append(reporter.Tags, ReporterTagStats{
+			Tag:            s.Tag,
+			Reports:        s.Reports,
+			Invalid:        s.Invalid,
+			Reverted:       s.Reverted,
+			BogusRatio:     s.BogusRatio(),
+			MedianInterval: s.MedianInterval,
+			Suspicious:     suspicious,
+		})
+		reporter.Suspicious = reporter.Suspicious || suspicious
+	}
+	sort.SliceStable(reporters, func(i, j int) bool {
+		return reporters[i].Suspicious && !reporters[j].Suspicious
+	})
+	return reporters
+}
+
+// newBlockedSkylinkGET returns the admin view of the given blocked skylink.
+func newBlockedSkylinkGET(doc *database.BlockedSkylink) BlockedSkylinkGET {
+	resp := BlockedSkylinkGET{
+		Hash:               doc.Hash,
+		Namespace:          doc.Namespace,
+		Tags:               doc.Tags,
+		Severity:           doc.Severity,
+		Source:             doc.Source,
+		Deleted:            doc.Deleted,
+		Failed:             doc.Failed,
+		FailureClass:       doc.FailureClass,
+		FailureReason:      doc.FailureReason,
+		Invalid:            doc.Invalid,
+		Reverted:           doc.Reverted,
+		RevertedTags:       doc.RevertedTags,
+		SkippedAllowListed: doc.SkippedAllowListed,
+		ContentMissing:     doc.ContentMissing,
+		CallbackAttempts:   doc.CallbackAttempts,
+		TimestampAdded:     doc.TimestampAdded,
+		Events:             doc.Events,
+	}
+	if !doc.DeletedAt.IsZero() {
+		resp.DeletedAt = &doc.DeletedAt
+	}
+	if !doc.TimestampBlocked.IsZero() {
+		resp.TimestampBlocked = &doc.TimestampBlocked
+	}
+	if !doc.TimestampReverted.IsZero() {
+		resp.TimestampReverted = &doc.TimestampReverted
+	}
+	if resp.Events == nil {
+		resp.Events = []database.Event{}
+	}
+	return resp
+}
@@ -0,0 +1,1342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/fastrand"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+)
+
+// TestAdminReblock verifies the /admin/reblock endpoint requires an admin key
+// and queues the hashes within the requested range to be blocked again.
+func TestAdminReblock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API in aggregator mode with an admin key
+	cfg := newTestConfig()
+	cfg.AggregatorMode = true
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert hashes that were added a day apart, the ones of the last two
+	// days are tagged as phishing, the others as malware
+	now := database.Now()
+	var hashes []database.Hash
+	for i := 0; i < 5; i++ {
+		tag := "malware"
+		if i < 2 {
+			tag = "phishing"
+		}
+		hash := database.HashBytes([]byte(fmt.Sprint(i)))
+		err = api.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			Tags:           []string{tag},
+			TimestampAdded: now.Add(-time.Duration(i) * 24 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// reblock is a helper that calls the endpoint with the given key and
+	// request
+	reblock := func(key string, req ReblockPOST) *httptest.ResponseRecorder {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/admin/reblock", bytes.NewReader(body))
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	week := ReblockPOST{From: now.Add(-7 * 24 * time.Hour)}
+
+	// assert the endpoint requires an admin key
+	if w := reblock("", week); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := reblock("scannerkey", week); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert reblocking is refused without a blocker
+	if w := reblock("adminkey", week); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// register a hook that records the queued hashes
+	var queued []database.Hash
+	api.RegisterReblockHook(func(hashes []database.Hash) {
+		queued = append([]database.Hash{}, hashes...)
+	})
+
+	tests := []struct {
+		name     string
+		req      ReblockPOST
+		code     int
+		expected []database.Hash
+	}{
+		{"NoFrom", ReblockPOST{}, http.StatusBadRequest, nil},
+		{"ToBeforeFrom", ReblockPOST{From: now, To: now.Add(-time.Hour)}, http.StatusBadRequest, nil},
+		{"Week", week, http.StatusOK, hashes},
+		{"From", ReblockPOST{From: now.Add(-36 * time.Hour)}, http.StatusOK, hashes[:2]},
+		{"Range", ReblockPOST{From: now.Add(-60 * time.Hour), To: now.Add(-12 * time.Hour)}, http.StatusOK, hashes[1:3]},
+		{"Tags", ReblockPOST{From: week.From, Tags: []string{"Phishing"}}, http.StatusOK, hashes[:2]},
+	}
+	for _, test := range tests {
+		queued = nil
+		w := reblock("adminkey", test.req)
+		if w.Code != test.code {
+			t.Fatalf("%v: unexpected status code %v, %v", test.name, w.Code, w.Body.String())
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var resp ReblockResponse
+		err = json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Hashes != len(test.expected) || len(queued) != len(test.expected) {
+			t.Fatalf("%v: unexpected number of hashes %v %v != %v", test.name, resp.Hashes, len(queued), len(test.expected))
+		}
+		expected := make(map[database.Hash]struct{})
+		for _, hash := range test.expected {
+			expected[hash] = struct{}{}
+		}
+		for _, hash := range queued {
+			if _, ok := expected[hash]; !ok {
+				t.Fatalf("%v: unexpected hash %v", test.name, hash)
+			}
+		}
+	}
+}
+
+// TestBlocklistNamespace verifies the blocklist of another namespace can only
+// be listed with an admin key.
+func TestBlocklistNamespace(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a handle on the same database in another namespace, both
+	// namespaces block the same hash but only the other one blocks a second
+	other := database.NewTestDB(ctx, t.Name(), database.WithTestNamespace("other"), database.WithCleanup(t))
+	shared := database.HashBytes([]byte("shared"))
+	only := database.HashBytes([]byte("only"))
+	for _, insert := range []struct {
+		db   database.Store
+		hash database.Hash
+	}{
+		{api.staticDB, shared},
+		{other, shared},
+		{other, only},
+	} {
+		err = insert.db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           insert.hash,
+			Tags:           []string{"malware"},
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// list is a helper that lists the blocklist of the given namespace with
+	// the given key
+	list := func(key, namespace string) (*httptest.ResponseRecorder, BlocklistGET) {
+		r := httptest.NewRequest(http.MethodGet, "/blocklist?namespace="+namespace, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		var blg BlocklistGET
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&blg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, blg
+	}
+
+	// assert everyone can list our own namespace
+	w, blg := list("", database.DefaultNamespace)
+	if w.Code != http.StatusOK || len(blg.Entries) != 1 || blg.Entries[0].Hash != shared {
+		t.Fatal("unexpected response", w.Code, blg)
+	}
+
+	// assert the other namespace requires an admin key
+	if w, _ := list("", "other"); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w, _ := list("scannerkey", "other"); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w, _ := list("adminkey", "other!"); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	w, blg = list("adminkey", "other")
+	if w.Code != http.StatusOK || len(blg.Entries) != 2 {
+		t.Fatal("unexpected response", w.Code, blg)
+	}
+}
+
+// TestAdminBlock verifies the /admin/block/:hash endpoint requires an admin
+// key and returns the state of a skylink along with its lifecycle events and
+// whether it's allowlisted.
+func TestAdminBlock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a hash that failed to get blocked before it got blocked
+	hash := database.HashBytes([]byte("inspect"))
+	err = api.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           hash,
+		Tags:           []string{"malware"},
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.staticDB.MarkFailed(ctx, []database.Hash{hash}, database.FailureClassTransient, "unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.staticDB.MarkSucceeded(ctx, []database.Hash{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// allowlist it after it got blocked
+	err = api.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+		Hash:           hash,
+		Description:    "false positive",
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// inspect is a helper that calls the endpoint with the given key and hash
+	inspect := func(key, hash string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/block/"+hash, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key
+	if w := inspect("", hash.String()); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := inspect("scannerkey", hash.String()); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert invalid and unknown hashes are rejected
+	if w := inspect("adminkey", "invalid"); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	unknown := database.HashBytes([]byte("unknown"))
+	if w := inspect("adminkey", unknown.String()); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert the response holds the events
+	w := inspect("adminkey", hash.String())
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	var resp BlockedSkylinkGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Hash != hash || resp.Failed || resp.TimestampBlocked == nil {
+		t.Fatal("unexpected response", resp)
+	}
+	if !resp.AllowListed || resp.AllowListDescription != "false positive" {
+		t.Fatal("unexpected allowlist state", resp.AllowListed, resp.AllowListDescription)
+	}
+	if len(resp.Events) != 2 || resp.Events[0].Type != database.EventFailed || resp.Events[1].Type != database.EventSucceeded {
+		t.Fatal("unexpected events", resp.Events)
+	}
+	if resp.Events[0].Detail != "transient: unreachable" {
+		t.Fatal("unexpected detail", resp.Events[0].Detail)
+	}
+}
+
+// TestBlocklistPending verifies the /blocklist/pending endpoint requires an
+// admin key and only lists the skylinks that await the next sweep, along with
+// their age.
+func TestBlocklistPending(t *testing.T) {
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seed a pending skylink that was added an hour ago, one that got
+	// allowlisted since, and skylinks that got blocked, failed or were found
+	// invalid
+	now := database.Now()
+	pending := database.HashBytes([]byte("pending"))
+	allowListed := database.HashBytes([]byte("allowlisted"))
+	skylinks := []database.BlockedSkylink{
+		{Hash: pending, Tags: []string{"malware"}, TimestampAdded: now.Add(-time.Hour)},
+		{Hash: allowListed, Tags: []string{"malware"}, TimestampAdded: now},
+		{Hash: database.HashBytes([]byte("blocked")), TimestampAdded: now, TimestampBlocked: now},
+		{Hash: database.HashBytes([]byte("failed")), TimestampAdded: now, Failed: true},
+		{Hash: database.HashBytes([]byte("invalid")), TimestampAdded: now, Invalid: true},
+	}
+	for i := range skylinks {
+		err = api.staticDB.CreateBlockedSkylink(ctx, &skylinks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = api.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+		Hash:           allowListed,
+		Description:    "false positive",
+		TimestampAdded: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// list is a helper that calls the endpoint with the given key
+	list := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/blocklist/pending", nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key
+	if w := list(""); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := list("scannerkey"); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert only the pending skylinks are listed, oldest first
+	w := list("adminkey")
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	var resp PendingGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.HasMore || len(resp.Entries) != 2 {
+		t.Fatal("unexpected response", resp)
+	}
+	entry := resp.Entries[0]
+	if entry.Hash != pending || !reflect.DeepEqual(entry.Tags, []string{"malware"}) || entry.AllowListed {
+		t.Fatal("unexpected entry", entry)
+	}
+	if entry.Age < time.Hour || entry.Age > time.Hour+time.Minute {
+		t.Fatal("unexpected age", entry.Age)
+	}
+
+	// assert the allowlisted skylink is flagged
+	entry = resp.Entries[1]
+	if entry.Hash != allowListed || !entry.AllowListed || entry.AllowListDescription != "false positive" {
+		t.Fatal("unexpected entry", entry)
+	}
+}
+
+// TestAdminBlockReset verifies the /admin/block/:hash/reset endpoint requires
+// an admin key, resets the state of a skylink that failed to get blocked or
+// that is invalid, records the reset and queues the skylink to be blocked
+// again.
+func TestAdminBlockReset(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// register a hook that records the queued hashes
+	var queued []database.Hash
+	api.RegisterReblockHook(func(hashes []database.Hash) {
+		queued = append(queued, hashes...)
+	})
+
+	// insert a hash that failed to get blocked and one that is invalid, both
+	// were added a day ago
+	added := database.Now().Add(-24 * time.Hour)
+	failed := database.HashBytes([]byte("failed"))
+	invalid := database.HashBytes([]byte("invalid"))
+	for _, hash := range []database.Hash{failed, invalid} {
+		err = api.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: added,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = api.staticDB.MarkFailed(ctx, []database.Hash{failed}, database.FailureClassPermanent, "unexpected response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.staticDB.MarkInvalid(ctx, []database.Hash{invalid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reset is a helper that calls the endpoint with the given key, hash and
+	// body
+	reset := func(key, hash, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/block/"+hash+"/reset", bytes.NewReader([]byte(body)))
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key
+	if w := reset("", failed.String(), ""); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := reset("scannerkey", failed.String(), ""); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert invalid and unknown hashes are rejected
+	if w := reset("adminkey", "invalid", ""); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	unknown := database.HashBytes([]byte("unknown"))
+	if w := reset("adminkey", unknown.String(), ""); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if len(queued) != 0 {
+		t.Fatal("unexpected queued hashes", queued)
+	}
+
+	tests := []struct {
+		name  string
+		hash  database.Hash
+		body  string
+		event string
+		bump  bool
+	}{
+		{"Failed", failed, "", database.EventFailed, false},
+		{"Invalid", invalid, `{"bumpTimestamp":true}`, database.EventInvalid, true},
+	}
+	for i, test := range tests {
+		w := reset("adminkey", test.hash.String(), test.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status code %v, %v", test.name, w.Code, w.Body.String())
+		}
+		var resp BlockedSkylinkGET
+		err = json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// assert the flags got cleared and the reset got recorded
+		if resp.Failed || resp.Invalid || resp.FailureClass != "" || resp.FailureReason != "" {
+			t.Fatalf("%v: unexpected response %v", test.name, resp)
+		}
+		if len(resp.Events) != 2 || resp.Events[0].Type != test.event || resp.Events[1].Type != database.EventReset {
+			t.Fatalf("%v: unexpected events %v", test.name, resp.Events)
+		}
+		if resp.Events[1].Detail != "reset by admin key 'admin'" {
+			t.Fatalf("%v: unexpected detail %v", test.name, resp.Events[1].Detail)
+		}
+
+		// assert the timestamp only got bumped if requested
+		if resp.TimestampAdded.After(added) != test.bump {
+			t.Fatalf("%v: unexpected timestamp %v", test.name, resp.TimestampAdded)
+		}
+
+		// assert the hash got queued to be blocked again
+		if len(queued) != i+1 || queued[i] != test.hash {
+			t.Fatalf("%v: unexpected queued hashes %v", test.name, queued)
+		}
+	}
+}
+
+// TestAdminBlockDelete verifies the /admin/block/:hash endpoint requires an
+// admin key, soft-deletes the skylink, records the deletion and queues the
+// skylink to be removed from skyd's blocklist.
+func TestAdminBlockDelete(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a hash and mark it as blocked by skyd
+	hash := database.HashBytes([]byte("blocked"))
+	err = api.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           hash,
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.staticDB.MarkSucceeded(ctx, []database.Hash{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// del is a helper that calls the endpoint with the given key and hash
+	del := func(key, hash string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/admin/block/"+hash, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key
+	if w := del("", hash.String()); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := del("scannerkey", hash.String()); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert invalid and unknown hashes are rejected
+	if w := del("adminkey", "invalid"); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := del("adminkey", database.HashBytes([]byte("unknown")).String()); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// delete the hash
+	w := del("adminkey", hash.String())
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	var resp BlockedSkylinkGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the deletion got recorded
+	if !resp.Deleted || resp.DeletedAt == nil {
+		t.Fatal("unexpected response", resp)
+	}
+	last := resp.Events[len(resp.Events)-1]
+	if last.Type != database.EventDeleted || last.Detail != "deleted by admin key 'admin'" {
+		t.Fatal("unexpected event", last)
+	}
+
+	// assert the hash is queued to be removed from skyd's blocklist
+	hashes, err := api.staticDB.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != hash {
+		t.Fatal("unexpected hashes", hashes)
+	}
+
+	// assert deleting it again is rejected
+	if w := del("adminkey", hash.String()); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+}
+
+// TestUnblock verifies the /unblock endpoint reverts the given tags and only
+// unblocks the skylink once none of its tags remain.
+func TestUnblock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a skylink that's blocked for two reasons
+	hash := database.HashBytes([]byte("unblock"))
+	err = api.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           hash,
+		Tags:           []string{"copyright", "malware"},
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unblock is a helper that calls the endpoint with the given key and body
+	unblock := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/unblock", bytes.NewReader([]byte(body)))
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	body := func(tags ...string) string {
+		b, err := json.Marshal(UnblockPOST{Hash: hash, Tags: tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// assert the endpoint requires an admin key
+	if w := unblock("", body()); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := unblock("scannerkey", body()); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert unknown hashes and tags are rejected
+	unknown, err := json.Marshal(UnblockPOST{Hash: database.HashBytes([]byte("unknown"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := unblock("adminkey", string(unknown)); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := unblock("adminkey", body("spam")); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := unblock("adminkey", "{}"); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// listed is a helper that returns whether the skylink is on the blocklist
+	// along with the tags it's listed with
+	listed := func() (bool, []string) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blocklist", nil))
+		var blg BlocklistGET
+		err := json.NewDecoder(w.Body).Decode(&blg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range blg.Entries {
+			if entry.Hash == hash {
+				return true, entry.Tags
+			}
+		}
+		return false, nil
+	}
+
+	tests := []struct {
+		name     string
+		tags     []string
+		active   []string
+		reverted []string
+	}{
+		{"Partial", []string{"Copyright"}, []string{"malware"}, []string{"copyright"}},
+		{"RepeatedPartial", []string{"copyright"}, []string{"malware"}, []string{"copyright"}},
+		{"FinalFull", nil, []string{}, []string{"copyright", "malware"}},
+	}
+	for _, test := range tests {
+		w := unblock("adminkey", body(test.tags...))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status code %v, %v", test.name, w.Code, w.Body.String())
+		}
+		var resp BlockedSkylinkGET
+		err = json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Tags, test.active) || !reflect.DeepEqual(resp.RevertedTags, test.reverted) {
+			t.Fatalf("%v: unexpected tags %v, reverted %v", test.name, resp.Tags, resp.RevertedTags)
+		}
+
+		// assert the skylink is only reverted, and dropped from the
+		// blocklist, once none of its tags remain
+		reverted := len(test.active) == 0
+		if resp.Reverted != reverted {
+			t.Fatalf("%v: unexpected reverted %v", test.name, resp.Reverted)
+		}
+		isListed, tags := listed()
+		if isListed == reverted || (isListed && !reflect.DeepEqual(tags, test.active)) {
+			t.Fatalf("%v: unexpected listing %v %v", test.name, isListed, tags)
+		}
+		last := resp.Events[len(resp.Events)-1]
+		if last.Type != database.EventReverted || !strings.HasSuffix(last.Detail, "reverted by admin key 'admin'") {
+			t.Fatalf("%v: unexpected event %v", test.name, last)
+		}
+	}
+}
+
+// TestAdminIdentities verifies identities can be blocked, listed and unblocked
+// through the admin endpoints.
+func TestAdminIdentities(t *testing.T) {
+	t.Parallel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// call is a helper that calls the given endpoint with the given key
+	call := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoints require an admin key
+	mySkyID := strings.Repeat("ab", 32)
+	body := fmt.Sprintf(`{"myskyid":"%s","reason":"republishes abusive content"}`, strings.ToUpper(mySkyID))
+	if w := call(http.MethodPost, "/admin/identities", "scannerkey", body); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert malformed requests are rejected
+	for _, invalid := range []string{`{"myskyid":"abc","reason":"spam"}`, fmt.Sprintf(`{"myskyid":"%s"}`, mySkyID)} {
+		if w := call(http.MethodPost, "/admin/identities", "adminkey", invalid); w.Code != http.StatusBadRequest {
+			t.Fatal("unexpected status code", w.Code, invalid)
+		}
+	}
+
+	// block the identity and assert it's listed
+	if w := call(http.MethodPost, "/admin/identities", "adminkey", body); w.Code != http.StatusNoContent {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	w := call(http.MethodGet, "/admin/identities", "adminkey", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	var resp BlockedIdentitiesGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Identities) != 1 || resp.Identities[0].MySkyID != mySkyID || resp.Identities[0].Reason != "republishes abusive content" {
+		t.Fatal("unexpected identities", resp.Identities)
+	}
+
+	// unblock it, unblocking it again is a not found
+	if w := call(http.MethodDelete, "/admin/identities/"+mySkyID, "adminkey", ""); w.Code != http.StatusNoContent {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodDelete, "/admin/identities/"+mySkyID, "adminkey", ""); w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+}
+
+// TestAdminServers verifies the /admin/servers endpoint lists the latest block
+// timestamp of every blocker, sorted by server UID.
+func TestAdminServers(t *testing.T) {
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// store the latest block timestamps of two blockers
+	eu := database.Now().Add(-time.Hour)
+	us := database.Now().Add(-2 * time.Hour)
+	for uid, ts := range map[string]time.Time{"us-1": us, "eu-1": eu} {
+		err = api.staticDB.UpdateLatestBlockTimestamp(ctx, uid, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// call is a helper that calls the endpoint with the given key
+	call := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/servers", nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key
+	if w := call("scannerkey"); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// assert both blockers are listed
+	w := call("adminkey")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %v, body %v", w.Code, w.Body.String())
+	}
+	var resp ServersGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Servers) != 2 {
+		t.Fatalf("unexpected servers %+v", resp.Servers)
+	}
+	for i, expected := range []struct {
+		uid string
+		ts  time.Time
+	}{{"eu-1", eu}, {"us-1", us}} {
+		server := resp.Servers[i]
+		if server.ServerUID != expected.uid || !server.LatestBlock.Equal(expected.ts) {
+			t.Fatalf("unexpected server %+v, expected %v at %v", server, expected.uid, expected.ts)
+		}
+		if server.LastUpdated.IsZero() || server.LastUpdated.Before(expected.ts) {
+			t.Fatalf("unexpected last update %v", server.LastUpdated)
+		}
+	}
+}
+
+// TestAdminAllowListHits verifies reports of allowlisted skylinks are recorded
+// and listed, most reported first, through the admin endpoint.
+func TestAdminAllowListHits(t *testing.T) {
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// allowlist two hashes
+	var probed, other database.Hash
+	fastrand.Read(probed.Hash[:])
+	fastrand.Read(other.Hash[:])
+	for _, hash := range []database.Hash{probed, other} {
+		err = api.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+			Hash:           hash,
+			Description:    "test hash",
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// report the first hash three times by two users, the other one once, the
+	// reports are answered as if the skylinks got reported
+	reports := []struct {
+		hash database.Hash
+		sub  string
+	}{
+		{probed, "alice"},
+		{probed, "bob"},
+		{probed, "alice"},
+		{other, "alice"},
+	}
+	for _, report := range reports {
+		w := httptest.NewRecorder()
+		api.handleBlockRequest(ctx, w, BlockPOST{Hash: report.hash, Tags: []string{"spam"}}, report.sub, database.SourceAPI)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %v, body %v", w.Code, w.Body.String())
+		}
+		var resp statusResponse
+		err = json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != "reported" {
+			t.Fatal("unexpected status", resp.Status)
+		}
+	}
+
+	// call is a helper that calls the endpoint with the given key and query
+	call := func(key, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/allowlist/hits"+query, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key and validates the limit
+	if w := call("scannerkey", ""); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	if w := call("adminkey", "?limit=0"); w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", w.Code)
+	}
+
+	// the hits are recorded in the background, wait until they're counted
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		w := call("adminkey", "")
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("unexpected status code %v", w.Code)
+		}
+		var resp AllowListHitsGET
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			return err
+		}
+		if len(resp.Hits) != 2 {
+			return fmt.Errorf("unexpected number of hits %v", len(resp.Hits))
+		}
+		first, second := resp.Hits[0], resp.Hits[1]
+		if first.Hash != probed || first.Hits != 3 || first.Reporters != 2 || first.LastHit.IsZero() {
+			return fmt.Errorf("unexpected hit %+v", first)
+		}
+		if second.Hash != other || second.Hits != 1 || second.Reporters != 1 {
+			return fmt.Errorf("unexpected hit %+v", second)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the limit is applied
+	w := call("adminkey", "?limit=1")
+	var resp AllowListHitsGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Hits) != 1 || resp.Hits[0].Hash != probed {
+		t.Fatal("unexpected hits", resp.Hits)
+	}
+
+	// assert the allowlisted hashes didn't get blocked
+	for _, hash := range []database.Hash{probed, other} {
+		doc, err := api.staticDB.FindByHash(ctx, hash)
+		if err != nil || doc != nil {
+			t.Fatal("unexpected", doc, err)
+		}
+	}
+}
+
+// TestAdminReporterStats verifies the /admin/stats/reporters endpoint flags the
+// reporters whose reports of a tag turned out to be bogus.
+func TestAdminReporterStats(t *testing.T) {
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key and custom thresholds
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	cfg.Suspicion = database.SuspicionThresholds{MinReports: 3, BogusRatio: 0.5}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seed phishing reports of two reporters, two out of three of mallory's
+	// reports turned out to be bogus, none of alice's did
+	now := database.Now()
+	seed := []struct {
+		sub      string
+		invalid  bool
+		reverted bool
+	}{
+		{"alice", false, false},
+		{"alice", false, false},
+		{"alice", false, false},
+		{"mallory", true, false},
+		{"mallory", false, true},
+		{"mallory", false, false},
+	}
+	for i, r := range seed {
+		var hash database.Hash
+		fastrand.Read(hash.Hash[:])
+		bsl := &database.BlockedSkylink{
+			Hash:           hash,
+			Reporter:       database.Reporter{Sub: r.sub},
+			Source:         database.SourcePoW,
+			Invalid:        r.invalid,
+			Tags:           []string{"phishing"},
+			TimestampAdded: now.Add(time.Duration(i-len(seed)) * time.Minute),
+		}
+		if r.reverted {
+			bsl.Tags, bsl.RevertedTags = nil, bsl.Tags
+		}
+		err = api.staticDB.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// call is a helper that calls the endpoint with the given key and query
+	call := func(key, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/stats/reporters"+query, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key and validates its parameters
+	if w := call("scannerkey", ""); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	for _, query := range []string{"?window=-1h", "?window=soon", "?source=email"} {
+		if w := call("adminkey", query); w.Code != http.StatusBadRequest {
+			t.Fatal("unexpected status code", w.Code, query)
+		}
+	}
+
+	// assert mallory is flagged and listed first
+	w := call("adminkey", "?window=1d&source=pow")
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code, w.Body.String())
+	}
+	var resp ReporterStatsGET
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Window != (24*time.Hour).String() || resp.Source != database.SourcePoW || len(resp.Reporters) != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	mallory, alice := resp.Reporters[0], resp.Reporters[1]
+	if mallory.Reporter != "mallory" || !mallory.Suspicious || len(mallory.Tags) != 1 {
+		t.Fatalf("unexpected stats %+v", mallory)
+	}
+	tag := mallory.Tags[0]
+	if tag.Tag != "phishing" || tag.Reports != 3 || tag.Invalid != 1 || tag.Reverted != 1 || tag.BogusRatio != 2.0/3 || tag.MedianInterval != time.Minute || !tag.Suspicious {
+		t.Fatalf("unexpected tag stats %+v", tag)
+	}
+	if alice.Reporter != "alice" || alice.Suspicious || len(alice.Tags) != 1 || alice.Tags[0].BogusRatio != 0 {
+		t.Fatalf("unexpected stats %+v", alice)
+	}
+
+	// assert the stats are empty for another source
+	w = call("adminkey", "?source=api")
+	resp = ReporterStatsGET{}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Reporters) != 0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+// TestAdminArchive verifies the /admin/archive endpoint archives the skylinks
+// that got reverted long ago, and that reporting an archived skylink again,
+// on its own or in a batch, restores it from the archive.
+func TestAdminArchive(t *testing.T) {
+	t.Parallel()
+
+	// create a context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a new test API with an admin key
+	cfg := newTestConfig()
+	cfg.APIKeys = []APIKey{
+		{ID: "admin", Key: "adminkey", Admin: true},
+		{ID: "scanner", Key: "scannerkey"},
+	}
+	api, err := newMemoryTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seed two skylinks that got reverted long ago, one that got reverted
+	// recently, one that got reverted long ago but that's still blocked by
+	// skyd and one that's blocked
+	now := database.Now()
+	old := now.Add(-database.DefaultArchiveAge - time.Hour)
+	seed := []struct {
+		reverted time.Time
+		blocked  time.Time
+	}{
+		{old, time.Time{}},
+		{old, time.Time{}},
+		{now.Add(-time.Hour), time.Time{}},
+		{old, old},
+		{time.Time{}, now},
+	}
+	skylinks := make([]skymodules.Skylink, len(seed))
+	hashes := make([]database.Hash, len(seed))
+	for i, s := range seed {
+		var root crypto.Hash
+		fastrand.Read(root[:])
+		skylinks[i], err = skymodules.NewSkylinkV1(root, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = database.NewHash(skylinks[i])
+		bsl := &database.BlockedSkylink{
+			Hash:              hashes[i],
+			Reporter:          database.Reporter{Sub: "alice"},
+			Tags:              []string{"copyright"},
+			TimestampAdded:    old.Add(-time.Hour),
+			TimestampBlocked:  s.blocked,
+			TimestampReverted: s.reverted,
+		}
+		if !s.reverted.IsZero() {
+			bsl.Reverted = true
+			bsl.Tags, bsl.RevertedTags = []string{}, bsl.Tags
+		}
+		err = api.staticDB.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// call is a helper that calls the endpoint with the given key and query
+	call := func(key, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/archive"+query, nil)
+		r.Header.Set(APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// assert the endpoint requires an admin key and validates the age
+	if w := call("scannerkey", ""); w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status code", w.Code)
+	}
+	for _, query := range []string{"?age=-1h", "?age=soon"} {
+		if w := call("adminkey", query); w.Code != http.StatusBadRequest {
+			t.Fatal("unexpected status code", w.Code, query)
+		}
+	}
+
+	// archive the skylinks, archiving them again is a no-op
+	for _, expected := range []int{2, 0} {
+		w := call("adminkey", "")
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status code", w.Code, w.Body.String())
+		}
+		var resp ArchiveResponse
+		err = json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Archived != expected || !resp.Before.Before(now.Add(-database.DefaultArchiveAge+time.Minute)) {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+	}
+	for i, hash := range hashes {
+		doc, err := api.staticDB.FindByHash(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archived := i < 2; archived != (doc == nil) {
+			t.Fatal("unexpected skylink", i, doc)
+		}
+	}
+
+	// assert reporting an archived skylink again resurrects it
+	bp := BlockPOST{Hash: hashes[0], Tags: []string{"malware"}}
+	d, _, err := api.decideBlockRequest(ctx, &bp, "bob", database.SourceAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.outcome != blockOutcomeResurrect || d.existing == nil || !d.existing.Archived {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	w := httptest.NewRecorder()
+	api.handleBlockRequest(ctx, w, bp, "bob", database.SourceAPI)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %v, body %v", w.Code, w.Body.String())
+	}
+	var resp statusResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "reported" {
+		t.Fatal("unexpected status", resp.Status)
+	}
+
+	// assert it was restored from the archive with its history
+	doc, err := api.staticDB.FindByHash(ctx, hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || doc.Archived || doc.Reverted || !reflect.DeepEqual(doc.Tags, []string{"malware"}) || !reflect.DeepEqual(doc.RevertedTags, []string{"copyright"}) {
+		t.Fatalf("unexpected skylink %+v", doc)
+	}
+	if doc.Reporter.Sub != "bob" || len(doc.MergedReporters) != 1 || doc.MergedReporters[0].Sub != "alice" {
+		t.Fatal("unexpected reporters", doc.Reporter, doc.MergedReporters)
+	}
+	if len(doc.Events) == 0 || doc.Events[len(doc.Events)-1].Type != database.EventResurrected {
+		t.Fatal("unexpected events", doc.Events)
+	}
+
+	// assert the other archived skylink is still archived
+	doc, err = api.staticDB.FindByHash(ctx, hashes[1], database.IncludeArchived())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || !doc.Archived {
+		t.Fatalf("unexpected skylink %+v", doc)
+	}
+
+	// report it in a batch along with the blocked skylink, assert it gets
+	// restored too and the blocked skylink gets the new tag
+	batch := []skylink{{link: skylinks[1].String()}, {link: skylinks[4].String()}}
+	w = httptest.NewRecorder()
+	api.handleBatchBlockRequest(ctx, w, BlockPOST{Tags: []string{"malware"}}, batch, "bob", database.SourceAPI)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %v, body %v", w.Code, w.Body.String())
+	}
+	var batchResp batchStatusResponse
+	err = json.NewDecoder(w.Body).Decode(&batchResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batchResp.Statuses) != 2 || batchResp.Statuses[0].Status != "reported" || batchResp.Statuses[1].Status != "duplicate" {
+		t.Fatalf("unexpected statuses %+v", batchResp.Statuses)
+	}
+	doc, err = api.staticDB.FindByHash(ctx, hashes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || doc.Archived || !reflect.DeepEqual(doc.RevertedTags, []string{"copyright"}) || len(doc.MergedReporters) != 1 {
+		t.Fatalf("unexpected skylink %+v", doc)
+	}
+	doc, err = api.staticDB.FindByHash(ctx, hashes[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || !reflect.DeepEqual(doc.Tags, []string{"copyright", "malware"}) {
+		t.Fatalf("unexpected skylink %+v", doc)
+	}
+}
@@ -1,53 +1,722 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/events"
+	"github.com/SkynetLabs/blocker/modules"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/crypto"
 )
 
+const (
+	// accountsFailureThreshold is the number of consecutive failed calls to
+	// the accounts service after which we stop calling it for the duration of
+	// the accounts cooldown.
+	accountsFailureThreshold = 5
+
+	// accountsCooldown is the amount of time we stop calling the accounts
+	// service for once it's considered down, after which we probe it again.
+	accountsCooldown = 30 * time.Second
+
+	// allowListHitTimeout is the amount of time we allow recording a report
+	// of an allowlisted skylink to take, it's recorded in the background.
+	allowListHitTimeout = 10 * time.Second
+
+	// defaultSuspicionMinReports and defaultSuspicionBogusRatio are the
+	// suspicion thresholds of reporters unless others are configured, see
+	// database.SuspicionThresholds.
+	defaultSuspicionMinReports = 10
+	defaultSuspicionBogusRatio = 0.5
+
+	// preflightMaxConcurrent is the maximum number of pre-flight checks that
+	// are in flight at once, reports that come in while the maximum is
+	// reached are not checked.
+	preflightMaxConcurrent = 16
+
+	// hashRateMeasureDuration is the amount of time we spend hashing proofs on
+	// startup to measure the reference hash rate of the server.
+	hashRateMeasureDuration = 100 * time.Millisecond
+
+	// Version is the semantic version of the API, it's advertised on the
+	// /capabilities endpoint. The minor version is bumped when endpoints or
+	// fields are added, the major version when they're changed or removed.
+	Version = "1.0.0"
+)
+
+// Config holds the configuration of the API.
+type Config struct {
+	// AccountsHost and AccountsPort define where the accounts service is
+	// listening.
+	AccountsHost string
+	AccountsPort string
+
+	// MaxProofUses is the maximum number of times a single proof of work can
+	// be used to report skylinks within the proof usage window.
+	MaxProofUses int
+
+	// MaxDailyReports is the maximum number of skylinks a single MySkyID can
+	// report through the /powblock endpoint within the report window.
+	MaxDailyReports int
+
+	// TrustedMySkyIDs is the set of MySkyIDs, hex encoded, that are exempt
+	// from the report limit.
+	TrustedMySkyIDs map[string]struct{}
+
+	// PoWSecret is the secret used to sign the challenges handed out by the
+	// /powblock endpoint. All blocker instances in a cluster should share the
+	// same secret.
+	PoWSecret []byte
+
+	// PoWV1Deadline is the time after which v1 proofs are no longer accepted
+	// by the /powblock endpoint. If it's zero, v1 proofs are always accepted.
+	PoWV1Deadline time.Time
+
+	// Debug enables the pprof and runtime debug endpoints.
+	Debug bool
+
+	// Severities maps tags onto the severity of the reports that carry them,
+	// reports of critical severity trigger the registered critical report
+	// hooks. Reports with tags that aren't mapped are of normal severity.
+	Severities database.SeverityMapping
+
+	// AnonymizeReporters indicates the name, email and other contact of
+	// reporters are replaced with their digest, salted with the reporter
+	// salt, before they're stored.
+	AnonymizeReporters bool
+	ReporterSalt       []byte
+
+	// AggregatorMode indicates the blocker runs without skyd, it only
+	// collects reports and serves the blocklist. Reports that require
+	// resolving a skylink are rejected.
+	AggregatorMode bool
+
+	// TLSCertFile and TLSKeyFile are the paths to the certificate and key
+	// used to serve the API over TLS. If they're empty, the API is served
+	// over plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Limits are the limits enforced by the handlers, limits that are zero
+	// default to the values defined in handlers.go.
+	Limits Limits
+
+	// APIKeys are the API keys of trusted reporters, sent in the
+	// Skynet-Api-Key header. Keys can be restricted to a set of tags.
+	// Requests to the /block endpoint that carry a key are rejected if the
+	// key is unknown, or if it's not allowed to apply one of the report's
+	// tags. Requests without a key are not affected.
+	APIKeys []APIKey
+
+	// AlertWebhook and Push indicate whether critical reports are POSTed to
+	// a webhook and whether new reports are pushed to peer blockers. Both
+	// are handled outside of the API using the report hooks, they're only
+	// advertised on the /capabilities endpoint.
+	AlertWebhook bool
+	Push         bool
+
+	// ShedThreshold is the 95th percentile of the latency of database
+	// operations above which non-critical requests are rejected, reports are
+	// still accepted but with a shorter timeout. ShedAllThreshold is the one
+	// above which all of them are rejected. Load shedding is disabled if
+	// ShedThreshold is zero.
+	ShedThreshold    time.Duration
+	ShedAllThreshold time.Duration
+
+	// AllowListFailOpen indicates reports are accepted when the allow list
+	// can't be checked, e.g. because the database is unavailable. By default
+	// they are rejected, which prevents blocking allowlisted content.
+	AllowListFailOpen bool
+
+	// CallbackDomains are the domains reporters can be notified on once the
+	// hash they reported is blocked or found to be invalid. Callback URLs
+	// must point to one of these domains, or one of their subdomains. If
+	// it's empty, reports with a callback URL are rejected.
+	CallbackDomains []string
+
+	// Role is the role of the API, being one of RoleBoth, RoleRead and
+	// RoleWrite, it defaults to RoleBoth. It determines which routes are
+	// served, see buildHTTPRoutes.
+	Role string
+
+	// DisableListing indicates the listing routes, e.g. the blocklist, are
+	// not served. It's only allowed for the write role.
+	DisableListing bool
+
+	// ListingCacheControl is the Cache-Control header of the successful
+	// responses of the listing routes, it defaults to
+	// DefaultListingCacheControl. CDN-fronted deployments can set it to e.g.
+	// 'public, max-age=60'.
+	ListingCacheControl string
+
+	// PreflightCheck indicates new reports of skylinks are checked against
+	// skyd before they're stored, reports of content skyd can't find are
+	// flagged as missing and get blocked after the other reports. Reports of
+	// hashes can't be checked. It's not supported in aggregator mode.
+	PreflightCheck bool
+
+	// Suspicion are the thresholds above which reporters are flagged as
+	// suspicious on the /admin/stats/reporters endpoint, thresholds that are
+	// zero default to defaultSuspicionMinReports and
+	// defaultSuspicionBogusRatio.
+	Suspicion database.SuspicionThresholds
+
+	// ArchiveAge is the age, measured from the time they got reverted, after
+	// which reverted skylinks are moved to the archive by the /admin/archive
+	// endpoint, it defaults to database.DefaultArchiveAge.
+	ArchiveAge time.Duration
+
+	// PublicResponseHash indicates the responses to PoW reports include the
+	// hash of the reported skylink. By default they only include its status,
+	// see responseFieldVisibility.
+	PublicResponseHash bool
+}
+
+// APIKey is the API key of a trusted reporter, e.g. the malware scanner.
+type APIKey struct {
+	// ID identifies the key, it's recorded on the origin of the skylinks
+	// reported with the key.
+	ID string `json:"id"`
+
+	// Key is the secret that's sent in the Skynet-Api-Key header, or that
+	// signs the request, see verifySignature.
+	Key string `json:"key"`
+
+	// Tags are the tags the key is allowed to apply, compared by their
+	// normalized form. A key without tags is not restricted.
+	Tags []string `json:"tags,omitempty"`
+
+	// Admin indicates the key grants access to the admin endpoints.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Limits are the limits enforced by the API's handlers.
+type Limits struct {
+	// MaxBodySize is the maximum size of the body of a block request.
+	MaxBodySize int64 `json:"maxBodySize"`
+
+	// MaxBatchSize is the maximum number of skylinks that can be reported in
+	// a single request to the PoW block endpoint.
+	MaxBatchSize int `json:"maxBatchSize"`
+
+	// MaxPageSize is the maximum number of entries returned by a single
+	// request to the blocklist endpoint.
+	MaxPageSize int `json:"maxPageSize"`
+
+	// MaxHashPrefixMatches is the maximum number of entries returned by the
+	// blocklist endpoint when it's queried by hash prefix.
+	MaxHashPrefixMatches int `json:"maxHashPrefixMatches"`
+}
+
+// allowLister checks whether hashes and publishers are on the allow list, it's
+// implemented by the database.
+type allowLister interface {
+	IsAllowListed(ctx context.Context, hash crypto.Hash) (bool, error)
+	IsPublisherAllowListed(ctx context.Context, publicKey string) (bool, error)
+}
+
+// queryObserver is implemented by stores that report the latency of their
+// queries, the load shedder admits requests based on it.
+type queryObserver interface {
+	SetQueryObserver(observer func(time.Duration))
+}
+
 // API is our central entry point to all subsystems relevant to serving
 // requests.
 type API struct {
-	staticDB         *database.DB
-	staticLogger     *logrus.Logger
+	staticConfig     Config
+	staticDB         database.Store
+	staticHashRate   float64
+	staticLogger     *logrus.Entry
 	staticRouter     *httprouter.Router
 	staticSkydClient *SkydClient
+
+	// staticAccountsBreaker guards the calls to the accounts service, it
+	// prevents every report from waiting on the accounts service while it's
+	// down.
+	staticAccountsBreaker *modules.CircuitBreaker
+
+	// staticAllowList is used to check reports against the allow list, it's
+	// the database unless a test replaces it.
+	staticAllowList allowLister
+
+	// staticPreflight bounds the number of pre-flight checks that are in
+	// flight, see contentMissing.
+	staticPreflight chan struct{}
+
+	// staticShedder decides which requests to admit based on the latency of
+	// the database, it's nil if load shedding is disabled.
+	staticShedder *modules.LoadShedder
+
+	// staticRoutes are the routes registered on the router, they're listed
+	// on the /capabilities endpoint.
+	staticRoutes []Route
+
+	// staticAPIKeys are the configured API keys, by key.
+	staticAPIKeys map[string]APIKey
+
+	// staticAPIKeysByID are the configured API keys, by id. Signed requests
+	// identify their key by id, see verifySignature.
+	staticAPIKeysByID map[string]APIKey
+
+	// listener and server are created by ListenAndServeAddr, they are kept
+	// around so the server can be shut down gracefully.
+	listener net.Listener
+	server   *http.Server
+	shutdown bool
+
+	// statusFns are the functions that return the status snapshots of other
+	// components, which are exposed on the debug endpoint.
+	statusFns map[string]func() interface{}
+
+	// healthFns are the functions that return the health details of other
+	// components, which are exposed on the /health endpoint.
+	healthFns map[string]func() interface{}
+
+	// healthChecks are the health checks that are run on the /health
+	// endpoint, in the order they were registered.
+	healthChecks []healthCheck
+
+	// gauges are the metrics exposed on the /metrics endpoint, by name.
+	gauges map[string]gauge
+
+	// reports counts the reported hashes and skylinks by the form they were
+	// reported in, it's exposed on the /metrics endpoint.
+	reports map[string]uint64
+
+	// criticalFns are the functions that get called for every report of
+	// critical severity.
+	criticalFns []func(database.BlockedSkylink)
+
+	// reportFns are the functions that get called for every newly reported
+	// skylink.
+	reportFns []func(database.BlockedSkylink)
+
+	// bus is the event bus new reports and reverts are published on, it's
+	// nil if no bus was registered.
+	bus *events.Bus
+
+	// reblockFn is the function that queues hashes to be blocked again, it's
+	// not set in aggregator mode.
+	reblockFn func([]database.Hash)
+
+	// auditFn is the function that returns the state of the auditor, it's
+	// only set if audits are enabled.
+	auditFn func() interface{}
+
+	staticMu sync.Mutex
 }
 
-// New creates a new API instance.
-func New(skydClient *SkydClient, db *database.DB, logger *logrus.Logger) (*API, error) {
+// New creates a new API instance. The skyd client is only required if the API
+// is not running in aggregator mode.
+func New(cfg Config, skydClient *SkydClient, db database.Store, logger *logrus.Entry) (*API, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, errors.AddContext(err, "invalid config")
+	}
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
 	if logger == nil {
 		return nil, errors.New("no logger provided")
 	}
-	if skydClient == nil {
+	if skydClient == nil && !cfg.AggregatorMode {
 		return nil, errors.New("no skyd client provided")
 	}
+	if cfg.AggregatorMode {
+		skydClient = nil
+	}
+	accountsBreaker, err := modules.NewCircuitBreaker(accountsFailureThreshold, accountsCooldown)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create accounts circuit breaker")
+	}
+	var shedder *modules.LoadShedder
+	if cfg.ShedThreshold > 0 {
+		shedder, err = modules.NewLoadShedder(cfg.ShedThreshold, cfg.ShedAllThreshold, shedWindow, shedMaxSamples)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to create load shedder")
+		}
+		if observed, ok := db.(queryObserver); ok {
+			observed.SetQueryObserver(shedder.Observe)
+		}
+	}
 	router := httprouter.New()
 	router.RedirectTrailingSlash = true
 
 	api := &API{
+		staticConfig:     cfg,
 		staticDB:         db,
+		staticHashRate:   modules.MeasureHashRate(hashRateMeasureDuration),
 		staticLogger:     logger,
 		staticRouter:     router,
 		staticSkydClient: skydClient,
+
+		staticAccountsBreaker: accountsBreaker,
+		staticAllowList:       db,
+		staticPreflight:       make(chan struct{}, preflightMaxConcurrent),
+		staticShedder:         shedder,
+
+		statusFns: make(map[string]func() interface{}),
+	}
+	api.staticAPIKeys = make(map[string]APIKey, len(cfg.APIKeys))
+	api.staticAPIKeysByID = make(map[string]APIKey, len(cfg.APIKeys))
+	for _, key := range cfg.APIKeys {
+		api.staticAPIKeys[key.Key] = key
+		api.staticAPIKeysByID[key.ID] = key
 	}
 
+	api.registerDefaultHealthChecks()
 	api.buildHTTPRoutes()
 	return api, nil
 }
 
-// ListenAndServe starts the API server on the given port.
-func (api *API) ListenAndServe(port int) error {
-	api.staticLogger.Info(fmt.Sprintf("Listening on port %d", port))
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), api.staticRouter)
+// accountsURL returns the url on which the accounts service is reachable.
+func (cfg Config) accountsURL() string {
+	return fmt.Sprintf("http://%s:%s", cfg.AccountsHost, cfg.AccountsPort)
+}
+
+// validate returns an error if the config is invalid.
+func (cfg Config) validate() error {
+	if cfg.MaxProofUses <= 0 {
+		return errors.New("max proof uses should be positive")
+	}
+	if cfg.MaxDailyReports <= 0 {
+		return errors.New("max daily reports should be positive")
+	}
+	if len(cfg.PoWSecret) == 0 {
+		return errors.New("no PoW secret provided")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS requires both a certificate and a key")
+	}
+	if cfg.AnonymizeReporters && len(cfg.ReporterSalt) == 0 {
+		return errors.New("anonymizing reporters requires a reporter salt")
+	}
+	if cfg.Suspicion.MinReports < 0 || cfg.Suspicion.BogusRatio < 0 || cfg.Suspicion.BogusRatio > 1 {
+		return errors.New("suspicion thresholds can't be negative and the bogus ratio can't exceed 1")
+	}
+	if cfg.ArchiveAge < 0 {
+		return errors.New("archive age can't be negative")
+	}
+	if cfg.PreflightCheck && cfg.AggregatorMode {
+		return errors.New("pre-flight checks require skyd, they're not supported in aggregator mode")
+	}
+	ids := make(map[string]struct{}, len(cfg.APIKeys))
+	keys := make(map[string]struct{}, len(cfg.APIKeys))
+	for _, key := range cfg.APIKeys {
+		if key.ID == "" || key.Key == "" {
+			return errors.New("API keys require an id and a key")
+		}
+		if _, exists := ids[key.ID]; exists {
+			return fmt.Errorf("API key id '%v' is a duplicate", key.ID)
+		}
+		if _, exists := keys[key.Key]; exists {
+			return fmt.Errorf("API key '%v' is a duplicate of another key", key.ID)
+		}
+		ids[key.ID] = struct{}{}
+		keys[key.Key] = struct{}{}
+	}
+	for _, domain := range cfg.CallbackDomains {
+		if domain == "" || domain != strings.ToLower(domain) || strings.ContainsAny(domain, "/:") {
+			return fmt.Errorf("callback domain '%v' is invalid, it should be a lowercase hostname", domain)
+		}
+	}
+	switch cfg.Role {
+	case "", RoleBoth, RoleRead, RoleWrite:
+	default:
+		return fmt.Errorf("unknown role '%v'", cfg.Role)
+	}
+	if cfg.DisableListing && cfg.role() != RoleWrite {
+		return errors.New("listing routes can only be disabled for the write role")
+	}
+	if strings.ContainsAny(cfg.ListingCacheControl, "\r\n") {
+		return errors.New("listing cache control can't contain line breaks")
+	}
+	l := cfg.Limits
+	if l.MaxBodySize < 0 || l.MaxBatchSize < 0 || l.MaxPageSize < 0 || l.MaxHashPrefixMatches < 0 {
+		return errors.New("limits can't be negative")
+	}
+	return nil
+}
+
+// role returns the role of the API, it defaults to RoleBoth.
+func (cfg Config) role() string {
+	if cfg.Role == "" {
+		return RoleBoth
+	}
+	return cfg.Role
+}
+
+// limits returns the limits enforced by the handlers, limits that aren't
+// configured are set to their default.
+func (cfg Config) limits() Limits {
+	l := cfg.Limits
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = maxBodySize
+	}
+	if l.MaxBatchSize == 0 {
+		l.MaxBatchSize = maxBatchSize
+	}
+	if l.MaxPageSize == 0 {
+		l.MaxPageSize = maxLimit
+	}
+	if l.MaxHashPrefixMatches == 0 {
+		l.MaxHashPrefixMatches = maxHashPrefixMatches
+	}
+	return l
+}
+
+// suspicion returns the suspicion thresholds of reporters, thresholds that
+// are zero are set to their default.
+func (cfg Config) suspicion() database.SuspicionThresholds {
+	t := cfg.Suspicion
+	if t.MinReports == 0 {
+		t.MinReports = defaultSuspicionMinReports
+	}
+	if t.BogusRatio == 0 {
+		t.BogusRatio = defaultSuspicionBogusRatio
+	}
+	return t
+}
+
+// archiveAge returns the age after which reverted skylinks are archived, it
+// defaults to database.DefaultArchiveAge.
+func (cfg Config) archiveAge() time.Duration {
+	if cfg.ArchiveAge == 0 {
+		return database.DefaultArchiveAge
+	}
+	return cfg.ArchiveAge
+}
+
+// reporterSalt returns the salt reporters are anonymized with, it returns nil
+// if reporters are not anonymized.
+func (cfg Config) reporterSalt() []byte {
+	if !cfg.AnonymizeReporters {
+		return nil
+	}
+	return cfg.ReporterSalt
+}
+
+// ListenAndServeAddr starts the API server on the given address, e.g.
+// "127.0.0.1:4000". The API is served over TLS if a certificate and key are
+// configured. It blocks until the server fails or until it is shut down, in
+// which case it returns nil.
+func (api *API) ListenAndServeAddr(addr string) error {
+	api.staticMu.Lock()
+	if api.shutdown {
+		api.staticMu.Unlock()
+		return nil
+	}
+	if api.server != nil {
+		api.staticMu.Unlock()
+		return errors.New("server already started")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		api.staticMu.Unlock()
+		return errors.AddContext(err, "failed to listen")
+	}
+	api.listener = l
+	api.server = &http.Server{Handler: api.staticRouter}
+	server := api.server
+	api.staticMu.Unlock()
+
+	certFile, keyFile := api.staticConfig.TLSCertFile, api.staticConfig.TLSKeyFile
+	if certFile != "" && keyFile != "" {
+		api.staticLogger.WithField("addr", l.Addr().String()).Info("Listening (TLS)")
+		err = server.ServeTLS(l, certFile, keyFile)
+	} else {
+		api.staticLogger.WithField("addr", l.Addr().String()).Info("Listening")
+		err = server.Serve(l)
+	}
+	if errors.Contains(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// RegisterStatus registers a function that returns a status snapshot of a
+// component under the given name, it is exposed on the debug endpoint.
+func (api *API) RegisterStatus(name string, statusFn func() interface{}) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	if api.statusFns == nil {
+		api.statusFns = make(map[string]func() interface{})
+	}
+	api.statusFns[name] = statusFn
+}
+
+// RegisterHealthDetail registers a function that returns a health detail of a
+// component under the given name, it is exposed on the /health endpoint. The
+// function is called for every health check, so it shouldn't block.
+func (api *API) RegisterHealthDetail(name string, detailFn func() interface{}) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	if api.healthFns == nil {
+		api.healthFns = make(map[string]func() interface{})
+	}
+	api.healthFns[name] = detailFn
+}
+
+// RegisterHealthCheck registers a health check of a dependency under the given
+// name, it is run on the /health endpoint. If the check returns an error the
+// blocker is considered to be at least of the given status, either
+// HealthStatusDegraded or HealthStatusDown. A check that's registered under
+// an existing name replaces it.
+func (api *API) RegisterHealthCheck(name, severity string, checkFn func(context.Context) error) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	check := healthCheck{
+		staticName:     name,
+		staticSeverity: severity,
+		staticCheckFn:  checkFn,
+	}
+	for i := range api.healthChecks {
+		if api.healthChecks[i].staticName == name {
+			api.healthChecks[i] = check
+			return
+		}
+	}
+	api.healthChecks = append(api.healthChecks, check)
+}
+
+// RegisterCriticalReportHook registers a function that gets called for every
+// newly reported skylink of critical severity, e.g. to block it immediately or
+// to fire an alert. The function is called while handling the request, so it
+// shouldn't block.
+func (api *API) RegisterCriticalReportHook(fn func(database.BlockedSkylink)) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	api.criticalFns = append(api.criticalFns, fn)
+}
+
+// RegisterReportHook registers a function that gets called for every newly
+// reported skylink, regardless of its severity, e.g. to push it to other
+// blockers. Reports of skylinks that were reported before are not passed. The
+// function is called while handling the request, so it shouldn't block.
+func (api *API) RegisterReportHook(fn func(database.BlockedSkylink)) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	api.reportFns = append(api.reportFns, fn)
+}
+
+// RegisterEventBus registers the event bus the API publishes new reports and
+// reverted skylinks on, which lets other components react to them without
+// being called while handling the request.
+func (api *API) RegisterEventBus(bus *events.Bus) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	api.bus = bus
+}
+
+// RegisterReblockHook registers the function that queues hashes to be sent to
+// skyd again through the /admin/reblock endpoint. The function is called while
+// handling the request, so it shouldn't block.
+func (api *API) RegisterReblockHook(fn func([]database.Hash)) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	api.reblockFn = fn
+}
+
+// RegisterAuditHook registers the function that returns the state of the
+// auditor, including the report of its last audit, which is exposed on the
+// /admin/audit endpoint.
+func (api *API) RegisterAuditHook(fn func() interface{}) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	api.auditFn = fn
+}
+
+// managedNotifyCritical calls the registered critical report hooks with the
+// given report.
+func (api *API) managedNotifyCritical(bs database.BlockedSkylink) {
+	api.staticMu.Lock()
+	fns := append([]func(database.BlockedSkylink){}, api.criticalFns...)
+	api.staticMu.Unlock()
+	for _, fn := range fns {
+		fn(bs)
+	}
+}
+
+// managedNotifyReport calls the registered report hooks with the given report
+// and publishes it on the event bus.
+func (api *API) managedNotifyReport(bs database.BlockedSkylink) {
+	api.staticMu.Lock()
+	fns := append([]func(database.BlockedSkylink){}, api.reportFns...)
+	api.staticMu.Unlock()
+	for _, fn := range fns {
+		fn(bs)
+	}
+	api.managedPublish(events.Event{
+		Type:     events.BlockCreated,
+		Hashes:   []database.Hash{bs.Hash},
+		Skylinks: []database.BlockedSkylink{bs},
+	})
+}
+
+// managedPublish publishes the given event on the registered event bus.
+func (api *API) managedPublish(e events.Event) {
+	api.staticMu.Lock()
+	bus := api.bus
+	api.staticMu.Unlock()
+	e.Publisher = events.PublisherAPI
+	bus.Publish(e)
+}
+
+// managedStatuses returns the status snapshots of all registered components.
+func (api *API) managedStatuses() map[string]interface{} {
+	api.staticMu.Lock()
+	statusFns := make(map[string]func() interface{}, len(api.statusFns))
+	for name, fn := range api.statusFns {
+		statusFns[name] = fn
+	}
+	api.staticMu.Unlock()
+
+	statuses := make(map[string]interface{}, len(statusFns))
+	for name, fn := range statusFns {
+		statuses[name] = fn()
+	}
+	return statuses
+}
+
+// managedHealthDetails returns the health details of all registered
+// components.
+func (api *API) managedHealthDetails() map[string]interface{} {
+	api.staticMu.Lock()
+	healthFns := make(map[string]func() interface{}, len(api.healthFns))
+	for name, fn := range api.healthFns {
+		healthFns[name] = fn
+	}
+	api.staticMu.Unlock()
+
+	details := make(map[string]interface{}, len(healthFns))
+	for name, fn := range healthFns {
+		details[name] = fn()
+	}
+	return details
+}
+
+// Shutdown gracefully shuts down the API server, it waits for in-flight
+// requests to finish until the given context expires. Calling Shutdown on a
+// server that was never started prevents it from being started afterwards.
+func (api *API) Shutdown(ctx context.Context) error {
+	api.staticMu.Lock()
+	api.shutdown = true
+	server := api.server
+	api.staticMu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
 
 // ServeHTTP implements the http.Handler interface.
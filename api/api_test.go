@@ -2,92 +2,374 @@ package api
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	url "net/url"
+	"path/filepath"
+	"testing"
+	"time"
 
+	"github.com/SkynetLabs/blocker/client"
 	"github.com/SkynetLabs/blocker/database"
-	"github.com/sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 )
 
-// apiTester is a helper struct wrapping handlers of the underlying API that
-// record a certain request and parse the API response.
+// apiTester is a helper struct that serves the underlying API on a test server
+// and calls it through the blocker's client.
 type apiTester struct {
-	staticAPI *API
+	staticClient *client.Client
 }
 
-// newAPITester returns a new instance of apiTester
-func newAPITester(api *API) *apiTester {
-	return &apiTester{staticAPI: api}
+// newAPITester returns a new instance of apiTester, the test server is closed
+// when the test finishes.
+func newAPITester(t *testing.T, api *API) *apiTester {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	c, err := client.New(server.URL, client.WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiTester{staticClient: c}
+}
+
+// newTestConfig returns an API config for testing
+func newTestConfig() Config {
+	return Config{
+		AccountsHost:    "localhost",
+		AccountsPort:    "3000",
+		MaxProofUses:    50,
+		MaxDailyReports: 100,
+		TrustedMySkyIDs: make(map[string]struct{}),
+		PoWSecret:       fastrand.Bytes(32),
+	}
 }
 
 // newTestAPI returns a new API instance
-func newTestAPI(dbName string, client *SkydClient) (*API, error) {
+func newTestAPI(t *testing.T, client *SkydClient) (*API, error) {
+	return newCustomTestAPI(t, newTestConfig(), client)
+}
+
+// newCustomTestAPI returns a new API instance using the given config
+func newCustomTestAPI(t *testing.T, cfg Config, client *SkydClient) (*API, error) {
 	// create database
-	db := database.NewTestDB(context.Background(), dbName)
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
 
 	// create a nil logger
-	logger := logrus.New()
-	logger.Out = ioutil.Discard
+	logger, _ := logtest.NewNullLogger()
 
 	// create the API
-	api, err := New(client, db, logger)
+	api, err := New(cfg, client, db, logger.WithField("module", "api"))
 	if err != nil {
 		return nil, err
 	}
 	return api, nil
 }
 
-// blocklistGET records an api call to GET /blocklist on the underlying API
-// using the given parameters and returns a parsed response.
+// newMemoryTestAPI returns a new API instance using the given config that is
+// backed by an in-memory store, it doesn't depend on MongoDB.
+func newMemoryTestAPI(t *testing.T, cfg Config, client *SkydClient) (*API, error) {
+	// create the store
+	store, err := database.NewMemoryStore(database.DefaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a nil logger
+	logger, _ := logtest.NewNullLogger()
+
+	// create the API
+	return New(cfg, client, store, logger.WithField("module", "api"))
+}
+
+// blocklistGET calls GET /blocklist on the underlying API using the given
+// parameters and returns the parsed response.
 func (at *apiTester) blocklistGET(sort *string, offset, limit *int) (BlocklistGET, error) {
-	// set url values
-	values := url.Values{}
+	var opts client.BlocklistOptions
+	if sort != nil {
+		opts.Sort = *sort
+	}
 	if offset != nil {
-		values.Set("offset", fmt.Sprint(*offset))
+		opts.Offset = *offset
 	}
 	if limit != nil {
-		values.Set("limit", fmt.Sprint(*limit))
-	}
-	if sort != nil {
-		values.Set("sort", *sort)
+		opts.Limit = *limit
 	}
+	return at.blocklistPage(opts)
+}
+
+// blocklistPrefixGET calls the blocklist endpoint with the given hash prefix.
+func (at *apiTester) blocklistPrefixGET(prefix string) (BlocklistGET, error) {
+	return at.blocklistPage(client.BlocklistOptions{HashPrefix: prefix})
+}
 
-	// execute the request
-	var blg BlocklistGET
-	err := at.get("/blocklist", values, &blg)
+// blocklistPage fetches a page of the blocklist and converts it into the API's
+// response type.
+func (at *apiTester) blocklistPage(opts client.BlocklistOptions) (BlocklistGET, error) {
+	page, err := at.staticClient.BlocklistPage(context.Background(), opts)
 	if err != nil {
 		return BlocklistGET{}, err
 	}
+
+	// convert the page
+	blg := BlocklistGET{
+		Entries: make([]BlockedHash, len(page.Entries)),
+		HasMore: page.HasMore,
+	}
+	for i, entry := range page.Entries {
+		blg.Entries[i] = BlockedHash{Hash: database.Hash{Hash: entry.Hash}, Tags: entry.Tags}
+	}
 	return blg, nil
 }
 
-// get is a helper function that executes a GET request on the given endpoint
-// with the provided query values. The response will get unmarshaled into the
-// given response object.
-func (at *apiTester) get(endpoint string, query url.Values, obj interface{}) error {
-	// create the request
-	url := fmt.Sprintf("%s?%s", endpoint, query.Encode())
-	req := httptest.NewRequest(http.MethodGet, url, nil)
+// TestShutdown verifies the API server can be shut down gracefully.
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	// create a bare API, we don't need a database to serve and shut down
+	logger, hook := logtest.NewNullLogger()
+	api := &API{
+		staticLogger: logger.WithField("module", "api"),
+		staticRouter: httprouter.New(),
+	}
+
+	// start the server on a random port
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- api.ListenAndServeAddr("127.0.0.1:0")
+	}()
+
+	// wait until the server is listening
+	addr, err := waitForListener(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shut it down and assert ListenAndServe returns without error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = api.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ListenAndServe did not return after shutdown")
+	}
+
+	// assert the listener got logged with the module and address
+	entry := hook.LastEntry()
+	if entry == nil || entry.Message != "Listening" {
+		t.Fatal("expected the listener to be logged", entry)
+	}
+	if entry.Data["module"] != "api" || entry.Data["addr"] != addr.String() {
+		t.Fatal("unexpected log fields", entry.Data)
+	}
+
+	// assert the server can't be started after it was shut down
+	err = api.ListenAndServeAddr("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestListenAndServeAddr verifies the API can be served on a configured
+// address, both over plain HTTP and over TLS.
+func TestListenAndServeAddr(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Plain",
+			test: testListenAndServeAddrPlain,
+		},
+		{
+			name: "TLS",
+			test: testListenAndServeAddrTLS,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.test)
+	}
+}
+
+// testListenAndServeAddrPlain verifies the health route can be reached over
+// plain HTTP.
+func testListenAndServeAddrPlain(t *testing.T) {
+	api, err := newTestAPI(t, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, api)
+	assertHealthy(t, http.DefaultClient, fmt.Sprintf("http://%s/health", addr))
+}
+
+// testListenAndServeAddrTLS verifies the health route can be reached over TLS
+// when a certificate and key are configured.
+func testListenAndServeAddrTLS(t *testing.T) {
+	certFile, keyFile, pool := newTestCertificate(t)
+	cfg := newTestConfig()
+	cfg.TLSCertFile = certFile
+	cfg.TLSKeyFile = keyFile
+	api, err := newCustomTestAPI(t, cfg, NewSkydClient("http://localhost:9980", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, api)
+
+	// assert plain HTTP is not served
+	res, err := http.Get(fmt.Sprintf("http://%s/health", addr))
+	if err == nil {
+		drainAndClose(res.Body)
+		if res.StatusCode == http.StatusOK {
+			t.Fatal("expected plain HTTP request to fail")
+		}
+	}
+
+	// assert the health route is reachable over TLS
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	assertHealthy(t, client, fmt.Sprintf("https://%s/health", addr))
+}
 
-	// create a recorder and execute the request
-	w := httptest.NewRecorder()
-	at.staticAPI.blocklistGET(w, req, nil)
-	res := w.Result()
+// startTestServer starts the given API on a random local port and returns the
+// address it listens on, the server is shut down when the test finishes.
+func startTestServer(t *testing.T, api *API) net.Addr {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- api.ListenAndServeAddr("127.0.0.1:0")
+	}()
+	addr, err := waitForListener(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := api.Shutdown(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	})
+	return addr
+}
+
+// assertHealthy asserts the health route at the given url responds with a
+// healthy status.
+func assertHealthy(t *testing.T, client *http.Client, url string) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer drainAndClose(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status code", res.StatusCode)
+	}
+	var status struct {
+		DBAlive        bool     `json:"dbAlive"`
+		SchemaHealthy  bool     `json:"schemaHealthy"`
+		MissingIndexes []string `json:"missingIndexes"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.DBAlive {
+		t.Fatal("expected db to be alive")
+	}
+	if !status.SchemaHealthy || len(status.MissingIndexes) != 0 {
+		t.Fatal("expected db schema to be healthy", status.MissingIndexes)
+	}
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 in a
+// temporary directory. It returns the paths to the certificate and key, and a
+// cert pool that trusts the certificate.
+func newTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
 
-	// return an error if the status code is not in the 200s
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("GET request to '%s' with status %d error %v", endpoint, res.StatusCode, readAPIError(res.Body))
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// handle the response body
-	err := json.NewDecoder(res.Body).Decode(obj)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = ioutil.WriteFile(certFile, certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("failed to add certificate to pool")
+	}
+	return certFile, keyFile, pool
+}
+
+// waitForListener waits until the given API is listening and returns the
+// address it listens on.
+func waitForListener(api *API) (net.Addr, error) {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		api.staticMu.Lock()
+		l := api.listener
+		api.staticMu.Unlock()
+		if l != nil {
+			return l.Addr(), nil
+		}
 	}
-	return nil
+	return nil, errors.New("server was not started")
 }
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+const (
+	// FeatureAggregatorMode indicates the blocker runs without skyd, reports
+	// of v2 skylinks are rejected.
+	FeatureAggregatorMode = "aggregatorMode"
+
+	// FeatureAlertWebhook indicates critical reports are POSTed to a webhook.
+	FeatureAlertWebhook = "alertWebhook"
+
+	// FeatureAnonymizeReporters indicates reporters are anonymized before
+	// they're stored.
+	FeatureAnonymizeReporters = "anonymizeReporters"
+
+	// FeatureBatchPoW indicates the PoW block endpoint accepts a batch of
+	// skylinks.
+	FeatureBatchPoW = "batchPoW"
+
+	// FeatureCallbacks indicates reports can carry a callback URL that's
+	// notified once the reported hash is blocked or found to be invalid.
+	FeatureCallbacks = "callbacks"
+
+	// FeatureHashPrefix indicates the blocklist can be queried by hash
+	// prefix.
+	FeatureHashPrefix = "hashPrefix"
+
+	// FeaturePoWV1 indicates v1 proofs, which don't contain a challenge, are
+	// still accepted.
+	FeaturePoWV1 = "powV1"
+
+	// FeaturePoWV2 indicates v2 proofs, which contain a challenge, are
+	// accepted.
+	FeaturePoWV2 = "powV2"
+
+	// FeaturePush indicates new reports are pushed to peer blockers.
+	FeaturePush = "push"
+
+	// FeatureRequestSigning indicates reports can be signed with an API key
+	// rather than carrying it.
+	FeatureRequestSigning = "requestSigning"
+)
+
+type (
+	// CapabilitiesGET is the response of the /capabilities endpoint, it
+	// allows callers to detect which features a blocker supports without
+	// probing its routes. Features that aren't listed are not supported.
+	CapabilitiesGET struct {
+		Version  string          `json:"version"`
+		Role     string          `json:"role"`
+		Routes   []Route         `json:"routes"`
+		Features map[string]bool `json:"features"`
+		Limits   Limits          `json:"limits"`
+		PoW      PoWCapabilities `json:"pow"`
+	}
+
+	// PoWCapabilities describes the proofs of work accepted by the PoW block
+	// endpoint.
+	PoWCapabilities struct {
+		Target          string   `json:"target"`
+		Versions        []string `json:"versions"`
+		MaxProofUses    int      `json:"maxProofUses"`
+		MaxDailyReports int      `json:"maxDailyReports"`
+	}
+
+	// Route is a route served by the API.
+	Route struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+)
+
+// capabilitiesGET returns the version of the API, the routes it serves, the
+// features that are enabled and the limits that are enforced. The limits are
+// read from the same config the handlers enforce them from.
+func (api *API) capabilitiesGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	cfg := api.staticConfig
+	acceptV1 := api.acceptV1Proofs()
+	skyapi.WriteJSON(w, CapabilitiesGET{
+		Version: Version,
+		Role:    cfg.role(),
+		Routes:  append([]Route{}, api.staticRoutes...),
+		Features: map[string]bool{
+			FeatureAggregatorMode:     cfg.AggregatorMode,
+			FeatureAlertWebhook:       cfg.AlertWebhook,
+			FeatureAnonymizeReporters: cfg.AnonymizeReporters,
+			FeatureBatchPoW:           true,
+			FeatureCallbacks:          len(cfg.CallbackDomains) > 0,
+			FeatureHashPrefix:         true,
+			FeaturePoWV1:              acceptV1,
+			FeaturePoWV2:              true,
+			FeaturePush:               cfg.Push,
+			FeatureRequestSigning:     true,
+		},
+		Limits: cfg.limits(),
+		PoW: PoWCapabilities{
+			Target:          hex.EncodeToString(modules.MySkyTarget[:]),
+			Versions:        modules.ProofVersions(acceptV1),
+			MaxProofUses:    cfg.MaxProofUses,
+			MaxDailyReports: cfg.MaxDailyReports,
+		},
+	})
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestCapabilitiesGET verifies the /capabilities endpoint reflects the config
+// of the API.
+func TestCapabilitiesGET(t *testing.T) {
+	t.Parallel()
+
+	// newCapabilitiesAPI returns a bare API with its routes registered
+	newCapabilitiesAPI := func(cfg Config) *API {
+		logger, _ := logtest.NewNullLogger()
+		api := &API{
+			staticConfig: cfg,
+			staticLogger: logger.WithField("module", "api"),
+			staticRouter: httprouter.New(),
+		}
+		api.buildHTTPRoutes()
+		return api
+	}
+	get := func(api *API) CapabilitiesGET {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status code", w.Code)
+		}
+		var caps CapabilitiesGET
+		err := json.NewDecoder(w.Body).Decode(&caps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return caps
+	}
+
+	// assert the capabilities of the default config
+	caps := get(newCapabilitiesAPI(newTestConfig()))
+	if caps.Version != Version {
+		t.Fatal("unexpected version", caps.Version)
+	}
+	if caps.Role != RoleBoth {
+		t.Fatal("unexpected role", caps.Role)
+	}
+	if caps.PoW.Target != hex.EncodeToString(modules.MySkyTarget[:]) || len(caps.PoW.Versions) != 2 {
+		t.Fatal("unexpected pow", caps.PoW)
+	}
+	if caps.PoW.MaxProofUses != 50 || caps.PoW.MaxDailyReports != 100 {
+		t.Fatal("unexpected pow limits", caps.PoW)
+	}
+	expected := Limits{
+		MaxBodySize:          maxBodySize,
+		MaxBatchSize:         maxBatchSize,
+		MaxPageSize:          maxLimit,
+		MaxHashPrefixMatches: maxHashPrefixMatches,
+	}
+	if caps.Limits != expected {
+		t.Fatal("unexpected limits", caps.Limits)
+	}
+	for _, feature := range []string{FeatureBatchPoW, FeatureHashPrefix, FeaturePoWV1, FeaturePoWV2, FeatureRequestSigning} {
+		if !caps.Features[feature] {
+			t.Fatal("expected feature to be enabled", feature)
+		}
+	}
+	for _, feature := range []string{FeatureAggregatorMode, FeatureAlertWebhook, FeatureAnonymizeReporters, FeatureCallbacks, FeaturePush} {
+		if enabled, ok := caps.Features[feature]; !ok || enabled {
+			t.Fatal("expected feature to be disabled", feature)
+		}
+	}
+
+	// assert the routes are listed, the debug routes aren't
+	routes := make(map[Route]struct{})
+	for _, route := range caps.Routes {
+		routes[route] = struct{}{}
+	}
+	for _, route := range []Route{
+		{http.MethodGet, "/capabilities"},
+		{http.MethodGet, "/blocklist"},
+		{http.MethodPost, "/block"},
+		{http.MethodPost, "/powblock"},
+	} {
+		if _, ok := routes[route]; !ok {
+			t.Fatal("missing route", route)
+		}
+	}
+	if _, ok := routes[Route{http.MethodGet, "/debug/vars"}]; ok {
+		t.Fatal("unexpected debug route")
+	}
+
+	// toggle the config
+	cfg := newTestConfig()
+	cfg.AggregatorMode = true
+	cfg.AnonymizeReporters = true
+	cfg.ReporterSalt = []byte("salt")
+	cfg.AlertWebhook = true
+	cfg.CallbackDomains = []string{"example.com"}
+	cfg.Push = true
+	cfg.Debug = true
+	cfg.PoWV1Deadline = time.Now().Add(-time.Hour)
+	cfg.Limits = Limits{MaxBodySize: 256, MaxBatchSize: 2, MaxPageSize: 10}
+	api := newCapabilitiesAPI(cfg)
+
+	// assert the capabilities reflect the toggled config
+	caps = get(api)
+	for _, feature := range []string{FeatureAggregatorMode, FeatureAlertWebhook, FeatureAnonymizeReporters, FeatureCallbacks, FeaturePush} {
+		if !caps.Features[feature] {
+			t.Fatal("expected feature to be enabled", feature)
+		}
+	}
+	if caps.Features[FeaturePoWV1] || len(caps.PoW.Versions) != 1 {
+		t.Fatal("expected v1 proofs to be rejected", caps.PoW.Versions)
+	}
+	expected = Limits{
+		MaxBodySize:          256,
+		MaxBatchSize:         2,
+		MaxPageSize:          10,
+		MaxHashPrefixMatches: maxHashPrefixMatches,
+	}
+	if caps.Limits != expected {
+		t.Fatal("unexpected limits", caps.Limits)
+	}
+	found := false
+	for _, route := range caps.Routes {
+		found = found || route == Route{http.MethodGet, "/debug/vars"}
+	}
+	if !found {
+		t.Fatal("expected debug route to be listed")
+	}
+
+	// assert the handlers enforce the advertised limits
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+	sl := `"` + v1SkylinkStr + `"`
+	w := post("/powblock", `{"skylinks":[`+sl+`,`+sl+`,`+sl+`]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 2 skylinks") {
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+	w = post("/block", `{"tags":["`+strings.Repeat("a", 300)+`"]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too large") {
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+	_, _, _, err := parseListParameters(map[string][]string{"limit": {"11"}}, caps.Limits.MaxPageSize)
+	if err == nil {
+		t.Fatal("expected the limit to be enforced")
+	}
+}
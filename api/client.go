@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,18 +10,71 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 
 	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/skynet-accounts/build"
+	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/node/api"
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
-	// clientDefaultTimeout is the timeout of the http calls to in seconds
-	clientDefaultTimeout = "30"
+	// clientDefaultTimeout is the default timeout of the calls to skyd that
+	// block hashes.
+	clientDefaultTimeout = 30 * time.Second
+
+	// clientMetadataTimeout is the timeout of the calls to skyd that fetch the
+	// metadata of a skylink, they're made while a report is being handled so
+	// they have to be quick.
+	clientMetadataTimeout = 5 * time.Second
+)
+
+var (
+	// ErrRequestTooLarge is returned when skyd rejected a request because its
+	// body was too large.
+	ErrRequestTooLarge = errors.New("request too large")
+
+	// ErrSkydTimeout is returned when a request to skyd did not complete within
+	// its timeout. Skyd might have processed the request partially or even
+	// fully, so the outcome of the request is unknown.
+	ErrSkydTimeout = errors.New("skyd timed out")
+
+	// ErrSkydUnavailable is returned when a request to skyd failed because
+	// skyd responded with a server error, e.g. because it's overloaded.
+	ErrSkydUnavailable = errors.New("skyd is unavailable")
+
+	// ErrSkydUnreachable is returned when a request to skyd failed because
+	// skyd could not be reached.
+	ErrSkydUnreachable = errors.New("skyd is unreachable")
+
+	// ErrSkylinkNotFound is returned when skyd failed to resolve a skylink
+	// because its registry entry does not exist or is empty.
+	ErrSkylinkNotFound = errors.New("skylink not found")
+
+	// daemonReadyMinBackoff is the initial amount of time we wait between
+	// checking whether skyd is ready, it doubles after every attempt.
+	daemonReadyMinBackoff = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  10 * time.Millisecond,
+			Standard: time.Second,
+		},
+	).(time.Duration)
+
+	// daemonReadyMaxBackoff is the maximum amount of time we wait between
+	// checking whether skyd is ready.
+	daemonReadyMaxBackoff = build.Select(
+		build.Var{
+			Dev:      5 * time.Second,
+			Testing:  100 * time.Millisecond,
+			Standard: 30 * time.Second,
+		},
+	).(time.Duration)
 )
 
 type (
@@ -28,7 +82,12 @@ type (
 	// It exposes API methods and abstracts the response handling.
 	SkydClient struct {
 		staticDefaultHeaders http.Header
+		staticHTTPClient     *http.Client
 		staticPortalURL      string
+
+		// staticBlocklistKey is the key the pages of the portal's blocklist
+		// have to be signed with, it's nil if they don't have to be signed.
+		staticBlocklistKey ed25519.PublicKey
 	}
 
 	// BlockResponse is the response object returned by the Skyd API's block
@@ -53,6 +112,15 @@ type (
 		Error string `json:"error"`
 	}
 
+	// StatusError is the error returned when skyd responds with a status code
+	// outside of the 200s.
+	StatusError struct {
+		Method     string
+		URL        string
+		StatusCode int
+		Err        error
+	}
+
 	// resolveResponse is the response object returned by the Skyd API's resolve
 	// endpoint
 	resolveResponse struct {
@@ -77,6 +145,7 @@ func NewCustomSkydClient(portalURL string, headers http.Header) *SkydClient {
 	headers.Set("User-Agent", "Sia-Agent")
 	return &SkydClient{
 		staticDefaultHeaders: headers,
+		staticHTTPClient:     http.DefaultClient,
 		staticPortalURL:      portalURL,
 	}
 }
@@ -90,26 +159,35 @@ func (br *BlockResponse) InvalidHashes() ([]database.Hash, error) {
 
 	hashes := make([]database.Hash, len(br.Invalids))
 	for i, invalid := range br.Invalids {
-		var h database.Hash
-		err := h.LoadString(invalid.Input)
+		h, err := database.HashFromString(invalid.Input)
 		if err != nil {
-			return nil, err
+			return nil, errors.AddContext(err, "invalid hash in response")
 		}
 		hashes[i] = h
 	}
 	return hashes, nil
 }
 
-// BlocklistGET calls the `/portal/blocklist` endpoint with given parameters
+// BlocklistGET calls the `/portal/blocklist` endpoint with given parameters.
+// If the client was created for a portal that signs its blocklist, pages that
+// aren't signed with the portal's key are rejected.
 func (c *SkydClient) BlocklistGET(offset int) (*BlocklistGET, error) {
 	// set url values
 	query := url.Values{}
 	query.Set("offset", fmt.Sprint(offset))
 	query.Set("sort", "desc")
 
+	// verify the signature of the page if required
+	var verifyFn func(http.Header, []byte) error
+	if c.staticBlocklistKey != nil {
+		verifyFn = func(header http.Header, body []byte) error {
+			return verifyBlocklistSignature(c.staticBlocklistKey, header, body)
+		}
+	}
+
 	// execute the get request
 	var blg BlocklistGET
-	err := c.get("/skynet/portal/blocklist", query, &blg)
+	err := c.getVerified("/skynet/portal/blocklist", query, &blg, verifyFn)
 	if err != nil {
 		return nil, errors.AddContext(err, fmt.Sprintf("failed to fetch blocklist for portal %s", c.staticPortalURL))
 	}
@@ -121,30 +199,64 @@ func (c *SkydClient) BlocklistGET(offset int) (*BlocklistGET, error) {
 // returns which hashes were blocked, which hashes were invalid and potentially
 // an error.
 func (c *SkydClient) BlockHashes(hashes []database.Hash) ([]database.Hash, []database.Hash, error) {
-	// convert the hashes to strings
-	adds := make([]string, len(hashes))
-	for h, hash := range hashes {
-		adds[h] = hash.String()
-	}
+	return c.BlockHashesWithTimeout(hashes, clientDefaultTimeout)
+}
 
+// UnblockHashes will perform an API call to skyd to remove the given hashes
+// from its blocklist.
+func (c *SkydClient) UnblockHashes(hashes []database.Hash) error {
 	// build the post body
+	removes := make([]string, len(hashes))
+	for i, hash := range hashes {
+		removes[i] = hash.String()
+	}
 	reqBody, err := json.Marshal(skyapi.SkynetBlocklistPOST{
-		Add:    adds,
-		Remove: nil,
+		Remove: removes,
 		IsHash: true,
 	})
+	if err != nil {
+		return errors.AddContext(err, "failed to build request body")
+	}
+
+	// execute the request
+	ctx, cancel := context.WithTimeout(context.Background(), clientDefaultTimeout)
+	defer cancel()
+	var response BlockResponse
+	err = c.post(ctx, "/skynet/blocklist", url.Values{}, bytes.NewBuffer(reqBody), &response)
+	if err != nil {
+		return errors.AddContext(err, "failed to execute POST request")
+	}
+	return nil
+}
+
+// BlockHashesWithTimeout is like BlockHashes but gives skyd the given amount
+// of time to block the hashes. If the request times out the returned error
+// contains ErrSkydTimeout, if skyd rejects the request because it's too large
+// the error contains ErrRequestTooLarge.
+func (c *SkydClient) BlockHashesWithTimeout(hashes []database.Hash, timeout time.Duration) ([]database.Hash, []database.Hash, error) {
+	// build the post body
+	reqBody, err := blockRequestBody(hashes)
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "failed to build request body")
 	}
 	body := bytes.NewBuffer(reqBody)
 
-	// build the query parameters
+	// build the query parameters, skyd expects the timeout in seconds
+	seconds := int64((timeout + time.Second - 1) / time.Second)
 	query := url.Values{}
-	query.Add("timeout", clientDefaultTimeout)
+	query.Add("timeout", fmt.Sprint(seconds))
 
 	// execute the request
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	var response BlockResponse
-	err = c.post("/skynet/blocklist", query, body, &response)
+	err = c.post(ctx, "/skynet/blocklist", query, body, &response)
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode >= http.StatusInternalServerError {
+		err = errors.Compose(err, ErrSkydUnavailable)
+	}
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusRequestEntityTooLarge {
+		err = errors.Compose(err, ErrRequestTooLarge)
+	}
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "failed to execute POST request")
 	}
@@ -158,27 +270,110 @@ func (c *SkydClient) BlockHashes(hashes []database.Hash) ([]database.Hash, []dat
 	return database.DiffHashes(hashes, invalids), invalids, nil
 }
 
+// BlockRequestSize returns the size, in bytes, of the body of the request that
+// blocks the given hashes.
+func BlockRequestSize(hashes []database.Hash) int {
+	reqBody, err := blockRequestBody(hashes)
+	if err != nil {
+		return 0
+	}
+	return len(reqBody)
+}
+
+// Blocklist returns the hashes on skyd's blocklist.
+func (c *SkydClient) Blocklist() ([]database.Hash, error) {
+	var response skyapi.SkynetBlocklistGET
+	err := c.get("/skynet/blocklist", url.Values{}, &response)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch skyd blocklist")
+	}
+	hashes := make([]database.Hash, len(response.Blocklist))
+	for i, hash := range response.Blocklist {
+		hashes[i] = database.Hash{Hash: hash}
+	}
+	return hashes, nil
+}
+
 // ResolveSkylink will resolve the given skylink.
 func (c *SkydClient) ResolveSkylink(skylink skymodules.Skylink) (skymodules.Skylink, error) {
+	resolved, _, err := c.ResolveSkylinkPublisher(skylink)
+	return resolved, err
+}
+
+// ResolveSkylinkPublisher resolves the given skylink like ResolveSkylink, it
+// also returns the public key of the publisher of a v2 skylink, being the
+// public key of the registry entry it points to. The public key is taken from
+// the registry proof skyd attaches to the response, it's only returned if the
+// skylink is derived from it. It's empty for v1 skylinks and if skyd didn't
+// attach a valid proof.
+func (c *SkydClient) ResolveSkylinkPublisher(skylink skymodules.Skylink) (skymodules.Skylink, string, error) {
 	// no need to resolve the skylink if it's a v1 skylink
 	if skylink.IsSkylinkV1() {
-		return skylink, nil
+		return skylink, "", nil
 	}
 
-	// execute the request
+	// execute the request, keeping the proof
 	var response resolveResponse
+	var proof string
 	endpoint := fmt.Sprintf("/skynet/resolve/%s", skylink.String())
-	err := c.get(endpoint, url.Values{}, &response)
+	err := c.getVerified(endpoint, url.Values{}, &response, func(header http.Header, _ []byte) error {
+		proof = header.Get(skyapi.SkynetProofHeader)
+		return nil
+	})
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return skymodules.Skylink{}, "", errors.Compose(err, ErrSkylinkNotFound)
+	}
 	if err != nil {
-		return skymodules.Skylink{}, errors.AddContext(err, "failed to execute GET request")
+		return skymodules.Skylink{}, "", errors.AddContext(err, "failed to execute GET request")
 	}
+	publisher := registryPublisher(skylink, proof)
 
 	// check whether we resolved a valid skylink
 	err = skylink.LoadString(response.Skylink)
 	if err != nil {
-		return skymodules.Skylink{}, errors.AddContext(err, "unable to load the resolved skylink")
+		return skymodules.Skylink{}, "", errors.AddContext(err, "unable to load the resolved skylink")
 	}
-	return skylink, nil
+	return skylink, publisher, nil
+}
+
+// ContentAvailable returns whether skyd can fetch the metadata of the given
+// skylink, which is a lightweight way of checking whether the content still
+// exists. It returns false if skyd reports the skylink as not found, any other
+// failure returns an error as the availability of the content is unknown. The
+// call is given clientMetadataTimeout to complete.
+func (c *SkydClient) ContentAvailable(ctx context.Context, skylink skymodules.Skylink) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, clientMetadataTimeout)
+	defer cancel()
+
+	// create the request
+	url := fmt.Sprintf("%s/skynet/metadata/%s", c.staticPortalURL, skylink.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to create request")
+	}
+
+	// set headers and execute the request
+	for k, v := range c.staticDefaultHeaders {
+		req.Header.Set(k, v[0])
+	}
+	res, err := c.staticHTTPClient.Do(req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return false, errors.Compose(err, ErrSkydTimeout)
+	}
+	if err != nil {
+		return false, errors.Compose(err, ErrSkydUnreachable)
+	}
+	defer drainAndClose(res.Body)
+
+	// skyd responds with a not found if the content is gone, the body of a
+	// successful response holds the metadata which we don't need
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		return false, nil
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false, newStatusError(res, url)
+	}
+	return true, nil
 }
 
 // DaemonReady connects to the local skyd and checks its status.
@@ -196,10 +391,50 @@ func (c *SkydClient) DaemonReady() bool {
 		response.Renter
 }
 
+// WaitForDaemonReady polls the local skyd until it is ready, backing off
+// exponentially between attempts. It returns an error if skyd is not ready
+// before the given timeout elapses or if the context is cancelled.
+func (c *SkydClient) WaitForDaemonReady(ctx context.Context, timeout time.Duration, logger *logrus.Entry) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	backoff := daemonReadyMinBackoff
+	for attempt := 1; ; attempt++ {
+		if c.DaemonReady() {
+			return nil
+		}
+		logger.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+			"waited":  time.Since(start).Round(time.Second),
+			"timeout": timeout,
+		}).Info("Skyd is not ready yet")
+
+		select {
+		case <-ctx.Done():
+			return errors.AddContext(ctx.Err(), fmt.Sprintf("skyd was not ready after %v", time.Since(start).Round(time.Second)))
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > daemonReadyMaxBackoff {
+			backoff = daemonReadyMaxBackoff
+		}
+	}
+}
+
 // get is a helper function that executes a GET request on the given endpoint
 // with the provided query values. The response will get unmarshaled into the
 // given response object.
 func (c *SkydClient) get(endpoint string, query url.Values, obj interface{}) error {
+	return c.getVerified(endpoint, query, obj, nil)
+}
+
+// getVerified is a helper function that executes a GET request like get, if a
+// verify function is given the response body is only unmarshaled into the
+// given response object after it passed verification.
+func (c *SkydClient) getVerified(endpoint string, query url.Values, obj interface{}, verifyFn func(http.Header, []byte) error) error {
 	// create the request
 	queryString := query.Encode()
 	url := fmt.Sprintf("%s%s", c.staticPortalURL, endpoint)
@@ -214,31 +449,39 @@ func (c *SkydClient) get(endpoint string, query url.Values, obj interface{}) err
 
 	// set headers and execute the request
 	req.Header.Set("User-Agent", "Sia-Agent")
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.staticHTTPClient.Do(req)
 	if err != nil {
-		return err
+		return errors.Compose(err, ErrSkydUnreachable)
 	}
 	defer drainAndClose(res.Body)
 
 	// return an error if the status code is not in the 200s
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("GET request to '%s' with status %d error %v", url, res.StatusCode, readAPIError(res.Body))
+		return newStatusError(res, url)
 	}
 
 	// handle the response body
-	err = json.NewDecoder(res.Body).Decode(obj)
+	if verifyFn == nil {
+		return json.NewDecoder(res.Body).Decode(obj)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBlocklistPageSize))
+	if err != nil {
+		return errors.AddContext(err, "failed to read response")
+	}
+	err = verifyFn(res.Header, body)
 	if err != nil {
 		return err
 	}
-	return nil
+	return json.Unmarshal(body, obj)
 }
 
 // post is a helper function that executes a POST request on the given endpoint
-// with the provided query values.
-func (c *SkydClient) post(endpoint string, query url.Values, body io.Reader, obj interface{}) error {
+// with the provided query values. If the given context expires before the
+// request completes, the returned error contains ErrSkydTimeout.
+func (c *SkydClient) post(ctx context.Context, endpoint string, query url.Values, body io.Reader, obj interface{}) error {
 	// create the request
 	url := fmt.Sprintf("%s%s?%s", c.staticPortalURL, endpoint, query.Encode())
-	req, err := http.NewRequest(http.MethodPost, url, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		return errors.AddContext(err, "failed to create request")
 	}
@@ -247,15 +490,18 @@ func (c *SkydClient) post(endpoint string, query url.Values, body io.Reader, obj
 	for k, v := range c.staticDefaultHeaders {
 		req.Header.Set(k, v[0])
 	}
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.staticHTTPClient.Do(req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Compose(err, ErrSkydTimeout)
+	}
 	if err != nil {
-		return err
+		return errors.Compose(err, ErrSkydUnreachable)
 	}
 	defer drainAndClose(res.Body)
 
 	// return an error if the status code is not in the 200s
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("POST request to '%s' with status %d error %v", url, res.StatusCode, readAPIError(res.Body))
+		return newStatusError(res, url)
 	}
 
 	// handle the response body
@@ -266,6 +512,54 @@ func (c *SkydClient) post(endpoint string, query url.Values, body io.Reader, obj
 	return nil
 }
 
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request to '%s' with status %d error %v", e.Method, e.URL, e.StatusCode, e.Err)
+}
+
+// newStatusError returns a StatusError for the given response, the error is
+// read from the response body.
+func newStatusError(res *http.Response, url string) *StatusError {
+	return &StatusError{
+		Method:     res.Request.Method,
+		URL:        url,
+		StatusCode: res.StatusCode,
+		Err:        readAPIError(res.Body),
+	}
+}
+
+// blockRequestBody returns the body of the request that blocks the given
+// hashes.
+func blockRequestBody(hashes []database.Hash) ([]byte, error) {
+	// convert the hashes to strings
+	adds := make([]string, len(hashes))
+	for h, hash := range hashes {
+		adds[h] = hash.String()
+	}
+	return json.Marshal(skyapi.SkynetBlocklistPOST{
+		Add:    adds,
+		Remove: nil,
+		IsHash: true,
+	})
+}
+
+// registryPublisher returns the public key of the first registry entry of the
+// given proof, which is the entry the given v2 skylink points to, if the
+// skylink is derived from it. It returns an empty string if the proof is
+// missing or invalid, the publisher is unknown in that case.
+func registryPublisher(skylink skymodules.Skylink, proof string) string {
+	var entries []skyapi.RegistryHandlerGET
+	err := json.Unmarshal([]byte(proof), &entries)
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	entry := entries[0]
+	if skymodules.NewSkylinkV2(entry.PublicKey, entry.DataKey) != skylink {
+		return ""
+	}
+	return entry.PublicKey.String()
+}
+
 // drainAndClose reads rc until EOF and then closes it. drainAndClose should
 // always be called on HTTP response bodies, because if the body is not fully
 // read, the underlying connection can't be reused.
@@ -1,11 +1,22 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
 )
 
 // mockPortalBlocklistResponse is a mock handler for the
@@ -56,3 +67,187 @@ func testBlocklistGET(t *testing.T, s *httptest.Server) {
 		t.Fatal("expected at least one entry")
 	}
 }
+
+// TestWaitForDaemonReady verifies the client waits for skyd to become ready
+// and gives up after the timeout.
+func TestWaitForDaemonReady(t *testing.T) {
+	t.Parallel()
+
+	nullLogger, _ := logtest.NewNullLogger()
+	logger := nullLogger.WithField("module", "api")
+
+	// create a mock that becomes ready after a delay
+	readyAfter := time.Now().Add(200 * time.Millisecond)
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		ready := time.Now().After(readyAfter)
+		skyapi.WriteJSON(w, DaemonReadyResponse{
+			Ready:     ready,
+			Consensus: ready,
+			Gateway:   ready,
+			Renter:    ready,
+		})
+	}))
+	defer server.Close()
+	c := NewSkydClient(server.URL, "")
+
+	// assert we give up if skyd isn't ready before the timeout
+	err := c.WaitForDaemonReady(context.Background(), 50*time.Millisecond, logger)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert we give up if the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = c.WaitForDaemonReady(ctx, time.Minute, logger)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert we wait for skyd to become ready
+	err = c.WaitForDaemonReady(context.Background(), 10*time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(readyAfter) {
+		t.Fatal("skyd was not ready yet")
+	}
+	if n := atomic.LoadUint64(&requests); n < 3 {
+		t.Fatal("expected multiple attempts", n)
+	}
+}
+
+// TestContentAvailable verifies the client reports content skyd can't find as
+// unavailable, and that other failures are returned as errors.
+func TestContentAvailable(t *testing.T) {
+	t.Parallel()
+
+	// create skylinks for every response of the mock
+	newSkylink := func() skymodules.Skylink {
+		var root crypto.Hash
+		fastrand.Read(root[:])
+		sl, err := skymodules.NewSkylinkV1(root, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sl
+	}
+	reachable, missing, broken := newSkylink(), newSkylink(), newSkylink()
+
+	// create a mock that serves the metadata of the reachable skylink
+	mux := http.NewServeMux()
+	mux.HandleFunc("/skynet/metadata/"+reachable.String(), func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteJSON(w, skymodules.SkyfileMetadata{Filename: "file"})
+	})
+	mux.HandleFunc("/skynet/metadata/"+missing.String(), func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteError(w, skyapi.Error{Message: "not found"}, http.StatusNotFound)
+	})
+	mux.HandleFunc("/skynet/metadata/"+broken.String(), func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteError(w, skyapi.Error{Message: "overloaded"}, http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := NewSkydClient(server.URL, "")
+
+	available, err := c.ContentAvailable(context.Background(), reachable)
+	if err != nil || !available {
+		t.Fatal("expected content to be available", err)
+	}
+	available, err = c.ContentAvailable(context.Background(), missing)
+	if err != nil || available {
+		t.Fatal("expected content to be missing", err)
+	}
+	_, err = c.ContentAvailable(context.Background(), broken)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert an unreachable skyd is an error
+	server.Close()
+	_, err = c.ContentAvailable(context.Background(), reachable)
+	if !errors.Contains(err, ErrSkydUnreachable) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestResolveSkylinkPublisher verifies the client returns the publisher of a
+// v2 skylink from the registry proof skyd attaches, but only if the skylink is
+// derived from the public key in the proof.
+func TestResolveSkylinkPublisher(t *testing.T) {
+	t.Parallel()
+
+	// create the v2 skylinks of two publishers
+	published, publisher := newTestPublisher("app")
+	other, _ := newTestPublisher("app")
+
+	// create a mock that attaches a valid proof for the published skylink
+	// and a proof of the wrong publisher for the other one
+	mux := http.NewServeMux()
+	mux.Handle("/skynet/resolve/", mockResolveWithProof(map[string]skyapi.RegistryHandlerGET{
+		published.String(): {DataKey: crypto.HashObject("app"), PublicKey: publisher},
+		other.String():     {DataKey: crypto.HashObject("app"), PublicKey: publisher},
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := NewSkydClient(server.URL, "")
+
+	// assert the publisher of the published skylink is returned
+	resolved, key, err := c.ResolveSkylinkPublisher(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.String() != v1SkylinkStr || key != publisher.String() {
+		t.Fatal("unexpected resolution", resolved, key)
+	}
+
+	// assert the publisher is unknown if the proof doesn't match
+	_, key, err = c.ResolveSkylinkPublisher(other)
+	if err != nil || key != "" {
+		t.Fatal("unexpected publisher", key, err)
+	}
+
+	// assert the publisher is unknown if there's no proof
+	unproven, _ := newTestPublisher("app")
+	_, key, err = c.ResolveSkylinkPublisher(unproven)
+	if err != nil || key != "" {
+		t.Fatal("unexpected publisher", key, err)
+	}
+
+	// assert v1 skylinks have no publisher
+	var v1 skymodules.Skylink
+	err = v1.LoadString(v1SkylinkStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err = c.ResolveSkylinkPublisher(v1)
+	if err != nil || key != "" {
+		t.Fatal("unexpected publisher", key, err)
+	}
+}
+
+// newTestPublisher returns the v2 skylink with the given data key of a new
+// publisher, along with the publisher's public key.
+func newTestPublisher(dataKey string) (skymodules.Skylink, types.SiaPublicKey) {
+	_, pk := crypto.GenerateKeyPair()
+	spk := types.Ed25519PublicKey(pk)
+	return skymodules.NewSkylinkV2(spk, crypto.HashObject(dataKey)), spk
+}
+
+// mockResolveWithProof returns a mock handler for the resolve endpoint that
+// resolves every skylink to the v1 skylink, attaching a proof of the given
+// registry entry by skylink.
+func mockResolveWithProof(proofs map[string]skyapi.RegistryHandlerGET) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := proofs[strings.TrimPrefix(r.URL.Path, "/skynet/resolve/")]; ok {
+			proof, err := json.Marshal([]skyapi.RegistryHandlerGET{entry})
+			if err != nil {
+				skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(skyapi.SkynetProofHeader, string(proof))
+		}
+		skyapi.WriteJSON(w, resolveResponse{Skylink: v1SkylinkStr})
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+type (
+	// DebugVarsGET is the response returned by the /debug/vars endpoint, it
+	// contains runtime statistics and the status snapshots of the blocker's
+	// components.
+	DebugVarsGET struct {
+		Goroutines int                    `json:"goroutines"`
+		Memory     DebugMemStats          `json:"memory"`
+		Statuses   map[string]interface{} `json:"statuses"`
+	}
+
+	// DebugMemStats contains a subset of the runtime's memory and GC
+	// statistics.
+	DebugMemStats struct {
+		Alloc        uint64    `json:"alloc"`
+		HeapAlloc    uint64    `json:"heapalloc"`
+		HeapInuse    uint64    `json:"heapinuse"`
+		HeapObjects  uint64    `json:"heapobjects"`
+		HeapSys      uint64    `json:"heapsys"`
+		Sys          uint64    `json:"sys"`
+		NumGC        uint32    `json:"numgc"`
+		PauseTotalNs uint64    `json:"pausetotalns"`
+		LastGC       time.Time `json:"lastgc"`
+	}
+)
+
+// debugPprof serves the pprof profiles, it dispatches the request to the
+// pprof handler matching the profile name in the path.
+func debugPprof(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	switch ps.ByName("name") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		// Index serves the named profiles, e.g. heap and goroutine, based on
+		// the request path.
+		pprof.Index(w, r)
+	}
+}
+
+// debugVarsGET returns runtime statistics and the status snapshots of all
+// registered components.
+func (api *API) debugVarsGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	var lastGC time.Time
+	if ms.LastGC > 0 {
+		lastGC = time.Unix(0, int64(ms.LastGC)).UTC()
+	}
+	skyapi.WriteJSON(w, DebugVarsGET{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: DebugMemStats{
+			Alloc:        ms.Alloc,
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapObjects:  ms.HeapObjects,
+			HeapSys:      ms.HeapSys,
+			Sys:          ms.Sys,
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+			LastGC:       lastGC,
+		},
+		Statuses: api.managedStatuses(),
+	})
+}
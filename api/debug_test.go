@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestDebugRoutes verifies the debug routes are only served when debugging is
+// enabled.
+func TestDebugRoutes(t *testing.T) {
+	t.Parallel()
+
+	// newDebugAPI returns a bare API with its routes registered
+	newDebugAPI := func(debug bool) *API {
+		logger, _ := logtest.NewNullLogger()
+		cfg := newTestConfig()
+		cfg.Debug = debug
+		api := &API{
+			staticConfig: cfg,
+			staticLogger: logger.WithField("module", "api"),
+			staticRouter: httprouter.New(),
+		}
+		api.buildHTTPRoutes()
+		return api
+	}
+	get := func(api *API, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	paths := []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/vars"}
+
+	// assert the routes 404 when debugging is disabled
+	api := newDebugAPI(false)
+	for _, path := range paths {
+		if w := get(api, path); w.Code != http.StatusNotFound {
+			t.Fatalf("unexpected status code for %v, %v", path, w.Code)
+		}
+	}
+
+	// assert the routes are served when debugging is enabled
+	api = newDebugAPI(true)
+	api.RegisterStatus("component", func() interface{} { return "ok" })
+	for _, path := range paths {
+		if w := get(api, path); w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %v, %v", path, w.Code)
+		}
+	}
+
+	// assert the heap profile is served
+	w := get(api, "/debug/pprof/heap")
+	if w.Body.Len() == 0 {
+		t.Fatal("expected heap profile")
+	}
+
+	// assert the vars contain runtime stats and the registered status
+	var vars DebugVarsGET
+	err := json.NewDecoder(get(api, "/debug/vars").Body).Decode(&vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Goroutines == 0 || vars.Memory.HeapAlloc == 0 {
+		t.Fatal("unexpected runtime stats", vars)
+	}
+	if vars.Statuses["component"] != "ok" {
+		t.Fatal("unexpected statuses", vars.Statuses)
+	}
+}
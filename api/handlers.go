@@ -5,9 +5,9 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	url "net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -15,21 +15,51 @@ import (
 	"github.com/SkynetLabs/blocker/database"
 	"github.com/SkynetLabs/blocker/modules"
 	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.sia.tech/siad/crypto"
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
-	// maxBodySize defines the maximum size of the POST body when making request
-	// to the block endpoints
+	// APIKeyHeader is the header that holds the API key of a trusted
+	// reporter.
+	APIKeyHeader = "Skynet-Api-Key"
+
+	// maxBodySize defines the default maximum size of the POST body when
+	// making request to the block endpoints
 	maxBodySize = int64(1 << 16) // 64kib
 
-	// maxLimit defines the maximum value for the limit parameter used by the
-	// blocklist endpoint
+	// maxBatchSize defines the default maximum number of skylinks that can
+	// be reported in a single request to the PoW block endpoint
+	maxBatchSize = 20
+
+	// maxLimit defines the default maximum value for the limit parameter
+	// used by the blocklist endpoint
 	maxLimit = 1000
 
+	// maxHashPrefixMatches defines the default maximum number of entries the
+	// blocklist endpoint returns when it's queried by hash prefix
+	maxHashPrefixMatches = 20
+
+	// minHashPrefixLength defines the minimum number of hex characters of the
+	// hashPrefix parameter used by the blocklist endpoint
+	minHashPrefixLength = 8
+
+	// minTimeseriesBucket defines the minimum value for the bucket parameter
+	// used by the timeseries endpoint
+	minTimeseriesBucket = time.Minute
+
+	// blockedIdentitySeverity is the minimum severity of reports attributed
+	// to a blocked identity.
+	blockedIdentitySeverity = database.SeverityHigh
+
+	// blockedIdentityTag is the tag reports attributed to a blocked identity
+	// are tagged with.
+	blockedIdentityTag = "blocked-identity"
+
 	// sortAscending defines the query string parameter option that can be
 	// passed as 'sort' parameter. If passed the response will contain the
 	// entries sorted by the 'sortBy' parameter in ascending fashion.
@@ -41,10 +71,75 @@ const (
 	sortDescending = "desc"
 )
 
+const (
+	// blockOutcomeAllowListed is the outcome of a report of an allowlisted
+	// skylink, which isn't blocked but recorded as a hit on the allow list.
+	blockOutcomeAllowListed = "allowlisted"
+
+	// blockOutcomeBlock is the outcome of a report of a new skylink, which
+	// gets blocked.
+	blockOutcomeBlock = "block"
+
+	// blockOutcomeDuplicate is the outcome of a report of a skylink that was
+	// reported before, its new tags are added if it's blocked already.
+	blockOutcomeDuplicate = "duplicate"
+
+	// blockOutcomeResurrect is the outcome of a report of a skylink that was
+	// found to be invalid, which gets blocked again.
+	blockOutcomeResurrect = "resurrect"
+)
+
 var (
+	// errAccountsUnavailable is the error returned when the accounts service
+	// can't be reached, or when calls to it are skipped because it's down.
+	errAccountsUnavailable = errors.New("accounts service unavailable")
+
+	// errUnknownAPIKey is the error returned when a request carries an API
+	// key that is not configured.
+	errUnknownAPIKey = errors.New("unknown API key")
+
+	// errProofReused is the error returned when a proof of work has been used
+	// more than the allowed number of times.
+	errProofReused = errors.New("proof has been used too many times, please mine a new proof using a fresh nonce")
+
+	// errIdentityBlocked is the error returned when a proof of work is
+	// created by a MySkyID that's blocked from reporting.
+	errIdentityBlocked = errors.New("this MySkyID is blocked from reporting skylinks")
+
+	// errInvalidMySkyID is the error returned when a MySkyID isn't a hex
+	// encoded ed25519 public key.
+	errInvalidMySkyID = errors.New("invalid MySkyID, should be a hex encoded public key")
+
+	// errTooManyReports is the error returned when a MySkyID has exceeded the
+	// number of reports it is allowed to make within the report window.
+	errTooManyReports = errors.New("too many reports, please try again later")
+
 	// errResolve is the error returned when we failed to resolve a skylink,
 	// indicating skyd failure
 	errResolve = errors.New("failed to resolve skylink")
+
+	// errResolvedToV2 is the error returned when skyd resolved a skylink into
+	// another v2 skylink rather than into a v1 skylink.
+	errResolvedToV2 = errors.New("skylink resolved to a v2 skylink, expected a v1 skylink")
+
+	// errResolveUnavailable is the error returned when a skylink needs to be
+	// resolved but there's no skyd to resolve it, which is the case when the
+	// blocker is running in aggregator mode.
+	errResolveUnavailable = errors.New("resolving v2 skylinks is not supported by this blocker, please report the v1 skylink or its hash instead")
+
+	// errAllowListUnavailable is the error returned when a report can't be
+	// checked against the allow list, the report is rejected rather than
+	// risking to block allowlisted content.
+	errAllowListUnavailable = errors.New("failed to verify the skylink against the allow list, please try again later")
+
+	// errCallbacksDisabled is the error returned when a report carries a
+	// callback URL but no callback domains are configured.
+	errCallbacksDisabled = errors.New("callbacks are not enabled on this blocker")
+
+	// errInvalidCallbackURL is the error returned when a report carries a
+	// callback URL that is malformed, isn't https or doesn't point to one of
+	// the callback domains.
+	errInvalidCallbackURL = errors.New("invalid callback URL")
 )
 
 type (
@@ -60,8 +155,50 @@ type (
 		//
 		// It is encouraged to use this field when possible as it allows
 		// services that interact with the blocker to only deal with hashes
-		// instead of skylinks.
-		Hash crypto.Hash `json:"hash"`
+		// instead of skylinks. The zero hash is treated as unset.
+		Hash database.Hash `json:"hash"`
+
+		// MerkleRoot is the merkle root of the reported content, it allows
+		// services that only know the root, e.g. host-side scanners, to
+		// report it without synthesizing a skylink. It's hex encoded like a
+		// hash and can't be combined with 'hash' or 'skylink'. The zero root
+		// is treated as unset.
+		MerkleRoot database.Hash `json:"merkleroot"`
+
+		// Metadata holds optional provenance information of the report, e.g.
+		// the message ID of the abuse email the skylink was parsed from.
+		Metadata map[string]string `json:"metadata,omitempty"`
+
+		// Portal is the url of the portal the hash was reported on, it's set
+		// by peer blockers that push their reports to us. Reports with a
+		// portal are stored as synced reports and are never pushed again,
+		// which prevents them from echoing between blockers. It's ignored by
+		// the PoW endpoint.
+		Portal string `json:"portal,omitempty"`
+
+		// CallbackURL is an optional https URL that's notified once the
+		// reported hash is blocked or found to be invalid. It must point to
+		// one of the configured callback domains.
+		CallbackURL string `json:"callback_url,omitempty"`
+
+		// MySkyID is the optional hex encoded MySkyID the report is
+		// attributed to. Reports attributed to a blocked identity get tagged
+		// with blockedIdentityTag and are of at least high severity. The
+		// /powblock endpoint attributes reports to the MySkyID of the proof.
+		MySkyID string `json:"myskyid,omitempty"`
+
+		// KeyID is the ID of the API key the request was made with, it's
+		// set by the /block endpoint.
+		KeyID string `json:"-"`
+
+		// IdentityBlocked is set if the report is attributed to a blocked
+		// identity, see MySkyID.
+		IdentityBlocked bool `json:"-"`
+
+		// AttributionPending is set by the /block endpoint if the request
+		// carried a cookie but the accounts service was unavailable to
+		// identify the user.
+		AttributionPending bool `json:"-"`
 	}
 
 	// BlocklistGET returns a list of blocked hashes
@@ -70,24 +207,47 @@ type (
 		HasMore bool          `json:"hasmore"`
 	}
 
+	// TimeseriesGET is the response of the /stats/timeseries endpoint, it
+	// contains the number of reported skylinks per bucket within the window
+	// and the latency percentiles of blocking the skylinks reported within
+	// the window. The failures hold the number of skylinks that currently
+	// fail to get blocked, by failure class.
+	TimeseriesGET struct {
+		Bucket   string                    `json:"bucket"`
+		Window   string                    `json:"window"`
+		Buckets  []database.ActivityBucket `json:"buckets"`
+		Latency  database.BlockLatency     `json:"latency"`
+		Failures map[string]int            `json:"failures"`
+	}
+
 	// BlockedHash describes a blocked hash along with the set of tags it was
 	// reported with
 	BlockedHash struct {
-		Hash crypto.Hash `json:"hash"`
-		Tags []string    `json:"tags"`
+		Hash database.Hash `json:"hash"`
+		Tags []string      `json:"tags"`
 	}
 
 	// BlockWithPoWPOST describes a request to the /blockpow endpoint
-	// containing a pow.
+	// containing a pow. Instead of a single skylink or hash, the request can
+	// contain a batch of skylinks which are all covered by the same pow.
 	BlockWithPoWPOST struct {
 		BlockPOST
-		PoW modules.BlockPoW `json:"pow"`
+		Skylinks []skylink        `json:"skylinks"`
+		PoW      modules.BlockPoW `json:"pow"`
 	}
 
 	// BlockWithPoWGET is the response a user gets from the /blockpow
-	// endpoint.
+	// endpoint. The challenge has to be included in v2 proofs. The difficulty
+	// is the expected number of hash attempts required to meet the target,
+	// together with the reference hash rate, measured on the server in hashes
+	// per second, it allows clients to estimate how long solving the pow will
+	// take on their own hardware.
 	BlockWithPoWGET struct {
-		Target string `json:"target"`
+		Target            string                `json:"target"`
+		Challenge         *modules.PoWChallenge `json:"challenge"`
+		Difficulty        uint64                `json:"difficulty"`
+		ReferenceHashRate uint64                `json:"referencehashrate"`
+		Versions          []string              `json:"versions"`
 	}
 
 	// Reporter is a person who reported that a given skylink should be
@@ -98,13 +258,74 @@ type (
 		OtherContact string `json:"othercontact"`
 	}
 
-	// statusResponse is what we return on block requests
+	// statusResponse is what we return on block requests. Duplicate reports
+	// describe the existing report, being when it got reported, its current
+	// tags and whether, and when, it got blocked. Only trusted callers get
+	// to see the reporter of the existing report.
 	statusResponse struct {
+		Status           string     `json:"status"`
+		Hash             string     `json:"hash,omitempty"`
+		TimestampAdded   *time.Time `json:"timestamp_added,omitempty"`
+		TimestampBlocked *time.Time `json:"timestamp_blocked,omitempty"`
+		Blocked          *bool      `json:"blocked,omitempty"`
+		Tags             []string   `json:"tags,omitempty"`
+		Reporter         *Reporter  `json:"reporter,omitempty"`
+	}
+
+	// BlockValidation is the response of the /block/validate endpoint, it
+	// describes what blocking the validated request would do.
+	BlockValidation struct {
+		// Status is the status /block would respond with.
 		Status string `json:"status"`
+
+		// Outcome is what blocking the request would do, either
+		// "allowlisted", "block", "duplicate" or "resurrect".
+		Outcome string `json:"outcome"`
+
+		Hash     string   `json:"hash"`
+		Tags     []string `json:"tags,omitempty"`
+		NewTags  []string `json:"new_tags,omitempty"`
+		Severity string   `json:"severity,omitempty"`
 	}
 
-	// skylink is a helper type which adds custom decoding for skylinks.
-	skylink string
+	// blockDecision is the outcome of the checks of a report, it's decided
+	// without writing anything so the block routes, which act on it, and
+	// the validate route, which returns it, can't drift apart.
+	blockDecision struct {
+		outcome string
+
+		// skylink is the skylink the report would block.
+		skylink *database.BlockedSkylink
+
+		// existing is the skylink that was reported before, if any.
+		existing *database.BlockedSkylink
+
+		// newTags are the tags the report would add to the existing
+		// skylink, it's only set if that's blocked already.
+		newTags []string
+	}
+
+	// batchStatusResponse is what we return on batch block requests, it
+	// contains a status for every skylink in the batch
+	batchStatusResponse struct {
+		Statuses []skylinkStatus `json:"statuses"`
+	}
+
+	// skylinkStatus is the status of a single skylink in a batch block request
+	skylinkStatus struct {
+		Skylink string `json:"skylink"`
+		Status  string `json:"status"`
+		Hash    string `json:"hash,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	// skylink is a helper type which adds custom decoding for skylinks. It
+	// holds the normalized skylink and the form it was reported in, see
+	// modules.SkylinkForms.
+	skylink struct {
+		link string
+		form string
+	}
 )
 
 // UnmarshalJSON implements json.Unmarshaler for a skylink.
@@ -114,40 +335,70 @@ func (sl *skylink) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	// Trim all the redundant information.
-	//
-	// TODO: is this really necessary? if possible we should try and drop this
-	link, err = extractSkylinkHash(link)
+	// Normalise the skylink. We want to use the same encoding in the
+	// database, regardless of the encoding of the skylink when we receive it
+	// - base32 or base64 - and regardless of any redundant information such
+	// as the portal domain.
+	link, form, err := modules.NormalizeSkylinkForm(link)
 	if err != nil {
 		return err
 	}
-	// Normalise the skylink hash. We want to use the same hash encoding in the
-	// database, regardless of the encoding of the skylink when we receive it -
-	// base32 or base64.
-	var slNormalized skymodules.Skylink
-	err = slNormalized.LoadString(link)
-	if err != nil {
-		return errors.AddContext(err, "invalid skylink provided")
-	}
-	*sl = skylink(slNormalized.String())
+	*sl = skylink{link: link, form: form}
 	return nil
 }
 
+// MarshalJSON implements json.Marshaler for a skylink, only the normalized
+// skylink is encoded.
+func (sl skylink) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sl.link)
+}
+
 // blocklistGET returns a list of blocked hashes and associated tags. This route
 // allows paging through the result set by the following query string
 // parameters: 'sort', 'offset' and 'limit', which default to 'asc', 0 and 1000.
 // The results are sorted on the 'timestamp_added' field, but the caller can
 // request to see the newest results first. The default limit also serves as a
-// limit.
+// limit. The 'hashPrefix' parameter only returns the hashes that start with
+// the given prefix, it allows looking up a hash that was truncated in a log
+// line, in which case at most 20 entries are returned. Admins can list the
+// blocklist of another namespace through the 'namespace' parameter.
 func (api *API) blocklistGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// parse offset and limit parameters
-	sort, offset, limit, err := parseListParameters(r.URL.Query())
+	limits := api.staticConfig.limits()
+	sort, offset, limit, err := parseListParameters(r.URL.Query(), limits.MaxPageSize)
 	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	blocked, more, err := api.staticDB.BlockedHashes(r.Context(), sort, offset, limit)
+	// parse the hash prefix
+	var opts []database.QueryOption
+	prefix, err := parseHashPrefix(r.URL.Query())
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if prefix != "" {
+		opts = append(opts, database.WithHashPrefix(prefix))
+		if limit > limits.MaxHashPrefixMatches {
+			limit = limits.MaxHashPrefixMatches
+		}
+	}
+
+	// parse the namespace, only admins can cross into another namespace
+	if ns := r.URL.Query().Get("namespace"); ns != "" && ns != api.staticDB.Namespace() {
+		if !api.checkAdmin(w, r) {
+			return
+		}
+		err = database.ValidateNamespace(ns)
+		if err != nil {
+			WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, database.InNamespace(ns))
+	}
+
+	blocked, more, err := api.staticDB.BlockedHashes(r.Context(), sort, offset, limit, opts...)
 	if err != nil {
 		WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -156,7 +407,7 @@ func (api *API) blocklistGET(w http.ResponseWriter, r *http.Request, _ httproute
 	hashes := make([]BlockedHash, len(blocked))
 	for i, bh := range blocked {
 		hashes[i] = BlockedHash{
-			Hash: bh.Hash.Hash,
+			Hash: bh.Hash,
 			Tags: bh.Tags,
 		}
 	}
@@ -166,19 +417,41 @@ func (api *API) blocklistGET(w http.ResponseWriter, r *http.Request, _ httproute
 	})
 }
 
-// healthGET returns the status of the service
-func (api *API) healthGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	status := struct {
-		DBAlive bool `json:"dbAlive"`
-	}{}
+// timeseriesGET returns the number of reported skylinks over time, grouped in
+// buckets by source.
+func (api *API) timeseriesGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// parse bucket and window parameters
+	bucket, window, err := parseTimeseriesParameters(r.URL.Query())
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 
-	// Apply a timeout.
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	buckets, err := api.staticDB.ActivitySeries(r.Context(), bucket, window)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	latency, err := api.staticDB.BlockLatency(r.Context(), database.Now().Add(-window))
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
 
-	err := api.staticDB.Ping(ctx)
-	status.DBAlive = err == nil
-	skyapi.WriteJSON(w, status)
+	failures, err := api.staticDB.FailureCounts(r.Context())
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	skyapi.WriteJSON(w, TimeseriesGET{
+		Bucket:   bucket.String(),
+		Window:   window.String(),
+		Buckets:  buckets,
+		Latency:  latency,
+		Failures: failures,
+	})
 }
 
 // blockPOST blocks a skylink
@@ -187,9 +460,44 @@ func (api *API) healthGET(w http.ResponseWriter, r *http.Request, _ httprouter.P
 // by trusted sources such as the malware scanner or abuse email scanner. There
 // is another route called 'blockWithPoWPOST' that requires some proof of work
 // to be done by means of 'authenticating' the caller.
+// Requests can carry the API key of a trusted reporter, or be signed with it,
+// which is recorded on the origin of the report and might restrict the tags it
+// can apply.
 func (api *API) blockPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, sub, source, ok := api.readBlockPOST(w, r)
+	if !ok {
+		return
+	}
+
+	// Handle the request
+	api.handleBlockRequest(r.Context(), w, body, sub, source)
+}
+
+// blockValidatePOST validates a block request without blocking anything. It
+// takes the same request as blockPOST, runs the same checks and returns the
+// outcome blocking it would have, along with the resolved hash. It's meant to
+// be used by reporters that are developing an integration.
+func (api *API) blockValidatePOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, sub, source, ok := api.readBlockPOST(w, r)
+	if !ok {
+		return
+	}
+	d, code, err := api.decideBlockRequest(r.Context(), &body, sub, source)
+	if err != nil {
+		WriteError(w, err, code)
+		return
+	}
+	skyapi.WriteJSON(w, d.validation())
+}
+
+// readBlockPOST reads the block post object of a request to the /block
+// routes, enforces the tag restrictions of its API key and identifies the
+// reporter. It returns the object, the reporter's sub and the source of the
+// report. If the request is invalid an error is written and false is
+// returned.
+func (api *API) readBlockPOST(w http.ResponseWriter, r *http.Request) (BlockPOST, string, string, bool) {
 	// Protect against large bodies.
-	b := http.MaxBytesReader(w, r.Body, maxBodySize)
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
 	defer b.Close()
 
 	// Parse the request.
@@ -197,21 +505,38 @@ func (api *API) blockPOST(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	err := json.NewDecoder(b).Decode(&body)
 	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
-		return
+		return BlockPOST{}, "", "", false
 	}
 
-	// Get the sub from the form
-	sub := r.FormValue("sub")
-	if sub == "" {
-		// No sub. Maybe we didn't try to fetch it? Try now. Don't log errors.
-		u, err := UserFromReq(r, api.staticLogger)
-		if err == nil {
-			sub = u.Sub
-		}
+	// Normalize the tags.
+	err = body.normalizeTags()
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return BlockPOST{}, "", "", false
 	}
 
-	// Handle the request
-	api.handleBlockRequest(r.Context(), w, body, sub)
+	// Enforce the tag restrictions of the API key, if one is given.
+	body.KeyID, err = api.checkAPIKey(requestAPIKey(r), body.Tags)
+	if errors.Contains(err, errUnknownAPIKey) {
+		WriteError(w, err, http.StatusUnauthorized)
+		return BlockPOST{}, "", "", false
+	}
+	if err != nil {
+		WriteError(w, err, http.StatusForbidden)
+		return BlockPOST{}, "", "", false
+	}
+
+	// Identify the reporter, errors aren't logged as most reports don't
+	// carry a cookie.
+	sub, err := api.requestSub(r, body.KeyID)
+	body.AttributionPending = errors.Contains(err, errAccountsUnavailable)
+
+	// Reports pushed by peer blockers are stored as synced reports
+	source := database.SourceAPI
+	if body.Portal != "" {
+		source = database.SourceSync
+	}
+	return body, sub, source, true
 }
 
 // blockWithPoWPOST blocks a skylink. It is meant to be used by untrusted
@@ -221,7 +546,7 @@ func (api *API) blockPOST(w http.ResponseWriter, r *http.Request, _ httprouter.P
 // us to more easily unblock a batch of links.
 func (api *API) blockWithPoWPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Protect against large bodies.
-	b := http.MaxBytesReader(w, r.Body, maxBodySize)
+	b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
 	defer b.Close()
 
 	// Parse the request.
@@ -232,155 +557,959 @@ func (api *API) blockWithPoWPOST(w http.ResponseWriter, r *http.Request, _ httpr
 		return
 	}
 
+	// Only peer blockers can push reports of other portals.
+	body.Portal = ""
+
+	// Normalize the tags.
+	err = body.normalizeTags()
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Validate the batch, every skylink in the batch counts as a report.
+	err = body.validateBatch(api.staticConfig.limits().MaxBatchSize)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	numReports := 1
+	if len(body.Skylinks) > 0 {
+		numReports = len(body.Skylinks)
+	}
+
 	// Use the MySkyID as the sub to consider the reporter authenticated.
 	sub := hex.EncodeToString(body.PoW.MySkyID[:])
 
+	// Reject proofs of blocked identities before verifying them, the reports
+	// are attributed to the MySkyID of the proof.
+	blocked, err := api.staticDB.IsIdentityBlocked(r.Context(), sub)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to check blocked identities"), http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		WriteError(w, errIdentityBlocked, http.StatusForbidden)
+		return
+	}
+	body.MySkyID = sub
+
 	// Verify the pow.
-	err = body.PoW.Verify()
+	err = body.PoW.Verify(api.staticConfig.PoWSecret, api.acceptV1Proofs())
 	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 
+	// Verify the reporter has not exceeded the amount of reports it is allowed
+	// to make within the report window.
+	quota, err := api.checkReportLimit(r.Context(), sub, numReports)
+	if errors.Contains(err, errTooManyReports) {
+		quota.writeHeaders(w)
+		WriteError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to check report limit"), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep track of how many times the proof has been used, this prevents the
+	// same proof from being reused to report an unlimited amount of skylinks.
+	// Every skylink in a batch counts as a use of the proof.
+	proofHash := database.HashBytes(body.PoW.ProofBytes())
+	uses, err := api.staticDB.IncrementProofUsage(r.Context(), proofHash, numReports)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to track proof usage"), http.StatusInternalServerError)
+		return
+	}
+	if uses > api.staticConfig.MaxProofUses {
+		WriteError(w, errProofReused, http.StatusTooManyRequests)
+		return
+	}
+
+	// Record the report.
+	err = api.staticDB.RecordReports(r.Context(), sub, numReports, database.Now())
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to record report"), http.StatusInternalServerError)
+		return
+	}
+	quota.consume(numReports)
+	quota.writeHeaders(w)
+
 	// Handle the request
-	api.handleBlockRequest(r.Context(), w, body.BlockPOST, sub)
+	if len(body.Skylinks) > 0 {
+		api.handleBatchBlockRequest(r.Context(), w, body.BlockPOST, body.Skylinks, sub, database.SourcePoW)
+		return
+	}
+	api.handleBlockRequest(r.Context(), w, body.BlockPOST, sub, database.SourcePoW)
 }
 
 // blockWithPoWGET is the handler for the /blockpow [GET] endpoint.
 func (api *API) blockWithPoWGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	difficulty := uint64(math.MaxUint64)
+	if d := modules.Difficulty(modules.MySkyTarget); d.IsUint64() {
+		difficulty = d.Uint64()
+	}
 	skyapi.WriteJSON(w, BlockWithPoWGET{
-		Target: hex.EncodeToString(modules.MySkyTarget[:]),
+		Target:            hex.EncodeToString(modules.MySkyTarget[:]),
+		Challenge:         modules.NewPoWChallenge(api.staticConfig.PoWSecret),
+		Difficulty:        difficulty,
+		ReferenceHashRate: uint64(api.staticHashRate),
+		Versions:          modules.ProofVersions(api.acceptV1Proofs()),
 	})
 }
 
 // handleBlockRequest is a handler that is called by both the regular and PoW
 // block handlers. It executes all code which is shared between the two
-// handlers.
-func (api *API) handleBlockRequest(ctx context.Context, w http.ResponseWriter, bp BlockPOST, sub string) {
-	// Resolve the post body into a hash
-	hash, err := api.resolveHash(bp)
+// handlers. The response is shaped by the auth level of the source, see
+// writeBlockResponse.
+func (api *API) handleBlockRequest(ctx context.Context, w http.ResponseWriter, bp BlockPOST, sub, source string) {
+	level := sourceAuthLevel(source)
+
+	// Decide what to do with the report
+	d, code, err := api.decideBlockRequest(ctx, &bp, sub, source)
 	if err != nil {
-		// return an internal server error if the resolve failed due to skyd
-		// either being down or behaving unexpectedly
-		code := http.StatusBadRequest
-		if errors.Contains(err, errResolve) {
-			code = http.StatusInternalServerError
-		}
-		WriteError(w, errors.AddContext(err, "failed to resolve hash"), code)
+		WriteError(w, err, code)
 		return
 	}
+	api.managedCountReport(bp.form())
+	bs := d.skylink
+	existing := d.existing
+	logger := api.staticLogger.WithField("hash", bs.Hash.String())
 
-	// Check whether the skylink is on the allow list
-	if api.isAllowListed(ctx, hash) {
-		skyapi.WriteJSON(w, statusResponse{"reported"})
+	switch d.outcome {
+	case blockOutcomeAllowListed:
+		api.recordAllowListHit(bs.Hash.Hash, bp, sub, source)
+		api.writeBlockResponse(w, statusResponse{Status: "reported", Hash: bs.Hash.String()}, level)
+		return
+	case blockOutcomeDuplicate:
+		// Reports of content that is already blocked only touch the
+		// database if they add new tags.
+		err = api.addNewTags(ctx, d, logger)
+		if err != nil {
+			WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		api.writeBlockResponse(w, newDuplicateResponse(bs.Hash, existing), level)
 		return
 	}
 
-	// Create a blocked skylink object
-	bs := &database.BlockedSkylink{
-		Hash: database.Hash{Hash: hash},
-		Reporter: database.Reporter{
-			Name:            bp.Reporter.Name,
-			Email:           bp.Reporter.Email,
-			OtherContact:    bp.Reporter.OtherContact,
-			Sub:             sub,
-			Unauthenticated: sub == "",
-		},
-		Tags:           bp.Tags,
-		TimestampAdded: time.Now().UTC(),
+	// Archived skylinks are blocked anew, they're restored from the archive
+	// so they keep their history
+	archived := existing != nil && existing.Archived
+	if archived {
+		existing = nil
+	}
+
+	// Check whether the content still exists, missing content is blocked
+	// after the other reports as it's less likely to be served
+	if existing == nil {
+		bs.ContentMissing = api.contentMissing(ctx, bp, logger)
 	}
 
 	// Block the link.
-	api.staticLogger.Debugf("blocking hash %s", bs.Hash)
-	err = api.staticDB.CreateBlockedSkylink(ctx, bs)
+	logger.Debug("blocking hash")
+	if archived {
+		err = api.restoreArchived(ctx, bs)
+	} else {
+		err = api.staticDB.CreateBlockedSkylink(ctx, bs)
+	}
 	if errors.Contains(err, database.ErrSkylinkExists) {
-		skyapi.WriteJSON(w, statusResponse{"duplicate"})
+		// the skylink might have been marked as invalid, in which case we
+		// resurrect it rather than report a duplicate
+		resurrected, err := api.resurrectInvalid(ctx, bs)
+		if err != nil {
+			WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if resurrected {
+			logger.Info("resurrected invalid hash")
+			api.writeBlockResponse(w, statusResponse{Status: "reported", Hash: bs.Hash.String()}, level)
+			return
+		}
+
+		// the skylink might have been reported concurrently, in which case
+		// we didn't find it before
+		if existing == nil {
+			existing, err = api.staticDB.FindByHash(ctx, bs.Hash)
+			if err != nil {
+				WriteError(w, errors.AddContext(err, "failed to find existing skylink"), http.StatusInternalServerError)
+				return
+			}
+		}
+		api.writeBlockResponse(w, newDuplicateResponse(bs.Hash, existing), level)
 		return
 	}
 	if err != nil {
 		WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.staticLogger.Debugf("blocked hash %s", bs.Hash)
-	skyapi.WriteJSON(w, statusResponse{"reported"})
+	if archived {
+		logger.Info("restored archived hash")
+	}
+	logger.Debug("blocked hash")
+	api.managedNotifyBlocked(*bs)
+	api.writeBlockResponse(w, statusResponse{Status: "reported", Hash: bs.Hash.String()}, level)
 }
 
-// isAllowListed returns true if the given skylink is on the allow list
+// addNewTags adds the new tags of the given decision of a duplicate report to
+// the skylink that's blocked already.
+func (api *API) addNewTags(ctx context.Context, d blockDecision, logger *logrus.Entry) error {
+	if len(d.newTags) == 0 {
+		return nil
+	}
+	err := api.staticDB.AddTags(ctx, d.skylink.Hash, d.newTags)
+	if err != nil && !errors.Contains(err, database.ErrNoDocumentsFound) {
+		return errors.AddContext(err, "failed to add tags")
+	}
+	logger.WithField("tags", d.newTags).Debug("added tags to blocked hash")
+	d.existing.Tags = append(d.existing.Tags, d.newTags...)
+	return nil
+}
+
+// restoreArchived restores the archived skylink the given skylink reports
+// again, it keeps its history. It returns database.ErrSkylinkExists if the
+// skylink was restored concurrently.
+func (api *API) restoreArchived(ctx context.Context, bs *database.BlockedSkylink) error {
+	err := api.staticDB.RestoreArchived(ctx, bs.Hash, bs)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		return database.ErrSkylinkExists
+	}
+	return err
+}
+
+// managedNotifyBlocked notifies the listeners of a newly blocked skylink,
+// reports of critical severity are fast-tracked.
+func (api *API) managedNotifyBlocked(bs database.BlockedSkylink) {
+	api.managedNotifyReport(bs)
+	if bs.Severity == database.SeverityCritical {
+		api.staticLogger.WithFields(logrus.Fields{"hash": bs.Hash.String(), "tags": bs.Tags}).Info("reported hash of critical severity")
+		api.managedNotifyCritical(bs)
+	}
+}
+
+// decideBlockRequest runs the checks of the given report, made through the
+// given source, and decides what blocking it would do without writing
+// anything. Reports attributed to a blocked identity are flagged on the given
+// block post object. If the report is rejected the returned error comes with
+// the status code of the response.
+func (api *API) decideBlockRequest(ctx context.Context, bp *BlockPOST, sub, source string) (blockDecision, int, error) {
+	// Validate the callback URL
+	err := api.validateCallbackURL(bp.CallbackURL)
+	if err != nil {
+		return blockDecision{}, http.StatusBadRequest, err
+	}
+
+	// Flag reports attributed to a blocked identity
+	err = api.attributeIdentity(ctx, bp, source)
+	if errors.Contains(err, errInvalidMySkyID) {
+		return blockDecision{}, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return blockDecision{}, http.StatusInternalServerError, err
+	}
+
+	// Resolve the post body into a hash
+	hash, publisher, err := api.resolveHashAndPublisher(*bp)
+	if err != nil {
+		return blockDecision{}, resolveErrorCode(err), errors.AddContext(err, "failed to resolve hash")
+	}
+	return api.decideReport(ctx, *bp, hash, publisher, sub, source)
+}
+
+// decideReport decides what blocking the given report of the given hash, which
+// was resolved from the given publisher's skylink if any, would do. It's the
+// part of decideBlockRequest that's run for every skylink of a batch. If the
+// report can't be decided the returned error comes with the status code of the
+// response.
+func (api *API) decideReport(ctx context.Context, bp BlockPOST, hash crypto.Hash, publisher, sub, source string) (blockDecision, int, error) {
+	// Create a blocked skylink object
+	bs := newBlockedSkylink(hash, bp, sub, source, api.staticConfig.reporterSalt())
+	bs.Severity = api.reportSeverity(bp, bs.Tags)
+	d := blockDecision{skylink: bs}
+
+	// Check whether the skylink or its publisher is on the allow list
+	allowlisted, err := api.isAllowListed(ctx, hash, publisher)
+	if err != nil {
+		return blockDecision{}, http.StatusServiceUnavailable, err
+	}
+	if allowlisted {
+		d.outcome = blockOutcomeAllowListed
+		return d, 0, nil
+	}
+
+	// Check whether the skylink was reported before. Reports of content
+	// that is already blocked, e.g. through another v2 skylink pointing to
+	// the same content, only add their new tags. Invalid and archived
+	// skylinks are resurrected.
+	d.existing, err = api.staticDB.FindByHash(ctx, bs.Hash, database.IncludeArchived())
+	if err != nil {
+		return blockDecision{}, http.StatusInternalServerError, errors.AddContext(err, "failed to find existing skylink")
+	}
+	switch {
+	case d.existing == nil:
+		d.outcome = blockOutcomeBlock
+	case d.existing.Archived:
+		d.outcome = blockOutcomeResurrect
+	case d.existing.IsBlocked():
+		d.outcome = blockOutcomeDuplicate
+		d.newTags = newTags(d.existing.Tags, bs.Tags)
+	case d.existing.Invalid:
+		d.outcome = blockOutcomeResurrect
+	default:
+		d.outcome = blockOutcomeDuplicate
+	}
+	return d, 0, nil
+}
+
+// validation returns the response of the /block/validate endpoint for the
+// decision.
+func (d blockDecision) validation() BlockValidation {
+	status := "reported"
+	if d.outcome == blockOutcomeDuplicate {
+		status = "duplicate"
+	}
+	return BlockValidation{
+		Status:   status,
+		Outcome:  d.outcome,
+		Hash:     d.skylink.Hash.String(),
+		Tags:     d.skylink.Tags,
+		NewTags:  d.newTags,
+		Severity: d.skylink.Severity,
+	}
+}
+
+// contentMissing returns whether skyd reports the content of the skylink in
+// the given report as missing. The check is only done if pre-flight checks are
+// enabled and the report carries a skylink, hashes can't be checked. To bound
+// the load on skyd, reports that come in while the maximum number of checks is
+// in flight are not checked. If the check fails, the content is assumed to
+// exist.
+func (api *API) contentMissing(ctx context.Context, bp BlockPOST, logger *logrus.Entry) bool {
+	if !api.staticConfig.PreflightCheck || api.staticSkydClient == nil || bp.Skylink.link == "" {
+		return false
+	}
+	select {
+	case api.staticPreflight <- struct{}{}:
+		defer func() { <-api.staticPreflight }()
+	default:
+		logger.Debug("skipped pre-flight check, too many checks in flight")
+		return false
+	}
+
+	var sl skymodules.Skylink
+	err := sl.LoadString(bp.Skylink.link)
+	if err != nil {
+		return false
+	}
+	available, err := api.staticSkydClient.ContentAvailable(ctx, sl)
+	if err != nil {
+		logger.WithError(err).Debug("pre-flight check failed")
+		return false
+	}
+	if !available {
+		logger.Info("reported content is missing")
+	}
+	return !available
+}
+
+// checkAPIKey returns the ID of the given API key if it's allowed to apply the
+// given tags. It returns errUnknownAPIKey if the key is not configured and an
+// error naming the first disallowed tag if the key is restricted to a set of
+// tags that doesn't contain all given tags. Requests without a key are not
+// restricted.
+func (api *API) checkAPIKey(key string, tags []string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	apiKey, exists := api.staticAPIKeys[key]
+	if !exists {
+		return "", errUnknownAPIKey
+	}
+	if len(apiKey.Tags) == 0 {
+		return apiKey.ID, nil
+	}
+	allowed := make(map[string]struct{}, len(apiKey.Tags))
+	for _, tag := range apiKey.Tags {
+		allowed[database.NormalizeTag(tag)] = struct{}{}
+	}
+	for _, tag := range tags {
+		if _, ok := allowed[database.NormalizeTag(tag)]; !ok {
+			return "", fmt.Errorf("API key '%v' is not allowed to apply tag '%v'", apiKey.ID, tag)
+		}
+	}
+	return apiKey.ID, nil
+}
+
+// checkReportLimit returns errTooManyReports if the given MySkyID is not
+// allowed to report n more skylinks because it would exceed the maximum number
+// of reports within the report window. Trusted MySkyIDs are exempt. It returns
+// the MySkyID's quota, which is nil for trusted MySkyIDs.
+//
+// NOTE: the check and the recording of the report are not atomic, concurrent
+// requests by the same MySkyID can slightly exceed the limit which is fine.
+func (api *API) checkReportLimit(ctx context.Context, mySkyID string, n int) (*reportQuota, error) {
+	if _, trusted := api.staticConfig.TrustedMySkyIDs[mySkyID]; trusted {
+		return nil, nil
+	}
+	now := database.Now()
+	reports, oldest, err := api.staticDB.ReportUsage(ctx, mySkyID, now.Add(-database.ReportWindow))
+	if err != nil {
+		return nil, err
+	}
+	quota := newReportQuota(api.staticConfig.MaxDailyReports, reports, oldest, now)
+	if reports+n > api.staticConfig.MaxDailyReports {
+		return quota, errTooManyReports
+	}
+	return quota, nil
+}
+
+// handleBatchBlockRequest is a handler that blocks a batch of skylinks, which
+// are all reported using the reporter and tags of the given block post object.
+// Every skylink gets resolved and decided on like a single report, see
+// decideReport, before any of them is applied, after which the new ones are
+// inserted in bulk. The response contains a status for every skylink, it's
+// shaped by the auth level of the source, see writeBlockResponse.
+func (api *API) handleBatchBlockRequest(ctx context.Context, w http.ResponseWriter, bp BlockPOST, skylinks []skylink, sub, source string) {
+	err := api.validateCallbackURL(bp.CallbackURL)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = api.attributeIdentity(ctx, &bp, source)
+	if errors.Contains(err, errInvalidMySkyID) {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	statuses := make([]skylinkStatus, len(skylinks))
+
+	// Resolve every skylink into a hash and decide what to do with it. This
+	// doesn't write anything, if a report can't be decided the entire batch
+	// is rejected so it can be retried as a whole. The decision is nil for
+	// skylinks that can't be resolved.
+	reports := make([]BlockPOST, len(skylinks))
+	decisions := make([]*blockDecision, len(skylinks))
+	for i, sl := range skylinks {
+		statuses[i].Skylink = sl.link
+
+		// Resolve the skylink into a hash
+		reports[i] = bp
+		reports[i].Skylink = sl
+		reports[i].Hash = database.Hash{}
+		hash, publisher, err := api.resolveHashAndPublisher(reports[i])
+		if err != nil {
+			statuses[i].Status = "failed"
+			statuses[i].Error = errors.AddContext(err, "failed to resolve hash").Error()
+			continue
+		}
+		statuses[i].Hash = database.Hash{Hash: hash}.String()
+
+		// Decide what to do with the report
+		d, code, err := api.decideReport(ctx, reports[i], hash, publisher, sub, source)
+		if err != nil {
+			WriteError(w, err, code)
+			return
+		}
+		decisions[i] = &d
+	}
+
+	// Collect the skylinks to block and check whether their content still
+	// exists, see handleBlockRequest. Archived skylinks are restored one by
+	// one so they keep their history, the others are inserted in bulk, keep
+	// track of the index of the status every skylink to block belongs to
+	var toBlock []database.BlockedSkylink
+	var indices []int
+	for i, d := range decisions {
+		if d == nil || d.outcome == blockOutcomeAllowListed || d.outcome == blockOutcomeDuplicate {
+			continue
+		}
+		archived := d.existing != nil && d.existing.Archived
+		if d.existing == nil || archived {
+			logger := api.staticLogger.WithField("hash", d.skylink.Hash.String())
+			d.skylink.ContentMissing = api.contentMissing(ctx, reports[i], logger)
+		}
+		if !archived {
+			toBlock = append(toBlock, *d.skylink)
+			indices = append(indices, i)
+		}
+	}
+
+	// Block the links. This is the only write that rejects the entire
+	// batch, so it's done before any of the other reports is applied.
+	api.staticLogger.WithField("batch_size", len(toBlock)).Debug("blocking hashes")
+	duplicates, err := api.staticDB.CreateBlockedSkylinkBatch(ctx, toBlock)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Apply the other reports, if one of them fails only its own skylink is
+	// reported as failed
+	for i, d := range decisions {
+		if d == nil {
+			continue
+		}
+		api.managedCountReport(reports[i].form())
+		bs := d.skylink
+		logger := api.staticLogger.WithField("hash", bs.Hash.String())
+
+		switch {
+		case d.outcome == blockOutcomeAllowListed:
+			api.recordAllowListHit(bs.Hash.Hash, reports[i], sub, source)
+			statuses[i].Status = "reported"
+		case d.outcome == blockOutcomeDuplicate:
+			err = api.addNewTags(ctx, *d, logger)
+			if err != nil {
+				statuses[i].Status = "failed"
+				statuses[i].Error = err.Error()
+				continue
+			}
+			statuses[i].Status = "duplicate"
+		case d.existing != nil && d.existing.Archived:
+			err = api.restoreArchived(ctx, bs)
+			if errors.Contains(err, database.ErrSkylinkExists) {
+				statuses[i].Status = "duplicate"
+				continue
+			}
+			if err != nil {
+				statuses[i].Status = "failed"
+				statuses[i].Error = errors.AddContext(err, "failed to restore archived hash").Error()
+				continue
+			}
+			logger.Info("restored archived hash")
+			statuses[i].Status = "reported"
+			api.managedNotifyBlocked(*bs)
+		}
+	}
+
+	for _, index := range indices {
+		statuses[index].Status = "reported"
+	}
+	isDuplicate := make(map[int]struct{}, len(duplicates))
+	for _, duplicate := range duplicates {
+		isDuplicate[duplicate] = struct{}{}
+	}
+	for i := range toBlock {
+		if _, exists := isDuplicate[i]; !exists {
+			api.managedNotifyBlocked(toBlock[i])
+		}
+	}
+	for _, duplicate := range duplicates {
+		// resurrect duplicates that were marked as invalid, see
+		// handleBlockRequest
+		resurrected, err := api.resurrectInvalid(ctx, &toBlock[duplicate])
+		if err != nil {
+			api.staticLogger.WithError(err).WithField("hash", toBlock[duplicate].Hash.String()).Error("failed to resurrect invalid hash")
+		}
+		if !resurrected {
+			statuses[indices[duplicate]].Status = "duplicate"
+		}
+	}
+	api.writeBlockResponse(w, batchStatusResponse{statuses}, sourceAuthLevel(source))
+}
+
+// attributeIdentity normalizes the MySkyID the given block post object is
+// attributed to, if any, and flags the report if the MySkyID is blocked.
+// Flagged reports are tagged with blockedIdentityTag. It returns
+// errInvalidMySkyID if the MySkyID is malformed. Proof of work reports of
+// blocked identities are rejected before they get here, see blockWithPoWPOST,
+// so their identity isn't looked up again.
+func (api *API) attributeIdentity(ctx context.Context, bp *BlockPOST, source string) error {
+	if bp.MySkyID == "" {
+		return nil
+	}
+	mySkyID, err := parseMySkyID(bp.MySkyID)
+	if err != nil {
+		return err
+	}
+	bp.MySkyID = mySkyID
+	if source == database.SourcePoW {
+		return nil
+	}
+	blocked, err := api.staticDB.IsIdentityBlocked(ctx, mySkyID)
+	if err != nil {
+		return errors.AddContext(err, "failed to check blocked identities")
+	}
+	bp.IdentityBlocked = blocked
+	if blocked {
+		bp.Tags = database.NormalizeTags(append(bp.Tags, blockedIdentityTag))
+	}
+	return nil
+}
+
+// reportSeverity returns the severity of a report with the given tags made by
+// the given block post object. Reports attributed to a blocked identity are of
+// at least blockedIdentitySeverity.
+func (api *API) reportSeverity(bp BlockPOST, tags []string) string {
+	severity := api.staticConfig.Severities.Severity(tags)
+	if bp.IdentityBlocked && !database.SeverityAtLeast(severity, blockedIdentitySeverity) {
+		return blockedIdentitySeverity
+	}
+	return severity
+}
+
+// parseMySkyID returns the normalized form of the given hex encoded MySkyID,
+// it returns errInvalidMySkyID if it's not a hex encoded ed25519 public key.
+func parseMySkyID(mySkyID string) (string, error) {
+	mySkyID = strings.ToLower(strings.TrimSpace(mySkyID))
+	b, err := hex.DecodeString(mySkyID)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return "", errInvalidMySkyID
+	}
+	return mySkyID, nil
+}
+
+// resurrectInvalid resurrects the existing skylink with the same hash as the
+// given blocked skylink if it was marked as invalid, which allows content that
+// previously failed to get blocked to be reported again. It returns whether the
+// skylink got resurrected.
+func (api *API) resurrectInvalid(ctx context.Context, bs *database.BlockedSkylink) (bool, error) {
+	existing, err := api.staticDB.FindByHash(ctx, bs.Hash)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to find existing skylink")
+	}
+	if existing == nil || !existing.Invalid {
+		return false, nil
+	}
+	err = api.staticDB.ResurrectInvalid(ctx, bs.Hash, bs)
+	if errors.Contains(err, database.ErrNoDocumentsFound) {
+		// the skylink got resurrected concurrently
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to resurrect invalid skylink")
+	}
+	return true, nil
+}
+
+// validateCallbackURL returns an error if the given callback URL can't be
+// notified. An empty URL is valid, otherwise it has to be an https URL without
+// credentials that points to one of the configured callback domains.
+func (api *API) validateCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	if len(api.staticConfig.CallbackDomains) == 0 {
+		return errCallbacksDisabled
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return errors.Compose(errInvalidCallbackURL, err)
+	}
+	if u.Scheme != "https" {
+		return errors.AddContext(errInvalidCallbackURL, "scheme should be https")
+	}
+	if u.User != nil {
+		return errors.AddContext(errInvalidCallbackURL, "credentials are not allowed")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range api.staticConfig.CallbackDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return nil
+		}
+	}
+	return errors.AddContext(errInvalidCallbackURL, fmt.Sprintf("domain '%v' is not allowed", host))
+}
+
+// isAllowListed returns true if the given skylink is on the allow list, or if
+// the given publisher is, which allowlists all v2 skylinks it publishes. The
+// publisher is checked first, it's empty if the skylink wasn't reported as a
+// v2 skylink. If the allow list can't be checked it returns
+// errAllowListUnavailable, unless the API is configured to fail open, in which
+// case the skylink is considered not to be allowlisted.
 //
 // NOTE: the given skylink is expected to be a v1 skylink, meaning the caller of
 // this function should have tried to resolve the skylink beforehand
-func (api *API) isAllowListed(ctx context.Context, hash crypto.Hash) bool {
-	allowlisted, err := api.staticDB.IsAllowListed(ctx, hash)
+func (api *API) isAllowListed(ctx context.Context, hash crypto.Hash, publisher string) (bool, error) {
+	var allowlisted bool
+	var err error
+	if publisher != "" {
+		allowlisted, err = api.staticAllowList.IsPublisherAllowListed(ctx, publisher)
+	}
+	if err == nil && !allowlisted {
+		allowlisted, err = api.staticAllowList.IsAllowListed(ctx, hash)
+	}
 	if err != nil {
-		api.staticLogger.Error("failed to verify skylink against the allow list", err)
-		return false
+		logger := api.staticLogger.WithError(err).WithField("hash", hash.String())
+		if api.staticConfig.AllowListFailOpen {
+			logger.Warn("failed to verify skylink against the allow list, accepting the report")
+			return false, nil
+		}
+		logger.Error("failed to verify skylink against the allow list, rejecting the report")
+		return false, errAllowListUnavailable
+	}
+	return allowlisted, nil
+}
+
+// resolveErrorCode returns the status code of the given error returned by
+// resolveHash. It's a not found if the skylink's registry entry is gone, a bad
+// gateway if skyd is down and an internal server error if skyd is behaving
+// unexpectedly.
+func resolveErrorCode(err error) int {
+	switch {
+	case errors.Contains(err, ErrSkylinkNotFound):
+		return http.StatusNotFound
+	case errors.Contains(err, ErrSkydUnreachable):
+		return http.StatusBadGateway
+	case errors.Contains(err, errResolve):
+		return http.StatusInternalServerError
 	}
-	return allowlisted
+	return http.StatusBadRequest
 }
 
 // resolveHash resolves the given block post object into a hash. If a hash was
 // already given, it will simply return that. If a skylink was given, it will
 // try to resolve it first if necessary and return the hash of the v1 skylink.
 func (api *API) resolveHash(bp BlockPOST) (crypto.Hash, error) {
+	hash, _, err := api.resolveHashAndPublisher(bp)
+	return hash, err
+}
+
+// resolveHashAndPublisher resolves the given block post object into a hash like
+// resolveHash, it also returns the public key of the publisher of a reported v2
+// skylink, see ResolveSkylinkPublisher. The publisher is empty for all other
+// reports.
+func (api *API) resolveHashAndPublisher(bp BlockPOST) (crypto.Hash, string, error) {
 	// validate the block post
 	err := bp.validate()
 	if err != nil {
-		return crypto.Hash{}, err
+		return crypto.Hash{}, "", err
 	}
 
 	// if the hash is set, we are done
-	if bp.Hash != (crypto.Hash{}) {
-		return bp.Hash, nil
+	if bp.Hash != (database.Hash{}) {
+		return bp.Hash.Hash, "", nil
+	}
+
+	// if the merkle root is set, hash it the same way NewHash does
+	if bp.MerkleRoot != (database.Hash{}) {
+		return crypto.HashObject(bp.MerkleRoot.Hash), "", nil
 	}
 
 	// decode the skylink
 	var skylink skymodules.Skylink
-	err = skylink.LoadString(string(bp.Skylink))
+	err = skylink.LoadString(bp.Skylink.link)
 	if err != nil {
-		return crypto.Hash{}, errors.AddContext(err, "failed to load skylink")
+		return crypto.Hash{}, "", errors.AddContext(err, "failed to load skylink")
 	}
 
-	// resolve the skylink
-	skylink, err = api.staticSkydClient.ResolveSkylink(skylink)
+	// resolve the skylink, v2 skylinks can't be resolved without skyd
+	if api.staticSkydClient == nil {
+		if !skylink.IsSkylinkV1() {
+			return crypto.Hash{}, "", errResolveUnavailable
+		}
+		return crypto.HashObject(skylink.MerkleRoot()), "", nil
+	}
+	skylink, publisher, err := api.staticSkydClient.ResolveSkylinkPublisher(skylink)
 	if err != nil {
-		return crypto.Hash{}, errors.Compose(err, errResolve)
+		return crypto.Hash{}, "", errors.Compose(err, errResolve)
 	}
 
 	// sanity check the skylink is a v1 skylink
 	if !skylink.IsSkylinkV1() {
-		return crypto.Hash{}, errors.Compose(err, errResolve)
+		return crypto.Hash{}, "", errors.Compose(errResolvedToV2, errResolve)
 	}
 
 	// return the hash
-	return crypto.HashObject(skylink.MerkleRoot()), nil
+	return crypto.HashObject(skylink.MerkleRoot()), publisher, nil
+}
+
+// validateBatch returns an error if the block post object contains a batch of
+// skylinks that is larger than the given size, or if it contains a batch of
+// skylinks as well as a single skylink or hash.
+func (bp *BlockWithPoWPOST) validateBatch(maxSize int) error {
+	if len(bp.Skylinks) == 0 {
+		return nil
+	}
+	if len(bp.Skylinks) > maxSize {
+		return fmt.Errorf("too many skylinks, a batch can contain at most %v skylinks", maxSize)
+	}
+	if bp.Hash != (database.Hash{}) || bp.Skylink.link != "" || bp.MerkleRoot != (database.Hash{}) {
+		return errors.New("skylinks can not be combined with a hash, skylink or merkle root")
+	}
+	return errors.AddContext(database.ValidateMetadata(bp.Metadata), "invalid metadata")
 }
 
 // validate returns an error if the block post object does not contain a hash or
-// skylink
+// skylink, or if it contains invalid metadata.
 func (bp *BlockPOST) validate() error {
-	if bp.Hash == (crypto.Hash{}) && bp.Skylink == "" {
-		return errors.New("hash or skylink is required")
+	hasRoot := bp.MerkleRoot != (database.Hash{})
+	if bp.Hash == (database.Hash{}) && bp.Skylink.link == "" && !hasRoot {
+		return errors.New("hash, skylink or merkle root is required")
 	}
-	return nil
+	if hasRoot && (bp.Hash != (database.Hash{}) || bp.Skylink.link != "") {
+		return errors.New("merkle root can not be combined with a hash or skylink")
+	}
+	if bp.Portal != "" {
+		u, err := url.Parse(bp.Portal)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid portal '%v', should be the url of a portal", bp.Portal)
+		}
+	}
+	return errors.AddContext(database.ValidateMetadata(bp.Metadata), "invalid metadata")
 }
 
-// extractSkylinkHash extracts the skylink hash from the given skylink that
-// might have protocol, path, etc. within it.
-func extractSkylinkHash(skylink string) (string, error) {
-	extractSkylinkRE := regexp.MustCompile("^.*([a-z0-9]{55})|([a-zA-Z0-9-_]{46}).*$")
-	m := extractSkylinkRE.FindStringSubmatch(skylink)
-	if len(m) < 3 || (m[1] == "" && m[2] == "") {
-		return "", errors.New("no valid skylink found in string " + skylink)
+// form returns the form in which the hash, merkle root or skylink of the block
+// post object was reported, see modules.SkylinkForms. It's empty if none of
+// them is set.
+func (bp *BlockPOST) form() string {
+	if bp.Hash != (database.Hash{}) {
+		return modules.SkylinkFormHash
 	}
-	if m[1] != "" {
-		return m[1], nil
+	if bp.MerkleRoot != (database.Hash{}) {
+		return modules.SkylinkFormMerkleRoot
 	}
-	return m[2], nil
+	return bp.Skylink.form
+}
+
+// normalizeTags normalizes the tags of the block post object, see
+// database.NormalizeTags, and returns an error if they exceed the limits.
+func (bp *BlockPOST) normalizeTags() error {
+	bp.Tags = database.NormalizeTags(bp.Tags)
+	return errors.AddContext(database.ValidateTags(bp.Tags), "invalid tags")
+}
+
+// acceptV1Proofs returns whether v1 proofs are still accepted.
+func (api *API) acceptV1Proofs() bool {
+	deadline := api.staticConfig.PoWV1Deadline
+	return deadline.IsZero() || time.Now().Before(deadline)
+}
+
+// newBlockedSkylink returns a blocked skylink object for the given hash,
+// reported through the given source using the reporter and tags of the given
+// block post object. Reports with a portal originate from that portal, reports
+// with a sub from a user and the others from a trusted service. If a salt is
+// given the reporter gets anonymized.
+func newBlockedSkylink(hash crypto.Hash, bp BlockPOST, sub, source string, salt []byte) *database.BlockedSkylink {
+	reporter := database.Reporter{
+		Name:               bp.Reporter.Name,
+		Email:              bp.Reporter.Email,
+		OtherContact:       bp.Reporter.OtherContact,
+		Sub:                sub,
+		Unauthenticated:    sub == "",
+		AttributionPending: bp.AttributionPending,
+	}
+	reporter.Normalize()
+	if salt != nil {
+		reporter.Anonymize(salt)
+	}
+	origin := database.Origin{Type: database.OriginTypeService, Identifier: reporter.Name}
+	if reporter.Sub != "" {
+		origin = database.Origin{Type: database.OriginTypeUser, Identifier: reporter.Sub}
+	}
+	var seenOnPortals []string
+	if bp.Portal != "" {
+		origin = database.Origin{Type: database.OriginTypePortal, URL: bp.Portal}
+		seenOnPortals = []string{bp.Portal}
+	}
+	origin.KeyID = bp.KeyID
+	origin.Form = bp.form()
+	return &database.BlockedSkylink{
+		CallbackURL:    bp.CallbackURL,
+		Hash:           database.Hash{Hash: hash},
+		Metadata:       bp.Metadata,
+		Origin:         origin,
+		Reporter:       reporter,
+		SeenOnPortals:  seenOnPortals,
+		Source:         source,
+		Tags:           bp.Tags,
+		TimestampAdded: database.Now(),
+	}
+}
+
+// recordAllowListHit records a report of the given allowlisted hash. The hit
+// is written in the background, so it never delays the response, failing to
+// record it only gets logged.
+func (api *API) recordAllowListHit(hash crypto.Hash, bp BlockPOST, sub, source string) {
+	bs := newBlockedSkylink(hash, bp, sub, source, api.staticConfig.reporterSalt())
+	hit := database.AllowListHit{
+		Hash:           bs.Hash,
+		Reporter:       allowListHitReporter(bs.Origin),
+		Source:         source,
+		TimestampAdded: bs.TimestampAdded,
+	}
+	go api.threadedRecordAllowListHit(hit)
+}
+
+// threadedRecordAllowListHit writes the given allowlist hit to the database.
+func (api *API) threadedRecordAllowListHit(hit database.AllowListHit) {
+	ctx, cancel := context.WithTimeout(context.Background(), allowListHitTimeout)
+	defer cancel()
+
+	err := api.staticDB.RecordAllowListHit(ctx, hit)
+	if err != nil {
+		api.staticLogger.WithError(err).WithField("hash", hit.Hash.String()).Warn("failed to record allowlist hit")
+	}
+}
+
+// allowListHitReporter returns who reported an allowlisted skylink given the
+// origin of the report, being the user's sub, the id of the API key, the
+// portal it got synced from or the (anonymized) name of the reporter.
+func allowListHitReporter(origin database.Origin) string {
+	switch {
+	case origin.Type == database.OriginTypeUser:
+		return origin.Identifier
+	case origin.KeyID != "":
+		return "key:" + origin.KeyID
+	case origin.URL != "":
+		return origin.URL
+	default:
+		return origin.Identifier
+	}
+}
+
+// newDuplicateResponse returns the response to a duplicate report of the given
+// existing report of the given hash. If the existing report is nil, e.g.
+// because it got deleted concurrently, the response only contains the status
+// and the hash.
+func newDuplicateResponse(hash database.Hash, existing *database.BlockedSkylink) statusResponse {
+	resp := statusResponse{Status: "duplicate", Hash: hash.String()}
+	if existing == nil {
+		return resp
+	}
+	blocked := existing.IsBlocked()
+	resp.TimestampAdded = &existing.TimestampAdded
+	resp.Blocked = &blocked
+	resp.Tags = existing.Tags
+	if blocked {
+		resp.TimestampBlocked = &existing.TimestampBlocked
+	}
+	r := existing.Reporter
+	if r.Name != "" || r.Email != "" || r.OtherContact != "" {
+		resp.Reporter = &Reporter{
+			Name:         r.Name,
+			Email:        r.Email,
+			OtherContact: r.OtherContact,
+		}
+	}
+	return resp
+}
+
+// newTags returns the tags that are not in the given existing tags.
+func newTags(existing, tags []string) []string {
+	has := make(map[string]struct{}, len(existing))
+	for _, tag := range existing {
+		has[tag] = struct{}{}
+	}
+	var added []string
+	for _, tag := range tags {
+		if _, exists := has[tag]; !exists {
+			has[tag] = struct{}{}
+			added = append(added, tag)
+		}
+	}
+	return added
 }
 
 // parseListParameters parses sort, offset and limit from the given query. If
-// not present, they default to 1 ('asc'), 0 and 1000 respectively.
-func parseListParameters(query url.Values) (int, int, int, error) {
+// not present, they default to 1 ('asc'), 0 and the given max page size
+// respectively.
+func parseListParameters(query url.Values, maxPageSize int) (int, int, int, error) {
 	var err error
 
 	// parse sort
@@ -409,21 +1538,101 @@ func parseListParameters(query url.Values) (int, int, int, error) {
 	}
 
 	// parse limit
-	limit := maxLimit
+	limit := maxPageSize
 	limitStr := query.Get("limit")
 	if limitStr != "" {
 		limit, err = strconv.Atoi(limitStr)
 		if err != nil {
 			return 0, 0, 0, err
 		}
-		if limit < 1 || limit > maxLimit {
-			return 0, 0, 0, fmt.Errorf("invalid value for 'limit' parameter, must be between 1 and %v", maxLimit)
+		if limit < 1 || limit > maxPageSize {
+			return 0, 0, 0, fmt.Errorf("invalid value for 'limit' parameter, must be between 1 and %v", maxPageSize)
 		}
 	}
 
 	return sort, offset, limit, nil
 }
 
+// parseHashPrefix parses the hash prefix from the given query. The prefix is
+// lowercased and has to consist of at least 8 hex characters, it returns an
+// empty string if it's not present.
+func parseHashPrefix(query url.Values) (string, error) {
+	prefix := strings.ToLower(strings.TrimSpace(query.Get("hashPrefix")))
+	if prefix == "" {
+		return "", nil
+	}
+	if len(prefix) < minHashPrefixLength || len(prefix) > crypto.HashSize*2 {
+		return "", fmt.Errorf("invalid value for 'hashPrefix' parameter, must be between %v and %v characters", minHashPrefixLength, crypto.HashSize*2)
+	}
+	for _, c := range prefix {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", fmt.Errorf("invalid value for 'hashPrefix' parameter, '%v' is not hex", prefix)
+		}
+	}
+	return prefix, nil
+}
+
+// parseTimeseriesParameters parses bucket and window from the given query. Both
+// are durations which can also be expressed in days, e.g. '1d'. If not present,
+// they default to a day and 30 days respectively.
+func parseTimeseriesParameters(query url.Values) (time.Duration, time.Duration, error) {
+	var err error
+
+	// parse bucket
+	bucket := 24 * time.Hour
+	bucketStr := query.Get("bucket")
+	if bucketStr != "" {
+		bucket, err = parseDuration(bucketStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid value for 'bucket' parameter, %v", err)
+		}
+		if bucket < minTimeseriesBucket {
+			return 0, 0, fmt.Errorf("invalid value for 'bucket' parameter, must be at least %v", minTimeseriesBucket)
+		}
+	}
+
+	// parse window
+	window := 30 * 24 * time.Hour
+	windowStr := query.Get("window")
+	if windowStr != "" {
+		window, err = parseDuration(windowStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid value for 'window' parameter, %v", err)
+		}
+	}
+	if window < bucket {
+		return 0, 0, fmt.Errorf("invalid value for 'window' parameter, can not be smaller than the bucket")
+	}
+	if window/bucket >= database.MaxActivityBuckets {
+		return 0, 0, fmt.Errorf("invalid value for 'window' parameter, can contain at most %v buckets", database.MaxActivityBuckets-1)
+	}
+
+	return bucket, window, nil
+}
+
+// parseDuration parses the given duration, on top of the units supported by
+// time.ParseDuration it supports a number of days, e.g. '90d'.
+func parseDuration(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+		if err != nil {
+			return 0, err
+		}
+		if days <= 0 {
+			return 0, errors.New("must be positive")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
+
 // WriteError wraps WriteError from the skyd node api
 func WriteError(w http.ResponseWriter, err error, code int) {
 	skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, code)
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DefaultListingCacheControl is the default Cache-Control header of the
+	// successful responses of the listing routes, e.g. the blocklist. It
+	// allows caches to store them but requires them to revalidate every
+	// time.
+	DefaultListingCacheControl = "no-cache"
+
+	// noStoreCacheControl is the Cache-Control header of the responses that
+	// must not be cached, e.g. the responses of the write routes.
+	noStoreCacheControl = "no-store"
+
+	// strictTransportSecurity is the Strict-Transport-Security header of the
+	// responses of an API that's served over TLS, it instructs browsers to
+	// only use HTTPS for a year.
+	strictTransportSecurity = "max-age=31536000"
+)
+
+// listingWriter is a http.ResponseWriter that replaces the Cache-Control
+// header of unsuccessful responses, this prevents a CDN from caching errors
+// or responses of a load shedding API.
+type listingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *listingWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code != http.StatusOK {
+		w.Header().Set("Cache-Control", noStoreCacheControl)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// securityHeaders wraps the handler of the given route so every response
+// carries the security headers, along with the cache headers of the route's
+// kind. Listing routes get the configured Cache-Control header, the debug
+// routes don't get one so profiles are streamed as is, all other routes
+// must not be cached.
+func (api *API) securityHeaders(r route) httprouter.Handle {
+	cacheControl := noStoreCacheControl
+	switch r.kind {
+	case routeListing:
+		cacheControl = api.staticConfig.listingCacheControl()
+	case routeDebug:
+		cacheControl = ""
+	}
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		api.setSecurityHeaders(w)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		if r.kind == routeListing {
+			w = &listingWriter{ResponseWriter: w}
+		}
+		r.handler(w, req, ps)
+	}
+}
+
+// setSecurityHeaders sets the security headers that every response carries.
+func (api *API) setSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if api.staticConfig.TLSCertFile != "" {
+		w.Header().Set("Strict-Transport-Security", strictTransportSecurity)
+	}
+}
+
+// listingCacheControl returns the Cache-Control header of the successful
+// responses of the listing routes, it defaults to DefaultListingCacheControl.
+func (cfg Config) listingCacheControl() string {
+	if cfg.ListingCacheControl == "" {
+		return DefaultListingCacheControl
+	}
+	return cfg.ListingCacheControl
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestSecurityHeaders verifies the responses of every kind of route carry the
+// security headers and the cache headers of their kind.
+func TestSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	// serve is a helper that serves a request through a route of the given
+	// kind, the route's handler responds with the given status code
+	serve := func(cfg Config, kind routeKind, code int) http.Header {
+		api := &API{staticConfig: cfg}
+		h := api.securityHeaders(route{
+			method: http.MethodGet,
+			path:   "/",
+			kind:   kind,
+			handler: func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+				w.WriteHeader(code)
+			},
+		})
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+		if w.Code != code {
+			t.Fatal("unexpected status code", w.Code)
+		}
+		return w.Header()
+	}
+
+	cdn := Config{ListingCacheControl: "public, max-age=60"}
+	tls := Config{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}
+	tests := []struct {
+		name         string
+		cfg          Config
+		kind         routeKind
+		code         int
+		cacheControl string
+		hsts         bool
+	}{
+		{"Read", Config{}, routeRead, http.StatusOK, noStoreCacheControl, false},
+		{"Write", Config{}, routeWrite, http.StatusOK, noStoreCacheControl, false},
+		{"Listing", Config{}, routeListing, http.StatusOK, DefaultListingCacheControl, false},
+		{"ListingCDN", cdn, routeListing, http.StatusOK, "public, max-age=60", false},
+		{"ListingError", cdn, routeListing, http.StatusServiceUnavailable, noStoreCacheControl, false},
+		{"Debug", Config{}, routeDebug, http.StatusOK, "", false},
+		{"WriteTLS", tls, routeWrite, http.StatusOK, noStoreCacheControl, true},
+		{"ListingTLS", tls, routeListing, http.StatusOK, DefaultListingCacheControl, true},
+	}
+	for _, test := range tests {
+		header := serve(test.cfg, test.kind, test.code)
+		if header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Fatalf("%v: unexpected X-Content-Type-Options '%v'", test.name, header.Get("X-Content-Type-Options"))
+		}
+		if header.Get("Cache-Control") != test.cacheControl {
+			t.Fatalf("%v: unexpected Cache-Control '%v'", test.name, header.Get("Cache-Control"))
+		}
+		if (header.Get("Strict-Transport-Security") != "") != test.hsts {
+			t.Fatalf("%v: unexpected Strict-Transport-Security '%v'", test.name, header.Get("Strict-Transport-Security"))
+		}
+	}
+
+	// assert the registered routes inherit the headers
+	logger, _ := logtest.NewNullLogger()
+	api := &API{
+		staticLogger: logger.WithField("module", "api"),
+		staticRouter: httprouter.New(),
+	}
+	api.buildHTTPRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Cache-Control") != noStoreCacheControl {
+		t.Fatal("unexpected headers", w.Header())
+	}
+
+	// assert the listing cache control can't contain line breaks
+	cfg := newTestConfig()
+	cfg.ListingCacheControl = "public\r\nSet-Cookie: a=b"
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+const (
+	// HealthStatusOK, HealthStatusDegraded and HealthStatusDown are the
+	// health statuses of the blocker and of its checks, in increasing order
+	// of severity. A degraded blocker keeps serving requests, but some of
+	// its dependencies are failing, a blocker that is down can't serve
+	// requests.
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded"
+	HealthStatusDown     = "down"
+
+	// healthTimeout is the maximum amount of time the health checks are
+	// allowed to take, checks that don't return in time are failed.
+	healthTimeout = 5 * time.Second
+)
+
+type (
+	// HealthGET is the response of the /health endpoint.
+	HealthGET struct {
+		// Status is the rollup of the checks, being the status of the most
+		// severe failing check.
+		Status string        `json:"status"`
+		Checks []HealthCheck `json:"checks"`
+
+		Role           string   `json:"role"`
+		DBAlive        bool     `json:"dbAlive"`
+		SchemaHealthy  bool     `json:"schemaHealthy"`
+		MissingIndexes []string `json:"missingIndexes,omitempty"`
+
+		// Accounts is the state of the circuit breaker guarding the calls
+		// to the accounts service.
+		Accounts modules.CircuitBreakerStatus `json:"accounts"`
+
+		// Shedding is the state of the load shedder, it's omitted if load
+		// shedding is disabled.
+		Shedding *modules.LoadShedderStatus `json:"shedding,omitempty"`
+
+		// Details holds the health details of other components, e.g. the
+		// lag of the blocker.
+		Details map[string]interface{} `json:"details,omitempty"`
+	}
+
+	// HealthCheck is the result of a single health check.
+	HealthCheck struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+
+		// Latency is the number of seconds the check took.
+		Latency float64 `json:"latency"`
+		Error   string  `json:"error,omitempty"`
+	}
+
+	// healthCheck is a registered health check, the blocker takes on its
+	// severity if the check fails.
+	healthCheck struct {
+		staticName     string
+		staticSeverity string
+		staticCheckFn  func(context.Context) error
+	}
+)
+
+// healthGET returns the status of the service, it responds with a 503 if the
+// blocker is down.
+func (api *API) healthGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Apply a timeout.
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	var health HealthGET
+	health.Status, health.Checks = api.managedCheckHealth(ctx)
+	health.Role = api.staticConfig.role()
+	for _, check := range health.Checks {
+		if check.Name == "mongo" {
+			health.DBAlive = check.Status == HealthStatusOK
+		}
+	}
+	health.SchemaHealthy = api.staticDB.SchemaHealthy()
+	health.MissingIndexes = api.staticDB.MissingIndexes()
+	health.Accounts = api.staticAccountsBreaker.Status()
+	if api.staticShedder != nil {
+		shedding := api.staticShedder.Status()
+		health.Shedding = &shedding
+	}
+	if details := api.managedHealthDetails(); len(details) > 0 {
+		health.Details = details
+	}
+
+	if health.Status == HealthStatusDown {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	skyapi.WriteJSON(w, health)
+}
+
+// registerDefaultHealthChecks registers the health checks of the blocker's own
+// dependencies. The blocker is down without its database, it's degraded if
+// the database lacks indexes, if the accounts service is unreachable or if
+// skyd isn't ready.
+func (api *API) registerDefaultHealthChecks() {
+	api.RegisterHealthCheck("mongo", HealthStatusDown, api.staticDB.Ping)
+	api.RegisterHealthCheck("schema", HealthStatusDegraded, func(context.Context) error {
+		if api.staticDB.SchemaHealthy() {
+			return nil
+		}
+		return fmt.Errorf("missing indexes: %s", strings.Join(api.staticDB.MissingIndexes(), ", "))
+	})
+	api.RegisterHealthCheck("accounts", HealthStatusDegraded, func(context.Context) error {
+		status := api.staticAccountsBreaker.Status()
+		if status.State != modules.CircuitOpen {
+			return nil
+		}
+		return fmt.Errorf("accounts service unreachable after %d consecutive failures", status.ConsecutiveFailures)
+	})
+	if api.staticSkydClient != nil {
+		api.RegisterHealthCheck("skyd", HealthStatusDegraded, func(context.Context) error {
+			if !api.staticSkydClient.DaemonReady() {
+				return errors.New("skyd is not ready")
+			}
+			return nil
+		})
+	}
+}
+
+// managedCheckHealth runs all health checks concurrently and returns the
+// rollup of their statuses along with their results, in the order they were
+// registered.
+func (api *API) managedCheckHealth(ctx context.Context) (string, []HealthCheck) {
+	api.staticMu.Lock()
+	checks := append([]healthCheck(nil), api.healthChecks...)
+	api.staticMu.Unlock()
+
+	results := make([]HealthCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			results[i] = check.run(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := HealthStatusOK
+	for _, result := range results {
+		if healthSeverity(result.Status) > healthSeverity(status) {
+			status = result.Status
+		}
+	}
+	return status, results
+}
+
+// run runs the health check, it fails the check if it doesn't return before
+// the context expires.
+func (check healthCheck) run(ctx context.Context) HealthCheck {
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- check.staticCheckFn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		err = errors.AddContext(ctx.Err(), "health check timed out")
+	}
+
+	result := HealthCheck{
+		Name:    check.staticName,
+		Status:  HealthStatusOK,
+		Latency: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		result.Status = check.staticSeverity
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// healthSeverity returns the severity of the given health status, the higher
+// the more severe.
+func healthSeverity(status string) int {
+	switch status {
+	case HealthStatusOK:
+		return 0
+	case HealthStatusDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+// TestHealthChecks verifies the health checks roll up into the status of the
+// most severe failing check.
+func TestHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	// register a check per dependency that fails if it's toggled
+	var mu sync.Mutex
+	failing := make(map[string]bool)
+	api := &API{}
+	for _, check := range []struct {
+		name     string
+		severity string
+	}{
+		{"mongo", HealthStatusDown},
+		{"schema", HealthStatusDegraded},
+		{"accounts", HealthStatusDegraded},
+		{"skyd", HealthStatusDegraded},
+		{"blocker", HealthStatusDegraded},
+		{"syncer", HealthStatusDegraded},
+	} {
+		name := check.name
+		api.RegisterHealthCheck(name, check.severity, func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing[name] {
+				return errors.New(name + " failed")
+			}
+			return nil
+		})
+	}
+
+	// setFailing resets the failing checks to the given ones
+	setFailing := func(names ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = make(map[string]bool)
+		for _, name := range names {
+			failing[name] = true
+		}
+	}
+
+	tests := []struct {
+		name    string
+		failing []string
+		status  string
+	}{
+		{"Healthy", nil, HealthStatusOK},
+		{"MongoDown", []string{"mongo"}, HealthStatusDown},
+		{"SchemaUnhealthy", []string{"schema"}, HealthStatusDegraded},
+		{"AccountsUnreachable", []string{"accounts"}, HealthStatusDegraded},
+		{"SkydDown", []string{"skyd"}, HealthStatusDegraded},
+		{"BlockerLags", []string{"blocker"}, HealthStatusDegraded},
+		{"PortalsFailing", []string{"syncer"}, HealthStatusDegraded},
+		{"SkydAndMongoDown", []string{"skyd", "mongo"}, HealthStatusDown},
+	}
+	for _, test := range tests {
+		setFailing(test.failing...)
+
+		status, checks := api.managedCheckHealth(context.Background())
+		if status != test.status {
+			t.Fatalf("%v: unexpected status '%v'", test.name, status)
+		}
+		if len(checks) != 6 || checks[0].Name != "mongo" || checks[5].Name != "syncer" {
+			t.Fatalf("%v: unexpected checks %v", test.name, checks)
+		}
+		for _, check := range checks {
+			if (check.Status != HealthStatusOK) != failing[check.Name] || (check.Error != "") != failing[check.Name] {
+				t.Fatalf("%v: unexpected check %v", test.name, check)
+			}
+		}
+	}
+
+	// assert a check that doesn't return in time is failed
+	setFailing()
+	release := make(chan struct{})
+	defer close(release)
+	api.RegisterHealthCheck("syncer", HealthStatusDegraded, func(context.Context) error {
+		<-release
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	status, checks := api.managedCheckHealth(ctx)
+	if status != HealthStatusDegraded || len(checks) != 6 {
+		t.Fatal("unexpected health", status, checks)
+	}
+	if checks[5].Status != HealthStatusDegraded || checks[5].Error == "" {
+		t.Fatal("unexpected check", checks[5])
+	}
+}
+
+// TestHealthGET verifies the /health endpoint reports the status of the
+// blocker and responds with a 503 if it's down.
+func TestHealthGET(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a skyd that is ready until it's toggled
+	var mu sync.Mutex
+	ready := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		skyapi.WriteJSON(w, DaemonReadyResponse{Ready: ready, Consensus: ready, Gateway: ready, Renter: ready})
+	}))
+	defer server.Close()
+	setReady := func(r bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		ready = r
+	}
+
+	api, err := newTestAPI(t, NewSkydClient(server.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// health is a helper that fetches the health of the blocker
+	health := func() (int, HealthGET) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var hg HealthGET
+		err := json.NewDecoder(w.Body).Decode(&hg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, hg
+	}
+
+	// assert the blocker is healthy
+	code, hg := health()
+	if code != http.StatusOK || hg.Status != HealthStatusOK || !hg.DBAlive {
+		t.Fatal("unexpected health", code, hg)
+	}
+	if len(hg.Checks) != 4 {
+		t.Fatal("unexpected checks", hg.Checks)
+	}
+
+	// assert the blocker is degraded while skyd isn't ready
+	setReady(false)
+	code, hg = health()
+	if code != http.StatusOK || hg.Status != HealthStatusDegraded || !hg.DBAlive {
+		t.Fatal("unexpected health", code, hg)
+	}
+	setReady(true)
+
+	// assert the blocker is down without its database
+	api.RegisterHealthCheck("mongo", HealthStatusDown, func(context.Context) error {
+		return errors.New("no reachable servers")
+	})
+	code, hg = health()
+	if code != http.StatusServiceUnavailable || hg.Status != HealthStatusDown || hg.DBAlive {
+		t.Fatal("unexpected health", code, hg)
+	}
+	if len(hg.Checks) != 4 || hg.Checks[0].Error != "no reachable servers" {
+		t.Fatal("unexpected checks", hg.Checks)
+	}
+}
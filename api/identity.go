@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// BlocklistSignatureHeader is the header that holds the hex encoded
+	// ed25519 signature of a page of a portal's blocklist, it signs the raw
+	// response body.
+	BlocklistSignatureHeader = "Skynet-Blocklist-Signature"
+
+	// maxBlocklistPageSize is the maximum size of a page of a portal's
+	// blocklist we read to verify its signature.
+	maxBlocklistPageSize = 1 << 24 // 16MiB
+)
+
+var (
+	// ErrCertificateMismatch is returned when the TLS certificate of a portal
+	// doesn't match its pinned fingerprint.
+	ErrCertificateMismatch = errors.New("certificate doesn't match the pinned fingerprint")
+
+	// ErrInvalidBlocklistSignature is returned when a page of a portal's
+	// blocklist is not signed by the portal's configured key.
+	ErrInvalidBlocklistSignature = errors.New("invalid blocklist signature")
+)
+
+// PortalIdentity describes how the identity of a portal we sync the blocklist
+// from is verified. The portal's TLS certificate can be pinned, and the portal
+// can be required to sign the pages of its blocklist, or both.
+type PortalIdentity struct {
+	URL string `json:"url"`
+
+	// TLSFingerprint is the hex encoded SHA-256 fingerprint of the portal's
+	// leaf certificate, in DER form.
+	TLSFingerprint string `json:"tlsFingerprint,omitempty"`
+
+	// PublicKey is the hex encoded ed25519 public key the portal signs the
+	// pages of its blocklist with, see BlocklistSignatureHeader.
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// NewPortalClient returns a client for the portal with the given identity, it
+// rejects TLS certificates that don't match the pinned fingerprint and pages
+// of the blocklist that aren't signed with the portal's key.
+func NewPortalClient(identity PortalIdentity) (*SkydClient, error) {
+	fingerprint, publicKey, err := identity.parse()
+	if err != nil {
+		return nil, err
+	}
+	c := NewSkydClient(identity.URL, "")
+	c.staticBlocklistKey = publicKey
+	if fingerprint != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = pinnedTLSConfig(fingerprint)
+		c.staticHTTPClient = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// Validate returns an error if the identity is incomplete or if its
+// fingerprint or public key are malformed.
+func (pi PortalIdentity) Validate() error {
+	_, _, err := pi.parse()
+	return err
+}
+
+// parse decodes the fingerprint and the public key of the identity, either of
+// them is nil if it's not set.
+func (pi PortalIdentity) parse() (fingerprint []byte, publicKey ed25519.PublicKey, err error) {
+	if pi.URL == "" {
+		return nil, nil, errors.New("portal identity is missing a 'url'")
+	}
+	if pi.TLSFingerprint == "" && pi.PublicKey == "" {
+		return nil, nil, fmt.Errorf("portal identity of '%v' needs a 'tlsFingerprint' or a 'publicKey'", pi.URL)
+	}
+	if pi.TLSFingerprint != "" {
+		if !strings.HasPrefix(strings.ToLower(pi.URL), "https://") {
+			return nil, nil, fmt.Errorf("can't pin the certificate of '%v', it's not served over https", pi.URL)
+		}
+		// allow the colon separated form openssl prints
+		fingerprint, err = hex.DecodeString(strings.ReplaceAll(pi.TLSFingerprint, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, nil, fmt.Errorf("tls fingerprint of '%v' should be a hex encoded SHA-256 hash", pi.URL)
+		}
+	}
+	if pi.PublicKey != "" {
+		key, err := hex.DecodeString(pi.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("public key of '%v' should be a hex encoded ed25519 public key", pi.URL)
+		}
+		publicKey = ed25519.PublicKey(key)
+	}
+	return fingerprint, publicKey, nil
+}
+
+// pinnedTLSConfig returns a TLS config that only accepts a leaf certificate
+// with the given SHA-256 fingerprint. The pin replaces the verification of
+// the certificate chain, which allows peers to use self-signed certificates,
+// a compromised or coerced CA can't issue a certificate that matches it.
+func pinnedTLSConfig(fingerprint []byte) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrCertificateMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], fingerprint) != 1 {
+				return ErrCertificateMismatch
+			}
+			return nil
+		},
+	}
+}
+
+// verifyBlocklistSignature verifies the given page of a blocklist is signed
+// with the given key, the signature is taken from the given headers.
+func verifyBlocklistSignature(key ed25519.PublicKey, header http.Header, body []byte) error {
+	sig, err := hex.DecodeString(header.Get(BlocklistSignatureHeader))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.AddContext(ErrInvalidBlocklistSignature, "missing or malformed signature")
+	}
+	if !ed25519.Verify(key, body, sig) {
+		return ErrInvalidBlocklistSignature
+	}
+	return nil
+}
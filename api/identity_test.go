@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestPortalIdentity verifies the client of a portal with a pinned certificate
+// or a signing key rejects portals that fail to prove their identity.
+func TestPortalIdentity(t *testing.T) {
+	t.Parallel()
+
+	// create the key the portal signs its blocklist with, and another one
+	pk, sk := newTestKeyPair(t)
+	otherPK, otherSK := newTestKeyPair(t)
+
+	// create a portal that signs its blocklist with the given key, a nil key
+	// means the blocklist isn't signed
+	newPortal := func(signingKey ed25519.PrivateKey) *httptest.Server {
+		page, err := json.Marshal(BlocklistGET{
+			Entries: []BlockedHash{{Hash: database.HashBytes([]byte("hash"))}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if signingKey != nil {
+				w.Header().Set(BlocklistSignatureHeader, hex.EncodeToString(ed25519.Sign(signingKey, page)))
+			}
+			w.Write(page)
+		}))
+	}
+	signed := newPortal(sk)
+	defer signed.Close()
+	wrongKey := newPortal(otherSK)
+	defer wrongKey.Close()
+	unsigned := newPortal(nil)
+	defer unsigned.Close()
+
+	// fingerprint returns the fingerprint of the given server's certificate,
+	// note that all httptest TLS servers share the same certificate
+	fingerprint := func(s *httptest.Server) string {
+		sum := sha256.Sum256(s.Certificate().Raw)
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name     string
+		identity PortalIdentity
+		err      error
+	}{
+		{"Pinned", PortalIdentity{URL: unsigned.URL, TLSFingerprint: fingerprint(unsigned)}, nil},
+		{"PinnedMismatch", PortalIdentity{URL: unsigned.URL, TLSFingerprint: hex.EncodeToString(fastrand.Bytes(sha256.Size))}, ErrCertificateMismatch},
+		{"Signed", PortalIdentity{URL: signed.URL, TLSFingerprint: fingerprint(signed), PublicKey: hex.EncodeToString(pk)}, nil},
+		{"SignedWrongKey", PortalIdentity{URL: wrongKey.URL, TLSFingerprint: fingerprint(wrongKey), PublicKey: hex.EncodeToString(pk)}, ErrInvalidBlocklistSignature},
+		{"SignedOtherKey", PortalIdentity{URL: wrongKey.URL, TLSFingerprint: fingerprint(wrongKey), PublicKey: hex.EncodeToString(otherPK)}, nil},
+		{"Unsigned", PortalIdentity{URL: unsigned.URL, TLSFingerprint: fingerprint(unsigned), PublicKey: hex.EncodeToString(pk)}, ErrInvalidBlocklistSignature},
+	}
+	for _, test := range tests {
+		c, err := NewPortalClient(test.identity)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		blg, err := c.BlocklistGET(0)
+		if test.err == nil && err != nil {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		if test.err != nil && (err == nil || !strings.Contains(err.Error(), test.err.Error())) {
+			t.Fatalf("%v: expected error '%v', got '%v'", test.name, test.err, err)
+		}
+		if test.err == nil && len(blg.Entries) != 1 {
+			t.Fatalf("%v: unexpected entries %v", test.name, blg.Entries)
+		}
+	}
+
+	// assert a client without a pin doesn't trust the self-signed certificate
+	_, err := NewSkydClient(unsigned.URL, "").BlocklistGET(0)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert a tampered page is rejected
+	header := make(http.Header)
+	header.Set(BlocklistSignatureHeader, hex.EncodeToString(ed25519.Sign(sk, []byte("page"))))
+	if err := verifyBlocklistSignature(pk, header, []byte("tampered")); !errors.Contains(err, ErrInvalidBlocklistSignature) {
+		t.Fatal("unexpected error", err)
+	}
+	if err := verifyBlocklistSignature(pk, header, []byte("page")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPortalIdentityValidate verifies portal identities are validated.
+func TestPortalIdentityValidate(t *testing.T) {
+	t.Parallel()
+
+	fingerprint := hex.EncodeToString(fastrand.Bytes(sha256.Size))
+	key := hex.EncodeToString(fastrand.Bytes(ed25519.PublicKeySize))
+	tests := []struct {
+		name     string
+		identity PortalIdentity
+		valid    bool
+	}{
+		{"Fingerprint", PortalIdentity{URL: "https://siasky.net", TLSFingerprint: fingerprint}, true},
+		{"FingerprintColons", PortalIdentity{URL: "https://siasky.net", TLSFingerprint: strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:])}, true},
+		{"PublicKey", PortalIdentity{URL: "http://siasky.net", PublicKey: key}, true},
+		{"Both", PortalIdentity{URL: "https://siasky.net", TLSFingerprint: fingerprint, PublicKey: key}, true},
+		{"NoURL", PortalIdentity{TLSFingerprint: fingerprint}, false},
+		{"Neither", PortalIdentity{URL: "https://siasky.net"}, false},
+		{"FingerprintOverHTTP", PortalIdentity{URL: "http://siasky.net", TLSFingerprint: fingerprint}, false},
+		{"ShortFingerprint", PortalIdentity{URL: "https://siasky.net", TLSFingerprint: fingerprint[2:]}, false},
+		{"InvalidKey", PortalIdentity{URL: "https://siasky.net", PublicKey: "zz" + key[2:]}, false},
+	}
+	for _, test := range tests {
+		err := test.identity.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// newTestKeyPair returns a random ed25519 key pair.
+func newTestKeyPair(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk, sk
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// metricsContentType is the content type of the Prometheus text
+	// exposition format.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// reportsMetric is the name of the counter of reported hashes and
+	// skylinks, it's labeled with the form they were reported in.
+	reportsMetric = "blocker_reports_total"
+)
+
+// gauge is a metric that's exposed on the /metrics endpoint, its value is
+// read when the endpoint is scraped.
+type gauge struct {
+	staticName  string
+	staticHelp  string
+	staticValue func() float64
+}
+
+// RegisterGauge registers a gauge under the given name, which is exposed on
+// the /metrics endpoint in the Prometheus text format. The given function is
+// called on every scrape to read the gauge's value, so it shouldn't block.
+// Registering a gauge under a name that's registered already replaces it.
+func (api *API) RegisterGauge(name, help string, value func() float64) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	if api.gauges == nil {
+		api.gauges = make(map[string]gauge)
+	}
+	api.gauges[name] = gauge{
+		staticName:  name,
+		staticHelp:  help,
+		staticValue: value,
+	}
+}
+
+// managedGauges returns the registered gauges, sorted by name.
+func (api *API) managedGauges() []gauge {
+	api.staticMu.Lock()
+	gauges := make([]gauge, 0, len(api.gauges))
+	for _, g := range api.gauges {
+		gauges = append(gauges, g)
+	}
+	api.staticMu.Unlock()
+
+	sort.Slice(gauges, func(i, j int) bool {
+		return gauges[i].staticName < gauges[j].staticName
+	})
+	return gauges
+}
+
+// managedCountReport increments the counter of reports made in the given
+// form, see modules.SkylinkForms.
+func (api *API) managedCountReport(form string) {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	if api.reports == nil {
+		api.reports = make(map[string]uint64)
+	}
+	api.reports[form]++
+}
+
+// managedReports returns the number of reports made per form, every form is
+// included so the series exist before the first report is made.
+func (api *API) managedReports() []uint64 {
+	api.staticMu.Lock()
+	defer api.staticMu.Unlock()
+	reports := make([]uint64, len(modules.SkylinkForms))
+	for i, form := range modules.SkylinkForms {
+		reports[i] = api.reports[form]
+	}
+	return reports
+}
+
+// metricsGET writes the report counters and the registered gauges in the
+// Prometheus text format.
+func (api *API) metricsGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# HELP %s Number of reported hashes and skylinks, by the form they were reported in.\n", reportsMetric)
+	fmt.Fprintf(&sb, "# TYPE %s counter\n", reportsMetric)
+	for i, count := range api.managedReports() {
+		fmt.Fprintf(&sb, "%s{form=\"%s\"} %d\n", reportsMetric, modules.SkylinkForms[i], count)
+	}
+	for _, g := range api.managedGauges() {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", g.staticName, g.staticHelp)
+		fmt.Fprintf(&sb, "# TYPE %s gauge\n", g.staticName)
+		fmt.Fprintf(&sb, "%s %s\n", g.staticName, strconv.FormatFloat(g.staticValue(), 'g', -1, 64))
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	_, _ = w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestMetricsGET verifies the /metrics endpoint writes the report counters and
+// the registered gauges in the Prometheus text format.
+func TestMetricsGET(t *testing.T) {
+	t.Parallel()
+
+	// create a bare API with its routes registered
+	logger, _ := logtest.NewNullLogger()
+	api := &API{
+		staticLogger: logger.WithField("module", "api"),
+		staticRouter: httprouter.New(),
+	}
+	api.buildHTTPRoutes()
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status code", w.Code)
+		}
+		if w.Header().Get("Content-Type") != metricsContentType {
+			t.Fatal("unexpected content type", w.Header().Get("Content-Type"))
+		}
+		return w.Body.String()
+	}
+
+	// assert the report counters are written for every form, even if no
+	// reports were made
+	reports := `# HELP blocker_reports_total Number of reported hashes and skylinks, by the form they were reported in.
+# TYPE blocker_reports_total counter
+blocker_reports_total{form="hash"} 0
+blocker_reports_total{form="merkleroot"} 0
+blocker_reports_total{form="skylink"} 0
+blocker_reports_total{form="url"} 0
+blocker_reports_total{form="subdomain"} 0
+`
+	if body := get(); body != reports {
+		t.Fatal("unexpected body", body)
+	}
+
+	// count some reports
+	api.managedCountReport(modules.SkylinkFormHash)
+	api.managedCountReport(modules.SkylinkFormSubdomain)
+	api.managedCountReport(modules.SkylinkFormSubdomain)
+	reports = strings.Replace(reports, `{form="hash"} 0`, `{form="hash"} 1`, 1)
+	reports = strings.Replace(reports, `{form="subdomain"} 0`, `{form="subdomain"} 2`, 1)
+	if body := get(); body != reports {
+		t.Fatal("unexpected body", body)
+	}
+
+	// register two gauges, assert they're sorted by name and read on every
+	// scrape
+	lag := 1.5
+	api.RegisterGauge("blocker_lag_seconds", "Lag of the blocker.", func() float64 { return lag })
+	api.RegisterGauge("a_gauge", "A gauge.", func() float64 { return 42 })
+	expected := reports + `# HELP a_gauge A gauge.
+# TYPE a_gauge gauge
+a_gauge 42
+# HELP blocker_lag_seconds Lag of the blocker.
+# TYPE blocker_lag_seconds gauge
+blocker_lag_seconds 1.5
+`
+	if body := get(); body != expected {
+		t.Fatal("unexpected body", body)
+	}
+	lag = 0
+	if body := get(); body != expected[:len(expected)-4]+"0\n" {
+		t.Fatal("unexpected body", body)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+)
+
+// reportQuota holds the counters of the report quota of a MySkyID, which
+// allows a maximum number of reports within the sliding report window.
+type reportQuota struct {
+	limit     int
+	remaining int
+
+	// reset is the time at which the oldest report within the window drops
+	// out of it, freeing up (part of) the quota.
+	reset time.Time
+}
+
+// newReportQuota returns the quota of a MySkyID that made the given number of
+// reports within the report window, the oldest of which at the given time.
+// The oldest time is zero if the MySkyID made no reports, in which case the
+// window starts now.
+func newReportQuota(limit, reports int, oldest, now time.Time) *reportQuota {
+	if oldest.IsZero() {
+		oldest = now
+	}
+	q := &reportQuota{
+		limit:     limit,
+		remaining: limit - reports,
+		reset:     oldest.Add(database.ReportWindow),
+	}
+	if q.remaining < 0 {
+		q.remaining = 0
+	}
+	return q
+}
+
+// consume updates the quota after n reports got recorded.
+func (q *reportQuota) consume(n int) {
+	if q == nil {
+		return
+	}
+	q.remaining -= n
+	if q.remaining < 0 {
+		q.remaining = 0
+	}
+}
+
+// writeHeaders sets the rate limit headers of the quota on the given response,
+// the reset header holds a unix timestamp. It's a no-op for a nil quota, which
+// is the quota of a reporter that's exempt from the limit.
+func (q *reportQuota) writeHeaders(w http.ResponseWriter) {
+	if q == nil {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(q.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(q.remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(q.reset.Unix(), 10))
+}
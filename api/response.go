@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/errors"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+)
+
+// authLevel is the level at which the caller of a block route is
+// authenticated, it determines which fields of the response it gets to see.
+type authLevel int
+
+const (
+	// authLevelPublic is the level of callers that only authenticate with a
+	// proof of work, i.e. callers of the /powblock route.
+	authLevelPublic authLevel = iota
+
+	// authLevelTrusted is the level of callers of the /block route, which is
+	// only exposed to trusted sources, authenticated by an API key, a cookie
+	// or the network they're calling from.
+	authLevelTrusted
+)
+
+// responseFieldVisibility maps the fields of the block responses onto the
+// minimum auth level of the callers that get to see them. Fields that are not
+// in the map are only visible to trusted callers, fields that are added to the
+// responses therefore don't leak to public callers by accident.
+var responseFieldVisibility = map[string]authLevel{
+	"status":   authLevelPublic,
+	"statuses": authLevelPublic,
+	"skylink":  authLevelPublic,
+	"error":    authLevelPublic,
+
+	"hash":              authLevelTrusted,
+	"timestamp_added":   authLevelTrusted,
+	"timestamp_blocked": authLevelTrusted,
+	"blocked":           authLevelTrusted,
+	"tags":              authLevelTrusted,
+	"reporter":          authLevelTrusted,
+}
+
+// sourceAuthLevel returns the auth level of the caller that reported a skylink
+// from the given source.
+func sourceAuthLevel(source string) authLevel {
+	if source == database.SourcePoW {
+		return authLevelPublic
+	}
+	return authLevelTrusted
+}
+
+// writeBlockResponse writes the given response of a block route, stripped of
+// the fields that are not visible at the given auth level.
+func (api *API) writeBlockResponse(w http.ResponseWriter, resp interface{}, level authLevel) {
+	if level >= authLevelTrusted {
+		skyapi.WriteJSON(w, resp)
+		return
+	}
+	shaped, err := api.shapeResponse(resp, level)
+	if err != nil {
+		WriteError(w, errors.AddContext(err, "failed to shape response"), http.StatusInternalServerError)
+		return
+	}
+	skyapi.WriteJSON(w, shaped)
+}
+
+// shapeResponse returns the JSON representation of the given response without
+// the fields that are not visible at the given auth level, the fields of
+// nested objects are shaped as well.
+func (api *API) shapeResponse(resp interface{}, level authLevel) (interface{}, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return api.shapeValue(v, level), nil
+}
+
+// shapeValue removes the fields that are not visible at the given auth level
+// from the given decoded JSON value.
+func (api *API) shapeValue(v interface{}, level authLevel) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for field, value := range v {
+			if !api.isVisible(field, level) {
+				delete(v, field)
+				continue
+			}
+			v[field] = api.shapeValue(value, level)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = api.shapeValue(v[i], level)
+		}
+	}
+	return v
+}
+
+// isVisible returns whether the given field of a block response is visible at
+// the given auth level. The hash is visible to public callers if the API is
+// configured to include it.
+func (api *API) isVisible(field string, level authLevel) bool {
+	if field == "hash" && api.staticConfig.PublicResponseHash {
+		return true
+	}
+	visibility, known := responseFieldVisibility[field]
+	if !known {
+		visibility = authLevelTrusted
+	}
+	return level >= visibility
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+)
+
+// TestWriteBlockResponse verifies the fields of the block responses that are
+// visible at every auth level, so fields that are added to the responses can't
+// leak to public callers by accident.
+func TestWriteBlockResponse(t *testing.T) {
+	t.Parallel()
+
+	// create a duplicate response with every field set
+	hash := database.HashBytes([]byte("hash"))
+	blocked := true
+	now := time.Now().UTC()
+	duplicate := statusResponse{
+		Status:           "duplicate",
+		Hash:             hash.String(),
+		TimestampAdded:   &now,
+		TimestampBlocked: &now,
+		Blocked:          &blocked,
+		Tags:             []string{"malware"},
+		Reporter:         &Reporter{Name: "John"},
+	}
+	batch := batchStatusResponse{[]skylinkStatus{
+		{Skylink: "skylink", Status: "reported", Hash: hash.String()},
+		{Skylink: "invalid", Status: "failed", Error: "failed to resolve hash"},
+	}}
+
+	// fields is a helper that writes the given response and returns the sorted
+	// fields of the response, and of its first nested status if it has any
+	fields := func(api *API, resp interface{}, level authLevel) ([]string, []string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		api.writeBlockResponse(w, resp, level)
+		var decoded map[string]interface{}
+		err := json.NewDecoder(w.Body).Decode(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var top, nested []string
+		for field := range decoded {
+			top = append(top, field)
+		}
+		if statuses, ok := decoded["statuses"].([]interface{}); ok {
+			for field := range statuses[0].(map[string]interface{}) {
+				nested = append(nested, field)
+			}
+		}
+		sort.Strings(top)
+		sort.Strings(nested)
+		return top, nested
+	}
+
+	public := &API{}
+	publicWithHash := &API{staticConfig: Config{PublicResponseHash: true}}
+	tests := []struct {
+		name   string
+		api    *API
+		resp   interface{}
+		level  authLevel
+		top    []string
+		nested []string
+	}{
+		{"DuplicatePublic", public, duplicate, authLevelPublic, []string{"status"}, nil},
+		{"DuplicatePublicHash", publicWithHash, duplicate, authLevelPublic, []string{"hash", "status"}, nil},
+		{"DuplicateTrusted", public, duplicate, authLevelTrusted, []string{"blocked", "hash", "reporter", "status", "tags", "timestamp_added", "timestamp_blocked"}, nil},
+		{"BatchPublic", public, batch, authLevelPublic, []string{"statuses"}, []string{"skylink", "status"}},
+		{"BatchPublicHash", publicWithHash, batch, authLevelPublic, []string{"statuses"}, []string{"hash", "skylink", "status"}},
+		{"BatchTrusted", public, batch, authLevelTrusted, []string{"statuses"}, []string{"hash", "skylink", "status"}},
+	}
+	for _, test := range tests {
+		top, nested := fields(test.api, test.resp, test.level)
+		if !reflect.DeepEqual(top, test.top) {
+			t.Fatalf("%v: unexpected fields %v != %v", test.name, top, test.top)
+		}
+		if !reflect.DeepEqual(nested, test.nested) {
+			t.Fatalf("%v: unexpected nested fields %v != %v", test.name, nested, test.nested)
+		}
+	}
+
+	// assert fields that are unknown to the visibility map are not visible to
+	// public callers
+	if public.isVisible("new_field", authLevelPublic) || !public.isVisible("new_field", authLevelTrusted) {
+		t.Fatal("unexpected visibility of an unknown field")
+	}
+}
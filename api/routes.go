@@ -1,81 +1,269 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	url "net/url"
 
+	"github.com/SkynetLabs/blocker/modules"
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
-	api2 "gitlab.com/SkynetLabs/skyd/node/api"
 )
 
-var (
-	// AccountsHost is the host on which the accounts service is listening.
-	// NOTE: this variable is overwritten with what is set in the environment
-	AccountsHost = "accounts"
+const (
+	// RoleBoth is the role of an API that serves all routes.
+	RoleBoth = "both"
 
-	// AccountsPort is the port on which the accounts service is listening.
-	// NOTE: this variable is overwritten with what is set in the environment
-	AccountsPort = "3000"
+	// RoleRead is the role of an API that only serves the routes that read
+	// from the database, e.g. the blocklist. Read instances can be scaled out
+	// separately from the write path.
+	RoleRead = "read"
+
+	// RoleWrite is the role of an API that serves the routes that write to
+	// the database, e.g. the block endpoints. Its listing routes can be
+	// disabled to keep the load off the primary.
+	RoleWrite = "write"
+)
+
+const (
+	// routeRead is the kind of the routes that don't write to the database,
+	// they're served by every role.
+	routeRead routeKind = iota
+
+	// routeListing is the kind of the read routes that list the database,
+	// write instances can disable them.
+	routeListing
+
+	// routeWrite is the kind of the routes that write to the database, read
+	// instances don't serve them.
+	routeWrite
+
+	// routeDebug is the kind of the debug routes, they're only served if
+	// debugging is enabled.
+	routeDebug
 )
 
-// buildHTTPRoutes registers all HTTP routes and their handlers.
+type (
+	// route describes an HTTP route served by the API, its kind determines
+	// which roles serve it.
+	route struct {
+		method  string
+		path    string
+		handler httprouter.Handle
+		kind    routeKind
+	}
+
+	// routeKind is the kind of a route.
+	routeKind int
+)
+
+// routes returns the descriptors of all HTTP routes.
+func (api *API) routes() []route {
+	return []route{
+		{http.MethodGet, "/health", api.healthGET, routeRead},
+		{http.MethodGet, "/capabilities", api.capabilitiesGET, routeRead},
+		{http.MethodGet, "/metrics", api.metricsGET, routeRead},
+		{http.MethodGet, "/blocklist", api.shed(false, api.blocklistGET), routeListing},
+		{http.MethodPost, "/block", api.shed(true, api.verifySignature(api.validateCookie(api.blockPOST))), routeWrite},
+		{http.MethodPost, "/block/validate", api.shed(false, api.verifySignature(api.validateCookie(api.blockValidatePOST))), routeRead},
+		{http.MethodGet, "/powblock", api.blockWithPoWGET, routeWrite},
+		{http.MethodPost, "/powblock", api.shed(true, api.blockWithPoWPOST), routeWrite},
+		{http.MethodGet, "/stats/timeseries", api.shed(false, api.timeseriesGET), routeListing},
+
+		// The admin routes require an admin API key.
+		{http.MethodPost, "/admin/reblock", api.requireAdmin(api.adminReblockPOST), routeWrite},
+		{http.MethodPost, "/admin/archive", api.requireAdmin(api.adminArchivePOST), routeWrite},
+		{http.MethodGet, "/admin/audit", api.requireAdmin(api.adminAuditGET), routeRead},
+		{http.MethodGet, "/admin/block/:hash", api.requireAdmin(api.adminBlockGET), routeRead},
+		{http.MethodGet, "/blocklist/pending", api.requireAdmin(api.shed(false, api.blocklistPendingGET)), routeRead},
+		{http.MethodPost, "/admin/block/:hash/reset", api.requireAdmin(api.adminBlockResetPOST), routeWrite},
+		{http.MethodDelete, "/admin/block/:hash", api.requireAdmin(api.adminBlockDELETE), routeWrite},
+		{http.MethodPost, "/unblock", api.requireAdmin(api.unblockPOST), routeWrite},
+		{http.MethodGet, "/admin/identities", api.requireAdmin(api.adminIdentitiesGET), routeRead},
+		{http.MethodPost, "/admin/identities", api.requireAdmin(api.adminIdentitiesPOST), routeWrite},
+		{http.MethodDelete, "/admin/identities/:myskyid", api.requireAdmin(api.adminIdentitiesDELETE), routeWrite},
+		{http.MethodGet, "/admin/allowlist/hits", api.requireAdmin(api.adminAllowListHitsGET), routeRead},
+		{http.MethodGet, "/admin/stats/reporters", api.requireAdmin(api.adminReporterStatsGET), routeRead},
+		{http.MethodGet, "/admin/servers", api.requireAdmin(api.adminServersGET), routeRead},
+
+		{http.MethodGet, "/debug/pprof/*name", debugPprof, routeDebug},
+		{http.MethodPost, "/debug/pprof/*name", debugPprof, routeDebug},
+		{http.MethodGet, "/debug/vars", api.debugVarsGET, routeDebug},
+	}
+}
+
+// buildHTTPRoutes registers the HTTP routes that are served by the API's
+// role, along with their handlers. Every handler is wrapped so its responses
+// carry the security and cache headers of its kind, see securityHeaders.
+//
+// Requests with a method a path isn't served with are rejected with a 405,
+// OPTIONS requests are answered with a 204. Both carry an Allow header that
+// lists the methods the path is served with, the router derives it from the
+// registered routes so it only lists the routes of the API's role.
 func (api *API) buildHTTPRoutes() {
-	api.staticRouter.GET("/health", api.healthGET)
-	api.staticRouter.GET("/blocklist", api.blocklistGET)
-	api.staticRouter.POST("/block", api.blockPOST)
-	api.staticRouter.GET("/powblock", api.blockWithPoWGET)
-	api.staticRouter.POST("/powblock", api.blockWithPoWPOST)
+	for _, r := range api.routes() {
+		if api.staticConfig.serves(r) {
+			api.handle(r.method, r.path, api.securityHeaders(r))
+		}
+	}
+	api.staticRouter.HandleMethodNotAllowed = true
+	api.staticRouter.HandleOPTIONS = true
+	api.staticRouter.MethodNotAllowed = http.HandlerFunc(api.methodNotAllowed)
+	api.staticRouter.GlobalOPTIONS = http.HandlerFunc(api.globalOPTIONS)
+}
+
+// methodNotAllowed handles requests with a method the path isn't served with,
+// the router sets the Allow header before calling it.
+func (api *API) methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	api.setSecurityHeaders(w)
+	w.Header().Set("Cache-Control", noStoreCacheControl)
+	err := fmt.Errorf("method %v is not allowed, use %v", req.Method, w.Header().Get("Allow"))
+	WriteError(w, err, http.StatusMethodNotAllowed)
+}
+
+// globalOPTIONS handles the OPTIONS requests of all paths, the router sets the
+// Allow header before calling it.
+func (api *API) globalOPTIONS(w http.ResponseWriter, _ *http.Request) {
+	api.setSecurityHeaders(w)
+	w.Header().Set("Cache-Control", noStoreCacheControl)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serves returns whether an API with the given config serves the given route.
+func (cfg Config) serves(r route) bool {
+	switch r.kind {
+	case routeListing:
+		return !(cfg.role() == RoleWrite && cfg.DisableListing)
+	case routeWrite:
+		return cfg.role() != RoleRead
+	case routeDebug:
+		return cfg.Debug
+	default:
+		return true
+	}
+}
+
+// handle registers the given handler on the router and records the route so
+// it's listed on the /capabilities endpoint.
+func (api *API) handle(method, path string, h httprouter.Handle) {
+	api.staticRouter.Handle(method, path, h)
+	api.staticRoutes = append(api.staticRoutes, Route{Method: method, Path: path})
+}
+
+// cookieUserCtxKey is the context key under which validateCookie stores the
+// outcome of identifying the user behind the request's cookie.
+type cookieUserCtxKey struct{}
+
+// cookieUser is the outcome of identifying the user behind a request's cookie,
+// either the user's sub or the error that prevented identifying them.
+type cookieUser struct {
+	sub string
+	err error
 }
 
 // validateCookie extracts the cookie from the incoming blocking request and
 // uses it to get user info from accounts. This action utilises accounts'
-// infrastructure to validate the cookie.
+// infrastructure to validate the cookie. The outcome is passed on to the
+// handler through the request's context, see requestSub. Requests without a
+// valid cookie are passed through unauthenticated, it's up to the handler to
+// reject them.
 func (api *API) validateCookie(h httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		u, err := UserFromReq(req, api.staticLogger)
-		if err != nil {
-			api2.WriteError(w, api2.Error{err.Error()}, http.StatusUnauthorized)
-			return
+		var cu cookieUser
+		u, err := api.managedUserFromReq(req)
+		if err == nil {
+			cu.sub = u.Sub
 		}
-		if req.Form == nil {
-			req.Form = url.Values{}
+		cu.err = err
+		req = req.WithContext(context.WithValue(req.Context(), cookieUserCtxKey{}, cu))
+		h(w, req, ps)
+	}
+}
+
+// requestSub returns the sub of the user making the given request. That's the
+// sub validateCookie got from accounts, or the sub passed as form value if the
+// request is authenticated with the API key with the given id, e.g. because
+// it's made by a portal that identified the user itself. The signature of a
+// signed request covers its query, so the sub can't be altered in transit. A
+// sub passed as form value by anyone else is ignored, it would let any caller
+// have their report recorded as made by an arbitrary user. Requests that didn't
+// pass through validateCookie are identified by their cookie here. The returned
+// error is the reason the user couldn't be identified, if any.
+func (api *API) requestSub(req *http.Request, keyID string) (string, error) {
+	cu, validated := req.Context().Value(cookieUserCtxKey{}).(cookieUser)
+	if validated && cu.sub != "" {
+		return cu.sub, nil
+	}
+	if keyID != "" {
+		if sub := req.FormValue("sub"); sub != "" {
+			return sub, nil
 		}
-		req.Form.Set("sub", u.Sub)
+	}
+	if validated {
+		return "", cu.err
+	}
+	u, err := api.managedUserFromReq(req)
+	if err != nil {
+		return "", err
+	}
+	return u.Sub, nil
+}
 
-		h(w, req, ps)
+// managedUserFromReq identifies the user making the request through
+// UserFromReq. Calls to the accounts service go through a circuit breaker,
+// while it's open requests carrying a cookie fail with errAccountsUnavailable
+// without calling the accounts service.
+func (api *API) managedUserFromReq(req *http.Request) (*database.User, error) {
+	if _, err := req.Cookie("skynet-jwt"); err != nil {
+		return nil, errors.AddContext(err, "failed to read skynet cookie")
 	}
+	var u *database.User
+	err := api.staticAccountsBreaker.Do(func() (err error) {
+		u, err = UserFromReq(req, api.staticConfig.accountsURL(), api.staticLogger)
+		return err
+	}, func(err error) bool {
+		return errors.Contains(err, errAccountsUnavailable)
+	})
+	if errors.Contains(err, modules.ErrCircuitOpen) {
+		return nil, errors.Compose(err, errAccountsUnavailable)
+	}
+	return u, err
 }
 
 // UserFromReq identifies the user making the request by reading the attached
-// skynet cookie and querying Accounts service for the user's info.
-func UserFromReq(req *http.Request, logger *logrus.Logger) (*database.User, error) {
+// skynet cookie and querying Accounts service, reachable on the given url, for
+// the user's info.
+func UserFromReq(req *http.Request, accountsURL string, logger *logrus.Entry) (*database.User, error) {
 	cookie, err := req.Cookie("skynet-jwt")
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to read skynet cookie")
 	}
-	accountsURL := fmt.Sprintf("http://%s:%s/user", AccountsHost, AccountsPort)
-	areq, err := http.NewRequest(http.MethodGet, accountsURL, nil)
+	areq, err := http.NewRequest(http.MethodGet, accountsURL+"/user", nil)
 	areq.AddCookie(cookie)
 	aresp, err := http.DefaultClient.Do(areq)
 	if err != nil {
-		return nil, errors.AddContext(err, "validateCookie: failed to talk to accounts")
+		return nil, errors.Compose(errors.AddContext(err, "validateCookie: failed to talk to accounts"), errAccountsUnavailable)
 	}
 	defer aresp.Body.Close()
 	if aresp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(aresp.Body)
-		logger.Tracef("validateCookie: failed to talk to accounts, status code %d, body %s", aresp.StatusCode, string(b))
+		logger.WithFields(logrus.Fields{
+			"status": aresp.StatusCode,
+			"body":   string(b),
+		}).Trace("validateCookie: failed to talk to accounts")
+		if aresp.StatusCode >= http.StatusInternalServerError {
+			return nil, errAccountsUnavailable
+		}
 		return nil, errors.New("Unauthorized")
 	}
 	var u database.User
 	err = json.NewDecoder(aresp.Body).Decode(&u)
 	if err != nil {
-		logger.Warnf("validateCookie: failed to parse accounts' response body: %s", err.Error())
+		logger.WithError(err).Warn("validateCookie: failed to parse accounts' response body")
 		return nil, err
 	}
 	return &u, nil
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestRoles verifies the API only serves the routes of its role, excluded
+// routes are not served and aren't listed on the /capabilities endpoint.
+func TestRoles(t *testing.T) {
+	t.Parallel()
+
+	// newRoleAPI returns a bare API with the given role and its routes
+	// registered
+	newRoleAPI := func(role string, disableListing bool) *API {
+		logger, _ := logtest.NewNullLogger()
+		cfg := newTestConfig()
+		cfg.Role = role
+		cfg.DisableListing = disableListing
+		if err := cfg.validate(); err != nil {
+			t.Fatal(err)
+		}
+		api := &API{
+			staticConfig: cfg,
+			staticLogger: logger.WithField("module", "api"),
+			staticRouter: httprouter.New(),
+		}
+		api.buildHTTPRoutes()
+		return api
+	}
+
+	reads := []Route{
+		{http.MethodGet, "/health"},
+		{http.MethodGet, "/capabilities"},
+		{http.MethodGet, "/metrics"},
+		{http.MethodPost, "/block/validate"},
+		{http.MethodGet, "/admin/audit"},
+		{http.MethodGet, "/admin/block/:hash"},
+		{http.MethodGet, "/blocklist/pending"},
+		{http.MethodGet, "/admin/allowlist/hits"},
+		{http.MethodGet, "/admin/stats/reporters"},
+		{http.MethodGet, "/admin/identities"},
+		{http.MethodGet, "/admin/servers"},
+	}
+	listings := []Route{
+		{http.MethodGet, "/blocklist"},
+		{http.MethodGet, "/stats/timeseries"},
+	}
+	writes := []Route{
+		{http.MethodPost, "/block"},
+		{http.MethodGet, "/powblock"},
+		{http.MethodPost, "/powblock"},
+		{http.MethodPost, "/admin/reblock"},
+		{http.MethodPost, "/admin/archive"},
+		{http.MethodPost, "/admin/block/:hash/reset"},
+		{http.MethodDelete, "/admin/block/:hash"},
+		{http.MethodPost, "/unblock"},
+		{http.MethodPost, "/admin/identities"},
+		{http.MethodDelete, "/admin/identities/:myskyid"},
+	}
+	concat := func(routes ...[]Route) []Route {
+		var all []Route
+		for _, r := range routes {
+			all = append(all, r...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name           string
+		role           string
+		disableListing bool
+		served         []Route
+		excluded       []Route
+	}{
+		{"Default", "", false, concat(reads, listings, writes), nil},
+		{"Both", RoleBoth, false, concat(reads, listings, writes), nil},
+		{"Read", RoleRead, false, concat(reads, listings), writes},
+		{"Write", RoleWrite, false, concat(reads, listings, writes), nil},
+		{"WriteWithoutListing", RoleWrite, true, concat(reads, writes), listings},
+	}
+	for _, test := range tests {
+		api := newRoleAPI(test.role, test.disableListing)
+		registered := make(map[Route]struct{})
+		for _, route := range api.staticRoutes {
+			registered[route] = struct{}{}
+		}
+		if len(registered) != len(test.served) {
+			t.Fatalf("%v: unexpected number of routes %v", test.name, len(registered))
+		}
+		for _, route := range test.served {
+			if _, ok := registered[route]; !ok {
+				t.Fatalf("%v: route %v is not served", test.name, route)
+			}
+		}
+
+		// assert the excluded routes are not found, or not allowed if their
+		// path is served with another method
+		paths := make(map[string]struct{})
+		for _, route := range api.staticRoutes {
+			paths[route.Path] = struct{}{}
+		}
+		for _, route := range test.excluded {
+			code := http.StatusNotFound
+			if _, ok := paths[route.Path]; ok {
+				code = http.StatusMethodNotAllowed
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(route.Method, route.Path, nil))
+			if w.Code != code {
+				t.Fatalf("%v: unexpected status code %v for %v", test.name, w.Code, route)
+			}
+		}
+	}
+
+	// assert listing routes can only be disabled for the write role
+	cfg := newTestConfig()
+	cfg.DisableListing = true
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected error")
+	}
+	cfg.Role = RoleRead
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert unknown roles are rejected
+	cfg = newTestConfig()
+	cfg.Role = "readwrite"
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestMethodNotAllowed verifies requests with a method a path isn't served
+// with are rejected with a 405, and that both those and OPTIONS requests carry
+// an Allow header that lists the methods of the path's routes.
+func TestMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	logger, _ := logtest.NewNullLogger()
+	cfg := newTestConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	api := &API{
+		staticConfig: cfg,
+		staticLogger: logger.WithField("module", "api"),
+		staticRouter: httprouter.New(),
+	}
+	api.buildHTTPRoutes()
+
+	// derive the expected Allow header of every path from the route table
+	methods := make(map[string][]string)
+	for _, r := range api.routes() {
+		if cfg.serves(r) {
+			methods[r.path] = append(methods[r.path], r.method)
+		}
+	}
+	for path, m := range methods {
+		allow := append(m, http.MethodOptions)
+		sort.Strings(allow)
+
+		// pick a method the path isn't served with
+		served := make(map[string]struct{})
+		for _, method := range allow {
+			served[method] = struct{}{}
+		}
+		var wrong string
+		for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if _, ok := served[method]; !ok {
+				wrong = method
+				break
+			}
+		}
+
+		// assert a wrong method is rejected with a 405
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(wrong, path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("unexpected status code %v for %v %v", w.Code, wrong, path)
+		}
+		if w.Header().Get("Allow") != strings.Join(allow, ", ") {
+			t.Fatalf("unexpected Allow header '%v' for %v", w.Header().Get("Allow"), path)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || !strings.Contains(w.Body.String(), "not allowed") {
+			t.Fatalf("unexpected response for %v %v, %v", wrong, path, w.Body.String())
+		}
+
+		// assert OPTIONS reflects the same methods
+		w = httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, path, nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status code %v for OPTIONS %v", w.Code, path)
+		}
+		if w.Header().Get("Allow") != strings.Join(allow, ", ") {
+			t.Fatalf("unexpected Allow header '%v' for OPTIONS %v", w.Header().Get("Allow"), path)
+		}
+	}
+
+	// assert a POST to the blocklist is a 405 rather than a 404
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/blocklist", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, OPTIONS" {
+		t.Fatal("unexpected", w.Code, w.Header().Get("Allow"))
+	}
+
+	// assert unknown paths are still not found
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status code", w.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// shedWindow is the window over which the load shedder computes the 95th
+	// percentile of the latency of database operations.
+	shedWindow = time.Minute
+
+	// shedMaxSamples is the maximum number of latencies the load shedder
+	// keeps within its window.
+	shedMaxSamples = 1000
+
+	// shedRetryAfter is the amount of time clients are asked to wait before
+	// retrying a request that got shed.
+	shedRetryAfter = 30 * time.Second
+
+	// shedDBTimeout is the timeout of critical requests that are admitted
+	// while non-critical requests are shed. It prevents reports from piling
+	// up while the database is slow.
+	shedDBTimeout = 10 * time.Second
+)
+
+var (
+	// errLoadShed is returned when a request got rejected because the
+	// database is too slow to serve it.
+	errLoadShed = errors.New("the blocker is overloaded, retry later")
+)
+
+// shed wraps the given handler so it's only served if the load shedder admits
+// it. Non-critical requests are rejected with a 503 and a Retry-After header
+// once the database slows down, critical requests are still served, with a
+// shorter timeout, until the database slows down even further.
+func (api *API) shed(critical bool, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if api.staticShedder == nil {
+			h(w, r, ps)
+			return
+		}
+
+		tier := api.staticShedder.Tier()
+		if tier == modules.ShedAll || (tier == modules.ShedNonCritical && !critical) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(shedRetryAfter.Seconds())))
+			WriteError(w, errLoadShed, http.StatusServiceUnavailable)
+			return
+		}
+		if tier == modules.ShedNonCritical {
+			ctx, cancel := context.WithTimeout(r.Context(), shedDBTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestShed verifies non-critical requests are shed first, critical requests
+// are served with a shorter timeout until the load shedder sheds all requests.
+func TestShed(t *testing.T) {
+	t.Parallel()
+
+	shedder, err := modules.NewLoadShedder(time.Second, 5*time.Second, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &API{staticShedder: shedder}
+
+	// serve is a helper that serves a request through a handler of the given
+	// class, it returns the response and the deadline of the request
+	serve := func(critical bool) (*httptest.ResponseRecorder, time.Time) {
+		var deadline time.Time
+		h := api.shed(critical, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			deadline, _ = r.Context().Deadline()
+		})
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+		return w, deadline
+	}
+	observe := func(latency time.Duration) {
+		for i := 0; i < 10; i++ {
+			shedder.Observe(latency)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		latency     time.Duration
+		nonCritical int
+		critical    int
+		deadline    bool
+	}{
+		{"Fast", 10 * time.Millisecond, http.StatusOK, http.StatusOK, false},
+		{"Slow", 2 * time.Second, http.StatusServiceUnavailable, http.StatusOK, true},
+		{"VerySlow", 10 * time.Second, http.StatusServiceUnavailable, http.StatusServiceUnavailable, false},
+		{"Recovered", 10 * time.Millisecond, http.StatusOK, http.StatusOK, false},
+	}
+	for _, test := range tests {
+		observe(test.latency)
+
+		w, _ := serve(false)
+		if w.Code != test.nonCritical {
+			t.Fatalf("%v: unexpected status code %v for non-critical request", test.name, w.Code)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "30" {
+			t.Fatalf("%v: unexpected Retry-After header '%v'", test.name, w.Header().Get("Retry-After"))
+		}
+
+		w, deadline := serve(true)
+		if w.Code != test.critical {
+			t.Fatalf("%v: unexpected status code %v for critical request", test.name, w.Code)
+		}
+		if !deadline.IsZero() != test.deadline {
+			t.Fatalf("%v: unexpected deadline %v", test.name, deadline)
+		}
+		if test.deadline && time.Until(deadline) > shedDBTimeout {
+			t.Fatalf("%v: deadline exceeds the shed timeout", test.name)
+		}
+	}
+
+	// assert requests are served if load shedding is disabled
+	api.staticShedder = nil
+	if w, _ := serve(false); w.Code != http.StatusOK {
+		t.Fatal("unexpected status code", w.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/julienschmidt/httprouter"
+)
+
+// signedKeyCtxKey is the context key under which verifySignature stores the
+// API key that signed the request.
+type signedKeyCtxKey struct{}
+
+// verifySignature wraps the given handler so signed requests are verified
+// before the handler runs. A signed request carries the id of an API key, the
+// time it was signed and an HMAC-SHA256 signature over that time, the method,
+// the path and query and the body, using the key as secret. This keeps the key
+// itself out of the request, and out of the logs of every proxy in between.
+//
+// Requests with an unknown key id, a timestamp outside of the signature window
+// or an invalid signature are rejected with a 401. Requests that aren't signed
+// are passed through as is, they can still authenticate with the key in the
+// Skynet-Api-Key header.
+func (api *API) verifySignature(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !modules.IsSigned(r) {
+			h(w, r, ps)
+			return
+		}
+
+		keyID := r.Header.Get(modules.SignatureKeyIDHeader)
+		apiKey, exists := api.staticAPIKeysByID[keyID]
+		if !exists {
+			WriteError(w, errUnknownAPIKey, http.StatusUnauthorized)
+			return
+		}
+
+		// Read the body, the signature covers it, and protect against large
+		// bodies while doing so.
+		b := http.MaxBytesReader(w, r.Body, api.staticConfig.limits().MaxBodySize)
+		body, err := ioutil.ReadAll(b)
+		_ = b.Close()
+		if err != nil {
+			WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = modules.VerifySignature(r, apiKey.Key, body, time.Now())
+		if err != nil {
+			api.staticLogger.WithError(err).WithField("key_id", keyID).WithField("path", r.URL.Path).Warn("rejected signed request")
+			WriteError(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		// Restore the body and pass the key on to the handler.
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), signedKeyCtxKey{}, apiKey))
+		h(w, r, ps)
+	}
+}
+
+// requestAPIKey returns the API key of the given request. That's the key that
+// signed the request, if it was signed, or the key in the Skynet-Api-Key header
+// otherwise, which might be empty.
+func requestAPIKey(r *http.Request) string {
+	if apiKey, ok := r.Context().Value(signedKeyCtxKey{}).(APIKey); ok {
+		return apiKey.Key
+	}
+	return r.Header.Get(APIKeyHeader)
+}
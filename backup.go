@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/SkynetLabs/blocker/config"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+)
+
+// export writes an export of the blocklist to the file given in the args, or
+// to stdout if no file or "-" is given, and returns the exit code of the
+// process.
+func export(args []string) int {
+	fs := flag.NewFlagSet(cmdExport, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: blocker %s [file]\n", cmdExport)
+	}
+	if fs.Parse(args) != nil || fs.NArg() > 1 {
+		return 2
+	}
+
+	// open the output
+	var w io.Writer = os.Stdout
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create export file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return withDB(func(ctx context.Context, db *database.DB) error {
+		return db.Export(ctx, w)
+	})
+}
+
+// importExport imports the export in the file given in the args, or from
+// stdin if no file or "-" is given, and returns the exit code of the process.
+func importExport(args []string) int {
+	fs := flag.NewFlagSet(cmdImport, flag.ContinueOnError)
+	merge := fs.Bool("merge", false, "keep existing documents instead of overwriting them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: blocker %s [-merge] [file]\n", cmdImport)
+		fs.PrintDefaults()
+	}
+	if fs.Parse(args) != nil || fs.NArg() > 1 {
+		return 2
+	}
+
+	// open the input
+	var r io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open export file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return withDB(func(ctx context.Context, db *database.DB) error {
+		res, err := db.Import(ctx, r, *merge)
+		fmt.Fprintf(os.Stderr, "inserted: %d, updated: %d, unchanged: %d, conflicts: %d\n", res.Inserted, res.Updated, res.Unchanged, res.Conflicts)
+		return err
+	})
+}
+
+// repair repairs the skylinks collection, merging duplicate documents and
+// backfilling the hashes of legacy documents, and returns the exit code of the
+// process.
+func repair(args []string) int {
+	fs := flag.NewFlagSet(cmdRepair, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: blocker %s\n", cmdRepair)
+	}
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return 2
+	}
+
+	return withDB(func(ctx context.Context, db *database.DB) error {
+		res, err := db.Repair(ctx)
+		fmt.Fprintf(os.Stderr, "backfilled: %d, unresolved: %d, merged: %d, deleted: %d, missing indexes: %v\n", res.Backfilled, res.Unresolved, res.Merged, res.Deleted, res.MissingIndexes)
+		return err
+	})
+}
+
+// withDB loads the config, connects to the database and calls the given
+// function, which gets cancelled on exit signals. It returns the exit code of
+// the process.
+func withDB(fn func(context.Context, *database.DB) error) int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+
+	// log to stderr, stdout might be used for the export
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	db, err := connectDB(ctx, cfg, logger.WithField("module", "db"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+		defer closeCancel()
+		_ = db.Close(closeCtx)
+	}()
+
+	err = fn(ctx, db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
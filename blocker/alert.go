@@ -0,0 +1,299 @@
+package blocker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// alertTimeout is the maximum amount of time we wait for the alert URL to
+	// accept an alert.
+	alertTimeout = 30 * time.Second
+)
+
+type (
+	// AlertConfig defines when the backlog monitor fires an alert and where
+	// it sends it to.
+	AlertConfig struct {
+		// URL is the url alerts are POSTed to, it receives backlog alerts
+		// and alerts about reports of critical severity. If it's empty, and
+		// there are no rules, alerts are only logged.
+		URL string
+
+		// Rules route alerts to webhooks by their event, tags and severity,
+		// see WebhookRule.
+		Rules []WebhookRule
+
+		// FailedThreshold and InvalidThreshold are the number of failed and
+		// invalid skylinks above which an alert gets fired.
+		FailedThreshold  int
+		InvalidThreshold int
+
+		// CheckInterval is the amount of time between checks of the backlog.
+		CheckInterval time.Duration
+
+		// Cooldown is the minimum amount of time between two alerts.
+		Cooldown time.Duration
+	}
+
+	// Alert is the payload that gets POSTed to the alert URL and to the
+	// webhooks whose rules match it. Alerts about reports hold the hash, tags
+	// and severity of the report.
+	Alert struct {
+		Event            string           `json:"event"`
+		Message          string           `json:"message"`
+		Backlog          database.Backlog `json:"backlog"`
+		FailedThreshold  int              `json:"failedthreshold"`
+		InvalidThreshold int              `json:"invalidthreshold"`
+		Hash             string           `json:"hash,omitempty"`
+		Tags             []string         `json:"tags,omitempty"`
+		Severity         string           `json:"severity,omitempty"`
+		Time             time.Time        `json:"time"`
+	}
+
+	// BacklogMonitor periodically checks the number of skylinks that failed
+	// to get blocked, or that skyd rejected as invalid, and fires an alert
+	// when either of them exceeds its threshold.
+	//
+	// An alert is fired once per episode, an episode starts when the backlog
+	// crosses a threshold and ends when it dropped below all thresholds again.
+	// Episodes that start within the cooldown of the previous alert don't fire
+	// an alert, this avoids flooding the alert URL when the backlog hovers
+	// around a threshold.
+	BacklogMonitor struct {
+		started bool
+
+		// alerting is true while the backlog exceeds one of the thresholds.
+		alerting bool
+
+		// lastAlert is the time at which the last alert got fired.
+		lastAlert time.Time
+
+		staticCfg        AlertConfig
+		staticDB         database.Store
+		staticDispatcher *Dispatcher
+		staticLogger     *logrus.Entry
+		staticMu         sync.Mutex
+		staticStopChan   chan struct{}
+		staticWaitGroup  sync.WaitGroup
+	}
+
+	// MonitorStatus is a snapshot of the backlog monitor's state.
+	MonitorStatus struct {
+		Started   bool      `json:"started"`
+		Alerting  bool      `json:"alerting"`
+		LastAlert time.Time `json:"lastalert"`
+	}
+)
+
+// NewBacklogMonitor returns a new BacklogMonitor with the given parameters.
+func NewBacklogMonitor(cfg AlertConfig, db database.Store, logger *logrus.Entry) (*BacklogMonitor, error) {
+	if db == nil {
+		return nil, errors.New("no DB provided")
+	}
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+	if cfg.FailedThreshold <= 0 || cfg.InvalidThreshold <= 0 {
+		return nil, errors.New("alert thresholds have to be positive")
+	}
+	if cfg.CheckInterval <= 0 {
+		return nil, errors.New("alert check interval has to be positive")
+	}
+
+	// the alert url is a catch-all for backlog alerts and critical reports
+	rules := append([]WebhookRule(nil), cfg.Rules...)
+	if cfg.URL != "" {
+		rules = append(rules, WebhookRule{
+			URLs:        []string{cfg.URL},
+			MinSeverity: database.SeverityCritical,
+		})
+	}
+	dispatcher, err := NewDispatcher(rules)
+	if err != nil {
+		return nil, err
+	}
+	m := &BacklogMonitor{
+		staticCfg:        cfg,
+		staticDB:         db,
+		staticDispatcher: dispatcher,
+		staticLogger:     logger,
+		staticStopChan:   make(chan struct{}),
+	}
+	return m, nil
+}
+
+// Start launches a background task that periodically checks the backlog.
+func (m *BacklogMonitor) Start() error {
+	m.staticMu.Lock()
+	defer m.staticMu.Unlock()
+
+	// assert 'Start' is only called once
+	if m.started {
+		return errors.New("backlog monitor already started")
+	}
+	m.started = true
+
+	// start the check loop
+	m.staticWaitGroup.Add(1)
+	go func() {
+		m.threadedCheckLoop()
+		m.staticWaitGroup.Done()
+	}()
+
+	return nil
+}
+
+// Stop waits for the monitor's waitgroup and times out after one minute.
+func (m *BacklogMonitor) Stop() error {
+	// check whether the monitor was started
+	m.staticMu.Lock()
+	if !m.started {
+		m.staticMu.Unlock()
+		return errors.New("backlog monitor not started")
+	}
+	m.started = false
+	m.staticMu.Unlock()
+
+	// stop the monitor by closing the stop channel
+	close(m.staticStopChan)
+
+	// wait for the waitgroup, timeout and signal unclean shutdown after 1m
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		m.staticWaitGroup.Wait()
+	}()
+	select {
+	case <-c:
+		return nil
+	case <-time.After(stopTimeoutDuration):
+		return errors.New("unclean backlog monitor shutdown")
+	}
+}
+
+// Status returns a snapshot of the monitor's state.
+func (m *BacklogMonitor) Status() MonitorStatus {
+	m.staticMu.Lock()
+	defer m.staticMu.Unlock()
+	return MonitorStatus{
+		Started:   m.started,
+		Alerting:  m.alerting,
+		LastAlert: m.lastAlert,
+	}
+}
+
+// threadedCheckLoop holds the check loop
+func (m *BacklogMonitor) threadedCheckLoop() {
+	// convenience variables
+	logger := m.staticLogger
+
+	for {
+		err := m.managedCheck()
+		if err != nil {
+			logger.WithError(err).Error("failed to check the backlog")
+		}
+
+		select {
+		case <-m.staticStopChan:
+			return
+		case <-time.After(m.staticCfg.CheckInterval):
+		}
+	}
+}
+
+// managedCheck fetches the backlog and fires an alert if it exceeds one of the
+// thresholds and we're not in the middle of an episode or within the cooldown
+// of the previous alert.
+func (m *BacklogMonitor) managedCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	backlog, err := m.staticDB.Backlog(ctx)
+	if err != nil {
+		return err
+	}
+	exceeded := m.exceededThresholds(backlog)
+	alerting := len(exceeded) > 0
+
+	m.staticMu.Lock()
+	wasAlerting := m.alerting
+	m.alerting = alerting
+	inCooldown := !m.lastAlert.IsZero() && time.Since(m.lastAlert) < m.staticCfg.Cooldown
+	fire := alerting && !wasAlerting && !inCooldown
+	if fire {
+		m.lastAlert = time.Now().UTC()
+	}
+	m.staticMu.Unlock()
+
+	logger := m.staticLogger.WithFields(logrus.Fields{
+		"failed":  backlog.Failed,
+		"invalid": backlog.Invalid,
+	})
+	switch {
+	case wasAlerting && !alerting:
+		logger.Info("Backlog dropped below the alert thresholds")
+	case alerting && !wasAlerting && inCooldown:
+		logger.Warn("Backlog exceeds the alert thresholds, alert suppressed by cooldown")
+	}
+	if !fire {
+		return nil
+	}
+
+	message := fmt.Sprintf("blocker backlog exceeds the alert thresholds, %v", strings.Join(exceeded, ", "))
+	logger.Errorf("[CRITICAL] %v", message)
+	return m.staticDispatcher.Dispatch(ctx, Alert{
+		Event:            WebhookEventBacklog,
+		Message:          message,
+		Backlog:          backlog,
+		FailedThreshold:  m.staticCfg.FailedThreshold,
+		InvalidThreshold: m.staticCfg.InvalidThreshold,
+		Time:             time.Now().UTC(),
+	})
+}
+
+// AlertReport fires an alert for the given newly reported skylink, it's sent
+// to the webhooks whose rules match the report and, if it's of critical
+// severity, to the alert URL. Contrary to backlog alerts, every report fires an
+// alert.
+func (m *BacklogMonitor) AlertReport(bs database.BlockedSkylink) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+
+	message := fmt.Sprintf("received a report for hash %v", bs.Hash.String())
+	if bs.Severity == database.SeverityCritical {
+		message = fmt.Sprintf("received a report of critical severity for hash %v", bs.Hash.String())
+		m.staticLogger.WithFields(logrus.Fields{
+			"hash": bs.Hash.String(),
+			"tags": bs.Tags,
+		}).Error("[CRITICAL] received a report of critical severity")
+	}
+	return m.staticDispatcher.Dispatch(ctx, Alert{
+		Event:    WebhookEventReport,
+		Message:  message,
+		Hash:     bs.Hash.String(),
+		Tags:     bs.Tags,
+		Severity: bs.Severity,
+		Time:     database.Now(),
+	})
+}
+
+// exceededThresholds returns a description of every threshold the given
+// backlog exceeds.
+func (m *BacklogMonitor) exceededThresholds(backlog database.Backlog) []string {
+	var exceeded []string
+	if backlog.Failed > m.staticCfg.FailedThreshold {
+		exceeded = append(exceeded, fmt.Sprintf("%v failed skylinks (threshold %v)", backlog.Failed, m.staticCfg.FailedThreshold))
+	}
+	if backlog.Invalid > m.staticCfg.InvalidThreshold {
+		exceeded = append(exceeded, fmt.Sprintf("%v invalid skylinks (threshold %v)", backlog.Invalid, m.staticCfg.InvalidThreshold))
+	}
+	return exceeded
+}
@@ -0,0 +1,236 @@
+package blocker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestBacklogMonitor verifies the backlog monitor fires exactly one alert per
+// episode in which the backlog exceeds the thresholds, and that episodes
+// starting within the cooldown of the previous alert don't fire an alert.
+func TestBacklogMonitor(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the alerts it receives
+	var mu sync.Mutex
+	var alerts []Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		err := json.NewDecoder(r.Body).Decode(&alert)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	numAlerts := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(alerts)
+	}
+
+	// create the database and insert some skylinks
+	db := database.NewTestDB(ctx, t.Name(), database.WithCleanup(t))
+	var hashes []database.Hash
+	for i := 0; i < 4; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("skylink_%d", i)))
+		err := db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	markFailed := func(hashes ...database.Hash) {
+		err := db.MarkFailed(ctx, hashes, database.FailureClassTransient, "skyd unreachable")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	markSucceeded := func(hashes ...database.Hash) {
+		err := db.MarkSucceeded(ctx, hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// newMonitor is a helper that creates a monitor with the given cooldown
+	// that alerts when more than two skylinks failed
+	newMonitor := func(cooldown time.Duration) (*BacklogMonitor, *logtest.Hook) {
+		logger, hook := logtest.NewNullLogger()
+		m, err := NewBacklogMonitor(AlertConfig{
+			URL:              server.URL,
+			FailedThreshold:  2,
+			InvalidThreshold: 10,
+			CheckInterval:    time.Minute,
+			Cooldown:         cooldown,
+		}, db, logger.WithField("module", "blocker"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m, hook
+	}
+	// check is a helper that checks the backlog and asserts the number of
+	// alerts received so far
+	check := func(m *BacklogMonitor, expected int) {
+		t.Helper()
+		err := m.managedCheck()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := numAlerts(); n != expected {
+			t.Fatalf("unexpected number of alerts, %v != %v", n, expected)
+		}
+	}
+
+	m, hook := newMonitor(0)
+
+	// assert we don't alert as long as the backlog is below the threshold
+	markFailed(hashes[0], hashes[1])
+	check(m, 0)
+
+	// cross the threshold and assert we alert exactly once for the episode
+	markFailed(hashes[2])
+	check(m, 1)
+	check(m, 1)
+	markFailed(hashes[3])
+	check(m, 1)
+	if !m.Status().Alerting {
+		t.Fatal("expected monitor to be alerting")
+	}
+
+	// assert the alert holds the backlog and thresholds
+	alert := alerts[0]
+	if alert.Backlog.Failed != 3 || alert.Backlog.Invalid != 0 {
+		t.Fatal("unexpected backlog", alert.Backlog)
+	}
+	if alert.FailedThreshold != 2 || alert.InvalidThreshold != 10 {
+		t.Fatal("unexpected thresholds", alert)
+	}
+	if !strings.Contains(alert.Message, "3 failed skylinks") {
+		t.Fatal("unexpected message", alert.Message)
+	}
+
+	// assert the alert got logged as critical
+	var critical int
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel && strings.HasPrefix(entry.Message, "[CRITICAL]") {
+			critical++
+		}
+	}
+	if critical != 1 {
+		t.Fatalf("unexpected number of critical logs, %v != 1", critical)
+	}
+
+	// end the episode and start a new one, assert we alert again
+	markSucceeded(hashes[1:]...)
+	check(m, 1)
+	if m.Status().Alerting {
+		t.Fatal("expected monitor to have stopped alerting")
+	}
+	markFailed(hashes[1:]...)
+	check(m, 2)
+
+	// create a monitor with a cooldown, assert the second episode within the
+	// cooldown doesn't fire an alert
+	m, _ = newMonitor(time.Hour)
+	check(m, 3)
+	markSucceeded(hashes[1:]...)
+	check(m, 3)
+	markFailed(hashes[1:]...)
+	check(m, 3)
+	if !m.Status().Alerting {
+		t.Fatal("expected monitor to be alerting")
+	}
+}
+
+// TestAlertReport verifies every report of critical severity fires an alert to
+// the alert url that holds its hash and tags, and that other reports don't.
+func TestAlertReport(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a server that records the alerts it receives
+	alerts := make(chan Alert, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		err := json.NewDecoder(r.Body).Decode(&alert)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		alerts <- alert
+	}))
+	defer server.Close()
+
+	// create the monitor
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	logger, _ := logtest.NewNullLogger()
+	m, err := NewBacklogMonitor(AlertConfig{
+		URL:              server.URL,
+		FailedThreshold:  2,
+		InvalidThreshold: 10,
+		CheckInterval:    time.Minute,
+		Cooldown:         time.Hour,
+	}, db, logger.WithField("module", "blocker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alert twice, assert the cooldown doesn't apply to critical reports
+	bs := database.BlockedSkylink{
+		Hash:     database.HashBytes([]byte("skylink")),
+		Severity: database.SeverityCritical,
+		Tags:     []string{"csam"},
+	}
+	for i := 0; i < 2; i++ {
+		err = m.AlertReport(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alert := <-alerts
+		if alert.Hash != bs.Hash.String() || len(alert.Tags) != 1 || alert.Tags[0] != "csam" {
+			t.Fatal("unexpected alert", alert)
+		}
+		if alert.Event != WebhookEventReport || alert.Severity != database.SeverityCritical {
+			t.Fatal("unexpected alert", alert)
+		}
+	}
+
+	// assert reports of lower severity aren't sent to the alert url
+	bs.Severity = database.SeverityHigh
+	err = m.AlertReport(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case alert := <-alerts:
+		t.Fatal("unexpected alert", alert)
+	default:
+	}
+}
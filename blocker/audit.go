@@ -0,0 +1,322 @@
+package blocker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/crypto"
+)
+
+const (
+	// auditPageSize is the number of skylinks the auditor reads from the
+	// database at once.
+	auditPageSize = 1000
+
+	// maxReportedExtras is the maximum number of unknown hashes on skyd's
+	// blocklist that are kept in the audit report, the report always holds
+	// the total number of them.
+	maxReportedExtras = 100
+)
+
+var (
+	// errAuditStopped is returned when the auditor got stopped in the middle
+	// of an audit.
+	errAuditStopped = errors.New("auditor stopped")
+)
+
+type (
+	// Auditor periodically compares the database with skyd's blocklist. Hashes
+	// that skyd confirmed blocking but that are no longer on its blocklist are
+	// queued to be blocked again. Hashes on skyd's blocklist that the database
+	// doesn't know about are reported, but left untouched, they might have been
+	// blocked by someone other than the blocker.
+	Auditor struct {
+		started bool
+
+		// auditing is true while an audit is running.
+		auditing bool
+
+		// lastReport is the report of the last audit that completed, lastErr
+		// is the error of the last audit that failed.
+		lastReport *AuditReport
+		lastErr    error
+
+		staticDB         database.Store
+		staticInterval   time.Duration
+		staticLogger     *logrus.Entry
+		staticReblock    func([]database.Hash)
+		staticSkydClient *api.SkydClient
+		staticMu         sync.Mutex
+		staticStopChan   chan struct{}
+		staticWaitGroup  sync.WaitGroup
+	}
+
+	// AuditReport is the outcome of an audit.
+	AuditReport struct {
+		Started  time.Time `json:"started"`
+		Finished time.Time `json:"finished"`
+
+		// Blocklist is the number of hashes on skyd's blocklist.
+		Blocklist int `json:"blocklist"`
+
+		// Confirmed is the number of skylinks that skyd confirmed blocking.
+		Confirmed int `json:"confirmed"`
+
+		// Missing is the number of confirmed skylinks that were not on skyd's
+		// blocklist, they were queued to be blocked again.
+		Missing int `json:"missing"`
+
+		// Extra is the number of hashes on skyd's blocklist that the database
+		// doesn't know about, ExtraHashes holds up to maxReportedExtras of
+		// them.
+		Extra       int      `json:"extra"`
+		ExtraHashes []string `json:"extrahashes"`
+	}
+
+	// AuditorStatus is a snapshot of the auditor's state.
+	AuditorStatus struct {
+		Started    bool         `json:"started"`
+		Auditing   bool         `json:"auditing"`
+		LastReport *AuditReport `json:"lastreport,omitempty"`
+		LastError  string       `json:"lasterror,omitempty"`
+	}
+)
+
+// NewAuditor returns a new Auditor that audits the database against skyd's
+// blocklist every interval. The given reblock function is called with the
+// hashes that are missing from skyd's blocklist, it shouldn't block.
+func NewAuditor(skydClient *api.SkydClient, db database.Store, reblock func([]database.Hash), interval time.Duration, logger *logrus.Entry) (*Auditor, error) {
+	if skydClient == nil {
+		return nil, errors.New("no skyd client provided")
+	}
+	if db == nil {
+		return nil, errors.New("no DB provided")
+	}
+	if reblock == nil {
+		return nil, errors.New("no reblock function provided")
+	}
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+	if interval <= 0 {
+		return nil, errors.New("audit interval has to be positive")
+	}
+	a := &Auditor{
+		staticDB:         db,
+		staticInterval:   interval,
+		staticLogger:     logger,
+		staticReblock:    reblock,
+		staticSkydClient: skydClient,
+		staticStopChan:   make(chan struct{}),
+	}
+	return a, nil
+}
+
+// Start launches a background task that periodically runs an audit, the first
+// one runs after one interval.
+func (a *Auditor) Start() error {
+	a.staticMu.Lock()
+	defer a.staticMu.Unlock()
+
+	// assert 'Start' is only called once
+	if a.started {
+		return errors.New("auditor already started")
+	}
+	a.started = true
+
+	// start the audit loop
+	a.staticWaitGroup.Add(1)
+	go func() {
+		a.threadedAuditLoop()
+		a.staticWaitGroup.Done()
+	}()
+
+	return nil
+}
+
+// Stop waits for the auditor's waitgroup and times out after one minute.
+func (a *Auditor) Stop() error {
+	// check whether the auditor was started
+	a.staticMu.Lock()
+	if !a.started {
+		a.staticMu.Unlock()
+		return errors.New("auditor not started")
+	}
+	a.started = false
+	a.staticMu.Unlock()
+
+	// stop the auditor by closing the stop channel
+	close(a.staticStopChan)
+
+	// wait for the waitgroup, timeout and signal unclean shutdown after 1m
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		a.staticWaitGroup.Wait()
+	}()
+	select {
+	case <-c:
+		return nil
+	case <-time.After(stopTimeoutDuration):
+		return errors.New("unclean auditor shutdown")
+	}
+}
+
+// Status returns a snapshot of the auditor's state.
+func (a *Auditor) Status() AuditorStatus {
+	a.staticMu.Lock()
+	defer a.staticMu.Unlock()
+	status := AuditorStatus{
+		Started:    a.started,
+		Auditing:   a.auditing,
+		LastReport: a.lastReport,
+	}
+	if a.lastErr != nil {
+		status.LastError = a.lastErr.Error()
+	}
+	return status
+}
+
+// threadedAuditLoop holds the audit loop
+func (a *Auditor) threadedAuditLoop() {
+	for {
+		select {
+		case <-a.staticStopChan:
+			return
+		case <-time.After(a.staticInterval):
+		}
+
+		_, err := a.Audit()
+		if err != nil && !errors.Contains(err, errAuditStopped) {
+			a.staticLogger.WithError(err).Error("failed to audit skyd's blocklist")
+		}
+	}
+}
+
+// Audit compares the database with skyd's blocklist. Confirmed skylinks that
+// are missing from skyd's blocklist have the time they got blocked cleared
+// and are passed to the reblock function. Hashes on skyd's blocklist that are
+// unknown to the database are only reported.
+//
+// Skyd doesn't page its blocklist, so it's fetched in one go and kept in a set
+// of 32-byte hashes, the database is read in pages of auditPageSize skylinks.
+// Skylinks that got confirmed after skyd's blocklist was fetched are skipped,
+// they might be missing from it because they weren't blocked yet at the time.
+func (a *Auditor) Audit() (AuditReport, error) {
+	a.staticMu.Lock()
+	if a.auditing {
+		a.staticMu.Unlock()
+		return AuditReport{}, errors.New("audit already running")
+	}
+	a.auditing = true
+	a.staticMu.Unlock()
+
+	report, err := a.managedAudit()
+
+	a.staticMu.Lock()
+	a.auditing = false
+	a.lastErr = err
+	if err == nil {
+		a.lastReport = &report
+	}
+	a.staticMu.Unlock()
+	return report, err
+}
+
+// managedAudit runs an audit, see Audit.
+func (a *Auditor) managedAudit() (AuditReport, error) {
+	report := AuditReport{Started: database.Now()}
+
+	// build the set of hashes on skyd's blocklist
+	hashes, err := a.staticSkydClient.Blocklist()
+	if err != nil {
+		return AuditReport{}, err
+	}
+	blocklist := make(map[crypto.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		blocklist[hash.Hash] = struct{}{}
+	}
+	hashes = nil
+	report.Blocklist = len(blocklist)
+
+	// page through the skylinks, every hash the database knows about is
+	// removed from the set so only the unknown ones remain
+	var after primitive.ObjectID
+	for {
+		select {
+		case <-a.staticStopChan:
+			return AuditReport{}, errAuditStopped
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+		page, err := a.staticDB.SkylinksAfter(ctx, after, auditPageSize)
+		if err != nil {
+			cancel()
+			return AuditReport{}, errors.AddContext(err, "failed to fetch skylinks")
+		}
+
+		var missing []database.Hash
+		for _, sl := range page {
+			_, blocked := blocklist[sl.Hash.Hash]
+			delete(blocklist, sl.Hash.Hash)
+			if sl.Deleted || !sl.IsBlocked() || !sl.TimestampBlocked.Before(report.Started) {
+				continue
+			}
+			report.Confirmed++
+			if !blocked {
+				missing = append(missing, sl.Hash)
+			}
+		}
+
+		// requeue the missing hashes
+		if len(missing) > 0 {
+			err = a.staticDB.ClearBlocked(ctx, missing)
+			if err != nil {
+				cancel()
+				return AuditReport{}, errors.AddContext(err, "failed to clear the blocked timestamp of missing hashes")
+			}
+			a.staticReblock(missing)
+			report.Missing += len(missing)
+		}
+		cancel()
+
+		if len(page) < auditPageSize {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+
+	// report the unknown hashes
+	report.Extra = len(blocklist)
+	for hash := range blocklist {
+		if len(report.ExtraHashes) == maxReportedExtras {
+			break
+		}
+		report.ExtraHashes = append(report.ExtraHashes, database.Hash{Hash: hash}.String())
+	}
+	report.Finished = database.Now()
+
+	logger := a.staticLogger.WithFields(logrus.Fields{
+		"blocklist": report.Blocklist,
+		"confirmed": report.Confirmed,
+		"missing":   report.Missing,
+		"extra":     report.Extra,
+	})
+	if report.Missing > 0 {
+		logger.Warn("Audit found hashes missing from skyd's blocklist, they were queued to be blocked again")
+	}
+	if report.Extra > 0 {
+		logger.WithField("hashes", report.ExtraHashes).Warn("Audit found hashes on skyd's blocklist that are unknown to the database")
+	}
+	if report.Missing == 0 && report.Extra == 0 {
+		logger.Info("Audit found the database and skyd's blocklist to be consistent")
+	}
+	return report, nil
+}
@@ -0,0 +1,125 @@
+package blocker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/database"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+	"go.sia.tech/siad/crypto"
+)
+
+// TestAuditor verifies the auditor requeues confirmed hashes that are missing
+// from skyd's blocklist and reports the hashes on skyd's blocklist that the
+// database doesn't know about, without touching them.
+func TestAuditor(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create the database and insert four confirmed hashes, one that's
+	// pending and one that's invalid
+	db := database.NewTestDB(ctx, t.Name(), database.WithCleanup(t))
+	var hashes []database.Hash
+	for i := 0; i < 6; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("skylink_%d", i)))
+		bs := &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now().Add(-time.Hour),
+		}
+		if i < 4 {
+			bs.TimestampBlocked = database.Now().Add(-time.Hour)
+		}
+		err := db.CreateBlockedSkylink(ctx, bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	err := db.MarkInvalid(ctx, hashes[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a skyd that lost the third and fourth hash, and that holds a
+	// hash the database doesn't know about
+	extra := database.HashBytes([]byte("extra"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteJSON(w, skyapi.SkynetBlocklistGET{
+			Blocklist: []crypto.Hash{hashes[0].Hash, hashes[1].Hash, extra.Hash},
+		})
+	}))
+	defer server.Close()
+
+	// create the auditor, recording the hashes it requeues
+	var reblocked []database.Hash
+	reblock := func(hashes []database.Hash) {
+		reblocked = append(reblocked, hashes...)
+	}
+	logger, _ := logtest.NewNullLogger()
+	auditor, err := NewAuditor(api.NewSkydClient(server.URL, ""), db, reblock, time.Hour, logger.WithField("module", "blocker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run an audit
+	report, err := auditor.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blocklist != 3 || report.Confirmed != 4 || report.Missing != 2 || report.Extra != 1 {
+		t.Fatal("unexpected report", report)
+	}
+	if len(report.ExtraHashes) != 1 || report.ExtraHashes[0] != extra.String() {
+		t.Fatal("unexpected extra hashes", report.ExtraHashes)
+	}
+	if status := auditor.Status(); status.LastReport == nil || status.LastReport.Missing != 2 || status.LastError != "" {
+		t.Fatal("unexpected status", status)
+	}
+
+	// assert the missing hashes got requeued and are pending again
+	if len(reblocked) != 2 || reblocked[0] != hashes[2] || reblocked[1] != hashes[3] {
+		t.Fatal("unexpected reblocked hashes", reblocked)
+	}
+	for i, hash := range hashes[:4] {
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+		if doc.TimestampBlocked.IsZero() != (i >= 2) {
+			t.Fatal("unexpected timestamp blocked", i, doc.TimestampBlocked)
+		}
+		requeued := len(doc.Events) == 1 && doc.Events[0].Type == database.EventRequeued
+		if requeued != (i >= 2) {
+			t.Fatal("unexpected events", i, doc.Events)
+		}
+	}
+
+	// assert the extra hash wasn't added to the database
+	doc, err := db.FindByHash(ctx, extra)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// run another audit, the requeued hashes are not confirmed until the
+	// blocker blocked them again so they are not reported twice
+	reblocked = nil
+	report, err = auditor.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Confirmed != 2 || report.Missing != 0 || report.Extra != 1 || len(reblocked) != 0 {
+		t.Fatal("unexpected report", report, reblocked)
+	}
+}
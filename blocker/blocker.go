@@ -1,12 +1,16 @@
 package blocker
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"runtime/pprof"
 	"sync"
 	"time"
 
 	"github.com/SkynetLabs/blocker/api"
 	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/events"
 	"github.com/SkynetLabs/skynet-accounts/build"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
@@ -17,15 +21,43 @@ const (
 	// blocking simultaneously.
 	blockBatchSize = 100
 
-	// stopTimeoutDuration is the amount of time we wait when stop is called
-	// before cancelling out and returning with an error indicating an unclean
-	// shutdown.
+	// bootstrapBatchSize is the max number of hashes of skyd's blocklist
+	// that are looked up at once when bootstrapping from skyd.
+	bootstrapBatchSize = 1000
+
+	// DefaultBatchTimeout is the default amount of time we give skyd to block
+	// a batch of hashes.
+	DefaultBatchTimeout = 30 * time.Second
+
+	// DefaultLagThreshold is the default lag above which every sweep logs a
+	// warning, see Blocker.Lag.
+	DefaultLagThreshold = 15 * time.Minute
+
+	// DefaultMaxBatchBytes is the default maximum size, in bytes, of the body
+	// of a request that blocks a batch of hashes.
+	DefaultMaxBatchBytes = 1 << 20
+
+	// DefaultRetryLimit is the default maximum number of hashes that get
+	// retried per run of the retry loop.
+	DefaultRetryLimit = 1000
+
+	// markFlushBatches is the maximum number of batches of which the success
+	// markers are coalesced into a single update.
+	markFlushBatches = 10
+
+	// stopTimeoutDuration is the default amount of time we wait when stop is
+	// called before cancelling out and returning with an error indicating an
+	// unclean shutdown.
 	stopTimeoutDuration = time.Minute
 )
 
 var (
-	// blockInterval defines the amount of time between fetching hashes that
-	// need to be blocked from the database.
+	// ErrInterrupted is returned by BlockHashes when the blocker got stopped
+	// before all hashes were sent to skyd.
+	ErrInterrupted = errors.New("blocking got interrupted by shutdown")
+
+	// blockInterval defines the default amount of time between fetching
+	// hashes that need to be blocked from the database.
 	blockInterval = build.Select(
 		build.Var{
 			Dev:      10 * time.Second,
@@ -34,9 +66,19 @@ var (
 		},
 	).(time.Duration)
 
-	// retryInterval defines the amount of time between retries of blocked
-	// hashes that failed to get blocked the first time around. This interval
-	// is (a lot) higher than the blockInterval.
+	// markFlushInterval is the maximum amount of time the success markers of
+	// consecutive batches are held before they're flushed.
+	markFlushInterval = build.Select(
+		build.Var{
+			Dev:      5 * time.Second,
+			Testing:  time.Minute,
+			Standard: 5 * time.Second,
+		},
+	).(time.Duration)
+
+	// retryInterval defines the default amount of time between retries of
+	// blocked hashes that failed to get blocked the first time around. This
+	// interval is (a lot) higher than the blockInterval.
 	retryInterval = build.Select(
 		build.Var{
 			Dev:      time.Minute,
@@ -47,6 +89,21 @@ var (
 )
 
 type (
+	// allowLister looks up which hashes are on the allow list, it's
+	// implemented by the database.
+	allowLister interface {
+		AllowListedHashes(ctx context.Context, hashes []database.Hash) ([]database.Hash, error)
+	}
+
+	// hashMarker persists the outcome of sending hashes to skyd, it's
+	// implemented by the database.
+	hashMarker interface {
+		MarkSucceeded(ctx context.Context, hashes []database.Hash) error
+		MarkInvalid(ctx context.Context, hashes []database.Hash) error
+		MarkFailed(ctx context.Context, hashes []database.Hash, class, reason string) error
+		ReconcileBlocked(ctx context.Context, hashes []database.Hash) (marked, unmarked []database.Hash, err error)
+	}
+
 	// Blocker scans the database for skylinks that should be blocked and calls
 	// skyd to block them.
 	Blocker struct {
@@ -57,17 +114,231 @@ type (
 		// to block.
 		latestBlockTime time.Time
 
-		staticDB         *database.DB
-		staticLogger     *logrus.Logger
-		staticMu         sync.Mutex
-		staticSkydClient *api.SkydClient
-		staticStopChan   chan struct{}
-		staticWaitGroup  sync.WaitGroup
+		// lastBatchSize and lastBatchBytes are the number of hashes and the
+		// size of the request of the last batch sent to skyd.
+		lastBatchSize  int
+		lastBatchBytes int
+
+		// blocking and retrying indicate whether the block and retry loop are
+		// currently processing hashes, batchStart and batchTotal indicate the
+		// progress of the current call to 'BlockHashes'. They help diagnosing
+		// a blocker that fails to stop.
+		blocking   bool
+		retrying   bool
+		batchStart int
+		batchTotal int
+
+		// blockPending is true while the block loop is blocking new hashes,
+		// blockDone gets closed when it's done. The retry loop waits for it
+		// in between batches so retries don't starve the block loop.
+		blockPending bool
+		blockDone    chan struct{}
+
+		// nextBlockRun and nextRetryRun are the times the block and retry
+		// loop are scheduled to wake up, they're recorded when the loop goes
+		// to sleep and nextBlockRun is moved forward by TriggerBlock. They're
+		// zero until the loop completed its first run.
+		nextBlockRun time.Time
+		nextRetryRun time.Time
+
+		// retryQueueBefore and retryQueueAfter are the number of hashes that
+		// were waiting to be retried before and after the last retry run.
+		retryQueueBefore int
+		retryQueueAfter  int
+
+		// lag is the amount of time between the start of the last sweep and
+		// the time the oldest hash that is still waiting to get blocked was
+		// added, it's zero if there are none.
+		lag time.Duration
+
+		// reblockQueue holds the hashes that were queued through Reblock,
+		// they are sent to skyd again by the next run of the block loop
+		// regardless of whether they were blocked before.
+		reblockQueue map[database.Hash]struct{}
+
+		// persistQueue holds the hashes that skyd blocked but that failed to
+		// be marked as succeeded, the next run of the block loop marks them
+		// without sending them to skyd again. Until then they're skipped by
+		// both loops.
+		persistQueue map[database.Hash]struct{}
+
+		// staticAllowList is used to skip allowlisted hashes, if it fails
+		// hashes aren't blocked unless staticAllowListFailOpen is set.
+		staticAllowList         allowLister
+		staticAllowListFailOpen bool
+
+		// staticMarker persists the outcome of sending hashes to skyd.
+		staticMarker hashMarker
+
+		// staticServerUID identifies the blocker, the latest block time is
+		// stored under it so a restart resumes where the blocker left off.
+		// If it's empty the latest block time isn't stored. A blocker with
+		// an unknown server UID initialises its latest block time from
+		// skyd's blocklist if staticBootstrapFromSkyd is set.
+		staticServerUID         string
+		staticBootstrapFromSkyd bool
+
+		// staticBus is the event bus the outcome of sending hashes to skyd
+		// is published on, it's nil if no bus was configured.
+		staticBus *events.Bus
+
+		staticBatchTimeout  time.Duration
+		staticBlockInterval time.Duration
+		staticDB            database.Store
+		staticLagThreshold  time.Duration
+		staticLogger        *logrus.Entry
+		staticMaxBatchBytes int
+		staticMu            sync.Mutex
+		staticRetryInterval time.Duration
+		staticRetryLimit    int
+		staticSeverities    database.SeverityMapping
+		staticSkydClient    *api.SkydClient
+		staticStaleAge      time.Duration
+		staticStopChan      chan struct{}
+		staticStopTimeout   time.Duration
+		staticTriggerChan   chan struct{}
+		staticWaitGroup     sync.WaitGroup
+	}
+
+	// Option configures a Blocker.
+	Option func(*Blocker)
+
+	// Status is a snapshot of the blocker's state.
+	Status struct {
+		Started          bool      `json:"started"`
+		LatestBlockTime  time.Time `json:"latestblocktime"`
+		LastBatchSize    int       `json:"lastbatchsize"`
+		LastBatchBytes   int       `json:"lastbatchbytes"`
+		Blocking         bool      `json:"blocking"`
+		Retrying         bool      `json:"retrying"`
+		BatchStart       int       `json:"batchstart"`
+		BatchTotal       int       `json:"batchtotal"`
+		RetryQueueBefore int       `json:"retryqueuebefore"`
+		RetryQueueAfter  int       `json:"retryqueueafter"`
+		ReblockQueue     int       `json:"reblockqueue"`
+		PersistQueue     int       `json:"persistqueue"`
+		NextBlockRun     time.Time `json:"nextblockrun"`
+		NextRetryRun     time.Time `json:"nextretryrun"`
+
+		// Lag is the lag of the blocker in nanoseconds, see Blocker.Lag.
+		Lag time.Duration `json:"lag"`
 	}
 )
 
+// WithAllowListFailOpen sets whether hashes are blocked when the allow list
+// can't be checked, by default they are not, which prevents blocking
+// allowlisted content while the database is unavailable.
+func WithAllowListFailOpen(failOpen bool) Option {
+	return func(bl *Blocker) {
+		bl.staticAllowListFailOpen = failOpen
+	}
+}
+
+// WithBatchTimeout sets the amount of time we give skyd to block a batch of
+// hashes, it defaults to DefaultBatchTimeout.
+func WithBatchTimeout(timeout time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticBatchTimeout = timeout
+	}
+}
+
+// WithBlockInterval sets the amount of time between sweeps of the database for
+// new hashes to block.
+func WithBlockInterval(interval time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticBlockInterval = interval
+	}
+}
+
+// WithBootstrapFromSkyd sets whether a blocker that runs for the first time
+// under its server UID initialises its latest block time from skyd's
+// blocklist, rather than sending the entire blocklist to skyd. The hashes on
+// skyd's blocklist are marked as blocked, which assumes skyd's blocklist is
+// trustworthy. It requires a server UID, see WithServerUID.
+func WithBootstrapFromSkyd(bootstrap bool) Option {
+	return func(bl *Blocker) {
+		bl.staticBootstrapFromSkyd = bootstrap
+	}
+}
+
+// WithEventBus sets the event bus the blocker publishes on whenever it marks
+// hashes as blocked, failed or invalid.
+func WithEventBus(bus *events.Bus) Option {
+	return func(bl *Blocker) {
+		bl.staticBus = bus
+	}
+}
+
+// WithLagThreshold sets the lag above which every sweep logs a warning, it
+// defaults to DefaultLagThreshold.
+func WithLagThreshold(threshold time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticLagThreshold = threshold
+	}
+}
+
+// WithMaxBatchBytes sets the maximum size, in bytes, of the body of a request
+// that blocks a batch of hashes, it defaults to DefaultMaxBatchBytes. Batches
+// are shrunk to stay within this budget, a single hash is always sent though.
+func WithMaxBatchBytes(n int) Option {
+	return func(bl *Blocker) {
+		bl.staticMaxBatchBytes = n
+	}
+}
+
+// WithRetryInterval sets the amount of time between retries of hashes that
+// failed to get blocked.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticRetryInterval = interval
+	}
+}
+
+// WithRetryLimit sets the maximum number of hashes that get retried per run of
+// the retry loop, it defaults to DefaultRetryLimit.
+func WithRetryLimit(n int) Option {
+	return func(bl *Blocker) {
+		bl.staticRetryLimit = n
+	}
+}
+
+// WithServerUID sets the server UID the latest block time is stored under,
+// which lets a restarted blocker resume where it left off rather than send
+// the entire blocklist to skyd again.
+func WithServerUID(serverUID string) Option {
+	return func(bl *Blocker) {
+		bl.staticServerUID = serverUID
+	}
+}
+
+// WithSeverities sets the mapping of tags onto severities that is used to rank
+// hashes that have no severity, e.g. because they were synced from another
+// portal. Hashes are blocked in order of their severity.
+func WithSeverities(severities database.SeverityMapping) Option {
+	return func(bl *Blocker) {
+		bl.staticSeverities = severities
+	}
+}
+
+// WithStaleServerAge sets the amount of time after which the latest block
+// timestamp of a blocker that stopped updating it is removed, it defaults to
+// database.DefaultStaleServerAge. The retry loop removes them.
+func WithStaleServerAge(age time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticStaleAge = age
+	}
+}
+
+// WithStopTimeout sets the amount of time Stop waits for the blocker's loops
+// to exit before it gives up, it defaults to one minute.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(bl *Blocker) {
+		bl.staticStopTimeout = timeout
+	}
+}
+
 // New returns a new Blocker with the given parameters.
-func New(skydClient *api.SkydClient, db *database.DB, logger *logrus.Logger) (*Blocker, error) {
+func New(skydClient *api.SkydClient, db database.Store, logger *logrus.Entry, opts ...Option) (*Blocker, error) {
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
@@ -78,48 +349,147 @@ func New(skydClient *api.SkydClient, db *database.DB, logger *logrus.Logger) (*B
 		return nil, errors.New("no Skyd client provided")
 	}
 	bl := &Blocker{
-		staticDB:         db,
-		staticLogger:     logger,
-		staticSkydClient: skydClient,
-		staticStopChan:   make(chan struct{}),
+		staticAllowList:     db,
+		staticBatchTimeout:  DefaultBatchTimeout,
+		staticBlockInterval: blockInterval,
+		staticDB:            db,
+		staticLagThreshold:  DefaultLagThreshold,
+		staticLogger:        logger,
+		staticMarker:        db,
+		staticMaxBatchBytes: DefaultMaxBatchBytes,
+		staticRetryInterval: retryInterval,
+		staticRetryLimit:    DefaultRetryLimit,
+		staticSkydClient:    skydClient,
+		staticStaleAge:      database.DefaultStaleServerAge,
+		staticStopChan:      make(chan struct{}),
+		staticStopTimeout:   stopTimeoutDuration,
+		staticTriggerChan:   make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(bl)
+	}
+	if bl.staticBatchTimeout <= 0 {
+		return nil, errors.New("batch timeout has to be positive")
+	}
+	if bl.staticBlockInterval <= 0 || bl.staticRetryInterval <= 0 {
+		return nil, errors.New("block and retry interval have to be positive")
+	}
+	if bl.staticLagThreshold <= 0 {
+		return nil, errors.New("lag threshold has to be positive")
+	}
+	if bl.staticMaxBatchBytes <= 0 {
+		return nil, errors.New("max batch bytes has to be positive")
+	}
+	if bl.staticRetryLimit <= 0 {
+		return nil, errors.New("retry limit has to be positive")
+	}
+	if bl.staticStopTimeout <= 0 {
+		return nil, errors.New("stop timeout has to be positive")
+	}
+	if bl.staticStaleAge <= 0 {
+		return nil, errors.New("stale server age has to be positive")
+	}
+	if bl.staticBootstrapFromSkyd && bl.staticServerUID == "" {
+		return nil, errors.New("bootstrapping from skyd requires a server UID")
 	}
 	return bl, nil
 }
 
 // BlockHashes blocks the given list of hashes. It returns the amount of hashes
 // which were blocked successfully, the amount that were invalid, and a
-// potential error.
+// potential error. If the blocker gets stopped before all hashes were sent to
+// skyd, it returns the counts so far and ErrInterrupted.
 func (bl *Blocker) BlockHashes(hashes []database.Hash) (int, int, error) {
+	// skip the hashes that are allowlisted, the API refuses to block them
+	// but they might have entered the database through the syncer or have
+	// been allowlisted after they got reported
+	hashes, err := bl.managedSkipAllowListed(hashes)
+	if err != nil {
+		return 0, 0, err
+	}
+
 	start := 0
 
 	// keep track of the amount of blocked and invalid hashes
 	var numBlocked int
 	var numInvalid int
 
+	// the batch size starts at the maximum and shrinks whenever skyd rejects
+	// a batch for being too large
+	batchSize := blockBatchSize
+
+	// the success markers of consecutive batches are coalesced into a single
+	// update, which is flushed every markFlushBatches batches or after
+	// markFlushInterval, whichever comes first, and before we return. A crash
+	// loses at most the markers of one flush window, those hashes are sent
+	// to skyd again by the next sweep.
+	var unflushed []database.Hash
+	var unflushedBatches int
+	lastFlush := time.Now()
+	flush := func() {
+		if len(unflushed) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+			defer cancel()
+			bl.managedMarkSucceeded(ctx, unflushed)
+		}
+		unflushed = nil
+		unflushedBatches = 0
+		lastFlush = time.Now()
+	}
+	defer flush()
+
 	for start < len(hashes) {
 		// check whether we need to escape
 		select {
 		case <-bl.staticStopChan:
-			return numBlocked, numInvalid, nil
+			return numBlocked, numInvalid, ErrInterrupted
 		default:
 		}
 
-		// calculate the end of the batch range
-		end := start + blockBatchSize
+		// calculate the end of the batch range, shrinking the batch until its
+		// request fits within the byte budget
+		end := start + batchSize
 		if end > len(hashes) {
 			end = len(hashes)
 		}
+		size := api.BlockRequestSize(hashes[start:end])
+		for end-start > 1 && size > bl.staticMaxBatchBytes {
+			end--
+			size = api.BlockRequestSize(hashes[start:end])
+		}
 
 		// create the batch
 		batch := hashes[start:end]
+		bl.managedUpdateBatch(start, len(hashes), len(batch), size)
 
-		// send the batch to skyd, if an error occurs we mark it as failed and
+		// send the batch to skyd
+		blocked, invalid, err := bl.staticSkydClient.BlockHashesWithTimeout(batch, bl.staticBatchTimeout)
+
+		// if skyd rejected the batch for being too large, we retry it in
+		// smaller batches
+		if errors.Contains(err, api.ErrRequestTooLarge) && len(batch) > 1 {
+			batchSize = len(batch) / 2
+			bl.staticLogger.WithFields(logrus.Fields{
+				"batch_size":  len(batch),
+				"batch_bytes": size,
+			}).Warn("Skyd rejected the batch for being too large, shrinking the batch")
+			continue
+		}
+
+		// if the request timed out, skyd might have blocked (some of) the
+		// hashes, so we verify which hashes made it onto the blocklist and
 		// escape early because something is probably wrong
-		blocked, invalid, err := bl.staticSkydClient.BlockHashes(batch)
+		if errors.Contains(err, api.ErrSkydTimeout) {
+			n, verifyErr := bl.managedVerifyBatch(batch, err)
+			return numBlocked + n, numInvalid, errors.Compose(err, verifyErr)
+		}
+
+		// if an error occurs we mark the batch as failed and escape early
+		// because something is probably wrong
 		if err != nil {
 			ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
 			defer cancel()
-			err = errors.Compose(err, bl.staticDB.MarkFailed(ctx, batch))
+			err = errors.Compose(err, bl.managedMarkFailed(ctx, batch, failureClass(err), err.Error()))
 			return numBlocked, numInvalid, err
 		}
 
@@ -127,17 +497,31 @@ func (bl *Blocker) BlockHashes(hashes []database.Hash) (int, int, error) {
 		numBlocked += len(blocked)
 		numInvalid += len(invalid)
 
-		// create a context
-		ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+		// queue the success markers, skyd blocked the hashes so if they fail
+		// to be marked as succeeded they're queued to be persisted by the
+		// next sweep rather than being sent to skyd again
+		unflushed = append(unflushed, blocked...)
+		unflushedBatches++
+		if unflushedBatches >= markFlushBatches || time.Since(lastFlush) >= markFlushInterval {
+			flush()
+		}
 
-		// update the documents
-		err1 := bl.staticDB.MarkSucceeded(ctx, blocked)
-		err2 := bl.staticDB.MarkInvalid(ctx, invalid)
-		if err := errors.Compose(err1, err2); err != nil {
+		// mark the invalid hashes
+		if len(invalid) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+			err = bl.staticDB.Retry(ctx, func() error {
+				return bl.staticMarker.MarkInvalid(ctx, invalid)
+			})
 			cancel()
-			return numBlocked, numInvalid, err
+			if err != nil {
+				return numBlocked, numInvalid, err
+			}
+			bl.staticBus.Publish(events.Event{
+				Type:      events.BlockInvalid,
+				Publisher: events.PublisherBlocker,
+				Hashes:    invalid,
+			})
 		}
-		cancel()
 
 		// update start
 		start = end
@@ -146,6 +530,174 @@ func (bl *Blocker) BlockHashes(hashes []database.Hash) (int, int, error) {
 	return numBlocked, numInvalid, nil
 }
 
+// managedVerifyBatch is called when blocking the given batch timed out with
+// the given error, in which case we don't know whether skyd blocked the
+// hashes. It looks up which hashes of the batch are on skyd's blocklist, marks
+// those as succeeded and the others as failed. It returns the number of hashes
+// that were blocked. If the blocklist can't be fetched, the entire batch is
+// marked as failed.
+func (bl *Blocker) managedVerifyBatch(batch []database.Hash, batchErr error) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	blocklist, err := bl.staticSkydClient.Blocklist()
+	if err != nil {
+		err = errors.AddContext(err, "failed to verify batch that timed out")
+		return 0, errors.Compose(err, bl.managedMarkFailed(ctx, batch, database.FailureClassTransient, batchErr.Error()))
+	}
+
+	onBlocklist := make(map[database.Hash]struct{}, len(blocklist))
+	for _, hash := range blocklist {
+		onBlocklist[hash] = struct{}{}
+	}
+	var blocked, failed []database.Hash
+	for _, hash := range batch {
+		if _, exists := onBlocklist[hash]; exists {
+			blocked = append(blocked, hash)
+		} else {
+			failed = append(failed, hash)
+		}
+	}
+	bl.staticLogger.WithFields(logrus.Fields{
+		"blocked": len(blocked),
+		"failed":  len(failed),
+	}).Warn("Blocking batch timed out, verified its hashes against skyd's blocklist")
+
+	bl.managedMarkSucceeded(ctx, blocked)
+	if len(failed) > 0 {
+		err = bl.managedMarkFailed(ctx, failed, database.FailureClassTransient, batchErr.Error())
+	}
+	return len(blocked), err
+}
+
+// managedMarkSucceeded marks the given hashes, which skyd blocked, as
+// succeeded, retrying if the database is failing over. If that fails the
+// hashes are queued to be persisted by the next run of the block loop.
+func (bl *Blocker) managedMarkSucceeded(ctx context.Context, hashes []database.Hash) {
+	if len(hashes) == 0 {
+		return
+	}
+	err := bl.staticDB.Retry(ctx, func() error {
+		return bl.staticMarker.MarkSucceeded(ctx, hashes)
+	})
+	if err != nil {
+		bl.staticLogger.WithError(err).WithField("hashes", len(hashes)).Warn("Failed to mark blocked hashes as succeeded, queued them to be persisted")
+		bl.managedQueuePersist(hashes)
+		return
+	}
+	bl.staticBus.Publish(events.Event{
+		Type:      events.BlockConfirmed,
+		Publisher: events.PublisherBlocker,
+		Hashes:    hashes,
+	})
+}
+
+// managedPersistQueued marks the hashes in the persist queue as succeeded,
+// without sending them to skyd again. Only the hashes that still lack the
+// success marker get marked, if that fails all hashes are queued again.
+func (bl *Blocker) managedPersistQueued() error {
+	hashes := bl.managedTakePersistQueue()
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	var unmarked []database.Hash
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		_, unmarked, err = bl.staticMarker.ReconcileBlocked(ctx, hashes)
+		return err
+	})
+	if err == nil {
+		err = bl.staticDB.Retry(ctx, func() error {
+			return bl.staticMarker.MarkSucceeded(ctx, unmarked)
+		})
+	}
+	if err != nil {
+		bl.managedQueuePersist(hashes)
+		return errors.AddContext(err, "failed to persist blocked hashes")
+	}
+	if len(unmarked) > 0 {
+		bl.staticBus.Publish(events.Event{
+			Type:      events.BlockConfirmed,
+			Publisher: events.PublisherBlocker,
+			Hashes:    unmarked,
+		})
+	}
+	bl.staticLogger.WithFields(logrus.Fields{
+		"queued":    len(hashes),
+		"persisted": len(unmarked),
+	}).Info("Persisted blocked hashes")
+	return nil
+}
+
+// managedMarkFailed marks the given hashes as failed, retrying if the database
+// is failing over.
+func (bl *Blocker) managedMarkFailed(ctx context.Context, hashes []database.Hash, class, reason string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	err := bl.staticDB.Retry(ctx, func() error {
+		return bl.staticMarker.MarkFailed(ctx, hashes, class, reason)
+	})
+	if err != nil {
+		return err
+	}
+	bl.staticBus.Publish(events.Event{
+		Type:      events.BlockFailed,
+		Publisher: events.PublisherBlocker,
+		Hashes:    hashes,
+		Reason:    reason,
+	})
+	return nil
+}
+
+// managedSkipAllowListed returns the given hashes without the ones that are on
+// the allow list. The allowlisted hashes get marked as skipped, which prevents
+// them from being picked up by the block and retry loops again. If the allow
+// list can't be checked an error is returned, unless the blocker is configured
+// to fail open, in which case all hashes are returned.
+func (bl *Blocker) managedSkipAllowListed(hashes []database.Hash) ([]database.Hash, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	var allowlisted []database.Hash
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		allowlisted, err = bl.staticAllowList.AllowListedHashes(ctx, hashes)
+		return err
+	})
+	if err != nil && bl.staticAllowListFailOpen {
+		bl.staticLogger.WithError(err).Warn("Failed to look up allowlisted hashes, blocking all hashes")
+		return hashes, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to look up allowlisted hashes")
+	}
+	if len(allowlisted) == 0 {
+		return hashes, nil
+	}
+	err = bl.staticDB.Retry(ctx, func() error {
+		return bl.staticDB.MarkSkippedAllowListed(ctx, allowlisted)
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to mark allowlisted hashes as skipped")
+	}
+	bl.staticLogger.WithField("skipped", len(allowlisted)).Info("Skipped allowlisted hashes")
+
+	skip := make(map[database.Hash]struct{}, len(allowlisted))
+	for _, hash := range allowlisted {
+		skip[hash] = struct{}{}
+	}
+	filtered := make([]database.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		if _, exists := skip[hash]; !exists {
+			filtered = append(filtered, hash)
+		}
+	}
+	return filtered, nil
+}
+
 // Start launches the two backgrounds that periodically scan for new hashes to
 // block or retry hashes that failed to get blocked the first time around.
 func (bl *Blocker) Start() error {
@@ -174,7 +726,9 @@ func (bl *Blocker) Start() error {
 	return nil
 }
 
-// Stop waits for the blocker's waitgroup and times out after one minute.
+// Stop waits for the blocker's waitgroup and times out after the configured
+// stop timeout. On timeout it logs the blocker's state and a dump of all
+// goroutines, to help figuring out what prevented it from stopping.
 func (bl *Blocker) Stop() error {
 	// check whether the blocker was started
 	bl.staticMu.Lock()
@@ -197,28 +751,81 @@ func (bl *Blocker) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(stopTimeoutDuration):
+	case <-time.After(bl.staticStopTimeout):
+		var goroutines bytes.Buffer
+		_ = pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+		bl.staticLogger.WithFields(logrus.Fields{
+			"status":     bl.Status(),
+			"goroutines": goroutines.String(),
+		}).Error("Blocker failed to stop in time")
 		return errors.New("unclean blocker shutdown")
 	}
 }
 
+// TriggerBlock signals the block loop to sweep the database for new hashes
+// immediately rather than waiting for the block interval to elapse. It never
+// blocks, triggers that arrive while a sweep is pending are coalesced.
+func (bl *Blocker) TriggerBlock() {
+	select {
+	case bl.staticTriggerChan <- struct{}{}:
+	default:
+	}
+
+	// the block loop wakes up right away, or as soon as the current sweep
+	// is done
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	if bl.started {
+		bl.nextBlockRun = database.Now()
+	}
+}
+
+// Reblock queues the given hashes to be sent to skyd again by the block loop,
+// regardless of whether they were blocked before, and triggers it. It's meant
+// to replay the blocklist after skyd lost it, e.g. after a data wipe. It never
+// blocks.
+func (bl *Blocker) Reblock(hashes []database.Hash) {
+	bl.managedQueueReblock(hashes)
+	bl.TriggerBlock()
+}
+
 // threadedBlockLoop holds the main block loop
 func (bl *Blocker) threadedBlockLoop() {
 	// convenience variables
 	logger := bl.staticLogger
 
+	// Resume from the latest block time we stored, if we didn't store one
+	// yet it's bootstrapped from skyd's blocklist if enabled
+	err := bl.managedInitLatestBlockTime()
+	if err != nil {
+		logger.WithError(err).Error("Failed to initialise the latest block time, all hashes will be sent to skyd")
+	}
+
 	for {
+		bl.managedSetBlocking(true)
 		err := bl.managedBlock()
+		bl.managedSetBlocking(false)
 		if err != nil {
-			logger.Debugf("threadedBlockLoop error: %v", err)
+			logger.WithError(err).Debug("threadedBlockLoop error")
 		} else {
-			logger.Debugf("threadedBlockLoop ran successfully.")
+			logger.Debug("threadedBlockLoop ran successfully.")
+		}
+
+		// Remove the hashes that got reverted from skyd's blocklist
+		err = bl.managedUnblock()
+		if err != nil {
+			logger.WithError(err).Error("Failed to unblock reverted hashes")
 		}
 
+		timer := time.NewTimer(bl.managedScheduleBlockRun())
 		select {
 		case <-bl.staticStopChan:
+			timer.Stop()
 			return
-		case <-time.After(blockInterval):
+		case <-bl.staticTriggerChan:
+			timer.Stop()
+			logger.Debug("threadedBlockLoop triggered")
+		case <-timer.C:
 		}
 	}
 }
@@ -229,56 +836,362 @@ func (bl *Blocker) threadedRetryLoop() {
 	logger := bl.staticLogger
 
 	for {
+		bl.managedSetRetrying(true)
 		err := bl.managedRetryHashes()
+		bl.managedSetRetrying(false)
 		if err != nil {
-			logger.Debugf("threadedRetryLoop error: %v", err)
+			logger.WithError(err).Debug("threadedRetryLoop error")
 		} else {
-			logger.Debugf("threadedRetryLoop ran successfully.")
+			logger.Debug("threadedRetryLoop ran successfully.")
+		}
+
+		// Remove the latest block timestamps of blockers that no longer run
+		err = bl.managedPruneStaleServers()
+		if err != nil {
+			logger.WithError(err).Error("Failed to prune the latest block timestamps of stale servers")
 		}
 
+		timer := time.NewTimer(bl.managedScheduleRetryRun())
 		select {
 		case <-bl.staticStopChan:
+			timer.Stop()
 			return
-		case <-time.After(retryInterval):
+		case <-timer.C:
 		}
 	}
 }
 
-// managedBlock sweeps the DB for new hashes to block.
+// managedBlock sweeps the DB for new hashes to block. The lag is updated when
+// the sweep is done.
 func (bl *Blocker) managedBlock() error {
-	now := time.Now().UTC()
+	now := database.Now()
 	from := bl.managedLatestBlockTime()
+	defer bl.managedUpdateLag(now)
 
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
 	defer cancel()
 
-	bl.staticLogger.Debugf("managedBlock blocking hashes from %v", from)
+	bl.staticLogger.WithField("from", from).Debug("managedBlock blocking hashes")
 
-	// Fetch hashes to block
-	hashes, err := bl.staticDB.HashesToBlock(ctx, from)
+	// Fetch hashes to block, skipping the ones that skyd blocked already but
+	// are still waiting to be persisted
+	var hashes []database.Hash
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		hashes, err = bl.staticDB.HashesToBlock(ctx, from, database.RankBySeverity(bl.staticSeverities))
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	bl.staticLogger.Debugf("managedBlock found %d hashes", len(hashes))
+	hashes = bl.managedSkipQueuedPersist(hashes)
+
+	// Persist the hashes that skyd blocked but that failed to be marked as
+	// succeeded, this happens after fetching the hashes to block so they
+	// don't get picked up by this sweep
+	err = bl.managedPersistQueued()
+	if err != nil {
+		bl.staticLogger.WithError(err).Error("Failed to persist queued hashes")
+	}
+
+	// Add the hashes that were queued to be blocked again
+	reblock := bl.managedTakeReblockQueue()
+	hashes = appendUnique(hashes, reblock)
+
+	logger := bl.staticLogger.WithField("batch_size", len(hashes))
+	logger.Debug("managedBlock found hashes")
 	if len(hashes) == 0 {
+		// Store the unchanged latest block time, which refreshes the time we
+		// last updated it, so an idle blocker isn't pruned as a stale server
+		err = bl.managedRefreshLatestBlockTime()
+		if err != nil {
+			logger.WithError(err).Error("Failed to refresh the latest block time")
+		}
 		return nil
 	}
 
-	bl.staticLogger.Tracef("managedBlock will block all these: %+v", hashes)
+	logger.WithField("hashes", hashes).Trace("managedBlock will block all these")
+
+	// Signal the retry loop there's pending work
+	done := bl.managedSetBlockPending()
+	defer done()
 
 	// Block the hashes
 	blocked, invalid, err := bl.BlockHashes(hashes)
+	if errors.Contains(err, ErrInterrupted) {
+		// Don't update the latest block time, the next sweep has to cover
+		// the hashes that weren't sent to skyd
+		logger.WithFields(logrus.Fields{
+			"blocked": blocked,
+			"invalid": invalid,
+		}).Info("Blocking hashes got interrupted by shutdown")
+		bl.managedQueueReblock(reblock)
+		return err
+	}
 	if err != nil {
-		bl.staticLogger.Errorf("Failed to block hashes: %s", err)
+		logger.WithError(err).Error("Failed to block hashes")
+		bl.managedQueueReblock(reblock)
 		return err
 	}
 
-	bl.staticLogger.Tracef("managedBlock blocked %v hashes, %v invalid hashes", blocked, invalid)
+	logger.WithFields(logrus.Fields{
+		"blocked": blocked,
+		"invalid": invalid,
+	}).Trace("managedBlock blocked hashes")
 
 	// Update the latest block time to the time immediately prior to fetching
 	// the hashes from the database.
 	bl.managedUpdateLatestBlockTime(now)
+	err = bl.managedStoreLatestBlockTime(now)
+	if err != nil {
+		logger.WithError(err).Error("Failed to store the latest block time")
+	}
+	return nil
+}
+
+// managedInitLatestBlockTime initialises the latest block time to the one we
+// stored under our server UID. If we didn't store one yet, because we run for
+// the first time, and bootstrapping is enabled, it's bootstrapped from skyd's
+// blocklist.
+func (bl *Blocker) managedInitLatestBlockTime() error {
+	if bl.staticServerUID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	var latest time.Time
+	var found bool
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		latest, found, err = bl.staticDB.LatestBlockTimestamp(ctx, bl.staticServerUID)
+		return err
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch the latest block time")
+	}
+	if found {
+		bl.managedUpdateLatestBlockTime(latest)
+		return nil
+	}
+	if !bl.staticBootstrapFromSkyd {
+		return nil
+	}
+	return bl.managedBootstrapFromSkyd()
+}
+
+// managedBootstrapFromSkyd initialises the latest block time from skyd's
+// blocklist. The hashes on skyd's blocklist are marked as blocked and the
+// latest block time is set to right after the time the most recently added one
+// of them was added. The hashes that were added before but aren't on skyd's blocklist are
+// queued to be blocked, so only they are sent to skyd.
+func (bl *Blocker) managedBootstrapFromSkyd() error {
+	blocklist, err := bl.staticSkydClient.Blocklist()
+	if err != nil {
+		return err
+	}
+
+	// Mark the hashes on skyd's blocklist as blocked, in batches, and find
+	// the time the most recently added one was added
+	var latest time.Time
+	onSkyd := make(map[database.Hash]struct{}, len(blocklist))
+	for start := 0; start < len(blocklist); start += bootstrapBatchSize {
+		end := start + bootstrapBatchSize
+		if end > len(blocklist) {
+			end = len(blocklist)
+		}
+		batch := blocklist[start:end]
+		for _, hash := range batch {
+			onSkyd[hash] = struct{}{}
+		}
+
+		added, err := bl.managedBootstrapBatch(batch)
+		if err != nil {
+			return err
+		}
+		if added.After(latest) {
+			latest = added
+		}
+	}
+	if latest.IsZero() {
+		bl.staticLogger.WithField("blocklist", len(blocklist)).Info("None of the hashes on skyd's blocklist are known, all hashes will be sent to skyd")
+		return nil
+	}
+
+	// Queue the hashes that skyd doesn't know about
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	var hashes []database.Hash
+	err = bl.staticDB.Retry(ctx, func() (err error) {
+		hashes, err = bl.staticDB.HashesToBlock(ctx, time.Time{})
+		return err
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch hashes to block")
+	}
+	var missing []database.Hash
+	for _, hash := range hashes {
+		if _, exists := onSkyd[hash]; !exists {
+			missing = append(missing, hash)
+		}
+	}
+	bl.managedQueueReblock(missing)
+
+	// The sweep includes the hashes added at the latest block time, move it
+	// past the most recently added hash on skyd's blocklist so it's not sent
+	// again, the hashes added within the same millisecond are queued.
+	latest = latest.Add(time.Millisecond)
+	bl.managedUpdateLatestBlockTime(latest)
+	err = bl.managedStoreLatestBlockTime(latest)
+	if err != nil {
+		return errors.AddContext(err, "failed to store the latest block time")
+	}
+	bl.staticLogger.WithFields(logrus.Fields{
+		"blocklist": len(blocklist),
+		"missing":   len(missing),
+		"latest":    latest,
+	}).Info("Bootstrapped the latest block time from skyd's blocklist")
+	return nil
+}
+
+// managedBootstrapBatch marks the given hashes, which are on skyd's blocklist,
+// as blocked and returns the time the most recently added one of them was
+// added, it's zero if none of them is known.
+func (bl *Blocker) managedBootstrapBatch(hashes []database.Hash) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	err := bl.staticDB.Retry(ctx, func() error {
+		return bl.staticDB.MarkSucceeded(ctx, hashes)
+	})
+	if err != nil {
+		return time.Time{}, errors.AddContext(err, "failed to mark hashes as blocked")
+	}
+	var added time.Time
+	err = bl.staticDB.Retry(ctx, func() (err error) {
+		added, err = bl.staticDB.LatestTimestampAdded(ctx, hashes)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, errors.AddContext(err, "failed to fetch the time hashes were added")
+	}
+	return added, nil
+}
+
+// managedStoreLatestBlockTime stores the given latest block time under our
+// server UID, it's a no-op if we don't have one.
+func (bl *Blocker) managedStoreLatestBlockTime(latest time.Time) error {
+	if bl.staticServerUID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	return bl.staticDB.Retry(ctx, func() error {
+		return bl.staticDB.UpdateLatestBlockTimestamp(ctx, bl.staticServerUID, latest)
+	})
+}
+
+// managedRefreshLatestBlockTime stores our current latest block time again, it
+// serves as a heartbeat for sweeps that had nothing to block. It's a no-op if
+// we didn't block anything yet, storing a zero time would keep a restart from
+// bootstrapping from skyd.
+func (bl *Blocker) managedRefreshLatestBlockTime() error {
+	latest := bl.managedLatestBlockTime()
+	if latest.IsZero() {
+		return nil
+	}
+	return bl.managedStoreLatestBlockTime(latest)
+}
+
+// managedPruneStaleServers removes the latest block timestamps that weren't
+// updated within the stale server age, they belong to blockers that no longer
+// run, e.g. because their container got replaced. Our own timestamp is never
+// removed.
+func (bl *Blocker) managedPruneStaleServers() error {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	var pruned int
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		pruned, err = bl.staticDB.PruneLatestBlockTimestamps(ctx, database.Now().Add(-bl.staticStaleAge), bl.staticServerUID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		bl.staticLogger.WithField("pruned", pruned).Info("Pruned the latest block timestamps of stale servers")
+	}
+	return nil
+}
+
+// managedUnblock removes a batch of reverted and soft-deleted hashes, that skyd
+// confirmed blocking, from skyd's blocklist. Hashes that fail to get removed stay queued
+// and are retried on the next sweep.
+func (bl *Blocker) managedUnblock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	var hashes []database.Hash
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		hashes, err = bl.staticDB.HashesToUnblock(ctx, blockBatchSize)
+		return err
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch hashes to unblock")
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	err = bl.staticSkydClient.UnblockHashes(hashes)
+	if err != nil {
+		return errors.AddContext(err, "failed to unblock hashes")
+	}
+	bl.staticLogger.WithField("batch_size", len(hashes)).Info("Unblocked reverted and deleted hashes")
+	return bl.staticDB.MarkUnblocked(ctx, hashes)
+}
+
+// Status returns a snapshot of the blocker's state.
+func (bl *Blocker) Status() Status {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	return Status{
+		Started:          bl.started,
+		LatestBlockTime:  bl.latestBlockTime,
+		LastBatchSize:    bl.lastBatchSize,
+		LastBatchBytes:   bl.lastBatchBytes,
+		Blocking:         bl.blocking,
+		Retrying:         bl.retrying,
+		BatchStart:       bl.batchStart,
+		BatchTotal:       bl.batchTotal,
+		RetryQueueBefore: bl.retryQueueBefore,
+		RetryQueueAfter:  bl.retryQueueAfter,
+		ReblockQueue:     len(bl.reblockQueue),
+		PersistQueue:     len(bl.persistQueue),
+		NextBlockRun:     bl.nextBlockRun,
+		NextRetryRun:     bl.nextRetryRun,
+		Lag:              bl.lag,
+	}
+}
+
+// Lag returns the effective lag of the blocker, being the amount of time
+// between the start of the last sweep and the time at which the oldest hash
+// that was still waiting to get blocked after that sweep was added. It's zero
+// if there was no pending work.
+func (bl *Blocker) Lag() time.Duration {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	return bl.lag
+}
+
+// CheckLag returns an error if the blocker's lag exceeds the lag threshold,
+// it's used as a health check.
+func (bl *Blocker) CheckLag() error {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	if bl.lag > bl.staticLagThreshold {
+		return fmt.Errorf("blocker lags %v behind the oldest unblocked report, threshold is %v", bl.lag.Round(time.Second), bl.staticLagThreshold)
+	}
 	return nil
 }
 
@@ -289,34 +1202,77 @@ func (bl *Blocker) managedLatestBlockTime() time.Time {
 	return bl.latestBlockTime
 }
 
-// managedRetryHashes fetches all blocked skylinks that failed to get blocked
-// the first time and retries them.
+// managedRetryHashes fetches the blocked skylinks that failed to get blocked
+// the first time, up until the retry limit, and retries them. The hashes are
+// retried in batches, in between which the retry loop yields to the block loop
+// if it has new hashes to block. The number of hashes waiting to be retried
+// is recorded before and after the run.
 func (bl *Blocker) managedRetryHashes() error {
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
 	defer cancel()
 
+	// Record the queue depth before and after the run
+	before, err := bl.staticDB.Backlog(ctx)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch the retry queue depth")
+	}
+	bl.managedUpdateRetryQueue(before.Failed, -1)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+		defer cancel()
+		after, err := bl.staticDB.Backlog(ctx)
+		if err != nil {
+			bl.staticLogger.WithError(err).Error("Failed to fetch the retry queue depth")
+			return
+		}
+		bl.managedUpdateRetryQueue(before.Failed, after.Failed)
+	}()
+
 	// Fetch hashes to retry
-	hashes, err := bl.staticDB.HashesToRetry(ctx)
+	var hashes []database.Hash
+	err = bl.staticDB.Retry(ctx, func() (err error) {
+		hashes, err = bl.staticDB.HashesToRetry(ctx, bl.staticRetryLimit)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	// Escape early if there are none
+	// Escape early if there are none, hashes that skyd blocked already but
+	// are still waiting to be persisted aren't retried
+	hashes = bl.managedSkipQueuedPersist(hashes)
 	if len(hashes) == 0 {
 		return nil
 	}
 
-	bl.staticLogger.Tracef("managedRetryHashes will retry all these: %+v", hashes)
+	logger := bl.staticLogger.WithField("batch_size", len(hashes))
+	logger.WithField("hashes", hashes).Trace("managedRetryHashes will retry all these")
 
-	// Retry the hashes
-	blocked, _, err := bl.BlockHashes(hashes)
-	if err != nil {
-		bl.staticLogger.Errorf("Failed to retry skylinks: %s", err)
-		return err
+	// Retry the hashes in batches
+	var blocked int
+	for start := 0; start < len(hashes); start += blockBatchSize {
+		// yield to the block loop, escape if the blocker got stopped
+		if !bl.managedYieldToBlock() {
+			break
+		}
+
+		end := start + blockBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		n, _, err := bl.BlockHashes(hashes[start:end])
+		blocked += n
+		if errors.Contains(err, ErrInterrupted) {
+			return err
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to retry skylinks")
+			return err
+		}
 	}
 
-	bl.staticLogger.Tracef("managedRetryHashes blocked %v hashes", blocked)
+	logger.WithField("blocked", blocked).Trace("managedRetryHashes blocked hashes")
 
 	// NOTE: we purposefully do not update the latest block timestamp in the
 	// retry loop
@@ -324,9 +1280,235 @@ func (bl *Blocker) managedRetryHashes() error {
 	return nil
 }
 
+// managedSetBlockPending signals the retry loop that the block loop is blocking
+// new hashes. The returned function has to be called when it's done.
+func (bl *Blocker) managedSetBlockPending() func() {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	done := make(chan struct{})
+	bl.blockPending = true
+	bl.blockDone = done
+	return func() {
+		bl.staticMu.Lock()
+		defer bl.staticMu.Unlock()
+		bl.blockPending = false
+		close(done)
+	}
+}
+
+// managedYieldToBlock waits for the block loop to finish blocking new hashes,
+// if it's currently doing so. It returns false if the blocker got stopped
+// while waiting.
+func (bl *Blocker) managedYieldToBlock() bool {
+	bl.staticMu.Lock()
+	pending := bl.blockPending
+	done := bl.blockDone
+	bl.staticMu.Unlock()
+
+	if pending {
+		bl.staticLogger.Debug("managedRetryHashes yielding to the block loop")
+		select {
+		case <-done:
+		case <-bl.staticStopChan:
+			return false
+		}
+	}
+	select {
+	case <-bl.staticStopChan:
+		return false
+	default:
+		return true
+	}
+}
+
+// managedUpdateRetryQueue records the number of hashes that were waiting to be
+// retried before and after the retry run, an unknown depth is recorded as -1.
+func (bl *Blocker) managedUpdateRetryQueue(before, after int) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.retryQueueBefore = before
+	bl.retryQueueAfter = after
+}
+
+// managedUpdateBatch records the progress of the current call to
+// 'BlockHashes', being the index of the first hash of the batch that is being
+// sent to skyd and the total number of hashes, as well as the number of hashes
+// and the request size of that batch.
+func (bl *Blocker) managedUpdateBatch(start, total, size, numBytes int) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.batchStart = start
+	bl.batchTotal = total
+	bl.lastBatchSize = size
+	bl.lastBatchBytes = numBytes
+}
+
+// managedSetBlocking sets whether the block loop is processing hashes.
+func (bl *Blocker) managedSetBlocking(blocking bool) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.blocking = blocking
+}
+
+// managedScheduleBlockRun records the time the block loop wakes up when it goes
+// to sleep and returns the amount of time it sleeps for. If it got triggered
+// while it was sweeping it wakes up right away.
+func (bl *Blocker) managedScheduleBlockRun() time.Duration {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.nextBlockRun = database.Now().Add(bl.staticBlockInterval)
+	if len(bl.staticTriggerChan) > 0 {
+		bl.nextBlockRun = database.Now()
+	}
+	return bl.staticBlockInterval
+}
+
+// managedScheduleRetryRun records the time the retry loop wakes up when it goes
+// to sleep and returns the amount of time it sleeps for.
+func (bl *Blocker) managedScheduleRetryRun() time.Duration {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.nextRetryRun = database.Now().Add(bl.staticRetryInterval)
+	return bl.staticRetryInterval
+}
+
+// managedSetRetrying sets whether the retry loop is processing hashes.
+func (bl *Blocker) managedSetRetrying(retrying bool) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	bl.retrying = retrying
+}
+
+// managedQueueReblock adds the given hashes to the reblock queue.
+func (bl *Blocker) managedQueueReblock(hashes []database.Hash) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	if bl.reblockQueue == nil {
+		bl.reblockQueue = make(map[database.Hash]struct{}, len(hashes))
+	}
+	for _, hash := range hashes {
+		bl.reblockQueue[hash] = struct{}{}
+	}
+}
+
+// managedTakeReblockQueue empties the reblock queue and returns the hashes it
+// held.
+func (bl *Blocker) managedTakeReblockQueue() []database.Hash {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	hashes := make([]database.Hash, 0, len(bl.reblockQueue))
+	for hash := range bl.reblockQueue {
+		hashes = append(hashes, hash)
+	}
+	bl.reblockQueue = nil
+	return hashes
+}
+
+// managedQueuePersist adds the given hashes to the persist queue.
+func (bl *Blocker) managedQueuePersist(hashes []database.Hash) {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	if bl.persistQueue == nil {
+		bl.persistQueue = make(map[database.Hash]struct{}, len(hashes))
+	}
+	for _, hash := range hashes {
+		bl.persistQueue[hash] = struct{}{}
+	}
+}
+
+// managedTakePersistQueue empties the persist queue and returns the hashes it
+// held.
+func (bl *Blocker) managedTakePersistQueue() []database.Hash {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	hashes := make([]database.Hash, 0, len(bl.persistQueue))
+	for hash := range bl.persistQueue {
+		hashes = append(hashes, hash)
+	}
+	bl.persistQueue = nil
+	return hashes
+}
+
+// managedSkipQueuedPersist returns the given hashes without the ones that are
+// in the persist queue.
+func (bl *Blocker) managedSkipQueuedPersist(hashes []database.Hash) []database.Hash {
+	bl.staticMu.Lock()
+	defer bl.staticMu.Unlock()
+	if len(bl.persistQueue) == 0 {
+		return hashes
+	}
+	filtered := make([]database.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		if _, queued := bl.persistQueue[hash]; !queued {
+			filtered = append(filtered, hash)
+		}
+	}
+	return filtered
+}
+
+// managedUpdateLag computes the lag of the blocker relative to the start of
+// the sweep at the given time, and logs a warning if it exceeds the threshold.
+// The lag is left untouched if the oldest unblocked hash can't be looked up.
+func (bl *Blocker) managedUpdateLag(sweepStart time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	var oldest time.Time
+	err := bl.staticDB.Retry(ctx, func() (err error) {
+		oldest, err = bl.staticDB.OldestUnblocked(ctx)
+		return err
+	})
+	if err != nil {
+		bl.staticLogger.WithError(err).Error("Failed to compute the blocker's lag")
+		return
+	}
+
+	var lag time.Duration
+	if !oldest.IsZero() && sweepStart.After(oldest) {
+		lag = sweepStart.Sub(oldest)
+	}
+	bl.staticMu.Lock()
+	bl.lag = lag
+	bl.staticMu.Unlock()
+
+	if lag > bl.staticLagThreshold {
+		bl.staticLogger.WithFields(logrus.Fields{
+			"lag":       lag.String(),
+			"threshold": bl.staticLagThreshold.String(),
+			"oldest":    oldest,
+		}).Warn("Blocker lags behind the oldest unblocked report")
+	}
+}
+
 // managedUpdateLatestBlockTime updates the latest block time
 func (bl *Blocker) managedUpdateLatestBlockTime(latest time.Time) {
 	bl.staticMu.Lock()
 	defer bl.staticMu.Unlock()
 	bl.latestBlockTime = latest
 }
+
+// failureClass returns the failure class of the given error returned by skyd
+// when blocking hashes. Failures because skyd was unreachable, timed out or
+// responded with a server error are transient, all others are considered
+// permanent.
+func failureClass(err error) string {
+	if errors.Contains(err, api.ErrSkydUnreachable) || errors.Contains(err, api.ErrSkydUnavailable) || errors.Contains(err, api.ErrSkydTimeout) {
+		return database.FailureClassTransient
+	}
+	return database.FailureClassPermanent
+}
+
+// appendUnique appends the hashes of b that are not in a to a.
+func appendUnique(a, b []database.Hash) []database.Hash {
+	seen := make(map[database.Hash]struct{}, len(a))
+	for _, hash := range a {
+		seen[hash] = struct{}{}
+	}
+	for _, hash := range b {
+		if _, exists := seen[hash]; !exists {
+			seen[hash] = struct{}{}
+			a = append(a, hash)
+		}
+	}
+	return a
+}
@@ -4,17 +4,75 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/blocker/api"
 	"github.com/SkynetLabs/blocker/database"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
 )
 
+// faultyAllowList is an allow lister that fails every lookup, it simulates the
+// database being unavailable.
+type faultyAllowList struct{}
+
+// AllowListedHashes implements the allowLister interface.
+func (faultyAllowList) AllowListedHashes(context.Context, []database.Hash) ([]database.Hash, error) {
+	return nil, errors.New("database unavailable")
+}
+
+// flakyMarker marks hashes as succeeded in the database, but fails to do so
+// the given number of times first, it simulates a database hiccup.
+type flakyMarker struct {
+	database.Store
+	failures int32
+}
+
+// MarkSucceeded implements the hashMarker interface.
+func (m *flakyMarker) MarkSucceeded(ctx context.Context, hashes []database.Hash) error {
+	if atomic.AddInt32(&m.failures, -1) >= 0 {
+		return errors.New("database unavailable")
+	}
+	return m.Store.MarkSucceeded(ctx, hashes)
+}
+
+// countingMarker marks hashes in the database and counts the updates it
+// issues.
+type countingMarker struct {
+	database.Store
+	succeeded int32
+	invalid   int32
+	failed    int32
+}
+
+// MarkSucceeded implements the hashMarker interface.
+func (m *countingMarker) MarkSucceeded(ctx context.Context, hashes []database.Hash) error {
+	atomic.AddInt32(&m.succeeded, 1)
+	return m.Store.MarkSucceeded(ctx, hashes)
+}
+
+// MarkInvalid implements the hashMarker interface.
+func (m *countingMarker) MarkInvalid(ctx context.Context, hashes []database.Hash) error {
+	atomic.AddInt32(&m.invalid, 1)
+	return m.Store.MarkInvalid(ctx, hashes)
+}
+
+// MarkFailed implements the hashMarker interface.
+func (m *countingMarker) MarkFailed(ctx context.Context, hashes []database.Hash, class, reason string) error {
+	atomic.AddInt32(&m.failed, 1)
+	return m.Store.MarkFailed(ctx, hashes, class, reason)
+}
+
 // mockBlocklistResponse is a mock handler for the /skynet/blocklist endpoint
 func mockBlocklistResponse(w http.ResponseWriter, r *http.Request) {
 	var request skyapi.SkynetBlocklistPOST
@@ -57,6 +115,78 @@ func TestBlocker(t *testing.T) {
 			name: "BlockHashes",
 			test: testBlockHashes,
 		},
+		{
+			name: "TimestampBlocked",
+			test: testTimestampBlocked,
+		},
+		{
+			name: "FailureClassification",
+			test: testFailureClassification,
+		},
+		{
+			name: "SkipAllowListed",
+			test: testSkipAllowListed,
+		},
+		{
+			name: "AllowListUnavailable",
+			test: testAllowListUnavailable,
+		},
+		{
+			name: "BatchTooLarge",
+			test: testBatchTooLarge,
+		},
+		{
+			name: "BatchTimeout",
+			test: testBatchTimeout,
+		},
+		{
+			name: "StopTimeout",
+			test: testStopTimeout,
+		},
+		{
+			name: "RetryLimit",
+			test: testRetryLimit,
+		},
+		{
+			name: "TriggerBlock",
+			test: testTriggerBlock,
+		},
+		{
+			name: "Reblock",
+			test: testReblock,
+		},
+		{
+			name: "Reset",
+			test: testReset,
+		},
+		{
+			name: "Lag",
+			test: testLag,
+		},
+		{
+			name: "Unblock",
+			test: testUnblock,
+		},
+		{
+			name: "BootstrapFromSkyd",
+			test: testBootstrapFromSkyd,
+		},
+		{
+			name: "InterruptedSweep",
+			test: testInterruptedSweep,
+		},
+		{
+			name: "PersistQueue",
+			test: testPersistQueue,
+		},
+		{
+			name: "CoalesceMarkers",
+			test: testCoalesceMarkers,
+		},
+		{
+			name: "PruneStaleServers",
+			test: testPruneStaleServers,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -71,8 +201,7 @@ func testBlockHashes(t *testing.T, server *httptest.Server) {
 	client := api.NewSkydClient(server.URL, "")
 
 	// create the blocker
-	ctx, cancel := context.WithCancel(context.Background())
-	blocker, err := newTestBlocker(ctx, "BlockHashes", client)
+	blocker, err := newTestBlocker(t, client)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,7 +214,6 @@ func testBlockHashes(t *testing.T, server *httptest.Server) {
 
 	// defer a call to stops
 	defer func() {
-		cancel()
 		err := blocker.Stop()
 		if err != nil {
 			t.Fatal(err)
@@ -125,19 +253,1676 @@ func testBlockHashes(t *testing.T, server *httptest.Server) {
 	}
 }
 
-// newTestBlocker returns a new blocker instance
-func newTestBlocker(ctx context.Context, dbName string, skydClient *api.SkydClient) (*Blocker, error) {
-	// create database
-	db := database.NewTestDB(context.Background(), dbName)
+// testTimestampBlocked verifies the time a hash got blocked is recorded once,
+// when skyd confirms the hash got blocked for the first time, and is preserved
+// across failures and retries.
+func testTimestampBlocked(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
 
-	// create a nil logger
-	logger := logrus.New()
-	logger.Out = ioutil.Discard
+	// create a server that fails to block hashes while 'fail' is set
+	var fail uint32
+	failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint32(&fail) == 1 {
+			skyapi.WriteError(w, skyapi.Error{Message: "failed to block"}, http.StatusInternalServerError)
+			return
+		}
+		mockBlocklistResponse(w, r)
+	}))
+	defer failServer.Close()
+
+	// create the blocker, we don't start it to have full control over when
+	// hashes get blocked
+	blocker, err := newTestBlocker(t, api.NewSkydClient(failServer.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert two hashes
+	first := database.HashBytes([]byte("first"))
+	second := database.HashBytes([]byte("second"))
+	for _, hash := range []database.Hash{first, second} {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// timestampBlocked is a helper that returns the time the given hash got
+	// blocked
+	timestampBlocked := func(hash database.Hash) time.Time {
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+		return doc.TimestampBlocked
+	}
+
+	// assert the timestamp isn't set before the hash got blocked
+	if !timestampBlocked(first).IsZero() {
+		t.Fatal("unexpected timestamp")
+	}
+
+	// block the first hash and assert the timestamp got set
+	_, _, err = blocker.BlockHashes([]database.Hash{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockedAt := timestampBlocked(first)
+	if blockedAt.IsZero() {
+		t.Fatal("expected timestamp to be set")
+	}
+
+	// fail to block both hashes, assert the timestamp of the first hash is
+	// preserved and the second hash has no timestamp
+	atomic.StoreUint32(&fail, 1)
+	_, _, err = blocker.BlockHashes([]database.Hash{first, second})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !timestampBlocked(first).Equal(blockedAt) {
+		t.Fatal("unexpected timestamp", timestampBlocked(first), blockedAt)
+	}
+	if !timestampBlocked(second).IsZero() {
+		t.Fatal("unexpected timestamp")
+	}
+
+	// retry, assert the timestamp of the first hash is still preserved and
+	// the second hash got its timestamp set
+	atomic.StoreUint32(&fail, 0)
+	toRetry, err := db.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRetry) != 2 {
+		t.Fatalf("unexpected number of hashes to retry, %v != 2", len(toRetry))
+	}
+	_, _, err = blocker.BlockHashes(toRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timestampBlocked(first).Equal(blockedAt) {
+		t.Fatal("unexpected timestamp", timestampBlocked(first), blockedAt)
+	}
+	if timestampBlocked(second).IsZero() {
+		t.Fatal("expected timestamp to be set")
+	}
+}
+
+// testFailureClassification verifies hashes that fail to get blocked are
+// classified as transient or permanent failures depending on how skyd fails.
+func testFailureClassification(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that responds with the configured status code, or
+	// with the mocked blocklist response if no status code is configured
+	var status int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := atomic.LoadInt32(&status); code != 0 {
+			skyapi.WriteError(w, skyapi.Error{Message: http.StatusText(int(code))}, int(code))
+			return
+		}
+		mockBlocklistResponse(w, r)
+	}))
+	defer mockServer.Close()
 
 	// create the blocker
-	blocker, err := New(skydClient, db, logger)
+	blocker, err := newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""))
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert the hashes
+	unavailable := database.HashBytes([]byte("unavailable"))
+	rejected := database.HashBytes([]byte("rejected"))
+	invalid := database.HashBytes([]byte("invalid_hash"))
+	for _, hash := range []database.Hash{unavailable, rejected, invalid} {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// block every hash with a different response from skyd
+	tests := []struct {
+		hash   database.Hash
+		status int32
+	}{
+		{rejected, http.StatusBadRequest},
+		{unavailable, http.StatusServiceUnavailable},
+		{invalid, 0},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&status, test.status)
+		_, _, err = blocker.BlockHashes([]database.Hash{test.hash})
+		if (test.status != 0) != (err != nil) {
+			t.Fatal("unexpected error", test.status, err)
+		}
+	}
+
+	// assert the classification
+	expected := []struct {
+		hash    database.Hash
+		failed  bool
+		invalid bool
+		class   string
+	}{
+		{rejected, true, false, database.FailureClassPermanent},
+		{unavailable, true, false, database.FailureClassTransient},
+		{invalid, false, true, ""},
+	}
+	for _, e := range expected {
+		doc, err := db.FindByHash(ctx, e.hash)
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+		if doc.Failed != e.failed || doc.Invalid != e.invalid || doc.FailureClass != e.class {
+			t.Fatal("unexpected classification", doc.Failed, doc.Invalid, doc.FailureClass, e)
+		}
+		if e.failed && doc.FailureReason == "" {
+			t.Fatal("expected failure reason to be set")
+		}
+	}
+
+	// assert the transient failure gets retried first
+	toRetry, err := db.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRetry) != 2 || toRetry[0] != unavailable || toRetry[1] != rejected {
+		t.Fatal("unexpected hashes to retry", toRetry)
+	}
+}
+
+// testSkipAllowListed verifies hashes that are on the allowlist are never sent
+// to skyd, regardless of how they entered the database, and that they are no
+// longer picked up by the block loop.
+func testSkipAllowListed(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the hashes it is asked to block
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, hash := range request.Add {
+			seen[hash] = struct{}{}
+		}
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer mockServer.Close()
+
+	// create the blocker
+	blocker, err := newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert two hashes and allowlist one of them after it got reported
+	allowlisted := database.HashBytes([]byte("allowlisted"))
+	blocked := database.HashBytes([]byte("blocked"))
+	for _, hash := range []database.Hash{allowlisted, blocked} {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			Source:         database.SourceSync,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+		Hash:           allowlisted,
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run a sweep
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert skyd only saw the hash that isn't allowlisted
+	mu.Lock()
+	_, sawAllowListed := seen[allowlisted.String()]
+	_, sawBlocked := seen[blocked.String()]
+	mu.Unlock()
+	if sawAllowListed || !sawBlocked {
+		t.Fatal("unexpected hashes sent to skyd", seen)
+	}
+
+	// assert the allowlisted hash got marked as skipped
+	doc, err := db.FindByHash(ctx, allowlisted)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if !doc.SkippedAllowListed || !doc.TimestampBlocked.IsZero() {
+		t.Fatal("unexpected document", doc)
+	}
+
+	// assert it is no longer picked up by the block loop
+	toBlock, err := db.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range toBlock {
+		if hash == allowlisted {
+			t.Fatal("expected allowlisted hash to be excluded")
+		}
+	}
+}
+
+// testAllowListUnavailable verifies no hashes are sent to skyd while the allow
+// list can't be checked, unless the blocker is configured to fail open.
+func testAllowListUnavailable(t *testing.T, _ *httptest.Server) {
+	// create a server that records the hashes it is asked to block
+	var mu sync.Mutex
+	var seen []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		seen = append(seen, request.Add...)
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer mockServer.Close()
+
+	// create the blocker and break its allow list
+	blocker, err := newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker.staticAllowList = faultyAllowList{}
+
+	// assert the hash isn't blocked
+	hash := database.HashBytes([]byte("hash"))
+	_, _, err = blocker.BlockHashes([]database.Hash{hash})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	mu.Lock()
+	sent := append([]string{}, seen...)
+	mu.Unlock()
+	if len(sent) != 0 {
+		t.Fatal("unexpected hashes sent to skyd", sent)
+	}
+
+	// assert the hash is blocked if the blocker fails open
+	blocker, err = newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""), WithAllowListFailOpen(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker.staticAllowList = faultyAllowList{}
+	blocked, _, err := blocker.BlockHashes([]database.Hash{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	sent = append([]string{}, seen...)
+	mu.Unlock()
+	if blocked != 1 || len(sent) != 1 || sent[0] != hash.String() {
+		t.Fatal("unexpected hashes sent to skyd", blocked, sent)
+	}
+}
+
+// testBatchTooLarge verifies batches are shrunk to stay within the byte budget
+// and are retried in smaller batches when skyd rejects them as too large.
+func testBatchTooLarge(t *testing.T, _ *httptest.Server) {
+	// create a server that rejects batches of more than two hashes with a 413
+	// and records the size of every batch it receives
+	var mu sync.Mutex
+	var batches []int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, len(request.Add))
+		mu.Unlock()
+		if len(request.Add) > 2 {
+			skyapi.WriteError(w, skyapi.Error{Message: "request too large"}, http.StatusRequestEntityTooLarge)
+			return
+		}
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer mockServer.Close()
+
+	var hashes []database.Hash
+	for i := 0; i < 5; i++ {
+		hashes = append(hashes, database.HashBytes([]byte(fmt.Sprintf("skylink_hash_%d", i))))
+	}
+
+	// blockAndReset is a helper that blocks the hashes using the given
+	// blocker and returns the batch sizes skyd received
+	blockAndReset := func(blocker *Blocker) []int {
+		blocked, invalid, err := blocker.BlockHashes(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked != len(hashes) || invalid != 0 {
+			t.Fatal("unexpected counts", blocked, invalid)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sizes := batches
+		batches = nil
+		return sizes
+	}
+
+	// assert the batch gets halved when skyd rejects it
+	client := api.NewSkydClient(mockServer.URL, "")
+	blocker, err := newTestBlocker(t, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := blockAndReset(blocker); fmt.Sprint(sizes) != "[5 2 2 1]" {
+		t.Fatal("unexpected batches", sizes)
+	}
+
+	// assert the batch gets shrunk to stay within the byte budget, without
+	// skyd having to reject it
+	budget := api.BlockRequestSize(hashes[:2])
+	blocker, err = New(client, blocker.staticDB, blocker.staticLogger, WithMaxBatchBytes(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := blockAndReset(blocker); fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Fatal("unexpected batches", sizes)
+	}
+	if status := blocker.Status(); status.LastBatchSize != 1 || status.LastBatchBytes != api.BlockRequestSize(hashes[4:]) {
+		t.Fatal("unexpected status", status)
+	}
+}
+
+// testBatchTimeout verifies that, when a batch times out, its hashes are
+// verified against skyd's blocklist to decide which ones got blocked.
+func testBatchTimeout(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that only adds the first hash of every batch to its
+	// blocklist and then hangs until the request is cancelled
+	var mu sync.Mutex
+	var blocklist skyapi.SkynetBlocklistGET
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			defer mu.Unlock()
+			skyapi.WriteJSON(w, blocklist)
+			return
+		}
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || len(request.Add) == 0 {
+			skyapi.WriteError(w, skyapi.Error{Message: "bad request"}, http.StatusBadRequest)
+			return
+		}
+		var hash database.Hash
+		err = hash.LoadString(request.Add[0])
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		blocklist.Blocklist = append(blocklist.Blocklist, hash.Hash)
+		mu.Unlock()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer mockServer.Close()
+
+	// create the blocker with a short batch timeout
+	blocker, err := newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""), WithBatchTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert two hashes
+	first := database.HashBytes([]byte("first"))
+	second := database.HashBytes([]byte("second"))
+	for _, hash := range []database.Hash{first, second} {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// block them, assert the timeout is reported and the first hash counts
+	// as blocked
+	blocked, _, err := blocker.BlockHashes([]database.Hash{first, second})
+	if !errors.Contains(err, api.ErrSkydTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+	if blocked != 1 {
+		t.Fatalf("unexpected number of blocked hashes, %v != 1", blocked)
+	}
+
+	// assert the first hash got marked as blocked and the second as failed
+	doc, err := db.FindByHash(ctx, first)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if doc.Failed || doc.TimestampBlocked.IsZero() {
+		t.Fatal("expected first hash to be blocked", doc)
+	}
+	doc, err = db.FindByHash(ctx, second)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if !doc.Failed || doc.FailureClass != database.FailureClassTransient || !doc.TimestampBlocked.IsZero() {
+		t.Fatal("expected second hash to have failed", doc)
+	}
+}
+
+// testStopTimeout verifies Stop gives up after the configured stop timeout and
+// logs the blocker's state and a goroutine dump when skyd hangs.
+func testStopTimeout(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that hangs until it gets released
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		skyapi.WriteError(w, skyapi.Error{Message: "released"}, http.StatusServiceUnavailable)
+	}))
+	defer mockServer.Close()
+
+	// create the blocker with a short stop timeout
+	db := database.NewTestDB(ctx, t.Name(), database.WithCleanup(t))
+	logger, hook := logtest.NewNullLogger()
+	blocker, err := New(api.NewSkydClient(mockServer.URL, ""), db, logger.WithField("module", "blocker"), WithStopTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a hash and start the blocker
+	err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           database.HashBytes([]byte("hanging")),
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blocker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait until skyd received the hash
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("skyd never received the hash")
+	}
+
+	// assert stopping the blocker times out
+	start := time.Now()
+	err = blocker.Stop()
+	if err == nil || !strings.Contains(err.Error(), "unclean blocker shutdown") {
+		t.Fatal("unexpected error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("stop took too long", elapsed)
+	}
+
+	// release skyd and wait for the loops to exit
+	close(release)
+	blocker.staticWaitGroup.Wait()
+
+	// assert the state and goroutines got logged
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Blocker failed to stop in time" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("expected the failed stop to be logged")
+	}
+	status, ok := entry.Data["status"].(Status)
+	if !ok || !status.Blocking || status.BatchStart != 0 || status.BatchTotal != 1 {
+		t.Fatal("unexpected status", entry.Data["status"])
+	}
+	goroutines, ok := entry.Data["goroutines"].(string)
+	if !ok || !strings.Contains(goroutines, "threadedBlockLoop") {
+		t.Fatal("unexpected goroutines", entry.Data["goroutines"])
+	}
+}
+
+// testRetryLimit verifies the retry loop retries at most the configured number
+// of hashes per run, transient failures first and oldest first, that it yields
+// to the block loop in between batches and that it records the queue depth.
+func testRetryLimit(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the hashes it receives, in order
+	var mu sync.Mutex
+	var received []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, request.Add...)
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer mockServer.Close()
+	numReceived := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	// create the blocker
+	retryLimit := blockBatchSize + blockBatchSize/5
+	blocker, err := newTestBlocker(t, api.NewSkydClient(mockServer.URL, ""), WithRetryLimit(retryLimit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// seed a large backlog of failed hashes, every other one failed
+	// transiently, inserted in reverse order so the oldest comes last
+	numHashes := 2 * blockBatchSize
+	now := database.Now()
+	skylinks := make([]database.BlockedSkylink, numHashes)
+	var transient, permanent []database.Hash
+	for i := 0; i < numHashes; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("skylink_%d", i)))
+		skylinks[numHashes-1-i] = database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: now.Add(time.Duration(i) * time.Second),
+		}
+		if i%2 == 0 {
+			transient = append(transient, hash)
+		} else {
+			permanent = append(permanent, hash)
+		}
+	}
+	_, err = db.CreateBlockedSkylinkBatch(ctx, skylinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkFailed(ctx, transient, database.FailureClassTransient, "skyd unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkFailed(ctx, permanent, database.FailureClassPermanent, "rejected")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signal the block loop has pending work and retry the hashes
+	done := blocker.managedSetBlockPending()
+	errChan := make(chan error)
+	go func() {
+		errChan <- blocker.managedRetryHashes()
+	}()
+
+	// assert the retry loop yields to the block loop
+	time.Sleep(100 * time.Millisecond)
+	if n := numReceived(); n != 0 {
+		t.Fatalf("expected the retry loop to yield, received %v hashes", n)
+	}
+	done()
+	err = <-errChan
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the cap and the ordering
+	expected := append(transient, permanent...)[:retryLimit]
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != retryLimit {
+		t.Fatalf("unexpected number of hashes retried, %v != %v", len(received), retryLimit)
+	}
+	for i, hash := range expected {
+		if received[i] != hash.String() {
+			t.Fatalf("unexpected hash at index %v", i)
+		}
+	}
+
+	// assert the queue depth got recorded
+	status := blocker.Status()
+	if status.RetryQueueBefore != numHashes || status.RetryQueueAfter != numHashes-retryLimit {
+		t.Fatal("unexpected retry queue depth", status.RetryQueueBefore, status.RetryQueueAfter)
+	}
+}
+
+// TestFailureClass is a unit test for the failureClass helper.
+func TestFailureClass(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{errors.AddContext(api.ErrSkydUnreachable, "failed to execute POST request"), database.FailureClassTransient},
+		{errors.AddContext(api.ErrSkydTimeout, "failed to execute POST request"), database.FailureClassTransient},
+		{errors.Compose(&api.StatusError{StatusCode: http.StatusBadGateway}, api.ErrSkydUnavailable), database.FailureClassTransient},
+		{&api.StatusError{StatusCode: http.StatusBadRequest}, database.FailureClassPermanent},
+		{errors.New("failed to parse invalid hashes"), database.FailureClassPermanent},
+	}
+	for _, test := range tests {
+		if class := failureClass(test.err); class != test.class {
+			t.Fatalf("unexpected class for '%v', %v != %v", test.err, class, test.class)
+		}
+	}
+}
+
+// testTriggerBlock verifies triggering the block loop sweeps the database for
+// new hashes without waiting for the block interval to elapse.
+func testTriggerBlock(t *testing.T, server *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a blocker with a block interval that exceeds the test's runtime
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""), WithBlockInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert is a helper that inserts a hash, waitForBlocked waits until the
+	// given hash got blocked
+	insert := func(hash database.Hash) {
+		err := db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBlocked := func(hash database.Hash) {
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			doc, err := db.FindByHash(ctx, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc != nil && !doc.TimestampBlocked.IsZero() {
+				return
+			}
+		}
+		t.Fatal("hash did not get blocked", hash)
+	}
+
+	// start the blocker and wait for the first sweep to block a hash
+	first := database.HashBytes([]byte("first"))
+	insert(first)
+	err = blocker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := blocker.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	waitForBlocked(first)
+
+	// assert the next runs got scheduled once the loops went to sleep
+	var status Status
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		status = blocker.Status()
+		if status.NextBlockRun.IsZero() || status.NextRetryRun.IsZero() {
+			return errors.New("next runs not scheduled")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(status.NextBlockRun); until < 59*time.Minute || until > time.Hour {
+		t.Fatal("unexpected next block run", status.NextBlockRun)
+	}
+
+	// insert another hash and trigger the block loop, assert it gets blocked
+	// and the next run is updated, either to now or to the time the loop
+	// goes to sleep again if it ran already
+	time.Sleep(10 * time.Millisecond)
+	second := database.HashBytes([]byte("second"))
+	insert(second)
+	blocker.TriggerBlock()
+	if next := blocker.Status().NextBlockRun; next.Equal(status.NextBlockRun) {
+		t.Fatal("expected the next block run to be updated", next)
+	}
+	waitForBlocked(second)
+
+	// assert the next run gets scheduled again after the triggered sweep
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		if next := blocker.Status().NextBlockRun; time.Until(next) < 59*time.Minute {
+			return errors.New("next block run not rescheduled")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert triggering never blocks the caller
+	for i := 0; i < 3; i++ {
+		blocker.TriggerBlock()
+	}
+}
+
+// testReblock verifies hashes that were blocked before are sent to skyd again
+// after they got queued through Reblock, without duplicating any documents.
+func testReblock(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the hashes it got asked to block
+	var mu sync.Mutex
+	received := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		for _, hash := range request.Add {
+			received[hash]++
+		}
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer server.Close()
+	count := func(hash database.Hash) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[hash.String()]
+	}
+
+	// create a blocker with a block interval that exceeds the test's runtime
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""), WithBlockInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert three hashes and start the blocker, wait for the first sweep
+	var hashes []database.Hash
+	for i := 0; i < 3; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("reblock_%d", i)))
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	err = blocker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := blocker.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		for _, hash := range hashes {
+			if count(hash) != 1 {
+				return fmt.Errorf("hash %v was sent %v times", hash, count(hash))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert another sweep doesn't send them again
+	blocker.TriggerBlock()
+	time.Sleep(200 * time.Millisecond)
+	for _, hash := range hashes {
+		if count(hash) != 1 {
+			t.Fatal("unexpected number of sends", count(hash))
+		}
+	}
+
+	// reblock the first two hashes, assert they're sent again
+	blocker.Reblock(hashes[:2])
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		if count(hashes[0]) != 2 || count(hashes[1]) != 2 {
+			return errors.New("hashes were not sent again")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(hashes[2]) != 1 {
+		t.Fatal("unexpected number of sends", count(hashes[2]))
+	}
+	if blocker.Status().ReblockQueue != 0 {
+		t.Fatal("expected the reblock queue to be empty", blocker.Status().ReblockQueue)
+	}
+
+	// assert no documents got duplicated
+	docs, _, err := db.BlockedHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != len(hashes) {
+		t.Fatal("unexpected number of documents", len(docs))
+	}
+}
+
+// testReset verifies skylinks that failed to get blocked or that are invalid
+// are sent to skyd again by the next sweep after their state got reset.
+func testReset(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the hashes it got asked to block
+	var mu sync.Mutex
+	received := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		for _, hash := range request.Add {
+			received[hash]++
+		}
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer server.Close()
+	count := func(hash database.Hash) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[hash.String()]
+	}
+
+	// create a blocker with a block interval that exceeds the test's runtime
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""), WithBlockInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert a hash that failed to get blocked and one that is invalid
+	failed := database.HashBytes([]byte("reset_failed"))
+	invalid := database.HashBytes([]byte("reset_invalid"))
+	for _, hash := range []database.Hash{failed, invalid} {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now().Add(-time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.MarkFailed(ctx, []database.Hash{failed}, database.FailureClassPermanent, "unexpected response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkInvalid(ctx, []database.Hash{invalid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start the blocker, assert the first sweep doesn't send the invalid hash
+	err = blocker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := blocker.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if count(invalid) != 0 {
+		t.Fatal("unexpected number of sends", count(invalid))
+	}
+
+	// reset both hashes and trigger a sweep, assert they're sent and blocked
+	for _, hash := range []database.Hash{failed, invalid} {
+		err = db.ResetBlockedSkylink(ctx, hash, true, "reset by test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocker.TriggerBlock()
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		for _, hash := range []database.Hash{failed, invalid} {
+			if count(hash) == 0 {
+				return fmt.Errorf("hash %v was not sent", hash)
+			}
+			doc, err := db.FindByHash(ctx, hash)
+			if err != nil {
+				return err
+			}
+			if !doc.IsBlocked() {
+				return fmt.Errorf("hash %v was not blocked", hash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the reset got recorded
+	doc, err := db.FindByHash(ctx, invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reset bool
+	for _, event := range doc.Events {
+		reset = reset || (event.Type == database.EventReset && event.Detail == "reset by test")
+	}
+	if !reset {
+		t.Fatal("expected a reset event", doc.Events)
+	}
+
+	// assert resetting an unknown hash fails
+	err = db.ResetBlockedSkylink(ctx, database.HashBytes([]byte("reset_unknown")), false, "")
+	if !errors.Contains(err, database.ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testLag verifies the lag of the blocker is computed relative to the oldest
+// unblocked hash after every sweep, and that it's zero without pending work.
+func testLag(t *testing.T, server *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create the blocker with a logger we can inspect
+	db := database.NewTestDB(ctx, t.Name(), database.WithCleanup(t))
+	logger, hook := logtest.NewNullLogger()
+	blocker, err := New(api.NewSkydClient(server.URL, ""), db, logger.WithField("module", "blocker"), WithLagThreshold(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the lag is zero before the first sweep
+	if blocker.Lag() != 0 || blocker.CheckLag() != nil {
+		t.Fatal("unexpected lag", blocker.Lag())
+	}
+
+	// assert a sweep without pending work leaves the lag at zero
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocker.Lag() != 0 {
+		t.Fatal("unexpected lag", blocker.Lag())
+	}
+
+	// seed an old hash that failed to get blocked, which keeps the block loop
+	// from picking it up
+	added := database.Now().Add(-2 * time.Hour)
+	old := database.HashBytes([]byte("old"))
+	err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           old,
+		TimestampAdded: added,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkFailed(ctx, []database.Hash{old}, database.FailureClassTransient, "skyd down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, err := db.OldestUnblocked(ctx)
+	if err != nil || !oldest.Equal(added) {
+		t.Fatal("unexpected", oldest, err)
+	}
+
+	// assert a sweep computes the lag relative to the failed hash and warns
+	// because it exceeds the threshold
+	start := database.Now()
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lag := blocker.Lag()
+	if lag < start.Sub(added) || lag > database.Now().Sub(added) {
+		t.Fatal("unexpected lag", lag)
+	}
+	if blocker.Status().Lag != lag {
+		t.Fatal("unexpected status", blocker.Status())
+	}
+	var warned bool
+	for _, entry := range hook.AllEntries() {
+		warned = warned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "lags behind"))
+	}
+	if !warned {
+		t.Fatal("expected a warning")
+	}
+	if err := blocker.CheckLag(); err == nil {
+		t.Fatal("expected the lag check to fail")
+	}
+
+	// block the hash and assert the lag drops to zero after the next sweep
+	err = db.MarkSucceeded(ctx, []database.Hash{old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocker.Lag() != 0 || blocker.CheckLag() != nil {
+		t.Fatal("unexpected lag", blocker.Lag())
+	}
+}
+
+// testPruneStaleServers verifies the latest block timestamps of the blockers
+// that didn't update theirs within the stale server age are removed, except
+// the blocker's own, and that an idle sweep refreshes the blocker's own.
+func testPruneStaleServers(t *testing.T, server *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create the blocker
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""), WithStaleServerAge(100*time.Millisecond), WithServerUID("self"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// store the timestamp of a server that stops updating it, and ours, then
+	// one of a server that keeps going
+	now := database.Now()
+	for _, serverUID := range []string{"stale", "self"} {
+		err = blocker.staticDB.UpdateLatestBlockTimestamp(ctx, serverUID, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	err = blocker.staticDB.UpdateLatestBlockTimestamp(ctx, "fresh", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prune them, assert only the stale one got removed, ours is kept even
+	// though we didn't update it either
+	err = blocker.managedPruneStaleServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, err := blocker.staticDB.LatestBlockTimestamps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 2 || timestamps[0].ServerUID != "fresh" || timestamps[1].ServerUID != "self" {
+		t.Fatal("unexpected timestamps", timestamps)
+	}
+
+	// sweep without hashes to block, assert it refreshed the time we last
+	// updated our timestamp but kept the timestamp itself
+	cutoff := database.Now()
+	blocker.managedUpdateLatestBlockTime(now)
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, err = blocker.staticDB.LatestBlockTimestamps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 2 || !timestamps[1].Timestamp.Equal(now) || timestamps[1].LastUpdated.Before(cutoff) {
+		t.Fatal("unexpected timestamps", timestamps)
+	}
+
+	// assert the age has to be positive
+	_, err = newTestBlocker(t, api.NewSkydClient(server.URL, ""), WithStaleServerAge(0))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// newTestBlocker returns a new blocker instance
+func newTestBlocker(t *testing.T, skydClient *api.SkydClient, opts ...Option) (*Blocker, error) {
+	// create database
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+
+	// create a nil logger
+	logger, _ := logtest.NewNullLogger()
+
+	// create the blocker
+	blocker, err := New(skydClient, db, logger.WithField("module", "blocker"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return blocker, nil
+}
+
+// testUnblock verifies a hash is only removed from skyd's blocklist once all of
+// its tags got reverted.
+func testUnblock(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the hashes it got asked to remove
+	var mu sync.Mutex
+	var removed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		removed = append(removed, request.Remove...)
+		mu.Unlock()
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer server.Close()
+	numRemoved := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(removed)
+	}
+
+	// create the blocker, we don't start it to have full control over when
+	// hashes get unblocked
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert a hash with two tags that skyd confirmed blocking
+	hash := database.HashBytes([]byte("unblock"))
+	err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           hash,
+		Tags:           []string{"copyright", "malware"},
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkSucceeded(ctx, []database.Hash{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// revert one of its tags, assert it's not removed
+	_, err = db.RevertTags(ctx, hash, []string{"copyright"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blocker.managedUnblock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numRemoved() != 0 {
+		t.Fatal("unexpected removed hashes", removed)
+	}
+
+	// revert the other one, assert it's removed exactly once
+	_, err = db.RevertTags(ctx, hash, []string{"malware"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = blocker.managedUnblock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if numRemoved() != 1 || removed[0] != hash.String() {
+		t.Fatal("unexpected removed hashes", removed)
+	}
+}
+
+// testBootstrapFromSkyd verifies a blocker that runs for the first time under
+// its server UID only sends the hashes to skyd that aren't on its blocklist
+// yet, and that a restart resumes from the stored latest block time.
+func testBootstrapFromSkyd(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// seed ten hashes, added a minute apart
+	var hashes []database.Hash
+	start := database.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		hashes = append(hashes, database.HashBytes([]byte(fmt.Sprintf("bootstrap_%d", i))))
+	}
+
+	// create a skyd that holds every other hash, it records the hashes it
+	// got asked to block and the number of times its blocklist got fetched
+	var mu sync.Mutex
+	received := make(map[string]int)
+	var fetched int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet {
+			fetched++
+			var blocklist []crypto.Hash
+			for i := 0; i < len(hashes); i += 2 {
+				blocklist = append(blocklist, hashes[i].Hash)
+			}
+			skyapi.WriteJSON(w, skyapi.SkynetBlocklistGET{Blocklist: blocklist})
+			return
+		}
+		var request skyapi.SkynetBlocklistPOST
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			panic(err)
+		}
+		for _, hash := range request.Add {
+			received[hash]++
+		}
+		skyapi.WriteJSON(w, api.BlockResponse{})
+	}))
+	defer server.Close()
+
+	// create the blocker, we don't start it to have full control over when
+	// hashes get blocked
+	client := api.NewSkydClient(server.URL, "")
+	blocker, err := newTestBlocker(t, client, WithServerUID("bootstrap"), WithBootstrapFromSkyd(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+	for i, hash := range hashes {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bootstrap and sweep, assert only the hashes skyd doesn't hold are sent
+	err = blocker.managedInitLatestBlockTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := blocker.managedLatestBlockTime(); !latest.Equal(start.Add(8*time.Minute + time.Millisecond)) {
+		t.Fatal("unexpected latest block time", latest)
+	}
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(received) != 5 || fetched != 1 {
+		t.Fatal("unexpected requests", received, fetched)
+	}
+	for i, hash := range hashes {
+		if received[hash.String()] != i%2 {
+			t.Fatalf("unexpected number of sends for hash %d, %v", i, received[hash.String()])
+		}
+	}
+	mu.Unlock()
+
+	// assert all hashes are marked as blocked
+	for _, hash := range hashes {
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.TimestampBlocked.IsZero() {
+			t.Fatal("hash not marked as blocked", hash)
+		}
+	}
+
+	// assert the latest block time got stored
+	stored, found, err := db.LatestBlockTimestamp(ctx, "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !stored.Equal(blocker.managedLatestBlockTime()) {
+		t.Fatal("unexpected latest block timestamp", stored, found)
+	}
+
+	// create a blocker with the same server UID on the same database, assert
+	// it resumes from the stored latest block time without fetching skyd's
+	// blocklist again
+	logger, _ := logtest.NewNullLogger()
+	restarted, err := New(client, db, logger.WithField("module", "blocker"), WithServerUID("bootstrap"), WithBootstrapFromSkyd(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restarted.managedInitLatestBlockTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.managedLatestBlockTime().Equal(stored) {
+		t.Fatal("unexpected latest block time", restarted.managedLatestBlockTime())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetched != 1 {
+		t.Fatal("unexpected number of fetches", fetched)
+	}
+
+	// assert bootstrapping requires a server UID
+	_, err = New(client, db, logger.WithField("module", "blocker"), WithBootstrapFromSkyd(true))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testInterruptedSweep verifies a sweep that gets interrupted by a shutdown
+// doesn't advance the latest block time, so the hashes it didn't send to skyd
+// are blocked after a restart.
+func testInterruptedSweep(t *testing.T, server *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a skyd that is slow to block a batch
+	received := make(chan struct{}, 1)
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		time.Sleep(200 * time.Millisecond)
+		mockBlocklistResponse(w, r)
+	}))
+	defer slowServer.Close()
+
+	// create a blocker with a server UID so it stores its latest block time
+	blocker, err := newTestBlocker(t, api.NewSkydClient(slowServer.URL, ""), WithServerUID("server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+
+	// insert enough hashes to span multiple batches
+	var hashes []database.Hash
+	for i := 0; i < 3*blockBatchSize; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("interrupted_%d", i)))
+		hashes = append(hashes, hash)
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// start the blocker and stop it while skyd blocks the first batch
+	err = blocker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("skyd never received the hashes")
+	}
+	err = blocker.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert not all hashes got blocked and the latest block time wasn't
+	// stored
+	var unblocked int
+	for _, hash := range hashes {
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+		if doc.TimestampBlocked.IsZero() {
+			unblocked++
+		}
+	}
+	if unblocked == 0 {
+		t.Fatal("expected the sweep to be interrupted")
+	}
+	_, found, err := db.LatestBlockTimestamp(ctx, "server")
+	if err != nil || found {
+		t.Fatal("unexpected latest block time", found, err)
+	}
+
+	// assert BlockHashes is interrupted once the blocker is stopped
+	_, _, err = blocker.BlockHashes(hashes)
+	if !errors.Contains(err, ErrInterrupted) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// restart the blocker and assert the leftover hashes get blocked
+	logger, _ := logtest.NewNullLogger()
+	restarted, err := New(api.NewSkydClient(server.URL, ""), db, logger.WithField("module", "blocker"), WithServerUID("server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restarted.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := restarted.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for _, hash := range hashes {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			doc, err := db.FindByHash(ctx, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc != nil && !doc.TimestampBlocked.IsZero() {
+				break
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("hash did not get blocked", hash)
+			}
+		}
+	}
+}
+
+// testPersistQueue verifies hashes that skyd blocked but that failed to be
+// marked as succeeded are persisted by the next sweep, without sending them to
+// skyd again.
+func testPersistQueue(t *testing.T, _ *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a skyd that counts the requests it receives
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mockBlocklistResponse(w, r)
+	}))
+	defer server.Close()
+
+	// create a blocker that fails to mark hashes as succeeded once
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+	blocker.staticMarker = &flakyMarker{Store: db, failures: 1}
+
+	// insert hashes that failed to get blocked before
+	var hashes []database.Hash
+	for i := 0; i < 3; i++ {
+		hash := database.HashBytes([]byte(fmt.Sprintf("persist_%d", i)))
+		hashes = append(hashes, hash)
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+			Failed:         true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// retry the hashes, skyd blocks them but they fail to be marked
+	err = blocker.managedRetryHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("unexpected number of requests", requests)
+	}
+	if blocker.Status().PersistQueue != len(hashes) {
+		t.Fatal("unexpected persist queue", blocker.Status().PersistQueue)
+	}
+	_, unmarked, err := db.ReconcileBlocked(ctx, hashes)
+	if err != nil || len(unmarked) != len(hashes) {
+		t.Fatal("unexpected", unmarked, err)
+	}
+
+	// assert the retry loop doesn't send the queued hashes to skyd again
+	err = blocker.managedRetryHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("unexpected number of requests", requests)
+	}
+
+	// assert the next sweep persists the hashes without calling skyd
+	err = blocker.managedBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("unexpected number of requests", requests)
+	}
+	if blocker.Status().PersistQueue != 0 {
+		t.Fatal("unexpected persist queue", blocker.Status().PersistQueue)
+	}
+	marked, unmarked, err := db.ReconcileBlocked(ctx, hashes)
+	if err != nil || len(marked) != len(hashes) || len(unmarked) != 0 {
+		t.Fatal("unexpected", marked, unmarked, err)
+	}
+}
+
+// testCoalesceMarkers verifies the success markers of consecutive batches are
+// coalesced into a single update and that empty sets aren't updated at all.
+func testCoalesceMarkers(t *testing.T, server *httptest.Server) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a blocker that counts its updates
+	blocker, err := newTestBlocker(t, api.NewSkydClient(server.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := blocker.staticDB
+	marker := &countingMarker{Store: db}
+	blocker.staticMarker = marker
+
+	// insert enough hashes to span two and a half flush windows, one of
+	// which is invalid
+	numBatches := 2*markFlushBatches + markFlushBatches/2
+	hashes := []database.Hash{database.HashBytes([]byte("invalid_hash"))}
+	for i := 1; i < numBatches*blockBatchSize; i++ {
+		hashes = append(hashes, database.HashBytes([]byte(fmt.Sprintf("coalesce_%d", i))))
+	}
+	for _, hash := range hashes[:blockBatchSize] {
+		err = db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// block the hashes
+	blocked, invalid, err := blocker.BlockHashes(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked != len(hashes)-1 || invalid != 1 {
+		t.Fatal("unexpected", blocked, invalid)
+	}
+
+	// assert a batch per update used to be issued, now the success markers
+	// are flushed once per window and only the batch with an invalid hash
+	// marks invalid hashes
+	if atomic.LoadInt32(&marker.succeeded) != 3 {
+		t.Fatal("unexpected number of success updates", marker.succeeded, "batches", numBatches)
+	}
+	if atomic.LoadInt32(&marker.invalid) != 1 || atomic.LoadInt32(&marker.failed) != 0 {
+		t.Fatal("unexpected number of updates", marker.invalid, marker.failed)
+	}
+
+	// assert the markers got persisted
+	marked, unmarked, err := db.ReconcileBlocked(ctx, hashes[:blockBatchSize])
+	if err != nil || len(marked) != blockBatchSize-1 || len(unmarked) != 0 {
+		t.Fatal("unexpected", len(marked), unmarked, err)
 	}
-	return blocker, nil
 }
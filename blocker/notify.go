@@ -0,0 +1,356 @@
+package blocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+const (
+	// CallbackKeyID is the key id the callbacks are signed with, receivers
+	// verify the signature using the callback secret.
+	CallbackKeyID = "blocker"
+
+	// CallbackStatusBlocked and CallbackStatusInvalid are the final states of
+	// a reported hash that are sent to its callback url.
+	CallbackStatusBlocked = "blocked"
+	CallbackStatusInvalid = "invalid"
+
+	// callbackBatchSize is the maximum number of callbacks we fetch from the
+	// database per iteration of the notify loop.
+	callbackBatchSize = 100
+
+	// callbackRateWindow is the window over which the number of deliveries
+	// per host is capped.
+	callbackRateWindow = time.Minute
+
+	// callbackTimeout is the maximum amount of time we wait for a callback
+	// url to accept a notification.
+	callbackTimeout = 30 * time.Second
+
+	// maxCallbackAttempts is the number of times we try to deliver a
+	// callback before we give up on it.
+	maxCallbackAttempts = 5
+)
+
+var (
+	// callbackInterval defines the amount of time between fetching the
+	// callbacks that are ready to be delivered from the database. Failed
+	// deliveries are retried on the next iteration.
+	callbackInterval = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  100 * time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
+)
+
+type (
+	// NotifierConfig defines how the notifier signs callbacks and how many
+	// it delivers.
+	NotifierConfig struct {
+		// Secret is the secret callbacks are signed with.
+		Secret string
+
+		// RateLimit is the maximum number of callbacks delivered to a single
+		// host within a minute, callbacks that exceed it are deferred.
+		RateLimit int
+	}
+
+	// CallbackPayload is the payload that gets POSTed to the callback url of
+	// a report once the reported hash reached its final state.
+	CallbackPayload struct {
+		Hash   database.Hash `json:"hash"`
+		Status string        `json:"status"`
+		Time   time.Time     `json:"time"`
+	}
+
+	// Notifier periodically delivers the callbacks of reports whose hash got
+	// blocked, or that skyd rejected as invalid. Callbacks are removed from
+	// the report once they're delivered, or once they failed to get delivered
+	// maxCallbackAttempts times.
+	Notifier struct {
+		started bool
+
+		// deliveries holds the time of the recent deliveries per host, it's
+		// used to cap the number of deliveries per host.
+		deliveries map[string][]time.Time
+
+		// delivered, failed and abandoned count the callbacks that got
+		// delivered, that failed to get delivered and that we gave up on.
+		delivered uint64
+		failed    uint64
+		abandoned uint64
+
+		staticCfg        NotifierConfig
+		staticDB         database.Store
+		staticHTTPClient *http.Client
+		staticLogger     *logrus.Entry
+		staticMu         sync.Mutex
+		staticStopChan   chan struct{}
+		staticWaitGroup  sync.WaitGroup
+	}
+
+	// NotifierStatus is a snapshot of the notifier's state.
+	NotifierStatus struct {
+		Started   bool   `json:"started"`
+		Delivered uint64 `json:"delivered"`
+		Failed    uint64 `json:"failed"`
+		Abandoned uint64 `json:"abandoned"`
+	}
+)
+
+// NewNotifier returns a new Notifier with the given parameters.
+func NewNotifier(cfg NotifierConfig, db database.Store, logger *logrus.Entry) (*Notifier, error) {
+	if db == nil {
+		return nil, errors.New("no DB provided")
+	}
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("no callback secret provided")
+	}
+	if cfg.RateLimit <= 0 {
+		return nil, errors.New("callback rate limit has to be positive")
+	}
+	n := &Notifier{
+		deliveries: make(map[string][]time.Time),
+		staticCfg:  cfg,
+		staticDB:   db,
+		staticHTTPClient: &http.Client{
+			Timeout: callbackTimeout,
+			// don't follow redirects, they could point outside of the
+			// callback domains
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		staticLogger:   logger,
+		staticStopChan: make(chan struct{}),
+	}
+	return n, nil
+}
+
+// Start launches a background task that periodically delivers callbacks.
+func (n *Notifier) Start() error {
+	n.staticMu.Lock()
+	defer n.staticMu.Unlock()
+
+	// assert 'Start' is only called once
+	if n.started {
+		return errors.New("notifier already started")
+	}
+	n.started = true
+
+	// start the notify loop
+	n.staticWaitGroup.Add(1)
+	go func() {
+		n.threadedNotifyLoop()
+		n.staticWaitGroup.Done()
+	}()
+
+	return nil
+}
+
+// Stop waits for the notifier's waitgroup and times out after one minute.
+func (n *Notifier) Stop() error {
+	// check whether the notifier was started
+	n.staticMu.Lock()
+	if !n.started {
+		n.staticMu.Unlock()
+		return errors.New("notifier not started")
+	}
+	n.started = false
+	n.staticMu.Unlock()
+
+	// stop the notifier by closing the stop channel
+	close(n.staticStopChan)
+
+	// wait for the waitgroup, timeout and signal unclean shutdown after 1m
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		n.staticWaitGroup.Wait()
+	}()
+	select {
+	case <-c:
+		return nil
+	case <-time.After(stopTimeoutDuration):
+		return errors.New("unclean notifier shutdown")
+	}
+}
+
+// Status returns a snapshot of the notifier's state.
+func (n *Notifier) Status() NotifierStatus {
+	n.staticMu.Lock()
+	defer n.staticMu.Unlock()
+	return NotifierStatus{
+		Started:   n.started,
+		Delivered: n.delivered,
+		Failed:    n.failed,
+		Abandoned: n.abandoned,
+	}
+}
+
+// threadedNotifyLoop holds the notify loop
+func (n *Notifier) threadedNotifyLoop() {
+	// convenience variables
+	logger := n.staticLogger
+
+	for {
+		err := n.managedNotify()
+		if err != nil {
+			logger.WithError(err).Error("failed to deliver callbacks")
+		}
+
+		select {
+		case <-n.staticStopChan:
+			return
+		case <-time.After(callbackInterval):
+		}
+	}
+}
+
+// managedNotify fetches the callbacks that are ready to be delivered and
+// delivers them. Callbacks to hosts that exceeded the rate limit are deferred
+// to the next iteration, they don't count as a failed attempt.
+func (n *Notifier) managedNotify() error {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	skylinks, err := n.staticDB.CallbacksToDeliver(ctx, callbackBatchSize)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch callbacks")
+	}
+
+	var errs []error
+	for _, bs := range skylinks {
+		// check for shutdown between deliveries
+		select {
+		case <-n.staticStopChan:
+			return errors.Compose(errs...)
+		default:
+		}
+
+		u, err := url.Parse(bs.CallbackURL)
+		if err != nil {
+			// the url got validated when the report was made, so this
+			// should never happen, there's no point in retrying it
+			n.staticLogger.WithError(err).WithField("hash", bs.Hash.String()).Error("dropping invalid callback url")
+			errs = append(errs, n.staticDB.ClearCallback(ctx, bs.Hash))
+			continue
+		}
+		if !n.managedReserveDelivery(u.Hostname()) {
+			continue
+		}
+		errs = append(errs, n.managedDeliver(bs))
+	}
+	return errors.Compose(errs...)
+}
+
+// managedReserveDelivery returns true if a callback can be delivered to the
+// given host without exceeding the rate limit, in which case the delivery is
+// accounted for.
+func (n *Notifier) managedReserveDelivery(host string) bool {
+	n.staticMu.Lock()
+	defer n.staticMu.Unlock()
+
+	// drop the deliveries that fell out of the window
+	cutoff := time.Now().Add(-callbackRateWindow)
+	var recent []time.Time
+	for _, t := range n.deliveries[host] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= n.staticCfg.RateLimit {
+		n.deliveries[host] = recent
+		return false
+	}
+	n.deliveries[host] = append(recent, time.Now())
+	return true
+}
+
+// managedDeliver delivers the callback of the given skylink. The callback is
+// cleared if it got delivered or if it failed to get delivered too many times,
+// otherwise its number of attempts is incremented so it gets retried.
+func (n *Notifier) managedDeliver(bs database.BlockedSkylink) error {
+	logger := n.staticLogger.WithFields(logrus.Fields{
+		"hash": bs.Hash.String(),
+		"url":  bs.CallbackURL,
+	})
+
+	status := CallbackStatusBlocked
+	if bs.Invalid {
+		status = CallbackStatusInvalid
+	}
+	err := n.managedSendCallback(bs.CallbackURL, CallbackPayload{
+		Hash:   bs.Hash,
+		Status: status,
+		Time:   database.Now(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	if err == nil {
+		n.staticMu.Lock()
+		n.delivered++
+		n.staticMu.Unlock()
+		return n.staticDB.ClearCallback(ctx, bs.Hash)
+	}
+
+	n.staticMu.Lock()
+	n.failed++
+	abandon := bs.CallbackAttempts+1 >= maxCallbackAttempts
+	if abandon {
+		n.abandoned++
+	}
+	n.staticMu.Unlock()
+
+	if abandon {
+		logger.WithError(err).Errorf("giving up on callback after %v attempts", maxCallbackAttempts)
+		return n.staticDB.ClearCallback(ctx, bs.Hash)
+	}
+	logger.WithError(err).Debug("failed to deliver callback")
+	return n.staticDB.IncrementCallbackAttempts(ctx, bs.Hash)
+}
+
+// managedSendCallback POSTs the given payload to the given callback url,
+// signed with the callback secret.
+func (n *Notifier) managedSendCallback(callbackURL string, payload CallbackPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.AddContext(err, "failed to encode callback")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.AddContext(err, "failed to create callback request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	modules.SignRequest(req, CallbackKeyID, n.staticCfg.Secret, body, time.Now())
+	resp, err := n.staticHTTPClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to send callback")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to send callback, unexpected status code %v", resp.StatusCode)
+	}
+	return nil
+}
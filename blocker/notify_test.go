@@ -0,0 +1,221 @@
+package blocker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestNotifier verifies the notifier delivers signed callbacks once a reported
+// hash got blocked or found to be invalid, that it gives up on callback urls
+// that keep failing and that it caps the number of deliveries per host.
+func TestNotifier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// create a server that records the callbacks it receives, requests to
+	// '/fail' always fail
+	secret := "callbacksecret"
+	var mu sync.Mutex
+	var callbacks []CallbackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get(modules.SignatureKeyIDHeader) != CallbackKeyID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		err = modules.VerifySignature(r, secret, body, database.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload CallbackPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		callbacks = append(callbacks, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	received := func() []CallbackPayload {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]CallbackPayload(nil), callbacks...)
+	}
+
+	// create the database and the notifier
+	db := database.NewTestDB(ctx, t.Name(), database.WithCleanup(t))
+	logger, _ := logtest.NewNullLogger()
+	n, err := NewNotifier(NotifierConfig{Secret: secret, RateLimit: 3}, db, logger.WithField("module", "notifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create is a helper that reports a hash with the given callback url
+	create := func(name, path string) database.Hash {
+		hash := database.HashBytes([]byte(name))
+		err := db.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+			CallbackURL:    server.URL + path,
+			Hash:           hash,
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	notify := func() {
+		t.Helper()
+		err := n.managedNotify()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCallback := func(hash database.Hash, attempts int, exists bool) {
+		t.Helper()
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (doc.CallbackURL != "") != exists || doc.CallbackAttempts != attempts {
+			t.Fatalf("unexpected callback '%v' after %v attempts", doc.CallbackURL, doc.CallbackAttempts)
+		}
+	}
+
+	// assert no callback is delivered while the hash isn't blocked yet
+	blocked := create("blocked", "/callback")
+	invalid := create("invalid", "/callback")
+	notify()
+	if len(received()) != 0 {
+		t.Fatal("unexpected callbacks", received())
+	}
+
+	// assert the callbacks are delivered once the hashes reach their final
+	// state, and they're cleared afterwards
+	err = db.MarkSucceeded(ctx, []database.Hash{blocked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkInvalid(ctx, []database.Hash{invalid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify()
+	got := received()
+	if len(got) != 2 {
+		t.Fatal("unexpected callbacks", got)
+	}
+	if got[0].Hash != blocked || got[0].Status != CallbackStatusBlocked {
+		t.Fatal("unexpected callback", got[0])
+	}
+	if got[1].Hash != invalid || got[1].Status != CallbackStatusInvalid {
+		t.Fatal("unexpected callback", got[1])
+	}
+	assertCallback(blocked, 0, false)
+	assertCallback(invalid, 0, false)
+
+	// assert the callbacks aren't delivered twice
+	notify()
+	if len(received()) != 2 {
+		t.Fatal("unexpected callbacks", received())
+	}
+
+	// assert a callback url that keeps failing is retried until we give up
+	// on it, the recent deliveries are reset before every attempt so the
+	// rate limit doesn't defer it
+	failing := create("failing", "/fail")
+	err = db.MarkSucceeded(ctx, []database.Hash{failing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxCallbackAttempts; i++ {
+		n.deliveries = make(map[string][]time.Time)
+		notify()
+		assertCallback(failing, i, true)
+	}
+	n.deliveries = make(map[string][]time.Time)
+	notify()
+	assertCallback(failing, 0, false)
+	if status := n.Status(); status.Delivered != 2 || status.Failed != maxCallbackAttempts || status.Abandoned != 1 {
+		t.Fatal("unexpected status", status)
+	}
+
+	// assert the deliveries to a single host are capped, the deferred ones
+	// are delivered once the rate limit allows it
+	n.deliveries = make(map[string][]time.Time)
+	var hashes []database.Hash
+	for i := 0; i < 5; i++ {
+		hashes = append(hashes, create(fmt.Sprintf("capped_%d", i), "/callback"))
+	}
+	err = db.MarkSucceeded(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify()
+	if len(received()) != 5 {
+		t.Fatal("unexpected callbacks", len(received()))
+	}
+	for i, hash := range hashes {
+		assertCallback(hash, 0, i >= 3)
+	}
+	n.deliveries = make(map[string][]time.Time)
+	notify()
+	if len(received()) != 7 {
+		t.Fatal("unexpected callbacks", len(received()))
+	}
+	for _, hash := range hashes {
+		assertCallback(hash, 0, false)
+	}
+}
+
+// TestNewNotifier verifies the notifier's constructor validates its config.
+func TestNewNotifier(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.NewEntry(logrus.New())
+	_, err := NewNotifier(NotifierConfig{Secret: "secret", RateLimit: 1}, nil, logger)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	db := &database.DB{}
+	_, err = NewNotifier(NotifierConfig{RateLimit: 1}, db, logger)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = NewNotifier(NotifierConfig{Secret: "secret"}, db, logger)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = NewNotifier(NotifierConfig{Secret: "secret", RateLimit: 1}, db, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package blocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// WebhookEventReport is the event of a newly reported skylink.
+	WebhookEventReport = "report"
+
+	// WebhookEventBacklog is the event of the backlog exceeding the alert
+	// thresholds.
+	WebhookEventBacklog = "backlog"
+)
+
+type (
+	// WebhookRule routes the events that match it to its urls. A rule
+	// without tags matches reports regardless of their tags, a rule without
+	// a minimum severity matches reports of every severity and a rule
+	// without events matches every event. Backlog events carry no tags, they
+	// only match rules without tags, the minimum severity doesn't apply to
+	// them.
+	WebhookRule struct {
+		URLs        []string `json:"urls"`
+		Tags        []string `json:"tags,omitempty"`
+		MinSeverity string   `json:"minSeverity,omitempty"`
+		Events      []string `json:"events,omitempty"`
+	}
+
+	// Dispatcher POSTs alerts to the urls of the webhook rules that match
+	// them, an alert is sent to every url at most once.
+	Dispatcher struct {
+		staticRules      []WebhookRule
+		staticHTTPClient *http.Client
+	}
+)
+
+// NewDispatcher returns a dispatcher that routes alerts by the given rules, it
+// returns an error if one of them is invalid.
+func NewDispatcher(rules []WebhookRule) (*Dispatcher, error) {
+	normalized := make([]WebhookRule, len(rules))
+	for i, rule := range rules {
+		err := rule.Validate()
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("invalid webhook rule %d", i))
+		}
+		rule.Tags = database.NormalizeTags(rule.Tags)
+		rule.MinSeverity = strings.ToLower(strings.TrimSpace(rule.MinSeverity))
+		normalized[i] = rule
+	}
+	return &Dispatcher{
+		staticRules:      normalized,
+		staticHTTPClient: &http.Client{Timeout: alertTimeout},
+	}, nil
+}
+
+// Validate returns an error if the rule has no urls, if one of them isn't an
+// absolute http(s) url, or if its minimum severity or one of its events is
+// unknown.
+func (r WebhookRule) Validate() error {
+	if len(r.URLs) == 0 {
+		return errors.New("webhook rule needs at least one url")
+	}
+	for _, u := range r.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			// NOTE: the url isn't part of the error, it might hold a token
+			return errors.New("webhook urls should be absolute http or https urls")
+		}
+	}
+	severity := strings.ToLower(strings.TrimSpace(r.MinSeverity))
+	if severity != "" && !database.IsSeverity(severity) {
+		return fmt.Errorf("invalid minimum severity '%s', should be '%s', '%s' or '%s'", r.MinSeverity, database.SeverityCritical, database.SeverityHigh, database.SeverityNormal)
+	}
+	for _, event := range r.Events {
+		if event != WebhookEventReport && event != WebhookEventBacklog {
+			return fmt.Errorf("invalid event '%s', should be '%s' or '%s'", event, WebhookEventReport, WebhookEventBacklog)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the given alert matches the rule.
+func (r WebhookRule) matches(alert Alert) bool {
+	if len(r.Events) > 0 && !containsString(r.Events, alert.Event) {
+		return false
+	}
+	if len(r.Tags) > 0 {
+		var tagged bool
+		for _, tag := range alert.Tags {
+			if containsString(r.Tags, database.NormalizeTag(tag)) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	if alert.Event == WebhookEventReport && r.MinSeverity != "" {
+		return database.SeverityAtLeast(alert.Severity, r.MinSeverity)
+	}
+	return true
+}
+
+// Dispatch POSTs the given alert to the urls of the rules that match it, the
+// urls are called concurrently. Urls that match more than one rule are only
+// called once.
+func (d *Dispatcher) Dispatch(ctx context.Context, alert Alert) error {
+	urls := d.urls(alert)
+	if len(urls) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return errors.AddContext(err, "failed to encode alert")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(urls))
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			errs[i] = d.send(ctx, u, body)
+		}(i, u)
+	}
+	wg.Wait()
+	return errors.Compose(errs...)
+}
+
+// urls returns the urls of the rules that match the given alert, without
+// duplicates, in the order of the rules.
+func (d *Dispatcher) urls(alert Alert) []string {
+	var urls []string
+	seen := make(map[string]struct{})
+	for _, rule := range d.staticRules {
+		if !rule.matches(alert) {
+			continue
+		}
+		for _, u := range rule.URLs {
+			if _, exists := seen[u]; exists {
+				continue
+			}
+			seen[u] = struct{}{}
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// send POSTs the given body to the given url.
+func (d *Dispatcher) send(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.AddContext(err, "failed to create alert request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.staticHTTPClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to send alert")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to send alert, unexpected status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// containsString returns whether the given slice contains the given string.
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package blocker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/SkynetLabs/blocker/database"
+)
+
+// TestDispatcher verifies the dispatcher routes alerts by the tags, severity
+// and event of its rules, and calls every url at most once per alert.
+func TestDispatcher(t *testing.T) {
+	t.Parallel()
+
+	// create a server that records the paths it received alerts on
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		err := json.NewDecoder(r.Body).Decode(&alert)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// create a dispatcher that routes csam reports to a restricted channel
+	// and the moderation feed, high severity reports to the moderation feed,
+	// and everything to the audit log
+	restricted := server.URL + "/restricted"
+	moderation := server.URL + "/moderation"
+	audit := server.URL + "/audit"
+	d, err := NewDispatcher([]WebhookRule{
+		{URLs: []string{restricted, moderation}, Tags: []string{"CSAM"}},
+		{URLs: []string{moderation}, MinSeverity: database.SeverityHigh, Events: []string{WebhookEventReport}},
+		{URLs: []string{audit}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		alert    Alert
+		expected []string
+	}{
+		{"Tag", Alert{Event: WebhookEventReport, Tags: []string{"csam"}, Severity: database.SeverityCritical}, []string{"/audit", "/moderation", "/restricted"}},
+		{"TagNormalSeverity", Alert{Event: WebhookEventReport, Tags: []string{"malware", "csam"}}, []string{"/audit", "/moderation", "/restricted"}},
+		{"Severity", Alert{Event: WebhookEventReport, Tags: []string{"malware"}, Severity: database.SeverityHigh}, []string{"/audit", "/moderation"}},
+		{"BelowSeverity", Alert{Event: WebhookEventReport, Tags: []string{"spam"}, Severity: database.SeverityNormal}, []string{"/audit"}},
+		{"Backlog", Alert{Event: WebhookEventBacklog}, []string{"/audit"}},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		received = nil
+		mu.Unlock()
+
+		err = d.Dispatch(context.Background(), test.alert)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		mu.Lock()
+		sort.Strings(received)
+		if len(received) != len(test.expected) {
+			t.Fatalf("%v: unexpected alerts %v", test.name, received)
+		}
+		for i := range received {
+			if received[i] != test.expected[i] {
+				t.Fatalf("%v: unexpected alerts %v", test.name, received)
+			}
+		}
+		mu.Unlock()
+	}
+
+	// assert a failing url doesn't prevent the others from being called
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	d, err = NewDispatcher([]WebhookRule{{URLs: []string{failing.URL, audit}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Dispatch(context.Background(), Alert{Event: WebhookEventBacklog})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0] != "/audit" {
+		t.Fatal("unexpected alerts", received)
+	}
+}
+
+// TestWebhookRuleValidate verifies webhook rules are validated.
+func TestWebhookRuleValidate(t *testing.T) {
+	t.Parallel()
+
+	urls := []string{"https://hooks.example.com"}
+	tests := []struct {
+		name  string
+		rule  WebhookRule
+		valid bool
+	}{
+		{"CatchAll", WebhookRule{URLs: urls}, true},
+		{"Full", WebhookRule{URLs: urls, Tags: []string{"csam"}, MinSeverity: "High", Events: []string{WebhookEventReport, WebhookEventBacklog}}, true},
+		{"NoURLs", WebhookRule{Tags: []string{"csam"}}, false},
+		{"RelativeURL", WebhookRule{URLs: []string{"hooks.example.com"}}, false},
+		{"UnknownScheme", WebhookRule{URLs: []string{"ftp://hooks.example.com"}}, false},
+		{"UnknownSeverity", WebhookRule{URLs: urls, MinSeverity: "urgent"}, false},
+		{"UnknownEvent", WebhookRule{URLs: urls, Events: []string{"blocked"}}, false},
+	}
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+// Package client implements a Go client for the blocker API. It allows
+// services like the malware scanner or the abuse email scanner to report
+// skylinks, and portals to page through the blocklist, without having to deal
+// with the HTTP details of the API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/crypto"
+)
+
+const (
+	// APIKeyHeader is the header that holds the API key, if one is
+	// configured.
+	APIKeyHeader = "Skynet-Api-Key"
+
+	// DefaultTimeout is the default timeout of a single request.
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultRetries is the default number of times a request is retried
+	// when the API responds with a server error.
+	DefaultRetries = 3
+
+	// DefaultRetryBackoff is the default amount of time we wait before
+	// retrying a request, it doubles after every attempt.
+	DefaultRetryBackoff = 500 * time.Millisecond
+
+	// SortAscending sorts the blocklist from oldest to newest.
+	SortAscending = "asc"
+
+	// SortDescending sorts the blocklist from newest to oldest.
+	SortDescending = "desc"
+
+	// StatusDuplicate is the status returned when a skylink was reported
+	// that was reported before.
+	StatusDuplicate = "duplicate"
+
+	// StatusReported is the status returned when a skylink got reported.
+	StatusReported = "reported"
+
+	// maxErrorBodySize is the maximum number of bytes we read from the body
+	// of an error response.
+	maxErrorBodySize = 1 << 16 // 64kib
+)
+
+var (
+	// ErrBadGateway is returned when the API responds with a 502, which
+	// happens when skyd can't be reached to resolve a skylink.
+	ErrBadGateway = errors.New("bad gateway")
+
+	// ErrForbidden is returned when the API responds with a 403, e.g.
+	// because the API key is not allowed to apply one of the report's tags.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrInvalidRequest is returned when the API rejects the request as
+	// invalid, or when the request fails validation before it's sent.
+	ErrInvalidRequest = errors.New("invalid request")
+
+	// ErrNotFound is returned when the API responds with a 404, e.g. because
+	// the registry entry of a reported v2 skylink does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrServer is returned when the API responds with a server error other
+	// than a 502.
+	ErrServer = errors.New("server error")
+
+	// ErrTooManyRequests is returned when the API responds with a 429, which
+	// happens when a reporter exceeded its number of reports.
+	ErrTooManyRequests = errors.New("too many requests")
+
+	// ErrUnexpectedStatus is returned when the API responds with a status
+	// code outside of the 200s that's not covered by any other error.
+	ErrUnexpectedStatus = errors.New("unexpected status")
+)
+
+type (
+	// Client is a client for the blocker API.
+	Client struct {
+		staticAPIKey       string
+		staticKeyID        string
+		staticKeySecret    string
+		staticBaseURL      string
+		staticHTTPClient   *http.Client
+		staticRetries      int
+		staticRetryBackoff time.Duration
+		staticTimeout      time.Duration
+	}
+
+	// Option configures a Client.
+	Option func(*Client)
+
+	// BlockRequest describes a skylink that gets reported to the blocker.
+	// Either the skylink or its hash must be set.
+	BlockRequest struct {
+		Skylink  string      `json:"skylink,omitempty"`
+		Hash     crypto.Hash `json:"hash"`
+		Reporter Reporter    `json:"reporter"`
+		Tags     []string    `json:"tags"`
+
+		// Metadata holds optional provenance information of the report, e.g.
+		// the message ID of the abuse email the skylink was parsed from.
+		// Values can't exceed 1 KiB.
+		Metadata map[string]string `json:"metadata,omitempty"`
+
+		// Portal is the url of the portal the skylink was reported on, it's
+		// only set by blockers that push their reports to a peer blocker.
+		// The peer won't push the report any further.
+		Portal string `json:"portal,omitempty"`
+
+		// Sub is the sub of the user on whose behalf the skylink gets
+		// reported, it's optional.
+		Sub string `json:"-"`
+	}
+
+	// BlockResult is the outcome of a single report within a bulk report.
+	BlockResult struct {
+		Status string
+		Err    error
+	}
+
+	// BlockedHash is an entry of the blocklist.
+	BlockedHash struct {
+		Hash crypto.Hash `json:"hash"`
+		Tags []string    `json:"tags"`
+	}
+
+	// BlocklistOptions configure what page of the blocklist gets fetched.
+	// Zero values are omitted and the API's defaults are used.
+	BlocklistOptions struct {
+		Sort   string
+		Offset int
+		Limit  int
+
+		// HashPrefix only lists the hashes that start with the given prefix
+		// of at least 8 hex characters, at most 20 entries are returned.
+		HashPrefix string
+	}
+
+	// BlocklistPage is a page of the blocklist.
+	BlocklistPage struct {
+		Entries []BlockedHash `json:"entries"`
+		HasMore bool          `json:"hasmore"`
+	}
+
+	// Capabilities describes the version, routes, enabled features and
+	// enforced limits of the blocker. Features that aren't listed are not
+	// supported.
+	Capabilities struct {
+		Version  string          `json:"version"`
+		Routes   []Route         `json:"routes"`
+		Features map[string]bool `json:"features"`
+		Limits   Limits          `json:"limits"`
+		PoW      PoWCapabilities `json:"pow"`
+	}
+
+	// Limits are the limits enforced by the blocker.
+	Limits struct {
+		MaxBodySize          int64 `json:"maxBodySize"`
+		MaxBatchSize         int   `json:"maxBatchSize"`
+		MaxPageSize          int   `json:"maxPageSize"`
+		MaxHashPrefixMatches int   `json:"maxHashPrefixMatches"`
+	}
+
+	// PoWCapabilities describes the proofs of work accepted by the blocker.
+	PoWCapabilities struct {
+		Target          string   `json:"target"`
+		Versions        []string `json:"versions"`
+		MaxProofUses    int      `json:"maxProofUses"`
+		MaxDailyReports int      `json:"maxDailyReports"`
+	}
+
+	// Route is a route served by the blocker.
+	Route struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+
+	// Health is the health of the blocker, its status is either 'ok' or
+	// 'degraded'. A blocker that is down responds with a 503.
+	Health struct {
+		Status         string        `json:"status"`
+		Checks         []HealthCheck `json:"checks"`
+		DBAlive        bool          `json:"dbAlive"`
+		SchemaHealthy  bool          `json:"schemaHealthy"`
+		MissingIndexes []string      `json:"missingIndexes"`
+	}
+
+	// HealthCheck is the result of one of the health checks of the blocker,
+	// its latency is expressed in seconds.
+	HealthCheck struct {
+		Name    string  `json:"name"`
+		Status  string  `json:"status"`
+		Latency float64 `json:"latency"`
+		Error   string  `json:"error,omitempty"`
+	}
+
+	// Reporter describes the reporter of a skylink.
+	Reporter struct {
+		Name         string `json:"name"`
+		Email        string `json:"email"`
+		OtherContact string `json:"othercontact"`
+	}
+
+	// statusResponse is the response of the block endpoint.
+	statusResponse struct {
+		Status string `json:"status"`
+	}
+)
+
+// New returns a client for the blocker API at the given base url, e.g.
+// 'http://blocker:4000'.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.AddContext(err, "invalid base url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base url '%s', scheme must be http or https", baseURL)
+	}
+	c := &Client{
+		staticBaseURL:      strings.TrimSuffix(baseURL, "/"),
+		staticHTTPClient:   http.DefaultClient,
+		staticRetries:      DefaultRetries,
+		staticRetryBackoff: DefaultRetryBackoff,
+		staticTimeout:      DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.staticHTTPClient == nil {
+		return nil, errors.New("http client can't be nil")
+	}
+	if c.staticTimeout <= 0 {
+		return nil, errors.New("timeout has to be positive")
+	}
+	if c.staticRetries < 0 {
+		return nil, errors.New("number of retries can't be negative")
+	}
+	if c.staticRetryBackoff < 0 {
+		return nil, errors.New("retry backoff can't be negative")
+	}
+	if (c.staticKeyID == "") != (c.staticKeySecret == "") {
+		return nil, errors.New("signing key needs both an id and a secret")
+	}
+	return c, nil
+}
+
+// SignRequest signs the given request with the secret of the API key with the
+// given id, the body has to be the body of the request. The blocker verifies
+// the signature over the current time, the method, the path and the body, so
+// the request has to be sent within minutes and can't be altered after it's
+// signed.
+func SignRequest(req *http.Request, keyID, secret string, body []byte) {
+	modules.SignRequest(req, keyID, secret, body, time.Now())
+}
+
+// WithAPIKey sets the API key that is sent with every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.staticAPIKey = key
+	}
+}
+
+// WithSigningKey signs every request with the secret of the API key with the
+// given id, rather than sending the key in the Skynet-Api-Key header. The
+// secret is the key as configured on the blocker.
+func WithSigningKey(keyID, secret string) Option {
+	return func(c *Client) {
+		c.staticKeyID = keyID
+		c.staticKeySecret = secret
+	}
+}
+
+// WithHTTPClient sets the http client that is used to execute the requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.staticHTTPClient = client
+	}
+}
+
+// WithRetries sets the number of times a request is retried when the API
+// responds with a server error, and the initial amount of time we wait before
+// retrying. The backoff doubles after every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.staticRetries = retries
+		c.staticRetryBackoff = backoff
+	}
+}
+
+// WithTimeout sets the timeout of a single request, retries get a timeout of
+// their own.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.staticTimeout = timeout
+	}
+}
+
+// Block reports the given skylink to the blocker. It returns StatusReported
+// or StatusDuplicate if the skylink was reported before.
+func (c *Client) Block(ctx context.Context, req BlockRequest) (string, error) {
+	err := req.normalize()
+	if err != nil {
+		return "", errors.Compose(err, ErrInvalidRequest)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to marshal request")
+	}
+	query := url.Values{}
+	if req.Sub != "" {
+		query.Set("sub", req.Sub)
+	}
+	var sr statusResponse
+	err = c.do(ctx, http.MethodPost, "/block", query, body, &sr)
+	if err != nil {
+		return "", err
+	}
+	return sr.Status, nil
+}
+
+// BlockBulk reports the given skylinks to the blocker, one after the other.
+// The result of every report is returned at the same index as its request.
+func (c *Client) BlockBulk(ctx context.Context, reqs []BlockRequest) []BlockResult {
+	results := make([]BlockResult, len(reqs))
+	for i, req := range reqs {
+		results[i].Status, results[i].Err = c.Block(ctx, req)
+	}
+	return results
+}
+
+// Blocklist returns an iterator over the blocklist, starting at the page
+// described by the given options. Pages are fetched lazily.
+func (c *Client) Blocklist(ctx context.Context, opts BlocklistOptions) *BlocklistIterator {
+	return &BlocklistIterator{
+		staticClient: c,
+		staticCtx:    ctx,
+		opts:         opts,
+		hasMore:      true,
+	}
+}
+
+// BlocklistPage fetches a single page of the blocklist.
+func (c *Client) BlocklistPage(ctx context.Context, opts BlocklistOptions) (BlocklistPage, error) {
+	query := url.Values{}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if opts.Offset != 0 {
+		query.Set("offset", fmt.Sprint(opts.Offset))
+	}
+	if opts.Limit != 0 {
+		query.Set("limit", fmt.Sprint(opts.Limit))
+	}
+	if opts.HashPrefix != "" {
+		query.Set("hashPrefix", opts.HashPrefix)
+	}
+	var page BlocklistPage
+	err := c.do(ctx, http.MethodGet, "/blocklist", query, nil, &page)
+	if err != nil {
+		return BlocklistPage{}, err
+	}
+	return page, nil
+}
+
+// Capabilities returns the version, routes, enabled features and enforced
+// limits of the blocker.
+func (c *Client) Capabilities(ctx context.Context) (Capabilities, error) {
+	var caps Capabilities
+	err := c.do(ctx, http.MethodGet, "/capabilities", nil, nil, &caps)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return caps, nil
+}
+
+// Health returns the health of the blocker.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	err := c.do(ctx, http.MethodGet, "/health", nil, nil, &health)
+	if err != nil {
+		return Health{}, err
+	}
+	return health, nil
+}
+
+// do executes a request and decodes the response into obj. Requests that fail
+// with a server error are retried with an exponential backoff.
+func (c *Client) do(ctx context.Context, method, endpoint string, query url.Values, body []byte, obj interface{}) error {
+	backoff := c.staticRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, endpoint, query, body, obj)
+		if err == nil || attempt >= c.staticRetries || !retryable(err) {
+			return err
+		}
+
+		// wait before retrying
+		select {
+		case <-ctx.Done():
+			return errors.Compose(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// doOnce executes a single request and decodes the response into obj.
+func (c *Client) doOnce(ctx context.Context, method, endpoint string, query url.Values, body []byte, obj interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.staticTimeout)
+	defer cancel()
+
+	// create the request
+	url := c.staticBaseURL + endpoint
+	if len(query) > 0 {
+		url = fmt.Sprintf("%s?%s", url, query.Encode())
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return errors.AddContext(err, "failed to create request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.staticAPIKey != "" {
+		req.Header.Set(APIKeyHeader, c.staticAPIKey)
+	}
+	if c.staticKeyID != "" {
+		SignRequest(req, c.staticKeyID, c.staticKeySecret, body)
+	}
+
+	// execute the request
+	res, err := c.staticHTTPClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, fmt.Sprintf("%s request to '%s' failed", method, url))
+	}
+	defer drainAndClose(res.Body)
+
+	// return an error if the status code is not in the 200s
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return newStatusError(res)
+	}
+
+	// handle the response body
+	err = json.NewDecoder(res.Body).Decode(obj)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode response")
+	}
+	return nil
+}
+
+// normalize validates the request and normalizes its skylink.
+func (req *BlockRequest) normalize() error {
+	if req.Skylink == "" && req.Hash == (crypto.Hash{}) {
+		return errors.New("either the skylink or the hash must be set")
+	}
+	if req.Skylink == "" {
+		return nil
+	}
+	skylink, err := modules.NormalizeSkylink(req.Skylink)
+	if err != nil {
+		return err
+	}
+	req.Skylink = skylink
+	return nil
+}
+
+// newStatusError returns the error for the given response, it contains the
+// error that corresponds with the response's status code as well as the
+// message returned by the API.
+func newStatusError(res *http.Response) error {
+	var statusErr error
+	switch code := res.StatusCode; {
+	case code == http.StatusBadRequest:
+		statusErr = ErrInvalidRequest
+	case code == http.StatusForbidden:
+		statusErr = ErrForbidden
+	case code == http.StatusNotFound:
+		statusErr = ErrNotFound
+	case code == http.StatusTooManyRequests:
+		statusErr = ErrTooManyRequests
+	case code == http.StatusBadGateway:
+		statusErr = ErrBadGateway
+	case code >= 500:
+		statusErr = ErrServer
+	default:
+		statusErr = ErrUnexpectedStatus
+	}
+	return errors.AddContext(statusErr, fmt.Sprintf("status %d, %s", res.StatusCode, readAPIError(res.Body)))
+}
+
+// readAPIError reads the message of the error returned by the API.
+func readAPIError(r io.Reader) string {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxErrorBodySize))
+	if err != nil {
+		return "could not read error response"
+	}
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &apiErr) != nil || apiErr.Message == "" {
+		return strings.TrimSpace(string(b))
+	}
+	return apiErr.Message
+}
+
+// retryable returns whether a request that failed with the given error should
+// be retried.
+func retryable(err error) bool {
+	return errors.Contains(err, ErrServer) || errors.Contains(err, ErrBadGateway)
+}
+
+// drainAndClose reads rc until EOF and then closes it. drainAndClose should
+// always be called on HTTP response bodies, because if the body is not fully
+// read, the underlying connection can't be reused.
+func drainAndClose(rc io.ReadCloser) {
+	io.Copy(ioutil.Discard, rc)
+	rc.Close()
+}
@@ -0,0 +1,409 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/modules"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.sia.tech/siad/crypto"
+)
+
+const (
+	// v1SkylinkStr is a v1 skylink, it can be resolved without skyd.
+	v1SkylinkStr = "BAAWi3ou51qCH24Im0ESS-5_gKg60qGIYtta-ryrl1kBnQ"
+)
+
+// TestClient runs the client against a blocker API backed by a database.
+func TestClient(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, c *Client)
+	}{
+		{
+			name: "Block",
+			test: testClientBlock,
+		},
+		{
+			name: "BlockBulk",
+			test: testClientBlockBulk,
+		},
+		{
+			name: "Blocklist",
+			test: testClientBlocklist,
+		},
+		{
+			name: "Capabilities",
+			test: testClientCapabilities,
+		},
+		{
+			name: "Health",
+			test: testClientHealth,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newTestClient(t))
+		})
+	}
+}
+
+// testClientBlock verifies reporting a single skylink.
+func testClientBlock(t *testing.T, c *Client) {
+	ctx := context.Background()
+
+	// report a skylink
+	req := BlockRequest{
+		Skylink:  "https://siasky.net/" + v1SkylinkStr + "/index.html",
+		Reporter: Reporter{Name: "client"},
+		Tags:     []string{"malware"},
+		Sub:      "client",
+	}
+	status, err := c.Block(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusReported {
+		t.Fatal("unexpected status", status)
+	}
+
+	// report it again
+	status, err = c.Block(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusDuplicate {
+		t.Fatal("unexpected status", status)
+	}
+
+	// assert invalid metadata is rejected by the blocker
+	_, err = c.Block(ctx, BlockRequest{
+		Hash:     randomHash(),
+		Metadata: map[string]string{"message_id": strings.Repeat("a", 2048)},
+	})
+	if !errors.Contains(err, ErrInvalidRequest) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert invalid requests are rejected before they're sent
+	_, err = c.Block(ctx, BlockRequest{Skylink: "not a skylink"})
+	if !errors.Contains(err, ErrInvalidRequest) {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = c.Block(ctx, BlockRequest{})
+	if !errors.Contains(err, ErrInvalidRequest) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testClientBlockBulk verifies reporting multiple skylinks at once.
+func testClientBlockBulk(t *testing.T, c *Client) {
+	hash := randomHash()
+	results := c.BlockBulk(context.Background(), []BlockRequest{
+		{Hash: hash, Sub: "client"},
+		{Hash: hash, Sub: "client"},
+		{Skylink: "not a skylink"},
+	})
+	if len(results) != 3 {
+		t.Fatal("unexpected number of results", len(results))
+	}
+	if results[0].Err != nil || results[0].Status != StatusReported {
+		t.Fatal("unexpected result", results[0])
+	}
+	if results[1].Err != nil || results[1].Status != StatusDuplicate {
+		t.Fatal("unexpected result", results[1])
+	}
+	if !errors.Contains(results[2].Err, ErrInvalidRequest) {
+		t.Fatal("unexpected result", results[2])
+	}
+}
+
+// testClientBlocklist verifies iterating over the blocklist.
+func testClientBlocklist(t *testing.T, c *Client) {
+	ctx := context.Background()
+
+	// report a couple of hashes
+	reported := make(map[crypto.Hash]struct{})
+	for i := 0; i < 5; i++ {
+		hash := randomHash()
+		_, err := c.Block(ctx, BlockRequest{Hash: hash, Sub: "client"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reported[hash] = struct{}{}
+	}
+
+	// assert a single page respects the limit
+	page, err := c.BlocklistPage(ctx, BlocklistOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || !page.HasMore {
+		t.Fatal("unexpected page", page)
+	}
+
+	// iterate over the blocklist using pages of 2 entries
+	it := c.Blocklist(ctx, BlocklistOptions{Sort: SortDescending, Limit: 2})
+	for it.Next() {
+		delete(reported, it.Entry().Hash)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 0 {
+		t.Fatal("expected all hashes to be listed", reported)
+	}
+
+	// assert an invalid page results in an error
+	it = c.Blocklist(ctx, BlocklistOptions{Sort: "random"})
+	if it.Next() {
+		t.Fatal("expected no entries")
+	}
+	if !errors.Contains(it.Err(), ErrInvalidRequest) {
+		t.Fatal("unexpected error", it.Err())
+	}
+}
+
+// testClientCapabilities verifies fetching the capabilities of the blocker.
+func testClientCapabilities(t *testing.T, c *Client) {
+	caps, err := c.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != api.Version || !caps.Features[api.FeatureAggregatorMode] {
+		t.Fatal("unexpected capabilities", caps)
+	}
+	if caps.Limits.MaxPageSize == 0 || caps.Limits.MaxBatchSize == 0 {
+		t.Fatal("unexpected limits", caps.Limits)
+	}
+}
+
+// testClientHealth verifies fetching the health of the blocker.
+func testClientHealth(t *testing.T, c *Client) {
+	health, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !health.DBAlive || !health.SchemaHealthy || health.Status == "" || len(health.Checks) == 0 {
+		t.Fatal("unexpected health", health)
+	}
+}
+
+// TestClientErrors verifies the client returns the error corresponding with
+// the status code of the response and retries server errors.
+func TestClientErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		code     int
+		expected error
+		retried  bool
+	}{
+		{"BadRequest", http.StatusBadRequest, ErrInvalidRequest, false},
+		{"Forbidden", http.StatusForbidden, ErrForbidden, false},
+		{"NotFound", http.StatusNotFound, ErrNotFound, false},
+		{"TooManyRequests", http.StatusTooManyRequests, ErrTooManyRequests, false},
+		{"Unauthorized", http.StatusUnauthorized, ErrUnexpectedStatus, false},
+		{"InternalServerError", http.StatusInternalServerError, ErrServer, true},
+		{"BadGateway", http.StatusBadGateway, ErrBadGateway, true},
+	}
+	for _, test := range tests {
+		var requests uint64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint64(&requests, 1)
+			w.WriteHeader(test.code)
+			json.NewEncoder(w).Encode(struct {
+				Message string `json:"message"`
+			}{"some error"})
+		}))
+		c, err := New(server.URL, WithRetries(2, time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Health(context.Background())
+		server.Close()
+		if !errors.Contains(err, test.expected) {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		expected := uint64(1)
+		if test.retried {
+			expected = 3
+		}
+		if requests != expected {
+			t.Fatalf("%v: unexpected number of requests, %v != %v", test.name, requests, expected)
+		}
+	}
+}
+
+// TestClientRetry verifies a request that succeeds after failing with a server
+// error, and that the API key is sent with every attempt.
+func TestClientRetry(t *testing.T) {
+	t.Parallel()
+
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(APIKeyHeader) != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddUint64(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Health{DBAlive: true})
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL, WithAPIKey("key"), WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !health.DBAlive || requests != 3 {
+		t.Fatal("unexpected result", health, requests)
+	}
+
+	// assert the timeout applies to every attempt
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+	c, err = New(slow.URL, WithTimeout(50*time.Millisecond), WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = c.Health(context.Background())
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("expected the request to time out", err)
+	}
+}
+
+// TestClientSigning verifies a client with a signing key signs every request
+// over its body, without sending the key itself.
+func TestClientSigning(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get(APIKeyHeader) != "" || r.Header.Get(modules.SignatureKeyIDHeader) != "scanner" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		err = modules.VerifySignature(r, "secret", body, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(statusResponse{Status: StatusReported})
+	}))
+	defer server.Close()
+
+	// assert a block request is signed over its body
+	c, err := New(server.URL, WithSigningKey("scanner", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hash crypto.Hash
+	fastrand.Read(hash[:])
+	status, err := c.Block(context.Background(), BlockRequest{Hash: hash, Tags: []string{"malware"}})
+	if err != nil || status != StatusReported {
+		t.Fatal("unexpected", status, err)
+	}
+
+	// assert the signature doesn't verify with another secret
+	c, err = New(server.URL, WithSigningKey("scanner", "other"), WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Block(context.Background(), BlockRequest{Hash: hash, Tags: []string{"malware"}})
+	if !errors.Contains(err, ErrUnexpectedStatus) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestNew verifies the options passed to New are validated.
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		url   string
+		opts  []Option
+		valid bool
+	}{
+		{"Valid", "http://localhost:4000", nil, true},
+		{"ValidOptions", "https://localhost:4000/", []Option{WithAPIKey("key"), WithTimeout(time.Second), WithRetries(0, 0)}, true},
+		{"NoScheme", "localhost:4000", nil, false},
+		{"InvalidTimeout", "http://localhost:4000", []Option{WithTimeout(0)}, false},
+		{"InvalidRetries", "http://localhost:4000", []Option{WithRetries(-1, time.Second)}, false},
+		{"InvalidBackoff", "http://localhost:4000", []Option{WithRetries(1, -time.Second)}, false},
+		{"NoHTTPClient", "http://localhost:4000", []Option{WithHTTPClient(nil)}, false},
+		{"SigningKey", "http://localhost:4000", []Option{WithSigningKey("scanner", "secret")}, true},
+		{"SigningKeyNoSecret", "http://localhost:4000", []Option{WithSigningKey("scanner", "")}, false},
+	}
+	for _, test := range tests {
+		_, err := New(test.url, test.opts...)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// newTestClient returns a client for a blocker API that is served by a test
+// server and backed by a test database.
+func newTestClient(t *testing.T) *Client {
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	logger, _ := logtest.NewNullLogger()
+	a, err := api.New(api.Config{
+		AccountsHost:    "localhost",
+		AccountsPort:    "3000",
+		MaxProofUses:    50,
+		MaxDailyReports: 100,
+		TrustedMySkyIDs: make(map[string]struct{}),
+		PoWSecret:       fastrand.Bytes(32),
+		AggregatorMode:  true,
+	}, nil, db, logger.WithField("module", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(a)
+	t.Cleanup(server.Close)
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// randomHash returns a random hash.
+func randomHash() crypto.Hash {
+	var h crypto.Hash
+	fastrand.Read(h[:])
+	return h
+}
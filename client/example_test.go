@@ -0,0 +1,44 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SkynetLabs/blocker/client"
+)
+
+// ExampleClient_Block reports a skylink on behalf of a trusted service.
+func ExampleClient_Block() {
+	c, err := client.New("http://blocker:4000",
+		client.WithTimeout(10*time.Second),
+		client.WithRetries(3, time.Second),
+	)
+	if err != nil {
+		panic(err)
+	}
+	status, err := c.Block(context.Background(), client.BlockRequest{
+		Skylink:  "https://siasky.net/BAAWi3ou51qCH24Im0ESS-5_gKg60qGIYtta-ryrl1kBnQ",
+		Reporter: client.Reporter{Name: "malware-scanner"},
+		Tags:     []string{"malware"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(status)
+}
+
+// ExampleClient_Blocklist iterates over the blocklist, newest entries first.
+func ExampleClient_Blocklist() {
+	c, err := client.New("http://blocker:4000")
+	if err != nil {
+		panic(err)
+	}
+	it := c.Blocklist(context.Background(), client.BlocklistOptions{Sort: client.SortDescending})
+	for it.Next() {
+		fmt.Println(it.Entry().Hash, it.Entry().Tags)
+	}
+	if err := it.Err(); err != nil {
+		panic(err)
+	}
+}
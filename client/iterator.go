@@ -0,0 +1,50 @@
+package client
+
+import "context"
+
+// BlocklistIterator iterates over the entries of the blocklist, fetching the
+// next page whenever the current one is exhausted.
+type BlocklistIterator struct {
+	staticClient *Client
+	staticCtx    context.Context
+
+	opts    BlocklistOptions
+	entries []BlockedHash
+	entry   BlockedHash
+	hasMore bool
+	err     error
+}
+
+// Next advances the iterator to the next entry, which is then available
+// through Entry. It returns false when the blocklist is exhausted or an error
+// occurred, in which case it's returned by Err.
+func (it *BlocklistIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.entries) == 0 && it.hasMore {
+		page, err := it.staticClient.BlocklistPage(it.staticCtx, it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.entries = page.Entries
+		it.hasMore = page.HasMore && len(page.Entries) > 0
+		it.opts.Offset += len(page.Entries)
+	}
+	if len(it.entries) == 0 {
+		return false
+	}
+	it.entry, it.entries = it.entries[0], it.entries[1:]
+	return true
+}
+
+// Entry returns the current entry of the iterator.
+func (it *BlocklistIterator) Entry() BlockedHash {
+	return it.entry
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *BlocklistIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/modules"
+	"gitlab.com/NebulousLabs/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// blockWithPoWPOST is the request body expected by the blocker's /powblock
+// endpoint.
+type blockWithPoWPOST struct {
+	Reporter api.Reporter     `json:"reporter"`
+	Skylink  string           `json:"skylink"`
+	Tags     []string         `json:"tags"`
+	PoW      modules.BlockPoW `json:"pow"`
+}
+
+// powsolve mines a proof of work against the target of a running blocker and
+// prints a request body for the /powblock endpoint, ready to be POSTed.
+func main() {
+	blockerURL := flag.String("blocker", "http://localhost:4000", "url of the blocker to fetch the target and challenge from")
+	seed := flag.String("seed", "", "hex encoded ed25519 seed of the MySkyID")
+	skylink := flag.String("skylink", "", "skylink to report")
+	tags := flag.String("tags", "", "comma separated list of tags")
+	name := flag.String("name", "", "name of the reporter")
+	email := flag.String("email", "", "email of the reporter")
+	threads := flag.Int("threads", runtime.NumCPU(), "number of threads used to solve the proof")
+	timeout := flag.Duration("timeout", 10*time.Minute, "maximum amount of time spent solving the proof")
+	flag.Parse()
+
+	// Load the MySky key.
+	seedBytes, err := hex.DecodeString(*seed)
+	if err != nil || len(seedBytes) != ed25519.SeedSize {
+		log.Fatalf("seed should be a hex encoded string of %v bytes", ed25519.SeedSize)
+	}
+	sk := ed25519.NewKeyFromSeed(seedBytes)
+	pk := sk.Public().(ed25519.PublicKey)
+
+	// Fetch the target and challenge.
+	target, challenge, err := fetchTarget(strings.TrimSuffix(*blockerURL, "/"))
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to fetch target"))
+	}
+
+	// Solve and sign the proof.
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	proof := modules.NewBlockPoW(pk, challenge)
+	start := time.Now()
+	err = modules.SolveProofParallel(ctx, &proof, target, *threads)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to solve proof"))
+	}
+	proof.Sign(sk)
+	fmt.Fprintf(os.Stderr, "solved proof in %v\n", time.Since(start))
+
+	// Print the request body.
+	body := blockWithPoWPOST{
+		Reporter: api.Reporter{
+			Name:  *name,
+			Email: *email,
+		},
+		Skylink: *skylink,
+		PoW:     proof,
+	}
+	for _, tag := range strings.Split(*tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			body.Tags = append(body.Tags, tag)
+		}
+	}
+	err = json.NewEncoder(os.Stdout).Encode(body)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to encode request body"))
+	}
+}
+
+// fetchTarget fetches the current target and challenge from the blocker's GET
+// /powblock endpoint.
+func fetchTarget(blockerURL string) (target [32]byte, challenge *modules.PoWChallenge, err error) {
+	res, err := http.Get(blockerURL + "/powblock")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET request to '%s/powblock' failed with status %d", blockerURL, res.StatusCode)
+		return
+	}
+
+	var resp api.BlockWithPoWGET
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return
+	}
+	targetBytes, err := hex.DecodeString(resp.Target)
+	if err != nil {
+		return
+	}
+	if len(targetBytes) != len(target) {
+		err = fmt.Errorf("unexpected target length %v", len(targetBytes))
+		return
+	}
+	copy(target[:], targetBytes)
+	return target, resp.Challenge, nil
+}
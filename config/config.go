@@ -0,0 +1,1189 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/blocker"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/pusher"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// defaultAccountsHost is the host on which we reach the accounts service
+	// unless overwritten by the "SKYNET_ACCOUNTS_HOST" environment variable.
+	defaultAccountsHost = "accounts"
+
+	// defaultAccountsPort is the port on which we reach the accounts service
+	// unless overwritten by the "SKYNET_ACCOUNTS_PORT" environment variable.
+	defaultAccountsPort = "3000"
+
+	// defaultAlertCheckInterval is the amount of time between checks of the
+	// backlog of failed and invalid skylinks unless overwritten by the
+	// "BLOCKER_ALERT_CHECK_INTERVAL" environment variable.
+	defaultAlertCheckInterval = 5 * time.Minute
+
+	// defaultAlertCooldown is the minimum amount of time between two backlog
+	// alerts unless overwritten by the "BLOCKER_ALERT_COOLDOWN" environment
+	// variable.
+	defaultAlertCooldown = time.Hour
+
+	// defaultAlertFailedThreshold is the number of failed skylinks above which
+	// we alert unless overwritten by the "BLOCKER_ALERT_FAILED_THRESHOLD"
+	// environment variable.
+	defaultAlertFailedThreshold = 1000
+
+	// defaultCallbackRateLimit is the maximum number of callbacks delivered to
+	// a single host within a minute unless overwritten by the
+	// "BLOCKER_CALLBACK_RATE_LIMIT" environment variable.
+	defaultCallbackRateLimit = 10
+
+	// defaultAlertInvalidThreshold is the number of invalid skylinks above
+	// which we alert unless overwritten by the
+	// "BLOCKER_ALERT_INVALID_THRESHOLD" environment variable.
+	defaultAlertInvalidThreshold = 10000
+
+	// defaultDBSlowQueryThreshold is the duration after which a database
+	// operation gets logged as slow unless overwritten by the
+	// "BLOCKER_DB_SLOW_QUERY_THRESHOLD" environment variable.
+	defaultDBSlowQueryThreshold = 500 * time.Millisecond
+
+	// defaultDBRetryWindow is the amount of time the database operations of
+	// the blocker and syncer loops are retried for during a primary failover
+	// unless overwritten by the "BLOCKER_DB_RETRY_WINDOW" environment
+	// variable.
+	defaultDBRetryWindow = 30 * time.Second
+
+	// defaultDBShedThreshold is the 95th percentile of the latency of
+	// database operations above which non-critical requests are shed unless
+	// overwritten by the "BLOCKER_DB_SHED_THRESHOLD" environment variable.
+	defaultDBShedThreshold = 2 * time.Second
+
+	// defaultDBShedAllThreshold is the 95th percentile of the latency of
+	// database operations above which all requests are shed unless
+	// overwritten by the "BLOCKER_DB_SHED_ALL_THRESHOLD" environment
+	// variable.
+	defaultDBShedAllThreshold = 10 * time.Second
+
+	// defaultListenAddr is the address the API listens on unless overwritten
+	// by the "BLOCKER_LISTEN_ADDR" environment variable.
+	defaultListenAddr = ":4000"
+
+	// defaultMode is the mode the blocker runs in unless overwritten by the
+	// "BLOCKER_MODE" environment variable.
+	defaultMode = ModeFull
+
+	// defaultLogFormat is the format in which the blocker logs unless
+	// overwritten by the "BLOCKER_LOG_FORMAT" environment variable.
+	defaultLogFormat = LogFormatText
+
+	// defaultLogLevel is the log level used unless overwritten by the
+	// "BLOCKER_LOG_LEVEL" environment variable.
+	defaultLogLevel = logrus.InfoLevel
+
+	// defaultPoWMaxDailyReports is the maximum number of skylinks a single
+	// MySkyID can report within the report window unless overwritten by the
+	// "BLOCKER_POW_MAX_DAILY_REPORTS" environment variable.
+	defaultPoWMaxDailyReports = 100
+
+	// defaultPoWMaxUses is the maximum number of times a single proof of work
+	// can be used unless overwritten by the "BLOCKER_POW_MAX_USES" environment
+	// variable.
+	defaultPoWMaxUses = 50
+
+	// defaultSkydHost is where we connect to skyd unless overwritten by the
+	// "API_HOST" environment variable.
+	defaultSkydHost = "sia"
+
+	// defaultSkydReadyTimeout is the maximum amount of time we wait for skyd
+	// to become ready on startup unless overwritten by the
+	// "BLOCKER_SKYD_READY_TIMEOUT" environment variable.
+	defaultSkydReadyTimeout = 5 * time.Minute
+
+	// defaultStopTimeout is the maximum amount of time we wait for the blocker
+	// and syncer to stop on shutdown unless overwritten by the
+	// "BLOCKER_STOP_TIMEOUT" environment variable.
+	defaultStopTimeout = time.Minute
+
+	// defaultSkydBatchTimeout is the amount of time we give skyd to block a
+	// batch of hashes unless overwritten by the "BLOCKER_SKYD_BATCH_TIMEOUT"
+	// environment variable.
+	defaultSkydBatchTimeout = 30 * time.Second
+
+	// defaultSkydMaxBatchBytes is the maximum size of the request that blocks
+	// a batch of hashes unless overwritten by the
+	// "BLOCKER_SKYD_MAX_BATCH_BYTES" environment variable.
+	defaultSkydMaxBatchBytes = 1 << 20
+
+	// defaultLagThreshold is the lag above which the blocker logs a warning
+	// unless overwritten by the "BLOCKER_LAG_THRESHOLD" environment variable.
+	defaultLagThreshold = 15 * time.Minute
+
+	// defaultRetryLimit is the maximum number of hashes the blocker retries
+	// per run of the retry loop unless overwritten by the
+	// "BLOCKER_RETRY_LIMIT" environment variable.
+	defaultRetryLimit = 1000
+
+	// defaultSkydPort is where we connect to skyd unless overwritten by the
+	// "API_PORT" environment variable.
+	defaultSkydPort = 9980
+
+	// fileSuffix is the suffix of the environment variables that point to a
+	// file containing the value of a secret.
+	fileSuffix = "_FILE"
+
+	// redacted is the value we print in place of secrets.
+	redacted = "[redacted]"
+)
+
+const (
+	// LogFormatJSON indicates the blocker logs JSON objects.
+	LogFormatJSON = "json"
+
+	// LogFormatText indicates the blocker logs plain text.
+	LogFormatText = "text"
+)
+
+const (
+	// ModeAggregator indicates the blocker runs without skyd, it only collects
+	// reports and serves the blocklist to other portals.
+	ModeAggregator = "aggregator"
+
+	// ModeFull indicates the blocker runs alongside skyd and blocks the
+	// reported skylinks in skyd.
+	ModeFull = "full"
+)
+
+// secretVars are the environment variables that can alternatively be provided
+// through a file, by setting the variable suffixed with "_FILE" to the path of
+// that file. This allows using secret mounts rather than exposing secrets in
+// the environment.
+var secretVars = []string{
+	"BLOCKER_ALERT_URL",
+	"BLOCKER_API_KEYS_CONFIG",
+	"BLOCKER_CALLBACK_SECRET",
+	"BLOCKER_POW_SECRET",
+	"BLOCKER_PUSH_PEERS",
+	"BLOCKER_REPORTER_SALT",
+	"BLOCKER_WEBHOOK_RULES",
+	"SIA_API_PASSWORD",
+	"SKYNET_DB_PASS",
+	"SKYNET_DB_USER",
+}
+
+// Config holds the configuration of the blocker, it is loaded from the
+// environment.
+type Config struct {
+	// ServerUID is a random string that uniquely identifies the server.
+	ServerUID string
+
+	// Mode is the mode the blocker runs in, either "full" or "aggregator".
+	Mode string
+
+	// LogLevel is the level at which the blocker logs.
+	LogLevel logrus.Level
+
+	// LogFormat is the format in which the blocker logs, either "json" or
+	// "text".
+	LogFormat string
+
+	// LogFile is the path of the file the blocker logs to, in addition to
+	// stderr. If it's empty, the blocker only logs to stderr.
+	LogFile string
+
+	// Debug enables the pprof and runtime debug endpoints on the API.
+	Debug bool
+
+	// ListenAddr is the address, in the form host:port, the API listens on.
+	ListenAddr string
+
+	// APIRole is the role of the API, either "read", "write" or "both". Read
+	// instances only serve the routes that read from the database and read
+	// from a secondary whenever possible. APIDisableListing disables the
+	// listing routes of write instances.
+	APIRole           string
+	APIDisableListing bool
+
+	// APIListingCacheControl is the Cache-Control header of the successful
+	// responses of the listing routes, e.g. the blocklist.
+	APIListingCacheControl string
+
+	// StopTimeout is the maximum amount of time we wait for the blocker and
+	// syncer to stop on shutdown.
+	StopTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile are the paths to the certificate and key
+	// used to serve the API over TLS, they're either both set or both empty.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// DBHost, DBPort, DBUser and DBPassword define how we connect to the
+	// database.
+	DBHost     string
+	DBPort     string
+	DBUser     string
+	DBPassword string
+
+	// DBSlowQueryThreshold is the duration after which a database operation
+	// gets logged as slow.
+	DBSlowQueryThreshold time.Duration
+
+	// DBRetryWindow is the amount of time the database operations of the
+	// blocker and syncer loops are retried for when they fail because the
+	// replica set is electing a new primary.
+	DBRetryWindow time.Duration
+
+	// DBInsertChunkSize is the maximum number of documents that get inserted
+	// at once when hashes are created in bulk, e.g. when syncing.
+	DBInsertChunkSize int
+
+	// DBShedThreshold and DBShedAllThreshold are the 95th percentiles of the
+	// latency of database operations above which the API rejects non-critical
+	// requests and all requests respectively.
+	DBShedThreshold    time.Duration
+	DBShedAllThreshold time.Duration
+
+	// DBIndexHidden indicates the indexes of the database schema are built
+	// hidden and only get unhidden once they're built.
+	DBIndexHidden bool
+
+	// DBIndexBuildTimeout is the maximum amount of time a single attempt at
+	// building an index may take, DBIndexBuildResumes is the number of times
+	// a build that exceeds it gets resumed before we give up on it.
+	DBIndexBuildTimeout time.Duration
+	DBIndexBuildResumes int
+
+	// Namespace is the namespace of the blocklist in the database, portals
+	// that share a database keep their blocklists apart by using different
+	// namespaces.
+	Namespace string
+
+	// SkydHost, SkydPort and SkydAPIPassword define how we connect to skyd.
+	SkydHost        string
+	SkydPort        int
+	SkydAPIPassword string
+
+	// SkydReadyTimeout is the maximum amount of time we wait for skyd to
+	// become ready on startup.
+	SkydReadyTimeout time.Duration
+
+	// SkydBatchTimeout is the amount of time we give skyd to block a batch
+	// of hashes.
+	SkydBatchTimeout time.Duration
+
+	// SkydMaxBatchBytes is the maximum size, in bytes, of the request that
+	// blocks a batch of hashes, batches are shrunk to stay within it.
+	SkydMaxBatchBytes int
+
+	// RetryLimit is the maximum number of hashes the blocker retries per run
+	// of the retry loop.
+	RetryLimit int
+
+	// BootstrapFromSkyd indicates a blocker that runs for the first time
+	// under its server UID initialises its latest block time from skyd's
+	// blocklist, rather than sending the entire blocklist to skyd.
+	BootstrapFromSkyd bool
+
+	// LagThreshold is the lag, being the time between a sweep of the blocker
+	// and the oldest report that's not blocked yet, above which the blocker
+	// logs a warning.
+	LagThreshold time.Duration
+
+	// Severities maps tags onto the severity of the reports that carry them,
+	// critical reports are blocked immediately and fire an alert.
+	Severities database.SeverityMapping
+
+	// AnonymizeReporters indicates the reporter's name, email and other
+	// contact are replaced with their salted digest before they're stored.
+	AnonymizeReporters bool
+
+	// ReporterSalt is the salt of the reporter digests, it's required when
+	// anonymizing reporters.
+	ReporterSalt []byte
+
+	// AllowListFailOpen indicates reports are accepted, and hashes blocked
+	// and synced, when the allow list can't be checked. By default they're
+	// rejected, which prevents blocking allowlisted content.
+	AllowListFailOpen bool
+
+	// PreflightCheck indicates new reports of skylinks are checked against
+	// skyd before they're stored, missing content gets blocked after the
+	// other reports.
+	PreflightCheck bool
+
+	// SuspicionMinReports and SuspicionBogusRatio are the thresholds above
+	// which reporters are flagged as suspicious, the API's defaults are used
+	// if they're zero.
+	SuspicionMinReports int
+	SuspicionBogusRatio float64
+
+	// ArchiveAge is the age, measured from the time they got reverted, after
+	// which reverted skylinks are moved to the archive by the /admin/archive
+	// endpoint.
+	ArchiveAge time.Duration
+
+	// StaleServerAge is the age after which the latest block timestamp of a
+	// server that stopped reporting it is pruned.
+	StaleServerAge time.Duration
+
+	// APIKeys are the API keys of trusted reporters, every key can be
+	// restricted to the set of tags it's allowed to apply.
+	APIKeys []api.APIKey
+
+	// AccountsHost and AccountsPort define how we reach the accounts service.
+	AccountsHost string
+	AccountsPort string
+
+	// PortalURLs are the portals we sync the blocklist with.
+	PortalURLs []string
+
+	// PortalIdentities pin the TLS certificate of the portals we sync with,
+	// or require them to sign their blocklist.
+	PortalIdentities []api.PortalIdentity
+
+	// OwnPortalURL is the url of the portal this blocker runs on, it is
+	// excluded from the portals we sync with and it's sent along with the
+	// reports we push to peers.
+	OwnPortalURL string
+
+	// PushPeers are the blockers we push new reports to, along with the API
+	// key we use to reach them.
+	PushPeers []pusher.Peer
+
+	// AlertURL is the url backlog alerts are POSTed to, if it's empty alerts
+	// are only logged.
+	AlertURL string
+
+	// WebhookRules route alerts about reports and the backlog to webhooks by
+	// their event, tags and severity.
+	WebhookRules []blocker.WebhookRule
+
+	// AlertFailedThreshold and AlertInvalidThreshold are the number of failed
+	// and invalid skylinks above which we alert.
+	AlertFailedThreshold  int
+	AlertInvalidThreshold int
+
+	// AlertCheckInterval is the amount of time between checks of the backlog.
+	AlertCheckInterval time.Duration
+
+	// AlertCooldown is the minimum amount of time between two alerts.
+	AlertCooldown time.Duration
+
+	// AuditInterval is the amount of time between audits of skyd's blocklist
+	// against the database, audits are disabled if it's zero.
+	AuditInterval time.Duration
+
+	// CallbackDomains are the domains reporters can be notified on once the
+	// hash they reported is blocked or found to be invalid, callbacks are
+	// disabled if it's empty. CallbackSecret is the secret the callbacks are
+	// signed with, it's required when callbacks are enabled.
+	CallbackDomains []string
+	CallbackSecret  string
+
+	// CallbackRateLimit is the maximum number of callbacks delivered to a
+	// single host within a minute.
+	CallbackRateLimit int
+
+	// Warnings contains the issues with the configuration that are not severe
+	// enough to prevent the blocker from starting, they should be logged.
+	Warnings []string
+
+	// PoWMaxUses is the maximum number of times a single proof of work can be
+	// used to report skylinks within the proof usage window.
+	PoWMaxUses int
+
+	// PoWMaxDailyReports is the maximum number of skylinks a single MySkyID
+	// can report within the report window.
+	PoWMaxDailyReports int
+
+	// PoWTrustedMySkyIDs is the set of MySkyIDs, hex encoded, that are exempt
+	// from the report limit.
+	PoWTrustedMySkyIDs map[string]struct{}
+
+	// PoWSecret is the secret used to sign PoW challenges, if it's empty the
+	// caller is expected to generate a random one.
+	PoWSecret []byte
+
+	// PoWResponseHash indicates the responses to PoW reports include the
+	// hash of the reported skylink, on top of its status.
+	PoWResponseHash bool
+
+	// PoWV1Deadline is the time after which v1 proofs are no longer accepted,
+	// if it's zero v1 proofs are always accepted.
+	PoWV1Deadline time.Time
+}
+
+// lookupFn is the signature of the function used to look up environment
+// variables, it matches os.LookupEnv.
+type lookupFn func(key string) (string, bool)
+
+// Load loads the configuration from the environment. If any of the
+// environment variables are missing or invalid, the returned error lists all
+// of them rather than only the first one.
+func Load() (Config, error) {
+	return load(os.LookupEnv)
+}
+
+// DBURI returns the connection string of the database.
+func (c Config) DBURI() string {
+	return fmt.Sprintf("mongodb://%v:%v", c.DBHost, c.DBPort)
+}
+
+// SkydURL returns the url on which we reach skyd.
+func (c Config) SkydURL() string {
+	return fmt.Sprintf("http://%s:%d", c.SkydHost, c.SkydPort)
+}
+
+// String returns a single line representation of the configuration, that is
+// safe to log, secrets are redacted.
+func (c Config) String() string {
+	v1Deadline := "none"
+	if !c.PoWV1Deadline.IsZero() {
+		v1Deadline = c.PoWV1Deadline.Format(time.RFC3339)
+	}
+
+	fields := []string{
+		fmt.Sprintf("ServerUID=%s", c.ServerUID),
+		fmt.Sprintf("Mode=%s", c.Mode),
+		fmt.Sprintf("LogLevel=%s", c.LogLevel),
+		fmt.Sprintf("LogFormat=%s", c.LogFormat),
+		fmt.Sprintf("LogFile=%s", c.LogFile),
+		fmt.Sprintf("Debug=%t", c.Debug),
+		fmt.Sprintf("ListenAddr=%s", c.ListenAddr),
+		fmt.Sprintf("APIRole=%s", c.APIRole),
+		fmt.Sprintf("APIDisableListing=%t", c.APIDisableListing),
+		fmt.Sprintf("APIListingCacheControl=%s", c.APIListingCacheControl),
+		fmt.Sprintf("StopTimeout=%v", c.StopTimeout),
+		fmt.Sprintf("TLS=%t", c.TLSCertFile != ""),
+		fmt.Sprintf("DB=%s", c.DBURI()),
+		fmt.Sprintf("DBUser=%s", c.DBUser),
+		fmt.Sprintf("DBPassword=%s", redact(c.DBPassword)),
+		fmt.Sprintf("DBSlowQueryThreshold=%v", c.DBSlowQueryThreshold),
+		fmt.Sprintf("DBRetryWindow=%v", c.DBRetryWindow),
+		fmt.Sprintf("DBInsertChunkSize=%d", c.DBInsertChunkSize),
+		fmt.Sprintf("DBShedThreshold=%v", c.DBShedThreshold),
+		fmt.Sprintf("DBShedAllThreshold=%v", c.DBShedAllThreshold),
+		fmt.Sprintf("DBIndexHidden=%t", c.DBIndexHidden),
+		fmt.Sprintf("DBIndexBuildTimeout=%v", c.DBIndexBuildTimeout),
+		fmt.Sprintf("DBIndexBuildResumes=%d", c.DBIndexBuildResumes),
+		fmt.Sprintf("Namespace=%s", c.Namespace),
+		fmt.Sprintf("Skyd=%s", c.SkydURL()),
+		fmt.Sprintf("SkydAPIPassword=%s", redact(c.SkydAPIPassword)),
+		fmt.Sprintf("SkydReadyTimeout=%v", c.SkydReadyTimeout),
+		fmt.Sprintf("SkydBatchTimeout=%v", c.SkydBatchTimeout),
+		fmt.Sprintf("SkydMaxBatchBytes=%d", c.SkydMaxBatchBytes),
+		fmt.Sprintf("RetryLimit=%d", c.RetryLimit),
+		fmt.Sprintf("BootstrapFromSkyd=%t", c.BootstrapFromSkyd),
+		fmt.Sprintf("LagThreshold=%v", c.LagThreshold),
+		fmt.Sprintf("Severities=%v", map[string]string(c.Severities)),
+		fmt.Sprintf("AnonymizeReporters=%t", c.AnonymizeReporters),
+		fmt.Sprintf("ReporterSalt=%s", redact(string(c.ReporterSalt))),
+		fmt.Sprintf("AllowListFailOpen=%t", c.AllowListFailOpen),
+		fmt.Sprintf("PreflightCheck=%t", c.PreflightCheck),
+		fmt.Sprintf("SuspicionMinReports=%d", c.SuspicionMinReports),
+		fmt.Sprintf("SuspicionBogusRatio=%v", c.SuspicionBogusRatio),
+		fmt.Sprintf("ArchiveAge=%v", c.ArchiveAge),
+		fmt.Sprintf("StaleServerAge=%v", c.StaleServerAge),
+		fmt.Sprintf("APIKeys=[%s]", strings.Join(apiKeyIDs(c.APIKeys), ",")),
+		fmt.Sprintf("Accounts=%s:%s", c.AccountsHost, c.AccountsPort),
+		fmt.Sprintf("PortalURLs=[%s]", strings.Join(c.PortalURLs, ",")),
+		fmt.Sprintf("PortalIdentities=[%s]", strings.Join(identityURLs(c.PortalIdentities), ",")),
+		fmt.Sprintf("OwnPortalURL=%s", c.OwnPortalURL),
+		fmt.Sprintf("PushPeers=[%s]", strings.Join(peerURLs(c.PushPeers), ",")),
+		fmt.Sprintf("AlertURL=%s", redact(c.AlertURL)),
+		fmt.Sprintf("WebhookRules=%d", len(c.WebhookRules)),
+		fmt.Sprintf("AlertFailedThreshold=%d", c.AlertFailedThreshold),
+		fmt.Sprintf("AlertInvalidThreshold=%d", c.AlertInvalidThreshold),
+		fmt.Sprintf("AlertCheckInterval=%v", c.AlertCheckInterval),
+		fmt.Sprintf("AlertCooldown=%v", c.AlertCooldown),
+		fmt.Sprintf("AuditInterval=%v", c.AuditInterval),
+		fmt.Sprintf("CallbackDomains=[%s]", strings.Join(c.CallbackDomains, ",")),
+		fmt.Sprintf("CallbackSecret=%s", redact(c.CallbackSecret)),
+		fmt.Sprintf("CallbackRateLimit=%d", c.CallbackRateLimit),
+		fmt.Sprintf("PoWMaxUses=%d", c.PoWMaxUses),
+		fmt.Sprintf("PoWMaxDailyReports=%d", c.PoWMaxDailyReports),
+		fmt.Sprintf("PoWTrustedMySkyIDs=%d", len(c.PoWTrustedMySkyIDs)),
+		fmt.Sprintf("PoWSecret=%s", redact(string(c.PoWSecret))),
+		fmt.Sprintf("PoWResponseHash=%t", c.PoWResponseHash),
+		fmt.Sprintf("PoWV1Deadline=%s", v1Deadline),
+	}
+	return strings.Join(fields, " ")
+}
+
+// load loads the configuration using the given lookup function, this allows
+// testing the parsing without touching the environment.
+func load(lookup lookupFn) (Config, error) {
+	cfg := Config{
+		Mode:                   defaultMode,
+		APIRole:                api.RoleBoth,
+		APIListingCacheControl: api.DefaultListingCacheControl,
+		LogLevel:               defaultLogLevel,
+		LogFormat:              defaultLogFormat,
+		ListenAddr:             defaultListenAddr,
+		StopTimeout:            defaultStopTimeout,
+		SkydHost:               defaultSkydHost,
+		SkydPort:               defaultSkydPort,
+		SkydReadyTimeout:       defaultSkydReadyTimeout,
+		SkydBatchTimeout:       defaultSkydBatchTimeout,
+		SkydMaxBatchBytes:      defaultSkydMaxBatchBytes,
+		RetryLimit:             defaultRetryLimit,
+		LagThreshold:           defaultLagThreshold,
+		Severities:             make(database.SeverityMapping),
+		DBSlowQueryThreshold:   defaultDBSlowQueryThreshold,
+		DBRetryWindow:          defaultDBRetryWindow,
+		DBInsertChunkSize:      database.DefaultInsertChunkSize,
+		DBShedThreshold:        defaultDBShedThreshold,
+		DBShedAllThreshold:     defaultDBShedAllThreshold,
+		DBIndexBuildTimeout:    database.DefaultIndexBuildTimeout,
+		ArchiveAge:             database.DefaultArchiveAge,
+		StaleServerAge:         database.DefaultStaleServerAge,
+		Namespace:              database.DefaultNamespace,
+		AccountsHost:           defaultAccountsHost,
+		AccountsPort:           defaultAccountsPort,
+		AlertFailedThreshold:   defaultAlertFailedThreshold,
+		AlertInvalidThreshold:  defaultAlertInvalidThreshold,
+		AlertCheckInterval:     defaultAlertCheckInterval,
+		AlertCooldown:          defaultAlertCooldown,
+		CallbackRateLimit:      defaultCallbackRateLimit,
+		PoWMaxUses:             defaultPoWMaxUses,
+		PoWMaxDailyReports:     defaultPoWMaxDailyReports,
+		PoWTrustedMySkyIDs:     make(map[string]struct{}),
+	}
+
+	// Resolve the secrets that are provided through files.
+	lookup, errs := lookupSecrets(lookup, secretVars)
+
+	required := func(key string, allowEmpty bool) string {
+		value, ok := lookup(key)
+		if !ok || (!allowEmpty && value == "") {
+			errs = append(errs, fmt.Errorf("missing env var %v", key))
+		}
+		return value
+	}
+	positiveInt := func(key string, dst *int) {
+		value, ok := lookup(key)
+		if !ok || value == "" {
+			return
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			errs = append(errs, fmt.Errorf("invalid env var %v, '%v' is not a positive integer", key, value))
+			return
+		}
+		*dst = n
+	}
+	positiveDuration := func(key string, dst *time.Duration) {
+		value, ok := lookup(key)
+		if !ok || value == "" {
+			return
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid env var %v, '%v' is not a positive duration", key, value))
+			return
+		}
+		*dst = d
+	}
+
+	// Server.
+	cfg.ServerUID = required("SERVER_UID", false)
+	if mode, ok := lookup("BLOCKER_MODE"); ok && mode != "" {
+		mode = strings.ToLower(mode)
+		if mode != ModeFull && mode != ModeAggregator {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_MODE, '%v' should be either '%v' or '%v'", mode, ModeFull, ModeAggregator))
+		} else {
+			cfg.Mode = mode
+		}
+	}
+	if level, ok := lookup("BLOCKER_LOG_LEVEL"); ok && level != "" {
+		logLevel, err := logrus.ParseLevel(level)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_LOG_LEVEL, %v", err))
+		} else {
+			cfg.LogLevel = logLevel
+		}
+	}
+	if format, ok := lookup("BLOCKER_LOG_FORMAT"); ok && format != "" {
+		format = strings.ToLower(format)
+		if format != LogFormatJSON && format != LogFormatText {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_LOG_FORMAT, '%v' should be either '%v' or '%v'", format, LogFormatJSON, LogFormatText))
+		} else {
+			cfg.LogFormat = format
+		}
+	}
+	cfg.LogFile, _ = lookup("BLOCKER_LOG_FILE")
+
+	// API.
+	if debug, ok := lookup("BLOCKER_DEBUG"); ok && debug != "" {
+		enabled, err := strconv.ParseBool(debug)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_DEBUG, '%v' is not a boolean", debug))
+		} else {
+			cfg.Debug = enabled
+		}
+	}
+	if addr, ok := lookup("BLOCKER_LISTEN_ADDR"); ok && addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_LISTEN_ADDR, '%v' is not of the form host:port", addr))
+		} else {
+			cfg.ListenAddr = addr
+		}
+	}
+	if role, ok := lookup("BLOCKER_API_ROLE"); ok && role != "" {
+		role = strings.ToLower(role)
+		if role != api.RoleRead && role != api.RoleWrite && role != api.RoleBoth {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_API_ROLE, '%v' should be either '%v', '%v' or '%v'", role, api.RoleRead, api.RoleWrite, api.RoleBoth))
+		} else {
+			cfg.APIRole = role
+		}
+	}
+	if disable, ok := lookup("BLOCKER_API_DISABLE_LISTING"); ok && disable != "" {
+		disabled, err := strconv.ParseBool(disable)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_API_DISABLE_LISTING, '%v' is not a boolean", disable))
+		} else if disabled && cfg.APIRole != api.RoleWrite {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_API_DISABLE_LISTING, listing can only be disabled if BLOCKER_API_ROLE is '%v'", api.RoleWrite))
+		} else {
+			cfg.APIDisableListing = disabled
+		}
+	}
+	if cacheControl, ok := lookup("BLOCKER_API_LISTING_CACHE_CONTROL"); ok && cacheControl != "" {
+		if strings.ContainsAny(cacheControl, "\r\n") {
+			errs = append(errs, errors.New("invalid env var BLOCKER_API_LISTING_CACHE_CONTROL, it can't contain line breaks"))
+		} else {
+			cfg.APIListingCacheControl = cacheControl
+		}
+	}
+	positiveDuration("BLOCKER_STOP_TIMEOUT", &cfg.StopTimeout)
+	cfg.TLSCertFile, _ = lookup("BLOCKER_TLS_CERT")
+	cfg.TLSKeyFile, _ = lookup("BLOCKER_TLS_KEY")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("invalid env var BLOCKER_TLS_CERT or BLOCKER_TLS_KEY, both have to be set to enable TLS"))
+	}
+
+	// Database.
+	cfg.DBUser = required("SKYNET_DB_USER", true)
+	cfg.DBPassword = required("SKYNET_DB_PASS", true)
+	cfg.DBHost = required("SKYNET_DB_HOST", true)
+	cfg.DBPort = required("SKYNET_DB_PORT", true)
+	positiveDuration("BLOCKER_DB_SLOW_QUERY_THRESHOLD", &cfg.DBSlowQueryThreshold)
+	positiveDuration("BLOCKER_DB_RETRY_WINDOW", &cfg.DBRetryWindow)
+	positiveInt("BLOCKER_DB_INSERT_CHUNK_SIZE", &cfg.DBInsertChunkSize)
+	positiveDuration("BLOCKER_DB_SHED_THRESHOLD", &cfg.DBShedThreshold)
+	positiveDuration("BLOCKER_DB_SHED_ALL_THRESHOLD", &cfg.DBShedAllThreshold)
+	if cfg.DBShedAllThreshold <= cfg.DBShedThreshold {
+		errs = append(errs, errors.New("invalid env var BLOCKER_DB_SHED_ALL_THRESHOLD, it has to exceed BLOCKER_DB_SHED_THRESHOLD"))
+	}
+	if hidden, ok := lookup("BLOCKER_DB_INDEX_HIDDEN"); ok && hidden != "" {
+		enabled, err := strconv.ParseBool(hidden)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_DB_INDEX_HIDDEN, '%v' is not a boolean", hidden))
+		} else {
+			cfg.DBIndexHidden = enabled
+		}
+	}
+	positiveDuration("BLOCKER_DB_INDEX_BUILD_TIMEOUT", &cfg.DBIndexBuildTimeout)
+	if resumes, ok := lookup("BLOCKER_DB_INDEX_BUILD_RESUMES"); ok && resumes != "" {
+		n, err := strconv.Atoi(resumes)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_DB_INDEX_BUILD_RESUMES, '%v' is not a non-negative integer", resumes))
+		} else {
+			cfg.DBIndexBuildResumes = n
+		}
+	}
+	if namespace, ok := lookup("BLOCKER_NAMESPACE"); ok && namespace != "" {
+		if err := database.ValidateNamespace(namespace); err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_NAMESPACE, %v", err))
+		} else {
+			cfg.Namespace = namespace
+		}
+	}
+
+	// Skyd.
+	if host, ok := lookup("API_HOST"); ok && host != "" {
+		cfg.SkydHost = host
+	}
+	positiveInt("API_PORT", &cfg.SkydPort)
+	positiveDuration("BLOCKER_SKYD_READY_TIMEOUT", &cfg.SkydReadyTimeout)
+	positiveDuration("BLOCKER_SKYD_BATCH_TIMEOUT", &cfg.SkydBatchTimeout)
+	positiveInt("BLOCKER_SKYD_MAX_BATCH_BYTES", &cfg.SkydMaxBatchBytes)
+	positiveInt("BLOCKER_RETRY_LIMIT", &cfg.RetryLimit)
+	if bootstrap, ok := lookup("BLOCKER_BOOTSTRAP_FROM_SKYD"); ok && bootstrap != "" {
+		enabled, err := strconv.ParseBool(bootstrap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_BOOTSTRAP_FROM_SKYD, '%v' is not a boolean", bootstrap))
+		} else {
+			cfg.BootstrapFromSkyd = enabled
+		}
+	}
+	positiveDuration("BLOCKER_LAG_THRESHOLD", &cfg.LagThreshold)
+	if severities, ok := lookup("BLOCKER_SEVERITIES"); ok && severities != "" {
+		var m map[string]string
+		err := json.Unmarshal([]byte(severities), &m)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_SEVERITIES, '%v' is not a JSON object mapping tags onto severities", severities))
+		} else if mapping, err := database.NewSeverityMapping(m); err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_SEVERITIES, %v", err))
+		} else {
+			cfg.Severities = mapping
+		}
+	}
+	if cfg.Mode == ModeAggregator {
+		cfg.SkydAPIPassword, _ = lookup("SIA_API_PASSWORD")
+	} else {
+		cfg.SkydAPIPassword = required("SIA_API_PASSWORD", false)
+	}
+
+	// Reporters.
+	if anonymize, ok := lookup("BLOCKER_ANONYMIZE_REPORTERS"); ok && anonymize != "" {
+		enabled, err := strconv.ParseBool(anonymize)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_ANONYMIZE_REPORTERS, '%v' is not a boolean", anonymize))
+		} else {
+			cfg.AnonymizeReporters = enabled
+		}
+	}
+	if cfg.AnonymizeReporters {
+		cfg.ReporterSalt = []byte(required("BLOCKER_REPORTER_SALT", false))
+	} else if salt, ok := lookup("BLOCKER_REPORTER_SALT"); ok && salt != "" {
+		cfg.ReporterSalt = []byte(salt)
+	}
+	if failOpen, ok := lookup("BLOCKER_ALLOWLIST_FAIL_OPEN"); ok && failOpen != "" {
+		enabled, err := strconv.ParseBool(failOpen)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_ALLOWLIST_FAIL_OPEN, '%v' is not a boolean", failOpen))
+		} else {
+			cfg.AllowListFailOpen = enabled
+		}
+	}
+	if preflight, ok := lookup("BLOCKER_PREFLIGHT_CHECK"); ok && preflight != "" {
+		enabled, err := strconv.ParseBool(preflight)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_PREFLIGHT_CHECK, '%v' is not a boolean", preflight))
+		} else {
+			cfg.PreflightCheck = enabled
+		}
+	}
+	positiveInt("BLOCKER_SUSPICION_MIN_REPORTS", &cfg.SuspicionMinReports)
+	if ratio, ok := lookup("BLOCKER_SUSPICION_BOGUS_RATIO"); ok && ratio != "" {
+		r, err := strconv.ParseFloat(ratio, 64)
+		if err != nil || r <= 0 || r > 1 {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_SUSPICION_BOGUS_RATIO, '%v' is not a ratio between 0 and 1", ratio))
+		} else {
+			cfg.SuspicionBogusRatio = r
+		}
+	}
+	positiveDuration("BLOCKER_ARCHIVE_AGE", &cfg.ArchiveAge)
+	positiveDuration("BLOCKER_STALE_SERVER_AGE", &cfg.StaleServerAge)
+	if keys, ok := lookup("BLOCKER_API_KEYS_CONFIG"); ok && keys != "" {
+		apiKeys, err := parseAPIKeys(keys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_API_KEYS_CONFIG, %v", err))
+		} else {
+			cfg.APIKeys = apiKeys
+		}
+	}
+
+	// Accounts.
+	if host, ok := lookup("SKYNET_ACCOUNTS_HOST"); ok && host != "" {
+		cfg.AccountsHost = host
+	}
+	if port, ok := lookup("SKYNET_ACCOUNTS_PORT"); ok && port != "" {
+		cfg.AccountsPort = port
+	}
+
+	// Syncer.
+	if own, ok := lookup("BLOCKER_OWN_PORTAL_URL"); ok && own != "" {
+		cfg.OwnPortalURL = sanitizePortalURL(own)
+		if err := validatePortalURL(cfg.OwnPortalURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_OWN_PORTAL_URL, %v", err))
+		}
+	}
+	portals, _ := lookup("BLOCKER_PORTALS_SYNC")
+	portalURLs, warnings, err := parsePortalURLs(portals, cfg.OwnPortalURL)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid env var BLOCKER_PORTALS_SYNC, %v", err))
+	}
+	cfg.PortalURLs = portalURLs
+	cfg.Warnings = append(cfg.Warnings, warnings...)
+	if identities, ok := lookup("BLOCKER_PORTALS_SYNC_IDENTITIES"); ok && identities != "" {
+		portalIdentities, err := parsePortalIdentities(identities, cfg.PortalURLs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_PORTALS_SYNC_IDENTITIES, %v", err))
+		} else {
+			cfg.PortalIdentities = portalIdentities
+		}
+	}
+
+	// Pusher.
+	if peers, ok := lookup("BLOCKER_PUSH_PEERS"); ok && peers != "" {
+		pushPeers, err := parsePushPeers(peers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_PUSH_PEERS, %v", err))
+		} else if cfg.OwnPortalURL == "" {
+			errs = append(errs, errors.New("missing env var BLOCKER_OWN_PORTAL_URL, it's required to push reports to peers"))
+		} else {
+			cfg.PushPeers = pushPeers
+		}
+	}
+
+	// Alerts.
+	if alertURL, ok := lookup("BLOCKER_ALERT_URL"); ok && alertURL != "" {
+		if err := validateAlertURL(alertURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_ALERT_URL, %v", err))
+		} else {
+			cfg.AlertURL = alertURL
+		}
+	}
+	if rules, ok := lookup("BLOCKER_WEBHOOK_RULES"); ok && rules != "" {
+		webhookRules, err := parseWebhookRules(rules)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_WEBHOOK_RULES, %v", err))
+		} else {
+			cfg.WebhookRules = webhookRules
+		}
+	}
+	positiveInt("BLOCKER_ALERT_FAILED_THRESHOLD", &cfg.AlertFailedThreshold)
+	positiveInt("BLOCKER_ALERT_INVALID_THRESHOLD", &cfg.AlertInvalidThreshold)
+	positiveDuration("BLOCKER_ALERT_CHECK_INTERVAL", &cfg.AlertCheckInterval)
+	positiveDuration("BLOCKER_ALERT_COOLDOWN", &cfg.AlertCooldown)
+
+	// Audits, they are opt-in.
+	positiveDuration("BLOCKER_AUDIT_INTERVAL", &cfg.AuditInterval)
+
+	// Callbacks, they are opt-in.
+	domains, _ := lookup("BLOCKER_CALLBACK_DOMAINS")
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.ContainsAny(domain, "/:@") {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_CALLBACK_DOMAINS, '%v' is not a hostname", domain))
+			continue
+		}
+		cfg.CallbackDomains = append(cfg.CallbackDomains, domain)
+	}
+	if len(cfg.CallbackDomains) > 0 {
+		cfg.CallbackSecret = required("BLOCKER_CALLBACK_SECRET", false)
+	}
+	positiveInt("BLOCKER_CALLBACK_RATE_LIMIT", &cfg.CallbackRateLimit)
+
+	// PoW.
+	positiveInt("BLOCKER_POW_MAX_USES", &cfg.PoWMaxUses)
+	positiveInt("BLOCKER_POW_MAX_DAILY_REPORTS", &cfg.PoWMaxDailyReports)
+	trusted, _ := lookup("BLOCKER_POW_TRUSTED_MYSKYIDS")
+	for _, id := range strings.Split(trusted, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id != "" {
+			cfg.PoWTrustedMySkyIDs[id] = struct{}{}
+		}
+	}
+	if secret, ok := lookup("BLOCKER_POW_SECRET"); ok && secret != "" {
+		cfg.PoWSecret = []byte(secret)
+	}
+	if deadline, ok := lookup("BLOCKER_POW_V1_DEADLINE"); ok && deadline != "" {
+		t, err := time.Parse(time.RFC3339, deadline)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_POW_V1_DEADLINE, '%v' is not an RFC3339 timestamp", deadline))
+		} else {
+			cfg.PoWV1Deadline = t
+		}
+	}
+	if responseHash, ok := lookup("BLOCKER_POW_RESPONSE_HASH"); ok && responseHash != "" {
+		enabled, err := strconv.ParseBool(responseHash)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid env var BLOCKER_POW_RESPONSE_HASH, '%v' is not a boolean", responseHash))
+		} else {
+			cfg.PoWResponseHash = enabled
+		}
+	}
+
+	if len(errs) > 0 {
+		return Config{}, errors.AddContext(errors.Compose(errs...), "invalid configuration")
+	}
+	return cfg, nil
+}
+
+// lookupSecrets returns a lookup function that resolves the given secret
+// variables from the file their "_FILE" variant points to, if it is set. The
+// file contents are trimmed of surrounding whitespace. It returns an error for
+// every secret that is set both directly and through a file, and for every file
+// that can't be read.
+func lookupSecrets(lookup lookupFn, keys []string) (lookupFn, []error) {
+	var errs []error
+	secrets := make(map[string]string)
+	for _, key := range keys {
+		path, ok := lookup(key + fileSuffix)
+		if !ok || path == "" {
+			continue
+		}
+		if value, ok := lookup(key); ok && value != "" {
+			errs = append(errs, fmt.Errorf("both %v and %v%v are set, only one of them is allowed", key, key, fileSuffix))
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read secret file from %v%v, %v", key, fileSuffix, err))
+			continue
+		}
+		secrets[key] = strings.TrimSpace(string(b))
+	}
+	return func(key string) (string, bool) {
+		if value, ok := secrets[key]; ok {
+			return value, true
+		}
+		return lookup(key)
+	}, errs
+}
+
+// parsePortalURLs parses the given comma separated list of portal urls, the
+// blocker will keep in sync the blocklist from these portals with the local
+// skyd instance. Invalid urls, duplicates and the given url of our own portal
+// are dropped, for every dropped url a warning is returned. It returns an error
+// if portals were configured but all of them were dropped.
+func parsePortalURLs(portalURLStr, ownPortalURL string) (portalURLs []string, warnings []string, err error) {
+	seen := make(map[string]struct{})
+	if ownPortalURL != "" {
+		seen[strings.ToLower(ownPortalURL)] = struct{}{}
+	}
+
+	var numConfigured int
+	for _, portalURL := range strings.Split(portalURLStr, ",") {
+		portalURL = sanitizePortalURL(portalURL)
+		if portalURL == "" {
+			continue
+		}
+		numConfigured++
+
+		if err := validatePortalURL(portalURL); err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring portal url '%v', %v", portalURL, err))
+			continue
+		}
+		key := strings.ToLower(portalURL)
+		if ownPortalURL != "" && key == strings.ToLower(ownPortalURL) {
+			warnings = append(warnings, fmt.Sprintf("ignoring portal url '%v', it's our own portal", portalURL))
+			continue
+		}
+		if _, exists := seen[key]; exists {
+			warnings = append(warnings, fmt.Sprintf("ignoring portal url '%v', it's a duplicate", portalURL))
+			continue
+		}
+		seen[key] = struct{}{}
+		portalURLs = append(portalURLs, portalURL)
+	}
+
+	if numConfigured > 0 && len(portalURLs) == 0 {
+		return nil, warnings, fmt.Errorf("all %v configured portal urls were rejected", numConfigured)
+	}
+	return portalURLs, warnings, nil
+}
+
+// parsePortalIdentities parses the given JSON array of portal identities, e.g.
+// '[{"url":"https://siasky.net","tlsFingerprint":"ab12...","publicKey":"cd34..."}]'.
+// Every identity needs to belong to one of the given portals we sync with,
+// and at most one identity can be defined per portal.
+func parsePortalIdentities(identitiesStr string, portalURLs []string) ([]api.PortalIdentity, error) {
+	var identities []api.PortalIdentity
+	err := json.Unmarshal([]byte(identitiesStr), &identities)
+	if err != nil {
+		return nil, errors.New("not a JSON array of portal identities with a 'url' and a 'tlsFingerprint' or a 'publicKey'")
+	}
+	portals := make(map[string]string, len(portalURLs))
+	for _, portalURL := range portalURLs {
+		portals[strings.ToLower(portalURL)] = portalURL
+	}
+	seen := make(map[string]struct{})
+	for i, identity := range identities {
+		key := strings.ToLower(sanitizePortalURL(identity.URL))
+		portalURL, exists := portals[key]
+		if !exists {
+			return nil, fmt.Errorf("portal '%v' is not one of the portals we sync with", identity.URL)
+		}
+		if _, exists := seen[key]; exists {
+			return nil, fmt.Errorf("portal '%v' has more than one identity", identity.URL)
+		}
+		seen[key] = struct{}{}
+		identity.URL = portalURL
+		if err := identity.Validate(); err != nil {
+			return nil, err
+		}
+		identities[i] = identity
+	}
+	return identities, nil
+}
+
+// parsePushPeers parses the given JSON array of peers, e.g.
+// '[{"url":"https://blocker.example.com","apiKey":"key"}]'. Every peer needs a
+// valid http or https url, duplicates are not allowed.
+func parsePushPeers(peersStr string) ([]pusher.Peer, error) {
+	var peers []pusher.Peer
+	err := json.Unmarshal([]byte(peersStr), &peers)
+	if err != nil {
+		return nil, errors.New("not a JSON array of peers with a 'url' and an 'apiKey'")
+	}
+	seen := make(map[string]struct{})
+	for i, peer := range peers {
+		peer.URL = strings.TrimSuffix(strings.TrimSpace(peer.URL), "/")
+		if err := validateAlertURL(peer.URL); err != nil {
+			return nil, fmt.Errorf("invalid peer url '%v', %v", peer.URL, err)
+		}
+		key := strings.ToLower(peer.URL)
+		if _, exists := seen[key]; exists {
+			return nil, fmt.Errorf("peer url '%v' is a duplicate", peer.URL)
+		}
+		seen[key] = struct{}{}
+		peers[i] = peer
+	}
+	return peers, nil
+}
+
+// parseAPIKeys parses the given JSON array of API keys, e.g.
+// '[{"id":"scanner","key":"secret","tags":["malware"]}]'. Every key needs an id
+// and a key, neither of which can be a duplicate. Keys without tags are not
+// restricted, keys with 'admin' set grant access to the admin endpoints.
+func parseAPIKeys(keysStr string) ([]api.APIKey, error) {
+	var keys []api.APIKey
+	err := json.Unmarshal([]byte(keysStr), &keys)
+	if err != nil {
+		return nil, errors.New("not a JSON array of API keys with an 'id', a 'key' and optionally 'tags' and 'admin'")
+	}
+	ids := make(map[string]struct{})
+	secrets := make(map[string]struct{})
+	for i, key := range keys {
+		key.ID = strings.TrimSpace(key.ID)
+		if key.ID == "" || key.Key == "" {
+			return nil, fmt.Errorf("API key %d is missing an 'id' or a 'key'", i)
+		}
+		if _, exists := ids[key.ID]; exists {
+			return nil, fmt.Errorf("API key id '%v' is a duplicate", key.ID)
+		}
+		if _, exists := secrets[key.Key]; exists {
+			return nil, fmt.Errorf("API key '%v' is a duplicate of another key", key.ID)
+		}
+		for _, tag := range key.Tags {
+			if strings.TrimSpace(tag) == "" {
+				return nil, fmt.Errorf("API key '%v' contains an empty tag", key.ID)
+			}
+		}
+		ids[key.ID] = struct{}{}
+		secrets[key.Key] = struct{}{}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// parseWebhookRules parses the given JSON array of webhook rules, e.g.
+// '[{"urls":["https://hooks.example.com/csam"],"tags":["csam"]}]'. Every rule
+// needs at least one url, see blocker.WebhookRule.
+func parseWebhookRules(rulesStr string) ([]blocker.WebhookRule, error) {
+	var rules []blocker.WebhookRule
+	err := json.Unmarshal([]byte(rulesStr), &rules)
+	if err != nil {
+		return nil, errors.New("not a JSON array of webhook rules with 'urls' and optionally 'tags', 'minSeverity' and 'events'")
+	}
+	for i, rule := range rules {
+		err = rule.Validate()
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("webhook rule %d", i))
+		}
+	}
+	return rules, nil
+}
+
+// apiKeyIDs returns the ids of the given API keys, it allows logging the keys
+// without their secrets.
+func apiKeyIDs(keys []api.APIKey) []string {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// identityURLs returns the urls of the portals of the given identities.
+func identityURLs(identities []api.PortalIdentity) []string {
+	urls := make([]string, len(identities))
+	for i, identity := range identities {
+		urls[i] = identity.URL
+	}
+	return urls
+}
+
+// peerURLs returns the urls of the given peers, it allows logging the peers
+// without their API keys.
+func peerURLs(peers []pusher.Peer) []string {
+	urls := make([]string, len(peers))
+	for i, peer := range peers {
+		urls[i] = peer.URL
+	}
+	return urls
+}
+
+// redact returns a placeholder for the given secret, it distinguishes between
+// secrets that are set and secrets that are not.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// validatePortalURL returns an error if the given, sanitized, portal url is
+// obviously broken. The host has to contain at least one dot, unless it's
+// localhost.
+func validatePortalURL(portalURL string) error {
+	u, err := url.Parse(portalURL)
+	if err != nil {
+		return errors.AddContext(err, "failed to parse url")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("url has no host")
+	}
+	if !strings.Contains(host, ".") && !strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("host '%v' is not a domain", host)
+	}
+	return nil
+}
+
+// sanitizePortalURL is a helper function that sanitizes the given input portal
+// URL, stripping away trailing slashes and ensuring it's prefixed with https.
+func sanitizePortalURL(portalURL string) string {
+	portalURL = strings.TrimSpace(portalURL)
+	portalURL = strings.TrimSuffix(portalURL, "/")
+	if strings.HasPrefix(portalURL, "https://") {
+		return portalURL
+	}
+	portalURL = strings.TrimPrefix(portalURL, "http://")
+	if portalURL == "" {
+		return portalURL
+	}
+	return fmt.Sprintf("https://%s", portalURL)
+}
+
+// validateAlertURL returns an error if the given alert url is not an absolute
+// http or https url.
+func validateAlertURL(alertURL string) error {
+	u, err := url.Parse(alertURL)
+	if err != nil {
+		return errors.AddContext(err, "failed to parse url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%v'", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("url has no host")
+	}
+	return nil
+}
@@ -0,0 +1,834 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// requiredEnv is a set of environment variables that contains all required
+// variables.
+var requiredEnv = map[string]string{
+	"SERVER_UID":       "94743e8e2673a176",
+	"SKYNET_DB_USER":   "SKYNET_DB_USER",
+	"SKYNET_DB_PASS":   "SKYNET_DB_PASS",
+	"SKYNET_DB_HOST":   "SKYNET_DB_HOST",
+	"SKYNET_DB_PORT":   "SKYNET_DB_PORT",
+	"SIA_API_PASSWORD": "SIA_API_PASSWORD",
+}
+
+// TestConfig runs the config tests
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "Defaults",
+			test: testDefaults,
+		},
+		{
+			name: "Overrides",
+			test: testOverrides,
+		},
+		{
+			name: "Missing",
+			test: testMissing,
+		},
+		{
+			name: "Invalid",
+			test: testInvalid,
+		},
+		{
+			name: "SecretFiles",
+			test: testSecretFiles,
+		},
+		{
+			name: "String",
+			test: testString,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.test)
+	}
+}
+
+// testDefaults verifies the defaults are used when only the required variables
+// are set.
+func testDefaults(t *testing.T) {
+	cfg, err := load(lookupMap(requiredEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerUID != "94743e8e2673a176" {
+		t.Fatal("unexpected", cfg.ServerUID)
+	}
+	if cfg.DBUser != "SKYNET_DB_USER" || cfg.DBPassword != "SKYNET_DB_PASS" {
+		t.Fatal("unexpected", cfg.DBUser, cfg.DBPassword)
+	}
+	if cfg.DBURI() != "mongodb://SKYNET_DB_HOST:SKYNET_DB_PORT" {
+		t.Fatal("unexpected", cfg.DBURI())
+	}
+	if cfg.SkydURL() != "http://sia:9980" {
+		t.Fatal("unexpected", cfg.SkydURL())
+	}
+	if cfg.SkydReadyTimeout != 5*time.Minute {
+		t.Fatal("unexpected", cfg.SkydReadyTimeout)
+	}
+	if cfg.SkydBatchTimeout != 30*time.Second || cfg.SkydMaxBatchBytes != 1<<20 {
+		t.Fatal("unexpected", cfg.SkydBatchTimeout, cfg.SkydMaxBatchBytes)
+	}
+	if cfg.RetryLimit != 1000 || cfg.LagThreshold != 15*time.Minute {
+		t.Fatal("unexpected", cfg.RetryLimit, cfg.LagThreshold)
+	}
+	if cfg.BootstrapFromSkyd {
+		t.Fatal("unexpected", cfg.BootstrapFromSkyd)
+	}
+	if len(cfg.Severities) != 0 {
+		t.Fatal("unexpected", cfg.Severities)
+	}
+	if cfg.DBSlowQueryThreshold != 500*time.Millisecond || cfg.DBRetryWindow != 30*time.Second {
+		t.Fatal("unexpected", cfg.DBSlowQueryThreshold, cfg.DBRetryWindow)
+	}
+	if cfg.DBInsertChunkSize != database.DefaultInsertChunkSize {
+		t.Fatal("unexpected", cfg.DBInsertChunkSize)
+	}
+	if cfg.DBShedThreshold != 2*time.Second || cfg.DBShedAllThreshold != 10*time.Second {
+		t.Fatal("unexpected", cfg.DBShedThreshold, cfg.DBShedAllThreshold)
+	}
+	if cfg.DBIndexHidden || cfg.DBIndexBuildTimeout != database.DefaultIndexBuildTimeout || cfg.DBIndexBuildResumes != 0 {
+		t.Fatal("unexpected", cfg.DBIndexHidden, cfg.DBIndexBuildTimeout, cfg.DBIndexBuildResumes)
+	}
+	if cfg.Namespace != database.DefaultNamespace {
+		t.Fatal("unexpected", cfg.Namespace)
+	}
+	if cfg.AccountsHost != defaultAccountsHost || cfg.AccountsPort != defaultAccountsPort {
+		t.Fatal("unexpected", cfg.AccountsHost, cfg.AccountsPort)
+	}
+	if cfg.AlertURL != "" || cfg.AlertFailedThreshold != defaultAlertFailedThreshold || cfg.AlertInvalidThreshold != defaultAlertInvalidThreshold {
+		t.Fatal("unexpected", cfg.AlertURL, cfg.AlertFailedThreshold, cfg.AlertInvalidThreshold)
+	}
+	if cfg.WebhookRules != nil {
+		t.Fatal("unexpected", cfg.WebhookRules)
+	}
+	if cfg.AlertCheckInterval != 5*time.Minute || cfg.AlertCooldown != time.Hour {
+		t.Fatal("unexpected", cfg.AlertCheckInterval, cfg.AlertCooldown)
+	}
+	if cfg.AuditInterval != 0 {
+		t.Fatal("unexpected", cfg.AuditInterval)
+	}
+	if len(cfg.CallbackDomains) != 0 || cfg.CallbackSecret != "" || cfg.CallbackRateLimit != defaultCallbackRateLimit {
+		t.Fatal("unexpected", cfg.CallbackDomains, cfg.CallbackSecret, cfg.CallbackRateLimit)
+	}
+	if cfg.LogLevel != logrus.InfoLevel {
+		t.Fatal("unexpected", cfg.LogLevel)
+	}
+	if cfg.Mode != ModeFull || cfg.Debug {
+		t.Fatal("unexpected", cfg.Mode, cfg.Debug)
+	}
+	if cfg.APIRole != api.RoleBoth || cfg.APIDisableListing {
+		t.Fatal("unexpected", cfg.APIRole, cfg.APIDisableListing)
+	}
+	if cfg.APIListingCacheControl != api.DefaultListingCacheControl {
+		t.Fatal("unexpected", cfg.APIListingCacheControl)
+	}
+	if cfg.AllowListFailOpen || cfg.PreflightCheck {
+		t.Fatal("unexpected", cfg.AllowListFailOpen, cfg.PreflightCheck)
+	}
+	if cfg.SuspicionMinReports != 0 || cfg.SuspicionBogusRatio != 0 {
+		t.Fatal("unexpected", cfg.SuspicionMinReports, cfg.SuspicionBogusRatio)
+	}
+	if cfg.ArchiveAge != database.DefaultArchiveAge {
+		t.Fatal("unexpected", cfg.ArchiveAge)
+	}
+	if cfg.StaleServerAge != database.DefaultStaleServerAge {
+		t.Fatal("unexpected", cfg.StaleServerAge)
+	}
+	if cfg.LogFormat != LogFormatText || cfg.LogFile != "" {
+		t.Fatal("unexpected", cfg.LogFormat, cfg.LogFile)
+	}
+	if cfg.ListenAddr != ":4000" || cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		t.Fatal("unexpected", cfg.ListenAddr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	if cfg.StopTimeout != time.Minute {
+		t.Fatal("unexpected", cfg.StopTimeout)
+	}
+	if len(cfg.PortalURLs) != 0 {
+		t.Fatal("unexpected", cfg.PortalURLs)
+	}
+	if len(cfg.PortalIdentities) != 0 {
+		t.Fatal("unexpected", cfg.PortalIdentities)
+	}
+	if cfg.PoWMaxUses != defaultPoWMaxUses || cfg.PoWMaxDailyReports != defaultPoWMaxDailyReports {
+		t.Fatal("unexpected", cfg.PoWMaxUses, cfg.PoWMaxDailyReports)
+	}
+	if len(cfg.PoWTrustedMySkyIDs) != 0 || len(cfg.PoWSecret) != 0 || !cfg.PoWV1Deadline.IsZero() || cfg.PoWResponseHash {
+		t.Fatal("unexpected PoW config", cfg)
+	}
+}
+
+// testOverrides verifies optional variables overwrite the defaults.
+func testOverrides(t *testing.T) {
+	env := withEnv(requiredEnv, map[string]string{
+		"API_HOST":                          "localhost",
+		"API_PORT":                          "9990",
+		"BLOCKER_SKYD_READY_TIMEOUT":        "90s",
+		"BLOCKER_SKYD_BATCH_TIMEOUT":        "1m",
+		"BLOCKER_SKYD_MAX_BATCH_BYTES":      "4096",
+		"BLOCKER_RETRY_LIMIT":               "250",
+		"BLOCKER_BOOTSTRAP_FROM_SKYD":       "true",
+		"BLOCKER_LAG_THRESHOLD":             "5m",
+		"BLOCKER_SEVERITIES":                `{"CSAM": "Critical", "malware": "high"}`,
+		"BLOCKER_DB_SLOW_QUERY_THRESHOLD":   "2s",
+		"BLOCKER_DB_RETRY_WINDOW":           "1m",
+		"BLOCKER_DB_INSERT_CHUNK_SIZE":      "500",
+		"BLOCKER_DB_SHED_THRESHOLD":         "5s",
+		"BLOCKER_DB_SHED_ALL_THRESHOLD":     "20s",
+		"BLOCKER_DB_INDEX_HIDDEN":           "true",
+		"BLOCKER_DB_INDEX_BUILD_TIMEOUT":    "10m",
+		"BLOCKER_DB_INDEX_BUILD_RESUMES":    "3",
+		"BLOCKER_NAMESPACE":                 "eu-portal",
+		"BLOCKER_ANONYMIZE_REPORTERS":       "true",
+		"BLOCKER_REPORTER_SALT":             "salt",
+		"BLOCKER_ALLOWLIST_FAIL_OPEN":       "true",
+		"BLOCKER_PREFLIGHT_CHECK":           "true",
+		"BLOCKER_SUSPICION_MIN_REPORTS":     "25",
+		"BLOCKER_SUSPICION_BOGUS_RATIO":     "0.8",
+		"BLOCKER_ARCHIVE_AGE":               "720h",
+		"BLOCKER_STALE_SERVER_AGE":          "1440h",
+		"BLOCKER_API_KEYS_CONFIG":           `[{"id": "scanner", "key": "key", "tags": ["malware"]}, {"id": "abuse", "key": "other"}]`,
+		"SKYNET_ACCOUNTS_HOST":              "127.0.0.1",
+		"SKYNET_ACCOUNTS_PORT":              "3001",
+		"BLOCKER_LOG_LEVEL":                 "debug",
+		"BLOCKER_LOG_FORMAT":                "JSON",
+		"BLOCKER_LOG_FILE":                  "/var/log/blocker.log",
+		"BLOCKER_LISTEN_ADDR":               "127.0.0.1:4001",
+		"BLOCKER_API_ROLE":                  "Write",
+		"BLOCKER_API_DISABLE_LISTING":       "true",
+		"BLOCKER_API_LISTING_CACHE_CONTROL": "public, max-age=60",
+		"BLOCKER_STOP_TIMEOUT":              "5s",
+		"BLOCKER_DEBUG":                     "true",
+		"BLOCKER_TLS_CERT":                  "cert.pem",
+		"BLOCKER_TLS_KEY":                   "key.pem",
+		"BLOCKER_PORTALS_SYNC":              "siasky.net/, skyportal.xyz,,",
+		"BLOCKER_PORTALS_SYNC_IDENTITIES":   `[{"url": "https://SiaSky.net/", "publicKey": "` + strings.Repeat("ab", 32) + `"}]`,
+		"BLOCKER_OWN_PORTAL_URL":            "portal.example.com",
+		"BLOCKER_PUSH_PEERS":                `[{"url": "https://blocker.siasky.net/", "apiKey": "key"}]`,
+		"BLOCKER_POW_MAX_USES":              "10",
+		"BLOCKER_POW_MAX_DAILY_REPORTS":     "20",
+		"BLOCKER_POW_TRUSTED_MYSKYIDS":      " ABCD ,ef01,",
+		"BLOCKER_POW_SECRET":                "secret",
+		"BLOCKER_POW_V1_DEADLINE":           "2022-06-01T00:00:00Z",
+		"BLOCKER_POW_RESPONSE_HASH":         "true",
+		"BLOCKER_ALERT_URL":                 "https://alerts.example.com/hook",
+		"BLOCKER_WEBHOOK_RULES":             `[{"urls": ["https://hooks.example.com/csam"], "tags": ["csam"]}, {"urls": ["https://hooks.example.com/moderation"], "minSeverity": "high", "events": ["report"]}]`,
+		"BLOCKER_ALERT_FAILED_THRESHOLD":    "50",
+		"BLOCKER_ALERT_INVALID_THRESHOLD":   "500",
+		"BLOCKER_ALERT_CHECK_INTERVAL":      "1m",
+		"BLOCKER_ALERT_COOLDOWN":            "30m",
+		"BLOCKER_AUDIT_INTERVAL":            "24h",
+		"BLOCKER_CALLBACK_DOMAINS":          " Example.com, abuse.example.org ,",
+		"BLOCKER_CALLBACK_SECRET":           "callbacksecret",
+		"BLOCKER_CALLBACK_RATE_LIMIT":       "5",
+	})
+	cfg, err := load(lookupMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SkydURL() != "http://localhost:9990" {
+		t.Fatal("unexpected", cfg.SkydURL())
+	}
+	if cfg.SkydReadyTimeout != 90*time.Second {
+		t.Fatal("unexpected", cfg.SkydReadyTimeout)
+	}
+	if cfg.SkydBatchTimeout != time.Minute || cfg.SkydMaxBatchBytes != 4096 {
+		t.Fatal("unexpected", cfg.SkydBatchTimeout, cfg.SkydMaxBatchBytes)
+	}
+	if cfg.RetryLimit != 250 || cfg.LagThreshold != 5*time.Minute {
+		t.Fatal("unexpected", cfg.RetryLimit, cfg.LagThreshold)
+	}
+	if !cfg.BootstrapFromSkyd {
+		t.Fatal("unexpected", cfg.BootstrapFromSkyd)
+	}
+	if len(cfg.Severities) != 2 || cfg.Severities["csam"] != database.SeverityCritical || cfg.Severities["malware"] != database.SeverityHigh {
+		t.Fatal("unexpected", cfg.Severities)
+	}
+	if cfg.DBSlowQueryThreshold != 2*time.Second || cfg.DBRetryWindow != time.Minute {
+		t.Fatal("unexpected", cfg.DBSlowQueryThreshold, cfg.DBRetryWindow)
+	}
+	if cfg.DBInsertChunkSize != 500 {
+		t.Fatal("unexpected", cfg.DBInsertChunkSize)
+	}
+	if cfg.DBShedThreshold != 5*time.Second || cfg.DBShedAllThreshold != 20*time.Second {
+		t.Fatal("unexpected", cfg.DBShedThreshold, cfg.DBShedAllThreshold)
+	}
+	if !cfg.DBIndexHidden || cfg.DBIndexBuildTimeout != 10*time.Minute || cfg.DBIndexBuildResumes != 3 {
+		t.Fatal("unexpected", cfg.DBIndexHidden, cfg.DBIndexBuildTimeout, cfg.DBIndexBuildResumes)
+	}
+	if cfg.Namespace != "eu-portal" {
+		t.Fatal("unexpected", cfg.Namespace)
+	}
+	if !cfg.AnonymizeReporters || string(cfg.ReporterSalt) != "salt" {
+		t.Fatal("unexpected", cfg.AnonymizeReporters, cfg.ReporterSalt)
+	}
+	if !cfg.AllowListFailOpen || !cfg.PreflightCheck {
+		t.Fatal("unexpected", cfg.AllowListFailOpen, cfg.PreflightCheck)
+	}
+	if cfg.SuspicionMinReports != 25 || cfg.SuspicionBogusRatio != 0.8 {
+		t.Fatal("unexpected", cfg.SuspicionMinReports, cfg.SuspicionBogusRatio)
+	}
+	if cfg.ArchiveAge != 720*time.Hour {
+		t.Fatal("unexpected", cfg.ArchiveAge)
+	}
+	if cfg.StaleServerAge != 1440*time.Hour {
+		t.Fatal("unexpected", cfg.StaleServerAge)
+	}
+	if len(cfg.APIKeys) != 2 || cfg.APIKeys[0].ID != "scanner" || cfg.APIKeys[0].Key != "key" || len(cfg.APIKeys[0].Tags) != 1 || cfg.APIKeys[1].Tags != nil {
+		t.Fatal("unexpected", cfg.APIKeys)
+	}
+	if cfg.AccountsHost != "127.0.0.1" || cfg.AccountsPort != "3001" {
+		t.Fatal("unexpected", cfg.AccountsHost, cfg.AccountsPort)
+	}
+	if cfg.LogLevel != logrus.DebugLevel {
+		t.Fatal("unexpected", cfg.LogLevel)
+	}
+	if cfg.LogFormat != LogFormatJSON || cfg.LogFile != "/var/log/blocker.log" {
+		t.Fatal("unexpected", cfg.LogFormat, cfg.LogFile)
+	}
+	if !cfg.Debug {
+		t.Fatal("expected debug to be enabled")
+	}
+	if cfg.ListenAddr != "127.0.0.1:4001" || cfg.TLSCertFile != "cert.pem" || cfg.TLSKeyFile != "key.pem" {
+		t.Fatal("unexpected", cfg.ListenAddr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	if cfg.APIRole != api.RoleWrite || !cfg.APIDisableListing {
+		t.Fatal("unexpected", cfg.APIRole, cfg.APIDisableListing)
+	}
+	if cfg.APIListingCacheControl != "public, max-age=60" {
+		t.Fatal("unexpected", cfg.APIListingCacheControl)
+	}
+	if cfg.StopTimeout != 5*time.Second {
+		t.Fatal("unexpected", cfg.StopTimeout)
+	}
+	if len(cfg.PortalURLs) != 2 || cfg.PortalURLs[0] != "https://siasky.net" || cfg.PortalURLs[1] != "https://skyportal.xyz" {
+		t.Fatal("unexpected", cfg.PortalURLs)
+	}
+	if len(cfg.PortalIdentities) != 1 || cfg.PortalIdentities[0].URL != "https://siasky.net" || cfg.PortalIdentities[0].PublicKey != strings.Repeat("ab", 32) {
+		t.Fatal("unexpected", cfg.PortalIdentities)
+	}
+	if len(cfg.PushPeers) != 1 || cfg.PushPeers[0].URL != "https://blocker.siasky.net" || cfg.PushPeers[0].APIKey != "key" {
+		t.Fatal("unexpected", cfg.PushPeers)
+	}
+	if cfg.PoWMaxUses != 10 || cfg.PoWMaxDailyReports != 20 {
+		t.Fatal("unexpected", cfg.PoWMaxUses, cfg.PoWMaxDailyReports)
+	}
+	_, abcd := cfg.PoWTrustedMySkyIDs["abcd"]
+	_, ef01 := cfg.PoWTrustedMySkyIDs["ef01"]
+	if len(cfg.PoWTrustedMySkyIDs) != 2 || !abcd || !ef01 {
+		t.Fatal("unexpected", cfg.PoWTrustedMySkyIDs)
+	}
+	if string(cfg.PoWSecret) != "secret" {
+		t.Fatal("unexpected", cfg.PoWSecret)
+	}
+	if !cfg.PoWResponseHash {
+		t.Fatal("unexpected", cfg.PoWResponseHash)
+	}
+	if !cfg.PoWV1Deadline.Equal(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected", cfg.PoWV1Deadline)
+	}
+	if cfg.AlertURL != "https://alerts.example.com/hook" || cfg.AlertFailedThreshold != 50 || cfg.AlertInvalidThreshold != 500 {
+		t.Fatal("unexpected", cfg.AlertURL, cfg.AlertFailedThreshold, cfg.AlertInvalidThreshold)
+	}
+	if len(cfg.WebhookRules) != 2 || cfg.WebhookRules[0].Tags[0] != "csam" || cfg.WebhookRules[1].MinSeverity != "high" || cfg.WebhookRules[1].Events[0] != "report" {
+		t.Fatal("unexpected", cfg.WebhookRules)
+	}
+	if cfg.AlertCheckInterval != time.Minute || cfg.AlertCooldown != 30*time.Minute {
+		t.Fatal("unexpected", cfg.AlertCheckInterval, cfg.AlertCooldown)
+	}
+	if cfg.AuditInterval != 24*time.Hour {
+		t.Fatal("unexpected", cfg.AuditInterval)
+	}
+	if len(cfg.CallbackDomains) != 2 || cfg.CallbackDomains[0] != "example.com" || cfg.CallbackDomains[1] != "abuse.example.org" {
+		t.Fatal("unexpected", cfg.CallbackDomains)
+	}
+	if cfg.CallbackSecret != "callbacksecret" || cfg.CallbackRateLimit != 5 {
+		t.Fatal("unexpected", cfg.CallbackSecret, cfg.CallbackRateLimit)
+	}
+
+	// assert callbacks require a secret
+	noSecret := withEnv(env, map[string]string{"BLOCKER_CALLBACK_SECRET": ""})
+	_, err = load(lookupMap(noSecret))
+	if err == nil || !strings.Contains(err.Error(), "missing env var BLOCKER_CALLBACK_SECRET") {
+		t.Fatal("unexpected outcome", err)
+	}
+
+	// assert pushing to peers requires our own portal url
+	delete(env, "BLOCKER_OWN_PORTAL_URL")
+	_, err = load(lookupMap(env))
+	if err == nil || !strings.Contains(err.Error(), "missing env var BLOCKER_OWN_PORTAL_URL") {
+		t.Fatal("unexpected outcome", err)
+	}
+}
+
+// testMissing verifies the error lists every missing required variable.
+func testMissing(t *testing.T) {
+	// assert every missing variable is reported at once
+	_, err := load(lookupMap(nil))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for variable := range requiredEnv {
+		if !strings.Contains(err.Error(), "missing env var "+variable) {
+			t.Fatalf("expected error to mention %v, got %v", variable, err)
+		}
+	}
+
+	// unset every variable one by one and assert the error only indicates
+	// what environment variable is missing
+	for variable := range requiredEnv {
+		env := withEnv(requiredEnv, nil)
+		delete(env, variable)
+		_, err := load(lookupMap(env))
+		if err == nil || !strings.Contains(err.Error(), "missing env var "+variable) {
+			t.Fatal("unexpected outcome", err)
+		}
+		if strings.Count(err.Error(), "missing env var") != 1 {
+			t.Fatal("unexpected outcome", err)
+		}
+	}
+
+	// assert the skyd password is not required in aggregator mode
+	env := withEnv(requiredEnv, map[string]string{"BLOCKER_MODE": "Aggregator"})
+	delete(env, "SIA_API_PASSWORD")
+	cfg, err := load(lookupMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != ModeAggregator {
+		t.Fatal("unexpected", cfg.Mode)
+	}
+
+	// assert the db variables are allowed to be empty, but the server uid and
+	// skyd password are not
+	_, err = load(lookupMap(withEnv(requiredEnv, map[string]string{"SKYNET_DB_PASS": ""})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = load(lookupMap(withEnv(requiredEnv, map[string]string{"SERVER_UID": "", "SIA_API_PASSWORD": ""})))
+	if err == nil || strings.Count(err.Error(), "missing env var") != 2 {
+		t.Fatal("unexpected outcome", err)
+	}
+
+	// assert the reporter salt is required when anonymizing reporters
+	_, err = load(lookupMap(withEnv(requiredEnv, map[string]string{"BLOCKER_ANONYMIZE_REPORTERS": "true"})))
+	if err == nil || !strings.Contains(err.Error(), "missing env var BLOCKER_REPORTER_SALT") {
+		t.Fatal("unexpected outcome", err)
+	}
+}
+
+// testInvalid verifies the error lists every invalid variable.
+func testInvalid(t *testing.T) {
+	cases := []struct {
+		variable string
+		value    string
+	}{
+		{"API_PORT", "abc"},
+		{"API_PORT", "-1"},
+		{"BLOCKER_LOG_LEVEL", "verbose"},
+		{"BLOCKER_LOG_FORMAT", "xml"},
+		{"BLOCKER_MODE", "partial"},
+		{"BLOCKER_SKYD_READY_TIMEOUT", "5"},
+		{"BLOCKER_SKYD_BATCH_TIMEOUT", "-30s"},
+		{"BLOCKER_SKYD_MAX_BATCH_BYTES", "1MB"},
+		{"BLOCKER_RETRY_LIMIT", "0"},
+		{"BLOCKER_BOOTSTRAP_FROM_SKYD", "maybe"},
+		{"BLOCKER_POW_RESPONSE_HASH", "maybe"},
+		{"BLOCKER_LAG_THRESHOLD", "15"},
+		{"BLOCKER_SEVERITIES", "csam=critical"},
+		{"BLOCKER_SEVERITIES", `{"csam": "urgent"}`},
+		{"BLOCKER_DB_SLOW_QUERY_THRESHOLD", "-1s"},
+		{"BLOCKER_DB_RETRY_WINDOW", "30"},
+		{"BLOCKER_DB_INSERT_CHUNK_SIZE", "0"},
+		{"BLOCKER_DB_SHED_THRESHOLD", "0s"},
+		{"BLOCKER_DB_SHED_ALL_THRESHOLD", "1s"},
+		{"BLOCKER_DB_INDEX_HIDDEN", "maybe"},
+		{"BLOCKER_DB_INDEX_BUILD_TIMEOUT", "0s"},
+		{"BLOCKER_DB_INDEX_BUILD_RESUMES", "-1"},
+		{"BLOCKER_NAMESPACE", "eu portal"},
+		{"BLOCKER_LISTEN_ADDR", "4000"},
+		{"BLOCKER_API_ROLE", "readonly"},
+		{"BLOCKER_API_DISABLE_LISTING", "nope"},
+		{"BLOCKER_API_DISABLE_LISTING", "true"},
+		{"BLOCKER_API_LISTING_CACHE_CONTROL", "public\r\nSet-Cookie: a=b"},
+		{"BLOCKER_STOP_TIMEOUT", "0"},
+		{"BLOCKER_DEBUG", "yes please"},
+		{"BLOCKER_ANONYMIZE_REPORTERS", "maybe"},
+		{"BLOCKER_ALLOWLIST_FAIL_OPEN", "sometimes"},
+		{"BLOCKER_PREFLIGHT_CHECK", "always"},
+		{"BLOCKER_SUSPICION_MIN_REPORTS", "0"},
+		{"BLOCKER_SUSPICION_BOGUS_RATIO", "1.5"},
+		{"BLOCKER_ARCHIVE_AGE", "-1h"},
+		{"BLOCKER_STALE_SERVER_AGE", "0s"},
+		{"BLOCKER_TLS_CERT", "cert.pem"},
+		{"BLOCKER_POW_MAX_USES", "0"},
+		{"BLOCKER_POW_MAX_DAILY_REPORTS", "ten"},
+		{"BLOCKER_POW_V1_DEADLINE", "2022-06-01"},
+		{"BLOCKER_ALERT_URL", "alerts.example.com"},
+		{"BLOCKER_WEBHOOK_RULES", `{"urls": ["https://hooks.example.com"]}`},
+		{"BLOCKER_WEBHOOK_RULES", `[{"tags": ["csam"]}]`},
+		{"BLOCKER_WEBHOOK_RULES", `[{"urls": ["https://hooks.example.com"], "minSeverity": "urgent"}]`},
+		{"BLOCKER_WEBHOOK_RULES", `[{"urls": ["https://hooks.example.com"], "events": ["blocked"]}]`},
+		{"BLOCKER_ALERT_FAILED_THRESHOLD", "0"},
+		{"BLOCKER_ALERT_INVALID_THRESHOLD", "-5"},
+		{"BLOCKER_ALERT_CHECK_INTERVAL", "0s"},
+		{"BLOCKER_ALERT_COOLDOWN", "1 hour"},
+		{"BLOCKER_AUDIT_INTERVAL", "-24h"},
+		{"BLOCKER_CALLBACK_DOMAINS", "https://example.com"},
+		{"BLOCKER_CALLBACK_RATE_LIMIT", "0"},
+		{"BLOCKER_PORTALS_SYNC_IDENTITIES", "https://siasky.net"},
+		{"BLOCKER_PORTALS_SYNC_IDENTITIES", `[{"url": "https://siasky.net", "publicKey": "abcd"}]`},
+		{"BLOCKER_PUSH_PEERS", "https://blocker.siasky.net"},
+		{"BLOCKER_PUSH_PEERS", `[{"url": "blocker.siasky.net"}]`},
+		{"BLOCKER_API_KEYS_CONFIG", "key"},
+		{"BLOCKER_API_KEYS_CONFIG", `[{"id": "scanner"}]`},
+		{"BLOCKER_API_KEYS_CONFIG", `[{"id": "scanner", "key": "a"}, {"id": "scanner", "key": "b"}]`},
+		{"BLOCKER_API_KEYS_CONFIG", `[{"id": "a", "key": "key"}, {"id": "b", "key": "key"}]`},
+	}
+
+	// assert every case fails on its own
+	all := make(map[string]string)
+	for _, c := range cases {
+		_, err := load(lookupMap(withEnv(requiredEnv, map[string]string{c.variable: c.value})))
+		if err == nil || !strings.Contains(err.Error(), "invalid env var "+c.variable) {
+			t.Fatalf("unexpected outcome for %v=%v, %v", c.variable, c.value, err)
+		}
+		all[c.variable] = c.value
+	}
+
+	// assert all invalid variables get reported at once
+	_, err := load(lookupMap(withEnv(requiredEnv, all)))
+	if err == nil || strings.Count(err.Error(), "invalid env var") != len(all) {
+		t.Fatal("unexpected outcome", err)
+	}
+}
+
+// testSecretFiles verifies secrets can be provided through files.
+func testSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	// the structured secrets are validated, so they need a valid value
+	values := map[string]string{
+		"BLOCKER_ALERT_URL":       "https://alerts.example.com/BLOCKER_ALERT_URL",
+		"BLOCKER_PUSH_PEERS":      `[{"url": "https://blocker.siasky.net", "apiKey": "BLOCKER_PUSH_PEERS"}]`,
+		"BLOCKER_API_KEYS_CONFIG": `[{"id": "scanner", "key": "BLOCKER_API_KEYS_CONFIG"}]`,
+		"BLOCKER_WEBHOOK_RULES":   `[{"urls": ["https://hooks.example.com/BLOCKER_WEBHOOK_RULES"]}]`,
+	}
+
+	// write a secret file for every secret variable, with a trailing newline,
+	// pushing to peers requires our own portal url to be set
+	env := withEnv(requiredEnv, map[string]string{"BLOCKER_OWN_PORTAL_URL": "portal.example.com"})
+	for _, variable := range secretVars {
+		value, ok := values[variable]
+		if !ok {
+			value = variable + "_FROM_FILE"
+		}
+		path := filepath.Join(dir, variable)
+		err := ioutil.WriteFile(path, []byte(" "+value+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(env, variable)
+		env[variable+fileSuffix] = path
+	}
+
+	// assert the secrets are read from the files and trimmed
+	cfg, err := load(lookupMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBUser != "SKYNET_DB_USER_FROM_FILE" || cfg.DBPassword != "SKYNET_DB_PASS_FROM_FILE" {
+		t.Fatal("unexpected", cfg.DBUser, cfg.DBPassword)
+	}
+	if cfg.SkydAPIPassword != "SIA_API_PASSWORD_FROM_FILE" {
+		t.Fatal("unexpected", cfg.SkydAPIPassword)
+	}
+	if string(cfg.PoWSecret) != "BLOCKER_POW_SECRET_FROM_FILE" {
+		t.Fatal("unexpected", string(cfg.PoWSecret))
+	}
+	if string(cfg.ReporterSalt) != "BLOCKER_REPORTER_SALT_FROM_FILE" {
+		t.Fatal("unexpected", string(cfg.ReporterSalt))
+	}
+	if cfg.AlertURL != values["BLOCKER_ALERT_URL"] {
+		t.Fatal("unexpected", cfg.AlertURL)
+	}
+
+	// assert setting both variants is an error
+	both := withEnv(env, map[string]string{"SIA_API_PASSWORD": "SIA_API_PASSWORD"})
+	_, err = load(lookupMap(both))
+	if err == nil || !strings.Contains(err.Error(), "both SIA_API_PASSWORD and SIA_API_PASSWORD_FILE are set") {
+		t.Fatal("unexpected outcome", err)
+	}
+
+	// assert a missing file is an error that mentions the variable
+	missing := withEnv(env, map[string]string{"SKYNET_DB_PASS_FILE": filepath.Join(dir, "missing")})
+	_, err = load(lookupMap(missing))
+	if err == nil || !strings.Contains(err.Error(), "failed to read secret file from SKYNET_DB_PASS_FILE") {
+		t.Fatal("unexpected outcome", err)
+	}
+
+	// assert an empty file variant falls back to the regular variable
+	empty := withEnv(requiredEnv, map[string]string{"SIA_API_PASSWORD_FILE": ""})
+	cfg, err = load(lookupMap(empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SkydAPIPassword != "SIA_API_PASSWORD" {
+		t.Fatal("unexpected", cfg.SkydAPIPassword)
+	}
+}
+
+// testString verifies the string representation of the config redacts all
+// secrets.
+func testString(t *testing.T) {
+	env := withEnv(requiredEnv, map[string]string{
+		"BLOCKER_POW_SECRET":      "BLOCKER_POW_SECRET",
+		"BLOCKER_REPORTER_SALT":   "BLOCKER_REPORTER_SALT",
+		"BLOCKER_ALERT_URL":       "https://alerts.example.com/BLOCKER_ALERT_URL",
+		"BLOCKER_OWN_PORTAL_URL":  "portal.example.com",
+		"BLOCKER_PUSH_PEERS":      `[{"url": "https://blocker.siasky.net", "apiKey": "BLOCKER_PUSH_PEERS"}]`,
+		"BLOCKER_API_KEYS_CONFIG": `[{"id": "scanner", "key": "BLOCKER_API_KEYS_CONFIG"}]`,
+		"BLOCKER_WEBHOOK_RULES":   `[{"urls": ["https://hooks.example.com/BLOCKER_WEBHOOK_RULES"]}]`,
+	})
+	cfg, err := load(lookupMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := cfg.String()
+	for _, secret := range []string{"SKYNET_DB_PASS", "SIA_API_PASSWORD", "BLOCKER_POW_SECRET", "BLOCKER_REPORTER_SALT", "BLOCKER_ALERT_URL", "BLOCKER_PUSH_PEERS", "BLOCKER_API_KEYS_CONFIG", "BLOCKER_WEBHOOK_RULES"} {
+		if strings.Contains(str, secret) {
+			t.Fatalf("secret %v was not redacted, %v", secret, str)
+		}
+	}
+	if !strings.Contains(str, "ServerUID=94743e8e2673a176") || !strings.Contains(str, redacted) {
+		t.Fatal("unexpected", str)
+	}
+}
+
+// TestLoad verifies Load reads the configuration from the environment.
+func TestLoad(t *testing.T) {
+	// create a function to restore the environment
+	variables := []string{"API_PORT"}
+	for variable := range requiredEnv {
+		variables = append(variables, variable)
+	}
+	restoreEnvFn := restoreEnv(variables)
+	defer func() {
+		err := restoreEnvFn()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for variable, value := range requiredEnv {
+		err := os.Setenv(variable, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Setenv("API_PORT", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SkydPort != 1234 || cfg.ServerUID != requiredEnv["SERVER_UID"] {
+		t.Fatal("unexpected", cfg)
+	}
+}
+
+// TestSanitizePortalURL is a unit test for the sanitizePortalURL helper
+func TestSanitizePortalURL(t *testing.T) {
+	cases := []struct {
+		input  string
+		output string
+	}{
+		{"https://siasky.net", "https://siasky.net"},
+		{"https://siasky.net ", "https://siasky.net"},
+		{" https://siasky.net ", "https://siasky.net"},
+		{"https://siasky.net/", "https://siasky.net"},
+		{"http://siasky.net", "https://siasky.net"},
+		{"siasky.net", "https://siasky.net"},
+	}
+
+	// Test set cases to ensure known edge cases are always handled
+	for _, test := range cases {
+		res := sanitizePortalURL(test.input)
+		if res != test.output {
+			t.Fatalf("unexpected result, %v != %v", res, test.output)
+		}
+	}
+}
+
+// TestParsePortalURLs is a unit test for the parsePortalURLs helper, it covers
+// sanitizing, validating and deduplicating the configured portal urls.
+func TestParsePortalURLs(t *testing.T) {
+	cases := []struct {
+		name        string
+		input       string
+		own         string
+		output      []string
+		numWarnings int
+		err         bool
+	}{
+		{"Empty", "", "", nil, 0, false},
+		{"OnlySeparators", " ,, ", "", nil, 0, false},
+		{"Single", "siasky.net/", "", []string{"https://siasky.net"}, 0, false},
+		{"Multiple", "siasky.net/, skyportal.xyz,,", "", []string{"https://siasky.net", "https://skyportal.xyz"}, 0, false},
+		{"Localhost", "http://localhost:9980", "", []string{"https://localhost:9980"}, 0, false},
+		{"NoHost", "https://,siasky.net", "", []string{"https://siasky.net"}, 1, false},
+		{"NoDomain", "siasky,siasky.net", "", []string{"https://siasky.net"}, 1, false},
+		{"Duplicates", "siasky.net,https://SIASKY.net/,siasky.net", "", []string{"https://siasky.net"}, 2, false},
+		{"Own", "siasky.net,skyportal.xyz", "https://SkyPortal.xyz", []string{"https://siasky.net"}, 1, false},
+		{"AllRejected", "https://,siasky", "", nil, 2, true},
+		{"OnlyOwn", "siasky.net", "https://siasky.net", nil, 1, true},
+	}
+	for _, c := range cases {
+		urls, warnings, err := parsePortalURLs(c.input, c.own)
+		if (err != nil) != c.err {
+			t.Fatalf("%v: unexpected error %v", c.name, err)
+		}
+		if len(warnings) != c.numWarnings {
+			t.Fatalf("%v: unexpected warnings %v", c.name, warnings)
+		}
+		if len(urls) != len(c.output) {
+			t.Fatalf("%v: unexpected urls %v", c.name, urls)
+		}
+		for i := range urls {
+			if urls[i] != c.output[i] {
+				t.Fatalf("%v: unexpected urls %v", c.name, urls)
+			}
+		}
+	}
+
+	// assert the config surfaces the warnings and errors
+	env := withEnv(requiredEnv, map[string]string{
+		"BLOCKER_PORTALS_SYNC":   "siasky.net,skyportal.xyz",
+		"BLOCKER_OWN_PORTAL_URL": "skyportal.xyz",
+	})
+	cfg, err := load(lookupMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.PortalURLs) != 1 || len(cfg.Warnings) != 1 || cfg.OwnPortalURL != "https://skyportal.xyz" {
+		t.Fatal("unexpected", cfg.PortalURLs, cfg.Warnings, cfg.OwnPortalURL)
+	}
+	env["BLOCKER_PORTALS_SYNC"] = "skyportal.xyz"
+	_, err = load(lookupMap(env))
+	if err == nil || !strings.Contains(err.Error(), "invalid env var BLOCKER_PORTALS_SYNC") {
+		t.Fatal("unexpected outcome", err)
+	}
+}
+
+// TestRestoreEnv is small unit test that covers the restoreEnv helper
+func TestRestoreEnv(t *testing.T) {
+	t.Parallel()
+
+	// assert it can handle nil
+	restoreFn := restoreEnv(nil)
+	err := restoreFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// set an env variable to some value
+	varName := "TestRestoreEnv"
+	err = os.Setenv(varName, "somevalue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create the function
+	restoreFn = restoreEnv([]string{varName})
+
+	// update the env variable and assert it's set
+	os.Setenv(varName, "somenewvalue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv(varName) != "somenewvalue" {
+		t.Fatal("unexpected", os.Getenv(varName))
+	}
+
+	// restore the env and assert it got restored
+	err = restoreFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv(varName) != "somevalue" {
+		t.Fatal("unexpected", os.Getenv(varName))
+	}
+}
+
+// restoreEnv is a helper function that returns a function that, when executed,
+// restores the environment to the point restoreEnv got called. It restores the
+// environment only for the given set of environment variable names.
+func restoreEnv(variables []string) func() error {
+	backup := make(map[string]string)
+	for _, variable := range variables {
+		value, exists := os.LookupEnv(variable)
+		if exists {
+			backup[variable] = value
+		}
+	}
+	return func() error {
+		var errs []error
+		for _, variable := range variables {
+			original, exists := backup[variable]
+			if !exists {
+				if err := os.Unsetenv(variable); err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			if err := os.Setenv(variable, original); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Compose(errs...)
+	}
+}
+
+// lookupMap returns a lookup function that looks up variables in the given
+// map rather than the environment.
+func lookupMap(env map[string]string) lookupFn {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+// withEnv returns a copy of the given environment with the given overrides
+// applied.
+func withEnv(env, overrides map[string]string) map[string]string {
+	out := make(map[string]string)
+	for k, v := range env {
+		out[k] = v
+	}
+	for k, v := range overrides {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultArchiveAge is the default age after which reverted skylinks
+	// are moved to the archive, measured from the time they got reverted.
+	DefaultArchiveAge = 180 * 24 * time.Hour
+)
+
+// ArchiveReverted moves the reverted skylinks that got reverted before the
+// given time, and that were removed from skyd's blocklist, from the skylinks
+// collection to the archive. The skylinks are moved in batches, every batch is
+// written to the archive before it's deleted from the skylinks collection. A
+// skylink that's archived already is overwritten, which makes it safe to rerun
+// after an interrupted run. It returns the number of archived skylinks.
+func (db *DB) ArchiveReverted(ctx context.Context, before time.Time) (int, error) {
+	// NOTE: skylinks that are still blocked by skyd are skipped, they're
+	// archived once the blocker removed them from skyd's blocklist
+	filter := db.namespaced(bson.M{
+		"reverted":           true,
+		"timestamp_reverted": bson.M{"$lt": before},
+		"timestamp_blocked":  bson.M{"$not": bson.M{"$gt": time.Time{}}},
+	})
+
+	var archived int
+	var lastID primitive.ObjectID
+	for {
+		// fetch the next batch
+		opts := options.Find()
+		opts.SetSort(bson.M{"_id": 1})
+		opts.SetLimit(migrationBatchSize)
+		batchFilter := bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": lastID}}}}
+		docs, err := db.find(ctx, batchFilter, opts)
+		if err != nil {
+			return archived, errors.AddContext(err, "failed to find reverted skylinks")
+		}
+		if len(docs) == 0 {
+			return archived, nil
+		}
+		lastID = docs[len(docs)-1].ID
+
+		// write the batch to the archive, the skylinks are upserted by
+		// their hash so a skylink that got archived, restored and
+		// reverted again replaces its previous copy, the replacement
+		// doesn't carry an id as the id of a document is immutable
+		now := Now()
+		ids := make([]primitive.ObjectID, 0, len(docs))
+		models := make([]mongo.WriteModel, 0, len(docs))
+		for _, doc := range docs {
+			ids = append(ids, doc.ID)
+			doc.ID = primitive.NilObjectID
+			doc.Archived = true
+			doc.TimestampArchived = now
+			models = append(models, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"namespace": doc.Namespace, "hash": doc.Hash}).
+				SetReplacement(doc).
+				SetUpsert(true))
+		}
+		done := db.trackQuery(collSkylinksArchive, "bulkWrite", nil)
+		_, err = db.staticSkylinksArchive.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		done()
+		if err != nil {
+			return archived, errors.AddContext(err, "failed to write reverted skylinks to the archive")
+		}
+
+		// delete the batch from the skylinks collection, skylinks that got
+		// reported again in the meantime are no longer reverted and stay
+		done = db.trackQuery(collSkylinks, "deleteMany", nil)
+		res, err := db.staticSkylinks.DeleteMany(ctx, bson.M{
+			"_id":      bson.M{"$in": ids},
+			"reverted": true,
+		})
+		done()
+		if err != nil {
+			return archived, errors.AddContext(err, "failed to delete archived skylinks")
+		}
+		archived += int(res.DeletedCount)
+	}
+}
+
+// RestoreArchived moves the archived skylink with the given hash back to the
+// skylinks collection as the given report, see restoreArchived. It returns
+// ErrNoDocumentsFound if there's no archived skylink with the given hash and
+// ErrSkylinkExists if the skylinks collection holds the hash already.
+func (db *DB) RestoreArchived(ctx context.Context, hash Hash, report *BlockedSkylink) error {
+	filter := db.namespaced(bson.M{"hash": hash.String()})
+	archived, err := db.findArchived(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if archived == nil {
+		return ErrNoDocumentsFound
+	}
+
+	// insert before deleting, if the delete fails the skylink is in both
+	// collections and the archived copy is overwritten when it gets
+	// archived again
+	restored := restoreArchived(*archived, report)
+	err = db.CreateBlockedSkylink(ctx, &restored)
+	if err != nil {
+		return err
+	}
+	defer db.trackQuery(collSkylinksArchive, "deleteOne", filter)()
+	_, err = db.staticSkylinksArchive.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete restored skylink from the archive")
+	}
+	return nil
+}
+
+// findArchived returns the archived skylink that matches the given filter, or
+// nil if there's none.
+func (db *DB) findArchived(ctx context.Context, filter interface{}) (*BlockedSkylink, error) {
+	defer db.trackQuery(collSkylinksArchive, "findOne", filter)()
+	var doc BlockedSkylink
+	err := db.staticSkylinksArchive.FindOne(ctx, filter).Decode(&doc)
+	if isDocumentNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.resolveOrigin()
+	return &doc, nil
+}
+
+// restoreArchived returns the skylink that replaces the given archived skylink
+// when its hash gets reported again. It's the given report, which gets
+// blocked anew, but it keeps the id, the hash and the history of the archived
+// skylink: its events, with a resurrected event appended, the tags that were
+// reverted and not reported again, its reporters and the portals it was seen
+// on.
+func restoreArchived(archived BlockedSkylink, report *BlockedSkylink) BlockedSkylink {
+	restored := copySkylink(*report)
+	restored.ID = archived.ID
+	restored.Hash = archived.Hash
+	restored.Events = append([]Event{}, archived.Events...)
+	addEvent(&restored, newEvent(EventResurrected, "restored from the archive"))
+	restored.RevertedTags = make([]string, 0, len(archived.RevertedTags))
+	for _, tag := range archived.RevertedTags {
+		if !containsString(restored.Tags, tag) {
+			restored.RevertedTags = append(restored.RevertedTags, tag)
+		}
+	}
+	restored.MergedReporters = append([]Reporter{}, archived.MergedReporters...)
+	if archived.Reporter != (Reporter{}) && archived.Reporter != restored.Reporter {
+		restored.MergedReporters = append(restored.MergedReporters, archived.Reporter)
+	}
+	restored.SeenOnPortals = append([]string{}, archived.SeenOnPortals...)
+	if restored.TimestampAdded.IsZero() {
+		restored.TimestampAdded = Now()
+	}
+	return restored
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// ExportVersion is the version of the export format, it has to be bumped
+	// whenever the format or the schema of the exported documents changes in
+	// a way that's not backwards compatible.
+	ExportVersion = 1
+
+	// importBatchSize is the number of documents that are upserted in a
+	// single bulk write when importing an export.
+	importBatchSize = 1000
+)
+
+var (
+	// ErrUnsupportedExportVersion is returned when importing an export that
+	// was created with an unsupported version of the export format.
+	ErrUnsupportedExportVersion = errors.New("unsupported export version")
+
+	// exportCollections are the collections that are exported. The proofs
+	// and reports collections only hold short-lived rate limiting data, so
+	// they are not part of an export.
+	exportCollections = []string{collSkylinks, collAllowlist}
+)
+
+type (
+	// ImportResult holds the outcome of an import.
+	ImportResult struct {
+		// Inserted is the number of documents that didn't exist yet.
+		Inserted int `json:"inserted"`
+
+		// Updated is the number of existing documents that were overwritten
+		// by the imported documents.
+		Updated int `json:"updated"`
+
+		// Unchanged is the number of existing documents that were identical
+		// to the imported documents.
+		Unchanged int `json:"unchanged"`
+
+		// Conflicts is the number of existing documents that were kept
+		// because we were merging the import.
+		Conflicts int `json:"conflicts"`
+	}
+
+	// exportHeader is the first line of an export.
+	exportHeader struct {
+		Version int       `json:"version"`
+		Created time.Time `json:"created"`
+	}
+
+	// exportRecord is a document of an export, the document is encoded as
+	// canonical extended JSON, preserving its exact BSON types.
+	exportRecord struct {
+		Collection string          `json:"collection"`
+		Document   json.RawMessage `json:"document"`
+	}
+)
+
+// Export streams the blocklist, being the skylinks and allowlist collections,
+// to the given writer. The export is newline delimited JSON, the first line is
+// a header that contains the version of the export format, every other line
+// is a document of one of the collections. Only the documents of the DB's
+// namespace are exported.
+func (db *DB) Export(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	// write the header
+	err := enc.Encode(exportHeader{
+		Version: ExportVersion,
+		Created: Now(),
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to write export header")
+	}
+
+	// write the documents, sorted by id to make exports deterministic
+	for _, collName := range exportCollections {
+		opts := options.Find().SetSort(bson.M{"_id": 1})
+		c, err := db.staticDB.Collection(collName).Find(ctx, db.namespaced(bson.M{}), opts)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to query collection '%v'", collName))
+		}
+		for c.Next(ctx) {
+			doc, err := bson.MarshalExtJSON(c.Current, true, false)
+			if err != nil {
+				_ = c.Close(ctx)
+				return errors.AddContext(err, fmt.Sprintf("failed to encode document of collection '%v'", collName))
+			}
+			err = enc.Encode(exportRecord{Collection: collName, Document: doc})
+			if err != nil {
+				_ = c.Close(ctx)
+				return errors.AddContext(err, "failed to write export record")
+			}
+		}
+		err = errors.Compose(c.Err(), c.Close(ctx))
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to export collection '%v'", collName))
+		}
+	}
+	return bw.Flush()
+}
+
+// Import reads an export, created by Export, from the given reader and upserts
+// its documents by hash. If merge is true, existing documents are kept and
+// counted as conflicts, otherwise they are overwritten by the imported ones.
+// The documents are imported into the DB's namespace, regardless of the
+// namespace they were exported from.
+func (db *DB) Import(ctx context.Context, r io.Reader, merge bool) (ImportResult, error) {
+	var result ImportResult
+	br := bufio.NewReader(r)
+
+	// read and validate the header
+	line, err := readLine(br)
+	if err != nil {
+		return result, errors.AddContext(err, "failed to read export header")
+	}
+	var header exportHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return result, errors.AddContext(err, "failed to parse export header")
+	}
+	if header.Version != ExportVersion {
+		return result, errors.AddContext(ErrUnsupportedExportVersion, fmt.Sprintf("version %v", header.Version))
+	}
+
+	// read the documents and upsert them in batches per collection
+	var collName string
+	var batch []mongo.WriteModel
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := db.staticDB.Collection(collName).BulkWrite(ctx, batch)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to import documents into collection '%v'", collName))
+		}
+		result.Inserted += int(res.UpsertedCount)
+		if merge {
+			result.Conflicts += int(res.MatchedCount)
+		} else {
+			result.Updated += int(res.ModifiedCount)
+			result.Unchanged += int(res.MatchedCount - res.ModifiedCount)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for n := 1; ; n++ {
+		line, err := readLine(br)
+		if errors.Contains(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, errors.AddContext(err, "failed to read export record")
+		}
+
+		var record exportRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return result, errors.AddContext(err, fmt.Sprintf("failed to parse export record %v", n))
+		}
+		if !isExportCollection(record.Collection) {
+			return result, fmt.Errorf("unknown collection '%v' in export record %v", record.Collection, n)
+		}
+		model, err := importModel(record.Document, db.staticNamespace, merge)
+		if err != nil {
+			return result, errors.AddContext(err, fmt.Sprintf("invalid document in export record %v", n))
+		}
+
+		// flush the batch if it's full or if we reached another collection
+		if record.Collection != collName || len(batch) == importBatchSize {
+			err = flush()
+			if err != nil {
+				return result, err
+			}
+			collName = record.Collection
+		}
+		batch = append(batch, model)
+	}
+	return result, flush()
+}
+
+// importModel returns the write model that upserts the given document, encoded
+// as extended JSON, by its hash into the given namespace. If merge is true
+// existing documents are left untouched. The id of the document is only set on
+// insert, since the id of an existing document can't be updated.
+func importModel(doc []byte, namespace string, merge bool) (mongo.WriteModel, error) {
+	var d bson.D
+	err := bson.UnmarshalExtJSON(doc, true, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	var hash interface{}
+	onInsert := bson.D{}
+	fields := bson.D{}
+	for _, e := range d {
+		switch e.Key {
+		case "_id":
+			onInsert = append(onInsert, e)
+			continue
+		case "hash":
+			hash = e.Value
+		case "namespace":
+			continue
+		}
+		fields = append(fields, e)
+	}
+	if hash == nil {
+		return nil, errors.New("document has no hash")
+	}
+	fields = append(fields, bson.E{Key: "namespace", Value: namespace})
+
+	var update bson.D
+	if merge {
+		update = bson.D{{Key: "$setOnInsert", Value: append(onInsert, fields...)}}
+	} else {
+		update = bson.D{{Key: "$set", Value: fields}}
+		if len(onInsert) > 0 {
+			update = append(update, bson.E{Key: "$setOnInsert", Value: onInsert})
+		}
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"namespace": namespace, "hash": hash}).
+		SetUpdate(update).
+		SetUpsert(true), nil
+}
+
+// isExportCollection returns true if the given collection is exported.
+func isExportCollection(collName string) bool {
+	for _, c := range exportCollections {
+		if c == collName {
+			return true
+		}
+	}
+	return false
+}
+
+// readLine reads the next non-empty line from the given reader, without the
+// trailing newline. It returns io.EOF if there are no more lines.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestExportImport verifies an export can be imported into another database
+// without losing any information and that existing documents are either kept
+// or overwritten depending on whether the import is merged.
+func TestExportImport(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create the source and destination databases
+	src := NewTestDB(ctx, t.Name()+"_src", WithCleanup(t))
+	dst := NewTestDB(ctx, t.Name()+"_dst", WithCleanup(t))
+
+	// seed the source database, using timestamps with sub-second precision
+	added := time.Date(2022, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	skylinks := []BlockedSkylink{
+		{
+			Hash:             HashBytes([]byte("skylink_1")),
+			Reporter:         Reporter{Name: "name", Email: "email", Sub: "sub"},
+			Source:           SourceAPI,
+			Tags:             []string{"tag_1"},
+			TimestampAdded:   added,
+			TimestampBlocked: added.Add(time.Minute),
+		},
+		{
+			Hash:           HashBytes([]byte("skylink_2")),
+			Failed:         true,
+			Tags:           []string{"tag_1", "tag_2"},
+			TimestampAdded: added.Add(time.Millisecond),
+		},
+		{
+			Hash:           HashBytes([]byte("skylink_3")),
+			Deleted:        true,
+			DeletedAt:      added.Add(time.Hour),
+			Invalid:        true,
+			TimestampAdded: added.Add(time.Second),
+		},
+	}
+	for _, sl := range skylinks {
+		err := src.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := src.CreateAllowListedSkylink(ctx, &AllowListedSkylink{
+		Hash:           HashBytes([]byte("allowlisted")),
+		Description:    "description",
+		TimestampAdded: added,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// export the source database and import it into the destination
+	var export bytes.Buffer
+	err = src.Export(ctx, &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := dst.Import(ctx, bytes.NewReader(export.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ImportResult{Inserted: 4}) {
+		t.Fatal("unexpected result", res)
+	}
+
+	// assert exporting the destination yields the exact same documents
+	var reexport bytes.Buffer
+	err = dst.Export(ctx, &reexport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := exportedDocuments(t, export.Bytes())
+	actual := exportedDocuments(t, reexport.Bytes())
+	if len(actual) != 4 {
+		t.Fatalf("unexpected number of documents, %v != 4", len(actual))
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("unexpected documents, %v != %v", actual, expected)
+	}
+
+	// assert the hashes and timestamps survived the round trip
+	for _, sl := range skylinks {
+		doc, err := dst.FindByHash(ctx, sl.Hash, IncludeDeleted())
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+		if !bytes.Equal(doc.Hash.Hash[:], sl.Hash.Hash[:]) {
+			t.Fatal("unexpected hash", doc.Hash, sl.Hash)
+		}
+		for _, ts := range [][2]time.Time{
+			{doc.TimestampAdded, sl.TimestampAdded},
+			{doc.TimestampBlocked, sl.TimestampBlocked},
+			{doc.DeletedAt, sl.DeletedAt},
+		} {
+			if !ts[0].Equal(ts[1].Truncate(time.Millisecond)) {
+				t.Fatal("unexpected timestamp", ts[0], ts[1])
+			}
+		}
+	}
+
+	// update a document in the destination
+	_, err = dst.staticSkylinks.UpdateOne(ctx, bson.M{"hash": skylinks[0].Hash}, bson.M{"$set": bson.M{"tags": []string{"changed"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert merging the import keeps the existing documents
+	res, err = dst.Import(ctx, bytes.NewReader(export.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ImportResult{Conflicts: 4}) {
+		t.Fatal("unexpected result", res)
+	}
+	doc, err := dst.FindByHash(ctx, skylinks[0].Hash)
+	if err != nil || doc == nil || !reflect.DeepEqual(doc.Tags, []string{"changed"}) {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert importing without merging overwrites the existing documents
+	res, err = dst.Import(ctx, bytes.NewReader(export.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ImportResult{Updated: 1, Unchanged: 3}) {
+		t.Fatal("unexpected result", res)
+	}
+	doc, err = dst.FindByHash(ctx, skylinks[0].Hash)
+	if err != nil || doc == nil || !reflect.DeepEqual(doc.Tags, skylinks[0].Tags) {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert unsupported versions and unknown collections are rejected
+	_, err = dst.Import(ctx, strings.NewReader(`{"version":2}`), false)
+	if !errors.Contains(err, ErrUnsupportedExportVersion) {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = dst.Import(ctx, strings.NewReader(`{"version":1}
+{"collection":"proofs","document":{"hash":"abc"}}`), false)
+	if err == nil || !strings.Contains(err.Error(), "unknown collection") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// exportedDocuments returns the documents of the given export by collection
+// and id, the header is skipped.
+func exportedDocuments(t *testing.T, export []byte) map[string]bson.M {
+	docs := make(map[string]bson.M)
+	scanner := bufio.NewScanner(bytes.NewReader(export))
+	scanner.Scan()
+	for scanner.Scan() {
+		var record exportRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc bson.M
+		err = bson.UnmarshalExtJSON(record.Document, true, &doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[record.Collection+"/"+doc["_id"].(primitive.ObjectID).Hex()] = doc
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return docs
+}
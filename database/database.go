@@ -3,13 +3,15 @@ package database
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -18,21 +20,60 @@ import (
 )
 
 const (
+	// FailureClassPermanent is the failure class of skylinks that failed to
+	// get blocked because skyd rejected the request.
+	FailureClassPermanent = "permanent"
+
+	// FailureClassTransient is the failure class of skylinks that failed to
+	// get blocked because skyd was unreachable or unavailable.
+	FailureClassTransient = "transient"
+
+	// FailureClassUnknown is the failure class of skylinks that failed to get
+	// blocked before we classified failures.
+	FailureClassUnknown = "unknown"
+
 	// MongoDefaultTimeout is the timeout for the context used in testing
 	// whenever a context is sent to mongo
 	MongoDefaultTimeout = time.Minute
 
-	// mongoIndexCreateTimeout is the timeout used when creating indices
-	mongoIndexCreateTimeout = time.Minute
+	// DefaultIndexBuildTimeout is the default maximum amount of time a single
+	// attempt at building an index may take.
+	DefaultIndexBuildTimeout = time.Minute
+
+	// proofUsageWindow is the amount of time during which we keep track of how
+	// many times a proof has been used, after this window the proof expires
+	// and its usage counter gets reset.
+	proofUsageWindow = 24 * time.Hour
+
+	// ReportWindow is the sliding window over which we keep track of the
+	// number of reports per MySkyID.
+	ReportWindow = 24 * time.Hour
+
+	// AllowListHitWindow is the amount of time during which we keep track of
+	// the reports of allowlisted skylinks, older hits expire.
+	AllowListHitWindow = 30 * 24 * time.Hour
+
+	// DefaultStaleServerAge is the default amount of time after which the
+	// latest block timestamp of a blocker that stopped updating it is
+	// removed, see PruneLatestBlockTimestamps.
+	DefaultStaleServerAge = 90 * 24 * time.Hour
+
+	// DefaultNamespace is the namespace of the DB unless another one is
+	// given through WithNamespace.
+	DefaultNamespace = "default"
 
-	// mongoTestUsername is the username used for the test database.
-	mongoTestUsername = "admin"
+	// DefaultInsertChunkSize is the default maximum number of documents that
+	// get inserted at once when creating blocked skylinks in bulk, larger
+	// bulks are split up so they don't exceed MongoDB's message size limit.
+	DefaultInsertChunkSize = 1000
 
-	// mongoTestPassword is the password used for the test database.
-	mongoTestPassword = "aO4tV5tC1oU3oQ7u" // #nosec G101
+	// maxNamespaceLength is the maximum length of a namespace.
+	maxNamespaceLength = 64
 
-	// mongoTestConnString is the connection string used for the test database.
-	mongoTestConnString = "mongodb://localhost:37017"
+	// migrationBatchSize is the number of documents that get updated at once
+	// when normalizing the reporters or migrating the origins of existing
+	// documents.
+	migrationBatchSize = 1000
 )
 
 var (
@@ -48,6 +89,10 @@ var (
 	// drop an index
 	ErrIndexDropFailed = errors.New("failed to drop an index")
 
+	// ErrInvalidNamespace is returned when a namespace is empty, too long or
+	// contains invalid characters.
+	ErrInvalidNamespace = errors.New("invalid namespace")
+
 	// ErrNoDocumentsFound is returned when a database operation completes
 	// successfully but it doesn't find or affect any documents.
 	ErrNoDocumentsFound = errors.New("no documents")
@@ -60,42 +105,165 @@ var (
 	// and it already exists there.
 	ErrSkylinkExists = errors.New("skylink already exists")
 
-	// ServerUID is a random string that uniquely identifies the server
-	ServerUID string
-
 	// True is a helper value, so we can pass a *bool to MongoDB's methods.
 	True = true
 
+	// reporterCollation is the collation used to look up reporters by email
+	// or sub, it compares strings case-insensitively.
+	reporterCollation = &options.Collation{Locale: "en", Strength: 2}
+
 	// dbName defines the name of the database this service uses
 	dbName = "blocker"
 
 	// collSkylinks defines the name of the skylinks collection
 	collSkylinks = "skylinks"
 
+	// collSkylinksArchive defines the name of the collection that holds the
+	// reverted skylinks that were archived, see ArchiveReverted
+	collSkylinksArchive = "skylinks_archive"
+
 	// collAllowlist defines the name of the allowlist collection
 	collAllowlist = "allowlist"
+
+	// collAllowListPublishers defines the name of the collection that holds
+	// the publishers whose v2 skylinks are allowlisted
+	collAllowListPublishers = "allowlist_publishers"
+
+	// collProofs defines the name of the proofs collection
+	collProofs = "proofs"
+
+	// collReports defines the name of the reports collection
+	collReports = "reports"
+
+	// collLatestBlockTimestamps defines the name of the collection that holds
+	// the latest block timestamp of every blocker, by server UID
+	collLatestBlockTimestamps = "latest_block_timestamps"
+
+	// collBlockedIdentities defines the name of the collection that holds
+	// the MySkyIDs that are blocked from reporting
+	collBlockedIdentities = "blocked_identities"
+
+	// collAllowListHits defines the name of the collection that holds the
+	// reports of allowlisted skylinks
+	collAllowListHits = "allowlist_hits"
+
+	// collMigrations defines the name of the collection that records the
+	// migrations that were applied, see Migration
+	collMigrations = "migrations"
 )
 
+// Now returns the current time in UTC, truncated to milliseconds. MongoDB
+// stores timestamps with millisecond precision, every timestamp we store
+// should be created using Now so it's equal to itself after a round trip
+// through the database.
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
 // DB holds a connection to the database, as well as helpful shortcuts to
 // collections and utilities.
 //
 // NOTE: update the 'Purge' method when adding new collections
 type DB struct {
-	staticClient    *mongo.Client
-	staticDB        *mongo.Database
-	staticAllowList *mongo.Collection
-	staticSkylinks  *mongo.Collection
-	staticLogger    *logrus.Logger
+	staticClient                *mongo.Client
+	staticDB                    *mongo.Database
+	staticAllowList             *mongo.Collection
+	staticAllowListHits         *mongo.Collection
+	staticAllowListPublishers   *mongo.Collection
+	staticBlockedIdentities     *mongo.Collection
+	staticLatestBlockTimestamps *mongo.Collection
+	staticMigrations            *mongo.Collection
+	staticProofs                *mongo.Collection
+	staticReports               *mongo.Collection
+	staticSkylinks              *mongo.Collection
+	staticSkylinksArchive       *mongo.Collection
+	staticLogger                *logrus.Entry
+
+	// staticNamespace is the namespace of the DB, every document of the
+	// skylinks and allowlist collections belongs to a namespace. This allows
+	// multiple portals to keep their blocklist in the same database, the DB
+	// only reads and writes the documents of its own namespace.
+	staticNamespace string
+
+	// missingIndexes are the indexes, in the form "collection.index", that
+	// were missing the last time the schema was checked.
+	missingIndexes []string
+
+	// queryStats holds the duration histograms of the database operations,
+	// operations that take longer than the slow query threshold get logged.
+	queryStats         map[string]*queryStats
+	slowQueryThreshold time.Duration
+
+	// queryObserver is called with the duration of every database operation,
+	// it allows the API to shed load when the database slows down.
+	queryObserver func(time.Duration)
+
+	// retryWindow is the amount of time operations passed to Retry are
+	// retried for when they fail with a retryable error.
+	retryWindow time.Duration
+
+	// queryFailpoint is called before every tracked operation, it allows
+	// tests to simulate slow operations.
+	queryFailpoint func(collName, op string)
+
+	// insertChunkSize is the maximum number of blocked skylinks that get
+	// inserted at once.
+	insertChunkSize int
+
+	// insertFailpoint is called before every chunk of blocked skylinks gets
+	// inserted, it allows tests to simulate a chunk failing.
+	insertFailpoint func(chunk int) error
+
+	// staticSecondaryPreferred indicates reads are served by a secondary of
+	// the replica set whenever one is available.
+	staticSecondaryPreferred bool
+
+	// staticIndexBuild configures how the indexes of the database schema
+	// are built.
+	staticIndexBuild IndexBuildOptions
+
+	// staticMigrationSet holds the migrations that run on startup, in order.
+	staticMigrationSet []Migration
+
+	staticMu sync.Mutex
+}
+
+// Option configures a DB.
+type Option func(*DB)
+
+// WithNamespace sets the namespace of the DB, it defaults to DefaultNamespace.
+func WithNamespace(namespace string) Option {
+	return func(db *DB) {
+		db.staticNamespace = namespace
+	}
+}
+
+// WithSecondaryPreferredReads has the DB read from a secondary of the replica
+// set whenever one is available, which takes the load of read-only instances
+// off the primary. Reads might be slightly stale. Writes always go to the
+// primary.
+func WithSecondaryPreferredReads() Option {
+	return func(db *DB) {
+		db.staticSecondaryPreferred = true
+	}
+}
+
+// WithIndexBuildOptions sets the options used when building the indexes of the
+// database schema, both on startup and when missing indexes get re-created.
+func WithIndexBuildOptions(opts IndexBuildOptions) Option {
+	return func(db *DB) {
+		db.staticIndexBuild = opts
+	}
 }
 
 // New creates a new database connection.
-func New(ctx context.Context, uri string, creds options.Credential, logger *logrus.Logger) (*DB, error) {
-	return NewCustomDB(ctx, uri, dbName, creds, logger)
+func New(ctx context.Context, uri string, creds options.Credential, logger *logrus.Entry, opts ...Option) (*DB, error) {
+	return NewCustomDB(ctx, uri, dbName, creds, logger, opts...)
 }
 
 // NewCustomDB creates a new database connection to a database with a custom
 // name.
-func NewCustomDB(ctx context.Context, uri string, dbName string, creds options.Credential, logger *logrus.Logger) (*DB, error) {
+func NewCustomDB(ctx context.Context, uri string, dbName string, creds options.Credential, logger *logrus.Entry, dbOpts ...Option) (*DB, error) {
 	if ctx == nil {
 		return nil, errors.New("no context provided")
 	}
@@ -103,11 +271,30 @@ func NewCustomDB(ctx context.Context, uri string, dbName string, creds options.C
 		return nil, errors.New("no logger provided")
 	}
 
+	// Apply the options, the namespace is needed to backfill the namespace
+	// of legacy documents before the schema is ensured.
+	configured := &DB{
+		staticNamespace:    DefaultNamespace,
+		staticMigrationSet: migrations(),
+	}
+	for _, opt := range dbOpts {
+		opt(configured)
+	}
+	if err := ValidateNamespace(configured.staticNamespace); err != nil {
+		return nil, err
+	}
+
 	// Prepare the options for connecting to the db.
+	readPref := readpref.Primary()
+	if configured.staticSecondaryPreferred {
+		readPref = readpref.SecondaryPreferred()
+	}
 	opts := options.Client().
 		ApplyURI(uri).
 		SetAuth(creds).
-		SetReadPreference(readpref.Primary()).
+		SetReadPreference(readPref).
+		SetRetryReads(true).
+		SetRetryWrites(true).
 		SetWriteConcern(writeconcern.New(
 			writeconcern.WMajority(),
 			writeconcern.WTimeout(time.Second*30),
@@ -123,9 +310,16 @@ func NewCustomDB(ctx context.Context, uri string, dbName string, creds options.C
 		return nil, errors.AddContext(err, "failed to connect to db")
 	}
 
-	// Ensure the database schema
+	// Backfill the namespace of documents that were inserted before
+	// namespaces existed, they're part of the unique index on the hash.
 	db := c.Database(dbName)
-	err = ensureDBSchema(ctx, db, logger)
+	err = backfillNamespace(ctx, db, configured.staticNamespace, logger)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to backfill the namespace")
+	}
+
+	// Ensure the database schema
+	_, err = ensureDBSchema(ctx, db, configured.staticIndexBuild, logger)
 	if err != nil && errors.Contains(err, ErrIndexCreateFailed) {
 		// We do not error out if we failed to ensure the existence of an index.
 		// It is definitely an issue that should be looked into, which is why we
@@ -138,60 +332,68 @@ func NewCustomDB(ctx context.Context, uri string, dbName string, creds options.C
 
 	// Define the database
 	cdb := &DB{
-		staticClient:    c,
-		staticDB:        db,
-		staticAllowList: db.Collection(collAllowlist),
-		staticSkylinks:  db.Collection(collSkylinks),
-		staticLogger:    logger,
+		staticClient:                c,
+		staticDB:                    db,
+		staticAllowList:             db.Collection(collAllowlist),
+		staticAllowListHits:         db.Collection(collAllowListHits),
+		staticAllowListPublishers:   db.Collection(collAllowListPublishers),
+		staticBlockedIdentities:     db.Collection(collBlockedIdentities),
+		staticLatestBlockTimestamps: db.Collection(collLatestBlockTimestamps),
+		staticMigrations:            db.Collection(collMigrations),
+		staticProofs:                db.Collection(collProofs),
+		staticReports:               db.Collection(collReports),
+		staticSkylinks:              db.Collection(collSkylinks),
+		staticSkylinksArchive:       db.Collection(collSkylinksArchive),
+		staticLogger:                logger,
+		staticNamespace:             configured.staticNamespace,
+
+		staticSecondaryPreferred: configured.staticSecondaryPreferred,
+		staticIndexBuild:         configured.staticIndexBuild,
+		staticMigrationSet:       configured.staticMigrationSet,
+
+		queryStats:         make(map[string]*queryStats),
+		slowQueryThreshold: DefaultSlowQueryThreshold,
+		retryWindow:        DefaultRetryWindow,
+		insertChunkSize:    DefaultInsertChunkSize,
 	}
 
-	return cdb, nil
-}
-
-// NewTestDB returns a test database, the database gets purged and on error we
-// panic.
-func NewTestDB(ctx context.Context, dbName string) *DB {
-	// create a discard logger
-	logger := logrus.New()
-	logger.Out = ioutil.Discard
-
-	// create the database, we swap out slashes for underscores so callers can
-	// easily pass t.Name()
-	dbName = strings.Replace(dbName, "/", "_", -1)
-	db, err := NewCustomDB(ctx, mongoTestConnString, dbName, options.Credential{
-		Username: mongoTestUsername,
-		Password: mongoTestPassword,
-	}, logger)
+	// Capture the health of the schema, this allows reporting a degraded
+	// database rather than silently running slow.
+	_, err = cdb.managedRefreshSchemaHealth(ctx)
 	if err != nil {
-		panic(err)
+		logger.Errorf(`[CRITICAL] failed to check DB schema, err: %v`, err)
+	}
+	if missing := cdb.MissingIndexes(); len(missing) > 0 {
+		logger.WithField("missing", missing).Warn("Database schema is degraded")
 	}
 
-	// create a context with timeout and purge the database
-	ctx, cancel := context.WithTimeout(ctx, MongoDefaultTimeout)
-	defer cancel()
-	err = db.Purge(ctx)
+	// Apply the migrations that weren't applied yet
+	err = cdb.managedRunMigrations(ctx, newMigrationOwner(), cdb.staticMigrationSet)
 	if err != nil {
-		panic(err)
+		return nil, errors.Compose(err, cdb.Close(ctx))
 	}
 
-	return db
+	return cdb, nil
 }
 
 // BlockedHashes allows to pass a skip and limit parameter and returns an array
 // of blocked hashes alongside a boolean that indicates whether there's more
 // documents after the current 'page'.
-func (db *DB) BlockedHashes(ctx context.Context, sort, skip, limit int) ([]BlockedSkylink, bool, error) {
+//
+// Soft-deleted skylinks are excluded unless the IncludeDeleted option is given.
+func (db *DB) BlockedHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error) {
 	// configure the options
 	opts := options.Find()
 	opts.SetSkip(int64(skip))
 	opts.SetLimit(int64(limit + 1))
-	opts.SetSort(bson.M{"timestamp_added": sort})
+	opts.SetSort(timestampAddedSort(sort))
 
 	// fetch the documents
-	docs, err := db.find(ctx, bson.M{
-		"invalid": bson.M{"$ne": true},
-		"hash":    bson.M{"$exists": true},
-	}, opts)
+	docs, err := db.find(ctx, db.skylinksFilter(bson.M{
+		"invalid":  bson.M{"$ne": true},
+		"reverted": bson.M{"$ne": true},
+		"hash":     bson.M{"$exists": true},
+	}, queryOpts...), opts)
 	if err != nil {
 		return nil, false, err
 	}
@@ -205,6 +407,221 @@ func (db *DB) BlockedHashes(ctx context.Context, sort, skip, limit int) ([]Block
 	return docs, false, nil
 }
 
+// PendingHashes returns the skylinks that were reported but that are still
+// awaiting the next sweep of the blocker, being the ones that weren't blocked
+// yet and that didn't fail, weren't found invalid, weren't reverted and weren't
+// skipped because they're allowlisted. It allows to pass a sort, skip and limit
+// parameter and returns whether there are more documents after the current
+// 'page'. Soft-deleted skylinks are excluded unless the IncludeDeleted option
+// is given.
+func (db *DB) PendingHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error) {
+	// configure the options
+	opts := options.Find()
+	opts.SetSkip(int64(skip))
+	opts.SetLimit(int64(limit + 1))
+	opts.SetSort(timestampAddedSort(sort))
+
+	// fetch the documents, the filter is backed by the pending index
+	docs, err := db.find(ctx, db.skylinksFilter(bson.M{
+		"timestamp_blocked":   bson.M{"$exists": false},
+		"failed":              bson.M{"$ne": true},
+		"invalid":             bson.M{"$ne": true},
+		"reverted":            bson.M{"$ne": true},
+		"skipped_allowlisted": bson.M{"$ne": true},
+	}, queryOpts...), opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(docs) > limit {
+		return docs[:limit], true, nil
+	}
+	return docs, false, nil
+}
+
+// timestampAddedSort returns a sort on the time documents were added in the
+// given order. Documents added within the same millisecond, e.g. by a bulk
+// insert, are ordered by their id, without a tiebreaker their order isn't
+// stable across queries and paging through them could repeat or skip some.
+func timestampAddedSort(order int) bson.D {
+	return bson.D{
+		{Key: "timestamp_added", Value: order},
+		{Key: "_id", Value: order},
+	}
+}
+
+// FindByReporter returns the blocked skylinks reported by the reporter with
+// the given email or sub, which are matched case-insensitively. It allows to
+// pass a sort, skip and limit parameter and returns whether there are more
+// documents after the current 'page'. Soft-deleted skylinks are excluded unless
+// the IncludeDeleted option is given.
+func (db *DB) FindByReporter(ctx context.Context, emailOrSub string, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error) {
+	id := normalizeReporterID(emailOrSub)
+	if id == "" {
+		return nil, false, errors.New("no reporter email or sub provided")
+	}
+
+	// configure the options, the collation has to match the one of the
+	// reporter indexes for them to be used
+	opts := options.Find()
+	opts.SetCollation(reporterCollation)
+	opts.SetSkip(int64(skip))
+	opts.SetLimit(int64(limit + 1))
+	opts.SetSort(timestampAddedSort(sort))
+
+	// fetch the documents
+	docs, err := db.find(ctx, db.skylinksFilter(bson.M{
+		"$or": bson.A{
+			bson.M{"reporter.email": id},
+			bson.M{"reporter.sub": id},
+		},
+	}, queryOpts...), opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// return whether there are more documents, see BlockedHashes
+	if len(docs) > int(limit) {
+		return docs[:limit], true, nil
+	}
+	return docs, false, nil
+}
+
+// NormalizeReporters normalizes the email and sub of the reporter of all
+// blocked skylinks that were inserted before reporters got normalized on
+// insert. The documents are updated in batches, it returns the number of
+// updated documents.
+func (db *DB) NormalizeReporters(ctx context.Context) (int, error) {
+	var updated int
+	for _, field := range []string{"reporter.email", "reporter.sub"} {
+		// find all documents where the field is not normalized
+		normalized := bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$" + field}}}
+		filter := bson.M{
+			field:   bson.M{"$type": "string"},
+			"$expr": bson.M{"$ne": bson.A{"$" + field, normalized}},
+		}
+		update := mongo.Pipeline{{{Key: "$set", Value: bson.M{field: normalized}}}}
+
+		for {
+			// fetch the ids of the next batch
+			opts := options.Find()
+			opts.SetProjection(bson.M{"_id": 1})
+			opts.SetLimit(migrationBatchSize)
+			docs, err := db.find(ctx, filter, opts)
+			if err != nil {
+				return updated, errors.AddContext(err, fmt.Sprintf("failed to find reporters to normalize on '%v'", field))
+			}
+			if len(docs) == 0 {
+				break
+			}
+			ids := make(bson.A, len(docs))
+			for i, doc := range docs {
+				ids[i] = doc.ID
+			}
+
+			// normalize the batch
+			res, err := db.staticSkylinks.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, update)
+			if err != nil {
+				return updated, errors.AddContext(err, fmt.Sprintf("failed to normalize reporters on '%v'", field))
+			}
+			updated += int(res.ModifiedCount)
+		}
+	}
+	return updated, nil
+}
+
+// MigrateOrigins sets the origin of all blocked skylinks that were inserted
+// before origins were tracked. Synced skylinks get the portal url, which used
+// to be stored as the reporter's name, as their origin and their reporter's
+// name is cleared. The documents are updated in batches, it returns the number
+// of updated documents.
+func (db *DB) MigrateOrigins(ctx context.Context) (int, error) {
+	filter := bson.M{"origin": bson.M{"$exists": false}}
+
+	var updated int
+	for {
+		// fetch the next batch, we decode the raw documents because 'find'
+		// resolves the origin of legacy documents
+		opts := options.Find()
+		opts.SetProjection(bson.M{"_id": 1, "reporter": 1, "source": 1})
+		opts.SetLimit(migrationBatchSize)
+		c, err := db.staticSkylinks.Find(ctx, filter, opts)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to find skylinks without origin")
+		}
+		var docs []BlockedSkylink
+		err = c.All(ctx, &docs)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to decode skylinks without origin")
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		// migrate the batch
+		models := make([]mongo.WriteModel, len(docs))
+		for i, doc := range docs {
+			origin := legacyOrigin(doc.Source, doc.Reporter)
+			set := bson.M{"origin": origin}
+			if origin.Type == OriginTypePortal {
+				set["reporter.name"] = ""
+			}
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": doc.ID}).
+				SetUpdate(bson.M{"$set": set})
+		}
+		res, err := db.staticSkylinks.BulkWrite(ctx, models)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to migrate origins")
+		}
+		updated += int(res.ModifiedCount)
+	}
+	return updated, nil
+}
+
+// ValidateNamespace returns an error if the given namespace is empty, too long
+// or contains characters other than letters, digits, '-', '_' and '.'.
+func ValidateNamespace(namespace string) error {
+	if namespace == "" || len(namespace) > maxNamespaceLength {
+		return errors.AddContext(ErrInvalidNamespace, fmt.Sprintf("namespace has to be between 1 and %v characters", maxNamespaceLength))
+	}
+	for _, r := range namespace {
+		valid := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.'
+		if !valid {
+			return errors.AddContext(ErrInvalidNamespace, fmt.Sprintf("namespace contains invalid character '%c'", r))
+		}
+	}
+	return nil
+}
+
+// backfillNamespace sets the given namespace on all documents of the skylinks
+// and allowlist collections that were inserted before namespaces existed. It
+// has to run before the schema is ensured, the unique index on the hash
+// includes the namespace. Every database used to belong to a single portal, so
+// the documents are assigned to the namespace of the first DB that connects.
+func backfillNamespace(ctx context.Context, db *mongo.Database, namespace string, logger *logrus.Entry) error {
+	filter := bson.M{"namespace": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"namespace": namespace}}
+	for _, coll := range []string{collSkylinks, collAllowlist} {
+		res, err := db.Collection(coll).UpdateMany(ctx, filter, update)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to backfill namespace of collection '%v'", coll))
+		}
+		if res.ModifiedCount > 0 {
+			logger.WithFields(logrus.Fields{
+				"collection": coll,
+				"namespace":  namespace,
+				"updated":    res.ModifiedCount,
+			}).Info("backfilled namespace")
+		}
+	}
+	return nil
+}
+
+// Namespace returns the namespace of the DB.
+func (db *DB) Namespace() string {
+	return db.staticNamespace
+}
+
 // Close disconnects the db.
 func (db *DB) Close(ctx context.Context) error {
 	return db.staticClient.Disconnect(ctx)
@@ -219,61 +636,62 @@ func (db *DB) CreateBlockedSkylink(ctx context.Context, skylink *BlockedSkylink)
 		return errors.AddContext(err, "unexpected blocked skylink")
 	}
 
-	// Insert the skylink
+	// Insert the skylink into our namespace
+	skylink.Namespace = db.staticNamespace
+	defer db.trackQuery(collSkylinks, "insertOne", nil)()
 	_, err = db.staticSkylinks.InsertOne(ctx, skylink)
 	if isDuplicateKey(err) {
 		return ErrSkylinkExists
 	}
 	if err != nil {
-		db.staticLogger.Debugf("CreateBlockedSkylink: mongodb error '%v'", err)
+		db.staticLogger.WithError(err).WithField("hash", skylink.Hash.String()).Debug("CreateBlockedSkylink: mongodb error")
 		return err
 	}
 	return nil
 }
 
 // CreateBlockedSkylinkBulk creates new blocked skylinks in bulk. It returns the
-// number of created entries.
+// number of created entries. The skylinks are inserted in chunks, see
+// SetInsertChunkSize. If a chunk fails to get inserted, or the context is done
+// in between chunks, the number of entries created so far is returned along
+// with the error.
 func (db *DB) CreateBlockedSkylinkBulk(ctx context.Context, skylinks []BlockedSkylink) (int, error) {
-	// Convenience variables
-	logger := db.staticLogger
-
-	// Ensure all required properties are set on the given blocked skylinks
-	for _, skylink := range skylinks {
-		err := skylink.Validate()
-		if err != nil {
-			return 0, errors.AddContext(err, "unexpected blocked skylink")
-		}
+	// Insert all objects in the database, duplicates are ignored
+	inserted, _, err := db.insertBlockedSkylinkChunks(ctx, skylinks)
+	if err != nil {
+		db.staticLogger.WithError(err).WithFields(logrus.Fields{
+			"batch_size": len(skylinks),
+			"inserted":   inserted,
+		}).Debug("CreateBlockedSkylinkBulk: mongodb error")
+		return inserted, err
 	}
+	return inserted, nil
+}
 
-	// Convert the given array to an interface array
-	docs := make([]interface{}, len(skylinks))
-	for i, doc := range skylinks {
-		docs[i] = doc
+// CreateBlockedSkylinkBatch creates new blocked skylinks in bulk. Contrary to
+// CreateBlockedSkylinkBulk it returns the indices of the given skylinks that
+// already existed in the database, allowing the caller to report a status for
+// every skylink in the batch.
+func (db *DB) CreateBlockedSkylinkBatch(ctx context.Context, skylinks []BlockedSkylink) ([]int, error) {
+	// return early if no skylinks were given
+	if len(skylinks) == 0 {
+		return nil, nil
 	}
 
-	// Create insert options, we set ordered to false to ensure a single write
-	// failure doesn't prevent the other writes from going through. We need this
-	// because we expect duplicates and want to simply ignore them.
-	opts := options.InsertMany()
-	opts.SetOrdered(false)
-
-	// Insert all objects in the database
-	res, err := db.staticSkylinks.InsertMany(ctx, docs, opts)
-
-	// Handle the error, we want to ignore all duplicate key errors
-	err = ignoreDuplicateKeyErrors(err)
+	// Insert all objects in the database, collecting the duplicates
+	_, duplicates, err := db.insertBlockedSkylinkChunks(ctx, skylinks)
 	if err != nil {
-		logger.Debugf("CreateBlockedSkylinkBulk: mongodb error '%v'", err)
-		return 0, err
+		db.staticLogger.WithError(err).WithField("batch_size", len(skylinks)).Debug("CreateBlockedSkylinkBatch: mongodb error")
+		return nil, err
 	}
-
-	return len(res.InsertedIDs), nil
+	return duplicates, nil
 }
 
 // CreateAllowListedSkylink creates a new allowlisted skylink. If the skylink
 // already exists it does nothing and returns without failure.
 func (db *DB) CreateAllowListedSkylink(ctx context.Context, skylink *AllowListedSkylink) error {
-	// insert the skylink
+	// insert the skylink into our namespace
+	skylink.Namespace = db.staticNamespace
 	_, err := db.staticAllowList.InsertOne(ctx, skylink)
 	if err != nil && !isDuplicateKey(err) {
 		return err
@@ -281,205 +699,1395 @@ func (db *DB) CreateAllowListedSkylink(ctx context.Context, skylink *AllowListed
 	return nil
 }
 
-// FindByHash fetches the DB record that corresponds to the given hash
-// from the database.
-func (db *DB) FindByHash(ctx context.Context, hash Hash) (*BlockedSkylink, error) {
-	return db.findOne(ctx, bson.M{"hash": hash.String()})
-}
-
-// IsAllowListed returns whether the given skylink is on the allow list.
-func (db *DB) IsAllowListed(ctx context.Context, hash crypto.Hash) (bool, error) {
-	res := db.staticAllowList.FindOne(ctx, bson.M{"hash": hash.String()})
-	if isDocumentNotFound(res.Err()) {
-		return false, nil
-	}
-	if res.Err() != nil {
-		return false, res.Err()
+// CreateAllowListedPublisher allowlists the v2 skylinks of the given publisher.
+// If the publisher is allowlisted already it does nothing and returns without
+// failure.
+func (db *DB) CreateAllowListedPublisher(ctx context.Context, publisher *AllowListedPublisher) error {
+	publisher.Namespace = db.staticNamespace
+	defer db.trackQuery(collAllowListPublishers, "insertOne", nil)()
+	_, err := db.staticAllowListPublishers.InsertOne(ctx, publisher)
+	if err != nil && !isDuplicateKey(err) {
+		return err
 	}
-	return true, nil
-}
-
-// MarkFailed will mark the given documents as failed
-func (db *DB) MarkFailed(ctx context.Context, hashes []Hash) error {
-	return db.updateFailedFlag(ctx, hashes, true)
+	return nil
 }
 
-// MarkInvalid will mark the given documents as invalid
-func (db *DB) MarkInvalid(ctx context.Context, hashes []Hash) error {
+// AddSeenOnPortal records that the given hashes appeared on the blocklist of
+// the portal with the given url.
+func (db *DB) AddSeenOnPortal(ctx context.Context, hashes []Hash, portalURL string) error {
 	// return early if no hashes were given
 	if len(hashes) == 0 {
 		return nil
 	}
 
 	// create the filter
-	filter := bson.M{
+	filter := db.namespaced(bson.M{
 		"hash": bson.M{"$in": hashes},
-	}
+	})
 
 	// define the update
 	update := bson.M{
-		"$set": bson.M{
-			"invalid": True,
+		"$addToSet": bson.M{
+			"seen_on_portals": portalURL,
 		},
 	}
 
 	// perform the update
-	collSkylinks := db.staticDB.Collection(collSkylinks)
-	_, err := collSkylinks.UpdateMany(ctx, filter, update)
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	_, err := db.staticSkylinks.UpdateMany(ctx, filter, update)
 	return err
 }
 
-// MarkSucceeded will toggle the failed flag for all documents in the given
-// list of hashes that are currently marked as failed.
-func (db *DB) MarkSucceeded(ctx context.Context, hashes []Hash) error {
-	return db.updateFailedFlag(ctx, hashes, false)
-}
+// AddTags adds the given tags to the skylink with the given hash, tags the
+// skylink already has are skipped. It returns ErrNoDocumentsFound if there's no
+// skylink with the given hash.
+func (db *DB) AddTags(ctx context.Context, hash Hash, tags []string) error {
+	// return early if no tags were given
+	if len(tags) == 0 {
+		return nil
+	}
 
-// Ping sends a ping command to verify that the client can connect to the DB and
-// specifically to the primary.
-func (db *DB) Ping(ctx context.Context) error {
-	return db.staticDB.Client().Ping(ctx, readpref.Primary())
-}
+	// define the update, it's a pipeline so we can merge the tags with the
+	// existing ones, which might be null
+	filter := db.skylinksFilter(bson.M{"hash": hash.String()})
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tags": bson.M{"$setUnion": bson.A{
+				bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+				bson.M{"$literal": tags},
+			}},
+		}}},
+	}
 
-// Purge deletes all documents from all collections in the database
-//
-// NOTE: this function should never be called in production and should only be
-// used for testing purposes
-func (db *DB) Purge(ctx context.Context) error {
-	_, err := db.staticSkylinks.DeleteMany(ctx, bson.D{})
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	res, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return errors.AddContext(err, "failed to purge skylinks collection")
+		return err
 	}
-	_, err = db.staticAllowList.DeleteMany(ctx, bson.D{})
-	if err != nil {
-		return errors.AddContext(err, "failed to purge allowlist collection")
+	if res.MatchedCount == 0 {
+		return ErrNoDocumentsFound
 	}
 	return nil
 }
 
-// HashesToBlock sweeps the database for unblocked hashes after the given
-// timestamp.
-func (db *DB) HashesToBlock(ctx context.Context, from time.Time) ([]Hash, error) {
-	// NOTE: $ne: true is not the same as $eq: false
-	filter := bson.M{
-		"timestamp_added": bson.M{"$gte": from},
-		"failed":          bson.M{"$ne": true},
-		"invalid":         bson.M{"$ne": true},
-	}
-	opts := options.Find()
-	opts.SetProjection(bson.M{"hash": 1})
-
-	docs, err := db.find(ctx, filter, opts)
-	if err != nil {
-		return nil, err
+// FindByHash fetches the DB record that corresponds to the given hash
+// from the database. Soft-deleted skylinks are excluded unless the
+// IncludeDeleted option is given. Archived skylinks are only returned if the
+// IncludeArchived option is given and the hash isn't in the skylinks
+// collection.
+func (db *DB) FindByHash(ctx context.Context, hash Hash, queryOpts ...QueryOption) (*BlockedSkylink, error) {
+	filter := db.skylinksFilter(bson.M{"hash": hash.String()}, queryOpts...)
+	doc, err := db.findOne(ctx, filter)
+	if err != nil || doc != nil || !newQueryOptions(queryOpts...).includeArchived {
+		return doc, err
 	}
+	return db.findArchived(ctx, filter)
+}
 
-	// Extract the hashes
-	hashes := make([]Hash, len(docs))
-	for i, doc := range docs {
-		hashes[i] = doc.Hash
+// FindByHashes fetches the DB records that correspond to the given hashes from
+// the database. Soft-deleted skylinks are excluded unless the IncludeDeleted
+// option is given.
+func (db *DB) FindByHashes(ctx context.Context, hashes []Hash, queryOpts ...QueryOption) ([]BlockedSkylink, error) {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil, nil
 	}
-	return hashes, nil
+	return db.find(ctx, db.skylinksFilter(bson.M{"hash": bson.M{"$in": hashes}}, queryOpts...))
 }
 
-// HashesToRetry returns all hashes that failed to get blocked the first time
-// around. This is a retry mechanism to ensure we keep retrying to block those
-// hashes, but at the same try 'unblock' the main block loop in order for it
-// to run smoothly.
-func (db *DB) HashesToRetry(ctx context.Context) ([]Hash, error) {
-	// NOTE: $ne: true is not the same as $eq: false
-	filter := bson.M{
-		"failed":  bson.M{"$eq": true},
-		"invalid": bson.M{"$ne": true},
+// ExistingHashes returns the subset of the given hashes that are in the
+// database, it's a lean alternative to FindByHashes for existence checks.
+// Soft-deleted skylinks are excluded unless the IncludeDeleted option is
+// given.
+func (db *DB) ExistingHashes(ctx context.Context, hashes []Hash, queryOpts ...QueryOption) ([]Hash, error) {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil, nil
 	}
 	opts := options.Find()
 	opts.SetProjection(bson.M{"hash": 1})
+	return db.findHashes(ctx, db.skylinksFilter(bson.M{"hash": bson.M{"$in": hashes}}, queryOpts...), opts)
+}
 
-	docs, err := db.find(ctx, filter, opts)
-	if err != nil {
-		return nil, err
+// IncrementProofUsage atomically increments the usage counter of the proof
+// with given hash by n and returns the updated counter. If the proof was not
+// used before it gets created, proofs expire after the proof usage window.
+func (db *DB) IncrementProofUsage(ctx context.Context, proofHash Hash, n int) (int, error) {
+	filter := bson.M{"hash": proofHash.String()}
+	update := bson.M{
+		"$inc":         bson.M{"uses": n},
+		"$setOnInsert": bson.M{"timestamp_added": Now()},
 	}
 
-	// Extract the hashes
-	hashes := make([]Hash, len(docs))
-	for i, doc := range docs {
-		hashes[i] = doc.Hash
-	}
-	return hashes, nil
-}
+	// we upsert the proof and want the updated document to be returned
+	opts := options.FindOneAndUpdate()
+	opts.SetUpsert(true)
+	opts.SetReturnDocument(options.After)
 
-// find wraps the `Find` function on the Skylinks collection and returns an
-// array of decoded blocked skylink objects
-func (db *DB) find(ctx context.Context, filter interface{},
-	opts ...*options.FindOptions) ([]BlockedSkylink, error) {
-	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts...)
-	if isDocumentNotFound(err) {
-		return nil, nil
+	var proof UsedProof
+	defer db.trackQuery(collProofs, "findOneAndUpdate", filter)()
+	err := db.staticProofs.FindOneAndUpdate(ctx, filter, update, opts).Decode(&proof)
+	if isDuplicateKey(err) {
+		// if two requests try to upsert the same proof at the same time, one
+		// of them fails with a duplicate key error, retrying the operation
+		// turns it into a regular update
+		err = db.staticProofs.FindOneAndUpdate(ctx, filter, update, opts).Decode(&proof)
 	}
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return proof.Uses, nil
+}
 
-	list := make([]BlockedSkylink, 0)
-	err = c.All(ctx, &list)
+// AllowListedHashes returns the subset of the given hashes that are on the
+// allow list.
+func (db *DB) AllowListedHashes(ctx context.Context, hashes []Hash) ([]Hash, error) {
+	docs, err := db.FindAllowListed(ctx, hashes)
 	if err != nil {
 		return nil, err
 	}
-	return list, nil
+	allowlisted := make([]Hash, len(docs))
+	for i, doc := range docs {
+		allowlisted[i] = doc.Hash
+	}
+	return allowlisted, nil
 }
 
-// findOne wraps the `FindOne` function on the Skylinks collection and returns
-// a decoded blocked skylink object
-func (db *DB) findOne(ctx context.Context, filter interface{},
-	opts ...*options.FindOneOptions) (*BlockedSkylink, error) {
-	sr := db.staticDB.Collection(collSkylinks).FindOne(ctx, filter, opts...)
-	if isDocumentNotFound(sr.Err()) {
+// FindAllowListed returns the allowlisted skylinks of the given hashes, those
+// that aren't on the allow list are left out. It's a single query, no matter
+// the number of hashes.
+func (db *DB) FindAllowListed(ctx context.Context, hashes []Hash) ([]AllowListedSkylink, error) {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
 		return nil, nil
 	}
-	if sr.Err() != nil {
-		return nil, sr.Err()
-	}
 
-	var sl BlockedSkylink
-	err := sr.Decode(&sl)
+	filter := db.namespaced(bson.M{"hash": bson.M{"$in": hashes}})
+	defer db.trackQuery(collAllowlist, "find", filter)()
+	c, err := db.staticAllowList.Find(ctx, filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to query allowlist")
+	}
+	var docs []AllowListedSkylink
+	err = c.All(ctx, &docs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode allowlisted skylinks")
+	}
+	return docs, nil
+}
+
+// IsAllowListed returns whether the given skylink is on the allow list.
+func (db *DB) IsAllowListed(ctx context.Context, hash crypto.Hash) (bool, error) {
+	filter := db.namespaced(bson.M{"hash": hash.String()})
+	defer db.trackQuery(collAllowlist, "findOne", filter)()
+	res := db.staticAllowList.FindOne(ctx, filter)
+	if isDocumentNotFound(res.Err()) {
+		return false, nil
+	}
+	if res.Err() != nil {
+		return false, res.Err()
+	}
+	return true, nil
+}
+
+// IsPublisherAllowListed returns whether the publisher with the given public
+// key is on the allow list.
+func (db *DB) IsPublisherAllowListed(ctx context.Context, publicKey string) (bool, error) {
+	filter := db.namespaced(bson.M{"public_key": publicKey})
+	defer db.trackQuery(collAllowListPublishers, "findOne", filter)()
+	res := db.staticAllowListPublishers.FindOne(ctx, filter)
+	if isDocumentNotFound(res.Err()) {
+		return false, nil
+	}
+	if res.Err() != nil {
+		return false, res.Err()
+	}
+	return true, nil
+}
+
+// RecordAllowListHit records that the given allowlisted skylink got reported.
+// Hits expire after the allowlist hit window.
+func (db *DB) RecordAllowListHit(ctx context.Context, hit AllowListHit) error {
+	hit.Namespace = db.staticNamespace
+	if hit.TimestampAdded.IsZero() {
+		hit.TimestampAdded = Now()
+	}
+	defer db.trackQuery(collAllowListHits, "insertOne", nil)()
+	_, err := db.staticAllowListHits.InsertOne(ctx, hit)
+	return err
+}
+
+// AllowListHits returns the allowlisted skylinks that got reported the most
+// within the allowlist hit window, along with the number of times they got
+// reported and by how many distinct reporters. At most 'limit' skylinks are
+// returned, the most reported ones first, a limit of zero or less returns all
+// of them.
+func (db *DB) AllowListHits(ctx context.Context, limit int) ([]AllowListHitCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.namespaced(bson.M{})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       "$hash",
+			"hits":      bson.M{"$sum": 1},
+			"reporters": bson.M{"$addToSet": "$reporter"},
+			"last_hit":  bson.M{"$max": "$timestamp_added"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"hits":      1,
+			"reporters": bson.M{"$size": "$reporters"},
+			"last_hit":  1,
+		}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "hits", Value: -1},
+			{Key: "_id", Value: 1},
+		}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	defer db.trackQuery(collAllowListHits, "aggregate", pipeline)()
+	c, err := db.staticAllowListHits.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate allowlist hits")
+	}
+	counts := make([]AllowListHitCount, 0)
+	err = c.All(ctx, &counts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode allowlist hits")
+	}
+	for i := range counts {
+		counts[i].LastHit = counts[i].LastHit.UTC()
+	}
+	return counts, nil
+}
+
+// BlockIdentity adds the given MySkyID to the blocked identities, along with
+// the reason it got blocked. If the MySkyID is blocked already its reason gets
+// updated.
+func (db *DB) BlockIdentity(ctx context.Context, mySkyID, reason string) error {
+	filter := db.namespaced(bson.M{"myskyid": mySkyID})
+	update := bson.M{
+		"$set":         bson.M{"reason": reason},
+		"$setOnInsert": bson.M{"timestamp_added": Now()},
+	}
+	opts := options.Update().SetUpsert(true)
+
+	defer db.trackQuery(collBlockedIdentities, "updateOne", filter)()
+	_, err := db.staticBlockedIdentities.UpdateOne(ctx, filter, update, opts)
+	if isDuplicateKey(err) {
+		// if two requests try to upsert the same identity at the same time,
+		// one of them fails with a duplicate key error, retrying the
+		// operation turns it into a regular update
+		_, err = db.staticBlockedIdentities.UpdateOne(ctx, filter, update, opts)
+	}
+	return err
+}
+
+// UnblockIdentity removes the given MySkyID from the blocked identities. It
+// returns ErrNoDocumentsFound if the MySkyID isn't blocked.
+func (db *DB) UnblockIdentity(ctx context.Context, mySkyID string) error {
+	filter := db.namespaced(bson.M{"myskyid": mySkyID})
+	defer db.trackQuery(collBlockedIdentities, "deleteOne", filter)()
+	res, err := db.staticBlockedIdentities.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoDocumentsFound
+	}
+	return nil
+}
+
+// BlockedIdentities returns all blocked identities, most recently blocked
+// first.
+func (db *DB) BlockedIdentities(ctx context.Context) ([]BlockedIdentity, error) {
+	filter := db.namespaced(bson.M{})
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp_added", Value: -1}})
+
+	defer db.trackQuery(collBlockedIdentities, "find", filter)()
+	c, err := db.staticBlockedIdentities.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to query blocked identities")
+	}
+	identities := make([]BlockedIdentity, 0)
+	err = c.All(ctx, &identities)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode blocked identities")
+	}
+	return identities, nil
+}
+
+// IsIdentityBlocked returns whether the given MySkyID is blocked.
+func (db *DB) IsIdentityBlocked(ctx context.Context, mySkyID string) (bool, error) {
+	filter := db.namespaced(bson.M{"myskyid": mySkyID})
+	defer db.trackQuery(collBlockedIdentities, "findOne", filter)()
+	res := db.staticBlockedIdentities.FindOne(ctx, filter)
+	if isDocumentNotFound(res.Err()) {
+		return false, nil
+	}
+	if res.Err() != nil {
+		return false, res.Err()
+	}
+	return true, nil
+}
+
+// MarkFailed will mark the given documents as failed
+//
+// The failure class indicates whether the failure is transient, e.g. skyd was
+// unreachable, or permanent, the reason describes the failure. Documents that
+// were marked as failed before get their failure updated.
+func (db *DB) MarkFailed(ctx context.Context, hashes []Hash, class, reason string) error {
+	if class != FailureClassTransient && class != FailureClassPermanent {
+		return fmt.Errorf("unknown failure class '%v'", class)
+	}
+
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// create the filter
+	filter := db.namespaced(bson.M{
+		"hash": bson.M{"$in": hashes},
+
+		// just to be on the safe side we ensure we never update invalid
+		// documents, the filters that fetch documents do this as well so this
+		// is only here to keep the database as clean as possible
+		"invalid": bson.M{"$eq": false},
+	})
+
+	// define the update, documents that fail again get their failure updated
+	detail := class
+	if reason != "" {
+		detail += ": " + reason
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"failed":         true,
+			"failure_class":  class,
+			"failure_reason": reason,
+		},
+		"$push": pushEvent(newEvent(EventFailed, detail)),
+	}
+
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	collSkylinks := db.staticDB.Collection(collSkylinks)
+	_, err := collSkylinks.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// MarkSkippedAllowListed will mark the given documents as skipped because
+// their hash is on the allow list, which excludes them from being blocked and
+// retried.
+func (db *DB) MarkSkippedAllowListed(ctx context.Context, hashes []Hash) error {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// create the filter
+	filter := db.namespaced(bson.M{
+		"hash": bson.M{"$in": hashes},
+	})
+
+	// define the update
+	update := bson.M{
+		"$set": bson.M{
+			"skipped_allowlisted": true,
+		},
+		"$push": pushEvent(newEvent(EventSkippedAllowListed, "")),
+	}
+
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	_, err := db.staticSkylinks.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// MarkInvalid will mark the given documents as invalid
+func (db *DB) MarkInvalid(ctx context.Context, hashes []Hash) error {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// create the filter
+	filter := db.namespaced(bson.M{
+		"hash": bson.M{"$in": hashes},
+	})
+
+	// define the update
+	update := bson.M{
+		"$set": bson.M{
+			"invalid": True,
+		},
+		"$push": pushEvent(newEvent(EventInvalid, "")),
+	}
+
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	collSkylinks := db.staticDB.Collection(collSkylinks)
+	_, err := collSkylinks.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// MarkSucceeded will toggle the failed flag for all documents in the given
+// list of hashes that are currently marked as failed. It also records when the
+// documents were confirmed blocked, unless that was recorded already, so
+// retries preserve the time of the first success.
+func (db *DB) MarkSucceeded(ctx context.Context, hashes []Hash) error {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// create the filter
+	filter := db.namespaced(bson.M{
+		"hash":    bson.M{"$in": hashes},
+		"invalid": bson.M{"$eq": false},
+	})
+
+	// define the update, it's a pipeline so we can keep the time the document
+	// was blocked first
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failed":            false,
+			"timestamp_blocked": bson.M{"$ifNull": bson.A{"$timestamp_blocked", Now()}},
+			"events":            appendEvent(newEvent(EventSucceeded, "")),
+		}}},
+		{{Key: "$unset", Value: bson.A{"failure_class", "failure_reason"}}},
+	}
+
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	collSkylinks := db.staticDB.Collection(collSkylinks)
+	_, err := collSkylinks.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// ReconcileBlocked reports which of the given hashes carry the success marker
+// set by MarkSucceeded, being a time at which they got blocked while they're
+// not marked as failed. Hashes of which the document lacks the marker are
+// returned as unmarked, hashes without a document, or of which the document is
+// invalid, are in neither list since MarkSucceeded doesn't update them.
+func (db *DB) ReconcileBlocked(ctx context.Context, hashes []Hash) (marked, unmarked []Hash, err error) {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil, nil, nil
+	}
+
+	filter := db.namespaced(bson.M{
+		"hash":    bson.M{"$in": hashes},
+		"invalid": bson.M{"$eq": false},
+	})
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 1, "timestamp_blocked": 1, "failed": 1})
+
+	defer db.trackQuery(collSkylinks, "find", filter)()
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var docs []struct {
+		Hash             Hash      `bson:"hash"`
+		TimestampBlocked time.Time `bson:"timestamp_blocked"`
+		Failed           bool      `bson:"failed"`
+	}
+	err = c.All(ctx, &docs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, doc := range docs {
+		if !doc.TimestampBlocked.IsZero() && !doc.Failed {
+			marked = append(marked, doc.Hash)
+		} else {
+			unmarked = append(unmarked, doc.Hash)
+		}
+	}
+	return marked, unmarked, nil
+}
+
+// ResurrectInvalid resurrects the invalid skylink with the given hash because
+// it got reported again. It clears the invalid and failed flags so the blocker
+// picks it up again, resets the time it was added and when it got blocked,
+// adds the tags of the given report and merges its reporter into the existing
+// one. It returns ErrNoDocumentsFound if there's no invalid skylink with the
+// given hash.
+func (db *DB) ResurrectInvalid(ctx context.Context, hash Hash, report *BlockedSkylink) error {
+	filter := db.skylinksFilter(bson.M{
+		"hash":    hash.String(),
+		"invalid": bson.M{"$eq": true},
+	})
+
+	// merge the reporter, fields that weren't set in the report are kept
+	timestampAdded := report.TimestampAdded
+	if timestampAdded.IsZero() {
+		timestampAdded = Now()
+	}
+	set := bson.M{
+		"events":          appendEvent(newEvent(EventResurrected, "")),
+		"failed":          false,
+		"invalid":         false,
+		"timestamp_added": timestampAdded,
+	}
+	for field, value := range map[string]string{
+		"reporter.name":          report.Reporter.Name,
+		"reporter.email":         report.Reporter.Email,
+		"reporter.other_contact": report.Reporter.OtherContact,
+		"reporter.sub":           report.Reporter.Sub,
+		"source":                 report.Source,
+	} {
+		// NOTE: we use '$literal' because the update is a pipeline, where
+		// strings starting with a '$' would be interpreted as field paths
+		if value != "" {
+			set[field] = bson.M{"$literal": value}
+		}
+	}
+	if report.Reporter.Sub != "" {
+		set["reporter.unauthenticated"] = false
+	}
+	if len(report.Tags) > 0 {
+		set["tags"] = bson.M{"$setUnion": bson.A{
+			bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+			bson.M{"$literal": report.Tags},
+		}}
+	}
+	if len(report.Metadata) > 0 {
+		set["metadata"] = bson.M{"$mergeObjects": bson.A{
+			bson.M{"$ifNull": bson.A{"$metadata", bson.M{}}},
+			bson.M{"$literal": report.Metadata},
+		}}
+	}
+
+	// define the update, it's a pipeline so we can merge the tags with the
+	// existing ones, which might be null
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: set}},
+		{{Key: "$unset", Value: "timestamp_blocked"}},
+	}
+
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	collSkylinks := db.staticDB.Collection(collSkylinks)
+	res, err := collSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNoDocumentsFound
+	}
+	return nil
+}
+
+// ResetBlockedSkylink resets the processing state of the skylink with the
+// given hash so it gets sent to skyd again. It clears the failed, invalid and
+// skipped allowlisted flags along with the failure, and records a reset event
+// with the given detail. If bump is true the time it was added is set to now,
+// which makes the next sweep of every blocker pick it up. It returns
+// ErrNoDocumentsFound if there's no skylink with the given hash.
+func (db *DB) ResetBlockedSkylink(ctx context.Context, hash Hash, bump bool, detail string) error {
+	filter := db.skylinksFilter(bson.M{"hash": hash.String()})
+
+	set := bson.M{
+		"events":              appendEvent(newEvent(EventReset, detail)),
+		"failed":              false,
+		"invalid":             false,
+		"skipped_allowlisted": false,
+	}
+	if bump {
+		set["timestamp_added"] = Now()
+	}
+
+	// define the update, it's a pipeline so we can append the event to the
+	// existing ones, which might be null
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: set}},
+		{{Key: "$unset", Value: bson.A{"failure_class", "failure_reason"}}},
+	}
+
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	res, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNoDocumentsFound
+	}
+	return nil
+}
+
+// RevertTags reverts the given tags of the skylink with the given hash, they
+// are moved from its tags to its reverted tags. Once none of its tags remain
+// the skylink is reverted, which drops it from the blocklist and queues it to
+// be removed from skyd's blocklist, see HashesToUnblock. If no tags are given
+// all of its tags are reverted. The update is a single findOneAndUpdate so
+// concurrent reverts can't undo each other. It returns the updated skylink,
+// or ErrNoDocumentsFound if there's no skylink with the given hash.
+func (db *DB) RevertTags(ctx context.Context, hash Hash, tags []string, detail string) (*BlockedSkylink, error) {
+	filter := db.skylinksFilter(bson.M{"hash": hash.String()})
+
+	// revert is the expression of the tags to revert, if no tags are given
+	// it's all of the skylink's tags
+	active := bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}
+	reverted := bson.M{"$ifNull": bson.A{"$reverted_tags", bson.A{}}}
+	var revert interface{} = active
+	if len(tags) > 0 {
+		revert = bson.M{"$literal": tags}
+	}
+	isReverted := bson.M{"$in": bson.A{"$$this", revert}}
+
+	// define the update, it's a pipeline so the tags are updated based on
+	// their current value, the second stage sees the updated tags
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tags": bson.M{"$filter": bson.M{
+				"input": active,
+				"cond":  bson.M{"$not": bson.A{isReverted}},
+			}},
+			"reverted_tags": bson.M{"$concatArrays": bson.A{reverted, bson.M{"$filter": bson.M{
+				"input": active,
+				"cond": bson.M{"$and": bson.A{
+					isReverted,
+					bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", reverted}}}},
+				}},
+			}}}},
+			"events": appendEvent(newEvent(EventReverted, detail)),
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"reverted": bson.M{"$eq": bson.A{bson.M{"$size": "$tags"}, 0}},
+			"timestamp_reverted": bson.M{"$cond": bson.A{
+				bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{bson.M{"$size": "$tags"}, 0}},
+					bson.M{"$ne": bson.A{"$reverted", true}},
+				}},
+				Now(),
+				"$timestamp_reverted",
+			}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate()
+	opts.SetReturnDocument(options.After)
+
+	var bsl BlockedSkylink
+	defer db.trackQuery(collSkylinks, "findOneAndUpdate", filter)()
+	err := db.staticSkylinks.FindOneAndUpdate(ctx, filter, update, opts).Decode(&bsl)
+	if isDocumentNotFound(err) {
+		return nil, ErrNoDocumentsFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &sl, nil
+	bsl.resolveOrigin()
+	return &bsl, nil
+}
+
+// HashesToUnblock returns the hashes of the reverted and soft-deleted skylinks
+// that skyd confirmed blocking, they have to be removed from skyd's blocklist.
+// At most limit hashes are returned, the oldest reverts come first, preceded
+// by the soft-deleted skylinks that weren't reverted.
+func (db *DB) HashesToUnblock(ctx context.Context, limit int) ([]Hash, error) {
+	filter := db.skylinksFilter(bson.M{
+		"$or": bson.A{
+			bson.M{"reverted": true},
+			bson.M{"deleted": true},
+		},
+		"timestamp_blocked": bson.M{"$gt": time.Time{}},
+	}, IncludeDeleted())
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 1})
+	opts.SetSort(bson.D{
+		{Key: "timestamp_reverted", Value: 1},
+		{Key: "_id", Value: 1},
+	})
+	opts.SetLimit(int64(limit))
+	return db.findHashes(ctx, filter, opts)
+}
+
+// MarkUnblocked marks the given reverted or soft-deleted hashes as removed from
+// skyd's blocklist, they're no longer considered blocked.
+func (db *DB) MarkUnblocked(ctx context.Context, hashes []Hash) error {
+	// return early if no hashes were given
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// create the filter
+	filter := db.namespaced(bson.M{
+		"hash": bson.M{"$in": hashes},
+		"$or": bson.A{
+			bson.M{"reverted": true},
+			bson.M{"deleted": true},
+		},
+	})
+
+	// define the update, it's a pipeline so we can append the event to the
+	// existing ones, which might be null
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"events": appendEvent(newEvent(EventUnblocked, "")),
+		}}},
+		{{Key: "$unset", Value: "timestamp_blocked"}},
+	}
+
+	// perform the update
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	_, err := db.staticSkylinks.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// SoftDelete marks the skylink with the given hash as deleted and records a
+// deleted event with the given detail. Soft-deleted skylinks are kept in the
+// database for auditing purposes but are excluded from all queries by default.
+// If skyd blocked the skylink already it gets removed from skyd's blocklist
+// like a reverted one, see HashesToUnblock. It returns ErrNoDocumentsFound if
+// there's no skylink with the given hash or if it was deleted already.
+func (db *DB) SoftDelete(ctx context.Context, hash Hash, detail string) error {
+	filter := db.skylinksFilter(bson.M{"hash": hash.String()})
+
+	// define the update, it's a pipeline so we can append the event to the
+	// existing ones, which might be null
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"deleted":    True,
+			"deleted_at": Now(),
+			"events":     appendEvent(newEvent(EventDeleted, detail)),
+		}}},
+	}
+
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	res, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNoDocumentsFound
+	}
+	return nil
+}
+
+// NumReports returns the number of reports made by the given MySkyID since the
+// given time.
+func (db *DB) NumReports(ctx context.Context, mySkyID string, since time.Time) (int, error) {
+	reports, _, err := db.ReportUsage(ctx, mySkyID, since)
+	return reports, err
+}
+
+// ReportUsage returns the number of reports made by the given MySkyID since
+// the given time, and the time of the oldest of those reports. The time is
+// zero if the MySkyID made no reports.
+func (db *DB) ReportUsage(ctx context.Context, mySkyID string, since time.Time) (int, time.Time, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"myskyid":         mySkyID,
+			"timestamp_added": bson.M{"$gte": since},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    nil,
+			"total":  bson.M{"$sum": "$reports"},
+			"oldest": bson.M{"$min": "$timestamp_added"},
+		}}},
+	}
+	defer db.trackQuery(collReports, "aggregate", pipeline)()
+	c, err := db.staticReports.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var result []struct {
+		Total  int       `bson:"total"`
+		Oldest time.Time `bson:"oldest"`
+	}
+	err = c.All(ctx, &result)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(result) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return result[0].Total, result[0].Oldest.UTC(), nil
+}
+
+// Ping sends a ping command to verify that the client can connect to the DB and
+// specifically to the primary.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.staticDB.Client().Ping(ctx, readpref.Primary())
+}
+
+// RecordReports records that the given MySkyID made n reports at the given
+// time. Records expire after the report window.
+func (db *DB) RecordReports(ctx context.Context, mySkyID string, n int, timestamp time.Time) error {
+	_, err := db.staticReports.InsertOne(ctx, Report{
+		MySkyID:        mySkyID,
+		Reports:        n,
+		TimestampAdded: timestamp,
+	})
+	return err
+}
+
+// LatestBlockTimestamp returns the latest block timestamp of the blocker with
+// the given server UID, it's the time of the start of its last successful
+// sweep. It returns false if the blocker never stored one.
+func (db *DB) LatestBlockTimestamp(ctx context.Context, serverUID string) (time.Time, bool, error) {
+	filter := bson.M{"server_uid": serverUID}
+	defer db.trackQuery(collLatestBlockTimestamps, "findOne", filter)()
+
+	var doc LatestBlockTimestamp
+	err := db.staticLatestBlockTimestamps.FindOne(ctx, filter).Decode(&doc)
+	if isDocumentNotFound(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return doc.Timestamp, true, nil
+}
+
+// UpdateLatestBlockTimestamp stores the latest block timestamp of the blocker
+// with the given server UID, along with the time it was updated.
+func (db *DB) UpdateLatestBlockTimestamp(ctx context.Context, serverUID string, timestamp time.Time) error {
+	filter := bson.M{"server_uid": serverUID}
+	update := bson.M{"$set": bson.M{"timestamp": timestamp, "last_updated": Now()}}
+	opts := options.Update().SetUpsert(true)
+
+	defer db.trackQuery(collLatestBlockTimestamps, "updateOne", filter)()
+	_, err := db.staticLatestBlockTimestamps.UpdateOne(ctx, filter, update, opts)
+	return err
+}
+
+// LatestBlockTimestamps returns the latest block timestamps of all blockers,
+// sorted by server UID.
+func (db *DB) LatestBlockTimestamps(ctx context.Context) ([]LatestBlockTimestamp, error) {
+	filter := bson.M{}
+	opts := options.Find().SetSort(bson.M{"server_uid": 1})
+
+	defer db.trackQuery(collLatestBlockTimestamps, "find", filter)()
+	c, err := db.staticLatestBlockTimestamps.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to query latest block timestamps")
+	}
+	docs := make([]LatestBlockTimestamp, 0)
+	err = c.All(ctx, &docs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode latest block timestamps")
+	}
+	return docs, nil
+}
+
+// PruneLatestBlockTimestamps removes the latest block timestamps that weren't
+// updated since the given time, they belong to blockers that no longer run.
+// Timestamps stored before we kept track of their last update are removed if
+// the timestamp itself is older. The timestamp of the given server UID is never
+// removed, a blocker doesn't prune its own. It returns the number of removed
+// timestamps.
+func (db *DB) PruneLatestBlockTimestamps(ctx context.Context, before time.Time, except string) (int, error) {
+	filter := bson.M{
+		"server_uid": bson.M{"$ne": except},
+		"$or": bson.A{
+			bson.M{"last_updated": bson.M{"$lt": before}},
+			bson.M{"last_updated": bson.M{"$exists": false}, "timestamp": bson.M{"$lt": before}},
+		},
+	}
+
+	defer db.trackQuery(collLatestBlockTimestamps, "deleteMany", filter)()
+	res, err := db.staticLatestBlockTimestamps.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to prune latest block timestamps")
+	}
+	return int(res.DeletedCount), nil
+}
+
+// LatestTimestampAdded returns the time the most recently added skylink out of
+// the skylinks with the given hashes was added, it's zero if none of them is
+// in the database.
+func (db *DB) LatestTimestampAdded(ctx context.Context, hashes []Hash) (time.Time, error) {
+	if len(hashes) == 0 {
+		return time.Time{}, nil
+	}
+	filter := db.skylinksFilter(bson.M{"hash": bson.M{"$in": hashes}})
+	opts := options.FindOne()
+	opts.SetProjection(bson.M{"timestamp_added": 1})
+	opts.SetSort(timestampAddedSort(-1))
+
+	defer db.trackQuery(collSkylinks, "findOne", filter)()
+	var doc BlockedSkylink
+	err := db.staticSkylinks.FindOne(ctx, filter, opts).Decode(&doc)
+	if isDocumentNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return doc.TimestampAdded, nil
+}
+
+// Purge deletes all documents from all collections in the database
+//
+// NOTE: this function should never be called in production and should only be
+// used for testing purposes
+func (db *DB) Purge(ctx context.Context) error {
+	_, err := db.staticSkylinks.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge skylinks collection")
+	}
+	_, err = db.staticAllowList.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge allowlist collection")
+	}
+	_, err = db.staticAllowListPublishers.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge allowlist publishers collection")
+	}
+	_, err = db.staticProofs.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge proofs collection")
+	}
+	_, err = db.staticReports.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge reports collection")
+	}
+	_, err = db.staticLatestBlockTimestamps.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge latest block timestamps collection")
+	}
+	_, err = db.staticBlockedIdentities.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge blocked identities collection")
+	}
+	_, err = db.staticAllowListHits.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge allowlist hits collection")
+	}
+	_, err = db.staticSkylinksArchive.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge skylinks archive collection")
+	}
+	_, err = db.staticMigrations.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return errors.AddContext(err, "failed to purge migrations collection")
+	}
+	return nil
+}
+
+// HashesToBlock sweeps the database for unblocked hashes after the given
+// timestamp. The hashes are sorted by severity, critical ones come first.
+// Within a severity, hashes of content that was missing when it got reported
+// come last, they're still blocked as the content could return. Soft-deleted
+// skylinks are excluded unless the IncludeDeleted option is given.
+func (db *DB) HashesToBlock(ctx context.Context, from time.Time, queryOpts ...QueryOption) ([]Hash, error) {
+	// NOTE: $ne: true is not the same as $eq: false
+	filter := db.skylinksFilter(bson.M{
+		"timestamp_added":     bson.M{"$gte": from},
+		"failed":              bson.M{"$ne": true},
+		"invalid":             bson.M{"$ne": true},
+		"reverted":            bson.M{"$ne": true},
+		"skipped_allowlisted": bson.M{"$ne": true},
+	}, queryOpts...)
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 1, "severity": 1, "tags": 1, "content_missing": 1})
+
+	var docs []hashDoc
+	err := db.findHashDocs(ctx, filter, func(doc hashDoc) {
+		docs = append(docs, doc)
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the documents by severity, documents without one are ranked by
+	// their tags if a mapping was given
+	severities := newQueryOptions(queryOpts...).severities
+	rank := func(doc hashDoc) int {
+		if doc.Severity == "" {
+			return severityRank(severities.Severity(doc.Tags))
+		}
+		return severityRank(doc.Severity)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		if rank(docs[i]) != rank(docs[j]) {
+			return rank(docs[i]) > rank(docs[j])
+		}
+		return !docs[i].ContentMissing && docs[j].ContentMissing
+	})
+
+	// Extract the hashes
+	hashes := make([]Hash, len(docs))
+	for i, doc := range docs {
+		hashes[i] = doc.Hash
+	}
+	return hashes, nil
+}
+
+// HashesToRetry returns the hashes that failed to get blocked the first time
+// around. This is a retry mechanism to ensure we keep retrying to block those
+// hashes, but at the same try 'unblock' the main block loop in order for it
+// to run smoothly. Transient failures are returned first, followed by the
+// permanent ones and the ones that failed before failures got classified,
+// within each class the oldest hashes come first. At most 'limit' hashes are
+// returned, a limit of zero or less returns all of them. Soft-deleted
+// skylinks are excluded unless the IncludeDeleted option is given.
+func (db *DB) HashesToRetry(ctx context.Context, limit int, queryOpts ...QueryOption) ([]Hash, error) {
+	// NOTE: $ne: true is not the same as $eq: false
+	filter := db.skylinksFilter(bson.M{
+		"failed":              bson.M{"$eq": true},
+		"invalid":             bson.M{"$ne": true},
+		"reverted":            bson.M{"$ne": true},
+		"skipped_allowlisted": bson.M{"$ne": true},
+	}, queryOpts...)
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 1})
+
+	// NOTE: sorting the failure class in descending order puts 'transient'
+	// before 'permanent', documents without a class come last as null sorts
+	// before any string
+	opts.SetSort(bson.D{
+		{Key: "failure_class", Value: -1},
+		{Key: "timestamp_added", Value: 1},
+		{Key: "_id", Value: 1},
+	})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	return db.findHashes(ctx, filter, opts)
+}
+
+// SkylinksAfter returns at most 'limit' skylinks of which the id is greater
+// than the given id, sorted by id, which allows scanning all skylinks in pages
+// of bounded size. Soft-deleted skylinks are included. Only the hash, the
+// state flags and the time the skylink got blocked are returned.
+func (db *DB) SkylinksAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]BlockedSkylink, error) {
+	filter := db.skylinksFilter(bson.M{
+		"_id": bson.M{"$gt": after},
+	}, IncludeDeleted())
+	opts := options.Find()
+	opts.SetProjection(bson.M{
+		"hash":              1,
+		"deleted":           1,
+		"failed":            1,
+		"invalid":           1,
+		"reverted":          1,
+		"timestamp_blocked": 1,
+	})
+	opts.SetSort(bson.M{"_id": 1})
+	opts.SetLimit(int64(limit))
+	return db.find(ctx, filter, opts)
 }
 
-// updateFailedFlag is a helper method that updates the failed flag on the
-// documents that correspond with the skylinks in the given array.
-func (db *DB) updateFailedFlag(ctx context.Context, hashes []Hash, failed bool) error {
+// ClearBlocked clears the time the skylinks with the given hashes got blocked,
+// which makes them pending again. It's meant for skylinks that skyd confirmed
+// blocking but that are no longer on its blocklist.
+func (db *DB) ClearBlocked(ctx context.Context, hashes []Hash) error {
 	// return early if no hashes were given
 	if len(hashes) == 0 {
 		return nil
 	}
 
-	// create the filter, make sure to specify currently unblocked skylinks
-	filter := bson.M{
-		"hash":   bson.M{"$in": hashes},
-		"failed": bson.M{"$eq": !failed},
+	filter := db.namespaced(bson.M{
+		"hash":              bson.M{"$in": hashes},
+		"timestamp_blocked": bson.M{"$exists": true},
+	})
+	update := bson.M{
+		"$unset": bson.M{"timestamp_blocked": ""},
+		"$push":  pushEvent(newEvent(EventRequeued, "missing from skyd's blocklist")),
+	}
 
-		// just to be on the safe side we ensure we never update invalid
-		// documents, the filters that fetch documents do this as well so this
-		// is only here to keep the database as clean as possible
-		"invalid": bson.M{"$eq": false},
+	defer db.trackQuery(collSkylinks, "updateMany", filter)()
+	_, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+	return err
+}
+
+// CallbacksToDeliver returns at most 'limit' skylinks that carry a callback
+// url and that reached their final state, meaning they're either confirmed
+// blocked or invalid. They are sorted by the time they were added.
+func (db *DB) CallbacksToDeliver(ctx context.Context, limit int) ([]BlockedSkylink, error) {
+	filter := db.skylinksFilter(bson.M{
+		"callback_url": bson.M{"$exists": true},
+		"$or": bson.A{
+			bson.M{"timestamp_blocked": bson.M{"$exists": true}},
+			bson.M{"invalid": bson.M{"$eq": true}},
+		},
+	})
+	opts := options.Find()
+	opts.SetSort(bson.D{
+		{Key: "timestamp_added", Value: 1},
+		{Key: "_id", Value: 1},
+	})
+	opts.SetLimit(int64(limit))
+	return db.find(ctx, filter, opts)
+}
+
+// ClearCallback removes the callback url of the skylink with the given hash,
+// along with the number of attempts to deliver it. It's called once the
+// callback got delivered, or once we gave up on delivering it.
+func (db *DB) ClearCallback(ctx context.Context, hash Hash) error {
+	filter := db.namespaced(bson.M{"hash": hash.String()})
+	update := bson.M{
+		"$unset": bson.M{"callback_url": "", "callback_attempts": ""},
 	}
 
-	// define the update
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	_, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// IncrementCallbackAttempts increments the number of failed attempts to
+// deliver the callback of the skylink with the given hash.
+func (db *DB) IncrementCallbackAttempts(ctx context.Context, hash Hash) error {
+	filter := db.namespaced(bson.M{
+		"hash":         hash.String(),
+		"callback_url": bson.M{"$exists": true},
+	})
 	update := bson.M{
-		"$set": bson.M{
-			"failed": failed,
-		},
+		"$inc": bson.M{"callback_attempts": 1},
 	}
 
-	// perform the update
-	collSkylinks := db.staticDB.Collection(collSkylinks)
-	_, err := collSkylinks.UpdateMany(ctx, filter, update)
+	defer db.trackQuery(collSkylinks, "updateOne", filter)()
+	_, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
 	return err
 }
 
+// find wraps the `Find` function on the Skylinks collection and returns an
+// array of decoded blocked skylink objects
+func (db *DB) find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) ([]BlockedSkylink, error) {
+	defer db.trackQuery(collSkylinks, "find", filter)()
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts...)
+	if isDocumentNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BlockedSkylink, 0)
+	err = c.All(ctx, &list)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].resolveOrigin()
+	}
+	return list, nil
+}
+
+// hashDoc is the minimal document the sweep queries decode into, it only
+// holds the fields they project. Decoding into it rather than a
+// BlockedSkylink saves allocating the fields that aren't projected for every
+// document.
+type hashDoc struct {
+	Hash           Hash     `bson:"hash"`
+	ContentMissing bool     `bson:"content_missing,omitempty"`
+	Severity       string   `bson:"severity,omitempty"`
+	Tags           []string `bson:"tags,omitempty"`
+}
+
+// LatestBlockTimestamp is the document that holds the latest block timestamp
+// of a blocker, blockers are identified by their server UID. LastUpdated is
+// the time the blocker last stored it, it's zero for timestamps that were
+// stored before it was kept track of.
+type LatestBlockTimestamp struct {
+	ServerUID   string    `bson:"server_uid"`
+	Timestamp   time.Time `bson:"timestamp"`
+	LastUpdated time.Time `bson:"last_updated,omitempty"`
+}
+
+// findHashDocs wraps the `Find` function on the Skylinks collection, it
+// decodes the documents one by one into a hashDoc and passes them to the given
+// function, which avoids holding all decoded documents in memory. The
+// projection of the given options should be limited to the fields of hashDoc.
+func (db *DB) findHashDocs(ctx context.Context, filter interface{}, fn func(hashDoc),
+	opts ...*options.FindOptions) error {
+	defer db.trackQuery(collSkylinks, "find", filter)()
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts...)
+	if isDocumentNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close(ctx)
+
+	for c.Next(ctx) {
+		var doc hashDoc
+		err = c.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		fn(doc)
+	}
+	return c.Err()
+}
+
+// findHashes returns the hashes of the documents that match the given filter,
+// see findHashDocs.
+func (db *DB) findHashes(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) ([]Hash, error) {
+	hashes := make([]Hash, 0)
+	err := db.findHashDocs(ctx, filter, func(doc hashDoc) {
+		hashes = append(hashes, doc.Hash)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// findOne wraps the `FindOne` function on the Skylinks collection and returns
+// a decoded blocked skylink object
+func (db *DB) findOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) (*BlockedSkylink, error) {
+	defer db.trackQuery(collSkylinks, "findOne", filter)()
+	sr := db.staticDB.Collection(collSkylinks).FindOne(ctx, filter, opts...)
+	if isDocumentNotFound(sr.Err()) {
+		return nil, nil
+	}
+	if sr.Err() != nil {
+		return nil, sr.Err()
+	}
+
+	var sl BlockedSkylink
+	err := sr.Decode(&sl)
+	if err != nil {
+		return nil, err
+	}
+	sl.resolveOrigin()
+	return &sl, nil
+}
+
+// pushEvent returns the '$push' operation that appends the given event to the
+// events of a document, only the last MaxEvents events are kept.
+func pushEvent(event Event) bson.M {
+	return bson.M{
+		"events": bson.M{
+			"$each":  bson.A{event},
+			"$slice": -MaxEvents,
+		},
+	}
+}
+
+// appendEvent returns the expression that appends the given event to the
+// events of a document, it's the equivalent of pushEvent for updates that are
+// pipelines. Only the last MaxEvents events are kept.
+func appendEvent(event Event) bson.M {
+	return bson.M{"$slice": bson.A{
+		bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$events", bson.A{}}},
+			bson.A{bson.M{"$literal": event}},
+		}},
+		-MaxEvents,
+	}}
+}
+
+// insertBlockedSkylinks is a helper method that inserts the given blocked
+// skylinks in the database, they're expected to be validated by the caller.
+// The insert is unordered, meaning a single write failure doesn't prevent the
+// other writes from going through.
+func (db *DB) insertBlockedSkylinks(ctx context.Context, skylinks []BlockedSkylink) (*mongo.InsertManyResult, error) {
+	// Convert the given array to an interface array, inserting the skylinks
+	// into our namespace
+	docs := make([]interface{}, len(skylinks))
+	for i, doc := range skylinks {
+		doc.Namespace = db.staticNamespace
+		docs[i] = doc
+	}
+
+	// Create insert options, we set ordered to false to ensure a single write
+	// failure doesn't prevent the other writes from going through. We need this
+	// because we expect duplicates and want to simply ignore them.
+	opts := options.InsertMany()
+	opts.SetOrdered(false)
+
+	defer db.trackQuery(collSkylinks, "insertMany", nil)()
+	return db.staticSkylinks.InsertMany(ctx, docs, opts)
+}
+
+// insertBlockedSkylinkChunks inserts the given skylinks in chunks of at most
+// the insert chunk size, every chunk is inserted unordered. Duplicate key
+// errors are ignored, it returns the number of inserted skylinks and the
+// indices of the skylinks that already existed. The context is checked in
+// between chunks, if it's done or if a chunk fails to get inserted, the number
+// of skylinks inserted so far is returned along with the error.
+func (db *DB) insertBlockedSkylinkChunks(ctx context.Context, skylinks []BlockedSkylink) (int, []int, error) {
+	// Validate all skylinks up front so we don't insert a partial bulk
+	for _, skylink := range skylinks {
+		err := skylink.Validate()
+		if err != nil {
+			return 0, nil, errors.AddContext(err, "unexpected blocked skylink")
+		}
+	}
+
+	db.staticMu.Lock()
+	chunkSize := db.insertChunkSize
+	db.staticMu.Unlock()
+	if chunkSize <= 0 {
+		chunkSize = DefaultInsertChunkSize
+	}
+
+	var inserted int
+	var duplicates []int
+	for start := 0; start < len(skylinks); start += chunkSize {
+		// check whether the context is done before inserting the next chunk
+		if err := ctx.Err(); err != nil {
+			return inserted, duplicates, errors.AddContext(err, fmt.Sprintf("interrupted after inserting %v of %v skylinks", inserted, len(skylinks)))
+		}
+
+		end := start + chunkSize
+		if end > len(skylinks) {
+			end = len(skylinks)
+		}
+		chunk := skylinks[start:end]
+
+		var err error
+		if db.insertFailpoint != nil {
+			err = db.insertFailpoint(start / chunkSize)
+		}
+		if err == nil {
+			_, err = db.insertBlockedSkylinks(ctx, chunk)
+		}
+
+		// collect the duplicates before ignoring the duplicate key errors
+		chunkDuplicates := duplicateKeyIndices(err)
+		if err = ignoreDuplicateKeyErrors(err); err != nil {
+			// the chunk is inserted unordered, so the documents without a
+			// write error made it into the database
+			if bwErr, ok := err.(mongo.BulkWriteException); ok && bwErr.WriteConcernError == nil {
+				inserted += len(chunk) - len(bwErr.WriteErrors)
+			}
+			return inserted, duplicates, errors.AddContext(err, fmt.Sprintf("failed to insert skylinks %v to %v", start, end))
+		}
+		inserted += len(chunk) - len(chunkDuplicates)
+		for _, index := range chunkDuplicates {
+			duplicates = append(duplicates, start+index)
+		}
+	}
+	return inserted, duplicates, nil
+}
+
+// SetInsertChunkSize sets the maximum number of blocked skylinks that get
+// inserted at once, it defaults to DefaultInsertChunkSize.
+func (db *DB) SetInsertChunkSize(size int) {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	db.insertChunkSize = size
+}
+
+// duplicateKeyIndices takes an error, if that error is a mongo
+// BulkWriteException, it returns the indices of the documents that failed to
+// get inserted due to a duplicate key error.
+func duplicateKeyIndices(err error) []int {
+	bWriteErr, ok := err.(mongo.BulkWriteException)
+	if !ok {
+		return nil
+	}
+
+	var indices []int
+	for _, bWriteError := range bWriteErr.WriteErrors {
+		if isDuplicateKey(bWriteError) {
+			indices = append(indices, bWriteError.Index)
+		}
+	}
+	return indices
+}
+
 // ignoreDuplicateKeyErrors takes an error, if that error is a mongo
 // BulkWriteException, it will loop through the write errors and ignore
 // duplicate key errors. If all write errors were duplicate key errors, this
@@ -508,16 +2116,60 @@ func ignoreDuplicateKeyErrors(err error) error {
 }
 
 // ensureDBSchema checks that we have all collections and indexes we need and
-// creates them if needed.
+// creates them if needed. Existing indexes of which the keys or options differ
+// from the schema are dropped and re-created, it returns a summary of what
+// happened to every index of the schema.
 // See https://docs.mongodb.com/manual/indexes/
 // See https://docs.mongodb.com/manual/core/index-unique/
-func ensureDBSchema(ctx context.Context, db *mongo.Database, log *logrus.Logger) error {
-	// schema defines a mapping between a collection name and the indexes that
-	// must exist for that collection.
-	schema := map[string][]mongo.IndexModel{
+func ensureDBSchema(ctx context.Context, db *mongo.Database, buildOpts IndexBuildOptions, log *logrus.Entry) (schemaSummary, error) {
+	// ensure all collections and indices exist
+	var summary schemaSummary
+	var createErr error
+	for collName, models := range dbSchema() {
+		coll, err := ensureCollection(ctx, db, collName)
+		if err != nil {
+			// no need to continue if ensuring a collection fails
+			return summary, err
+		}
+
+		// if ensuring the indexes fails, compose the error but continue to
+		// try and ensure the rest of the database schema
+		err = ensureIndexes(ctx, coll, models, buildOpts, log, &summary)
+		if err != nil {
+			createErr = errors.Compose(createErr, errors.AddContext(err, fmt.Sprintf("collection '%v'", collName)))
+		}
+	}
+	if createErr != nil {
+		createErr = errors.Compose(createErr, ErrIndexCreateFailed)
+	}
+	summary.sort()
+	log.WithFields(logrus.Fields{
+		"created":   summary.Created,
+		"kept":      summary.Kept,
+		"recreated": summary.Recreated,
+		"failed":    summary.Failed,
+	}).Info("Ensured database schema")
+
+	// drop the old indices on 'skylink' and the index on 'timestamp_blocked'
+	// that got superseded by the pending index
+	_, err1 := dropIndex(ctx, db.Collection(collAllowlist), "skylink")
+	_, err2 := dropIndex(ctx, db.Collection(collSkylinks), "skylink")
+	_, err3 := dropIndex(ctx, db.Collection(collSkylinks), "timestamp_blocked")
+	dropErr := errors.Compose(err1, err2, err3)
+	if dropErr != nil {
+		dropErr = errors.Compose(dropErr, ErrIndexDropFailed)
+	}
+
+	return summary, errors.Compose(createErr, dropErr)
+}
+
+// dbSchema returns a mapping between a collection name and the indexes that
+// must exist for that collection.
+func dbSchema() map[string][]mongo.IndexModel {
+	return map[string][]mongo.IndexModel{
 		collAllowlist: {
 			{
-				Keys:    bson.M{"hash": 1},
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "hash", Value: 1}},
 				Options: options.Index().SetName("hash").SetUnique(true),
 			},
 			{
@@ -525,15 +2177,75 @@ func ensureDBSchema(ctx context.Context, db *mongo.Database, log *logrus.Logger)
 				Options: options.Index().SetName("timestamp_added"),
 			},
 		},
-		collSkylinks: {
+		collAllowListHits: {
+			{
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "hash", Value: 1}},
+				Options: options.Index().SetName("hash"),
+			},
+			{
+				Keys:    bson.M{"timestamp_added": 1},
+				Options: options.Index().SetName("timestamp_added").SetExpireAfterSeconds(int32(AllowListHitWindow.Seconds())),
+			},
+		},
+		collAllowListPublishers: {
+			{
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "public_key", Value: 1}},
+				Options: options.Index().SetName("public_key").SetUnique(true),
+			},
+		},
+		collBlockedIdentities: {
+			{
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "myskyid", Value: 1}},
+				Options: options.Index().SetName("myskyid").SetUnique(true),
+			},
+		},
+		collLatestBlockTimestamps: {
+			{
+				Keys:    bson.M{"server_uid": 1},
+				Options: options.Index().SetName("server_uid").SetUnique(true),
+			},
+		},
+		collProofs: {
 			{
 				Keys:    bson.M{"hash": 1},
 				Options: options.Index().SetName("hash").SetUnique(true),
 			},
 			{
 				Keys:    bson.M{"timestamp_added": 1},
+				Options: options.Index().SetName("timestamp_added").SetExpireAfterSeconds(int32(proofUsageWindow.Seconds())),
+			},
+		},
+		collReports: {
+			{
+				Keys:    bson.M{"myskyid": 1},
+				Options: options.Index().SetName("myskyid"),
+			},
+			{
+				Keys:    bson.M{"timestamp_added": 1},
+				Options: options.Index().SetName("timestamp_added").SetExpireAfterSeconds(int32(ReportWindow.Seconds())),
+			},
+		},
+		collSkylinks: {
+			{
+				// NOTE: the same hash can be blocked in every namespace
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "hash", Value: 1}},
+				Options: options.Index().SetName("hash").SetUnique(true),
+			},
+			{
+				// NOTE: the index includes the id because it's the
+				// tiebreaker of the sort on timestamp_added
+				Keys:    bson.D{{Key: "timestamp_added", Value: 1}, {Key: "_id", Value: 1}},
 				Options: options.Index().SetName("timestamp_added"),
 			},
+			{
+				// NOTE: this index backs the listing of the pending
+				// skylinks and the lookup of the oldest skylink that
+				// isn't blocked yet, which don't have a
+				// timestamp_blocked, the id is the tiebreaker of the
+				// sort on timestamp_added
+				Keys:    bson.D{{Key: "timestamp_blocked", Value: 1}, {Key: "timestamp_added", Value: 1}, {Key: "_id", Value: 1}},
+				Options: options.Index().SetName("pending"),
+			},
 			{
 				Keys:    bson.M{"failed": 1},
 				Options: options.Index().SetName("failed"),
@@ -542,47 +2254,46 @@ func ensureDBSchema(ctx context.Context, db *mongo.Database, log *logrus.Logger)
 				Keys:    bson.M{"invalid": 1},
 				Options: options.Index().SetName("invalid"),
 			},
+			{
+				Keys:    bson.M{"reporter.email": 1},
+				Options: options.Index().SetName("reporter_email").SetCollation(reporterCollation),
+			},
+			{
+				Keys:    bson.M{"reporter.sub": 1},
+				Options: options.Index().SetName("reporter_sub").SetCollation(reporterCollation),
+			},
+			{
+				Keys:    bson.M{"metadata.$**": 1},
+				Options: options.Index().SetName("metadata"),
+			},
+			{
+				// NOTE: the index is sparse because only a fraction of
+				// the skylinks carry a callback, and only until it's
+				// delivered
+				Keys:    bson.M{"callback_url": 1},
+				Options: options.Index().SetName("callback_url").SetSparse(true),
+			},
+		},
+		collSkylinksArchive: {
+			{
+				Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "hash", Value: 1}},
+				Options: options.Index().SetName("hash").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"timestamp_archived": 1},
+				Options: options.Index().SetName("timestamp_archived"),
+			},
 		},
 	}
+}
 
-	// build the options
+// indexCreateOptions returns the options used when creating indexes, a build
+// is aborted by the database after the given amount of time.
+func indexCreateOptions(timeout time.Duration) *options.CreateIndexesOptions {
 	opts := options.CreateIndexes()
-	opts.SetMaxTime(mongoIndexCreateTimeout)
+	opts.SetMaxTime(timeout)
 	opts.SetCommitQuorumString("majority") // defaults to all
-
-	// ensure all collections and indices exist
-	var createErr error
-	for collName, models := range schema {
-		coll, err := ensureCollection(ctx, db, collName)
-		if err != nil {
-			// no need to continue if ensuring a collection fails
-			return err
-		}
-
-		iv := coll.Indexes()
-		names, err := iv.CreateMany(ctx, models, opts)
-		if err != nil {
-			// if the index creation fails, compose the error but continue to
-			// try and ensure the rest of the database schema
-			createErr = errors.Compose(createErr, errors.AddContext(err, fmt.Sprintf("collection '%v'", collName)))
-			continue
-		}
-
-		log.Debugf("Ensured index exists: %v | %v", collName, names)
-	}
-	if createErr != nil {
-		createErr = errors.Compose(createErr, ErrIndexCreateFailed)
-	}
-
-	// drop the old indices on 'skylink'
-	_, err1 := dropIndex(ctx, db.Collection(collAllowlist), "skylink")
-	_, err2 := dropIndex(ctx, db.Collection(collSkylinks), "skylink")
-	dropErr := errors.Compose(err1, err2)
-	if dropErr != nil {
-		dropErr = errors.Compose(dropErr, ErrIndexDropFailed)
-	}
-
-	return errors.Compose(createErr, dropErr)
+	return opts
 }
 
 // dropIndex is a helper function that drops the index with given name on the
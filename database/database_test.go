@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -13,7 +14,9 @@ import (
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/crypto"
 )
 
@@ -33,6 +36,10 @@ func TestDatabase(t *testing.T) {
 			name: "BlockedHashes",
 			test: testBlockedHashes,
 		},
+		{
+			name: "PendingHashes",
+			test: testPendingHashes,
+		},
 
 		{
 			name: "CreateBlockedSkylink",
@@ -46,6 +53,10 @@ func TestDatabase(t *testing.T) {
 			name: "IgnoreDuplicateKeyErrors",
 			test: testIgnoreDuplicateKeyErrors,
 		},
+		{
+			name: "IncrementProofUsage",
+			test: testIncrementProofUsage,
+		},
 		{
 			name: "IsAllowListedSkylink",
 			test: testIsAllowListedSkylink,
@@ -62,6 +73,10 @@ func TestDatabase(t *testing.T) {
 			name: "MarkInvalid",
 			test: testMarkInvalid,
 		},
+		{
+			name: "NumReports",
+			test: testNumReports,
+		},
 		{
 			name: "HasIndex",
 			test: testHasIndex,
@@ -74,6 +89,86 @@ func TestDatabase(t *testing.T) {
 			name: "Ping",
 			test: testPing,
 		},
+		{
+			name: "SchemaHealth",
+			test: testSchemaHealth,
+		},
+		{
+			name: "EnsureDBSchema",
+			test: testEnsureDBSchema,
+		},
+		{
+			name: "IndexBuildOptions",
+			test: testIndexBuildOptions,
+		},
+		{
+			name: "FindByReporter",
+			test: testFindByReporter,
+		},
+		{
+			name: "MigrateOrigins",
+			test: testMigrateOrigins,
+		},
+		{
+			name: "ActivitySeries",
+			test: testActivitySeries,
+		},
+		{
+			name: "SoftDelete",
+			test: testSoftDelete,
+		},
+		{
+			name: "BlockLatency",
+			test: testBlockLatency,
+		},
+		{
+			name: "TimestampRoundTrip",
+			test: testTimestampRoundTrip,
+		},
+		{
+			name: "HashesToBlockSeverity",
+			test: testHashesToBlockSeverity,
+		},
+		{
+			name: "Metadata",
+			test: testMetadata,
+		},
+		{
+			name: "AddTags",
+			test: testAddTags,
+		},
+		{
+			name: "BlockedHashesEqualTimestamps",
+			test: testBlockedHashesEqualTimestamps,
+		},
+		{
+			name: "Namespaces",
+			test: testNamespaces,
+		},
+		{
+			name: "BackfillNamespace",
+			test: testBackfillNamespace,
+		},
+		{
+			name: "Callbacks",
+			test: testCallbacks,
+		},
+		{
+			name: "FindHashes",
+			test: testFindHashes,
+		},
+		{
+			name: "RevertTags",
+			test: testRevertTags,
+		},
+		{
+			name: "LatestBlockTimestamp",
+			test: testLatestBlockTimestamp,
+		},
+		{
+			name: "BlockedIdentities",
+			test: testBlockedIdentities,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, test.test)
@@ -87,13 +182,7 @@ func testBlockedHashes(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// assert there's no hash that needs to be blocked
 	toBlock, err := db.HashesToBlock(ctx, time.Time{})
@@ -110,7 +199,7 @@ func testBlockedHashes(t *testing.T) {
 		Hash:           hash,
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -134,13 +223,7 @@ func testCreateBlockedSkylink(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// verify we assert 'Hash' is set
 	err := db.CreateBlockedSkylink(ctx, &BlockedSkylink{})
@@ -155,7 +238,7 @@ func testCreateBlockedSkylink(t *testing.T) {
 	}
 	err = db.CreateBlockedSkylink(ctx, &BlockedSkylink{
 		Hash:           HashBytes([]byte("somehash")),
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	if err != nil {
 		t.Fatal("unexpected error", err)
@@ -170,7 +253,7 @@ func testCreateBlockedSkylink(t *testing.T) {
 	hash := NewHash(sl)
 
 	// create a blocked skylink struct
-	now := time.Now().Round(time.Second).UTC()
+	now := Now()
 	bsl := &BlockedSkylink{
 		Hash: hash,
 		Reporter: Reporter{
@@ -220,27 +303,21 @@ func testCreateBlockedSkylinkBulk(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// create three blocked skylinks in bulk, make sure it contains a duplicate
 	added, err := db.CreateBlockedSkylinkBulk(ctx, []BlockedSkylink{
 		{
 			Hash:           HashBytes([]byte("somehash1")),
-			TimestampAdded: time.Now().UTC(),
+			TimestampAdded: Now(),
 		},
 		{
 			Hash:           HashBytes([]byte("somehash2")),
-			TimestampAdded: time.Now().UTC(),
+			TimestampAdded: Now(),
 		},
 		{
 			Hash:           HashBytes([]byte("somehash1")),
-			TimestampAdded: time.Now().UTC(),
+			TimestampAdded: Now(),
 		},
 	})
 
@@ -251,6 +328,71 @@ func testCreateBlockedSkylinkBulk(t *testing.T) {
 	if added != 2 {
 		t.Fatalf("unexpected amount of skylinks blocked, %v != 2", added)
 	}
+
+	// create ten skylinks that contain duplicates within a chunk and across
+	// chunks, using a chunk size of three
+	db = NewTestDB(ctx, t.Name()+"Chunked", WithCleanup(t))
+	db.SetInsertChunkSize(3)
+	var skylinks []BlockedSkylink
+	for _, i := range []int{0, 1, 0, 2, 3, 2, 4, 5, 6, 1} {
+		skylinks = append(skylinks, BlockedSkylink{
+			Hash:           HashBytes([]byte(fmt.Sprintf("chunked_%d", i))),
+			TimestampAdded: Now(),
+		})
+	}
+
+	// assert a failure on the second chunk returns the number of skylinks
+	// inserted by the first chunk
+	errFailpoint := errors.New("failpoint")
+	db.insertFailpoint = func(chunk int) error {
+		if chunk == 1 {
+			return errFailpoint
+		}
+		return nil
+	}
+	added, err = db.CreateBlockedSkylinkBulk(ctx, skylinks)
+	if !errors.Contains(err, errFailpoint) {
+		t.Fatal("unexpected error", err)
+	}
+	if added != 2 {
+		t.Fatalf("unexpected amount of skylinks blocked, %v != 2", added)
+	}
+
+	// assert retrying the bulk inserts the remaining skylinks
+	db.insertFailpoint = nil
+	added, err = db.CreateBlockedSkylinkBulk(ctx, skylinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 5 {
+		t.Fatalf("unexpected amount of skylinks blocked, %v != 5", added)
+	}
+	count, err := db.staticSkylinks.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 {
+		t.Fatalf("unexpected amount of documents, %v != 7", count)
+	}
+
+	// assert the duplicates are reported by their index in the batch
+	db = NewTestDB(ctx, t.Name()+"Batch", WithCleanup(t))
+	db.SetInsertChunkSize(3)
+	duplicates, err := db.CreateBlockedSkylinkBatch(ctx, skylinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(duplicates) != "[2 5 9]" {
+		t.Fatal("unexpected duplicates", duplicates)
+	}
+
+	// assert a done context interrupts the bulk before the first chunk
+	cancelled, cancelFn := context.WithCancel(ctx)
+	cancelFn()
+	added, err = db.CreateBlockedSkylinkBulk(cancelled, skylinks)
+	if !errors.Contains(err, context.Canceled) || added != 0 {
+		t.Fatal("unexpected outcome", added, err)
+	}
 }
 
 // testIgnoreDuplicateKeyErrors is a unit test that verifies the functionality
@@ -261,23 +403,17 @@ func testIgnoreDuplicateKeyErrors(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// insert two documents with the same hash (triggers duplicate key error)
 	docs := []interface{}{
 		BlockedSkylink{
 			Hash:           HashBytes([]byte("skylink_1")),
-			TimestampAdded: time.Now().UTC(),
+			TimestampAdded: Now(),
 		},
 		BlockedSkylink{
 			Hash:           HashBytes([]byte("skylink_1")),
-			TimestampAdded: time.Now().UTC(),
+			TimestampAdded: Now(),
 		},
 	}
 	_, err := db.staticSkylinks.InsertMany(ctx, docs)
@@ -305,6 +441,45 @@ func testIgnoreDuplicateKeyErrors(t *testing.T) {
 	}
 }
 
+// testIncrementProofUsage is a unit test that covers the functionality of the
+// 'IncrementProofUsage' method on the database.
+func testIncrementProofUsage(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// assert the first use of a proof creates the counter
+	proof := HashBytes([]byte("proof_1"))
+	uses, err := db.IncrementProofUsage(ctx, proof, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses != 1 {
+		t.Fatalf("unexpected number of uses, %v != 1", uses)
+	}
+
+	// assert consecutive uses increment the counter
+	uses, err = db.IncrementProofUsage(ctx, proof, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses != 3 {
+		t.Fatalf("unexpected number of uses, %v != 3", uses)
+	}
+
+	// assert other proofs are tracked separately
+	uses, err = db.IncrementProofUsage(ctx, HashBytes([]byte("proof_2")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses != 1 {
+		t.Fatalf("unexpected number of uses, %v != 1", uses)
+	}
+}
+
 // testIsAllowListedSkylink tests the 'IsAllowListed' method on the database.
 func testIsAllowListedSkylink(t *testing.T) {
 	// create context
@@ -312,20 +487,14 @@ func testIsAllowListedSkylink(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// Add a skylink in the allow list
 	hash := randomHash()
 	err := db.CreateAllowListedSkylink(ctx, &AllowListedSkylink{
 		Hash:           Hash{hash},
 		Description:    "test skylink",
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -359,13 +528,7 @@ func testMarkSucceeded(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// ensure 'MarkSucceeded' can handle an empty slice
 	var empty []Hash
@@ -379,7 +542,7 @@ func testMarkSucceeded(t *testing.T) {
 		Hash:           HashBytes([]byte("skylink_1")),
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -388,14 +551,14 @@ func testMarkSucceeded(t *testing.T) {
 		Hash:           HashBytes([]byte("skylink_2")),
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 		Failed:         true,
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	toRetry, err := db.HashesToRetry(ctx)
+	toRetry, err := db.HashesToRetry(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -403,18 +566,88 @@ func testMarkSucceeded(t *testing.T) {
 		t.Fatalf("unexpected number of documents, %v != 1", len(toRetry))
 	}
 
+	// assert neither document carries the success marker, the unknown hash
+	// is in neither list
+	all := []Hash{HashBytes([]byte("skylink_1")), HashBytes([]byte("skylink_2")), HashBytes([]byte("unknown"))}
+	marked, unmarked, err := db.ReconcileBlocked(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marked) != 0 || len(unmarked) != 2 {
+		t.Fatal("unexpected", marked, unmarked)
+	}
+
 	err = db.MarkSucceeded(ctx, toRetry)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	toRetry, err = db.HashesToRetry(ctx)
+	// assert the document that succeeded carries the success marker
+	marked, unmarked, err = db.ReconcileBlocked(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marked) != 1 || marked[0] != toRetry[0] || len(unmarked) != 1 || unmarked[0] != all[0] {
+		t.Fatal("unexpected", marked, unmarked)
+	}
+
+	toRetry, err = db.HashesToRetry(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(toRetry) != 0 {
 		t.Fatalf("unexpected number of documents, %v != 0", len(toRetry))
 	}
+
+	// assert the success got recorded as an event
+	hash := HashBytes([]byte("skylink_2"))
+	doc, err := db.FindByHash(ctx, hash)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	assertEvents(t, doc, EventSucceeded)
+	blocked := doc.TimestampBlocked
+	if blocked.IsZero() {
+		t.Fatal("expected the timestamp blocked to be set")
+	}
+
+	// assert succeeding again keeps the time it got blocked first but records
+	// every success, up until the maximum number of events
+	for i := 0; i < MaxEvents; i++ {
+		err = db.MarkSucceeded(ctx, []Hash{hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	doc, err = db.FindByHash(ctx, hash)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if doc.TimestampBlocked != blocked {
+		t.Fatal("unexpected timestamp blocked", doc.TimestampBlocked, blocked)
+	}
+	expected := make([]string, MaxEvents)
+	for i := range expected {
+		expected[i] = EventSucceeded
+	}
+	assertEvents(t, doc, expected...)
+}
+
+// assertEvents is a helper that asserts the given skylink holds events of the
+// given types, in order, with timestamps that don't go back in time.
+func assertEvents(t *testing.T, doc *BlockedSkylink, types ...string) {
+	t.Helper()
+	if len(doc.Events) != len(types) {
+		t.Fatalf("unexpected number of events, %v != %v, %+v", len(doc.Events), len(types), doc.Events)
+	}
+	for i, event := range doc.Events {
+		if event.Type != types[i] {
+			t.Fatalf("unexpected event type at index %v, %v != %v", i, event.Type, types[i])
+		}
+		if event.Timestamp.IsZero() || (i > 0 && event.Timestamp.Before(doc.Events[i-1].Timestamp)) {
+			t.Fatalf("unexpected event timestamp at index %v, %v", i, event.Timestamp)
+		}
+	}
 }
 
 // testMarkFailed is a unit test that covers the functionality of the
@@ -425,39 +658,39 @@ func testMarkFailed(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// ensure 'MarkFailed' can handle an empty slice
 	var empty []Hash
-	err := db.MarkFailed(ctx, empty)
+	err := db.MarkFailed(ctx, empty, FailureClassTransient, "")
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// ensure 'MarkFailed' rejects unknown failure classes
+	err = db.MarkFailed(ctx, empty, "unknown", "")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
 	// insert two regular documents and one invalid one
 	err1 := db.CreateBlockedSkylink(ctx, &BlockedSkylink{
 		Hash:           HashBytes([]byte("skylink_1")),
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	err2 := db.CreateBlockedSkylink(ctx, &BlockedSkylink{
 		Hash:           HashBytes([]byte("skylink_2")),
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	err3 := db.CreateBlockedSkylink(ctx, &BlockedSkylink{
 		Hash:           HashBytes([]byte("skylink_3")),
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 		Invalid:        true,
 	})
 	if err := errors.Compose(err1, err2, err3); err != nil {
@@ -478,7 +711,7 @@ func testMarkFailed(t *testing.T) {
 	}
 
 	// check we currently have 0 failed hashes
-	toRetry, err := db.HashesToRetry(ctx)
+	toRetry, err := db.HashesToRetry(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -491,13 +724,13 @@ func testMarkFailed(t *testing.T) {
 	for i, doc := range all {
 		hashes[i] = doc.Hash
 	}
-	err = db.MarkFailed(ctx, hashes)
+	err = db.MarkFailed(ctx, hashes, FailureClassPermanent, "rejected")
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// check we now have 2
-	toRetry, err = db.HashesToRetry(ctx)
+	toRetry, err = db.HashesToRetry(ctx, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -505,12 +738,142 @@ func testMarkFailed(t *testing.T) {
 		t.Fatalf("unexpected number of documents, %v != 2", len(toRetry))
 	}
 
+	// mark the second hash as failed again, this time transiently, and
+	// assert its failure got updated and it's retried first
+	second := HashBytes([]byte("skylink_2"))
+	err = db.MarkFailed(ctx, []Hash{second}, FailureClassTransient, "unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := db.FindByHash(ctx, second)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if doc.FailureClass != FailureClassTransient || doc.FailureReason != "unreachable" {
+		t.Fatal("unexpected failure", doc.FailureClass, doc.FailureReason)
+	}
+	toRetry, err = db.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRetry) != 2 || toRetry[0] != second {
+		t.Fatal("unexpected hashes to retry", toRetry)
+	}
+
+	// assert the limit is applied after sorting
+	toRetry, err = db.HashesToRetry(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRetry) != 1 || toRetry[0] != second {
+		t.Fatal("unexpected hashes to retry", toRetry)
+	}
+
+	// assert the failure counts
+	counts, err := db.FailureCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{FailureClassPermanent: 1, FailureClassTransient: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("unexpected failure counts, %v != %v", counts, expected)
+	}
+
+	// assert marking the hash as succeeded clears its failure
+	err = db.MarkSucceeded(ctx, []Hash{second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = db.FindByHash(ctx, second)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if doc.Failed || doc.FailureClass != "" || doc.FailureReason != "" {
+		t.Fatal("unexpected failure", doc.Failed, doc.FailureClass, doc.FailureReason)
+	}
+
+	// assert every failure got recorded as an event, along with its detail
+	assertEvents(t, doc, EventFailed, EventFailed, EventSucceeded)
+	if doc.Events[0].Detail != "permanent: rejected" || doc.Events[1].Detail != "transient: unreachable" {
+		t.Fatal("unexpected event details", doc.Events)
+	}
+
+	// assert the invalid document didn't get any events
+	doc, err = db.FindByHash(ctx, HashBytes([]byte("skylink_3")))
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	assertEvents(t, doc)
+
 	// the above tests asserted that both 'HashesToRetry' and 'MarkFailed' both
 	// handle invalid documents properly
 
 	// no need to mark them as succeeded, the other unit test covers that
 }
 
+// testNumReports is a unit test that covers the functionality of the
+// 'RecordReports', 'NumReports' and 'ReportUsage' methods on the database.
+func testNumReports(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// assert there are no reports
+	now := Now()
+	since := now.Add(-ReportWindow)
+	reports, err := db.NumReports(ctx, "id_1", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 0 {
+		t.Fatalf("unexpected number of reports, %v != 0", reports)
+	}
+
+	// record reports within the window, outside of the window and for
+	// another MySkyID
+	err1 := db.RecordReports(ctx, "id_1", 2, now)
+	err2 := db.RecordReports(ctx, "id_1", 1, now.Add(-time.Minute))
+	err3 := db.RecordReports(ctx, "id_1", 5, now.Add(-ReportWindow-time.Minute))
+	err4 := db.RecordReports(ctx, "id_2", 4, now)
+	if err := errors.Compose(err1, err2, err3, err4); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert only the reports within the window are counted
+	reports, err = db.NumReports(ctx, "id_1", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 3 {
+		t.Fatalf("unexpected number of reports, %v != 3", reports)
+	}
+
+	// assert the window rolls over
+	reports, err = db.NumReports(ctx, "id_1", now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 2 {
+		t.Fatalf("unexpected number of reports, %v != 2", reports)
+	}
+
+	// assert the usage holds the time of the oldest report in the window
+	reports, oldest, err := db.ReportUsage(ctx, "id_1", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 3 || !oldest.Equal(now.Add(-time.Minute)) {
+		t.Fatal("unexpected usage", reports, oldest)
+	}
+	reports, oldest, err = db.ReportUsage(ctx, "id_3", since)
+	if err != nil || reports != 0 || !oldest.IsZero() {
+		t.Fatal("unexpected usage", reports, oldest, err)
+	}
+}
+
 // testHasIndex is a unit test that verifies the functionality of the hasIndex
 // helper function
 func testHasIndex(t *testing.T) {
@@ -519,13 +882,7 @@ func testHasIndex(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// check whether we can find an index we expect to be there
 	found, err := hasIndex(ctx, db.staticSkylinks, "hash")
@@ -554,13 +911,7 @@ func testDropIndex(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// check whether dropIndex errors out on an unknown index
 	dropped, err := dropIndex(ctx, db.staticSkylinks, "nonexistingindexname")
@@ -589,13 +940,7 @@ func testMarkInvalid(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
-	defer func() {
-		err := db.Close(ctx)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// ensure 'MarkInvalid' can handle an empty slice
 	var empty []Hash
@@ -610,7 +955,7 @@ func testMarkInvalid(t *testing.T) {
 		Hash:           hash,
 		Reporter:       Reporter{},
 		Tags:           []string{"tag_1"},
-		TimestampAdded: time.Now().UTC(),
+		TimestampAdded: Now(),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -648,6 +993,7 @@ func testMarkInvalid(t *testing.T) {
 	if !bsl.Invalid {
 		t.Fatal("expected invalid to be true")
 	}
+	assertEvents(t, bsl, EventInvalid)
 
 	// assert 'HashesToBlock' excludes invalid documents
 	toBlock, err = db.HashesToBlock(ctx, time.Time{})
@@ -666,7 +1012,7 @@ func testPing(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, t.Name())
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// ping should succeed
 	err := db.Ping(ctx)
@@ -702,3 +1048,1801 @@ func randomHash() crypto.Hash {
 	rand.Read(h[:])
 	return h
 }
+
+// testSchemaHealth verifies the schema health gets updated when an index goes
+// missing and that checking the schema restores it.
+func testSchemaHealth(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// assert the schema is healthy after startup
+	if !db.SchemaHealthy() || len(db.MissingIndexes()) != 0 {
+		t.Fatal("expected schema to be healthy", db.MissingIndexes())
+	}
+
+	// drop an index and refresh the schema health
+	dropped, err := dropIndex(ctx, db.staticSkylinks, "failed")
+	if err != nil || !dropped {
+		t.Fatal("unexpected", dropped, err)
+	}
+	_, err = db.managedRefreshSchemaHealth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the schema is degraded
+	if db.SchemaHealthy() {
+		t.Fatal("expected schema to be degraded")
+	}
+	missing := db.MissingIndexes()
+	if len(missing) != 1 || missing[0] != "skylinks.failed" {
+		t.Fatal("unexpected missing indexes", missing)
+	}
+
+	// check the schema, which should re-create the missing index
+	missing, err = db.CheckSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 || !db.SchemaHealthy() {
+		t.Fatal("expected schema to be healthy", missing)
+	}
+	exists, err := hasIndex(ctx, db.staticSkylinks, "failed")
+	if err != nil || !exists {
+		t.Fatal("expected index to be restored", exists, err)
+	}
+}
+
+// testEnsureDBSchema verifies ensuring the schema re-creates indexes of which
+// the options were changed, converging on the schema, and that it refuses to
+// drop a unique index while the collection holds duplicates.
+func testEnsureDBSchema(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	numIndexes := 0
+	for _, models := range dbSchema() {
+		numIndexes += len(models)
+	}
+
+	// assert all indexes are kept on a fresh database
+	summary, err := ensureDBSchema(ctx, db.staticDB, IndexBuildOptions{}, db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Kept) != numIndexes || len(summary.Created)+len(summary.Recreated)+len(summary.Failed) != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	// mutate the indexes, we change the options of one index, drop the
+	// collation of another, drop one and rename one
+	iv := db.staticSkylinks.Indexes()
+	mutations := []struct {
+		drop  string
+		model *mongo.IndexModel
+	}{
+		{"timestamp_added", &mongo.IndexModel{Keys: bson.M{"timestamp_added": 1}, Options: options.Index().SetName("timestamp_added").SetSparse(true)}},
+		{"reporter_email", &mongo.IndexModel{Keys: bson.M{"reporter.email": 1}, Options: options.Index().SetName("reporter_email")}},
+		{"failed", nil},
+		{"invalid", &mongo.IndexModel{Keys: bson.M{"invalid": 1}, Options: options.Index().SetName("invalid_1")}},
+	}
+	for _, m := range mutations {
+		_, err = iv.DropOne(ctx, m.drop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.model != nil {
+			_, err = iv.CreateOne(ctx, *m.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// assert ensuring the schema converges
+	summary, err = ensureDBSchema(ctx, db.staticDB, IndexBuildOptions{}, db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.Created, []string{"skylinks.failed"}) {
+		t.Fatal("unexpected created indexes", summary.Created)
+	}
+	expected := []string{"skylinks.invalid", "skylinks.reporter_email", "skylinks.timestamp_added"}
+	if !reflect.DeepEqual(summary.Recreated, expected) {
+		t.Fatal("unexpected recreated indexes", summary.Recreated)
+	}
+	if len(summary.Kept) != numIndexes-4 || len(summary.Failed) != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	exists, err := hasIndex(ctx, db.staticSkylinks, "invalid_1")
+	if err != nil || exists {
+		t.Fatal("expected renamed index to be dropped", exists, err)
+	}
+
+	// assert a second pass keeps all indexes
+	summary, err = ensureDBSchema(ctx, db.staticDB, IndexBuildOptions{}, db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Kept) != numIndexes {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	// replace the unique hash index with a non-unique one and insert
+	// duplicates
+	_, err = iv.DropOne(ctx, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = iv.CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"hash": 1}, Options: options.Index().SetName("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := HashBytes([]byte("duplicate"))
+	for i := 0; i < 2; i++ {
+		_, err = db.staticSkylinks.InsertOne(ctx, bson.M{"hash": hash, "timestamp_added": Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the index is not dropped
+	summary, err = ensureDBSchema(ctx, db.staticDB, IndexBuildOptions{}, db.staticLogger)
+	if !errors.Contains(err, ErrIndexCreateFailed) || !errors.Contains(err, errIndexHasDuplicates) {
+		t.Fatal("unexpected error", err)
+	}
+	if !reflect.DeepEqual(summary.Failed, []string{"skylinks.hash"}) {
+		t.Fatal("unexpected failed indexes", summary.Failed)
+	}
+	exists, err = hasIndex(ctx, db.staticSkylinks, "hash")
+	if err != nil || !exists {
+		t.Fatal("expected the hash index to be kept", exists, err)
+	}
+}
+
+// testIndexBuildOptions verifies indexes are unhidden after a hidden build,
+// that an index which is still hidden gets unhidden, and that an index that
+// fails to be built doesn't prevent the others from being built.
+func testIndexBuildOptions(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	coll := db.staticDB.Collection("index_build")
+	_, err := coll.InsertMany(ctx, []interface{}{bson.M{"a": 1, "b": 1}, bson.M{"a": 2, "b": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hidden is a helper that returns whether the index with the given name
+	// exists and whether it's hidden
+	hidden := func(name string) (bool, bool) {
+		t.Helper()
+		existing, err := listIndexes(ctx, coll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec, exists := existing[name]
+		return exists, spec.Hidden
+	}
+
+	// ensure two indexes with a hidden build, one of which is invalid
+	buildOpts := IndexBuildOptions{Hidden: true, Resumes: 1}
+	models := []mongo.IndexModel{
+		{Keys: bson.M{"a": "invalid"}, Options: options.Index().SetName("invalid")},
+		{Keys: bson.M{"a": 1}, Options: options.Index().SetName("a")},
+	}
+	var summary schemaSummary
+	err = ensureIndexes(ctx, coll, models, buildOpts, db.staticLogger, &summary)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !reflect.DeepEqual(summary.Failed, []string{"index_build.invalid"}) || !reflect.DeepEqual(summary.Created, []string{"index_build.a"}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	exists, isHidden := hidden("a")
+	if !exists || isHidden {
+		t.Fatal("expected index to be built and unhidden", exists, isHidden)
+	}
+
+	// create a hidden index, as if a build was interrupted before unhiding it
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"b": 1}, Options: options.Index().SetName("b").SetHidden(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isHidden = hidden("b"); !isHidden {
+		t.Fatal("expected index to be hidden")
+	}
+
+	// assert the index is kept and unhidden
+	summary = schemaSummary{}
+	models = []mongo.IndexModel{{Keys: bson.M{"b": 1}, Options: options.Index().SetName("b")}}
+	err = ensureIndexes(ctx, coll, models, IndexBuildOptions{}, db.staticLogger, &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.Kept, []string{"index_build.b"}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if _, isHidden = hidden("b"); isHidden {
+		t.Fatal("expected index to be unhidden")
+	}
+
+	// assert missing indexes are re-created with the options of the DB
+	db.staticIndexBuild = buildOpts
+	_, err = dropIndex(ctx, db.staticSkylinks, "failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := db.CheckSchema(ctx)
+	if err != nil || len(missing) != 0 {
+		t.Fatal("unexpected", missing, err)
+	}
+	existing, err := listIndexes(ctx, db.staticSkylinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec, exists := existing["failed"]; !exists || spec.Hidden {
+		t.Fatal("expected index to be re-created and unhidden", exists, spec.Hidden)
+	}
+
+	// assert build timeouts are recognised
+	if !isIndexBuildTimeout(mongo.CommandError{Code: codeMaxTimeMSExpired}) || !isIndexBuildTimeout(context.DeadlineExceeded) {
+		t.Fatal("expected timeout")
+	}
+	if isIndexBuildTimeout(mongo.CommandError{Code: 11000}) {
+		t.Fatal("unexpected timeout")
+	}
+
+	// assert the budget covers the resumes
+	if (IndexBuildOptions{}).Budget() != DefaultIndexBuildTimeout || (IndexBuildOptions{Timeout: time.Minute, Resumes: 2}).Budget() != 3*time.Minute {
+		t.Fatal("unexpected budget")
+	}
+}
+
+// testMigrateOrigins verifies the origin of skylinks inserted before origins
+// were tracked is resolved when they're read and gets migrated.
+func testMigrateOrigins(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert skylinks in the legacy shape, without an origin, and one that
+	// has an origin already
+	portalURL := "https://siasky.net"
+	synced := HashBytes([]byte("synced"))
+	user := HashBytes([]byte("user"))
+	service := HashBytes([]byte("service"))
+	current := HashBytes([]byte("current"))
+	skylinks := []BlockedSkylink{
+		{Hash: synced, Reporter: Reporter{Name: portalURL}, Source: SourceSync},
+		{Hash: user, Reporter: Reporter{Name: "name", Sub: "sub"}, Source: SourcePoW},
+		{Hash: service, Reporter: Reporter{Name: "scanner"}, Source: SourceAPI},
+		{Hash: current, Origin: Origin{Type: OriginTypeUser, Identifier: "other"}, Source: SourceAPI},
+	}
+	for _, sl := range skylinks {
+		sl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// define the expected origin and reporter name of every skylink
+	tests := []struct {
+		hash     Hash
+		origin   Origin
+		reporter string
+	}{
+		{synced, Origin{Type: OriginTypePortal, URL: portalURL}, ""},
+		{user, Origin{Type: OriginTypeUser, Identifier: "sub"}, "name"},
+		{service, Origin{Type: OriginTypeService, Identifier: "scanner"}, "scanner"},
+		{current, Origin{Type: OriginTypeUser, Identifier: "other"}, ""},
+	}
+
+	// assertOrigins is a helper that asserts the origin of every skylink
+	assertOrigins := func() {
+		t.Helper()
+		for _, test := range tests {
+			doc, err := db.FindByHash(ctx, test.hash)
+			if err != nil || doc == nil {
+				t.Fatal("unexpected", doc, err)
+			}
+			if doc.Origin != test.origin {
+				t.Fatalf("unexpected origin, %v != %v", doc.Origin, test.origin)
+			}
+			if doc.Reporter.Name != test.reporter {
+				t.Fatalf("unexpected reporter, %v != %v", doc.Reporter.Name, test.reporter)
+			}
+		}
+	}
+
+	// assert the legacy origins are resolved on read
+	assertOrigins()
+
+	// migrate the origins, assert only the legacy documents got updated
+	updated, err := db.MigrateOrigins(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 3 {
+		t.Fatalf("unexpected number of updates, %v != 3", updated)
+	}
+	assertOrigins()
+
+	// assert the portal url got removed from the stored reporter
+	var raw BlockedSkylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"hash": synced}).Decode(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Reporter.Name != "" || raw.Origin.URL != portalURL {
+		t.Fatal("unexpected document", raw.Reporter, raw.Origin)
+	}
+
+	// assert migrating again is a no-op
+	updated, err = db.MigrateOrigins(ctx)
+	if err != nil || updated != 0 {
+		t.Fatal("unexpected", updated, err)
+	}
+}
+
+// testFindByReporter verifies reporters that only differ in case and
+// whitespace are normalized into one reporter that can be looked up.
+func testFindByReporter(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert documents reported by the same reporter with differently
+	// formatted emails, bypassing the normalization on insert, and one
+	// document reported by someone else
+	emails := []string{"Reporter@Example.com ", "reporter@example.com", " REPORTER@EXAMPLE.COM", "other@example.com"}
+	for i, email := range emails {
+		err := db.CreateBlockedSkylink(ctx, &BlockedSkylink{
+			Hash:           HashBytes([]byte(fmt.Sprintf("skylink_%d", i))),
+			Reporter:       Reporter{Email: email, Sub: " SUB "},
+			TimestampAdded: Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the reporter is found case-insensitively, but not the ones with
+	// stray whitespace as they haven't been normalized yet
+	docs, more, err := db.FindByReporter(ctx, "REPORTER@example.com", 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || more {
+		t.Fatal("unexpected", len(docs), more)
+	}
+
+	// normalize the reporters, all documents have their sub normalized and
+	// two of them their email
+	updated, err := db.NormalizeReporters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 6 {
+		t.Fatalf("unexpected number of updates, %v != 6", updated)
+	}
+
+	// assert normalizing again is a no-op
+	updated, err = db.NormalizeReporters(ctx)
+	if err != nil || updated != 0 {
+		t.Fatal("unexpected", updated, err)
+	}
+
+	// assert all duplicates resolve to the same reporter
+	docs, more, err = db.FindByReporter(ctx, " Reporter@Example.COM", 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 || more {
+		t.Fatal("unexpected", len(docs), more)
+	}
+	for _, doc := range docs {
+		if doc.Reporter.Email != "reporter@example.com" || doc.Reporter.Sub != "sub" {
+			t.Fatal("unexpected reporter", doc.Reporter)
+		}
+	}
+
+	// assert paging works
+	docs, more, err = db.FindByReporter(ctx, "reporter@example.com", 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || !more {
+		t.Fatal("unexpected", len(docs), more)
+	}
+
+	// assert we can look up by sub
+	docs, _, err = db.FindByReporter(ctx, "SUB", 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 4 {
+		t.Fatal("unexpected", len(docs))
+	}
+
+	// assert an empty reporter is rejected
+	_, _, err = db.FindByReporter(ctx, " ", 1, 0, 10)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testActivitySeries verifies the activity series is bucketed in UTC and
+// zero-filled.
+func testActivitySeries(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// seed documents on both sides of the last two midnights, the invalid
+	// document should not be counted
+	today := Now().Truncate(24 * time.Hour)
+	seeds := []BlockedSkylink{
+		{Source: SourceAPI, TimestampAdded: today},
+		{Source: SourcePoW, TimestampAdded: today.Add(-time.Millisecond)},
+		{Source: SourceSync, TimestampAdded: today.Add(-24 * time.Hour)},
+		{Source: SourceSync, TimestampAdded: today.Add(-24*time.Hour - time.Millisecond)},
+		{Source: SourceAPI, TimestampAdded: today.Add(-time.Hour), Invalid: true},
+	}
+	for i, seed := range seeds {
+		seed.Hash = HashBytes([]byte(fmt.Sprintf("activity_%d", i)))
+		err := db.CreateBlockedSkylink(ctx, &seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// fetch the series of the last two days
+	series, err := db.ActivitySeries(ctx, 24*time.Hour, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 {
+		t.Fatalf("unexpected number of buckets, %v != 3", len(series))
+	}
+	expected := []map[string]int{
+		{SourceAPI: 0, SourcePoW: 0, SourceSync: 1},
+		{SourceAPI: 0, SourcePoW: 1, SourceSync: 1},
+		{SourceAPI: 1, SourcePoW: 0, SourceSync: 0},
+	}
+	for i, bucket := range series {
+		start := today.Add(time.Duration(i-2) * 24 * time.Hour)
+		if !bucket.Start.Equal(start) || bucket.Start.Location() != time.UTC {
+			t.Fatalf("unexpected start of bucket %v, %v != %v", i, bucket.Start, start)
+		}
+		if !reflect.DeepEqual(bucket.Sources, expected[i]) {
+			t.Fatalf("unexpected sources in bucket %v, %v != %v", i, bucket.Sources, expected[i])
+		}
+		var total int
+		for _, count := range expected[i] {
+			total += count
+		}
+		if bucket.Total != total {
+			t.Fatalf("unexpected total in bucket %v, %v != %v", i, bucket.Total, total)
+		}
+	}
+
+	// assert invalid parameters are rejected
+	_, err = db.ActivitySeries(ctx, 0, time.Hour)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = db.ActivitySeries(ctx, time.Hour, time.Minute)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = db.ActivitySeries(ctx, time.Minute, MaxActivityBuckets*time.Minute)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testMetadata verifies the metadata of a blocked skylink is stored, returned
+// and can be searched on.
+func testMetadata(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert skylinks with and without metadata
+	withMetadata := HashBytes([]byte("with_metadata"))
+	other := HashBytes([]byte("other_metadata"))
+	skylinks := []BlockedSkylink{
+		{Hash: withMetadata, Metadata: map[string]string{"message_id": "<abc@example.com>", "mailbox": "abuse"}},
+		{Hash: other, Metadata: map[string]string{"message_id": "<def@example.com>", "mailbox": "abuse"}},
+		{Hash: HashBytes([]byte("without_metadata"))},
+	}
+	for _, sl := range skylinks {
+		sl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert invalid metadata is rejected
+	invalid := BlockedSkylink{
+		Hash:           HashBytes([]byte("invalid_metadata")),
+		Metadata:       map[string]string{"a.b": "c"},
+		TimestampAdded: Now(),
+	}
+	err := db.CreateBlockedSkylink(ctx, &invalid)
+	if err == nil {
+		t.Fatal("expected invalid metadata to be rejected")
+	}
+
+	// assert the metadata is returned
+	doc, err := db.FindByHash(ctx, withMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc.Metadata, skylinks[0].Metadata) {
+		t.Fatal("unexpected metadata", doc.Metadata)
+	}
+
+	// assert we can search on the metadata
+	docs, _, err := db.BlockedHashes(ctx, 1, 0, 10, WithMetadata("message_id", "<abc@example.com>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Hash != withMetadata {
+		t.Fatal("unexpected documents", docs)
+	}
+	docs, _, err = db.BlockedHashes(ctx, 1, 0, 10, WithMetadata("mailbox", "abuse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatal("unexpected documents", docs)
+	}
+	docs, _, err = db.BlockedHashes(ctx, 1, 0, 10, WithMetadata("mailbox", "abuse"), WithMetadata("message_id", "<def@example.com>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Hash != other {
+		t.Fatal("unexpected documents", docs)
+	}
+}
+
+// testSoftDelete verifies soft-deleted skylinks are excluded from every query
+// unless they are explicitly included.
+func testSoftDelete(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert a regular and a failed skylink that are kept and a regular and a
+	// failed skylink that get soft-deleted
+	from := Now().Add(-time.Minute)
+	kept := HashBytes([]byte("kept"))
+	keptFailed := HashBytes([]byte("kept_failed"))
+	deleted := HashBytes([]byte("deleted"))
+	deletedFailed := HashBytes([]byte("deleted_failed"))
+	for _, sl := range []BlockedSkylink{
+		{Hash: kept},
+		{Hash: keptFailed, Failed: true},
+		{Hash: deleted},
+		{Hash: deletedFailed, Failed: true},
+	} {
+		sl.Reporter = Reporter{Email: "reporter@example.com"}
+		sl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hash := range []Hash{deleted, deletedFailed} {
+		err := db.SoftDelete(ctx, hash, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert soft-deleting a deleted or unknown skylink fails
+	err := db.SoftDelete(ctx, deleted, "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+	err = db.SoftDelete(ctx, HashBytes([]byte("unknown")), "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert FindByHash
+	doc, err := db.FindByHash(ctx, deleted)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	doc, err = db.FindByHash(ctx, deleted, IncludeDeleted())
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	if !doc.Deleted || doc.DeletedAt.IsZero() {
+		t.Fatal("unexpected soft-delete fields", doc.Deleted, doc.DeletedAt)
+	}
+	doc, err = db.FindByHash(ctx, kept)
+	if err != nil || doc == nil || doc.Deleted {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert BlockedHashes
+	docs, _, err := db.BlockedHashes(ctx, 1, 0, 10)
+	if err != nil || len(docs) != 2 {
+		t.Fatal("unexpected", len(docs), err)
+	}
+	docs, _, err = db.BlockedHashes(ctx, 1, 0, 10, IncludeDeleted())
+	if err != nil || len(docs) != 4 {
+		t.Fatal("unexpected", len(docs), err)
+	}
+
+	// assert FindByReporter
+	docs, _, err = db.FindByReporter(ctx, "reporter@example.com", 1, 0, 10)
+	if err != nil || len(docs) != 2 {
+		t.Fatal("unexpected", len(docs), err)
+	}
+	docs, _, err = db.FindByReporter(ctx, "reporter@example.com", 1, 0, 10, IncludeDeleted())
+	if err != nil || len(docs) != 4 {
+		t.Fatal("unexpected", len(docs), err)
+	}
+
+	// assert HashesToBlock
+	hashes, err := db.HashesToBlock(ctx, from)
+	if err != nil || len(hashes) != 1 || hashes[0] != kept {
+		t.Fatal("unexpected", hashes, err)
+	}
+	hashes, err = db.HashesToBlock(ctx, from, IncludeDeleted())
+	if err != nil || len(hashes) != 2 {
+		t.Fatal("unexpected", hashes, err)
+	}
+
+	// assert HashesToRetry
+	hashes, err = db.HashesToRetry(ctx, 0)
+	if err != nil || len(hashes) != 1 || hashes[0] != keptFailed {
+		t.Fatal("unexpected", hashes, err)
+	}
+	hashes, err = db.HashesToRetry(ctx, 0, IncludeDeleted())
+	if err != nil || len(hashes) != 2 {
+		t.Fatal("unexpected", hashes, err)
+	}
+
+	// assert ActivitySeries
+	for _, c := range []struct {
+		opts  []QueryOption
+		total int
+	}{
+		{nil, 2},
+		{[]QueryOption{IncludeDeleted()}, 4},
+	} {
+		series, err := db.ActivitySeries(ctx, time.Hour, time.Hour, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int
+		for _, bucket := range series {
+			total += bucket.Total
+		}
+		if total != c.total {
+			t.Fatalf("unexpected total, %v != %v", total, c.total)
+		}
+	}
+}
+
+// testBlockLatency is a unit test that covers the 'BlockLatency' method.
+func testBlockLatency(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// assert the latency is empty if nothing got blocked
+	since := Now().Add(-24 * time.Hour)
+	latency, err := db.BlockLatency(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency != (BlockLatency{}) {
+		t.Fatal("unexpected latency", latency)
+	}
+
+	// seed skylinks that took 1 up to 10 minutes to get blocked, one that
+	// isn't blocked yet and one that was reported before the given time
+	added := Now().Add(-time.Hour)
+	seeds := []BlockedSkylink{
+		{TimestampAdded: added},
+		{TimestampAdded: since.Add(-time.Hour), TimestampBlocked: since},
+	}
+	for i := 1; i <= 10; i++ {
+		seeds = append(seeds, BlockedSkylink{
+			TimestampAdded:   added,
+			TimestampBlocked: added.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	for i, seed := range seeds {
+		seed.Hash = HashBytes([]byte(fmt.Sprintf("latency_%d", i)))
+		err := db.CreateBlockedSkylink(ctx, &seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the percentiles
+	latency, err = db.BlockLatency(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BlockLatency{
+		Count: 10,
+		P50:   (5 * time.Minute).Milliseconds(),
+		P90:   (9 * time.Minute).Milliseconds(),
+		P99:   (10 * time.Minute).Milliseconds(),
+	}
+	if latency != expected {
+		t.Fatalf("unexpected latency, %+v != %+v", latency, expected)
+	}
+}
+
+// testTimestampRoundTrip verifies the timestamps we store are exactly equal to
+// themselves after a round trip through the database.
+func testTimestampRoundTrip(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert a skylink and assert it's exactly equal after fetching it
+	hash := HashBytes([]byte("skylink"))
+	bsl := &BlockedSkylink{
+		Hash:              hash,
+		Tags:              []string{"tag"},
+		TimestampAdded:    Now(),
+		TimestampReverted: Now().Add(time.Hour),
+	}
+	err := db.CreateBlockedSkylink(ctx, bsl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := db.FindByHash(ctx, hash)
+	if err != nil || fetched == nil {
+		t.Fatal("unexpected", fetched, err)
+	}
+	if fetched.TimestampAdded != bsl.TimestampAdded {
+		t.Fatal("unexpected timestamp", fetched.TimestampAdded, bsl.TimestampAdded)
+	}
+	if fetched.TimestampReverted != bsl.TimestampReverted {
+		t.Fatal("unexpected timestamp", fetched.TimestampReverted, bsl.TimestampReverted)
+	}
+
+	// assert the timestamps set by the database are truncated and in UTC
+	before := Now()
+	err = db.MarkSucceeded(ctx, []Hash{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SoftDelete(ctx, hash, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err = db.FindByHash(ctx, hash, IncludeDeleted())
+	if err != nil || fetched == nil {
+		t.Fatal("unexpected", fetched, err)
+	}
+	for _, ts := range []time.Time{fetched.TimestampBlocked, fetched.DeletedAt} {
+		if ts.Location() != time.UTC || ts != ts.Truncate(time.Millisecond) || ts.Before(before) {
+			t.Fatal("unexpected timestamp", ts)
+		}
+	}
+
+	// assert a skylink with a timestamp that's not in UTC is rejected
+	err = db.CreateBlockedSkylink(ctx, &BlockedSkylink{
+		Hash:           HashBytes([]byte("local")),
+		TimestampAdded: time.Now().In(time.FixedZone("CET", 3600)),
+	})
+	if err == nil {
+		t.Fatal("expected a timestamp that's not in UTC to be rejected")
+	}
+}
+
+// testHashesToBlockSeverity verifies HashesToBlock returns the hashes in order
+// of their severity, and ranks hashes without a severity by their tags if a
+// mapping is given.
+func testHashesToBlockSeverity(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert skylinks of every severity, the least severe ones first
+	normal := HashBytes([]byte("normal"))
+	high := HashBytes([]byte("high"))
+	critical := HashBytes([]byte("critical"))
+	synced := HashBytes([]byte("synced"))
+	for _, bsl := range []BlockedSkylink{
+		{Hash: normal, Severity: SeverityNormal, Tags: []string{"spam"}},
+		{Hash: synced, Tags: []string{"csam"}},
+		{Hash: high, Severity: SeverityHigh, Tags: []string{"malware"}},
+		{Hash: critical, Severity: SeverityCritical, Tags: []string{"csam"}},
+	} {
+		bsl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the hashes are sorted by severity, the synced hash has none
+	hashes, err := db.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 4 || hashes[0] != critical || hashes[1] != high {
+		t.Fatal("unexpected order", hashes)
+	}
+
+	// assert the synced hash is ranked by its tags if a mapping is given
+	m, err := NewSeverityMapping(map[string]string{"csam": SeverityCritical})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = db.HashesToBlock(ctx, time.Time{}, RankBySeverity(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 4 || hashes[2] != high || hashes[3] != normal {
+		t.Fatal("unexpected order", hashes)
+	}
+	top := map[Hash]bool{hashes[0]: true, hashes[1]: true}
+	if !top[critical] || !top[synced] {
+		t.Fatal("unexpected order", hashes)
+	}
+}
+
+// testAddTags verifies tags get added to a skylink, including a skylink that
+// has no tags, without duplicating the tags it already has.
+func testAddTags(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert a skylink with and a skylink without tags
+	tagged := HashBytes([]byte("tagged"))
+	untagged := HashBytes([]byte("untagged"))
+	for _, sl := range []BlockedSkylink{
+		{Hash: tagged, Tags: []string{"malware"}},
+		{Hash: untagged},
+	} {
+		sl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// add tags to both
+	for _, hash := range []Hash{tagged, untagged} {
+		err := db.AddTags(ctx, hash, []string{"malware", "phishing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the tags got merged
+	for _, hash := range []Hash{tagged, untagged} {
+		doc, err := db.FindByHash(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(doc.Tags)
+		if len(doc.Tags) != 2 || doc.Tags[0] != "malware" || doc.Tags[1] != "phishing" {
+			t.Fatal("unexpected tags", doc.Tags)
+		}
+	}
+
+	// assert adding tags to an unknown skylink fails
+	err := db.AddTags(ctx, HashBytes([]byte("unknown")), []string{"malware"})
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testPendingHashes verifies only the skylinks that await the next sweep of the
+// blocker are listed as pending.
+func testPendingHashes(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// seed skylinks in every state, two of which are pending
+	now := Now()
+	pending1 := HashBytes([]byte("pending_1"))
+	pending2 := HashBytes([]byte("pending_2"))
+	skylinks := []BlockedSkylink{
+		{Hash: pending1, TimestampAdded: now.Add(-2 * time.Minute)},
+		{Hash: pending2, TimestampAdded: now.Add(-time.Minute)},
+		{Hash: HashBytes([]byte("blocked")), TimestampAdded: now, TimestampBlocked: now},
+		{Hash: HashBytes([]byte("failed")), TimestampAdded: now, Failed: true},
+		{Hash: HashBytes([]byte("invalid")), TimestampAdded: now, Invalid: true},
+		{Hash: HashBytes([]byte("reverted")), TimestampAdded: now, Reverted: true},
+		{Hash: HashBytes([]byte("skipped")), TimestampAdded: now, SkippedAllowListed: true},
+	}
+	for i := range skylinks {
+		err := db.CreateBlockedSkylink(ctx, &skylinks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert only the pending skylinks are listed, oldest first
+	docs, more, err := db.PendingHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || len(docs) != 2 || docs[0].Hash != pending1 || docs[1].Hash != pending2 {
+		t.Fatal("unexpected pending skylinks", docs, more)
+	}
+
+	// assert the listing pages
+	docs, more, err = db.PendingHashes(ctx, -1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !more || len(docs) != 1 || docs[0].Hash != pending2 {
+		t.Fatal("unexpected page", docs, more)
+	}
+	docs, more, err = db.PendingHashes(ctx, -1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || len(docs) != 1 || docs[0].Hash != pending1 {
+		t.Fatal("unexpected page", docs, more)
+	}
+
+	// assert a skylink is no longer pending once it's blocked
+	err = db.MarkSucceeded(ctx, []Hash{pending1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, _, err = db.PendingHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Hash != pending2 {
+		t.Fatal("unexpected pending skylinks", docs)
+	}
+}
+
+// testBlockedHashesEqualTimestamps is a regression test that verifies paging
+// through skylinks that were added within the same millisecond neither
+// repeats nor skips any of them.
+func testBlockedHashesEqualTimestamps(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert 50 skylinks with the same timestamp
+	added := Now()
+	expected := make(map[Hash]struct{})
+	for i := 0; i < 50; i++ {
+		hash := HashBytes([]byte(fmt.Sprintf("hash_%d", i)))
+		err := db.CreateBlockedSkylink(ctx, &BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: added,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[hash] = struct{}{}
+	}
+
+	// page through them in both directions using pages of 7 skylinks
+	for _, sort := range []int{1, -1} {
+		seen := make(map[Hash]struct{})
+		for offset := 0; ; offset += 7 {
+			docs, more, err := db.BlockedHashes(ctx, sort, offset, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, doc := range docs {
+				if _, exists := seen[doc.Hash]; exists {
+					t.Fatalf("hash %v listed twice, sort %v offset %v", doc.Hash, sort, offset)
+				}
+				seen[doc.Hash] = struct{}{}
+			}
+			if !more {
+				break
+			}
+		}
+		if !reflect.DeepEqual(seen, expected) {
+			t.Fatalf("expected all hashes to be listed once, sort %v, %v != %v", sort, len(seen), len(expected))
+		}
+	}
+}
+
+// testNamespaces verifies two namespaces in the same database can block the
+// same hash without seeing each other's skylinks.
+func testNamespaces(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create two handles on the same test database, in different namespaces,
+	// both handles have to be created before inserting because every handle
+	// purges the database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	other := NewTestDB(ctx, t.Name(), WithTestNamespace("other"), WithCleanup(t))
+	if db.Namespace() != DefaultNamespace || other.Namespace() != "other" {
+		t.Fatal("unexpected namespaces", db.Namespace(), other.Namespace())
+	}
+
+	// assert invalid namespaces are rejected
+	uri, creds := TestDBConnection()
+	_, err := NewCustomDB(ctx, uri, t.Name(), creds, db.staticLogger, WithNamespace("not valid"))
+	if !errors.Contains(err, ErrInvalidNamespace) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// insert the same hash in both namespaces, and a hash that's only blocked
+	// in the other namespace
+	shared := HashBytes([]byte("shared"))
+	only := HashBytes([]byte("only"))
+	from := Now()
+	for _, insert := range []struct {
+		db   *DB
+		hash Hash
+		tag  string
+	}{
+		{db, shared, "malware"},
+		{other, shared, "phishing"},
+		{other, only, "phishing"},
+	} {
+		err = insert.db.CreateBlockedSkylink(ctx, &BlockedSkylink{
+			Hash:           insert.hash,
+			Tags:           []string{insert.tag},
+			TimestampAdded: Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert duplicates are still detected within a namespace
+	err = other.CreateBlockedSkylink(ctx, &BlockedSkylink{Hash: shared, TimestampAdded: Now()})
+	if err != ErrSkylinkExists {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = other.CreateBlockedSkylinkBulk(ctx, []BlockedSkylink{
+		{Hash: shared, TimestampAdded: Now()},
+		{Hash: HashBytes([]byte("bulk")), TimestampAdded: Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert every namespace only finds its own skylinks
+	doc, err := db.FindByHash(ctx, shared)
+	if err != nil || doc == nil || doc.Namespace != DefaultNamespace || !reflect.DeepEqual(doc.Tags, []string{"malware"}) {
+		t.Fatal("unexpected", doc, err)
+	}
+	doc, err = other.FindByHash(ctx, shared)
+	if err != nil || doc == nil || doc.Namespace != "other" || !reflect.DeepEqual(doc.Tags, []string{"phishing"}) {
+		t.Fatal("unexpected", doc, err)
+	}
+	doc, err = db.FindByHash(ctx, only)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	hashes, err := db.HashesToBlock(ctx, from)
+	if err != nil || len(hashes) != 1 {
+		t.Fatal("unexpected", hashes, err)
+	}
+	hashes, err = other.HashesToBlock(ctx, from)
+	if err != nil || len(hashes) != 3 {
+		t.Fatal("unexpected", hashes, err)
+	}
+
+	// assert InNamespace reads across namespaces
+	doc, err = db.FindByHash(ctx, only, InNamespace("other"))
+	if err != nil || doc == nil || doc.Namespace != "other" {
+		t.Fatal("unexpected", doc, err)
+	}
+	blocked, _, err := db.BlockedHashes(ctx, 1, 0, 10, InNamespace("other"))
+	if err != nil || len(blocked) != 3 {
+		t.Fatal("unexpected", len(blocked), err)
+	}
+
+	// assert marking a shared hash only affects our own namespace
+	err = db.MarkFailed(ctx, []Hash{shared}, FailureClassTransient, "unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.MarkInvalid(ctx, []Hash{shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backlog, err := db.Backlog(ctx)
+	if err != nil || backlog != (Backlog{Failed: 1}) {
+		t.Fatal("unexpected", backlog, err)
+	}
+	backlog, err = other.Backlog(ctx)
+	if err != nil || backlog != (Backlog{Invalid: 1}) {
+		t.Fatal("unexpected", backlog, err)
+	}
+	err = db.MarkSucceeded(ctx, []Hash{shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = db.FindByHash(ctx, shared)
+	if err != nil || doc == nil || doc.Failed || doc.TimestampBlocked.IsZero() {
+		t.Fatal("unexpected", doc, err)
+	}
+	doc, err = other.FindByHash(ctx, shared)
+	if err != nil || doc == nil || !doc.Invalid || !doc.TimestampBlocked.IsZero() {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert the allowlist is scoped to the namespace
+	err = other.CreateAllowListedSkylink(ctx, &AllowListedSkylink{
+		Hash:           only,
+		Description:    "allowed in other",
+		TimestampAdded: Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowListed, err := db.IsAllowListed(ctx, only.Hash)
+	if err != nil || allowListed {
+		t.Fatal("unexpected", allowListed, err)
+	}
+	allowListed, err = other.IsAllowListed(ctx, only.Hash)
+	if err != nil || !allowListed {
+		t.Fatal("unexpected", allowListed, err)
+	}
+	allowed, err := db.AllowListedHashes(ctx, []Hash{only, shared})
+	if err != nil || len(allowed) != 0 {
+		t.Fatal("unexpected", allowed, err)
+	}
+
+	// assert soft-deleting only affects our own namespace
+	err = db.SoftDelete(ctx, shared, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = other.FindByHash(ctx, shared)
+	if err != nil || doc == nil || doc.Deleted {
+		t.Fatal("unexpected", doc, err)
+	}
+}
+
+// testBackfillNamespace verifies documents that were inserted before namespaces
+// existed are assigned to the namespace that's backfilled.
+func testBackfillNamespace(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert legacy documents without a namespace, and a document that
+	// belongs to another namespace already
+	legacy := HashBytes([]byte("legacy"))
+	other := HashBytes([]byte("other"))
+	_, err := db.staticSkylinks.InsertOne(ctx, bson.M{"hash": legacy, "tags": bson.A{"malware"}, "timestamp_added": Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticSkylinks.InsertOne(ctx, bson.M{"hash": other, "namespace": "other", "timestamp_added": Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticAllowList.InsertOne(ctx, bson.M{"hash": legacy, "timestamp_added": Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the legacy documents are not found before the backfill
+	doc, err := db.FindByHash(ctx, legacy)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// backfill the namespace, assert the legacy documents are found and the
+	// other namespace was left untouched
+	err = backfillNamespace(ctx, db.staticDB, DefaultNamespace, db.staticLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = db.FindByHash(ctx, legacy)
+	if err != nil || doc == nil || doc.Namespace != DefaultNamespace {
+		t.Fatal("unexpected", doc, err)
+	}
+	allowListed, err := db.IsAllowListed(ctx, legacy.Hash)
+	if err != nil || !allowListed {
+		t.Fatal("unexpected", allowListed, err)
+	}
+	doc, err = db.FindByHash(ctx, other)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	doc, err = db.FindByHash(ctx, other, InNamespace("other"))
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+}
+
+// testCallbacks verifies callbacks are only returned once the hash got blocked
+// or found to be invalid, and that they can be cleared.
+func testCallbacks(t *testing.T) {
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert a document with a callback and one without
+	hash := HashBytes([]byte("skylink_1"))
+	other := HashBytes([]byte("skylink_2"))
+	for _, bs := range []BlockedSkylink{
+		{Hash: hash, CallbackURL: "https://example.com/callback", TimestampAdded: Now()},
+		{Hash: other, TimestampAdded: Now()},
+	} {
+		err := db.CreateBlockedSkylink(ctx, &bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCallbacks := func(expected int) {
+		t.Helper()
+		callbacks, err := db.CallbacksToDeliver(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(callbacks) != expected {
+			t.Fatalf("expected %v callbacks, instead it was %v", expected, len(callbacks))
+		}
+	}
+
+	// assert the callback isn't returned until the hash got blocked
+	assertCallbacks(0)
+	err := db.MarkSucceeded(ctx, []Hash{hash, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCallbacks(1)
+
+	// assert the attempts are incremented
+	for i := 0; i < 2; i++ {
+		err = db.IncrementCallbackAttempts(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	callbacks, err := db.CallbacksToDeliver(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(callbacks) != 1 || callbacks[0].Hash != hash || callbacks[0].CallbackAttempts != 2 {
+		t.Fatal("unexpected callbacks", callbacks)
+	}
+
+	// assert clearing the callback removes the url and the attempts
+	err = db.ClearCallback(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCallbacks(0)
+	doc, err := db.FindByHash(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.CallbackURL != "" || doc.CallbackAttempts != 0 {
+		t.Fatal("unexpected callback", doc.CallbackURL, doc.CallbackAttempts)
+	}
+
+	// assert incrementing the attempts of a cleared callback is a no-op
+	err = db.IncrementCallbackAttempts(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = db.FindByHash(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.CallbackAttempts != 0 {
+		t.Fatal("unexpected attempts", doc.CallbackAttempts)
+	}
+}
+
+// testFindHashes verifies the lean decode path of the sweep queries returns
+// the same hashes, in the same order, as decoding the full documents.
+func testFindHashes(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert skylinks with a mix of flags, severities and tags, every third
+	// one failed to get blocked and one of them is soft-deleted
+	var hashes []Hash
+	for i := 0; i < 30; i++ {
+		sl := BlockedSkylink{
+			Hash:           HashBytes([]byte(fmt.Sprint("find_", i))),
+			Failed:         i%3 == 0,
+			Reporter:       Reporter{Name: "reporter", Email: "reporter@example.com"},
+			Tags:           []string{"malware"},
+			TimestampAdded: Now().Add(-time.Duration(i) * time.Second),
+		}
+		if i%5 == 0 {
+			sl.Severity = SeverityCritical
+		}
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, sl.Hash)
+	}
+	err := db.SoftDelete(ctx, hashes[3], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// oldPath fetches the hashes by decoding the full documents
+	oldPath := func(filter interface{}, opts *options.FindOptions) []Hash {
+		docs, err := db.find(ctx, filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := make([]Hash, len(docs))
+		for i, doc := range docs {
+			hashes[i] = doc.Hash
+		}
+		return hashes
+	}
+
+	// assert both paths return the same hashes for the retry query
+	filter := db.skylinksFilter(bson.M{"failed": bson.M{"$eq": true}})
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 1})
+	opts.SetSort(timestampAddedSort(1))
+	expected := oldPath(filter, opts)
+	found, err := db.findHashes(ctx, filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 9 || !reflect.DeepEqual(found, expected) {
+		t.Fatal("unexpected hashes", found, expected)
+	}
+	toRetry, err := db.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(toRetry, expected) {
+		t.Fatal("unexpected hashes", toRetry, expected)
+	}
+
+	// assert the severity and tags are decoded for the block query
+	var critical int
+	err = db.findHashDocs(ctx, db.skylinksFilter(bson.M{}), func(doc hashDoc) {
+		if doc.Severity == SeverityCritical {
+			critical++
+		}
+		if len(doc.Tags) != 1 || doc.Tags[0] != "malware" {
+			t.Fatal("unexpected tags", doc.Tags)
+		}
+	}, options.Find().SetProjection(bson.M{"hash": 1, "severity": 1, "tags": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if critical != 6 {
+		t.Fatal("unexpected number of critical hashes", critical)
+	}
+
+	// assert a query without matches returns an empty slice
+	found, err = db.findHashes(ctx, db.skylinksFilter(bson.M{"hash": "unknown"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || len(found) != 0 {
+		t.Fatal("unexpected hashes", found)
+	}
+
+	// assert the existing hashes match the documents found by hash
+	lookup := append([]Hash{HashBytes([]byte("unknown"))}, hashes[:5]...)
+	for _, includeDeleted := range []bool{false, true} {
+		var queryOpts []QueryOption
+		if includeDeleted {
+			queryOpts = append(queryOpts, IncludeDeleted())
+		}
+		docs, err := db.FindByHashes(ctx, lookup, queryOpts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing, err := db.ExistingHashes(ctx, lookup, queryOpts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(existing) != len(docs) {
+			t.Fatal("unexpected number of hashes", len(existing), len(docs))
+		}
+		found := make(map[Hash]struct{})
+		for _, hash := range existing {
+			found[hash] = struct{}{}
+		}
+		for _, doc := range docs {
+			if _, ok := found[doc.Hash]; !ok {
+				t.Fatal("missing hash", doc.Hash)
+			}
+		}
+	}
+}
+
+// BenchmarkDecodeHashes compares decoding the documents returned by the sweep
+// queries into blocked skylinks to decoding them into hash documents.
+func BenchmarkDecodeHashes(b *testing.B) {
+	// create the documents as returned by a query projecting the hash
+	raws := make([]bson.Raw, 1000)
+	for i := range raws {
+		raw, err := bson.Marshal(bson.M{
+			"_id":  primitive.NewObjectID(),
+			"hash": HashBytes([]byte(fmt.Sprint(i))),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		raws[i] = raw
+	}
+
+	b.Run("BlockedSkylink", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			docs := make([]BlockedSkylink, 0)
+			for _, raw := range raws {
+				var doc BlockedSkylink
+				if err := bson.Unmarshal(raw, &doc); err != nil {
+					b.Fatal(err)
+				}
+				docs = append(docs, doc)
+			}
+			hashes := make([]Hash, len(docs))
+			for i, doc := range docs {
+				hashes[i] = doc.Hash
+			}
+		}
+	})
+	b.Run("Hash", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			hashes := make([]Hash, 0)
+			for _, raw := range raws {
+				var doc hashDoc
+				if err := bson.Unmarshal(raw, &doc); err != nil {
+					b.Fatal(err)
+				}
+				hashes = append(hashes, doc.Hash)
+			}
+		}
+	})
+}
+
+// testRevertTags verifies reverting tags of a skylink only unblocks it once
+// none of its tags remain.
+func testRevertTags(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// insert a skylink with three tags and one with a single tag, skyd
+	// confirmed blocking both
+	multi := HashBytes([]byte("multi"))
+	single := HashBytes([]byte("single"))
+	for _, sl := range []BlockedSkylink{
+		{Hash: multi, Tags: []string{"copyright", "malware", "phishing"}},
+		{Hash: single, Tags: []string{"malware"}},
+	} {
+		sl.TimestampAdded = Now()
+		err := db.CreateBlockedSkylink(ctx, &sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.MarkSucceeded(ctx, []Hash{multi, single})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     Hash
+		tags     []string
+		active   []string
+		reverted []string
+	}{
+		{"Partial", multi, []string{"copyright"}, []string{"malware", "phishing"}, []string{"copyright"}},
+		{"RepeatedPartial", multi, []string{"copyright", "phishing"}, []string{"malware"}, []string{"copyright", "phishing"}},
+		{"UnknownTag", multi, []string{"spam"}, []string{"malware"}, []string{"copyright", "phishing"}},
+		{"FinalFull", multi, []string{"malware"}, []string{}, []string{"copyright", "phishing", "malware"}},
+		{"AllTags", single, nil, []string{}, []string{"malware"}},
+	}
+	for _, test := range tests {
+		doc, err := db.RevertTags(ctx, test.hash, test.tags, "reverted")
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(doc.Tags, test.active) || !reflect.DeepEqual(doc.RevertedTags, test.reverted) {
+			t.Fatalf("%v: unexpected tags %v, reverted %v", test.name, doc.Tags, doc.RevertedTags)
+		}
+
+		// assert the skylink is only reverted once none of its tags remain
+		reverted := len(test.active) == 0
+		if doc.Reverted != reverted || doc.TimestampReverted.IsZero() == reverted {
+			t.Fatalf("%v: unexpected reverted state %v %v", test.name, doc.Reverted, doc.TimestampReverted)
+		}
+		last := doc.Events[len(doc.Events)-1]
+		if last.Type != EventReverted || last.Detail != "reverted" {
+			t.Fatalf("%v: unexpected event %v", test.name, last)
+		}
+	}
+
+	// assert reverting an unknown skylink fails
+	_, err = db.RevertTags(ctx, HashBytes([]byte("unknown")), nil, "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert reverted skylinks are no longer listed
+	blocked, _, err := db.BlockedHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocked) != 0 {
+		t.Fatal("unexpected blocked hashes", blocked)
+	}
+
+	// assert both are queued to be removed from skyd's blocklist until they
+	// are marked as unblocked
+	toUnblock, err := db.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toUnblock) != 2 || toUnblock[0] != multi || toUnblock[1] != single {
+		t.Fatal("unexpected hashes to unblock", toUnblock)
+	}
+	err = db.MarkUnblocked(ctx, toUnblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toUnblock, err = db.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toUnblock) != 0 {
+		t.Fatal("unexpected hashes to unblock", toUnblock)
+	}
+	doc, err := db.FindByHash(ctx, single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.TimestampBlocked.IsZero() || doc.Events[len(doc.Events)-1].Type != EventUnblocked {
+		t.Fatal("unexpected skylink", doc)
+	}
+}
+
+// testLatestBlockTimestamp verifies the latest block timestamps are stored per
+// server UID, and that timestamps stored before their last update was kept
+// track of are pruned by their age.
+func testLatestBlockTimestamp(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// assert an unknown server has no timestamp
+	_, found, err := db.LatestBlockTimestamp(ctx, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("unexpected timestamp")
+	}
+
+	// store a timestamp for two servers and update the first one
+	now := Now()
+	for _, update := range []struct {
+		serverUID string
+		timestamp time.Time
+	}{
+		{"first", now.Add(-time.Hour)},
+		{"second", now.Add(-time.Minute)},
+		{"first", now},
+	} {
+		err = db.UpdateLatestBlockTimestamp(ctx, update.serverUID, update.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for serverUID, expected := range map[string]time.Time{
+		"first":  now,
+		"second": now.Add(-time.Minute),
+	} {
+		timestamp, found, err := db.LatestBlockTimestamp(ctx, serverUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !timestamp.Equal(expected) {
+			t.Fatal("unexpected timestamp", serverUID, timestamp, found)
+		}
+	}
+
+	// insert two skylinks, assert the time the latest one was added is
+	// returned for any set of hashes that includes it
+	older := HashBytes([]byte("older"))
+	newer := HashBytes([]byte("newer"))
+	for i, hash := range []Hash{older, newer} {
+		err = db.CreateBlockedSkylink(ctx, &BlockedSkylink{
+			Hash:           hash,
+			TimestampAdded: now.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	unknown := HashBytes([]byte("unknown"))
+	tests := []struct {
+		hashes   []Hash
+		expected time.Time
+	}{
+		{nil, time.Time{}},
+		{[]Hash{unknown}, time.Time{}},
+		{[]Hash{older, unknown}, now},
+		{[]Hash{older, newer}, now.Add(time.Minute)},
+	}
+	for _, test := range tests {
+		added, err := db.LatestTimestampAdded(ctx, test.hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added.Equal(test.expected) {
+			t.Fatal("unexpected timestamp", test.hashes, added)
+		}
+	}
+
+	// insert the timestamps of two servers that were stored before we kept
+	// track of their last update, assert only the old one gets pruned
+	for serverUID, timestamp := range map[string]time.Time{
+		"legacy-old": now.Add(-2 * time.Hour),
+		"legacy-new": now,
+	} {
+		_, err = db.staticLatestBlockTimestamps.InsertOne(ctx, bson.M{"server_uid": serverUID, "timestamp": timestamp})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruned, err := db.PruneLatestBlockTimestamps(ctx, now.Add(-time.Hour), "")
+	if err != nil || pruned != 1 {
+		t.Fatal("unexpected pruned timestamps", pruned, err)
+	}
+	for serverUID, expected := range map[string]bool{
+		"first":      true,
+		"second":     true,
+		"legacy-old": false,
+		"legacy-new": true,
+	} {
+		_, found, err := db.LatestBlockTimestamp(ctx, serverUID)
+		if err != nil || found != expected {
+			t.Fatal("unexpected timestamp", serverUID, found, err)
+		}
+	}
+}
+
+// testBlockedIdentities tests blocking and unblocking MySkyIDs.
+func testBlockedIdentities(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create two handles on the same test database, in different namespaces,
+	// see testNamespaces
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	other := NewTestDB(ctx, t.Name(), WithTestNamespace("other"), WithCleanup(t))
+
+	// assert an unknown identity is not blocked
+	id := strings.Repeat("ab", 32)
+	blocked, err := db.IsIdentityBlocked(ctx, id)
+	if err != nil || blocked {
+		t.Fatal("unexpected", blocked, err)
+	}
+
+	// block it twice, the second time updates the reason
+	err = db.BlockIdentity(ctx, id, "spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BlockIdentity(ctx, id, "republishes malware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err = db.IsIdentityBlocked(ctx, id)
+	if err != nil || !blocked {
+		t.Fatal("unexpected", blocked, err)
+	}
+	identities, err := db.BlockedIdentities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].MySkyID != id || identities[0].Reason != "republishes malware" || identities[0].Namespace != DefaultNamespace || identities[0].TimestampAdded.IsZero() {
+		t.Fatal("unexpected identities", identities)
+	}
+
+	// assert the identity isn't blocked in another namespace
+	blocked, err = other.IsIdentityBlocked(ctx, id)
+	if err != nil || blocked {
+		t.Fatal("unexpected", blocked, err)
+	}
+
+	// unblock it
+	err = db.UnblockIdentity(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err = db.IsIdentityBlocked(ctx, id)
+	if err != nil || blocked {
+		t.Fatal("unexpected", blocked, err)
+	}
+	err = db.UnblockIdentity(ctx, id)
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
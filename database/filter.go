@@ -0,0 +1,172 @@
+package database
+
+import (
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// QueryOption is an option that alters which skylinks are returned by
+	// the read methods of the DB.
+	QueryOption func(*queryOptions)
+
+	// queryOptions holds the options of a query on the skylinks collection.
+	queryOptions struct {
+		addedBefore     time.Time
+		hashPrefix      string
+		includeArchived bool
+		includeDeleted  bool
+		metadata        map[string]string
+		namespace       string
+		severities      SeverityMapping
+		tags            []string
+	}
+)
+
+// AddedBefore is a query option that only includes skylinks that were added
+// before the given time.
+func AddedBefore(t time.Time) QueryOption {
+	return func(opts *queryOptions) {
+		opts.addedBefore = t
+	}
+}
+
+// IncludeArchived is a query option that makes FindByHash fall through to the
+// archive of reverted skylinks when the hash isn't in the skylinks collection.
+// It's meant for detecting the history of a hash that gets reported again,
+// the other read methods ignore it.
+func IncludeArchived() QueryOption {
+	return func(opts *queryOptions) {
+		opts.includeArchived = true
+	}
+}
+
+// IncludeDeleted is a query option that includes soft-deleted skylinks in the
+// results of a query. It should only be used for admin views.
+func IncludeDeleted() QueryOption {
+	return func(opts *queryOptions) {
+		opts.includeDeleted = true
+	}
+}
+
+// WithHashPrefix is a query option that only includes skylinks of which the
+// hash starts with the given prefix. Hashes are stored as lowercase hex, so
+// the prefix is expected to be lowercase hex as well. The prefix match is
+// anchored, which allows it to use the index on the hash.
+func WithHashPrefix(prefix string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.hashPrefix = prefix
+	}
+}
+
+// WithMetadata is a query option that only includes skylinks of which the
+// metadata has the given value for the given key. It can be passed multiple
+// times, in which case all of the key-value pairs have to match.
+func WithMetadata(key, value string) QueryOption {
+	return func(opts *queryOptions) {
+		if opts.metadata == nil {
+			opts.metadata = make(map[string]string)
+		}
+		opts.metadata[key] = value
+	}
+}
+
+// WithTags is a query option that only includes skylinks that carry at least
+// one of the given tags. The tags are normalized, see NormalizeTag.
+func WithTags(tags ...string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.tags = append(opts.tags, NormalizeTags(tags)...)
+	}
+}
+
+// InNamespace is a query option that queries the skylinks of the given
+// namespace instead of the namespace of the DB. It's meant for admins
+// comparing the blocklists of different namespaces and only applies to reads.
+func InNamespace(namespace string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.namespace = namespace
+	}
+}
+
+// RankBySeverity is a query option that ranks skylinks that have no severity,
+// because they were synced or reported before severities were introduced, by
+// their tags using the given mapping. It only affects the order of the hashes
+// returned by HashesToBlock.
+func RankBySeverity(severities SeverityMapping) QueryOption {
+	return func(opts *queryOptions) {
+		opts.severities = severities
+	}
+}
+
+// newQueryOptions applies the given query options.
+func newQueryOptions(queryOpts ...QueryOption) queryOptions {
+	var opts queryOptions
+	for _, opt := range queryOpts {
+		opt(&opts)
+	}
+	return opts
+}
+
+// skylinksFilter builds the filter for a query on the skylinks collection. It
+// extends the given filter with the conditions every read path has to honour,
+// which by default means only the skylinks of the DB's namespace are included
+// and soft-deleted skylinks are excluded. The given filter is not modified.
+func (db *DB) skylinksFilter(filter bson.M, queryOpts ...QueryOption) bson.M {
+	opts := newQueryOptions(queryOpts...)
+
+	f := make(bson.M, len(filter)+len(opts.metadata)+2)
+	for k, v := range filter {
+		f[k] = v
+	}
+	f["namespace"] = db.staticNamespace
+	if opts.namespace != "" {
+		f["namespace"] = opts.namespace
+	}
+	// NOTE: $ne: true is not the same as $eq: false, documents inserted
+	// before soft-deletion was supported don't have a deleted field
+	if !opts.includeDeleted {
+		f["deleted"] = bson.M{"$ne": true}
+	}
+	for key, value := range opts.metadata {
+		f["metadata."+key] = value
+	}
+	if len(opts.tags) > 0 {
+		f["tags"] = bson.M{"$in": opts.tags}
+	}
+	if opts.hashPrefix != "" {
+		// merge the prefix match with the condition on the hash of the
+		// given filter, if any
+		cond := bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(opts.hashPrefix)}}
+		mergeCondition(f, "hash", cond)
+	}
+	if !opts.addedBefore.IsZero() {
+		mergeCondition(f, "timestamp_added", bson.M{"$lt": opts.addedBefore})
+	}
+	return f
+}
+
+// namespaced adds the condition on the DB's namespace to the given filter of a
+// query on the skylinks or allowlist collection and returns it. Writes always
+// go through a namespaced filter, they never cross namespaces.
+func (db *DB) namespaced(filter bson.M) bson.M {
+	filter["namespace"] = db.staticNamespace
+	return filter
+}
+
+// mergeCondition sets the given condition on the given field of the filter,
+// merging it with the condition the filter already has on that field, if any.
+func mergeCondition(f bson.M, field string, cond bson.M) {
+	switch existing := f[field].(type) {
+	case nil:
+	case bson.M:
+		for k, v := range existing {
+			cond[k] = v
+		}
+	default:
+		cond["$eq"] = existing
+	}
+	f[field] = cond
+}
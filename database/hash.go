@@ -1,7 +1,12 @@
 package database
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
@@ -12,12 +17,110 @@ import (
 	"go.sia.tech/siad/crypto"
 )
 
+const (
+	// OriginTypeUser is the origin type of skylinks reported by a user.
+	OriginTypeUser = "user"
+
+	// OriginTypeService is the origin type of skylinks reported by a trusted
+	// service, such as the malware scanner.
+	OriginTypeService = "service"
+
+	// OriginTypePortal is the origin type of skylinks synced from another
+	// portal's blocklist.
+	OriginTypePortal = "portal"
+
+	// MaxMetadataKeys is the maximum number of keys the metadata of a
+	// blocked skylink can contain.
+	MaxMetadataKeys = 16
+
+	// MaxMetadataKeySize is the maximum size, in bytes, of a metadata key.
+	MaxMetadataKeySize = 64
+
+	// MaxMetadataValueSize is the maximum size, in bytes, of a metadata
+	// value.
+	MaxMetadataValueSize = 1 << 10
+
+	// MaxEvents is the maximum number of lifecycle events kept per blocked
+	// skylink, older events are dropped.
+	MaxEvents = 20
+)
+
+const (
+	// EventDeleted is the type of the event recorded when a skylink got
+	// soft-deleted.
+	EventDeleted = "deleted"
+
+	// EventFailed is the type of the event recorded when skyd failed to
+	// block a skylink.
+	EventFailed = "failed"
+
+	// EventInvalid is the type of the event recorded when skyd rejected a
+	// skylink as invalid.
+	EventInvalid = "invalid"
+
+	// EventReset is the type of the event recorded when an admin reset the
+	// processing state of a skylink so it gets blocked again.
+	EventReset = "reset"
+
+	// EventRequeued is the type of the event recorded when a skylink that
+	// was confirmed blocked is no longer on skyd's blocklist and is queued to
+	// be blocked again.
+	EventRequeued = "requeued"
+
+	// EventReverted is the type of the event recorded when some or all of
+	// the tags of a skylink got reverted.
+	EventReverted = "reverted"
+
+	// EventResurrected is the type of the event recorded when an invalid
+	// or archived skylink got reported again.
+	EventResurrected = "resurrected"
+
+	// EventSkippedAllowListed is the type of the event recorded when a
+	// skylink was not blocked because it's on the allow list.
+	EventSkippedAllowListed = "skipped_allowlisted"
+
+	// EventSucceeded is the type of the event recorded when skyd blocked a
+	// skylink.
+	EventSucceeded = "succeeded"
+
+	// EventUnblocked is the type of the event recorded when a reverted
+	// skylink got removed from skyd's blocklist.
+	EventUnblocked = "unblocked"
+)
+
+var (
+	// ErrHashLength is returned when parsing a hash that is not exactly 64
+	// characters long.
+	ErrHashLength = fmt.Errorf("hash should be %d hex characters", crypto.HashSize*2)
+
+	// ErrHashNotHex is returned when parsing a hash that contains characters
+	// that are not hex.
+	ErrHashNotHex = errors.New("hash should only contain hex characters")
+)
+
 // Hash is a struct that embeds the crypto.Hash, allowing us to implement the
-// bsoncodec ValueMarshaler interfaces.
+// bsoncodec ValueMarshaler interfaces. Hashes are comparable, they should be
+// compared by value rather than by their string form.
 type Hash struct {
 	crypto.Hash
 }
 
+// HashFromString parses the given hex encoded hash. The hash has to be exactly
+// 64 hex characters, uppercase characters are accepted. It returns
+// ErrHashLength or ErrHashNotHex if the hash is invalid. The string form of the
+// returned hash is always lowercase, which is the form hashes are stored in.
+func HashFromString(s string) (Hash, error) {
+	var h Hash
+	if len(s) != crypto.HashSize*2 {
+		return Hash{}, errors.AddContext(ErrHashLength, fmt.Sprintf("got %d characters", len(s)))
+	}
+	_, err := hex.Decode(h.Hash[:], []byte(s))
+	if err != nil {
+		return Hash{}, errors.Compose(ErrHashNotHex, err)
+	}
+	return h, nil
+}
+
 // NewHash returns the Hash of the given skylink.
 func NewHash(sl skymodules.Skylink) Hash {
 	return Hash{crypto.HashObject(sl.MerkleRoot())}
@@ -28,6 +131,59 @@ func HashBytes(b []byte) Hash {
 	return Hash{crypto.HashBytes(b)}
 }
 
+// LoadString parses the given hex encoded hash into h, see HashFromString.
+func (h *Hash) LoadString(s string) error {
+	hash, err := HashFromString(s)
+	if err != nil {
+		return err
+	}
+	*h = hash
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface. Hashes are
+// always encoded as lowercase hex, in JSON values and map keys alike, this is
+// the only format in which the API writes hashes.
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, the hash is
+// parsed using HashFromString.
+func (h *Hash) UnmarshalText(b []byte) error {
+	return h.LoadString(string(b))
+}
+
+// MarshalJSON implements the json.Marshaler interface, it encodes the hash as
+// a JSON string using MarshalText. It takes precedence over the marshaler of
+// the embedded crypto.Hash, so the wire format of hashes is defined here.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	b, err := h.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(b))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, the hash is parsed
+// using HashFromString. A null value leaves the hash untouched.
+//
+// For compatibility with clients that encode hashes using siad's crypto.Hash,
+// which is what the API accepted before, uppercase hex is accepted as well, as
+// is the zero hash that those clients send when they report a skylink instead
+// of a hash. Uppercase hex is deprecated, new clients should send lowercase.
+func (h *Hash) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.AddContext(err, "hash should be a string")
+	}
+	return h.LoadString(s)
+}
+
 // MarshalBSONValue implements the bsoncodec.ValueMarshaler interface.
 func (h Hash) MarshalBSONValue() (bsontype.Type, []byte, error) {
 	return bsontype.String, bsoncore.AppendString(nil, h.String()), nil
@@ -40,8 +196,7 @@ func (h *Hash) UnmarshalBSONValue(t bsontype.Type, b []byte) error {
 		return fmt.Errorf("Hash UnmarshalBSONValue error, reading '%s'", string(b))
 	}
 
-	var unmarshaled Hash
-	err := unmarshaled.LoadString(s)
+	unmarshaled, err := HashFromString(s)
 	if err != nil {
 		return err
 	}
@@ -53,16 +208,16 @@ func (h *Hash) UnmarshalBSONValue(t bsontype.Type, b []byte) error {
 // of the base array but are not present in any of the other arrays.
 func DiffHashes(array []Hash, others ...[]Hash) []Hash {
 	// build a map of hashes to exclude
-	seen := make(map[string]struct{})
+	seen := make(map[Hash]struct{})
 	for _, other := range others {
 		for _, hash := range other {
-			seen[hash.String()] = struct{}{}
+			seen[hash] = struct{}{}
 		}
 	}
 
 	var diff []Hash
 	for _, hash := range array {
-		if _, exists := seen[hash.String()]; !exists {
+		if _, exists := seen[hash]; !exists {
 			diff = append(diff, hash)
 		}
 	}
@@ -75,25 +230,56 @@ type AllowListedSkylink struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty"`
 	Hash           Hash               `bson:"hash"`
 	Description    string             `bson:"description"`
+	Namespace      string             `bson:"namespace"`
+	TimestampAdded time.Time          `bson:"timestamp_added"`
+}
+
+// AllowListedPublisher is a publisher whose v2 skylinks are allow listed, it's
+// identified by the public key its registry entries are signed with. The
+// public key is in the format skyd uses, e.g. "ed25519:<hex>".
+type AllowListedPublisher struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	PublicKey      string             `bson:"public_key"`
+	Description    string             `bson:"description"`
+	Namespace      string             `bson:"namespace"`
 	TimestampAdded time.Time          `bson:"timestamp_added"`
 }
 
 // BlockedSkylink is a skylink blocked by an external request.
 type BlockedSkylink struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty"`
-	Failed            bool               `bson:"failed"`
-	Hash              Hash               `bson:"hash"`
-	Invalid           bool               `bson:"invalid"`
-	Reporter          Reporter           `bson:"reporter"`
-	Reverted          bool               `bson:"reverted"`
-	RevertedTags      []string           `bson:"reverted_tags"`
-	Tags              []string           `bson:"tags"`
-	TimestampAdded    time.Time          `bson:"timestamp_added"`
-	TimestampReverted time.Time          `bson:"timestamp_reverted"`
+	ID                 primitive.ObjectID `bson:"_id,omitempty"`
+	Archived           bool               `bson:"archived,omitempty"`
+	CallbackAttempts   int                `bson:"callback_attempts,omitempty"`
+	CallbackURL        string             `bson:"callback_url,omitempty"`
+	ContentMissing     bool               `bson:"content_missing,omitempty"`
+	Deleted            bool               `bson:"deleted,omitempty"`
+	DeletedAt          time.Time          `bson:"deleted_at,omitempty"`
+	Events             []Event            `bson:"events,omitempty"`
+	Failed             bool               `bson:"failed"`
+	FailureClass       string             `bson:"failure_class,omitempty"`
+	FailureReason      string             `bson:"failure_reason,omitempty"`
+	Hash               Hash               `bson:"hash"`
+	Invalid            bool               `bson:"invalid"`
+	Metadata           map[string]string  `bson:"metadata,omitempty"`
+	MergedReporters    []Reporter         `bson:"merged_reporters,omitempty"`
+	Namespace          string             `bson:"namespace"`
+	Origin             Origin             `bson:"origin,omitempty"`
+	Reporter           Reporter           `bson:"reporter"`
+	Reverted           bool               `bson:"reverted"`
+	SeenOnPortals      []string           `bson:"seen_on_portals,omitempty"`
+	SkippedAllowListed bool               `bson:"skipped_allowlisted,omitempty"`
+	Severity           string             `bson:"severity,omitempty"`
+	Source             string             `bson:"source,omitempty"`
+	RevertedTags       []string           `bson:"reverted_tags"`
+	Tags               []string           `bson:"tags"`
+	TimestampAdded     time.Time          `bson:"timestamp_added"`
+	TimestampArchived  time.Time          `bson:"timestamp_archived,omitempty"`
+	TimestampBlocked   time.Time          `bson:"timestamp_blocked,omitempty"`
+	TimestampReverted  time.Time          `bson:"timestamp_reverted"`
 }
 
 // Validate is a small helper function that ensures the required properties are
-// set on the BlockedSkylink object.
+// set on the BlockedSkylink object and that its timestamps are in UTC.
 func (bsl *BlockedSkylink) Validate() error {
 	if bsl.Hash == (Hash{}) {
 		return errors.New("missing 'Hash' property")
@@ -101,9 +287,176 @@ func (bsl *BlockedSkylink) Validate() error {
 	if bsl.TimestampAdded.IsZero() {
 		return errors.New("missing 'TimestampAdded' property")
 	}
+
+	// timestamps have to be in UTC, the zero time is considered UTC
+	timestamps := []struct {
+		field string
+		ts    time.Time
+	}{
+		{"DeletedAt", bsl.DeletedAt},
+		{"TimestampAdded", bsl.TimestampAdded},
+		{"TimestampArchived", bsl.TimestampArchived},
+		{"TimestampBlocked", bsl.TimestampBlocked},
+		{"TimestampReverted", bsl.TimestampReverted},
+	}
+	for _, t := range timestamps {
+		if t.ts.Location() != time.UTC {
+			return fmt.Errorf("'%s' property must be in UTC", t.field)
+		}
+	}
+	return ValidateMetadata(bsl.Metadata)
+}
+
+// IsBlocked returns whether skyd confirmed blocking the skylink. Skylinks that
+// failed to get blocked, that are invalid or that were reverted are not
+// considered blocked.
+func (bsl *BlockedSkylink) IsBlocked() bool {
+	return !bsl.TimestampBlocked.IsZero() && !bsl.Failed && !bsl.Invalid && !bsl.Reverted
+}
+
+// ValidateMetadata returns an error if the given metadata exceeds the maximum
+// number of keys, or if one of its keys or values is invalid. Keys are stored
+// as field names so they can't be empty, contain a dot or start with a '$'.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataKeys {
+		return fmt.Errorf("metadata can contain at most %d keys", MaxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > MaxMetadataKeySize {
+			return fmt.Errorf("metadata keys have to be between 1 and %d bytes", MaxMetadataKeySize)
+		}
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return fmt.Errorf("invalid metadata key '%s', keys can't contain a '.' or start with a '$'", key)
+		}
+		if len(value) > MaxMetadataValueSize {
+			return fmt.Errorf("value of metadata key '%s' exceeds %d bytes", key, MaxMetadataValueSize)
+		}
+	}
 	return nil
 }
 
+// resolveOrigin fills in the origin of a skylink that was inserted before
+// origins were tracked, derived from its source and reporter. Synced skylinks
+// used to store the portal url as the reporter's name, which gets cleared.
+func (bsl *BlockedSkylink) resolveOrigin() {
+	if !bsl.Origin.IsZero() {
+		return
+	}
+	bsl.Origin = legacyOrigin(bsl.Source, bsl.Reporter)
+	if bsl.Origin.Type == OriginTypePortal {
+		bsl.Reporter.Name = ""
+	}
+}
+
+// legacyOrigin returns the origin of a skylink that was inserted before
+// origins were tracked, given its source and reporter.
+func legacyOrigin(source string, reporter Reporter) Origin {
+	switch {
+	case source == SourceSync:
+		return Origin{Type: OriginTypePortal, URL: reporter.Name}
+	case reporter.Sub != "":
+		return Origin{Type: OriginTypeUser, Identifier: reporter.Sub}
+	default:
+		return Origin{Type: OriginTypeService, Identifier: reporter.Name}
+	}
+}
+
+// Event is a change in the lifecycle of a blocked skylink, e.g. skyd failing
+// to block it. The last MaxEvents events are kept on the skylink, which helps
+// debugging why a skylink is in the state it's in.
+type Event struct {
+	Type      string    `bson:"type" json:"type"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Detail    string    `bson:"detail,omitempty" json:"detail,omitempty"`
+}
+
+// newEvent returns an event of the given type that happened now.
+func newEvent(typ, detail string) Event {
+	return Event{Type: typ, Timestamp: Now(), Detail: detail}
+}
+
+// Origin describes where a blocked skylink was first seen. Contrary to the
+// reporter, which is the person that filed the report, the origin can be a
+// service or another portal.
+type Origin struct {
+	// Type is the type of the origin, being a user, a trusted service or a
+	// portal we synced the skylink from.
+	Type string `bson:"type"`
+
+	// Identifier identifies the user or service, for users this is their
+	// sub or MySkyID.
+	Identifier string `bson:"identifier,omitempty"`
+
+	// URL is the url of the portal the skylink got synced from.
+	URL string `bson:"url,omitempty"`
+
+	// KeyID is the ID of the API key the skylink was reported with.
+	KeyID string `bson:"key_id,omitempty"`
+
+	// Form is the form the hash or skylink was reported in, e.g. a hash or a
+	// url containing the skylink, see modules.SkylinkForms. It's not set for
+	// skylinks that were reported before it got recorded.
+	Form string `bson:"form,omitempty"`
+}
+
+// IsZero implements the bsoncodec.Zeroer interface, which allows omitting an
+// empty origin.
+func (o Origin) IsZero() bool {
+	return o == Origin{}
+}
+
+// UsedProof keeps track of how many times a proof of work has been used to
+// report skylinks.
+type UsedProof struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	Hash           Hash               `bson:"hash"`
+	Uses           int                `bson:"uses"`
+	TimestampAdded time.Time          `bson:"timestamp_added"`
+}
+
+// BlockedIdentity is a MySkyID that's blocked from reporting skylinks through
+// the PoW route, reports attributed to it get flagged.
+type BlockedIdentity struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	MySkyID        string             `bson:"myskyid"`
+	Namespace      string             `bson:"namespace"`
+	Reason         string             `bson:"reason"`
+	TimestampAdded time.Time          `bson:"timestamp_added"`
+}
+
+// AllowListHit is a report of an allowlisted skylink, which got answered as if
+// it was reported but never got blocked. Reports that keep hitting the allow
+// list indicate it's wrong, or that someone is probing it.
+type AllowListHit struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Hash      Hash               `bson:"hash"`
+	Namespace string             `bson:"namespace"`
+
+	// Reporter identifies who reported the skylink, e.g. their sub or the id
+	// of the API key they reported it with, it's empty if unknown.
+	Reporter       string    `bson:"reporter,omitempty"`
+	Source         string    `bson:"source,omitempty"`
+	TimestampAdded time.Time `bson:"timestamp_added"`
+}
+
+// AllowListHitCount holds the number of times an allowlisted skylink got
+// reported, by how many distinct reporters, and when it was last reported.
+type AllowListHitCount struct {
+	Hash      Hash      `bson:"_id"`
+	Hits      int       `bson:"hits"`
+	Reporters int       `bson:"reporters"`
+	LastHit   time.Time `bson:"last_hit"`
+}
+
+// Report keeps track of the number of skylinks a MySkyID reported at a certain
+// point in time.
+type Report struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	MySkyID        string             `bson:"myskyid"`
+	Reports        int                `bson:"reports"`
+	TimestampAdded time.Time          `bson:"timestamp_added"`
+}
+
 // Reporter is a person who reported that a given skylink should be blocked.
 type Reporter struct {
 	Name            string `bson:"name"`
@@ -111,4 +464,44 @@ type Reporter struct {
 	OtherContact    string `bson:"other_contact"`
 	Sub             string `bson:"sub,omitempty"`
 	Unauthenticated bool   `bson:"unauthenticated,omitempty"`
+
+	// AttributionPending is set on reports that carried a cookie which
+	// couldn't be resolved into a sub because the accounts service was
+	// unavailable.
+	AttributionPending bool `bson:"attribution_pending,omitempty"`
+}
+
+// Normalize trims and lowercases the reporter's email and sub, which ensures
+// the same reporter is always stored the same way.
+func (r *Reporter) Normalize() {
+	r.Email = normalizeReporterID(r.Email)
+	r.Sub = normalizeReporterID(r.Sub)
+}
+
+// Anonymize replaces the reporter's name, email and other contact with their
+// salted digest, see ReporterDigest. The sub is kept because it's
+// pseudonymous already. The reporter is expected to be normalized.
+func (r *Reporter) Anonymize(salt []byte) {
+	r.Name = ReporterDigest(salt, strings.TrimSpace(r.Name))
+	r.Email = ReporterDigest(salt, r.Email)
+	r.OtherContact = ReporterDigest(salt, strings.TrimSpace(r.OtherContact))
+}
+
+// ReporterDigest returns the hex encoded HMAC-SHA256 of the given value, keyed
+// with the given salt. The same value always results in the same digest for
+// as long as the salt doesn't change, which keeps the reports of a reporter
+// linkable without storing who they are. Empty values stay empty.
+func ReporterDigest(salt []byte, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeReporterID returns the normalized form of a reporter's email or
+// sub.
+func normalizeReporterID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
 }
@@ -2,8 +2,15 @@ package database
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.sia.tech/siad/crypto"
 )
@@ -26,8 +33,7 @@ func TestHashMarhsaling(t *testing.T) {
 	defer cancel()
 
 	// create test database
-	db := NewTestDB(ctx, dbName)
-	defer db.Close(ctx)
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
 
 	// create test collection and purge it
 	coll := db.staticDB.Collection(t.Name())
@@ -59,6 +65,178 @@ func TestHashMarhsaling(t *testing.T) {
 	}
 }
 
+// TestHashFromString is a unit test for HashFromString.
+func TestHashFromString(t *testing.T) {
+	t.Parallel()
+
+	hash := HashBytes([]byte("skylink"))
+	lower := hash.String()
+	tests := []struct {
+		name string
+		str  string
+		err  error
+	}{
+		{"Lowercase", lower, nil},
+		{"Uppercase", strings.ToUpper(lower), nil},
+		{"MixedCase", strings.ToUpper(lower[:32]) + lower[32:], nil},
+		{"Empty", "", ErrHashLength},
+		{"TooShort", lower[:63], ErrHashLength},
+		{"TooLong", lower + "0", ErrHashLength},
+		{"Prefixed", "0x" + lower[2:], ErrHashNotHex},
+		{"NotHex", "g" + lower[1:], ErrHashNotHex},
+		{"Whitespace", " " + lower[1:], ErrHashNotHex},
+	}
+	for _, test := range tests {
+		h, err := HashFromString(test.str)
+		if test.err != nil {
+			if !errors.Contains(err, test.err) {
+				t.Fatalf("%v: unexpected error %v", test.name, err)
+			}
+			if h != (Hash{}) {
+				t.Fatalf("%v: expected an empty hash", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		if h != hash || h.String() != lower {
+			t.Fatalf("%v: unexpected hash %v", test.name, h)
+		}
+	}
+}
+
+// TestHashFromStringFuzz feeds random input to HashFromString and asserts it
+// either returns one of its typed errors or a hash that encodes back to the
+// lowercase form of the input.
+func TestHashFromStringFuzz(t *testing.T) {
+	t.Parallel()
+
+	const alphabet = "0123456789abcdefABCDEFghxyzGHXYZ-_ "
+	for i := 0; i < 10000; i++ {
+		// build a random string, half of them have the length of a hash
+		n := fastrand.Intn(crypto.HashSize*4 + 1)
+		if i%2 == 0 {
+			n = crypto.HashSize * 2
+		}
+		b := make([]byte, n)
+		for j := range b {
+			b[j] = alphabet[fastrand.Intn(len(alphabet))]
+		}
+		str := string(b)
+
+		h, err := HashFromString(str)
+		if err != nil {
+			if !errors.Contains(err, ErrHashLength) && !errors.Contains(err, ErrHashNotHex) {
+				t.Fatalf("unexpected error for '%v': %v", str, err)
+			}
+			continue
+		}
+		if h.String() != strings.ToLower(str) {
+			t.Fatalf("unexpected hash for '%v': %v", str, h)
+		}
+	}
+
+	// assert random hashes survive a round trip through their string form
+	for i := 0; i < 1000; i++ {
+		var hash Hash
+		fastrand.Read(hash.Hash[:])
+		h, err := HashFromString(hex.EncodeToString(hash.Hash[:]))
+		if err != nil || h != hash {
+			t.Fatal("unexpected", h, hash, err)
+		}
+		h, err = HashFromString(strings.ToUpper(hash.String()))
+		if err != nil || h != hash {
+			t.Fatal("unexpected", h, hash, err)
+		}
+	}
+}
+
+// TestHashUnmarshalJSON verifies hashes are parsed using HashFromString when
+// they're unmarshaled from JSON.
+func TestHashUnmarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	// assert a marshaled hash survives a round trip
+	hash := HashBytes([]byte("skylink"))
+	b, err := json.Marshal(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Hash
+	err = json.Unmarshal(b, &h)
+	if err != nil || h != hash {
+		t.Fatal("unexpected", h, err)
+	}
+
+	// assert uppercase hashes are accepted
+	h = Hash{}
+	err = json.Unmarshal([]byte(fmt.Sprintf("%q", strings.ToUpper(hash.String()))), &h)
+	if err != nil || h != hash {
+		t.Fatal("unexpected", h, err)
+	}
+
+	// assert invalid hashes are rejected
+	for _, input := range []string{`"abc"`, `""`, `123`, fmt.Sprintf("%q", "z"+hash.String()[1:])} {
+		err = json.Unmarshal([]byte(input), &h)
+		if err == nil {
+			t.Fatalf("expected %v to be rejected", input)
+		}
+	}
+}
+
+// TestHashWireFormat pins the JSON encoding of hashes, as values and as map
+// keys, to lowercase hex.
+func TestHashWireFormat(t *testing.T) {
+	t.Parallel()
+
+	hash := HashBytes([]byte("skylink"))
+	lower := hash.String()
+	if lower != strings.ToLower(lower) || len(lower) != crypto.HashSize*2 {
+		t.Fatal("unexpected string form", lower)
+	}
+
+	// assert the exact encoding of a hash as a value, in a slice and as a map
+	// key
+	b, err := json.Marshal(struct {
+		Hash   Hash         `json:"hash"`
+		Hashes []Hash       `json:"hashes"`
+		Counts map[Hash]int `json:"counts"`
+	}{hash, []Hash{hash}, map[Hash]int{hash: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"hash":"%[1]s","hashes":["%[1]s"],"counts":{"%[1]s":1}}`, lower)
+	if string(b) != expected {
+		t.Fatalf("unexpected encoding %v, expected %v", string(b), expected)
+	}
+
+	// assert it's the encoding of the embedded crypto.Hash, which the API
+	// used before
+	legacy, err := json.Marshal(hash.Hash)
+	if err != nil || string(legacy) != fmt.Sprintf("%q", lower) {
+		t.Fatal("unexpected", string(legacy), err)
+	}
+
+	// assert map keys are decoded, uppercase ones included
+	var counts map[Hash]int
+	err = json.Unmarshal([]byte(fmt.Sprintf(`{"%s":1}`, strings.ToUpper(lower))), &counts)
+	if err != nil || counts[hash] != 1 {
+		t.Fatal("unexpected", counts, err)
+	}
+	err = json.Unmarshal([]byte(`{"abc":1}`), &counts)
+	if !errors.Contains(err, ErrHashLength) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the zero hash decodes into an empty hash
+	var h Hash
+	err = json.Unmarshal([]byte(fmt.Sprintf("%q", strings.Repeat("0", crypto.HashSize*2))), &h)
+	if err != nil || h != (Hash{}) {
+		t.Fatal("unexpected", h, err)
+	}
+}
+
 // TestDiffHashes is a unit test for the DiffHashes helper method
 func TestDiffHashes(t *testing.T) {
 	t.Parallel()
@@ -96,3 +274,99 @@ func TestDiffHashes(t *testing.T) {
 		t.Fatal("unexpected diff", output)
 	}
 }
+
+// TestNow is a unit test for Now.
+func TestNow(t *testing.T) {
+	t.Parallel()
+
+	now := Now()
+	if now.Location() != time.UTC {
+		t.Fatal("expected Now to return a UTC timestamp", now.Location())
+	}
+	if now != now.Truncate(time.Millisecond) {
+		t.Fatal("expected Now to be truncated to milliseconds", now)
+	}
+}
+
+// TestValidate is a unit test for the Validate method of a BlockedSkylink.
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	hash := HashBytes([]byte("skylink"))
+	local := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name  string
+		bsl   BlockedSkylink
+		valid bool
+	}{
+		{"Valid", BlockedSkylink{Hash: hash, TimestampAdded: Now()}, true},
+		{"NoHash", BlockedSkylink{TimestampAdded: Now()}, false},
+		{"NoTimestamp", BlockedSkylink{Hash: hash}, false},
+		{"LocalAdded", BlockedSkylink{Hash: hash, TimestampAdded: Now().In(local)}, false},
+		{"LocalBlocked", BlockedSkylink{Hash: hash, TimestampAdded: Now(), TimestampBlocked: Now().In(local)}, false},
+		{"LocalReverted", BlockedSkylink{Hash: hash, TimestampAdded: Now(), TimestampReverted: Now().In(local)}, false},
+		{"LocalDeleted", BlockedSkylink{Hash: hash, TimestampAdded: Now(), DeletedAt: Now().In(local)}, false},
+	}
+	for _, test := range tests {
+		err := test.bsl.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// TestAnonymize is a unit test for the Anonymize method of a Reporter.
+func TestAnonymize(t *testing.T) {
+	t.Parallel()
+
+	salt := []byte("salt")
+	reporter := Reporter{Name: " John ", Email: "john@example.com", Sub: "sub"}
+	reporter.Anonymize(salt)
+
+	// assert the PII got replaced with digests, the sub is kept
+	if reporter.Name != ReporterDigest(salt, "John") || reporter.Email != ReporterDigest(salt, "john@example.com") {
+		t.Fatal("unexpected reporter", reporter)
+	}
+	if reporter.OtherContact != "" || reporter.Sub != "sub" {
+		t.Fatal("unexpected reporter", reporter)
+	}
+
+	// assert the digest depends on the salt
+	if ReporterDigest([]byte("other"), "john@example.com") == reporter.Email {
+		t.Fatal("expected the digest to depend on the salt")
+	}
+	if len(reporter.Email) != 64 {
+		t.Fatal("unexpected digest length", len(reporter.Email))
+	}
+}
+
+// TestValidateMetadata is a unit test for ValidateMetadata.
+func TestValidateMetadata(t *testing.T) {
+	t.Parallel()
+
+	tooManyKeys := make(map[string]string)
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		tooManyKeys[fmt.Sprint(i)] = "value"
+	}
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		valid    bool
+	}{
+		{"Nil", nil, true},
+		{"Valid", map[string]string{"message_id": "<abc@example.com>", "mailbox": ""}, true},
+		{"MaxValue", map[string]string{"key": strings.Repeat("a", MaxMetadataValueSize)}, true},
+		{"LargeValue", map[string]string{"key": strings.Repeat("a", MaxMetadataValueSize+1)}, false},
+		{"LargeKey", map[string]string{strings.Repeat("a", MaxMetadataKeySize+1): "value"}, false},
+		{"EmptyKey", map[string]string{"": "value"}, false},
+		{"DottedKey", map[string]string{"a.b": "value"}, false},
+		{"OperatorKey", map[string]string{"$where": "value"}, false},
+		{"TooManyKeys", tooManyKeys, false},
+	}
+	for _, test := range tests {
+		err := ValidateMetadata(test.metadata)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,1430 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/crypto"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It mirrors the
+// semantics of the DB, including the ordering of the results and the way
+// updates treat soft-deleted and invalid skylinks, but it holds the documents
+// of a single namespace only, reads in another namespace through InNamespace
+// never return anything. It's meant for tests that don't depend on MongoDB.
+type MemoryStore struct {
+	staticNamespace string
+
+	// skylinks holds the blocked skylinks in the order they were inserted,
+	// which is the order in which MongoDB returns documents of queries that
+	// don't specify a sort. byHash indexes them by their hash.
+	skylinks []*BlockedSkylink
+	byHash   map[Hash]*BlockedSkylink
+
+	// archive holds the archived skylinks by their hash.
+	archive map[Hash]*BlockedSkylink
+
+	allowList             map[Hash]AllowListedSkylink
+	allowListHits         []AllowListHit
+	allowListPublishers   map[string]AllowListedPublisher
+	identities            map[string]BlockedIdentity
+	latestBlockTimestamps map[string]LatestBlockTimestamp
+	proofs                map[Hash]UsedProof
+	reports               []Report
+
+	staticMu sync.Mutex
+}
+
+// NewMemoryStore returns an empty in-memory store for the given namespace.
+func NewMemoryStore(namespace string) (*MemoryStore, error) {
+	if err := ValidateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	return &MemoryStore{
+		staticNamespace: namespace,
+
+		byHash:                make(map[Hash]*BlockedSkylink),
+		archive:               make(map[Hash]*BlockedSkylink),
+		allowList:             make(map[Hash]AllowListedSkylink),
+		allowListPublishers:   make(map[string]AllowListedPublisher),
+		identities:            make(map[string]BlockedIdentity),
+		latestBlockTimestamps: make(map[string]LatestBlockTimestamp),
+		proofs:                make(map[Hash]UsedProof),
+	}, nil
+}
+
+// Namespace returns the namespace of the store.
+func (ms *MemoryStore) Namespace() string {
+	return ms.staticNamespace
+}
+
+// Ping always succeeds.
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Retry calls the given operation once, the store has no transient errors.
+func (ms *MemoryStore) Retry(ctx context.Context, fn func() error) error {
+	return fn()
+}
+
+// SchemaHealthy always returns true, the store has no schema.
+func (ms *MemoryStore) SchemaHealthy() bool {
+	return true
+}
+
+// MissingIndexes always returns nil, the store has no indexes.
+func (ms *MemoryStore) MissingIndexes() []string {
+	return nil
+}
+
+// CreateBlockedSkylink creates a new skylink. If the skylink already exists it
+// returns ErrSkylinkExists.
+func (ms *MemoryStore) CreateBlockedSkylink(ctx context.Context, skylink *BlockedSkylink) error {
+	err := skylink.Validate()
+	if err != nil {
+		return errors.AddContext(err, "unexpected blocked skylink")
+	}
+	skylink.Namespace = ms.staticNamespace
+
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if !ms.insert(*skylink) {
+		return ErrSkylinkExists
+	}
+	return nil
+}
+
+// CreateBlockedSkylinkBulk creates new blocked skylinks in bulk, duplicates are
+// ignored. It returns the number of created entries.
+func (ms *MemoryStore) CreateBlockedSkylinkBulk(ctx context.Context, skylinks []BlockedSkylink) (int, error) {
+	inserted, _, err := ms.insertMany(skylinks)
+	return inserted, err
+}
+
+// CreateBlockedSkylinkBatch creates new blocked skylinks in bulk, it returns
+// the indices of the given skylinks that already existed.
+func (ms *MemoryStore) CreateBlockedSkylinkBatch(ctx context.Context, skylinks []BlockedSkylink) ([]int, error) {
+	if len(skylinks) == 0 {
+		return nil, nil
+	}
+	_, duplicates, err := ms.insertMany(skylinks)
+	if err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// AddSeenOnPortal records that the given hashes appeared on the blocklist of
+// the portal with the given url.
+func (ms *MemoryStore) AddSeenOnPortal(ctx context.Context, hashes []Hash, portalURL string) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		bsl.SeenOnPortals = unionStrings(bsl.SeenOnPortals, []string{portalURL})
+	}
+	return nil
+}
+
+// AddTags adds the given tags to the skylink with the given hash. It returns
+// ErrNoDocumentsFound if there's no skylink with the given hash.
+func (ms *MemoryStore) AddTags(ctx context.Context, hash Hash, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash)
+	if bsl == nil {
+		return ErrNoDocumentsFound
+	}
+	bsl.Tags = unionStrings(bsl.Tags, tags)
+	return nil
+}
+
+// FindByHash returns the skylink with the given hash, or nil if there's none.
+func (ms *MemoryStore) FindByHash(ctx context.Context, hash Hash, queryOpts ...QueryOption) (*BlockedSkylink, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash, queryOpts...)
+	if bsl == nil && newQueryOptions(queryOpts...).includeArchived {
+		if archived, exists := ms.archive[hash]; exists {
+			if docs := ms.filterIn([]*BlockedSkylink{archived}, nil, queryOpts...); len(docs) > 0 {
+				bsl = docs[0]
+			}
+		}
+	}
+	if bsl == nil {
+		return nil, nil
+	}
+	found := exportSkylink(bsl)
+	return &found, nil
+}
+
+// ExistingHashes returns the subset of the given hashes that are in the store.
+func (ms *MemoryStore) ExistingHashes(ctx context.Context, hashes []Hash, queryOpts ...QueryOption) ([]Hash, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	in := hashSet(hashes)
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	return skylinkHashes(ms.filter(func(bsl *BlockedSkylink) bool {
+		_, exists := in[bsl.Hash]
+		return exists
+	}, queryOpts...)), nil
+}
+
+// BlockedHashes returns a page of the blocked skylinks, alongside a boolean
+// that indicates whether there's more skylinks after the current page.
+func (ms *MemoryStore) BlockedHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return !bsl.Invalid && !bsl.Reverted
+	}, queryOpts...)
+	sortByTimestampAdded(docs, sort)
+	docs, more := page(docs, skip, limit)
+	return exportSkylinks(docs), more, nil
+}
+
+// PendingHashes returns a page of the skylinks that are awaiting the next
+// sweep of the blocker, alongside a boolean that indicates whether there's
+// more skylinks after the current page.
+func (ms *MemoryStore) PendingHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.TimestampBlocked.IsZero() && !bsl.Failed && !bsl.Invalid && !bsl.Reverted && !bsl.SkippedAllowListed
+	}, queryOpts...)
+	sortByTimestampAdded(docs, sort)
+	docs, more := page(docs, skip, limit)
+	return exportSkylinks(docs), more, nil
+}
+
+// LatestTimestampAdded returns the time the most recently added skylink out of
+// the skylinks with the given hashes was added, it's zero if none of them is
+// in the store.
+func (ms *MemoryStore) LatestTimestampAdded(ctx context.Context, hashes []Hash) (time.Time, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	in := hashSet(hashes)
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		_, exists := in[bsl.Hash]
+		return exists
+	})
+	if len(docs) == 0 {
+		return time.Time{}, nil
+	}
+	sortByTimestampAdded(docs, -1)
+	return docs[0].TimestampAdded, nil
+}
+
+// SkylinksAfter returns at most 'limit' skylinks of which the id is greater
+// than the given id, sorted by id. Soft-deleted skylinks are included. Only the
+// hash, the state flags and the time the skylink got blocked are returned.
+func (ms *MemoryStore) SkylinksAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]BlockedSkylink, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bytes.Compare(bsl.ID[:], after[:]) > 0
+	}, IncludeDeleted())
+	docs = limitSkylinks(docs, limit)
+
+	list := make([]BlockedSkylink, len(docs))
+	for i, bsl := range docs {
+		list[i] = BlockedSkylink{
+			ID:               bsl.ID,
+			Deleted:          bsl.Deleted,
+			Failed:           bsl.Failed,
+			Hash:             bsl.Hash,
+			Invalid:          bsl.Invalid,
+			Reverted:         bsl.Reverted,
+			TimestampBlocked: bsl.TimestampBlocked,
+		}
+		list[i].resolveOrigin()
+	}
+	return list, nil
+}
+
+// HashesToBlock returns the hashes of the unblocked skylinks that were added
+// after the given timestamp. The hashes are sorted by severity, critical ones
+// come first, and within a severity the missing content comes last.
+func (ms *MemoryStore) HashesToBlock(ctx context.Context, from time.Time, queryOpts ...QueryOption) ([]Hash, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return !bsl.TimestampAdded.Before(from) && !bsl.Failed && !bsl.Invalid && !bsl.Reverted && !bsl.SkippedAllowListed
+	}, queryOpts...)
+
+	severities := newQueryOptions(queryOpts...).severities
+	rank := func(bsl *BlockedSkylink) int {
+		if bsl.Severity == "" {
+			return severityRank(severities.Severity(bsl.Tags))
+		}
+		return severityRank(bsl.Severity)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		if rank(docs[i]) != rank(docs[j]) {
+			return rank(docs[i]) > rank(docs[j])
+		}
+		return !docs[i].ContentMissing && docs[j].ContentMissing
+	})
+	return skylinkHashes(docs), nil
+}
+
+// HashesToRetry returns the hashes that failed to get blocked, transient
+// failures come first, within each failure class the oldest hashes come first.
+// A limit of zero or less returns all of them.
+func (ms *MemoryStore) HashesToRetry(ctx context.Context, limit int, queryOpts ...QueryOption) ([]Hash, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.Failed && !bsl.Invalid && !bsl.Reverted && !bsl.SkippedAllowListed
+	}, queryOpts...)
+	sortByTimestampAdded(docs, 1)
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].FailureClass > docs[j].FailureClass
+	})
+	return skylinkHashes(limitSkylinks(docs, limit)), nil
+}
+
+// HashesToUnblock returns the hashes of the reverted and soft-deleted skylinks
+// that skyd confirmed blocking, the oldest reverts come first, preceded by the
+// soft-deleted skylinks that weren't reverted.
+func (ms *MemoryStore) HashesToUnblock(ctx context.Context, limit int) ([]Hash, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return (bsl.Reverted || bsl.Deleted) && !bsl.TimestampBlocked.IsZero()
+	}, IncludeDeleted())
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].TimestampReverted.Before(docs[j].TimestampReverted)
+	})
+	return skylinkHashes(limitSkylinks(docs, limit)), nil
+}
+
+// MarkFailed marks the given skylinks as failed with the given failure class
+// and reason, invalid skylinks are not updated.
+func (ms *MemoryStore) MarkFailed(ctx context.Context, hashes []Hash, class, reason string) error {
+	if class != FailureClassTransient && class != FailureClassPermanent {
+		return fmt.Errorf("unknown failure class '%v'", class)
+	}
+	detail := class
+	if reason != "" {
+		detail += ": " + reason
+	}
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		if bsl.Invalid {
+			continue
+		}
+		bsl.Failed = true
+		bsl.FailureClass = class
+		bsl.FailureReason = reason
+		addEvent(bsl, newEvent(EventFailed, detail))
+	}
+	return nil
+}
+
+// MarkInvalid marks the given skylinks as invalid.
+func (ms *MemoryStore) MarkInvalid(ctx context.Context, hashes []Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		bsl.Invalid = true
+		addEvent(bsl, newEvent(EventInvalid, ""))
+	}
+	return nil
+}
+
+// MarkSkippedAllowListed marks the given skylinks as skipped because their
+// hash is on the allow list.
+func (ms *MemoryStore) MarkSkippedAllowListed(ctx context.Context, hashes []Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		bsl.SkippedAllowListed = true
+		addEvent(bsl, newEvent(EventSkippedAllowListed, ""))
+	}
+	return nil
+}
+
+// MarkSucceeded clears the failure of the given skylinks and records when they
+// were confirmed blocked, unless that was recorded already. Invalid skylinks
+// are not updated.
+func (ms *MemoryStore) MarkSucceeded(ctx context.Context, hashes []Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		if bsl.Invalid {
+			continue
+		}
+		bsl.Failed = false
+		bsl.FailureClass = ""
+		bsl.FailureReason = ""
+		if bsl.TimestampBlocked.IsZero() {
+			bsl.TimestampBlocked = Now()
+		}
+		addEvent(bsl, newEvent(EventSucceeded, ""))
+	}
+	return nil
+}
+
+// MarkUnblocked marks the given reverted or soft-deleted skylinks as removed
+// from skyd's blocklist.
+func (ms *MemoryStore) MarkUnblocked(ctx context.Context, hashes []Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		if !bsl.Reverted && !bsl.Deleted {
+			continue
+		}
+		bsl.TimestampBlocked = time.Time{}
+		addEvent(bsl, newEvent(EventUnblocked, ""))
+	}
+	return nil
+}
+
+// ReconcileBlocked reports which of the given hashes carry the success marker
+// set by MarkSucceeded, see DB.ReconcileBlocked.
+func (ms *MemoryStore) ReconcileBlocked(ctx context.Context, hashes []Hash) (marked, unmarked []Hash, err error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		if bsl.Invalid {
+			continue
+		}
+		if !bsl.TimestampBlocked.IsZero() && !bsl.Failed {
+			marked = append(marked, bsl.Hash)
+		} else {
+			unmarked = append(unmarked, bsl.Hash)
+		}
+	}
+	return marked, unmarked, nil
+}
+
+// ClearBlocked clears the time the given skylinks got blocked, which makes
+// them pending again.
+func (ms *MemoryStore) ClearBlocked(ctx context.Context, hashes []Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	for _, bsl := range ms.byHashes(hashes) {
+		if bsl.TimestampBlocked.IsZero() {
+			continue
+		}
+		bsl.TimestampBlocked = time.Time{}
+		addEvent(bsl, newEvent(EventRequeued, "missing from skyd's blocklist"))
+	}
+	return nil
+}
+
+// ResurrectInvalid resurrects the invalid skylink with the given hash because
+// it got reported again, see DB.ResurrectInvalid. It returns
+// ErrNoDocumentsFound if there's no invalid skylink with the given hash.
+func (ms *MemoryStore) ResurrectInvalid(ctx context.Context, hash Hash, report *BlockedSkylink) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash)
+	if bsl == nil || !bsl.Invalid {
+		return ErrNoDocumentsFound
+	}
+
+	timestampAdded := report.TimestampAdded
+	if timestampAdded.IsZero() {
+		timestampAdded = Now()
+	}
+	addEvent(bsl, newEvent(EventResurrected, ""))
+	bsl.Failed = false
+	bsl.Invalid = false
+	bsl.TimestampAdded = truncateTime(timestampAdded)
+	bsl.TimestampBlocked = time.Time{}
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&bsl.Reporter.Name, report.Reporter.Name},
+		{&bsl.Reporter.Email, report.Reporter.Email},
+		{&bsl.Reporter.OtherContact, report.Reporter.OtherContact},
+		{&bsl.Reporter.Sub, report.Reporter.Sub},
+		{&bsl.Source, report.Source},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+	if report.Reporter.Sub != "" {
+		bsl.Reporter.Unauthenticated = false
+	}
+	if len(report.Tags) > 0 {
+		bsl.Tags = unionStrings(bsl.Tags, report.Tags)
+	}
+	if len(report.Metadata) > 0 {
+		if bsl.Metadata == nil {
+			bsl.Metadata = make(map[string]string, len(report.Metadata))
+		}
+		for key, value := range report.Metadata {
+			bsl.Metadata[key] = value
+		}
+	}
+	return nil
+}
+
+// ResetBlockedSkylink resets the processing state of the skylink with the
+// given hash so it gets sent to skyd again, see DB.ResetBlockedSkylink. It
+// returns ErrNoDocumentsFound if there's no skylink with the given hash.
+func (ms *MemoryStore) ResetBlockedSkylink(ctx context.Context, hash Hash, bump bool, detail string) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash)
+	if bsl == nil {
+		return ErrNoDocumentsFound
+	}
+	addEvent(bsl, newEvent(EventReset, detail))
+	bsl.Failed = false
+	bsl.FailureClass = ""
+	bsl.FailureReason = ""
+	bsl.Invalid = false
+	bsl.SkippedAllowListed = false
+	if bump {
+		bsl.TimestampAdded = Now()
+	}
+	return nil
+}
+
+// SoftDelete marks the skylink with the given hash as deleted, see
+// DB.SoftDelete. It returns ErrNoDocumentsFound if there's no skylink with the
+// given hash or if it was deleted already.
+func (ms *MemoryStore) SoftDelete(ctx context.Context, hash Hash, detail string) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash)
+	if bsl == nil {
+		return ErrNoDocumentsFound
+	}
+	bsl.Deleted = true
+	bsl.DeletedAt = Now()
+	addEvent(bsl, newEvent(EventDeleted, detail))
+	return nil
+}
+
+// RevertTags reverts the given tags of the skylink with the given hash, or all
+// of its tags if none are given, see DB.RevertTags. It returns the updated
+// skylink, or ErrNoDocumentsFound if there's no skylink with the given hash.
+func (ms *MemoryStore) RevertTags(ctx context.Context, hash Hash, tags []string, detail string) (*BlockedSkylink, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	bsl := ms.findOne(hash)
+	if bsl == nil {
+		return nil, ErrNoDocumentsFound
+	}
+
+	revert := bsl.Tags
+	if len(tags) > 0 {
+		revert = tags
+	}
+	active := make([]string, 0, len(bsl.Tags))
+	reverted := append(make([]string, 0, len(bsl.RevertedTags)), bsl.RevertedTags...)
+	for _, tag := range bsl.Tags {
+		switch {
+		case !containsString(revert, tag):
+			active = append(active, tag)
+		case !containsString(bsl.RevertedTags, tag):
+			reverted = append(reverted, tag)
+		}
+	}
+	bsl.Tags = active
+	bsl.RevertedTags = reverted
+	addEvent(bsl, newEvent(EventReverted, detail))
+	if len(active) == 0 && !bsl.Reverted {
+		bsl.TimestampReverted = Now()
+	}
+	bsl.Reverted = len(active) == 0
+
+	updated := exportSkylink(bsl)
+	return &updated, nil
+}
+
+// ArchiveReverted moves the reverted skylinks that got reverted before the
+// given time, and that were removed from skyd's blocklist, to the archive. It
+// returns the number of archived skylinks.
+func (ms *MemoryStore) ArchiveReverted(ctx context.Context, before time.Time) (int, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+
+	now := Now()
+	var archived int
+	kept := make([]*BlockedSkylink, 0, len(ms.skylinks))
+	for _, bsl := range ms.skylinks {
+		if !bsl.Reverted || !bsl.TimestampReverted.Before(before) || !bsl.TimestampBlocked.IsZero() {
+			kept = append(kept, bsl)
+			continue
+		}
+		bsl.Archived = true
+		bsl.TimestampArchived = now
+		ms.archive[bsl.Hash] = bsl
+		delete(ms.byHash, bsl.Hash)
+		archived++
+	}
+	ms.skylinks = kept
+	return archived, nil
+}
+
+// RestoreArchived moves the archived skylink with the given hash back into the
+// store as the given report, see DB.RestoreArchived.
+func (ms *MemoryStore) RestoreArchived(ctx context.Context, hash Hash, report *BlockedSkylink) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	archived, exists := ms.archive[hash]
+	if !exists {
+		return ErrNoDocumentsFound
+	}
+
+	restored := restoreArchived(*archived, report)
+	err := restored.Validate()
+	if err != nil {
+		return errors.AddContext(err, "unexpected blocked skylink")
+	}
+	if !ms.insert(restored) {
+		return ErrSkylinkExists
+	}
+	delete(ms.archive, hash)
+	return nil
+}
+
+// CallbacksToDeliver returns at most 'limit' skylinks that carry a callback
+// url and that are either confirmed blocked or invalid, sorted by the time
+// they were added.
+func (ms *MemoryStore) CallbacksToDeliver(ctx context.Context, limit int) ([]BlockedSkylink, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.CallbackURL != "" && (!bsl.TimestampBlocked.IsZero() || bsl.Invalid)
+	})
+	sortByTimestampAdded(docs, 1)
+	return exportSkylinks(limitSkylinks(docs, limit)), nil
+}
+
+// ClearCallback removes the callback url of the skylink with the given hash,
+// along with the number of attempts to deliver it.
+func (ms *MemoryStore) ClearCallback(ctx context.Context, hash Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if bsl, exists := ms.byHash[hash]; exists {
+		bsl.CallbackURL = ""
+		bsl.CallbackAttempts = 0
+	}
+	return nil
+}
+
+// IncrementCallbackAttempts increments the number of failed attempts to
+// deliver the callback of the skylink with the given hash.
+func (ms *MemoryStore) IncrementCallbackAttempts(ctx context.Context, hash Hash) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if bsl, exists := ms.byHash[hash]; exists && bsl.CallbackURL != "" {
+		bsl.CallbackAttempts++
+	}
+	return nil
+}
+
+// CreateAllowListedSkylink creates a new allowlisted skylink. If the skylink
+// already exists it does nothing and returns without failure.
+func (ms *MemoryStore) CreateAllowListedSkylink(ctx context.Context, skylink *AllowListedSkylink) error {
+	skylink.Namespace = ms.staticNamespace
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if _, exists := ms.allowList[skylink.Hash]; exists {
+		return nil
+	}
+	allowListed := *skylink
+	if allowListed.ID.IsZero() {
+		allowListed.ID = primitive.NewObjectID()
+	}
+	allowListed.TimestampAdded = truncateTime(allowListed.TimestampAdded)
+	ms.allowList[skylink.Hash] = allowListed
+	return nil
+}
+
+// AllowListedHashes returns the subset of the given hashes that are on the
+// allow list.
+func (ms *MemoryStore) AllowListedHashes(ctx context.Context, hashes []Hash) ([]Hash, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	allowListed := make([]Hash, 0)
+	for hash := range hashSet(hashes) {
+		if _, exists := ms.allowList[hash]; exists {
+			allowListed = append(allowListed, hash)
+		}
+	}
+	return allowListed, nil
+}
+
+// FindAllowListed returns the allowlisted skylinks of the given hashes, those
+// that aren't on the allow list are left out.
+func (ms *MemoryStore) FindAllowListed(ctx context.Context, hashes []Hash) ([]AllowListedSkylink, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	allowListed := make([]AllowListedSkylink, 0)
+	for hash := range hashSet(hashes) {
+		if doc, exists := ms.allowList[hash]; exists {
+			allowListed = append(allowListed, doc)
+		}
+	}
+	return allowListed, nil
+}
+
+// IsAllowListed returns whether the given skylink is on the allow list.
+func (ms *MemoryStore) IsAllowListed(ctx context.Context, hash crypto.Hash) (bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	_, exists := ms.allowList[Hash{hash}]
+	return exists, nil
+}
+
+// CreateAllowListedPublisher allowlists the v2 skylinks of the given publisher.
+// If the publisher is allowlisted already it does nothing and returns without
+// failure.
+func (ms *MemoryStore) CreateAllowListedPublisher(ctx context.Context, publisher *AllowListedPublisher) error {
+	publisher.Namespace = ms.staticNamespace
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if _, exists := ms.allowListPublishers[publisher.PublicKey]; exists {
+		return nil
+	}
+	allowListed := *publisher
+	if allowListed.ID.IsZero() {
+		allowListed.ID = primitive.NewObjectID()
+	}
+	allowListed.TimestampAdded = truncateTime(allowListed.TimestampAdded)
+	ms.allowListPublishers[publisher.PublicKey] = allowListed
+	return nil
+}
+
+// IsPublisherAllowListed returns whether the publisher with the given public
+// key is on the allow list.
+func (ms *MemoryStore) IsPublisherAllowListed(ctx context.Context, publicKey string) (bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	_, exists := ms.allowListPublishers[publicKey]
+	return exists, nil
+}
+
+// RecordAllowListHit records that the given allowlisted skylink got reported.
+// Hits expire after the allowlist hit window.
+func (ms *MemoryStore) RecordAllowListHit(ctx context.Context, hit AllowListHit) error {
+	hit.ID = primitive.NewObjectID()
+	hit.Namespace = ms.staticNamespace
+	if hit.TimestampAdded.IsZero() {
+		hit.TimestampAdded = Now()
+	}
+	hit.TimestampAdded = truncateTime(hit.TimestampAdded)
+
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+
+	// drop the expired hits
+	hits := ms.allowListHits[:0]
+	for _, h := range ms.allowListHits {
+		if time.Since(h.TimestampAdded) <= AllowListHitWindow {
+			hits = append(hits, h)
+		}
+	}
+	ms.allowListHits = append(hits, hit)
+	return nil
+}
+
+// AllowListHits returns the allowlisted skylinks that got reported the most,
+// see DB.AllowListHits.
+func (ms *MemoryStore) AllowListHits(ctx context.Context, limit int) ([]AllowListHitCount, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+
+	byHash := make(map[Hash]*AllowListHitCount)
+	reporters := make(map[Hash]map[string]struct{})
+	for _, hit := range ms.allowListHits {
+		count, exists := byHash[hit.Hash]
+		if !exists {
+			count = &AllowListHitCount{Hash: hit.Hash}
+			byHash[hit.Hash] = count
+			reporters[hit.Hash] = make(map[string]struct{})
+		}
+		count.Hits++
+		if hit.TimestampAdded.After(count.LastHit) {
+			count.LastHit = hit.TimestampAdded
+		}
+		if hit.Reporter != "" {
+			reporters[hit.Hash][hit.Reporter] = struct{}{}
+		}
+	}
+
+	counts := make([]AllowListHitCount, 0, len(byHash))
+	for hash, count := range byHash {
+		count.Reporters = len(reporters[hash])
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Hits != counts[j].Hits {
+			return counts[i].Hits > counts[j].Hits
+		}
+		return counts[i].Hash.String() < counts[j].Hash.String()
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
+
+// IncrementProofUsage increments the usage counter of the proof with the given
+// hash by n and returns the updated counter, proofs expire after the proof
+// usage window.
+func (ms *MemoryStore) IncrementProofUsage(ctx context.Context, proofHash Hash, n int) (int, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	proof, exists := ms.proofs[proofHash]
+	if !exists || time.Since(proof.TimestampAdded) > proofUsageWindow {
+		proof = UsedProof{
+			ID:             primitive.NewObjectID(),
+			Hash:           proofHash,
+			TimestampAdded: Now(),
+		}
+	}
+	proof.Uses += n
+	ms.proofs[proofHash] = proof
+	return proof.Uses, nil
+}
+
+// RecordReports records that the given MySkyID made n reports at the given
+// time. Records expire after the report window.
+func (ms *MemoryStore) RecordReports(ctx context.Context, mySkyID string, n int, timestamp time.Time) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+
+	// drop the expired records
+	reports := ms.reports[:0]
+	for _, report := range ms.reports {
+		if time.Since(report.TimestampAdded) <= ReportWindow {
+			reports = append(reports, report)
+		}
+	}
+	ms.reports = append(reports, Report{
+		ID:             primitive.NewObjectID(),
+		MySkyID:        mySkyID,
+		Reports:        n,
+		TimestampAdded: truncateTime(timestamp),
+	})
+	return nil
+}
+
+// NumReports returns the number of reports made by the given MySkyID since the
+// given time.
+func (ms *MemoryStore) NumReports(ctx context.Context, mySkyID string, since time.Time) (int, error) {
+	reports, _, err := ms.ReportUsage(ctx, mySkyID, since)
+	return reports, err
+}
+
+// ReportUsage returns the number of reports made by the given MySkyID since
+// the given time, and the time of the oldest of those reports. The time is
+// zero if the MySkyID made no reports.
+func (ms *MemoryStore) ReportUsage(ctx context.Context, mySkyID string, since time.Time) (int, time.Time, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	var total int
+	var oldest time.Time
+	for _, report := range ms.reports {
+		if report.MySkyID != mySkyID || report.TimestampAdded.Before(since) {
+			continue
+		}
+		total += report.Reports
+		if oldest.IsZero() || report.TimestampAdded.Before(oldest) {
+			oldest = report.TimestampAdded
+		}
+	}
+	return total, oldest, nil
+}
+
+// BlockIdentity adds the given MySkyID to the blocked identities, along with
+// the reason it got blocked. If the MySkyID is blocked already its reason gets
+// updated.
+func (ms *MemoryStore) BlockIdentity(ctx context.Context, mySkyID, reason string) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	identity, exists := ms.identities[mySkyID]
+	if !exists {
+		identity = BlockedIdentity{
+			ID:             primitive.NewObjectID(),
+			MySkyID:        mySkyID,
+			Namespace:      ms.staticNamespace,
+			TimestampAdded: Now(),
+		}
+	}
+	identity.Reason = reason
+	ms.identities[mySkyID] = identity
+	return nil
+}
+
+// UnblockIdentity removes the given MySkyID from the blocked identities. It
+// returns ErrNoDocumentsFound if the MySkyID isn't blocked.
+func (ms *MemoryStore) UnblockIdentity(ctx context.Context, mySkyID string) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	if _, exists := ms.identities[mySkyID]; !exists {
+		return ErrNoDocumentsFound
+	}
+	delete(ms.identities, mySkyID)
+	return nil
+}
+
+// BlockedIdentities returns all blocked identities, most recently blocked
+// first.
+func (ms *MemoryStore) BlockedIdentities(ctx context.Context) ([]BlockedIdentity, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	identities := make([]BlockedIdentity, 0, len(ms.identities))
+	for _, identity := range ms.identities {
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if !identities[i].TimestampAdded.Equal(identities[j].TimestampAdded) {
+			return identities[i].TimestampAdded.After(identities[j].TimestampAdded)
+		}
+		return bytes.Compare(identities[i].ID[:], identities[j].ID[:]) > 0
+	})
+	return identities, nil
+}
+
+// IsIdentityBlocked returns whether the given MySkyID is blocked.
+func (ms *MemoryStore) IsIdentityBlocked(ctx context.Context, mySkyID string) (bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	_, exists := ms.identities[mySkyID]
+	return exists, nil
+}
+
+// LatestBlockTimestamp returns the latest block timestamp of the blocker with
+// the given server UID. It returns false if the blocker never stored one.
+func (ms *MemoryStore) LatestBlockTimestamp(ctx context.Context, serverUID string) (time.Time, bool, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	doc, exists := ms.latestBlockTimestamps[serverUID]
+	return doc.Timestamp, exists, nil
+}
+
+// UpdateLatestBlockTimestamp stores the latest block timestamp of the blocker
+// with the given server UID, along with the time it was updated.
+func (ms *MemoryStore) UpdateLatestBlockTimestamp(ctx context.Context, serverUID string, timestamp time.Time) error {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	ms.latestBlockTimestamps[serverUID] = LatestBlockTimestamp{
+		ServerUID:   serverUID,
+		Timestamp:   truncateTime(timestamp),
+		LastUpdated: Now(),
+	}
+	return nil
+}
+
+// LatestBlockTimestamps returns the latest block timestamps of all blockers,
+// sorted by server UID.
+func (ms *MemoryStore) LatestBlockTimestamps(ctx context.Context) ([]LatestBlockTimestamp, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := make([]LatestBlockTimestamp, 0, len(ms.latestBlockTimestamps))
+	for _, doc := range ms.latestBlockTimestamps {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].ServerUID < docs[j].ServerUID
+	})
+	return docs, nil
+}
+
+// PruneLatestBlockTimestamps removes the latest block timestamps that weren't
+// updated since the given time, except the one of the given server UID, see
+// DB.PruneLatestBlockTimestamps.
+func (ms *MemoryStore) PruneLatestBlockTimestamps(ctx context.Context, before time.Time, except string) (int, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	var pruned int
+	for serverUID, doc := range ms.latestBlockTimestamps {
+		if serverUID != except && doc.LastUpdated.Before(before) {
+			delete(ms.latestBlockTimestamps, serverUID)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// ActivitySeries returns the number of skylinks reported within the given
+// window, grouped in buckets of the given size, see DB.ActivitySeries.
+func (ms *MemoryStore) ActivitySeries(ctx context.Context, bucket, window time.Duration, queryOpts ...QueryOption) ([]ActivityBucket, error) {
+	if bucket < time.Millisecond || bucket%time.Millisecond != 0 {
+		return nil, errors.New("bucket must be a positive number of milliseconds")
+	}
+	if window < bucket {
+		return nil, errors.New("window must be at least as large as the bucket")
+	}
+	n := int(window/bucket) + 1
+	if n > MaxActivityBuckets {
+		return nil, errors.New("too many buckets")
+	}
+	last := truncateToBucket(time.Now(), bucket)
+	first := last.Add(-time.Duration(n-1) * bucket)
+
+	series := make([]ActivityBucket, n)
+	for i := range series {
+		series[i].Start = first.Add(time.Duration(i) * bucket)
+		series[i].Sources = make(map[string]int, len(activitySources))
+		for _, source := range activitySources {
+			series[i].Sources[source] = 0
+		}
+	}
+
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return !bsl.TimestampAdded.Before(first) && !bsl.Invalid
+	}, queryOpts...)
+	for _, bsl := range docs {
+		i := int(truncateToBucket(bsl.TimestampAdded, bucket).Sub(first) / bucket)
+		if i < 0 || i >= n {
+			continue
+		}
+		source := bsl.Source
+		if source == "" {
+			source = SourceUnknown
+		}
+		series[i].Total++
+		series[i].Sources[source]++
+	}
+	return series, nil
+}
+
+// BlockLatency returns the percentiles of the time it took to block the
+// skylinks that were reported since the given time, see DB.BlockLatency.
+func (ms *MemoryStore) BlockLatency(ctx context.Context, since time.Time, queryOpts ...QueryOption) (BlockLatency, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return !bsl.TimestampAdded.Before(since) && !bsl.TimestampBlocked.IsZero() && !bsl.Invalid
+	}, queryOpts...)
+	if len(docs) == 0 {
+		return BlockLatency{}, nil
+	}
+
+	latencies := make([]int64, len(docs))
+	for i, bsl := range docs {
+		latencies[i] = bsl.TimestampBlocked.Sub(bsl.TimestampAdded).Milliseconds()
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	// percentile picks the given percentile from the sorted latencies using
+	// the nearest-rank method
+	percentile := func(p float64) int64 {
+		return latencies[int(math.Ceil(float64(len(latencies))*p-1))]
+	}
+	return BlockLatency{
+		Count: len(latencies),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+	}, nil
+}
+
+// FailureCounts returns the number of skylinks that are currently marked as
+// failed, by failure class.
+func (ms *MemoryStore) FailureCounts(ctx context.Context, queryOpts ...QueryOption) (map[string]int, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	counts := map[string]int{
+		FailureClassPermanent: 0,
+		FailureClassTransient: 0,
+	}
+	for _, bsl := range ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.Failed && !bsl.Invalid
+	}, queryOpts...) {
+		class := bsl.FailureClass
+		if class == "" {
+			class = FailureClassUnknown
+		}
+		counts[class]++
+	}
+	return counts, nil
+}
+
+// ReporterStats returns the stats of the reporters that reported skylinks
+// since the given time, by reporter and tag, see DB.ReporterStats.
+func (ms *MemoryStore) ReporterStats(ctx context.Context, since time.Time, source string, queryOpts ...QueryOption) ([]ReporterTagStats, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return !bsl.TimestampAdded.Before(since) && bsl.Reporter.Sub != "" && (source == "" || bsl.Source == source)
+	}, queryOpts...)
+
+	type key struct{ reporter, tag string }
+	byKey := make(map[key]*ReporterTagStats)
+	timestamps := make(map[key][]time.Time)
+	for _, bsl := range docs {
+		for _, tag := range unionStrings(bsl.Tags, bsl.RevertedTags) {
+			k := key{bsl.Reporter.Sub, tag}
+			stats, exists := byKey[k]
+			if !exists {
+				stats = &ReporterTagStats{Reporter: k.reporter, Tag: k.tag}
+				byKey[k] = stats
+			}
+			reverted := bsl.Reverted || containsString(bsl.RevertedTags, tag)
+			stats.Reports++
+			if bsl.Invalid {
+				stats.Invalid++
+			}
+			if reverted {
+				stats.Reverted++
+			}
+			if bsl.Invalid || reverted {
+				stats.Bogus++
+			}
+			timestamps[k] = append(timestamps[k], bsl.TimestampAdded)
+		}
+	}
+
+	stats := make([]ReporterTagStats, 0, len(byKey))
+	for k, s := range byKey {
+		s.MedianInterval = medianInterval(timestamps[k])
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Reporter != stats[j].Reporter {
+			return stats[i].Reporter < stats[j].Reporter
+		}
+		return stats[i].Tag < stats[j].Tag
+	})
+	return stats, nil
+}
+
+// Backlog returns the number of skylinks that are currently marked as failed
+// or invalid, see DB.Backlog.
+func (ms *MemoryStore) Backlog(ctx context.Context, queryOpts ...QueryOption) (Backlog, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	failed := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.Failed && !bsl.Invalid && !bsl.SkippedAllowListed
+	}, queryOpts...)
+	invalid := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.Invalid
+	}, queryOpts...)
+	return Backlog{Failed: len(failed), Invalid: len(invalid)}, nil
+}
+
+// OldestUnblocked returns the time at which the oldest skylink that is still
+// waiting to get blocked was added, or the zero time if there's none.
+func (ms *MemoryStore) OldestUnblocked(ctx context.Context, queryOpts ...QueryOption) (time.Time, error) {
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.TimestampBlocked.IsZero() && !bsl.Invalid && !bsl.SkippedAllowListed
+	}, queryOpts...)
+	if len(docs) == 0 {
+		return time.Time{}, nil
+	}
+	sortByTimestampAdded(docs, 1)
+	return docs[0].TimestampAdded, nil
+}
+
+// insert inserts a copy of the given skylink, it returns false if a skylink
+// with the same hash exists already. The caller is expected to hold the lock.
+func (ms *MemoryStore) insert(skylink BlockedSkylink) bool {
+	if _, exists := ms.byHash[skylink.Hash]; exists {
+		return false
+	}
+	bsl := copySkylink(skylink)
+	bsl.Namespace = ms.staticNamespace
+	if bsl.ID.IsZero() {
+		bsl.ID = primitive.NewObjectID()
+	}
+	ms.skylinks = append(ms.skylinks, &bsl)
+	ms.byHash[bsl.Hash] = &bsl
+	return true
+}
+
+// insertMany validates and inserts the given skylinks, ignoring duplicates. It
+// returns the number of inserted skylinks and the indices of the skylinks that
+// already existed.
+func (ms *MemoryStore) insertMany(skylinks []BlockedSkylink) (int, []int, error) {
+	for _, skylink := range skylinks {
+		err := skylink.Validate()
+		if err != nil {
+			return 0, nil, errors.AddContext(err, "unexpected blocked skylink")
+		}
+	}
+
+	ms.staticMu.Lock()
+	defer ms.staticMu.Unlock()
+	var inserted int
+	var duplicates []int
+	for i, skylink := range skylinks {
+		if ms.insert(skylink) {
+			inserted++
+		} else {
+			duplicates = append(duplicates, i)
+		}
+	}
+	return inserted, duplicates, nil
+}
+
+// filter returns the skylinks that match the given condition along with the
+// conditions every read path has to honour, see DB.skylinksFilter. They are
+// returned in the order they were inserted. The caller is expected to hold the
+// lock.
+func (ms *MemoryStore) filter(cond func(*BlockedSkylink) bool, queryOpts ...QueryOption) []*BlockedSkylink {
+	return ms.filterIn(ms.skylinks, cond, queryOpts...)
+}
+
+// filterIn returns the given skylinks that match the given condition along
+// with the conditions every read path has to honour, see filter.
+func (ms *MemoryStore) filterIn(skylinks []*BlockedSkylink, cond func(*BlockedSkylink) bool, queryOpts ...QueryOption) []*BlockedSkylink {
+	opts := newQueryOptions(queryOpts...)
+	namespace := ms.staticNamespace
+	if opts.namespace != "" {
+		namespace = opts.namespace
+	}
+
+	var docs []*BlockedSkylink
+	for _, bsl := range skylinks {
+		if bsl.Namespace != namespace || (bsl.Deleted && !opts.includeDeleted) {
+			continue
+		}
+		if !metadataMatches(bsl.Metadata, opts.metadata) {
+			continue
+		}
+		if len(opts.tags) > 0 && !containsAnyString(bsl.Tags, opts.tags) {
+			continue
+		}
+		if opts.hashPrefix != "" && !strings.HasPrefix(bsl.Hash.String(), opts.hashPrefix) {
+			continue
+		}
+		if !opts.addedBefore.IsZero() && !bsl.TimestampAdded.Before(opts.addedBefore) {
+			continue
+		}
+		if cond != nil && !cond(bsl) {
+			continue
+		}
+		docs = append(docs, bsl)
+	}
+	return docs
+}
+
+// findOne returns the skylink with the given hash that matches the given query
+// options, or nil if there's none. The caller is expected to hold the lock.
+func (ms *MemoryStore) findOne(hash Hash, queryOpts ...QueryOption) *BlockedSkylink {
+	docs := ms.filter(func(bsl *BlockedSkylink) bool {
+		return bsl.Hash == hash
+	}, queryOpts...)
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[0]
+}
+
+// byHashes returns the skylinks with the given hashes, soft-deleted skylinks
+// included, which mirrors the namespaced filter of the DB's updates. The
+// caller is expected to hold the lock.
+func (ms *MemoryStore) byHashes(hashes []Hash) []*BlockedSkylink {
+	var docs []*BlockedSkylink
+	for hash := range hashSet(hashes) {
+		if bsl, exists := ms.byHash[hash]; exists {
+			docs = append(docs, bsl)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return bytes.Compare(docs[i].ID[:], docs[j].ID[:]) < 0
+	})
+	return docs
+}
+
+// addEvent appends the given event to the events of the given skylink, only
+// the last MaxEvents events are kept.
+func addEvent(bsl *BlockedSkylink, event Event) {
+	bsl.Events = append(bsl.Events, event)
+	if len(bsl.Events) > MaxEvents {
+		bsl.Events = append([]Event(nil), bsl.Events[len(bsl.Events)-MaxEvents:]...)
+	}
+}
+
+// copySkylink returns a deep copy of the given skylink, with its timestamps
+// truncated to milliseconds like they would be when stored in MongoDB.
+func copySkylink(bsl BlockedSkylink) BlockedSkylink {
+	bsl.DeletedAt = truncateTime(bsl.DeletedAt)
+	bsl.TimestampAdded = truncateTime(bsl.TimestampAdded)
+	bsl.TimestampArchived = truncateTime(bsl.TimestampArchived)
+	bsl.TimestampBlocked = truncateTime(bsl.TimestampBlocked)
+	bsl.TimestampReverted = truncateTime(bsl.TimestampReverted)
+	if bsl.Events != nil {
+		bsl.Events = append([]Event{}, bsl.Events...)
+		for i := range bsl.Events {
+			bsl.Events[i].Timestamp = truncateTime(bsl.Events[i].Timestamp)
+		}
+	}
+	if bsl.MergedReporters != nil {
+		bsl.MergedReporters = append([]Reporter{}, bsl.MergedReporters...)
+	}
+	if bsl.Metadata != nil {
+		metadata := make(map[string]string, len(bsl.Metadata))
+		for key, value := range bsl.Metadata {
+			metadata[key] = value
+		}
+		bsl.Metadata = metadata
+	}
+	if bsl.RevertedTags != nil {
+		bsl.RevertedTags = append([]string{}, bsl.RevertedTags...)
+	}
+	if bsl.SeenOnPortals != nil {
+		bsl.SeenOnPortals = append([]string{}, bsl.SeenOnPortals...)
+	}
+	if bsl.Tags != nil {
+		bsl.Tags = append([]string{}, bsl.Tags...)
+	}
+	return bsl
+}
+
+// exportSkylink returns a copy of the given stored skylink with its origin
+// resolved, as the DB returns it.
+func exportSkylink(bsl *BlockedSkylink) BlockedSkylink {
+	exported := copySkylink(*bsl)
+	exported.resolveOrigin()
+	return exported
+}
+
+// exportSkylinks returns a copy of the given stored skylinks, see
+// exportSkylink.
+func exportSkylinks(docs []*BlockedSkylink) []BlockedSkylink {
+	list := make([]BlockedSkylink, len(docs))
+	for i, bsl := range docs {
+		list[i] = exportSkylink(bsl)
+	}
+	return list
+}
+
+// skylinkHashes returns the hashes of the given skylinks.
+func skylinkHashes(docs []*BlockedSkylink) []Hash {
+	hashes := make([]Hash, len(docs))
+	for i, bsl := range docs {
+		hashes[i] = bsl.Hash
+	}
+	return hashes
+}
+
+// sortByTimestampAdded sorts the given skylinks by the time they were added in
+// the given order, using their id as tiebreaker, see timestampAddedSort.
+func sortByTimestampAdded(docs []*BlockedSkylink, order int) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		a, b := docs[i], docs[j]
+		if order < 0 {
+			a, b = b, a
+		}
+		if !a.TimestampAdded.Equal(b.TimestampAdded) {
+			return a.TimestampAdded.Before(b.TimestampAdded)
+		}
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0
+	})
+}
+
+// page returns the page of the given skylinks at the given offset, alongside
+// a boolean that indicates whether there's more skylinks after the page.
+func page(docs []*BlockedSkylink, skip, limit int) ([]*BlockedSkylink, bool) {
+	if skip >= len(docs) {
+		return nil, false
+	}
+	docs = docs[skip:]
+	if len(docs) > limit {
+		return docs[:limit], true
+	}
+	return docs, false
+}
+
+// limitSkylinks returns at most 'limit' of the given skylinks, a limit of zero
+// or less returns all of them.
+func limitSkylinks(docs []*BlockedSkylink, limit int) []*BlockedSkylink {
+	if limit > 0 && len(docs) > limit {
+		return docs[:limit]
+	}
+	return docs
+}
+
+// truncateTime returns the given time in UTC truncated to milliseconds, which
+// is the precision at which MongoDB stores timestamps. The zero time is
+// returned as is.
+func truncateTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// hashSet returns the given hashes as a set.
+func hashSet(hashes []Hash) map[Hash]struct{} {
+	set := make(map[Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		set[hash] = struct{}{}
+	}
+	return set
+}
+
+// metadataMatches returns whether the given metadata holds all of the given
+// key-value pairs.
+func metadataMatches(metadata, pairs map[string]string) bool {
+	for key, value := range pairs {
+		if v, exists := metadata[key]; !exists || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// unionStrings returns the given elements with the given additions appended,
+// skipping the additions that are in there already.
+func unionStrings(elements, additions []string) []string {
+	union := append([]string{}, elements...)
+	for _, addition := range additions {
+		if !containsString(union, addition) {
+			union = append(union, addition)
+		}
+	}
+	return union
+}
+
+// containsString returns whether the given elements contain the given string.
+func containsString(elements []string, s string) bool {
+	for _, element := range elements {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAnyString returns whether the given elements contain any of the
+// given strings.
+func containsAnyString(elements, strs []string) bool {
+	for _, s := range strs {
+		if containsString(elements, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/build"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// migrationLockTTL is the amount of time the lock on a migration is held
+	// for, the instance running the migration renews it at a third of the
+	// TTL. A lock that isn't renewed, e.g. because the instance holding it
+	// crashed, expires and the migration is picked up by another instance.
+	migrationLockTTL = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Second,
+			Standard: 5 * time.Minute,
+		},
+	).(time.Duration)
+
+	// migrationPollInterval is the amount of time an instance waits before
+	// checking again whether a migration that's locked by another instance
+	// got applied.
+	migrationPollInterval = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  50 * time.Millisecond,
+			Standard: 5 * time.Second,
+		},
+	).(time.Duration)
+)
+
+const (
+	// MigrationTimeout is the amount of time the migrations that run on
+	// startup are expected to take at most, callers of New should leave
+	// room for it in the deadline of the context they pass.
+	MigrationTimeout = 30 * time.Minute
+)
+
+var (
+	// ErrMigrationFailed is returned when a migration that's not optional
+	// fails, it aborts the startup of the DB.
+	ErrMigrationFailed = errors.New("migration failed")
+)
+
+type (
+	// Migration is a one-off update of the documents in the database, e.g.
+	// backfilling a field of the documents that were inserted before it
+	// existed. Migrations run on startup, in the order they're registered,
+	// and every migration is applied once. It's recorded in the migrations
+	// collection once it's applied.
+	//
+	// A migration that got interrupted runs again from the start, so it has
+	// to be idempotent, and it should update the documents in batches.
+	Migration struct {
+		// ID identifies the migration, it must never change once the
+		// migration got released.
+		ID string
+
+		// Optional indicates a failure of the migration is logged rather
+		// than aborting startup, it's retried on the next startup.
+		Optional bool
+
+		// Run applies the migration and returns the number of updated
+		// documents.
+		Run func(ctx context.Context, db *DB) (int, error)
+	}
+
+	// migrationDoc is the document of a migration in the migrations
+	// collection. It doubles as the lock on the migration, the instance that
+	// runs the migration holds the lock until it's applied.
+	migrationDoc struct {
+		ID               string    `bson:"_id"`
+		Applied          bool      `bson:"applied"`
+		TimestampApplied time.Time `bson:"timestamp_applied,omitempty"`
+		Updated          int       `bson:"updated"`
+		LockedBy         string    `bson:"locked_by,omitempty"`
+		LockExpires      time.Time `bson:"lock_expires,omitempty"`
+	}
+)
+
+// migrations returns the registered migrations, in the order they run. New
+// migrations are appended, the IDs of existing ones must never change.
+//
+// NOTE: the namespace backfill is not a migration, the schema depends on it so
+// it runs before the schema is ensured, see backfillNamespace.
+func migrations() []Migration {
+	return []Migration{
+		{
+			ID:       "normalize-reporters",
+			Optional: true,
+			Run: func(ctx context.Context, db *DB) (int, error) {
+				return db.NormalizeReporters(ctx)
+			},
+		},
+		{
+			ID:       "normalize-tags",
+			Optional: true,
+			Run: func(ctx context.Context, db *DB) (int, error) {
+				return db.NormalizeTags(ctx)
+			},
+		},
+		{
+			// NOTE: documents that weren't migrated yet are resolved
+			// when they're read
+			ID:       "migrate-origins",
+			Optional: true,
+			Run: func(ctx context.Context, db *DB) (int, error) {
+				return db.MigrateOrigins(ctx)
+			},
+		},
+	}
+}
+
+// WithMigrations replaces the registered migrations that run on startup with
+// the given ones. It's meant for testing.
+func WithMigrations(migrations ...Migration) Option {
+	return func(db *DB) {
+		db.staticMigrationSet = migrations
+	}
+}
+
+// AppliedMigrations returns the IDs of the migrations that were applied, in
+// the order they were applied.
+func (db *DB) AppliedMigrations(ctx context.Context) ([]string, error) {
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "timestamp_applied", Value: 1}, {Key: "_id", Value: 1}})
+	defer db.trackQuery(collMigrations, "find", nil)()
+	c, err := db.staticMigrations.Find(ctx, bson.M{"applied": true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []migrationDoc
+	err = c.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids, nil
+}
+
+// managedRunMigrations applies the given migrations that weren't applied yet,
+// in order, on behalf of the given owner. A migration that's locked by another
+// instance is waited for, if that instance releases the lock without applying
+// it the migration is run by this instance. It returns an error wrapping
+// ErrMigrationFailed if a migration that's not optional fails, the migrations
+// after it don't run.
+func (db *DB) managedRunMigrations(ctx context.Context, owner string, migrations []Migration) error {
+	seen := make(map[string]struct{}, len(migrations))
+	for _, m := range migrations {
+		if _, exists := seen[m.ID]; exists || m.ID == "" {
+			return fmt.Errorf("migration ID '%v' is empty or not unique", m.ID)
+		}
+		seen[m.ID] = struct{}{}
+	}
+
+	for _, m := range migrations {
+		logger := db.staticLogger.WithField("migration", m.ID)
+		err := db.managedRunMigration(ctx, owner, m, logger)
+		if err != nil && m.Optional {
+			logger.WithError(err).Error("Optional migration failed, it's retried on the next start")
+			continue
+		}
+		if err != nil {
+			return errors.AddContext(errors.Compose(ErrMigrationFailed, err), fmt.Sprintf("migration '%v'", m.ID))
+		}
+	}
+	return nil
+}
+
+// managedRunMigration applies the given migration unless it was applied
+// already, see managedRunMigrations.
+func (db *DB) managedRunMigration(ctx context.Context, owner string, m Migration, logger *logrus.Entry) error {
+	// acquire the lock, waiting for the instance holding it to finish
+	for {
+		acquired, applied, err := db.managedLockMigration(ctx, owner, m.ID)
+		if err != nil {
+			return errors.AddContext(err, "failed to lock migration")
+		}
+		if applied {
+			return nil
+		}
+		if acquired {
+			break
+		}
+		logger.Debug("Migration is locked by another instance, waiting for it")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationPollInterval):
+		}
+	}
+
+	// renew the lock while the migration runs
+	renewCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		db.threadedRenewMigrationLock(renewCtx, owner, m.ID, logger)
+	}()
+
+	logger.Info("Running migration")
+	start := time.Now()
+	updated, err := m.Run(ctx, db)
+	cancel()
+	<-renewed
+
+	// release the lock, recording the migration as applied if it succeeded
+	filter := bson.M{"_id": m.ID, "locked_by": owner}
+	update := bson.M{"$unset": bson.M{"locked_by": "", "lock_expires": ""}}
+	if err == nil {
+		update["$set"] = bson.M{
+			"applied":           true,
+			"timestamp_applied": Now(),
+			"updated":           updated,
+		}
+	}
+	defer db.trackQuery(collMigrations, "updateOne", filter)()
+	_, releaseErr := db.staticMigrations.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Compose(err, releaseErr)
+	}
+	if releaseErr != nil {
+		return errors.AddContext(releaseErr, "failed to record migration as applied")
+	}
+	logger.WithFields(logrus.Fields{
+		"updated":  updated,
+		"duration": time.Since(start),
+	}).Info("Applied migration")
+	return nil
+}
+
+// managedLockMigration tries to acquire the lock on the migration with the
+// given ID for the given owner. The lock is acquired if the migration isn't
+// locked or if its lock expired. It returns whether the lock was acquired and
+// whether the migration was applied already.
+func (db *DB) managedLockMigration(ctx context.Context, owner, id string) (acquired, applied bool, err error) {
+	now := Now()
+	filter := bson.M{
+		"_id":     id,
+		"applied": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"locked_by": bson.M{"$exists": false}},
+			bson.M{"lock_expires": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"locked_by":    owner,
+			"lock_expires": now.Add(migrationLockTTL),
+		},
+		"$setOnInsert": bson.M{"applied": false, "updated": 0},
+	}
+
+	// NOTE: if the migration is applied or locked the filter doesn't match
+	// and the upsert fails on the duplicate id
+	done := db.trackQuery(collMigrations, "updateOne", filter)
+	_, err = db.staticMigrations.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	done()
+	if err == nil {
+		return true, false, nil
+	}
+	if !isDuplicateKey(err) {
+		return false, false, err
+	}
+
+	// check whether it was applied
+	var doc migrationDoc
+	defer db.trackQuery(collMigrations, "findOne", bson.M{"_id": id})()
+	err = db.staticMigrations.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if isDocumentNotFound(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return false, doc.Applied, nil
+}
+
+// threadedRenewMigrationLock extends the lock on the migration with the given
+// ID until the given context is done.
+func (db *DB) threadedRenewMigrationLock(ctx context.Context, owner, id string, logger *logrus.Entry) {
+	ticker := time.NewTicker(migrationLockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		filter := bson.M{"_id": id, "locked_by": owner}
+		update := bson.M{"$set": bson.M{"lock_expires": Now().Add(migrationLockTTL)}}
+		done := db.trackQuery(collMigrations, "updateOne", filter)
+		res, err := db.staticMigrations.UpdateOne(ctx, filter, update)
+		done()
+		if err != nil && ctx.Err() == nil {
+			logger.WithError(err).Warn("Failed to renew migration lock")
+		} else if err == nil && res.MatchedCount == 0 {
+			logger.Warn("Lost the migration lock, another instance might run the migration concurrently")
+		}
+	}
+}
+
+// newMigrationOwner returns a unique identifier for the instance running the
+// migrations, it's recorded on the locks it holds.
+func newMigrationOwner() string {
+	return primitive.NewObjectID().Hex()
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestMigrations runs the tests of the migration runner against the test DB.
+func TestMigrations(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{name: "Run", test: testMigrationsRun},
+		{name: "Failure", test: testMigrationsFailure},
+		{name: "Lock", test: testMigrationsLock},
+		{name: "Startup", test: testMigrationsStartup},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.test)
+	}
+}
+
+// testMigrationsRun verifies migrations run in order and only once.
+func testMigrationsRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// record is a helper that returns a migration that records it ran
+	var ran []string
+	record := func(id string) Migration {
+		return Migration{ID: id, Run: func(context.Context, *DB) (int, error) {
+			ran = append(ran, id)
+			return 1, nil
+		}}
+	}
+
+	// run the migrations twice, they only run the first time
+	migrations := []Migration{record("first"), record("second")}
+	for i := 0; i < 2; i++ {
+		err := db.managedRunMigrations(ctx, "owner", migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(ran, []string{"first", "second"}) {
+		t.Fatal("unexpected migrations ran", ran)
+	}
+
+	// register another migration, only that one runs
+	migrations = append(migrations, record("third"))
+	err := db.managedRunMigrations(ctx, "owner", migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []string{"first", "second", "third"}) {
+		t.Fatal("unexpected migrations ran", ran)
+	}
+	assertAppliedMigrations(t, db, "first", "second", "third")
+
+	// the number of updated documents is recorded
+	var doc migrationDoc
+	err = db.staticMigrations.FindOne(ctx, bson.M{"_id": "third"}).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.Applied || doc.Updated != 1 || doc.TimestampApplied.IsZero() || doc.LockedBy != "" {
+		t.Fatalf("unexpected migration %+v", doc)
+	}
+
+	// IDs have to be unique
+	err = db.managedRunMigrations(ctx, "owner", []Migration{record("fourth"), record("fourth")})
+	if err == nil || !strings.Contains(err.Error(), "not unique") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testMigrationsFailure verifies a failing migration aborts the run unless
+// it's optional, and that failed migrations are retried.
+func testMigrationsFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// migration is a helper that returns a migration that fails as long as
+	// the given flag is set
+	var ran []string
+	migration := func(id string, optional bool, fail *bool) Migration {
+		return Migration{ID: id, Optional: optional, Run: func(context.Context, *DB) (int, error) {
+			ran = append(ran, id)
+			if *fail {
+				return 0, errors.New("failure of " + id)
+			}
+			return 0, nil
+		}}
+	}
+	fail, pass := true, false
+	flakyFails, brokenFails := fail, fail
+	migrations := []Migration{
+		migration("flaky", true, &flakyFails),
+		migration("after-flaky", false, &pass),
+		migration("broken", false, &brokenFails),
+		migration("after-broken", false, &pass),
+	}
+
+	// the optional migration doesn't abort the run, the other one does
+	err := db.managedRunMigrations(ctx, "owner", migrations)
+	if !errors.Contains(err, ErrMigrationFailed) || !strings.Contains(err.Error(), "failure of broken") {
+		t.Fatal("unexpected error", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"flaky", "after-flaky", "broken"}) {
+		t.Fatal("unexpected migrations ran", ran)
+	}
+	assertAppliedMigrations(t, db, "after-flaky")
+
+	// the failed migrations released their lock and are retried
+	flakyFails, brokenFails = false, false
+	ran = nil
+	err = db.managedRunMigrations(ctx, "other", migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []string{"flaky", "broken", "after-broken"}) {
+		t.Fatal("unexpected migrations ran", ran)
+	}
+	assertAppliedMigrations(t, db, "after-broken", "after-flaky", "broken", "flaky")
+}
+
+// testMigrationsLock verifies concurrent instances don't run the same
+// migration twice, and that a migration locked by an instance that crashed is
+// picked up once its lock expired.
+func testMigrationsLock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// the slow migration outlives its lock, it only stays locked because the
+	// lock gets renewed
+	var slowRuns, fastRuns uint64
+	migrations := []Migration{
+		{ID: "slow", Run: func(context.Context, *DB) (int, error) {
+			atomic.AddUint64(&slowRuns, 1)
+			time.Sleep(2 * migrationLockTTL)
+			return 0, nil
+		}},
+		{ID: "fast", Run: func(context.Context, *DB) (int, error) {
+			atomic.AddUint64(&fastRuns, 1)
+			return 0, nil
+		}},
+	}
+
+	// run the migrations from three instances at once
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.managedRunMigrations(ctx, newMigrationOwner(), migrations)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slowRuns != 1 || fastRuns != 1 {
+		t.Fatal("unexpected number of runs", slowRuns, fastRuns)
+	}
+	assertAppliedMigrations(t, db, "fast", "slow")
+
+	// mimic an instance that crashed while running a migration
+	_, err := db.staticMigrations.InsertOne(ctx, migrationDoc{
+		ID:          "abandoned",
+		LockedBy:    "crashed",
+		LockExpires: Now().Add(migrationLockTTL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired, applied, err := db.managedLockMigration(ctx, "owner", "abandoned")
+	if err != nil || acquired || applied {
+		t.Fatal("unexpected lock", acquired, applied, err)
+	}
+
+	// the migration is run once the lock expired
+	var abandonedRuns int
+	start := time.Now()
+	err = db.managedRunMigrations(ctx, "owner", []Migration{{ID: "abandoned", Run: func(context.Context, *DB) (int, error) {
+		abandonedRuns++
+		return 0, nil
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abandonedRuns != 1 {
+		t.Fatal("unexpected number of runs", abandonedRuns)
+	}
+	if time.Since(start) < migrationLockTTL/2 {
+		t.Fatal("expected the migration to wait for the lock to expire")
+	}
+}
+
+// testMigrationsStartup verifies the migrations run when the DB is created and
+// that a failing migration aborts it.
+func testMigrationsStartup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	uri, creds := TestDBConnection()
+	dbName := strings.Replace(t.Name(), "/", "_", -1)
+
+	// a failing migration aborts the creation of the DB
+	failing := Migration{ID: "failing", Run: func(context.Context, *DB) (int, error) {
+		return 0, errors.New("failure")
+	}}
+	_, err := NewCustomDB(ctx, uri, dbName, creds, db.staticLogger, WithMigrations(failing))
+	if !errors.Contains(err, ErrMigrationFailed) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// an optional one doesn't
+	failing.Optional = true
+	passing := Migration{ID: "passing", Run: func(context.Context, *DB) (int, error) {
+		return 0, nil
+	}}
+	other, err := NewCustomDB(ctx, uri, dbName, creds, db.staticLogger, WithMigrations(failing, passing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := other.Close(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	assertAppliedMigrations(t, other, "passing")
+}
+
+// assertAppliedMigrations fails the test if the applied migrations aren't the
+// expected ones, which have to be sorted.
+func assertAppliedMigrations(t *testing.T, db *DB, expected ...string) {
+	t.Helper()
+	applied, err := db.AppliedMigrations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(applied)
+	if !reflect.DeepEqual(applied, expected) {
+		t.Fatalf("unexpected applied migrations %v, expected %v", applied, expected)
+	}
+}
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"context"
+
+	"github.com/SkynetLabs/blocker/modules"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// RepairResult holds the outcome of a repair of the skylinks collection.
+	RepairResult struct {
+		// Backfilled is the number of documents that got their hash
+		// backfilled from their legacy skylink.
+		Backfilled int `json:"backfilled"`
+
+		// Unresolved is the number of documents without hash of which the
+		// legacy skylink could not be parsed, these are left untouched and
+		// have to be looked into manually.
+		Unresolved int `json:"unresolved"`
+
+		// Merged is the number of hashes that had duplicate documents, which
+		// were merged into the oldest document.
+		Merged int `json:"merged"`
+
+		// Deleted is the number of duplicate documents that were deleted
+		// after being merged.
+		Deleted int `json:"deleted"`
+
+		// MissingIndexes are the indexes that are still missing after the
+		// index creation was retried.
+		MissingIndexes []string `json:"missing_indexes"`
+	}
+
+	// legacySkylink is a document that was inserted before we stored hashes
+	// instead of skylinks.
+	legacySkylink struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Skylink string             `bson:"skylink"`
+	}
+
+	// duplicateHash is a hash that is shared by multiple documents.
+	duplicateHash struct {
+		Hash string               `bson:"_id"`
+		IDs  []primitive.ObjectID `bson:"ids"`
+	}
+)
+
+// Repair repairs the skylinks collection of databases that accumulated
+// documents which prevent the unique index on the hash from being created.
+// It backfills the hash of documents that only have a legacy skylink, merges
+// the tags and reporters of documents that share a hash into the oldest one
+// and deletes the others, after which it retries creating the missing
+// indexes. Only the documents of the DB's namespace are repaired.
+//
+// The documents are repaired in batches, every step is idempotent so the
+// repair is safe to interrupt and run again.
+func (db *DB) Repair(ctx context.Context) (RepairResult, error) {
+	var res RepairResult
+
+	// backfill the hashes first, this might result in more duplicates
+	err := db.backfillHashes(ctx, &res)
+	if err != nil {
+		return res, errors.AddContext(err, "failed to backfill hashes")
+	}
+	db.staticLogger.WithFields(logrus.Fields{
+		"backfilled": res.Backfilled,
+		"unresolved": res.Unresolved,
+	}).Info("Repair: backfilled hashes")
+
+	err = db.mergeDuplicates(ctx, &res)
+	if err != nil {
+		return res, errors.AddContext(err, "failed to merge duplicates")
+	}
+	db.staticLogger.WithFields(logrus.Fields{
+		"merged":  res.Merged,
+		"deleted": res.Deleted,
+	}).Info("Repair: merged duplicates")
+
+	// retry creating the missing indexes
+	res.MissingIndexes, err = db.CheckSchema(ctx)
+	if err != nil {
+		return res, errors.AddContext(err, "failed to create missing indexes")
+	}
+	if len(res.MissingIndexes) > 0 {
+		db.staticLogger.WithField("missing", res.MissingIndexes).Warn("Repair: database schema is still degraded")
+	} else {
+		db.staticLogger.Info("Repair: database schema is healthy")
+	}
+	return res, nil
+}
+
+// backfillHashes sets the hash of all documents that don't have one from the
+// legacy skylink they were inserted with. The documents are paged by their
+// id, this ensures documents of which the skylink can't be parsed are only
+// visited once.
+func (db *DB) backfillHashes(ctx context.Context, res *RepairResult) error {
+	filter := db.namespaced(bson.M{
+		"hash":    nil,
+		"skylink": bson.M{"$type": "string"},
+	})
+
+	var lastID primitive.ObjectID
+	for {
+		// fetch the next batch
+		opts := options.Find()
+		opts.SetProjection(bson.M{"_id": 1, "skylink": 1})
+		opts.SetSort(bson.M{"_id": 1})
+		opts.SetLimit(migrationBatchSize)
+		batchFilter := bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": lastID}}}}
+		c, err := db.staticSkylinks.Find(ctx, batchFilter, opts)
+		if err != nil {
+			return errors.AddContext(err, "failed to find documents without hash")
+		}
+		var docs []legacySkylink
+		err = c.All(ctx, &docs)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode documents without hash")
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		lastID = docs[len(docs)-1].ID
+
+		// backfill the batch, documents that end up sharing a hash with an
+		// existing document fail to update if the unique index exists, in
+		// which case we merge them right away
+		for _, doc := range docs {
+			hash, err := legacyHash(doc.Skylink)
+			if err != nil {
+				db.staticLogger.WithError(err).WithField("id", doc.ID.Hex()).Warn("Repair: failed to resolve hash of legacy skylink")
+				res.Unresolved++
+				continue
+			}
+			_, err = db.staticSkylinks.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"hash": hash}})
+			if isDuplicateKey(err) {
+				err = db.mergeInto(ctx, hash, doc.ID, res)
+			}
+			if err != nil {
+				return errors.AddContext(err, "failed to backfill hash")
+			}
+			res.Backfilled++
+		}
+		db.staticLogger.WithField("backfilled", res.Backfilled).Debug("Repair: backfilled batch of hashes")
+	}
+}
+
+// mergeDuplicates merges all documents that share a hash into the oldest
+// document of that hash and deletes the others.
+func (db *DB) mergeDuplicates(ctx context.Context, res *RepairResult) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.namespaced(bson.M{"hash": bson.M{"$type": "string"}})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$hash",
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: migrationBatchSize}},
+	}
+	opts := options.Aggregate().SetAllowDiskUse(true)
+
+	for {
+		// fetch the next batch, merged hashes no longer show up
+		c, err := db.staticSkylinks.Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return errors.AddContext(err, "failed to find duplicate hashes")
+		}
+		var dupes []duplicateHash
+		err = c.All(ctx, &dupes)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode duplicate hashes")
+		}
+		if len(dupes) == 0 {
+			return nil
+		}
+
+		for _, dupe := range dupes {
+			hash, err := HashFromString(dupe.Hash)
+			if err != nil {
+				return errors.AddContext(err, "failed to parse duplicate hash")
+			}
+			err = db.mergeDocuments(ctx, hash, dupe.IDs, res)
+			if err != nil {
+				return errors.AddContext(err, "failed to merge documents of hash "+dupe.Hash)
+			}
+		}
+		db.staticLogger.WithFields(logrus.Fields{
+			"merged":  res.Merged,
+			"deleted": res.Deleted,
+		}).Debug("Repair: merged batch of duplicate hashes")
+	}
+}
+
+// mergeInto merges the document with the given id into the existing document
+// with the given hash.
+func (db *DB) mergeInto(ctx context.Context, hash Hash, id primitive.ObjectID, res *RepairResult) error {
+	existing, err := db.findOne(ctx, db.namespaced(bson.M{"hash": hash}))
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return errors.New("no document found for hash " + hash.String())
+	}
+	return db.mergeDocuments(ctx, hash, []primitive.ObjectID{existing.ID, id}, res)
+}
+
+// mergeDocuments merges the tags and reporters of the documents with the given
+// ids, which share the given hash, into the oldest one and deletes the others.
+// The oldest document is updated before the others get deleted, so no
+// information is lost if the merge gets interrupted.
+func (db *DB) mergeDocuments(ctx context.Context, hash Hash, ids []primitive.ObjectID, res *RepairResult) error {
+	// fetch the documents, oldest first, we don't decode the hash because
+	// documents merged during the backfill might not have one yet
+	opts := options.Find()
+	opts.SetProjection(bson.M{"hash": 0})
+	opts.SetSort(bson.D{{Key: "timestamp_added", Value: 1}, {Key: "_id", Value: 1}})
+	docs, err := db.find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return err
+	}
+	if len(docs) < 2 {
+		return nil
+	}
+	oldest, others := docs[0], docs[1:]
+
+	// collect the tags and reporters of all documents, we set them rather
+	// than adding them to the set because legacy documents might have null
+	// tags
+	tags := oldest.Tags
+	reporters := oldest.MergedReporters
+	otherIDs := make(bson.A, 0, len(others))
+	for _, doc := range others {
+		tags = append(tags, doc.Tags...)
+		if doc.Reporter != (Reporter{}) && doc.Reporter != oldest.Reporter {
+			reporters = append(reporters, doc.Reporter)
+		}
+		reporters = append(reporters, doc.MergedReporters...)
+		otherIDs = append(otherIDs, doc.ID)
+	}
+
+	// merge them into the oldest document
+	set := bson.M{"tags": uniqueTags(tags)}
+	if len(reporters) > 0 {
+		set["merged_reporters"] = uniqueReporters(reporters)
+	}
+	_, err = db.staticSkylinks.UpdateOne(ctx, bson.M{"_id": oldest.ID}, bson.M{"$set": set})
+	if err != nil {
+		return errors.AddContext(err, "failed to update oldest document")
+	}
+
+	// delete the others
+	deleted, err := db.staticSkylinks.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": otherIDs}})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete duplicate documents")
+	}
+	res.Merged++
+	res.Deleted += int(deleted.DeletedCount)
+
+	// the oldest document might be a legacy one, we can only set its hash
+	// once the others are deleted because of the unique index, if this gets
+	// interrupted the hash gets backfilled on the next run
+	_, err = db.staticSkylinks.UpdateOne(ctx, bson.M{"_id": oldest.ID, "hash": nil}, bson.M{"$set": bson.M{"hash": hash}})
+	if err != nil {
+		return errors.AddContext(err, "failed to set hash of oldest document")
+	}
+	return nil
+}
+
+// legacyHash returns the hash of the given legacy skylink.
+func legacyHash(skylink string) (Hash, error) {
+	str, err := modules.ExtractSkylink(skylink)
+	if err != nil {
+		return Hash{}, err
+	}
+	var sl skymodules.Skylink
+	err = sl.LoadString(str)
+	if err != nil {
+		return Hash{}, errors.AddContext(err, "invalid skylink")
+	}
+	return NewHash(sl), nil
+}
+
+// uniqueTags returns the given tags without duplicates, preserving their
+// order. It never returns nil.
+func uniqueTags(tags []string) []string {
+	seen := make(map[string]struct{}, len(tags))
+	unique := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		unique = append(unique, tag)
+	}
+	return unique
+}
+
+// uniqueReporters returns the given reporters without duplicates, preserving
+// their order.
+func uniqueReporters(reporters []Reporter) []Reporter {
+	seen := make(map[Reporter]struct{}, len(reporters))
+	var unique []Reporter
+	for _, reporter := range reporters {
+		if _, exists := seen[reporter]; exists {
+			continue
+		}
+		seen[reporter] = struct{}{}
+		unique = append(unique, reporter)
+	}
+	return unique
+}
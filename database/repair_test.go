@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestRepair verifies a collection with duplicate hashes and legacy documents
+// without hash gets repaired, after which the unique index on the hash can be
+// created, and that running the repair again is a no-op.
+func TestRepair(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database and drop the unique index, mimicking a database
+	// that was used before the index existed
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+	dropped, err := dropIndex(ctx, db.staticSkylinks, "hash")
+	if err != nil || !dropped {
+		t.Fatal("failed to drop index", err)
+	}
+
+	// resolve the hash of a legacy skylink
+	legacy := "BAAWi3ou51qCH24Im0ESS-5_gKg60qGIYtta-ryrl1kBnQ"
+	var sl skymodules.Skylink
+	err = sl.LoadString(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyHash := NewHash(sl)
+
+	// seed the collection with three documents of the same hash, a legacy
+	// document that shares its hash with a newer document and a legacy
+	// document of which the skylink is invalid, their namespace was
+	// backfilled when the database was connected to
+	added := Now().Add(-time.Hour)
+	hash := HashBytes([]byte("skylink"))
+	r1 := Reporter{Name: "r1", Email: "r1@example.com"}
+	r2 := Reporter{Name: "r2", Email: "r2@example.com"}
+	r3 := Reporter{Name: "r3", Email: "r3@example.com"}
+	docs := []bson.M{
+		{"hash": hash, "reporter": r2, "tags": bson.A{"tag_1", "tag_2"}, "timestamp_added": added.Add(time.Second)},
+		{"hash": hash, "reporter": r1, "tags": bson.A{"tag_1"}, "timestamp_added": added},
+		{"hash": hash, "reporter": r3, "tags": nil, "timestamp_added": added.Add(2 * time.Second)},
+		{"skylink": legacy, "reporter": r1, "tags": nil, "timestamp_added": added},
+		{"hash": legacyHash, "reporter": r2, "tags": bson.A{"tag_3"}, "timestamp_added": added.Add(time.Second)},
+		{"skylink": "not a skylink", "timestamp_added": added},
+	}
+	for _, doc := range docs {
+		doc["namespace"] = DefaultNamespace
+		_, err = db.staticSkylinks.InsertOne(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the unique index can't be created
+	missing, err := db.CheckSchema(ctx)
+	if err == nil || len(missing) != 1 {
+		t.Fatal("expected the index creation to fail", missing, err)
+	}
+
+	// repair the collection
+	res, err := db.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RepairResult{Backfilled: 1, Unresolved: 1, Merged: 2, Deleted: 3}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected result, %+v != %+v", res, expected)
+	}
+	if !db.SchemaHealthy() {
+		t.Fatal("expected the schema to be healthy", db.MissingIndexes())
+	}
+
+	// assert the duplicates were merged into the oldest document
+	doc, err := db.findOne(ctx, bson.M{"hash": hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Reporter != r1 {
+		t.Fatal("expected the oldest document to be kept", doc.Reporter)
+	}
+	if !reflect.DeepEqual(doc.Tags, []string{"tag_1", "tag_2"}) {
+		t.Fatal("unexpected tags", doc.Tags)
+	}
+	if !reflect.DeepEqual(doc.MergedReporters, []Reporter{r2, r3}) {
+		t.Fatal("unexpected merged reporters", doc.MergedReporters)
+	}
+
+	// assert the legacy document got its hash and was kept, it's the oldest
+	doc, err = db.findOne(ctx, bson.M{"hash": legacyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Reporter != r1 {
+		t.Fatal("expected the legacy document to be kept", doc.Reporter)
+	}
+	if !reflect.DeepEqual(doc.Tags, []string{"tag_3"}) {
+		t.Fatal("unexpected tags", doc.Tags)
+	}
+	if !reflect.DeepEqual(doc.MergedReporters, []Reporter{r2}) {
+		t.Fatal("unexpected merged reporters", doc.MergedReporters)
+	}
+
+	// assert the invalid legacy document was left untouched
+	count, err := db.staticSkylinks.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatal("unexpected number of documents", count)
+	}
+
+	// assert running the repair again is a no-op
+	res, err = db.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = RepairResult{Unresolved: 1}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected result, %+v != %+v", res, expected)
+	}
+}
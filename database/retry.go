@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	stderrors "errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	// DefaultRetryWindow is the default amount of time operations passed to
+	// Retry are retried for when they fail with a retryable error. Replica
+	// set elections typically complete within 12 seconds.
+	DefaultRetryWindow = 30 * time.Second
+
+	// retryBackoff is the amount of time Retry waits before retrying an
+	// operation for the first time, it doubles after every attempt.
+	retryBackoff = 100 * time.Millisecond
+
+	// maxRetryBackoff is the maximum amount of time Retry waits in between
+	// two attempts.
+	maxRetryBackoff = 5 * time.Second
+)
+
+var (
+	// retryableCodes are the codes of the server errors that are returned
+	// while the replica set elects a new primary or while a member is
+	// shutting down.
+	retryableCodes = []int{
+		91,    // ShutdownInProgress
+		189,   // PrimarySteppedDown
+		10107, // NotWritablePrimary
+		11600, // InterruptedAtShutdown
+		11602, // InterruptedDueToReplStateChange
+		13435, // NotPrimaryNoSecondaryOk
+		13436, // NotPrimaryOrSecondary
+	}
+)
+
+// IsRetryable returns true if the given error, or any of the errors it is
+// composed of, is a driver error that is expected to go away once the replica
+// set has elected a new primary, e.g. a network error or a not primary error.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case errors.Error:
+		for _, err := range e.ErrSet {
+			if IsRetryable(err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var sse topology.ServerSelectionError
+	if stderrors.As(err, &sse) {
+		return true
+	}
+	var se mongo.ServerError
+	if stderrors.As(err, &se) {
+		if se.HasErrorLabel("RetryableWriteError") {
+			return true
+		}
+		for _, code := range retryableCodes {
+			if se.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Retry calls the given operation and retries it with an exponential backoff
+// for as long as it fails with a retryable error, until the retry window
+// expires or the given context is done. It is meant for the operations of
+// long running loops, which shouldn't abort during a primary failover. The
+// operation should be a single, idempotent, database operation.
+func (db *DB) Retry(ctx context.Context, fn func() error) error {
+	db.staticMu.Lock()
+	window := db.retryWindow
+	db.staticMu.Unlock()
+
+	deadline := time.Now().Add(window)
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return errors.AddContext(err, "retry window expired")
+		}
+		db.staticLogger.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Warn("Database operation failed with a retryable error, retrying")
+
+		// wait before retrying
+		select {
+		case <-ctx.Done():
+			return errors.Compose(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// SetRetryWindow sets the amount of time operations passed to Retry are
+// retried for, a window of zero disables retrying.
+func (db *DB) SetRetryWindow(window time.Duration) {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	db.retryWindow = window
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// TestIsRetryable is a unit test for IsRetryable.
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	notPrimary := mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"Nil", nil, false},
+		{"Plain", errors.New("some error"), false},
+		{"DuplicateKey", mongo.CommandError{Code: 11000}, false},
+		{"Timeout", context.DeadlineExceeded, false},
+		{"NotPrimary", notPrimary, true},
+		{"SteppedDown", mongo.CommandError{Code: 189}, true},
+		{"ReplStateChange", mongo.CommandError{Code: 11602}, true},
+		{"NetworkError", mongo.CommandError{Labels: []string{"NetworkError"}}, true},
+		{"RetryableWriteError", mongo.WriteException{Labels: []string{"RetryableWriteError"}}, true},
+		{"ServerSelection", topology.ServerSelectionError{Wrapped: errors.New("no primary")}, true},
+		{"WithContext", errors.AddContext(notPrimary, "failed to find hashes"), true},
+		{"Composed", errors.Compose(errors.New("some error"), notPrimary), true},
+	}
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Fatalf("%v: unexpected outcome", test.name)
+		}
+	}
+}
+
+// TestRetry verifies operations that fail with a retryable error get retried
+// until they succeed or until the retry window expires.
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	// create a bare database, Retry doesn't need a connection
+	logger, hook := logtest.NewNullLogger()
+	db := &DB{staticLogger: logger.WithField("module", "db")}
+	db.SetRetryWindow(time.Second)
+	ctx := context.Background()
+
+	// errFn returns an operation that fails with the given error the given
+	// number of times before it succeeds
+	var attempts int
+	errFn := func(err error, failures int) func() error {
+		attempts = 0
+		return func() error {
+			attempts++
+			if attempts <= failures {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// assert an operation that fails during a failover gets retried
+	notPrimary := mongo.CommandError{Code: 10107}
+	err := db.Retry(ctx, errFn(notPrimary, 2))
+	if err != nil || attempts != 3 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+	if len(hook.AllEntries()) != 2 {
+		t.Fatal("expected every retry to be logged", len(hook.AllEntries()))
+	}
+
+	// assert an operation that fails with any other error is not retried
+	someErr := errors.New("some error")
+	err = db.Retry(ctx, errFn(someErr, 2))
+	if err != someErr || attempts != 1 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+
+	// assert the error surfaces after the retry window expires
+	err = db.Retry(ctx, errFn(notPrimary, 100))
+	if err == nil || !strings.Contains(err.Error(), "retry window expired") {
+		t.Fatal("unexpected error", err)
+	}
+	if attempts < 2 || attempts > 5 {
+		t.Fatal("unexpected number of attempts", attempts)
+	}
+
+	// assert retrying stops when the context is done
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = db.Retry(ctx, errFn(notPrimary, 100))
+	if !errors.Contains(err, context.Canceled) || attempts != 1 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+
+	// assert a window of zero disables retrying
+	db.SetRetryWindow(0)
+	err = db.Retry(context.Background(), errFn(notPrimary, 1))
+	if err == nil || attempts != 1 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+}
@@ -0,0 +1,646 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/build"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// schemaCheckInterval defines the amount of time between checks of the
+	// database schema, missing indexes are re-created on every check.
+	schemaCheckInterval = build.Select(
+		build.Var{
+			Dev:      10 * time.Minute,
+			Testing:  time.Second,
+			Standard: time.Hour,
+		},
+	).(time.Duration)
+
+	// indexProgressInterval defines the amount of time between log entries
+	// reporting the progress of an index build.
+	indexProgressInterval = build.Select(
+		build.Var{
+			Dev:      10 * time.Second,
+			Testing:  100 * time.Millisecond,
+			Standard: 30 * time.Second,
+		},
+	).(time.Duration)
+)
+
+const (
+	// codeMaxTimeMSExpired is the code of the error the database returns when
+	// an operation exceeds its max time.
+	codeMaxTimeMSExpired = 50
+
+	// indexProgressTimeout is the timeout of looking up the progress of an
+	// index build.
+	indexProgressTimeout = 5 * time.Second
+)
+
+// index results, they describe what happened to an index when it got ensured
+const (
+	indexKept = iota
+	indexCreated
+	indexRecreated
+)
+
+type (
+	// IndexBuildOptions configure how the indexes of the database schema are
+	// built.
+	IndexBuildOptions struct {
+		// Hidden indicates indexes are built hidden and only get unhidden
+		// once they're built, so the query planner doesn't consider an index
+		// before it's complete.
+		Hidden bool
+
+		// Timeout is the maximum amount of time a single attempt at building
+		// an index may take, it defaults to DefaultIndexBuildTimeout.
+		Timeout time.Duration
+
+		// Resumes is the number of times a build that exceeds the timeout is
+		// resumed before we give up on it.
+		Resumes int
+	}
+
+	// indexProgress is the progress of an index build, as reported by the
+	// database.
+	indexProgress struct {
+		Done  int64 `bson:"done"`
+		Total int64 `bson:"total"`
+	}
+
+	// schemaSummary summarizes what happened to the indexes of the database
+	// schema when it was ensured, indexes are in the form
+	// "collection.index".
+	schemaSummary struct {
+		Created   []string
+		Kept      []string
+		Recreated []string
+		Failed    []string
+	}
+
+	// indexSpec is the specification of an existing index, as listed by the
+	// database.
+	indexSpec struct {
+		Name                    string `bson:"name"`
+		Key                     bson.D `bson:"key"`
+		Unique                  bool   `bson:"unique"`
+		Sparse                  bool   `bson:"sparse"`
+		ExpireAfterSeconds      *int64 `bson:"expireAfterSeconds"`
+		PartialFilterExpression bson.M `bson:"partialFilterExpression"`
+		Collation               bson.M `bson:"collation"`
+		Hidden                  bool   `bson:"hidden"`
+	}
+)
+
+var (
+	// errIndexHasDuplicates is returned when a unique index differs from the
+	// schema but can't be re-created because the collection holds duplicates
+	// of its keys, dropping it would leave us without the index.
+	errIndexHasDuplicates = errors.New("unique index can't be re-created while the collection holds duplicates, run 'blocker repair'")
+)
+
+// Budget returns the maximum amount of time building a single index may take,
+// including the resumes of the build.
+func (opts IndexBuildOptions) Budget() time.Duration {
+	return opts.timeout() * time.Duration(opts.Resumes+1)
+}
+
+// timeout returns the maximum amount of time a single attempt at building an
+// index may take.
+func (opts IndexBuildOptions) timeout() time.Duration {
+	if opts.Timeout <= 0 {
+		return DefaultIndexBuildTimeout
+	}
+	return opts.Timeout
+}
+
+// MissingIndexes returns the indexes, in the form "collection.index", that were
+// missing from the database schema the last time it was checked.
+func (db *DB) MissingIndexes() []string {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	return append([]string(nil), db.missingIndexes...)
+}
+
+// SchemaHealthy returns true if all indexes of the database schema existed the
+// last time it was checked. If it returns false, the database is degraded and
+// queries might be slow.
+func (db *DB) SchemaHealthy() bool {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	return len(db.missingIndexes) == 0
+}
+
+// CheckSchema verifies all indexes of the database schema exist and attempts
+// to re-create the ones that are missing. It updates the schema health and
+// returns the indexes that are still missing.
+func (db *DB) CheckSchema(ctx context.Context) ([]string, error) {
+	missing, err := db.managedRefreshSchemaHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	// try and re-create the missing indexes, one at a time so a failing
+	// build doesn't prevent the others from being re-created
+	var createErr error
+	for collName, models := range missing {
+		coll, err := ensureCollection(ctx, db.staticDB, collName)
+		if err != nil {
+			createErr = errors.Compose(createErr, err)
+			continue
+		}
+		for _, model := range models {
+			name := *model.Options.Name
+			err = buildIndex(ctx, coll, model, db.staticIndexBuild, db.staticLogger)
+			if err != nil {
+				createErr = errors.Compose(createErr, errors.AddContext(err, fmt.Sprintf("index '%v' on collection '%v'", name, collName)))
+				continue
+			}
+			db.staticLogger.WithFields(logrus.Fields{
+				"collection": collName,
+				"index":      name,
+			}).Info("Re-created missing index")
+		}
+	}
+	if createErr != nil {
+		createErr = errors.Compose(createErr, ErrIndexCreateFailed)
+	}
+
+	// refresh the schema health
+	_, err = db.managedRefreshSchemaHealth(ctx)
+	if err != nil {
+		return nil, errors.Compose(createErr, err)
+	}
+	return db.MissingIndexes(), createErr
+}
+
+// StartSchemaCheck launches a background task that periodically checks the
+// database schema, re-creating missing indexes, until the given context gets
+// cancelled.
+func (db *DB) StartSchemaCheck(ctx context.Context) {
+	go db.threadedSchemaCheckLoop(ctx)
+}
+
+// managedRefreshSchemaHealth checks what indexes are missing from the
+// database schema and updates the schema health accordingly. It returns the
+// missing indexes, grouped by collection.
+func (db *DB) managedRefreshSchemaHealth(ctx context.Context) (map[string][]mongo.IndexModel, error) {
+	missing := make(map[string][]mongo.IndexModel)
+	var names []string
+	for collName, models := range dbSchema() {
+		coll := db.staticDB.Collection(collName)
+		for _, model := range models {
+			name := *model.Options.Name
+			exists, err := hasIndex(ctx, coll, name)
+			if err != nil {
+				return nil, errors.AddContext(err, fmt.Sprintf("failed to check index '%v' on collection '%v'", name, collName))
+			}
+			if !exists {
+				missing[collName] = append(missing[collName], model)
+				names = append(names, fmt.Sprintf("%v.%v", collName, name))
+			}
+		}
+	}
+	sort.Strings(names)
+
+	db.staticMu.Lock()
+	db.missingIndexes = names
+	db.staticMu.Unlock()
+	return missing, nil
+}
+
+// threadedSchemaCheckLoop periodically checks the database schema until the
+// given context gets cancelled.
+func (db *DB) threadedSchemaCheckLoop(ctx context.Context) {
+	ticker := time.NewTicker(schemaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		wasHealthy := db.SchemaHealthy()
+		checkCtx, cancel := context.WithTimeout(ctx, db.staticIndexBuild.Budget())
+		missing, err := db.CheckSchema(checkCtx)
+		cancel()
+		if err != nil {
+			db.staticLogger.Errorf(`[CRITICAL] failed to check DB schema, err: %v`, err)
+		}
+		if len(missing) > 0 {
+			db.staticLogger.WithField("missing", missing).Warn("Database schema is degraded")
+		} else if !wasHealthy && err == nil {
+			db.staticLogger.Info("Database schema is healthy again")
+		}
+	}
+}
+
+// sort sorts the indexes of every field of the summary.
+func (s *schemaSummary) sort() {
+	sort.Strings(s.Created)
+	sort.Strings(s.Kept)
+	sort.Strings(s.Recreated)
+	sort.Strings(s.Failed)
+}
+
+// ensureIndexes ensures the given indexes exist on the given collection. Every
+// index is ensured separately, an index that fails to be ensured is added to
+// the failed indexes of the summary and doesn't prevent the others from being
+// ensured.
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, models []mongo.IndexModel, buildOpts IndexBuildOptions, log *logrus.Entry, summary *schemaSummary) error {
+	existing, err := listIndexes(ctx, coll)
+	if err != nil {
+		return errors.AddContext(err, "failed to list indexes")
+	}
+
+	var ensureErr error
+	for _, model := range models {
+		name := *model.Options.Name
+		id := fmt.Sprintf("%v.%v", coll.Name(), name)
+		result, err := ensureIndex(ctx, coll, model, existing, buildOpts, log)
+		if err != nil {
+			summary.Failed = append(summary.Failed, id)
+			ensureErr = errors.Compose(ensureErr, errors.AddContext(err, fmt.Sprintf("index '%v'", name)))
+			continue
+		}
+		switch result {
+		case indexKept:
+			summary.Kept = append(summary.Kept, id)
+		case indexCreated:
+			summary.Created = append(summary.Created, id)
+		case indexRecreated:
+			summary.Recreated = append(summary.Recreated, id)
+		}
+	}
+	return ensureErr
+}
+
+// ensureIndex ensures the given index exists on the given collection, it
+// returns what happened to the index. It compares the existing indexes against
+// the given model, an index that is missing gets created, an index that
+// differs gets dropped and re-created. Unique indexes are not dropped while
+// the collection holds duplicates of their keys. An index that matches the
+// model but is hidden, e.g. because a previous build got interrupted before it
+// was unhidden, gets unhidden.
+func ensureIndex(ctx context.Context, coll *mongo.Collection, model mongo.IndexModel, existing map[string]indexSpec, buildOpts IndexBuildOptions, log *logrus.Entry) (int, error) {
+	name := *model.Options.Name
+	keys, err := indexKeys(model)
+	if err != nil {
+		return 0, err
+	}
+
+	// keep the index if it matches the model
+	spec, exists := existing[name]
+	if exists && spec.matches(keys, model.Options) {
+		if spec.Hidden {
+			err = unhideIndex(ctx, coll, name)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return indexKept, nil
+	}
+
+	// figure out what index has to be dropped, an index with the same keys
+	// but a different name conflicts with the model as well
+	var drop string
+	if exists {
+		drop = name
+	}
+	for _, other := range existing {
+		if drop == "" && keysEqual(other.Key, keys) {
+			drop = other.Name
+		}
+	}
+
+	// drop the conflicting index, guarding against dropping a unique index we
+	// won't be able to re-create
+	if drop != "" && model.Options.Unique != nil && *model.Options.Unique {
+		dupes, err := hasDuplicates(ctx, coll, keys)
+		if err == nil && dupes {
+			err = errIndexHasDuplicates
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if drop != "" {
+		_, err = coll.Indexes().DropOne(ctx, drop)
+		if err != nil {
+			return 0, errors.AddContext(err, fmt.Sprintf("failed to drop index '%v'", drop))
+		}
+	}
+
+	// build the index
+	err = buildIndex(ctx, coll, model, buildOpts, log)
+	if err != nil {
+		return 0, err
+	}
+	if drop != "" {
+		return indexRecreated, nil
+	}
+	return indexCreated, nil
+}
+
+// buildIndex builds the given index on the given collection, its progress is
+// logged while it's being built. A build that exceeds the timeout is resumed
+// up to the given number of times, re-issuing the build joins the build if the
+// database is still running it. If the index is built hidden, it gets unhidden
+// once it's built.
+func buildIndex(ctx context.Context, coll *mongo.Collection, model mongo.IndexModel, buildOpts IndexBuildOptions, log *logrus.Entry) error {
+	name := *model.Options.Name
+	logger := log.WithFields(logrus.Fields{
+		"collection": coll.Name(),
+		"index":      name,
+	})
+	if buildOpts.Hidden {
+		opts := *model.Options
+		model.Options = opts.SetHidden(true)
+	}
+
+	// log the progress of the build until it's done
+	start := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	go threadedLogIndexProgress(ctx, coll, name, start, logger, done)
+
+	for attempt := 0; ; attempt++ {
+		_, err := coll.Indexes().CreateOne(ctx, model, indexCreateOptions(buildOpts.timeout()))
+		if err == nil {
+			break
+		}
+		if !isIndexBuildTimeout(err) || attempt >= buildOpts.Resumes || ctx.Err() != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"elapsed": time.Since(start).Round(time.Second),
+		}).Warn("Index build timed out, resuming")
+	}
+	logger.WithField("elapsed", time.Since(start).Round(time.Second)).Info("Built index")
+
+	if buildOpts.Hidden {
+		return unhideIndex(ctx, coll, name)
+	}
+	return nil
+}
+
+// unhideIndex unhides the index with the given name on the given collection,
+// making it available to the query planner.
+func unhideIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	cmd := bson.D{
+		{Key: "collMod", Value: coll.Name()},
+		{Key: "index", Value: bson.M{"name": name, "hidden": false}},
+	}
+	err := coll.Database().RunCommand(ctx, cmd).Err()
+	if err != nil {
+		return errors.AddContext(err, fmt.Sprintf("failed to unhide index '%v'", name))
+	}
+	return nil
+}
+
+// threadedLogIndexProgress periodically logs the progress of the build of the
+// given index until the given channel gets closed. The number of documents
+// that are processed is only logged if the database reports it, which
+// requires the privilege to list the operations in progress.
+func threadedLogIndexProgress(ctx context.Context, coll *mongo.Collection, name string, start time.Time, logger *logrus.Entry, done <-chan struct{}) {
+	ticker := time.NewTicker(indexProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		entry := logger.WithField("elapsed", time.Since(start).Round(time.Second))
+		progressCtx, cancel := context.WithTimeout(ctx, indexProgressTimeout)
+		progress, found, err := indexBuildProgress(progressCtx, coll, name)
+		cancel()
+		if err == nil && found && progress.Total > 0 {
+			entry = entry.WithFields(logrus.Fields{
+				"done":  progress.Done,
+				"total": progress.Total,
+			})
+		}
+		entry.Info("Building index")
+	}
+}
+
+// indexBuildProgress returns the progress of the build of the given index, as
+// reported by the operations in progress on the database. The boolean
+// indicates whether the database reported any progress.
+func indexBuildProgress(ctx context.Context, coll *mongo.Collection, name string) (indexProgress, bool, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$currentOp", Value: bson.M{}}},
+		{{Key: "$match", Value: bson.M{
+			"command.createIndexes": coll.Name(),
+			"command.indexes.name":  name,
+			"progress":              bson.M{"$exists": true},
+		}}},
+		{{Key: "$limit", Value: 1}},
+	}
+	c, err := coll.Database().Client().Database("admin").Aggregate(ctx, pipeline)
+	if err != nil {
+		return indexProgress{}, false, err
+	}
+	var ops []struct {
+		Progress indexProgress `bson:"progress"`
+	}
+	err = c.All(ctx, &ops)
+	if err != nil || len(ops) == 0 {
+		return indexProgress{}, false, err
+	}
+	return ops[0].Progress, true, nil
+}
+
+// isIndexBuildTimeout returns whether the given error indicates an index build
+// exceeded its timeout.
+func isIndexBuildTimeout(err error) bool {
+	if mongo.IsTimeout(err) {
+		return true
+	}
+	cmdErr, ok := err.(mongo.CommandError)
+	return ok && cmdErr.HasErrorCode(codeMaxTimeMSExpired)
+}
+
+// listIndexes returns the specifications of the indexes that exist on the
+// given collection, by name.
+func listIndexes(ctx context.Context, coll *mongo.Collection) (map[string]indexSpec, error) {
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []indexSpec
+	err = cur.All(ctx, &specs)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]indexSpec, len(specs))
+	for _, spec := range specs {
+		existing[spec.Name] = spec
+	}
+	return existing, nil
+}
+
+// hasDuplicates returns whether the given collection holds multiple documents
+// with the same values for the given keys.
+func hasDuplicates(ctx context.Context, coll *mongo.Collection, keys bson.D) (bool, error) {
+	group := bson.M{}
+	for _, key := range keys {
+		group[key.Key] = "$" + key.Key
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": group, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 1}},
+	}
+	c, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return false, errors.AddContext(err, "failed to look for duplicates")
+	}
+	defer c.Close(ctx)
+	return c.Next(ctx), c.Err()
+}
+
+// indexKeys returns the keys of the given index model as an ordered document.
+func indexKeys(model mongo.IndexModel) (bson.D, error) {
+	b, err := bson.Marshal(model.Keys)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to marshal index keys")
+	}
+	var keys bson.D
+	err = bson.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to unmarshal index keys")
+	}
+	return keys, nil
+}
+
+// matches returns whether the existing index has the given keys and options.
+// Only the options the schema makes use of are compared.
+func (spec indexSpec) matches(keys bson.D, opts *options.IndexOptions) bool {
+	if !keysEqual(spec.Key, keys) {
+		return false
+	}
+	if spec.Unique != (opts.Unique != nil && *opts.Unique) {
+		return false
+	}
+	if spec.Sparse != (opts.Sparse != nil && *opts.Sparse) {
+		return false
+	}
+	if (spec.ExpireAfterSeconds == nil) != (opts.ExpireAfterSeconds == nil) {
+		return false
+	}
+	if spec.ExpireAfterSeconds != nil && *spec.ExpireAfterSeconds != int64(*opts.ExpireAfterSeconds) {
+		return false
+	}
+
+	// compare the partial filter
+	var filter bson.M
+	if opts.PartialFilterExpression != nil {
+		b, err := bson.Marshal(opts.PartialFilterExpression)
+		if err != nil || bson.Unmarshal(b, &filter) != nil {
+			return false
+		}
+	}
+	if !bsonEqual(spec.PartialFilterExpression, filter) {
+		return false
+	}
+
+	// compare the collation, the database fills in the defaults of all
+	// fields that weren't set so we only compare the ones that are
+	if opts.Collation == nil {
+		return spec.Collation == nil
+	}
+	var collation bson.M
+	if bson.Unmarshal(opts.Collation.ToDocument(), &collation) != nil {
+		return false
+	}
+	for k, v := range collation {
+		if !bsonEqual(spec.Collation[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// keysEqual returns whether the given index keys are equal, the order of the
+// keys matters.
+func keysEqual(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bsonEqual(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// bsonEqual returns whether the given decoded BSON values are equal, numbers
+// are compared regardless of their type and documents regardless of the order
+// of their fields.
+func bsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeBSON(a), normalizeBSON(b))
+}
+
+// normalizeBSON normalizes the given decoded BSON value so it can be compared
+// using reflect.DeepEqual, numbers are converted to float64 and documents to
+// maps. Empty documents are considered equal to nil.
+func normalizeBSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case bson.M:
+		if len(v) == 0 {
+			return nil
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalizeBSON(e)
+		}
+		return m
+	case bson.D:
+		if len(v) == 0 {
+			return nil
+		}
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = normalizeBSON(e.Value)
+		}
+		return m
+	case bson.A:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = normalizeBSON(e)
+		}
+		return a
+	default:
+		return v
+	}
+}
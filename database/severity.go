@@ -0,0 +1,85 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// SeverityCritical is the severity of reports that have to be blocked
+	// immediately, e.g. CSAM. They trigger the block loop and an alert.
+	SeverityCritical = "critical"
+
+	// SeverityHigh is the severity of reports that are blocked before the
+	// normal ones within a sweep of the block loop.
+	SeverityHigh = "high"
+
+	// SeverityNormal is the severity of all other reports, it's the default.
+	SeverityNormal = "normal"
+)
+
+// SeverityMapping maps tags onto the severity of the reports that carry them.
+// Tags are matched by their normalized form, see NormalizeTag, tags that
+// aren't mapped are of normal severity.
+type SeverityMapping map[string]string
+
+// NewSeverityMapping returns a mapping of the given tags onto the given
+// severities. It returns an error if one of the severities is unknown.
+func NewSeverityMapping(severities map[string]string) (SeverityMapping, error) {
+	m := make(SeverityMapping, len(severities))
+	for tag, severity := range severities {
+		tag = NormalizeTag(tag)
+		severity = strings.ToLower(strings.TrimSpace(severity))
+		if tag == "" {
+			return nil, errors.New("invalid severity mapping, tag can't be empty")
+		}
+		if severityRank(severity) == 0 {
+			return nil, fmt.Errorf("invalid severity '%s' for tag '%s', should be '%s', '%s' or '%s'", severity, tag, SeverityCritical, SeverityHigh, SeverityNormal)
+		}
+		m[tag] = severity
+	}
+	return m, nil
+}
+
+// Severity returns the highest severity of the given tags.
+func (m SeverityMapping) Severity(tags []string) string {
+	severity := SeverityNormal
+	for _, tag := range tags {
+		s, ok := m[NormalizeTag(tag)]
+		if ok && severityRank(s) > severityRank(severity) {
+			severity = s
+		}
+	}
+	return severity
+}
+
+// IsSeverity returns whether the given string is a known severity.
+func IsSeverity(severity string) bool {
+	return severityRank(severity) > 0
+}
+
+// SeverityAtLeast returns whether the given severity is at least as severe as
+// the given minimum. Reports without a severity are of normal severity.
+func SeverityAtLeast(severity, min string) bool {
+	if severity == "" {
+		severity = SeverityNormal
+	}
+	return severityRank(severity) >= severityRank(min)
+}
+
+// severityRank returns the rank of the given severity, a higher rank means the
+// report is more severe. Unknown severities have a rank of zero.
+func severityRank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 3
+	case SeverityHigh:
+		return 2
+	case SeverityNormal:
+		return 1
+	default:
+		return 0
+	}
+}
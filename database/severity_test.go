@@ -0,0 +1,52 @@
+package database
+
+import "testing"
+
+// TestSeverityMapping is a unit test for the SeverityMapping.
+func TestSeverityMapping(t *testing.T) {
+	t.Parallel()
+
+	// assert invalid mappings are rejected
+	_, err := NewSeverityMapping(map[string]string{"csam": "urgent"})
+	if err == nil {
+		t.Fatal("expected unknown severity to be rejected")
+	}
+	_, err = NewSeverityMapping(map[string]string{" ": SeverityHigh})
+	if err == nil {
+		t.Fatal("expected empty tag to be rejected")
+	}
+
+	// create a mapping, tags and severities are normalized
+	m, err := NewSeverityMapping(map[string]string{
+		"CSAM ":   "Critical",
+		"malware": SeverityHigh,
+		"spam":    SeverityNormal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		tags     []string
+		expected string
+	}{
+		{"NoTags", nil, SeverityNormal},
+		{"Unmapped", []string{"other"}, SeverityNormal},
+		{"Normal", []string{"spam"}, SeverityNormal},
+		{"High", []string{"spam", "malware"}, SeverityHigh},
+		{"Critical", []string{"malware", "csam", "spam"}, SeverityCritical},
+		{"CaseInsensitive", []string{" Csam"}, SeverityCritical},
+	}
+	for _, test := range tests {
+		if severity := m.Severity(test.tags); severity != test.expected {
+			t.Fatalf("%v: unexpected severity, %v != %v", test.name, severity, test.expected)
+		}
+	}
+
+	// assert a nil mapping considers every report normal
+	var nilMapping SeverityMapping
+	if severity := nilMapping.Severity([]string{"csam"}); severity != SeverityNormal {
+		t.Fatal("unexpected severity", severity)
+	}
+}
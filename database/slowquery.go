@@ -0,0 +1,174 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// DefaultSlowQueryThreshold is the duration after which a database
+	// operation is considered slow and gets logged.
+	DefaultSlowQueryThreshold = 500 * time.Millisecond
+)
+
+var (
+	// queryDurationBuckets are the upper bounds, in seconds, of the buckets of
+	// the query duration histograms, they match Prometheus' default buckets.
+	queryDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type (
+	// QueryHistogram is a histogram of the duration of a database operation.
+	// It follows the format of a Prometheus histogram, the buckets hold the
+	// cumulative number of operations that took at most the given number of
+	// seconds and the sum holds the total duration in seconds.
+	QueryHistogram struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}
+
+	// queryStats keeps track of the durations of a database operation.
+	queryStats struct {
+		buckets []uint64
+		count   uint64
+		sum     float64
+	}
+)
+
+// QueryStats returns the histograms of the duration of all database operations
+// that were performed, keyed by "collection.operation".
+func (db *DB) QueryStats() map[string]QueryHistogram {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+
+	histograms := make(map[string]QueryHistogram, len(db.queryStats))
+	for key, stats := range db.queryStats {
+		h := QueryHistogram{
+			Buckets: make(map[string]uint64, len(queryDurationBuckets)+1),
+			Count:   stats.count,
+			Sum:     stats.sum,
+		}
+		for i, le := range queryDurationBuckets {
+			h.Buckets[strconv.FormatFloat(le, 'g', -1, 64)] = stats.buckets[i]
+		}
+		h.Buckets["+Inf"] = stats.count
+		histograms[key] = h
+	}
+	return histograms
+}
+
+// SetSlowQueryThreshold sets the duration after which a database operation is
+// considered slow and gets logged.
+func (db *DB) SetSlowQueryThreshold(threshold time.Duration) {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	db.slowQueryThreshold = threshold
+}
+
+// SetQueryObserver sets the function that gets called with the duration of
+// every database operation, it's called synchronously so it shouldn't block.
+func (db *DB) SetQueryObserver(observer func(time.Duration)) {
+	db.staticMu.Lock()
+	defer db.staticMu.Unlock()
+	db.queryObserver = observer
+}
+
+// managedObserveQuery records the duration of the given operation and logs it
+// if it exceeds the slow query threshold. Only the shape of the filter gets
+// logged, not its values.
+func (db *DB) managedObserveQuery(collName, op string, filter interface{}, d time.Duration) {
+	key := fmt.Sprintf("%v.%v", collName, op)
+	seconds := d.Seconds()
+
+	db.staticMu.Lock()
+	stats, exists := db.queryStats[key]
+	if !exists {
+		stats = &queryStats{buckets: make([]uint64, len(queryDurationBuckets))}
+		db.queryStats[key] = stats
+	}
+	for i, le := range queryDurationBuckets {
+		if seconds <= le {
+			stats.buckets[i]++
+		}
+	}
+	stats.count++
+	stats.sum += seconds
+	threshold := db.slowQueryThreshold
+	observer := db.queryObserver
+	db.staticMu.Unlock()
+
+	if observer != nil {
+		observer(d)
+	}
+
+	if threshold > 0 && d > threshold {
+		db.staticLogger.WithFields(logrus.Fields{
+			"collection": collName,
+			"operation":  op,
+			"filter":     filterShape(filter),
+			"duration":   d,
+		}).Warn("Slow database operation")
+	}
+}
+
+// trackQuery starts tracking the duration of the given operation, the returned
+// function has to be called when the operation is done, typically by deferring
+// it.
+func (db *DB) trackQuery(collName, op string, filter interface{}) func() {
+	start := time.Now()
+	if db.queryFailpoint != nil {
+		db.queryFailpoint(collName, op)
+	}
+	return func() {
+		db.managedObserveQuery(collName, op, filter, time.Since(start))
+	}
+}
+
+// filterShape returns a representation of the given filter, or pipeline, in
+// which all values are replaced by a placeholder. This allows logging filters
+// without leaking the hashes or reporters they contain.
+func filterShape(filter interface{}) string {
+	switch f := filter.(type) {
+	case nil:
+		return "{}"
+	case bson.M:
+		keys := make([]string, 0, len(f))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = fmt.Sprintf("%v: %v", k, filterShape(f[k]))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case bson.D:
+		fields := make([]string, len(f))
+		for i, e := range f {
+			fields[i] = fmt.Sprintf("%v: %v", e.Key, filterShape(e.Value))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case bson.A:
+		elems := make([]string, len(f))
+		for i, e := range f {
+			elems[i] = filterShape(e)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case mongo.Pipeline:
+		stages := make([]string, len(f))
+		for i, stage := range f {
+			stages[i] = filterShape(stage)
+		}
+		return "[" + strings.Join(stages, ", ") + "]"
+	default:
+		return "?"
+	}
+}
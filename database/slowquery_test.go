@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestFilterShape is a unit test for the filterShape helper.
+func TestFilterShape(t *testing.T) {
+	t.Parallel()
+
+	hash := HashBytes([]byte("secret"))
+	tests := []struct {
+		name   string
+		filter interface{}
+		shape  string
+	}{
+		{"Nil", nil, "{}"},
+		{"Empty", bson.M{}, "{}"},
+		{"Map", bson.M{"invalid": bson.M{"$ne": true}, "hash": hash.String()}, "{hash: ?, invalid: {$ne: ?}}"},
+		{"Doc", bson.D{{Key: "hash", Value: bson.M{"$in": []Hash{hash}}}}, "{hash: {$in: ?}}"},
+		{"Array", bson.M{"$or": bson.A{bson.M{"reporter.email": "email"}, bson.M{"reporter.sub": "sub"}}}, "{$or: [{reporter.email: ?}, {reporter.sub: ?}]}"},
+		{"Pipeline", mongo.Pipeline{{{Key: "$match", Value: bson.M{"timestamp_added": bson.M{"$gte": time.Now()}}}}}, "[{$match: {timestamp_added: {$gte: ?}}}]"},
+	}
+	for _, test := range tests {
+		shape := filterShape(test.filter)
+		if shape != test.shape {
+			t.Fatalf("%v: unexpected shape, %v != %v", test.name, shape, test.shape)
+		}
+		if strings.Contains(shape, hash.String()) {
+			t.Fatalf("%v: shape contains the hash", test.name)
+		}
+	}
+}
+
+// TestSlowQueries verifies slow database operations get logged and all
+// operations are recorded in the query histograms.
+func TestSlowQueries(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database with a logger we can inspect
+	logger, hook := logtest.NewNullLogger()
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t), WithTestLogger(logger.WithField("module", "db")))
+	db.SetSlowQueryThreshold(50 * time.Millisecond)
+
+	// record the durations passed to the query observer
+	var observed []time.Duration
+	db.SetQueryObserver(func(d time.Duration) {
+		observed = append(observed, d)
+	})
+
+	// simulate slow finds
+	db.queryFailpoint = func(collName, op string) {
+		if collName == collSkylinks && op == "find" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// perform a fast and a slow operation
+	hash := HashBytes([]byte("skylink"))
+	_, err := db.FindByHash(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.BlockedHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert only the slow operation got logged, without the filter values
+	var slow []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Slow database operation" {
+			slow = append(slow, entry)
+		}
+	}
+	if len(slow) != 1 {
+		t.Fatalf("unexpected number of slow operations logged, %v != 1", len(slow))
+	}
+	entry := slow[0]
+	if entry.Level != logrus.WarnLevel {
+		t.Fatal("unexpected level", entry.Level)
+	}
+	if entry.Data["collection"] != collSkylinks || entry.Data["operation"] != "find" {
+		t.Fatal("unexpected fields", entry.Data)
+	}
+	if entry.Data["filter"] != "{deleted: {$ne: ?}, hash: {$exists: ?}, invalid: {$ne: ?}, namespace: ?}" {
+		t.Fatal("unexpected filter", entry.Data["filter"])
+	}
+	if d, ok := entry.Data["duration"].(time.Duration); !ok || d < 100*time.Millisecond {
+		t.Fatal("unexpected duration", entry.Data["duration"])
+	}
+
+	// assert the histograms
+	stats := db.QueryStats()
+	find, exists := stats["skylinks.find"]
+	if !exists || find.Count != 1 || find.Sum < 0.1 {
+		t.Fatal("unexpected find histogram", find)
+	}
+	if find.Buckets["0.05"] != 0 || find.Buckets["0.25"] != 1 || find.Buckets["+Inf"] != 1 {
+		t.Fatal("unexpected find buckets", find.Buckets)
+	}
+	findOne, exists := stats["skylinks.findOne"]
+	if !exists || findOne.Count != 1 || findOne.Buckets["+Inf"] != 1 {
+		t.Fatal("unexpected findOne histogram", findOne)
+	}
+
+	// assert the observer saw both operations
+	if len(observed) != 2 || observed[1] < 100*time.Millisecond {
+		t.Fatal("unexpected observed durations", observed)
+	}
+}
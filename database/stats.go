@@ -0,0 +1,465 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// SourceAPI is the source of skylinks reported through the trusted block
+	// endpoint.
+	SourceAPI = "api"
+
+	// SourcePoW is the source of skylinks reported through the PoW block
+	// endpoint.
+	SourcePoW = "pow"
+
+	// SourceSync is the source of skylinks synced from other portals.
+	SourceSync = "sync"
+
+	// SourceUnknown is the source of skylinks that were inserted before we
+	// kept track of the source.
+	SourceUnknown = "unknown"
+
+	// MaxActivityBuckets is the maximum number of buckets in an activity
+	// series.
+	MaxActivityBuckets = 1000
+)
+
+var (
+	// activitySources are the sources every activity bucket contains a count
+	// for, even if nothing got blocked from that source.
+	activitySources = []string{SourceAPI, SourcePoW, SourceSync}
+)
+
+// ActivityBucket holds the number of skylinks that got reported within the
+// bucket that starts at the given time, in total and by source.
+type ActivityBucket struct {
+	Start   time.Time      `json:"start"`
+	Total   int            `json:"total"`
+	Sources map[string]int `json:"sources"`
+}
+
+// ActivitySeries returns the number of skylinks reported within the given
+// window, grouped in buckets of the given size. Buckets are aligned to the unix
+// epoch in UTC, so daily buckets start at midnight UTC. The series contains
+// every bucket within the window, including empty ones, the last bucket being
+// the one that contains the current time. Soft-deleted skylinks are excluded
+// unless the IncludeDeleted option is given.
+func (db *DB) ActivitySeries(ctx context.Context, bucket, window time.Duration, queryOpts ...QueryOption) ([]ActivityBucket, error) {
+	if bucket < time.Millisecond || bucket%time.Millisecond != 0 {
+		return nil, errors.New("bucket must be a positive number of milliseconds")
+	}
+	if window < bucket {
+		return nil, errors.New("window must be at least as large as the bucket")
+	}
+	n := int(window/bucket) + 1
+	if n > MaxActivityBuckets {
+		return nil, errors.New("too many buckets")
+	}
+
+	// compute the start of the first and the last bucket
+	last := truncateToBucket(time.Now(), bucket)
+	first := last.Add(-time.Duration(n-1) * bucket)
+
+	// NOTE: we truncate the timestamps arithmetically rather than using
+	// '$dateTrunc', which requires MongoDB 5.0
+	bucketMS := bucket.Milliseconds()
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.skylinksFilter(bson.M{
+			"timestamp_added": bson.M{"$gte": first},
+			"invalid":         bson.M{"$ne": true},
+		}, queryOpts...)}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"start": bson.M{"$subtract": bson.A{
+					"$timestamp_added",
+					bson.M{"$mod": bson.A{bson.M{"$toLong": "$timestamp_added"}, bucketMS}},
+				}},
+				"source": bson.M{"$ifNull": bson.A{"$source", SourceUnknown}},
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	defer db.trackQuery(collSkylinks, "aggregate", pipeline)()
+	c, err := db.staticSkylinks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate activity")
+	}
+	var results []struct {
+		ID struct {
+			Start  time.Time `bson:"start"`
+			Source string    `bson:"source"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode activity")
+	}
+
+	// build the zero-filled series and fill in the results
+	series := make([]ActivityBucket, n)
+	for i := range series {
+		series[i].Start = first.Add(time.Duration(i) * bucket)
+		series[i].Sources = make(map[string]int, len(activitySources))
+		for _, source := range activitySources {
+			series[i].Sources[source] = 0
+		}
+	}
+	for _, result := range results {
+		i := int(result.ID.Start.Sub(first) / bucket)
+		if i < 0 || i >= n {
+			continue
+		}
+		series[i].Total += result.Count
+		series[i].Sources[result.ID.Source] += result.Count
+	}
+	return series, nil
+}
+
+// BlockLatency holds the percentiles, in milliseconds, of the time between a
+// skylink being reported and skyd confirming it got blocked.
+type BlockLatency struct {
+	Count int   `json:"count"`
+	P50   int64 `json:"p50"`
+	P90   int64 `json:"p90"`
+	P99   int64 `json:"p99"`
+}
+
+// BlockLatency returns the percentiles of the time it took to block the
+// skylinks that were reported since the given time. Skylinks that haven't been
+// blocked yet are not taken into account. Soft-deleted skylinks are excluded
+// unless the IncludeDeleted option is given.
+func (db *DB) BlockLatency(ctx context.Context, since time.Time, queryOpts ...QueryOption) (BlockLatency, error) {
+	// percentile returns the aggregation expression that picks the given
+	// percentile from the sorted latencies using the nearest-rank method
+	percentile := func(p float64) bson.M {
+		return bson.M{"$arrayElemAt": bson.A{
+			"$latencies",
+			bson.M{"$toInt": bson.M{"$ceil": bson.M{"$subtract": bson.A{
+				bson.M{"$multiply": bson.A{"$count", p}},
+				1,
+			}}}},
+		}}
+	}
+
+	// NOTE: MongoDB 4.4 has no '$percentile' operator, so we sort the
+	// latencies and pick the percentiles from the sorted array
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.skylinksFilter(bson.M{
+			"timestamp_added":   bson.M{"$gte": since},
+			"timestamp_blocked": bson.M{"$exists": true},
+			"invalid":           bson.M{"$ne": true},
+		}, queryOpts...)}},
+		{{Key: "$project", Value: bson.M{
+			"latency": bson.M{"$subtract": bson.A{"$timestamp_blocked", "$timestamp_added"}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"latency": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       nil,
+			"latencies": bson.M{"$push": "$latency"},
+			"count":     bson.M{"$sum": 1},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"count": 1,
+			"p50":   percentile(0.5),
+			"p90":   percentile(0.9),
+			"p99":   percentile(0.99),
+		}}},
+	}
+	defer db.trackQuery(collSkylinks, "aggregate", pipeline)()
+	c, err := db.staticSkylinks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return BlockLatency{}, errors.AddContext(err, "failed to aggregate block latency")
+	}
+	var results []struct {
+		Count int   `bson:"count"`
+		P50   int64 `bson:"p50"`
+		P90   int64 `bson:"p90"`
+		P99   int64 `bson:"p99"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return BlockLatency{}, errors.AddContext(err, "failed to decode block latency")
+	}
+	if len(results) == 0 {
+		return BlockLatency{}, nil
+	}
+	return BlockLatency(results[0]), nil
+}
+
+// FailureCounts returns the number of skylinks that are currently marked as
+// failed, by failure class. Skylinks that failed before failures got classified
+// are counted as FailureClassUnknown. Soft-deleted skylinks are excluded unless the
+// IncludeDeleted option is given.
+func (db *DB) FailureCounts(ctx context.Context, queryOpts ...QueryOption) (map[string]int, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.skylinksFilter(bson.M{
+			"failed":  bson.M{"$eq": true},
+			"invalid": bson.M{"$ne": true},
+		}, queryOpts...)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$ifNull": bson.A{"$failure_class", FailureClassUnknown}},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	defer db.trackQuery(collSkylinks, "aggregate", pipeline)()
+	c, err := db.staticSkylinks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate failures")
+	}
+	var results []struct {
+		Class string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode failures")
+	}
+
+	counts := map[string]int{
+		FailureClassPermanent: 0,
+		FailureClassTransient: 0,
+	}
+	for _, result := range results {
+		counts[result.Class] = result.Count
+	}
+	return counts, nil
+}
+
+// Backlog holds the number of skylinks that failed to get blocked and are
+// waiting to be retried, and the number of skylinks skyd rejected as invalid,
+// which are never retried.
+type Backlog struct {
+	Failed  int `json:"failed"`
+	Invalid int `json:"invalid"`
+}
+
+// Backlog returns the number of skylinks that are currently marked as failed
+// or invalid. Failed skylinks that got skipped because they are allowlisted
+// are not retried and therefore not counted. Soft-deleted skylinks are
+// excluded unless the IncludeDeleted option is given.
+func (db *DB) Backlog(ctx context.Context, queryOpts ...QueryOption) (Backlog, error) {
+	failedFilter := db.skylinksFilter(bson.M{
+		"failed":              bson.M{"$eq": true},
+		"invalid":             bson.M{"$ne": true},
+		"skipped_allowlisted": bson.M{"$ne": true},
+	}, queryOpts...)
+	failed, err := db.countSkylinks(ctx, failedFilter)
+	if err != nil {
+		return Backlog{}, errors.AddContext(err, "failed to count failed skylinks")
+	}
+	invalidFilter := db.skylinksFilter(bson.M{
+		"invalid": bson.M{"$eq": true},
+	}, queryOpts...)
+	invalid, err := db.countSkylinks(ctx, invalidFilter)
+	if err != nil {
+		return Backlog{}, errors.AddContext(err, "failed to count invalid skylinks")
+	}
+	return Backlog{Failed: failed, Invalid: invalid}, nil
+}
+
+// OldestUnblocked returns the time at which the oldest skylink that is still
+// waiting to get blocked was added, or the zero time if there's none. Skylinks
+// that failed to get blocked are still waiting, those that are invalid or that
+// got skipped because they're allowlisted are not. Soft-deleted skylinks are
+// excluded unless the IncludeDeleted option is given.
+func (db *DB) OldestUnblocked(ctx context.Context, queryOpts ...QueryOption) (time.Time, error) {
+	filter := db.skylinksFilter(bson.M{
+		"timestamp_blocked":   bson.M{"$exists": false},
+		"invalid":             bson.M{"$ne": true},
+		"skipped_allowlisted": bson.M{"$ne": true},
+	}, queryOpts...)
+	opts := options.FindOne()
+	opts.SetSort(bson.D{{Key: "timestamp_added", Value: 1}})
+	opts.SetProjection(bson.M{"timestamp_added": 1})
+
+	doc, err := db.findOne(ctx, filter, opts)
+	if err != nil {
+		return time.Time{}, errors.AddContext(err, "failed to find the oldest unblocked skylink")
+	}
+	if doc == nil {
+		return time.Time{}, nil
+	}
+	return doc.TimestampAdded, nil
+}
+
+// ReporterTagStats holds the number of skylinks a reporter reported with a tag
+// within a window, and how many of those reports turned out to be bogus. A
+// report is bogus if skyd rejected the skylink as invalid, or if the tag or the
+// entire report got reverted.
+type ReporterTagStats struct {
+	Reporter string
+	Tag      string
+	Reports  int
+	Invalid  int
+	Reverted int
+
+	// Bogus is the number of reports that are invalid, reverted or both.
+	Bogus int
+
+	// MedianInterval is the median time between two consecutive reports,
+	// it's zero if there's only one report.
+	MedianInterval time.Duration
+}
+
+// BogusRatio returns the fraction of the reports that turned out to be bogus.
+func (s ReporterTagStats) BogusRatio() float64 {
+	if s.Reports == 0 {
+		return 0
+	}
+	return float64(s.Bogus) / float64(s.Reports)
+}
+
+// SuspicionThresholds define when a reporter is suspected of filing bogus
+// reports, e.g. to get a competitor's content blocked.
+type SuspicionThresholds struct {
+	// MinReports is the minimum number of reports with a tag before the
+	// reporter can be suspected, which prevents flagging a reporter over a
+	// single mistake.
+	MinReports int
+
+	// BogusRatio is the fraction of bogus reports with a tag at or above
+	// which the reporter is suspected.
+	BogusRatio float64
+}
+
+// Suspicious returns whether the given stats exceed the thresholds.
+func (t SuspicionThresholds) Suspicious(s ReporterTagStats) bool {
+	return s.Reports > 0 && s.Reports >= t.MinReports && s.BogusRatio() >= t.BogusRatio
+}
+
+// ReporterStats returns the stats of the reporters that reported skylinks
+// since the given time, by reporter and tag, sorted by reporter and tag.
+// Reporters are identified by their sub, which is the MySkyID for reports
+// through the PoW endpoint, reports without a sub are not taken into account.
+// If a source is given only the reports from that source are. Soft-deleted
+// skylinks are excluded unless the IncludeDeleted option is given.
+func (db *DB) ReporterStats(ctx context.Context, since time.Time, source string, queryOpts ...QueryOption) ([]ReporterTagStats, error) {
+	match := bson.M{
+		"timestamp_added": bson.M{"$gte": since},
+		"reporter.sub":    bson.M{"$exists": true, "$ne": ""},
+	}
+	if source != "" {
+		match["source"] = source
+	}
+
+	// NOTE: reverted tags are moved out of the tags, so we count the union
+	// of both and consider a tag reverted if it's one of the reverted tags
+	revertedTags := bson.M{"$ifNull": bson.A{"$reverted_tags", bson.A{}}}
+	reverted := bson.M{"$or": bson.A{
+		bson.M{"$eq": bson.A{"$reverted", true}},
+		bson.M{"$in": bson.A{"$tag", revertedTags}},
+	}}
+	invalid := bson.M{"$eq": bson.A{"$invalid", true}}
+	count := func(cond interface{}) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{cond, 1, 0}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: db.skylinksFilter(match, queryOpts...)}},
+		{{Key: "$project", Value: bson.M{
+			"sub":             "$reporter.sub",
+			"invalid":         1,
+			"reverted":        1,
+			"reverted_tags":   1,
+			"timestamp_added": 1,
+			"tag": bson.M{"$setUnion": bson.A{
+				bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+				revertedTags,
+			}},
+		}}},
+		{{Key: "$unwind", Value: "$tag"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        bson.M{"sub": "$sub", "tag": "$tag"},
+			"reports":    bson.M{"$sum": 1},
+			"invalid":    count(invalid),
+			"reverted":   count(reverted),
+			"bogus":      count(bson.M{"$or": bson.A{invalid, reverted}}),
+			"timestamps": bson.M{"$push": "$timestamp_added"},
+		}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "_id.sub", Value: 1},
+			{Key: "_id.tag", Value: 1},
+		}}},
+	}
+	defer db.trackQuery(collSkylinks, "aggregate", pipeline)()
+	c, err := db.staticSkylinks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate reporter stats")
+	}
+	var results []struct {
+		ID struct {
+			Sub string `bson:"sub"`
+			Tag string `bson:"tag"`
+		} `bson:"_id"`
+		Reports    int         `bson:"reports"`
+		Invalid    int         `bson:"invalid"`
+		Reverted   int         `bson:"reverted"`
+		Bogus      int         `bson:"bogus"`
+		Timestamps []time.Time `bson:"timestamps"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode reporter stats")
+	}
+
+	stats := make([]ReporterTagStats, len(results))
+	for i, result := range results {
+		stats[i] = ReporterTagStats{
+			Reporter:       result.ID.Sub,
+			Tag:            result.ID.Tag,
+			Reports:        result.Reports,
+			Invalid:        result.Invalid,
+			Reverted:       result.Reverted,
+			Bogus:          result.Bogus,
+			MedianInterval: medianInterval(result.Timestamps),
+		}
+	}
+	return stats, nil
+}
+
+// medianInterval returns the median time between consecutive timestamps, the
+// timestamps don't have to be sorted. It returns zero for fewer than two
+// timestamps.
+func medianInterval(timestamps []time.Time) time.Duration {
+	if len(timestamps) < 2 {
+		return 0
+	}
+	sorted := append([]time.Time{}, timestamps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+	intervals := make([]time.Duration, len(sorted)-1)
+	for i := range intervals {
+		intervals[i] = sorted[i+1].Sub(sorted[i])
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i] < intervals[j]
+	})
+	mid := len(intervals) / 2
+	if len(intervals)%2 == 0 {
+		return (intervals[mid-1] + intervals[mid]) / 2
+	}
+	return intervals[mid]
+}
+
+// countSkylinks returns the number of skylinks that match the given filter.
+func (db *DB) countSkylinks(ctx context.Context, filter bson.M) (int, error) {
+	defer db.trackQuery(collSkylinks, "countDocuments", filter)()
+	n, err := db.staticSkylinks.CountDocuments(ctx, filter)
+	return int(n), err
+}
+
+// truncateToBucket returns the start of the bucket of the given size that
+// contains the given time, buckets are aligned to the unix epoch.
+func truncateToBucket(t time.Time, bucket time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(bucket)).UTC()
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/crypto"
+)
+
+// Store is the persistence layer of the blocker, it holds the operations the
+// api, the blocker and the syncer perform on the blocklist. The DB is the
+// MongoDB implementation and the default, the MemoryStore keeps everything in
+// memory and is meant for tests that don't depend on MongoDB.
+//
+// Every implementation has to pass the conformance tests in store_test.go.
+type Store interface {
+	// Namespace returns the namespace of the store, every skylink belongs
+	// to a namespace and the store only writes to its own.
+	Namespace() string
+
+	// Ping returns an error if the store can't be reached.
+	Ping(ctx context.Context) error
+
+	// Retry calls the given operation, retrying it for as long as it fails
+	// with an error the store considers transient.
+	Retry(ctx context.Context, fn func() error) error
+
+	// SchemaHealthy returns whether the store's schema is complete, and
+	// MissingIndexes the indexes that were missing the last time it was
+	// checked.
+	SchemaHealthy() bool
+	MissingIndexes() []string
+
+	// Reported skylinks.
+	CreateBlockedSkylink(ctx context.Context, skylink *BlockedSkylink) error
+	CreateBlockedSkylinkBulk(ctx context.Context, skylinks []BlockedSkylink) (int, error)
+	CreateBlockedSkylinkBatch(ctx context.Context, skylinks []BlockedSkylink) ([]int, error)
+	AddSeenOnPortal(ctx context.Context, hashes []Hash, portalURL string) error
+	AddTags(ctx context.Context, hash Hash, tags []string) error
+	FindByHash(ctx context.Context, hash Hash, queryOpts ...QueryOption) (*BlockedSkylink, error)
+	ExistingHashes(ctx context.Context, hashes []Hash, queryOpts ...QueryOption) ([]Hash, error)
+	BlockedHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error)
+	PendingHashes(ctx context.Context, sort, skip, limit int, queryOpts ...QueryOption) ([]BlockedSkylink, bool, error)
+	LatestTimestampAdded(ctx context.Context, hashes []Hash) (time.Time, error)
+	SkylinksAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]BlockedSkylink, error)
+
+	// The sweeps of the blocker and the outcome of sending hashes to skyd.
+	HashesToBlock(ctx context.Context, from time.Time, queryOpts ...QueryOption) ([]Hash, error)
+	HashesToRetry(ctx context.Context, limit int, queryOpts ...QueryOption) ([]Hash, error)
+	HashesToUnblock(ctx context.Context, limit int) ([]Hash, error)
+	MarkFailed(ctx context.Context, hashes []Hash, class, reason string) error
+	MarkInvalid(ctx context.Context, hashes []Hash) error
+	MarkSkippedAllowListed(ctx context.Context, hashes []Hash) error
+	MarkSucceeded(ctx context.Context, hashes []Hash) error
+	MarkUnblocked(ctx context.Context, hashes []Hash) error
+	ReconcileBlocked(ctx context.Context, hashes []Hash) (marked, unmarked []Hash, err error)
+	ClearBlocked(ctx context.Context, hashes []Hash) error
+
+	// Admin operations on a single skylink.
+	ResurrectInvalid(ctx context.Context, hash Hash, report *BlockedSkylink) error
+	ResetBlockedSkylink(ctx context.Context, hash Hash, bump bool, detail string) error
+	RevertTags(ctx context.Context, hash Hash, tags []string, detail string) (*BlockedSkylink, error)
+	SoftDelete(ctx context.Context, hash Hash, detail string) error
+
+	// The archive of reverted skylinks.
+	ArchiveReverted(ctx context.Context, before time.Time) (int, error)
+	RestoreArchived(ctx context.Context, hash Hash, report *BlockedSkylink) error
+
+	// Callbacks.
+	CallbacksToDeliver(ctx context.Context, limit int) ([]BlockedSkylink, error)
+	ClearCallback(ctx context.Context, hash Hash) error
+	IncrementCallbackAttempts(ctx context.Context, hash Hash) error
+
+	// The allow list.
+	CreateAllowListedSkylink(ctx context.Context, skylink *AllowListedSkylink) error
+	AllowListedHashes(ctx context.Context, hashes []Hash) ([]Hash, error)
+	FindAllowListed(ctx context.Context, hashes []Hash) ([]AllowListedSkylink, error)
+	IsAllowListed(ctx context.Context, hash crypto.Hash) (bool, error)
+	CreateAllowListedPublisher(ctx context.Context, publisher *AllowListedPublisher) error
+	IsPublisherAllowListed(ctx context.Context, publicKey string) (bool, error)
+	RecordAllowListHit(ctx context.Context, hit AllowListHit) error
+	AllowListHits(ctx context.Context, limit int) ([]AllowListHitCount, error)
+
+	// Proofs of work and the reports of MySkyIDs.
+	IncrementProofUsage(ctx context.Context, proofHash Hash, n int) (int, error)
+	RecordReports(ctx context.Context, mySkyID string, n int, timestamp time.Time) error
+	NumReports(ctx context.Context, mySkyID string, since time.Time) (int, error)
+	ReportUsage(ctx context.Context, mySkyID string, since time.Time) (int, time.Time, error)
+
+	// Blocked identities.
+	BlockIdentity(ctx context.Context, mySkyID, reason string) error
+	UnblockIdentity(ctx context.Context, mySkyID string) error
+	BlockedIdentities(ctx context.Context) ([]BlockedIdentity, error)
+	IsIdentityBlocked(ctx context.Context, mySkyID string) (bool, error)
+
+	// The latest block timestamp of every blocker, by server UID.
+	LatestBlockTimestamp(ctx context.Context, serverUID string) (time.Time, bool, error)
+	UpdateLatestBlockTimestamp(ctx context.Context, serverUID string, timestamp time.Time) error
+	LatestBlockTimestamps(ctx context.Context) ([]LatestBlockTimestamp, error)
+	PruneLatestBlockTimestamps(ctx context.Context, before time.Time, except string) (int, error)
+
+	// Statistics.
+	ActivitySeries(ctx context.Context, bucket, window time.Duration, queryOpts ...QueryOption) ([]ActivityBucket, error)
+	BlockLatency(ctx context.Context, since time.Time, queryOpts ...QueryOption) (BlockLatency, error)
+	Backlog(ctx context.Context, queryOpts ...QueryOption) (Backlog, error)
+	FailureCounts(ctx context.Context, queryOpts ...QueryOption) (map[string]int, error)
+	ReporterStats(ctx context.Context, since time.Time, source string, queryOpts ...QueryOption) ([]ReporterTagStats, error)
+	OldestUnblocked(ctx context.Context, queryOpts ...QueryOption) (time.Time, error)
+}
+
+// Exporter is implemented by stores that can export the blocklist, see
+// DB.Export.
+type Exporter interface {
+	Export(ctx context.Context, w io.Writer) error
+}
+
+var (
+	_ Store    = (*DB)(nil)
+	_ Exporter = (*DB)(nil)
+	_ Store    = (*MemoryStore)(nil)
+)
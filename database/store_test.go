@@ -0,0 +1,1131 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestStore runs the conformance tests every Store implementation has to pass,
+// against the MemoryStore and, unless tests run in short mode, the DB.
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	stores := []struct {
+		name  string
+		mongo bool
+		new   func(t *testing.T) Store
+	}{
+		{
+			name: "Memory",
+			new: func(t *testing.T) Store {
+				ms, err := NewMemoryStore(DefaultNamespace)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ms
+			},
+		},
+		{
+			name:  "MongoDB",
+			mongo: true,
+			new: func(t *testing.T) Store {
+				return NewTestDB(context.Background(), t.Name(), WithCleanup(t))
+			},
+		},
+	}
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"Skylinks", testStoreSkylinks},
+		{"Sweep", testStoreSweep},
+		{"ContentMissing", testStoreContentMissing},
+		{"Revert", testStoreRevert},
+		{"SoftDelete", testStoreSoftDelete},
+		{"Archive", testStoreArchive},
+		{"Callbacks", testStoreCallbacks},
+		{"AllowList", testStoreAllowList},
+		{"AllowListHits", testStoreAllowListHits},
+		{"AllowListPublishers", testStoreAllowListPublishers},
+		{"Identities", testStoreIdentities},
+		{"Usage", testStoreUsage},
+		{"ReporterStats", testStoreReporterStats},
+	}
+	for _, store := range stores {
+		if store.mongo && testing.Short() {
+			continue
+		}
+		store := store
+		for _, test := range tests {
+			test := test
+			t.Run(store.name+"/"+test.name, func(t *testing.T) {
+				test.test(t, store.new(t))
+			})
+		}
+	}
+}
+
+// testStoreSkylinks verifies skylinks can be created, found and listed.
+func testStoreSkylinks(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := Now()
+	a := storeSkylink("a", now.Add(-2*time.Minute), "malware")
+	b := storeSkylink("b", now.Add(-time.Minute), "phishing")
+	b.Metadata = map[string]string{"case": "42"}
+	c := storeSkylink("c", now, "csam")
+	d := storeSkylink("d", now, "malware")
+
+	// create a skylink, creating it again fails
+	err := s.CreateBlockedSkylink(ctx, &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Namespace != s.Namespace() {
+		t.Fatal("unexpected namespace", a.Namespace)
+	}
+	err = s.CreateBlockedSkylink(ctx, &a)
+	if !errors.Contains(err, ErrSkylinkExists) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// create skylinks in batch and in bulk, the duplicates are skipped
+	duplicates, err := s.CreateBlockedSkylinkBatch(ctx, []BlockedSkylink{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(duplicates, []int{0}) {
+		t.Fatal("unexpected duplicates", duplicates)
+	}
+	inserted, err := s.CreateBlockedSkylinkBulk(ctx, []BlockedSkylink{b, c, d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 2 {
+		t.Fatal("unexpected number of inserted skylinks", inserted)
+	}
+
+	// find a skylink by its hash
+	found, err := s.FindByHash(ctx, b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Hash != b.Hash || !found.TimestampAdded.Equal(b.TimestampAdded) || found.Metadata["case"] != "42" {
+		t.Fatal("unexpected skylink", found)
+	}
+	unknown := HashBytes([]byte("unknown"))
+	found, err = s.FindByHash(ctx, unknown)
+	if err != nil || found != nil {
+		t.Fatal("unexpected skylink", found, err)
+	}
+	existing, err := s.ExistingHashes(ctx, []Hash{a.Hash, b.Hash, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, existing, a.Hash, b.Hash)
+
+	// page through the blocklist in both directions, skylinks added at the
+	// same time are ordered by insertion
+	docs, more, err := s.BlockedHashes(ctx, 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, true, a.Hash, b.Hash)
+	docs, more, err = s.BlockedHashes(ctx, 1, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, false, c.Hash, d.Hash)
+	docs, more, err = s.BlockedHashes(ctx, -1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, true, d.Hash)
+
+	// assert the query options
+	for _, test := range []struct {
+		name     string
+		opt      QueryOption
+		expected []Hash
+	}{
+		{"Tags", WithTags("CSAM"), []Hash{c.Hash}},
+		{"HashPrefix", WithHashPrefix(b.Hash.String()[:8]), []Hash{b.Hash}},
+		{"Metadata", WithMetadata("case", "42"), []Hash{b.Hash}},
+		{"AddedBefore", AddedBefore(now), []Hash{a.Hash, b.Hash}},
+		{"Namespace", InNamespace("other"), nil},
+	} {
+		docs, more, err = s.BlockedHashes(ctx, 1, 0, 10, test.opt)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		assertSkylinks(t, docs, more, false, test.expected...)
+	}
+
+	// page through the skylinks by id
+	docs, err = s.SkylinksAfter(ctx, primitive.NilObjectID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 {
+		t.Fatal("unexpected number of skylinks", len(docs))
+	}
+	rest, err := s.SkylinksAfter(ctx, docs[2].ID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 1 || rest[0].Hash != d.Hash {
+		t.Fatal("unexpected skylinks", rest)
+	}
+
+	// add tags, the existing ones are kept
+	err = s.AddTags(ctx, b.Hash, []string{"phishing", "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = s.FindByHash(ctx, b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := append([]string{}, found.Tags...)
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"phishing", "spam"}) {
+		t.Fatal("unexpected tags", found.Tags)
+	}
+	err = s.AddTags(ctx, unknown, []string{"spam"})
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// record the portals a skylink was seen on
+	err = s.AddSeenOnPortal(ctx, []Hash{a.Hash}, "https://siasky.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddSeenOnPortal(ctx, []Hash{a.Hash}, "https://siasky.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = s.FindByHash(ctx, a.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found.SeenOnPortals, []string{"https://siasky.net"}) {
+		t.Fatal("unexpected portals", found.SeenOnPortals)
+	}
+
+	// assert the latest time a skylink out of the given ones was added
+	latest, err := s.LatestTimestampAdded(ctx, []Hash{a.Hash, b.Hash, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest.Equal(b.TimestampAdded) {
+		t.Fatal("unexpected timestamp", latest)
+	}
+}
+
+// testStoreSweep verifies the lifecycle of skylinks as they are swept by the
+// blocker.
+func testStoreSweep(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := Now()
+	a := storeSkylink("a", now.Add(-3*time.Minute), "malware")
+	b := storeSkylink("b", now.Add(-2*time.Minute), "csam")
+	b.Severity = SeverityCritical
+	c := storeSkylink("c", now.Add(-4*time.Minute), "phishing")
+	d := storeSkylink("d", now.Add(-time.Minute), "spam")
+	for _, bsl := range []*BlockedSkylink{&a, &b, &c, &d} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the critical skylink gets blocked first
+	hashes, err := s.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 4 || hashes[0] != b.Hash {
+		t.Fatal("unexpected hashes", hashes)
+	}
+	hashes, err = s.HashesToBlock(ctx, now.Add(-90*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, d.Hash)
+
+	// fail two of them, transient failures get retried first
+	err = s.MarkFailed(ctx, []Hash{c.Hash}, FailureClassPermanent, "rejected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.MarkFailed(ctx, []Hash{a.Hash}, FailureClassTransient, "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.MarkFailed(ctx, []Hash{a.Hash}, "unknown", "")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	hashes, err = s.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hashes, []Hash{a.Hash, c.Hash}) {
+		t.Fatal("unexpected hashes", hashes)
+	}
+	hashes, err = s.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, b.Hash, d.Hash)
+	counts, err := s.FailureCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[FailureClassPermanent] != 1 || counts[FailureClassTransient] != 1 {
+		t.Fatal("unexpected failure counts", counts)
+	}
+	oldest, err := s.OldestUnblocked(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oldest.Equal(c.TimestampAdded) {
+		t.Fatal("unexpected oldest unblocked", oldest)
+	}
+
+	// block two of them, the failure gets cleared
+	err = s.MarkSucceeded(ctx, []Hash{a.Hash, b.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.FindByHash(ctx, a.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Failed || found.FailureClass != "" || found.TimestampBlocked.IsZero() || !found.IsBlocked() {
+		t.Fatal("unexpected skylink", found)
+	}
+	if n := len(found.Events); n != 2 || found.Events[n-1].Type != EventSucceeded {
+		t.Fatal("unexpected events", found.Events)
+	}
+	marked, unmarked, err := s.ReconcileBlocked(ctx, []Hash{a.Hash, b.Hash, c.Hash, HashBytes([]byte("unknown"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, marked, a.Hash, b.Hash)
+	assertHashes(t, unmarked, c.Hash)
+	latency, err := s.BlockLatency(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency.Count != 2 || latency.P50 <= 0 || latency.P99 < latency.P50 {
+		t.Fatal("unexpected latency", latency)
+	}
+
+	// requeue one of them because it's missing from skyd's blocklist
+	err = s.ClearBlocked(ctx, []Hash{a.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, more, err := s.PendingHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, false, a.Hash, d.Hash)
+
+	// mark one invalid and resurrect it
+	err = s.MarkInvalid(ctx, []Hash{d.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backlog, err := s.Backlog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog != (Backlog{Failed: 1, Invalid: 1}) {
+		t.Fatal("unexpected backlog", backlog)
+	}
+	err = s.ResurrectInvalid(ctx, a.Hash, &BlockedSkylink{})
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+	err = s.ResurrectInvalid(ctx, d.Hash, &BlockedSkylink{
+		Reporter: Reporter{Name: "John"},
+		Tags:     []string{"malware"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = s.FindByHash(ctx, d.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Invalid || found.Reporter.Name != "John" || len(found.Tags) != 2 || !found.TimestampAdded.After(d.TimestampAdded) {
+		t.Fatal("unexpected skylink", found)
+	}
+
+	// reset the failed one
+	err = s.ResetBlockedSkylink(ctx, c.Hash, true, "retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = s.HashesToRetry(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Fatal("unexpected hashes", hashes)
+	}
+	found, err = s.FindByHash(ctx, c.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Failed || !found.TimestampAdded.After(c.TimestampAdded) || found.Events[len(found.Events)-1].Detail != "retry" {
+		t.Fatal("unexpected skylink", found)
+	}
+	err = s.ResetBlockedSkylink(ctx, HashBytes([]byte("unknown")), false, "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the activity counts all of them
+	series, err := s.ActivitySeries(ctx, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	for _, bucket := range series {
+		total += bucket.Total
+	}
+	if len(series) != 25 || total != 4 {
+		t.Fatal("unexpected activity", len(series), total)
+	}
+
+	// assert only the last events are kept
+	for i := 0; i < MaxEvents+5; i++ {
+		err = s.MarkFailed(ctx, []Hash{b.Hash}, FailureClassTransient, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err = s.FindByHash(ctx, b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Events) != MaxEvents {
+		t.Fatal("unexpected number of events", len(found.Events))
+	}
+}
+
+// testStoreContentMissing verifies the hashes of missing content are swept
+// after the other hashes of the same severity.
+func testStoreContentMissing(t *testing.T, s Store) {
+	ctx := context.Background()
+	missing := storeSkylink("missing", Now(), "spam")
+	missing.ContentMissing = true
+	missing.Severity = SeverityNormal
+	present := storeSkylink("present", Now(), "spam")
+	present.Severity = SeverityNormal
+	critical := storeSkylink("critical", Now(), "csam")
+	critical.ContentMissing = true
+	critical.Severity = SeverityCritical
+	for _, bsl := range []*BlockedSkylink{&missing, &present, &critical} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes, err := s.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Hash{critical.Hash, present.Hash, missing.Hash}
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Fatal("unexpected hashes", hashes)
+	}
+}
+
+// testStoreRevert verifies tags can be reverted and reverted skylinks get
+// unblocked.
+func testStoreRevert(t *testing.T, s Store) {
+	ctx := context.Background()
+	a := storeSkylink("a", Now(), "malware", "phishing")
+	err := s.CreateBlockedSkylink(ctx, &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.MarkSucceeded(ctx, []Hash{a.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// revert one of the tags
+	reverted, err := s.RevertTags(ctx, a.Hash, []string{"malware"}, "partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Reverted || !reflect.DeepEqual(reverted.Tags, []string{"phishing"}) || !reflect.DeepEqual(reverted.RevertedTags, []string{"malware"}) {
+		t.Fatal("unexpected skylink", reverted)
+	}
+	hashes, err := s.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Fatal("unexpected hashes", hashes)
+	}
+
+	// revert all of them
+	reverted, err = s.RevertTags(ctx, a.Hash, nil, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reverted.Reverted || len(reverted.Tags) != 0 || !reflect.DeepEqual(reverted.RevertedTags, []string{"malware", "phishing"}) || reverted.TimestampReverted.IsZero() {
+		t.Fatal("unexpected skylink", reverted)
+	}
+	docs, more, err := s.BlockedHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, false)
+
+	// unblock it
+	hashes, err = s.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, a.Hash)
+	err = s.MarkUnblocked(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = s.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Fatal("unexpected hashes", hashes)
+	}
+
+	_, err = s.RevertTags(ctx, HashBytes([]byte("unknown")), nil, "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testStoreSoftDelete verifies soft-deleted skylinks that skyd blocked get
+// unblocked like reverted ones, and that pending ones are no longer blocked.
+func testStoreSoftDelete(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	// a is blocked and b is pending
+	a := storeSkylink("a", Now(), "malware")
+	b := storeSkylink("b", Now(), "malware")
+	for _, bsl := range []*BlockedSkylink{&a, &b} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.MarkSucceeded(ctx, []Hash{a.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// soft-delete both of them
+	for _, hash := range []Hash{a.Hash, b.Hash} {
+		err = s.SoftDelete(ctx, hash, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.SoftDelete(ctx, a.Hash, "")
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+	hashes, err := s.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Fatal("unexpected hashes", hashes)
+	}
+
+	// assert only the blocked one gets unblocked
+	hashes, err = s.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, a.Hash)
+	err = s.MarkUnblocked(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = s.HashesToUnblock(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 0 {
+		t.Fatal("unexpected hashes", hashes)
+	}
+	doc, err := s.FindByHash(ctx, a.Hash, IncludeDeleted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil || !doc.Deleted || !doc.TimestampBlocked.IsZero() || doc.Events[len(doc.Events)-1].Type != EventUnblocked {
+		t.Fatalf("unexpected skylink %+v", doc)
+	}
+}
+
+// testStoreArchive verifies reverted skylinks that were unblocked are moved to
+// the archive, and that an archived skylink can be restored.
+func testStoreArchive(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	// a is reverted and unblocked, b is reverted but still blocked and c is
+	// blocked
+	a := storeSkylink("a", Now(), "malware", "phishing")
+	b := storeSkylink("b", Now(), "malware")
+	c := storeSkylink("c", Now(), "malware")
+	for _, bsl := range []*BlockedSkylink{&a, &b, &c} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.MarkSucceeded(ctx, []Hash{a.Hash, b.Hash, c.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []Hash{a.Hash, b.Hash} {
+		_, err = s.RevertTags(ctx, hash, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.MarkUnblocked(ctx, []Hash{a.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// skylinks reverted after the cutoff aren't archived
+	archived, err := s.ArchiveReverted(ctx, Now().Add(-time.Hour))
+	if err != nil || archived != 0 {
+		t.Fatal("unexpected archived skylinks", archived, err)
+	}
+
+	// archive a, rerunning the archival is a no-op
+	for _, expected := range []int{1, 0} {
+		archived, err = s.ArchiveReverted(ctx, Now().Add(time.Minute))
+		if err != nil || archived != expected {
+			t.Fatal("unexpected archived skylinks", archived, err)
+		}
+	}
+	hashes, err := s.ExistingHashes(ctx, []Hash{a.Hash, b.Hash, c.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, b.Hash, c.Hash)
+
+	// the archive is only read when asked to
+	found, err := s.FindByHash(ctx, a.Hash)
+	if err != nil || found != nil {
+		t.Fatal("unexpected skylink", found, err)
+	}
+	found, err = s.FindByHash(ctx, a.Hash, IncludeArchived())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || !found.Archived || found.TimestampArchived.IsZero() || !found.Reverted {
+		t.Fatal("unexpected skylink", found)
+	}
+
+	// restore it as a new report
+	report := storeSkylink("reporter", Now().Add(time.Minute), "csam", "malware")
+	err = s.RestoreArchived(ctx, a.Hash, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = s.FindByHash(ctx, a.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Archived || found.Reverted || found.IsBlocked() {
+		t.Fatal("unexpected skylink", found)
+	}
+	if !reflect.DeepEqual(found.Tags, []string{"csam", "malware"}) || !reflect.DeepEqual(found.RevertedTags, []string{"phishing"}) {
+		t.Fatal("unexpected tags", found.Tags, found.RevertedTags)
+	}
+	if found.Reporter.Name != "reporter" || len(found.MergedReporters) != 1 || found.MergedReporters[0].Name != "a" {
+		t.Fatal("unexpected reporters", found.Reporter, found.MergedReporters)
+	}
+	if len(found.Events) == 0 || found.Events[len(found.Events)-1].Type != EventResurrected {
+		t.Fatal("unexpected events", found.Events)
+	}
+	hashes, err = s.HashesToBlock(ctx, report.TimestampAdded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, a.Hash)
+
+	// it's no longer archived
+	err = s.RestoreArchived(ctx, a.Hash, &report)
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testStoreCallbacks verifies the callbacks of skylinks that reached their
+// final state are delivered.
+func testStoreCallbacks(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := Now()
+	a := storeSkylink("a", now.Add(-time.Minute), "malware")
+	a.CallbackURL = "https://example.com/a"
+	b := storeSkylink("b", now, "malware")
+	b.CallbackURL = "https://example.com/b"
+	c := storeSkylink("c", now, "malware")
+	for _, bsl := range []*BlockedSkylink{&a, &b, &c} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// callbacks are only delivered once the skylinks reached their final
+	// state
+	docs, err := s.CallbacksToDeliver(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, false, false)
+	err = s.MarkSucceeded(ctx, []Hash{a.Hash, c.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.MarkInvalid(ctx, []Hash{b.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err = s.CallbacksToDeliver(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, false, false, a.Hash, b.Hash)
+
+	// record a failed attempt and clear the callback
+	err = s.IncrementCallbackAttempts(ctx, a.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err = s.CallbacksToDeliver(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].CallbackAttempts != 1 {
+		t.Fatal("unexpected callbacks", docs)
+	}
+	err = s.ClearCallback(ctx, a.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err = s.CallbacksToDeliver(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, false, false, b.Hash)
+}
+
+// testStoreAllowList verifies allowlisted skylinks are skipped.
+func testStoreAllowList(t *testing.T, s Store) {
+	ctx := context.Background()
+	a := storeSkylink("a", Now(), "malware")
+	b := storeSkylink("b", Now(), "malware")
+	for _, bsl := range []*BlockedSkylink{&a, &b} {
+		err := s.CreateBlockedSkylink(ctx, bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// allow list one of them, twice
+	for i := 0; i < 2; i++ {
+		err := s.CreateAllowListedSkylink(ctx, &AllowListedSkylink{
+			Hash:           a.Hash,
+			Description:    "test",
+			TimestampAdded: Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	allowListed, err := s.IsAllowListed(ctx, a.Hash.Hash)
+	if err != nil || !allowListed {
+		t.Fatal("expected skylink to be allowlisted", err)
+	}
+	allowListed, err = s.IsAllowListed(ctx, b.Hash.Hash)
+	if err != nil || allowListed {
+		t.Fatal("unexpected allowlisted skylink", err)
+	}
+	hashes, err := s.AllowListedHashes(ctx, []Hash{a.Hash, b.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, a.Hash)
+	allowListedDocs, err := s.FindAllowListed(ctx, []Hash{a.Hash, b.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowListedDocs) != 1 || allowListedDocs[0].Hash != a.Hash || allowListedDocs[0].Description != "test" {
+		t.Fatal("unexpected allowlisted skylinks", allowListedDocs)
+	}
+
+	// skip it, it's no longer pending
+	err = s.MarkSkippedAllowListed(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err = s.HashesToBlock(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(t, hashes, b.Hash)
+	docs, more, err := s.PendingHashes(ctx, 1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSkylinks(t, docs, more, false, b.Hash)
+}
+
+// testStoreAllowListPublishers verifies publishers are allowlisted by their
+// public key.
+func testStoreAllowListPublishers(t *testing.T, s Store) {
+	ctx := context.Background()
+	a := "ed25519:" + strings.Repeat("a", 64)
+	b := "ed25519:" + strings.Repeat("b", 64)
+
+	// allow list one of them, twice
+	for i := 0; i < 2; i++ {
+		err := s.CreateAllowListedPublisher(ctx, &AllowListedPublisher{
+			PublicKey:      a,
+			Description:    "test",
+			TimestampAdded: Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	allowListed, err := s.IsPublisherAllowListed(ctx, a)
+	if err != nil || !allowListed {
+		t.Fatal("expected publisher to be allowlisted", err)
+	}
+	allowListed, err = s.IsPublisherAllowListed(ctx, b)
+	if err != nil || allowListed {
+		t.Fatal("unexpected allowlisted publisher", err)
+	}
+}
+
+// testStoreAllowListHits verifies reports of allowlisted skylinks are counted
+// per hash, most reported first.
+func testStoreAllowListHits(t *testing.T, s Store) {
+	ctx := context.Background()
+	a := HashBytes([]byte("a"))
+	b := HashBytes([]byte("b"))
+
+	// record three hits of a by two reporters, one of b
+	hits := []AllowListHit{
+		{Hash: b, Reporter: "alice"},
+		{Hash: a, Reporter: "alice"},
+		{Hash: a, Reporter: "bob"},
+		{Hash: a, Reporter: "alice"},
+	}
+	for _, hit := range hits {
+		err := s.RecordAllowListHit(ctx, hit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := s.AllowListHits(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Fatal("unexpected counts", counts)
+	}
+	if counts[0].Hash != a || counts[0].Hits != 3 || counts[0].Reporters != 2 || counts[0].LastHit.IsZero() {
+		t.Fatal("unexpected count", counts[0])
+	}
+	if counts[1].Hash != b || counts[1].Hits != 1 || counts[1].Reporters != 1 {
+		t.Fatal("unexpected count", counts[1])
+	}
+
+	// assert the limit is applied
+	counts, err = s.AllowListHits(ctx, 1)
+	if err != nil || len(counts) != 1 || counts[0].Hash != a {
+		t.Fatal("unexpected counts", counts, err)
+	}
+}
+
+// testStoreIdentities verifies identities can be blocked and unblocked.
+func testStoreIdentities(t *testing.T, s Store) {
+	ctx := context.Background()
+	id := "identity"
+
+	// block it twice, the reason gets updated
+	err := s.BlockIdentity(ctx, id, "spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.BlockIdentity(ctx, id, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := s.BlockedIdentities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].MySkyID != id || identities[0].Reason != "abuse" {
+		t.Fatal("unexpected identities", identities)
+	}
+	blocked, err := s.IsIdentityBlocked(ctx, id)
+	if err != nil || !blocked {
+		t.Fatal("expected identity to be blocked", err)
+	}
+
+	// unblock it twice, the second time it's not found
+	err = s.UnblockIdentity(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UnblockIdentity(ctx, id)
+	if !errors.Contains(err, ErrNoDocumentsFound) {
+		t.Fatal("unexpected error", err)
+	}
+	blocked, err = s.IsIdentityBlocked(ctx, id)
+	if err != nil || blocked {
+		t.Fatal("unexpected blocked identity", err)
+	}
+}
+
+// testStoreUsage verifies the usage of proofs, the reports of MySkyIDs and the
+// latest block timestamps are tracked, and that stale latest block timestamps
+// are pruned.
+func testStoreUsage(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := Now()
+
+	// use a proof
+	proof := HashBytes([]byte("proof"))
+	uses, err := s.IncrementProofUsage(ctx, proof, 1)
+	if err != nil || uses != 1 {
+		t.Fatal("unexpected uses", uses, err)
+	}
+	uses, err = s.IncrementProofUsage(ctx, proof, 2)
+	if err != nil || uses != 3 {
+		t.Fatal("unexpected uses", uses, err)
+	}
+
+	// record reports
+	err = s.RecordReports(ctx, "id", 2, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RecordReports(ctx, "id", 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, oldest, err := s.ReportUsage(ctx, "id", now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 5 || !oldest.Equal(now.Add(-time.Hour)) {
+		t.Fatal("unexpected usage", reports, oldest)
+	}
+	reports, err = s.NumReports(ctx, "id", now.Add(-time.Minute))
+	if err != nil || reports != 3 {
+		t.Fatal("unexpected reports", reports, err)
+	}
+	reports, oldest, err = s.ReportUsage(ctx, "other", time.Time{})
+	if err != nil || reports != 0 || !oldest.IsZero() {
+		t.Fatal("unexpected usage", reports, oldest, err)
+	}
+
+	// store the latest block timestamp
+	_, exists, err := s.LatestBlockTimestamp(ctx, "server")
+	if err != nil || exists {
+		t.Fatal("unexpected timestamp", exists, err)
+	}
+	err = s.UpdateLatestBlockTimestamp(ctx, "server", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, exists, err := s.LatestBlockTimestamp(ctx, "server")
+	if err != nil || !exists || !latest.Equal(now) {
+		t.Fatal("unexpected timestamp", latest, exists, err)
+	}
+
+	// store the timestamp of the server that prunes, then the one of another
+	// server after a while, then prune the timestamps that weren't updated in
+	// between
+	err = s.UpdateLatestBlockTimestamp(ctx, "self", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cutoff := Now()
+	time.Sleep(10 * time.Millisecond)
+	err = s.UpdateLatestBlockTimestamp(ctx, "fresh", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, err := s.LatestBlockTimestamps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 3 || timestamps[0].ServerUID != "fresh" || timestamps[1].ServerUID != "self" || timestamps[2].ServerUID != "server" {
+		t.Fatal("unexpected timestamps", timestamps)
+	}
+	if !timestamps[0].Timestamp.Equal(now) || !timestamps[0].LastUpdated.After(cutoff) || timestamps[2].LastUpdated.After(cutoff) {
+		t.Fatal("unexpected timestamps", timestamps)
+	}
+
+	// assert the stale timestamp got pruned, except the one of the server
+	// that prunes
+	pruned, err := s.PruneLatestBlockTimestamps(ctx, cutoff, "self")
+	if err != nil || pruned != 1 {
+		t.Fatal("unexpected pruned timestamps", pruned, err)
+	}
+	for serverUID, expected := range map[string]bool{
+		"server": false,
+		"fresh":  true,
+		"self":   true,
+	} {
+		_, exists, err = s.LatestBlockTimestamp(ctx, serverUID)
+		if err != nil || exists != expected {
+			t.Fatal("unexpected timestamp", serverUID, exists, err)
+		}
+	}
+}
+
+// testStoreReporterStats verifies the reports are counted by reporter and tag,
+// along with the fraction of them that turned out to be bogus.
+func testStoreReporterStats(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := Now()
+
+	// seed the reports of a reporter that files bogus phishing reports, two
+	// of them are invalid and one got reverted, and those of a reporter that
+	// doesn't, reports without a sub are not counted
+	seed := []struct {
+		name     string
+		sub      string
+		source   string
+		added    time.Time
+		tags     []string
+		reverted []string
+		invalid  bool
+	}{
+		{"m1", "mallory", SourcePoW, now.Add(-4 * time.Hour), []string{"phishing"}, nil, true},
+		{"m2", "mallory", SourcePoW, now.Add(-3 * time.Hour), []string{"phishing"}, nil, true},
+		{"m3", "mallory", SourcePoW, now.Add(-time.Hour), nil, []string{"phishing"}, false},
+		{"m4", "mallory", SourcePoW, now, []string{"phishing"}, nil, false},
+		{"a1", "alice", SourceAPI, now, []string{"malware", "phishing"}, nil, false},
+		{"n1", "", SourcePoW, now, []string{"phishing"}, nil, true},
+		{"old", "mallory", SourcePoW, now.Add(-48 * time.Hour), []string{"phishing"}, nil, true},
+	}
+	for _, r := range seed {
+		bsl := storeSkylink(r.name, r.added, r.tags...)
+		bsl.Reporter.Sub = r.sub
+		bsl.Source = r.source
+		bsl.RevertedTags = r.reverted
+		bsl.Reverted = len(r.tags) == 0
+		bsl.Invalid = r.invalid
+		err := s.CreateBlockedSkylink(ctx, &bsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := s.ReporterStats(ctx, now.Add(-24*time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ReporterTagStats{
+		{Reporter: "alice", Tag: "malware", Reports: 1},
+		{Reporter: "alice", Tag: "phishing", Reports: 1},
+		{Reporter: "mallory", Tag: "phishing", Reports: 4, Invalid: 2, Reverted: 1, Bogus: 3, MedianInterval: time.Hour},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if ratio := stats[2].BogusRatio(); ratio != 0.75 {
+		t.Fatal("unexpected ratio", ratio)
+	}
+	thresholds := SuspicionThresholds{MinReports: 4, BogusRatio: 0.5}
+	if !thresholds.Suspicious(stats[2]) || thresholds.Suspicious(stats[1]) {
+		t.Fatal("unexpected suspicion")
+	}
+
+	// assert the stats can be limited to a source
+	stats, err = s.ReporterStats(ctx, now.Add(-24*time.Hour), SourceAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Reporter != "alice" || stats[1].Reporter != "alice" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// storeSkylink returns a blocked skylink with the hash of the given name.
+func storeSkylink(name string, added time.Time, tags ...string) BlockedSkylink {
+	return BlockedSkylink{
+		Hash:           HashBytes([]byte(name)),
+		Reporter:       Reporter{Name: name},
+		Tags:           tags,
+		TimestampAdded: added,
+	}
+}
+
+// assertHashes fails the test if the given hashes aren't the expected ones,
+// regardless of their order.
+func assertHashes(t *testing.T, hashes []Hash, expected ...Hash) {
+	t.Helper()
+	if len(hashes) != len(expected) {
+		t.Fatalf("unexpected hashes %v, expected %v", hashes, expected)
+	}
+	for _, hash := range expected {
+		var found bool
+		for _, h := range hashes {
+			found = found || h == hash
+		}
+		if !found {
+			t.Fatalf("unexpected hashes %v, expected %v", hashes, expected)
+		}
+	}
+}
+
+// assertSkylinks fails the test if the given page of skylinks doesn't hold the
+// skylinks with the expected hashes, in order.
+func assertSkylinks(t *testing.T, docs []BlockedSkylink, more, expectedMore bool, expected ...Hash) {
+	t.Helper()
+	if more != expectedMore {
+		t.Fatalf("unexpected more %v", more)
+	}
+	if len(docs) != len(expected) {
+		t.Fatalf("unexpected number of skylinks %v, expected %v", len(docs), len(expected))
+	}
+	for i, doc := range docs {
+		if doc.Hash != expected[i] {
+			t.Fatalf("unexpected skylink at index %v", i)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MaxTags is the maximum number of tags a report can carry.
+	MaxTags = 20
+
+	// MaxTagLength is the maximum length of a tag in characters, after it
+	// got normalized.
+	MaxTagLength = 64
+)
+
+// NormalizeTag returns the normalized form of the given tag. It's trimmed and
+// lowercased and its internal whitespace is collapsed into single dashes, e.g.
+// ' Child  Abuse ' becomes 'child-abuse'. Tags that only consist of whitespace
+// normalize to the empty string.
+func NormalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// NormalizeTags returns the normalized form of the given tags, see
+// NormalizeTag. Empty tags are dropped and duplicates are removed, preserving
+// the order of the tags. It never returns nil.
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	return uniqueTags(normalized)
+}
+
+// ValidateTags returns an error if the given normalized tags exceed the maximum
+// number of tags, or if one of them exceeds the maximum tag length.
+func ValidateTags(tags []string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("a report can carry at most %d tags", MaxTags)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > MaxTagLength {
+			return fmt.Errorf("tag '%s' exceeds %d characters", tag, MaxTagLength)
+		}
+	}
+	return nil
+}
+
+// NormalizeTags normalizes the tags of all blocked skylinks that were inserted
+// before tags got normalized on insert, see NormalizeTag. Existing tags are
+// never dropped for exceeding the limits enforced on new reports. The
+// documents are paged by their id and updated in batches, it returns the
+// number of updated documents.
+func (db *DB) NormalizeTags(ctx context.Context) (int, error) {
+	filter := bson.M{"tags.0": bson.M{"$exists": true}}
+
+	var updated int
+	var lastID primitive.ObjectID
+	for {
+		// fetch the next batch
+		opts := options.Find()
+		opts.SetProjection(bson.M{"_id": 1, "tags": 1})
+		opts.SetSort(bson.M{"_id": 1})
+		opts.SetLimit(migrationBatchSize)
+		batchFilter := bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": lastID}}}}
+		c, err := db.staticSkylinks.Find(ctx, batchFilter, opts)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to find tagged skylinks")
+		}
+		var docs []BlockedSkylink
+		err = c.All(ctx, &docs)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to decode tagged skylinks")
+		}
+		if len(docs) == 0 {
+			return updated, nil
+		}
+		lastID = docs[len(docs)-1].ID
+
+		// normalize the batch, only the documents of which the tags change
+		// get updated
+		var models []mongo.WriteModel
+		for _, doc := range docs {
+			tags := NormalizeTags(doc.Tags)
+			if tagsEqual(tags, doc.Tags) {
+				continue
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": doc.ID}).
+				SetUpdate(bson.M{"$set": bson.M{"tags": tags}}))
+		}
+		if len(models) == 0 {
+			continue
+		}
+		res, err := db.staticSkylinks.BulkWrite(ctx, models)
+		if err != nil {
+			return updated, errors.AddContext(err, "failed to normalize tags")
+		}
+		updated += int(res.ModifiedCount)
+	}
+}
+
+// tagsEqual returns whether the given tags are equal, including their order.
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestNormalizeTags is a unit test for NormalizeTags.
+func TestNormalizeTags(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		tags       []string
+		normalized []string
+	}{
+		{"Nil", nil, []string{}},
+		{"Normalized", []string{"phishing", "malware"}, []string{"phishing", "malware"}},
+		{"Case", []string{"Phishing", "PHISHING", "phishing"}, []string{"phishing"}},
+		{"Trim", []string{" phishing", "phishing \t"}, []string{"phishing"}},
+		{"InternalWhitespace", []string{"Child  Abuse", "child\tabuse", "child abuse "}, []string{"child-abuse"}},
+		{"Empty", []string{"", " ", "\n", "malware"}, []string{"malware"}},
+		{"Order", []string{"malware", "Phishing", "MALWARE"}, []string{"malware", "phishing"}},
+		{"Unicode", []string{"ÉCOLE"}, []string{"école"}},
+	}
+	for _, test := range tests {
+		normalized := NormalizeTags(test.tags)
+		if !reflect.DeepEqual(normalized, test.normalized) {
+			t.Fatalf("%v: unexpected tags %v != %v", test.name, normalized, test.normalized)
+		}
+	}
+}
+
+// TestValidateTags is a unit test for ValidateTags.
+func TestValidateTags(t *testing.T) {
+	t.Parallel()
+
+	var tooManyTags []string
+	for i := 0; i <= MaxTags; i++ {
+		tooManyTags = append(tooManyTags, fmt.Sprint(i))
+	}
+	tests := []struct {
+		name  string
+		tags  []string
+		valid bool
+	}{
+		{"Nil", nil, true},
+		{"Valid", []string{"phishing", "malware"}, true},
+		{"MaxLength", []string{strings.Repeat("a", MaxTagLength)}, true},
+		{"MaxLengthMultiByte", []string{strings.Repeat("é", MaxTagLength)}, true},
+		{"TooLong", []string{strings.Repeat("a", MaxTagLength+1)}, false},
+		{"MaxTags", tooManyTags[:MaxTags], true},
+		{"TooManyTags", tooManyTags, false},
+	}
+	for _, test := range tests {
+		err := ValidateTags(test.tags)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// TestNormalizeTagsMigration verifies the tags of documents inserted before
+// tags got normalized are normalized, and that normalizing them again is a
+// no-op.
+func TestNormalizeTagsMigration(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+	defer cancel()
+
+	// create test database
+	db := NewTestDB(ctx, t.Name(), WithCleanup(t))
+
+	// seed the collection with dirty tags, bypassing the normalization on
+	// insert, and make sure it spans more than one batch
+	long := strings.Repeat("A", MaxTagLength+1)
+	seeded := []struct {
+		tags       bson.A
+		normalized []string
+	}{
+		{bson.A{"Phishing", "phishing ", "PHISHING"}, []string{"phishing"}},
+		{bson.A{"Child  Abuse", "malware"}, []string{"child-abuse", "malware"}},
+		{bson.A{" ", "malware"}, []string{"malware"}},
+		{bson.A{long}, []string{strings.ToLower(long)}},
+		{bson.A{"malware"}, []string{"malware"}},
+		{nil, nil},
+	}
+	for i, doc := range seeded {
+		_, err := db.staticSkylinks.InsertOne(ctx, bson.M{
+			"hash":            HashBytes([]byte(fmt.Sprint(i))),
+			"namespace":       DefaultNamespace,
+			"tags":            doc.tags,
+			"timestamp_added": Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var clean []interface{}
+	for i := 0; i < migrationBatchSize; i++ {
+		clean = append(clean, bson.M{
+			"hash":            HashBytes([]byte(fmt.Sprintf("clean_%d", i))),
+			"namespace":       DefaultNamespace,
+			"tags":            bson.A{"malware"},
+			"timestamp_added": Now(),
+		})
+	}
+	_, err := db.staticSkylinks.InsertMany(ctx, clean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.staticSkylinks.InsertOne(ctx, bson.M{
+		"hash":            HashBytes([]byte("last")),
+		"namespace":       DefaultNamespace,
+		"tags":            bson.A{"Last Batch"},
+		"timestamp_added": Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// normalize the tags, assert only the dirty documents got updated
+	updated, err := db.NormalizeTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 5 {
+		t.Fatalf("unexpected number of updates, %v != 5", updated)
+	}
+
+	// assert normalizing again is a no-op
+	updated, err = db.NormalizeTags(ctx)
+	if err != nil || updated != 0 {
+		t.Fatal("unexpected", updated, err)
+	}
+
+	// assert the tags got normalized
+	for i, doc := range seeded {
+		bsl, err := db.FindByHash(ctx, HashBytes([]byte(fmt.Sprint(i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bsl.Tags) != len(doc.normalized) || (len(doc.normalized) > 0 && !reflect.DeepEqual(bsl.Tags, doc.normalized)) {
+			t.Fatalf("%v: unexpected tags %v != %v", i, bsl.Tags, doc.normalized)
+		}
+	}
+	bsl, err := db.FindByHash(ctx, HashBytes([]byte("last")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bsl.Tags, []string{"last-batch"}) {
+		t.Fatal("unexpected tags", bsl.Tags)
+	}
+}
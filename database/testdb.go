@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// envMongoTestURI is the environment variable that overrides the
+	// connection string used for the test database.
+	envMongoTestURI = "MONGODB_TEST_URI"
+
+	// envMongoTestUsername is the environment variable that overrides the
+	// username used for the test database.
+	envMongoTestUsername = "MONGODB_TEST_USER"
+
+	// envMongoTestPassword is the environment variable that overrides the
+	// password used for the test database.
+	envMongoTestPassword = "MONGODB_TEST_PASSWORD"
+
+	// mongoTestUsername is the default username used for the test database.
+	mongoTestUsername = "admin"
+
+	// mongoTestPassword is the default password used for the test database.
+	mongoTestPassword = "aO4tV5tC1oU3oQ7u" // #nosec G101
+
+	// mongoTestConnString is the default connection string used for the test
+	// database.
+	mongoTestConnString = "mongodb://localhost:37017"
+)
+
+type (
+	// TestCleaner is the interface that allows NewTestDB to register a
+	// cleanup function, it is implemented by *testing.T and *testing.B.
+	TestCleaner interface {
+		Cleanup(func())
+	}
+
+	// TestDBOption is an option that can be passed to NewTestDB.
+	TestDBOption func(*testDBOptions)
+
+	// testDBOptions are the options used by NewTestDB.
+	testDBOptions struct {
+		cleaner   TestCleaner
+		logger    *logrus.Entry
+		namespace string
+	}
+)
+
+// WithCleanup registers a cleanup on the given test that drops the test
+// database and closes the connection to it once the test finishes.
+func WithCleanup(tc TestCleaner) TestDBOption {
+	return func(opts *testDBOptions) {
+		opts.cleaner = tc
+	}
+}
+
+// WithTestLogger sets the logger used by the test database, by default all
+// logs are discarded.
+func WithTestLogger(logger *logrus.Entry) TestDBOption {
+	return func(opts *testDBOptions) {
+		opts.logger = logger
+	}
+}
+
+// WithTestNamespace sets the namespace of the test database. Test databases
+// with the same name but another namespace share their collections, note that
+// every call to NewTestDB purges all namespaces.
+func WithTestNamespace(namespace string) TestDBOption {
+	return func(opts *testDBOptions) {
+		opts.namespace = namespace
+	}
+}
+
+// NewTestDB returns a test database with the given name, the database gets
+// purged and on error we panic. Slashes in the name are replaced with
+// underscores so callers can easily pass t.Name().
+//
+// The database connects to 'mongodb://localhost:37017' with the credentials
+// used by our test setup, they can be overridden by setting the
+// MONGODB_TEST_URI, MONGODB_TEST_USER and MONGODB_TEST_PASSWORD environment
+// variables.
+func NewTestDB(ctx context.Context, dbName string, opts ...TestDBOption) *DB {
+	// apply the options
+	var o testDBOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger == nil {
+		logger := logrus.New()
+		logger.Out = ioutil.Discard
+		o.logger = logrus.NewEntry(logger)
+	}
+	var dbOpts []Option
+	if o.namespace != "" {
+		dbOpts = append(dbOpts, WithNamespace(o.namespace))
+	}
+
+	// create the database
+	uri, creds := TestDBConnection()
+	dbName = strings.Replace(dbName, "/", "_", -1)
+	db, err := NewCustomDB(ctx, uri, dbName, creds, o.logger, dbOpts...)
+	if err != nil {
+		panic(err)
+	}
+
+	// create a context with timeout and purge the database
+	purgeCtx, cancel := context.WithTimeout(ctx, MongoDefaultTimeout)
+	defer cancel()
+	err = db.Purge(purgeCtx)
+	if err != nil {
+		panic(err)
+	}
+
+	// register the cleanup
+	if o.cleaner != nil {
+		o.cleaner.Cleanup(func() {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), MongoDefaultTimeout)
+			defer cancel()
+
+			// the test might have closed the database, so we drop it using
+			// a new connection
+			err := dropTestDB(cleanupCtx, uri, dbName, creds)
+			if err != nil {
+				o.logger.Errorf("failed to drop test database '%v', err: %v", dbName, err)
+			}
+			err = db.Close(cleanupCtx)
+			if err != nil && err != mongo.ErrClientDisconnected {
+				o.logger.Errorf("failed to close test database '%v', err: %v", dbName, err)
+			}
+		})
+	}
+	return db
+}
+
+// dropTestDB connects to the database with the given name and drops it.
+func dropTestDB(ctx context.Context, uri, dbName string, creds options.Credential) (err error) {
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetAuth(creds))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Compose(err, c.Disconnect(ctx))
+	}()
+	return c.Database(dbName).Drop(ctx)
+}
+
+// TestDBConnection returns the connection string and credentials used to
+// connect to the test database, it allows tests of other packages to connect
+// to it through their own config.
+func TestDBConnection() (string, options.Credential) {
+	uri := mongoTestConnString
+	if v, ok := os.LookupEnv(envMongoTestURI); ok && v != "" {
+		uri = v
+	}
+	creds := options.Credential{
+		Username: mongoTestUsername,
+		Password: mongoTestPassword,
+	}
+	if v, ok := os.LookupEnv(envMongoTestUsername); ok {
+		creds.Username = v
+	}
+	if v, ok := os.LookupEnv(envMongoTestPassword); ok {
+		creds.Password = v
+	}
+	return uri, creds
+}
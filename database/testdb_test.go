@@ -0,0 +1,33 @@
+package database
+
+import (
+	"testing"
+)
+
+// TestTestDBConnection verifies the test database connection defaults can be
+// overridden through the environment.
+func TestTestDBConnection(t *testing.T) {
+	// assert the defaults
+	t.Setenv(envMongoTestURI, "")
+	t.Setenv(envMongoTestUsername, mongoTestUsername)
+	t.Setenv(envMongoTestPassword, mongoTestPassword)
+	uri, creds := TestDBConnection()
+	if uri != mongoTestConnString {
+		t.Fatal("unexpected uri", uri)
+	}
+	if creds.Username != mongoTestUsername || creds.Password != mongoTestPassword {
+		t.Fatal("unexpected credentials", creds)
+	}
+
+	// assert the overrides
+	t.Setenv(envMongoTestURI, "mongodb://mongo:27017")
+	t.Setenv(envMongoTestUsername, "user")
+	t.Setenv(envMongoTestPassword, "pass")
+	uri, creds = TestDBConnection()
+	if uri != "mongodb://mongo:27017" {
+		t.Fatal("unexpected uri", uri)
+	}
+	if creds.Username != "user" || creds.Password != "pass" {
+		t.Fatal("unexpected credentials", creds)
+	}
+}
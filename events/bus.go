@@ -0,0 +1,279 @@
+// Package events implements the in-process event bus of the blocker. The API,
+// the blocker and the syncer publish what happens to the hashes they handle,
+// components that react to that, like the pusher or the alerts, subscribe to
+// the bus rather than being wired into the code paths that insert or block
+// hashes.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// BlockCreated is published when skylinks got reported or synced and
+	// were inserted into the database.
+	BlockCreated Type = "block_created"
+
+	// BlockConfirmed is published when hashes were blocked by skyd and
+	// marked as succeeded.
+	BlockConfirmed Type = "block_confirmed"
+
+	// BlockFailed is published when hashes failed to get blocked and were
+	// marked as failed.
+	BlockFailed Type = "block_failed"
+
+	// BlockReverted is published when all tags of a skylink got reverted,
+	// after which it gets unblocked.
+	BlockReverted Type = "block_reverted"
+
+	// BlockDeleted is published when a skylink got soft-deleted, after which
+	// it gets unblocked if skyd blocked it already.
+	BlockDeleted Type = "block_deleted"
+
+	// BlockInvalid is published when skyd rejected hashes as invalid and
+	// they were marked as such.
+	BlockInvalid Type = "block_invalid"
+)
+
+const (
+	// PublisherAPI is the publisher of events that originate from requests
+	// to the API.
+	PublisherAPI = "api"
+
+	// PublisherBlocker is the publisher of events that originate from the
+	// blocker sending hashes to skyd.
+	PublisherBlocker = "blocker"
+
+	// PublisherSyncer is the publisher of events that originate from
+	// syncing the blocklists of other portals.
+	PublisherSyncer = "syncer"
+)
+
+const (
+	// DefaultBufferSize is the default number of events that are buffered
+	// per subscriber, when the buffer is full new events are dropped.
+	DefaultBufferSize = 1000
+)
+
+var (
+	// ErrBusClosed is returned when subscribing to a bus that was closed.
+	ErrBusClosed = errors.New("event bus is closed")
+)
+
+type (
+	// Type is the type of an event.
+	Type string
+
+	// Event describes something that happened to a set of hashes. Events are
+	// shared between subscribers, so they mustn't be modified.
+	Event struct {
+		Type      Type
+		Publisher string
+		Hashes    []database.Hash
+
+		// Skylinks holds the skylinks that were inserted, it's only set on
+		// BlockCreated events.
+		Skylinks []database.BlockedSkylink
+
+		// Reason holds the reason hashes failed to get blocked, it's only
+		// set on BlockFailed events.
+		Reason string
+
+		Timestamp time.Time
+	}
+
+	// Bus fans out published events to its subscribers. Publishing never
+	// blocks, every subscriber has a bounded buffer and events that don't fit
+	// in it are dropped and counted, so a slow consumer can't hold up the
+	// code paths that publish.
+	Bus struct {
+		closed      bool
+		published   uint64
+		subscribers []*Subscription
+
+		staticMu        sync.Mutex
+		staticWaitGroup sync.WaitGroup
+	}
+
+	// Subscription receives the events of the types it subscribed to, in the
+	// order they were published.
+	Subscription struct {
+		// delivered and dropped are guarded by the mutex of the bus.
+		delivered uint64
+		dropped   uint64
+
+		staticC     chan Event
+		staticName  string
+		staticTypes map[Type]struct{}
+	}
+
+	// Status is a snapshot of the state of the bus.
+	Status struct {
+		Published   uint64             `json:"published"`
+		Subscribers []SubscriberStatus `json:"subscribers"`
+	}
+
+	// SubscriberStatus is a snapshot of the state of a subscriber.
+	SubscriberStatus struct {
+		Name      string `json:"name"`
+		Buffered  int    `json:"buffered"`
+		Capacity  int    `json:"capacity"`
+		Delivered uint64 `json:"delivered"`
+		Dropped   uint64 `json:"dropped"`
+	}
+)
+
+// NewBus returns a new event bus.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers a subscriber under the given name, which receives the
+// events of the given types, or all events if no types are given. Up to
+// bufferSize events are buffered, when the buffer is full new events are
+// dropped. The subscription's channel is closed when the bus is closed.
+func (b *Bus) Subscribe(name string, bufferSize int, types ...Type) (*Subscription, error) {
+	if bufferSize <= 0 {
+		return nil, errors.New("buffer size has to be positive")
+	}
+
+	b.staticMu.Lock()
+	defer b.staticMu.Unlock()
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	for _, sub := range b.subscribers {
+		if sub.staticName == name {
+			return nil, errors.New("a subscriber with that name exists already")
+		}
+	}
+
+	sub := &Subscription{
+		staticC:    make(chan Event, bufferSize),
+		staticName: name,
+	}
+	if len(types) > 0 {
+		sub.staticTypes = make(map[Type]struct{}, len(types))
+		for _, t := range types {
+			sub.staticTypes[t] = struct{}{}
+		}
+	}
+	b.subscribers = append(b.subscribers, sub)
+	return sub, nil
+}
+
+// Handle subscribes under the given name and calls the given function for
+// every event it receives, on a goroutine of its own. Close waits for the
+// function to handle the events that were buffered when the bus got closed.
+func (b *Bus) Handle(name string, bufferSize int, fn func(Event), types ...Type) error {
+	sub, err := b.Subscribe(name, bufferSize, types...)
+	if err != nil {
+		return err
+	}
+	b.staticWaitGroup.Add(1)
+	go func() {
+		defer b.staticWaitGroup.Done()
+		for e := range sub.Events() {
+			fn(e)
+		}
+	}()
+	return nil
+}
+
+// Publish hands the given event to every subscriber of its type without
+// blocking, the event is dropped for subscribers whose buffer is full. The
+// event's timestamp is set if it's zero. Publishing on a nil or closed bus is
+// a no-op, which lets components publish regardless of whether a bus was
+// configured.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	b.staticMu.Lock()
+	defer b.staticMu.Unlock()
+	if b.closed {
+		return
+	}
+	b.published++
+	for _, sub := range b.subscribers {
+		if !sub.wants(e.Type) {
+			continue
+		}
+		select {
+		case sub.staticC <- e:
+			sub.delivered++
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Close closes the channels of all subscribers and waits for the handlers
+// registered through Handle to return. Events published after the bus got
+// closed are discarded.
+func (b *Bus) Close() {
+	b.staticMu.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, sub := range b.subscribers {
+			close(sub.staticC)
+		}
+	}
+	b.staticMu.Unlock()
+	b.staticWaitGroup.Wait()
+}
+
+// Dropped returns the number of events that were dropped across all
+// subscribers.
+func (b *Bus) Dropped() uint64 {
+	b.staticMu.Lock()
+	defer b.staticMu.Unlock()
+	var dropped uint64
+	for _, sub := range b.subscribers {
+		dropped += sub.dropped
+	}
+	return dropped
+}
+
+// Status returns a snapshot of the state of the bus.
+func (b *Bus) Status() Status {
+	b.staticMu.Lock()
+	defer b.staticMu.Unlock()
+	status := Status{
+		Published:   b.published,
+		Subscribers: make([]SubscriberStatus, 0, len(b.subscribers)),
+	}
+	for _, sub := range b.subscribers {
+		status.Subscribers = append(status.Subscribers, SubscriberStatus{
+			Name:      sub.staticName,
+			Buffered:  len(sub.staticC),
+			Capacity:  cap(sub.staticC),
+			Delivered: sub.delivered,
+			Dropped:   sub.dropped,
+		})
+	}
+	return status
+}
+
+// Events returns the channel the subscriber receives its events on.
+func (s *Subscription) Events() <-chan Event {
+	return s.staticC
+}
+
+// wants returns whether the subscriber subscribed to events of the given
+// type.
+func (s *Subscription) wants(t Type) bool {
+	if s.staticTypes == nil {
+		return true
+	}
+	_, exists := s.staticTypes[t]
+	return exists
+}
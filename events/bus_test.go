@@ -0,0 +1,249 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/database"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.sia.tech/siad/crypto"
+)
+
+// TestBus runs the unit tests of the event bus.
+func TestBus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{name: "Ordering", test: testBusOrdering},
+		{name: "Isolation", test: testBusIsolation},
+		{name: "Backpressure", test: testBusBackpressure},
+		{name: "Close", test: testBusClose},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.test)
+	}
+}
+
+// testBusOrdering verifies a subscriber receives its events in the order they
+// were published, across publishers.
+func testBusOrdering(t *testing.T) {
+	bus := NewBus()
+	sub, err := bus.Subscribe("ordered", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// publish events of all types, alternating the publishers
+	hashes := randomHashes(50)
+	types := []Type{BlockCreated, BlockConfirmed, BlockFailed, BlockReverted, BlockInvalid}
+	publishers := []string{PublisherAPI, PublisherBlocker, PublisherSyncer}
+	for i, hash := range hashes {
+		bus.Publish(Event{
+			Type:      types[i%len(types)],
+			Publisher: publishers[i%len(publishers)],
+			Hashes:    []database.Hash{hash},
+		})
+	}
+
+	// assert they were received in order
+	for i, hash := range hashes {
+		e := <-sub.Events()
+		if e.Type != types[i%len(types)] || e.Hashes[0] != hash {
+			t.Fatalf("unexpected event at %v: %+v", i, e)
+		}
+		if e.Timestamp.IsZero() {
+			t.Fatal("expected the timestamp to be set")
+		}
+	}
+	select {
+	case e := <-sub.Events():
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+// testBusIsolation verifies subscribers only receive the types they subscribed
+// to and that a subscriber that doesn't consume its events doesn't affect the
+// others.
+func testBusIsolation(t *testing.T) {
+	bus := NewBus()
+
+	// a subscriber that never consumes its events
+	stuck, err := bus.Subscribe("stuck", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a subscriber of failures only
+	failures, err := bus.Subscribe("failures", 10, BlockFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a subscriber that consumes all its events through a handler
+	received := make(chan Event, 10)
+	err = bus.Handle("handler", 10, func(e Event) { received <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert names are unique and buffers are bounded
+	_, err = bus.Subscribe("stuck", 1)
+	if err == nil {
+		t.Fatal("expected duplicate name to be rejected")
+	}
+	_, err = bus.Subscribe("unbuffered", 0)
+	if err == nil {
+		t.Fatal("expected zero buffer size to be rejected")
+	}
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: BlockCreated, Publisher: PublisherAPI})
+	}
+	bus.Publish(Event{Type: BlockFailed, Publisher: PublisherBlocker, Reason: "skyd unreachable"})
+
+	// assert the handler received every event despite the stuck subscriber
+	for i := 0; i < 6; i++ {
+		select {
+		case e := <-received:
+			if i == 5 && e.Type != BlockFailed {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("handler didn't receive the event")
+		}
+	}
+
+	// assert the subscriber of failures only received the failure
+	if len(failures.Events()) != 1 {
+		t.Fatalf("unexpected number of failures %v", len(failures.Events()))
+	}
+	if e := <-failures.Events(); e.Reason != "skyd unreachable" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// assert only the stuck subscriber dropped events
+	if len(stuck.Events()) != 1 {
+		t.Fatalf("unexpected number of buffered events %v", len(stuck.Events()))
+	}
+	status := bus.Status()
+	if status.Published != 6 {
+		t.Fatalf("unexpected number of published events %v", status.Published)
+	}
+	for _, s := range status.Subscribers {
+		var expected uint64
+		if s.Name == "stuck" {
+			expected = 5
+		}
+		if s.Dropped != expected {
+			t.Fatalf("unexpected number of dropped events for %v, %v != %v", s.Name, s.Dropped, expected)
+		}
+	}
+	bus.Close()
+}
+
+// testBusBackpressure verifies events that don't fit in a subscriber's buffer
+// are dropped and counted, without blocking the publisher.
+func testBusBackpressure(t *testing.T) {
+	bus := NewBus()
+	sub, err := bus.Subscribe("slow", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// publish more events than fit in the buffer, this would block forever
+	// if publishing blocked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 25; i++ {
+			bus.Publish(Event{Type: BlockConfirmed, Reason: fmt.Sprint(i)})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("publish blocked")
+	}
+
+	// assert the overflow was dropped and accounted for
+	if bus.Dropped() != 15 {
+		t.Fatalf("unexpected number of dropped events %v", bus.Dropped())
+	}
+	status := bus.Status()
+	if len(status.Subscribers) != 1 {
+		t.Fatalf("unexpected subscribers %+v", status.Subscribers)
+	}
+	s := status.Subscribers[0]
+	if s.Delivered != 10 || s.Dropped != 15 || s.Buffered != 10 || s.Capacity != 10 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+
+	// assert the oldest events were kept, once drained new events are
+	// delivered again
+	for i := 0; i < 10; i++ {
+		if e := <-sub.Events(); e.Reason != fmt.Sprint(i) {
+			t.Fatalf("unexpected event at %v: %+v", i, e)
+		}
+	}
+	bus.Publish(Event{Type: BlockConfirmed, Reason: "after"})
+	if e := <-sub.Events(); e.Reason != "after" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if bus.Dropped() != 15 {
+		t.Fatalf("unexpected number of dropped events %v", bus.Dropped())
+	}
+}
+
+// testBusClose verifies closing the bus drains the handlers and that the bus
+// is inert afterwards.
+func testBusClose(t *testing.T) {
+	// assert publishing on a nil bus is a no-op
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: BlockCreated})
+
+	bus := NewBus()
+	var handled int
+	err := bus.Handle("handler", 10, func(Event) {
+		time.Sleep(10 * time.Millisecond)
+		handled++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: BlockInvalid})
+	}
+
+	// assert close waits for the buffered events to be handled
+	bus.Close()
+	if handled != 5 {
+		t.Fatalf("unexpected number of handled events %v", handled)
+	}
+
+	// assert the bus is inert
+	bus.Publish(Event{Type: BlockInvalid})
+	if bus.Status().Published != 5 {
+		t.Fatal("expected events published after close to be discarded")
+	}
+	_, err = bus.Subscribe("late", 1)
+	if err != ErrBusClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bus.Close()
+}
+
+// randomHashes returns n random hashes.
+func randomHashes(n int) []database.Hash {
+	hashes := make([]database.Hash, n)
+	for i := range hashes {
+		var h crypto.Hash
+		fastrand.Read(h[:])
+		hashes[i] = database.Hash{Hash: h}
+	}
+	return hashes
+}
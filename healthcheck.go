@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/blocker/config"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// healthcheckTimeout is the maximum amount of time the healthcheck is
+	// allowed to take.
+	healthcheckTimeout = 2 * time.Second
+
+	// maxHealthBodySize is the maximum size of the health response body we
+	// read.
+	maxHealthBodySize = 1 << 16 // 64kib
+)
+
+// healthcheck checks the health of the blocker running locally and returns the
+// exit code of the process. It only loads the config to figure out where the
+// blocker is listening, it doesn't connect to the database or skyd.
+func healthcheck() int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+	err = checkHealth(ctx, healthcheckClient(cfg), healthcheckURL(cfg))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// checkHealth performs a GET request against the given health endpoint and
+// returns an error, containing the response body, if the blocker is not
+// healthy.
+func checkHealth(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.AddContext(err, "failed to create health request")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "failed to reach the blocker")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHealthBodySize))
+	if err != nil {
+		return errors.AddContext(err, "failed to read health response")
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unhealthy, status %d, body %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var status struct {
+		DBAlive bool `json:"dbAlive"`
+	}
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		return fmt.Errorf("failed to parse health response, body %s", strings.TrimSpace(string(body)))
+	}
+	if !status.DBAlive {
+		return fmt.Errorf("unhealthy, body %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// healthcheckClient returns the client used to perform the healthcheck.
+func healthcheckClient(cfg config.Config) *http.Client {
+	client := &http.Client{Timeout: healthcheckTimeout}
+	if cfg.TLSCertFile != "" {
+		// The certificate is issued for the public hostname of the blocker
+		// rather than for the local address we probe, since we only check
+		// whether the blocker is alive we skip verifying it.
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return client
+}
+
+// healthcheckURL returns the url of the health endpoint of the blocker running
+// locally, based on the address it's configured to listen on.
+func healthcheckURL(cfg config.Config) string {
+	scheme := "http"
+	if cfg.TLSCertFile != "" {
+		scheme = "https"
+	}
+
+	// NOTE: the listen address was validated when loading the config
+	host, port, _ := net.SplitHostPort(cfg.ListenAddr)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s/health", scheme, net.JoinHostPort(host, port))
+}
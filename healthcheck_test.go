@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/config"
+)
+
+// TestCheckHealth verifies the healthcheck against a mocked health endpoint.
+func TestCheckHealth(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		errMsg string
+	}{
+		{"Healthy", http.StatusOK, `{"dbAlive":true}`, ""},
+		{"DBDown", http.StatusOK, `{"dbAlive":false}`, `unhealthy, body {"dbAlive":false}`},
+		{"BadStatus", http.StatusInternalServerError, `{"message":"oops"}`, `unhealthy, status 500, body {"message":"oops"}`},
+		{"BadBody", http.StatusOK, `not json`, "failed to parse health response, body not json"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(test.status)
+				fmt.Fprintln(w, test.body)
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := checkHealth(ctx, server.Client(), server.URL+"/health")
+			if test.errMsg == "" && err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if test.errMsg != "" && (err == nil || !strings.Contains(err.Error(), test.errMsg)) {
+				t.Fatalf("expected error '%v', got '%v'", test.errMsg, err)
+			}
+		})
+	}
+
+	// assert the healthcheck fails if the blocker is unreachable
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL + "/health"
+	server.Close()
+	err := checkHealth(context.Background(), http.DefaultClient, url)
+	if err == nil || !strings.Contains(err.Error(), "failed to reach the blocker") {
+		t.Fatal("unexpected outcome", err)
+	}
+}
+
+// TestHealthcheckURL is a unit test for the healthcheckURL helper.
+func TestHealthcheckURL(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		listenAddr string
+		tls        bool
+		url        string
+	}{
+		{":4000", false, "http://localhost:4000/health"},
+		{"0.0.0.0:4000", false, "http://localhost:4000/health"},
+		{"[::]:4000", false, "http://localhost:4000/health"},
+		{"127.0.0.1:4001", false, "http://127.0.0.1:4001/health"},
+		{"blocker:4000", true, "https://blocker:4000/health"},
+	}
+	for _, c := range cases {
+		cfg := config.Config{ListenAddr: c.listenAddr}
+		if c.tls {
+			cfg.TLSCertFile = "cert.pem"
+			cfg.TLSKeyFile = "key.pem"
+		}
+		if url := healthcheckURL(cfg); url != c.url {
+			t.Fatalf("unexpected url for %v, %v != %v", c.listenAddr, url, c.url)
+		}
+	}
+}
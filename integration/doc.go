@@ -0,0 +1,7 @@
+// Package integration holds the end-to-end tests of the blocker. They wire a
+// real database, the API, the blocker and the syncer together with mocked skyd
+// and portal servers, and exercise the full pipeline from a report, or a
+// synced portal blocklist, up until the hash got blocked by skyd.
+//
+// Like all tests that require a database, they are skipped in short mode.
+package integration
@@ -0,0 +1,528 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/blocker"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/syncer"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+)
+
+const (
+	// testBlockInterval and testRetryInterval are the intervals of the
+	// blocker's loops, they are a lot lower than the defaults to keep the
+	// tests fast.
+	testBlockInterval = 50 * time.Millisecond
+	testRetryInterval = 200 * time.Millisecond
+
+	// testSyncInterval is the interval of the syncer's loop.
+	testSyncInterval = 200 * time.Millisecond
+)
+
+type (
+	// tester wires a database, the API, the blocker and the syncer together
+	// with a mocked skyd.
+	tester struct {
+		staticAPI  *httptest.Server
+		staticDB   *database.DB
+		staticSkyd *mockSkyd
+	}
+
+	// mockSkyd mocks skyd's blocklist endpoints, it keeps track of the number
+	// of times every hash got blocked and fails requests that contain a hash
+	// that's marked as failing.
+	mockSkyd struct {
+		blocked map[crypto.Hash]int
+		failing map[crypto.Hash]struct{}
+
+		staticMu sync.Mutex
+	}
+
+	// mockPortal mocks a portal's blocklist endpoint, it serves the entries
+	// that are set on it.
+	mockPortal struct {
+		entries []api.BlockedHash
+
+		staticMu sync.Mutex
+	}
+)
+
+// TestIntegration runs the end-to-end scenarios.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{
+			name: "BasicBlock",
+			test: testBasicBlock,
+		},
+		{
+			name: "AllowListedBlock",
+			test: testAllowListedBlock,
+		},
+		{
+			name: "FailingHashRetry",
+			test: testFailingHashRetry,
+		},
+		{
+			name: "PortalSync",
+			test: testPortalSync,
+		},
+		{
+			name: "Duplicates",
+			test: testDuplicates,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.test)
+	}
+}
+
+// testBasicBlock verifies a reported hash gets blocked by skyd and is marked
+// as blocked in the database.
+func testBasicBlock(t *testing.T) {
+	tt := newTester(t)
+
+	// report a hash
+	hash := randomHash()
+	if status := tt.report(t, hash); status != "reported" {
+		t.Fatal("unexpected status", status)
+	}
+
+	// assert it gets blocked
+	tt.waitForBlocked(t, hash)
+	if n := tt.staticSkyd.numBlocked(hash); n != 1 {
+		t.Fatalf("unexpected number of blocks, %v != 1", n)
+	}
+
+	// assert the document
+	doc := tt.findByHash(t, hash)
+	if doc.Source != database.SourceAPI || doc.Origin.Type != database.OriginTypeUser {
+		t.Fatal("unexpected source or origin", doc.Source, doc.Origin)
+	}
+}
+
+// testAllowListedBlock verifies allowlisted hashes are never sent to skyd,
+// whether they are reported or entered the database in another way.
+func testAllowListedBlock(t *testing.T) {
+	tt := newTester(t)
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+
+	// allowlist two hashes
+	reported := randomHash()
+	inserted := randomHash()
+	for _, hash := range []crypto.Hash{reported, inserted} {
+		err := tt.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+			Hash:           database.Hash{Hash: hash},
+			Description:    "allowlisted",
+			TimestampAdded: database.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert reporting the hash doesn't add it to the database
+	if status := tt.report(t, reported); status != "reported" {
+		t.Fatal("unexpected status", status)
+	}
+	doc, err := tt.staticDB.FindByHash(ctx, database.Hash{Hash: reported})
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// insert the other hash directly, like the syncer would, and assert the
+	// blocker skips it
+	err = tt.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           database.Hash{Hash: inserted},
+		Source:         database.SourceSync,
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry(t, func() error {
+		if !tt.findByHash(t, inserted).SkippedAllowListed {
+			return errors.New("hash not skipped yet")
+		}
+		return nil
+	})
+
+	// assert skyd never received either of them
+	for _, hash := range []crypto.Hash{reported, inserted} {
+		if n := tt.staticSkyd.numBlocked(hash); n != 0 {
+			t.Fatalf("unexpected number of blocks, %v != 0", n)
+		}
+	}
+}
+
+// testFailingHashRetry verifies a hash that failed to get blocked is retried
+// by the retry loop once skyd recovers.
+func testFailingHashRetry(t *testing.T) {
+	tt := newTester(t)
+
+	// report a hash skyd fails to block
+	hash := randomHash()
+	tt.staticSkyd.setFailing(hash, true)
+	if status := tt.report(t, hash); status != "reported" {
+		t.Fatal("unexpected status", status)
+	}
+
+	// assert it gets marked as failed
+	retry(t, func() error {
+		doc := tt.findByHash(t, hash)
+		if !doc.Failed {
+			return errors.New("hash not failed yet")
+		}
+		if doc.FailureClass != database.FailureClassTransient {
+			return fmt.Errorf("unexpected failure class '%v'", doc.FailureClass)
+		}
+		return nil
+	})
+
+	// recover skyd and assert the hash gets blocked by the retry loop
+	tt.staticSkyd.setFailing(hash, false)
+	tt.waitForBlocked(t, hash)
+	if n := tt.staticSkyd.numBlocked(hash); n != 1 {
+		t.Fatalf("unexpected number of blocks, %v != 1", n)
+	}
+}
+
+// testPortalSync verifies hashes on a portal's blocklist are imported by the
+// syncer and blocked by the blocker, and that hashes that were reported
+// locally already are not imported again.
+func testPortalSync(t *testing.T) {
+	portal := &mockPortal{}
+	server := httptest.NewServer(portal)
+	t.Cleanup(server.Close)
+	tt := newTester(t, server.URL)
+
+	// report a hash locally and wait for it to get blocked
+	local := randomHash()
+	if status := tt.report(t, local); status != "reported" {
+		t.Fatal("unexpected status", status)
+	}
+	tt.waitForBlocked(t, local)
+
+	// add it to the portal's blocklist, together with a new hash, and assert
+	// both get blocked
+	synced := randomHash()
+	portal.setEntries(
+		api.BlockedHash{Hash: database.Hash{Hash: synced}, Tags: []string{"tag"}},
+		api.BlockedHash{Hash: database.Hash{Hash: local}, Tags: []string{"tag"}},
+	)
+	tt.waitForBlocked(t, synced)
+	retry(t, func() error {
+		if len(tt.findByHash(t, local).SeenOnPortals) == 0 {
+			return errors.New("local hash not seen on portal yet")
+		}
+		return nil
+	})
+
+	// assert the synced hash originates from the portal
+	doc := tt.findByHash(t, synced)
+	if doc.Origin.Type != database.OriginTypePortal || doc.Origin.URL != server.URL {
+		t.Fatal("unexpected origin", doc.Origin)
+	}
+	if doc.Source != database.SourceSync || !reflect.DeepEqual(doc.Tags, []string{"tag"}) {
+		t.Fatal("unexpected source or tags", doc.Source, doc.Tags)
+	}
+
+	// assert the local hash kept its origin
+	doc = tt.findByHash(t, local)
+	if doc.Origin.Type != database.OriginTypeUser || !reflect.DeepEqual(doc.SeenOnPortals, []string{server.URL}) {
+		t.Fatal("unexpected origin or portals", doc.Origin, doc.SeenOnPortals)
+	}
+
+	// assert both hashes got blocked exactly once
+	for _, hash := range []crypto.Hash{local, synced} {
+		if n := tt.staticSkyd.numBlocked(hash); n != 1 {
+			t.Fatalf("unexpected number of blocks, %v != 1", n)
+		}
+	}
+}
+
+// testDuplicates verifies reporting a hash more than once is reported as a
+// duplicate and doesn't block it again.
+func testDuplicates(t *testing.T) {
+	tt := newTester(t)
+
+	// report a hash twice before it got blocked
+	hash := randomHash()
+	if status := tt.report(t, hash); status != "reported" {
+		t.Fatal("unexpected status", status)
+	}
+	if status := tt.report(t, hash); status != "duplicate" {
+		t.Fatal("unexpected status", status)
+	}
+	tt.waitForBlocked(t, hash)
+
+	// report it again after it got blocked
+	if status := tt.report(t, hash); status != "duplicate" {
+		t.Fatal("unexpected status", status)
+	}
+
+	// give the blocker a couple of sweeps and assert it got blocked once
+	time.Sleep(5 * testBlockInterval)
+	if n := tt.staticSkyd.numBlocked(hash); n != 1 {
+		t.Fatalf("unexpected number of blocks, %v != 1", n)
+	}
+}
+
+// newTester returns a tester that syncs with the given portals. The blocker and
+// syncer are started and everything is torn down when the test finishes.
+func newTester(t *testing.T, portalURLs ...string) *tester {
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	logger, _ := logtest.NewNullLogger()
+
+	// create the mocked skyd
+	skyd := &mockSkyd{
+		blocked: make(map[crypto.Hash]int),
+		failing: make(map[crypto.Hash]struct{}),
+	}
+	skydServer := httptest.NewServer(skyd)
+	t.Cleanup(skydServer.Close)
+	skydClient := api.NewSkydClient(skydServer.URL, "")
+
+	// create the API
+	a, err := api.New(api.Config{
+		AccountsHost:    "localhost",
+		AccountsPort:    "3000",
+		MaxProofUses:    50,
+		MaxDailyReports: 100,
+		TrustedMySkyIDs: make(map[string]struct{}),
+		PoWSecret:       fastrand.Bytes(32),
+	}, skydClient, db, logger.WithField("module", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(a)
+	t.Cleanup(apiServer.Close)
+
+	// create and start the blocker
+	bl, err := blocker.New(skydClient, db, logger.WithField("module", "blocker"),
+		blocker.WithBlockInterval(testBlockInterval),
+		blocker.WithRetryInterval(testRetryInterval),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bl.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := bl.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// create and start the syncer
+	if len(portalURLs) > 0 {
+		s, err := syncer.New(db, portalURLs, logger.WithField("module", "syncer"),
+			syncer.WithSyncInterval(testSyncInterval),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Stop(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	return &tester{
+		staticAPI:  apiServer,
+		staticDB:   db,
+		staticSkyd: skyd,
+	}
+}
+
+// findByHash fetches the document of the given hash and fails the test if it
+// doesn't exist.
+func (tt *tester) findByHash(t *testing.T, hash crypto.Hash) *database.BlockedSkylink {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	doc, err := tt.staticDB.FindByHash(ctx, database.Hash{Hash: hash})
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+	return doc
+}
+
+// report reports the given hash through the API and returns the status of the
+// response.
+func (tt *tester) report(t *testing.T, hash crypto.Hash) string {
+	t.Helper()
+	body, err := json.Marshal(api.BlockPOST{
+		Hash:     database.Hash{Hash: hash},
+		Reporter: api.Reporter{Name: "integration"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: the report carries no cookie, so the accounts service isn't
+	// called to identify the reporter
+	res, err := http.Post(tt.staticAPI.URL+"/block", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status code", res.StatusCode)
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Status
+}
+
+// waitForBlocked waits until skyd blocked the given hash and the blocker
+// marked it as blocked in the database.
+func (tt *tester) waitForBlocked(t *testing.T, hash crypto.Hash) {
+	t.Helper()
+	retry(t, func() error {
+		if tt.staticSkyd.numBlocked(hash) == 0 {
+			return errors.New("hash not blocked by skyd yet")
+		}
+		doc := tt.findByHash(t, hash)
+		if doc.Failed || doc.TimestampBlocked.IsZero() {
+			return errors.New("hash not marked as blocked yet")
+		}
+		return nil
+	})
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (m *mockSkyd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/skynet/blocklist" {
+		skyapi.WriteError(w, skyapi.Error{Message: "not found"}, http.StatusNotFound)
+		return
+	}
+
+	m.staticMu.Lock()
+	defer m.staticMu.Unlock()
+
+	// return the blocklist
+	if r.Method == http.MethodGet {
+		var blg skyapi.SkynetBlocklistGET
+		for hash := range m.blocked {
+			blg.Blocklist = append(blg.Blocklist, hash)
+		}
+		skyapi.WriteJSON(w, blg)
+		return
+	}
+
+	// parse the hashes to block
+	var request skyapi.SkynetBlocklistPOST
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	hashes := make([]crypto.Hash, len(request.Add))
+	for i, str := range request.Add {
+		err := hashes[i].LoadString(str)
+		if err != nil {
+			skyapi.WriteError(w, skyapi.Error{Message: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if _, failing := m.failing[hashes[i]]; failing {
+			skyapi.WriteError(w, skyapi.Error{Message: "skyd unavailable"}, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// block them
+	for _, hash := range hashes {
+		m.blocked[hash]++
+	}
+	skyapi.WriteJSON(w, api.BlockResponse{})
+}
+
+// numBlocked returns the number of times the given hash got blocked.
+func (m *mockSkyd) numBlocked(hash crypto.Hash) int {
+	m.staticMu.Lock()
+	defer m.staticMu.Unlock()
+	return m.blocked[hash]
+}
+
+// setFailing sets whether requests that contain the given hash fail.
+func (m *mockSkyd) setFailing(hash crypto.Hash, failing bool) {
+	m.staticMu.Lock()
+	defer m.staticMu.Unlock()
+	if failing {
+		m.failing[hash] = struct{}{}
+	} else {
+		delete(m.failing, hash)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (p *mockPortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/skynet/portal/blocklist" {
+		skyapi.WriteError(w, skyapi.Error{Message: "not found"}, http.StatusNotFound)
+		return
+	}
+	p.staticMu.Lock()
+	defer p.staticMu.Unlock()
+	skyapi.WriteJSON(w, api.BlocklistGET{Entries: p.entries})
+}
+
+// setEntries sets the entries of the portal's blocklist, newest first.
+func (p *mockPortal) setEntries(entries ...api.BlockedHash) {
+	p.staticMu.Lock()
+	defer p.staticMu.Unlock()
+	p.entries = entries
+}
+
+// randomHash returns a random hash.
+func randomHash() crypto.Hash {
+	var h crypto.Hash
+	fastrand.Read(h[:])
+	return h
+}
+
+// retry retries the given function until it succeeds and fails the test if it
+// doesn't within ten seconds.
+func retry(t *testing.T, fn func() error) {
+	t.Helper()
+	err := build.Retry(200, 50*time.Millisecond, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/config"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// logFile is a writer that writes to a file that can be reopened, this allows
+// external tools such as logrotate to rotate the file.
+type logFile struct {
+	staticPath string
+
+	file *os.File
+	mu   sync.Mutex
+}
+
+// openLogFile opens the log file at the given path, it gets created if it
+// doesn't exist and appended to if it does.
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{staticPath: path}
+	err := f.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the log file.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Reopen closes the log file and opens it again. If the file was moved, a new
+// file gets created at the original path.
+func (f *logFile) Reopen() error {
+	file, err := os.OpenFile(f.staticPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.AddContext(err, "failed to open log file")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var closeErr error
+	if f.file != nil {
+		closeErr = f.file.Close()
+	}
+	f.file = file
+	return errors.AddContext(closeErr, "failed to close log file")
+}
+
+// Write implements the io.Writer interface.
+func (f *logFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	return f.file.Write(b)
+}
+
+// configureLogger configures the format and output of the given logger. If
+// a log file is configured, the logger writes to both stderr and that file,
+// which is returned so it can be reopened.
+func configureLogger(logger *logrus.Logger, cfg config.Config) (*logFile, error) {
+	logger.SetLevel(cfg.LogLevel)
+	if cfg.LogFormat == config.LogFormatJSON {
+		logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  "time",
+				logrus.FieldKeyLevel: "level",
+				logrus.FieldKeyMsg:   "msg",
+			},
+		})
+	}
+	if cfg.LogFile == "" {
+		return nil, nil
+	}
+	f, err := openLogFile(cfg.LogFile)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetOutput(io.MultiWriter(os.Stderr, f))
+	return f, nil
+}
+
+// reopenOnSignal reopens the given log file every time a signal is received on
+// the given channel, until the context gets cancelled.
+func reopenOnSignal(ctx context.Context, f *logFile, sigs <-chan os.Signal, logger *logrus.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		err := f.Reopen()
+		if err != nil {
+			logger.Errorf("Failed to reopen log file, err: %v", err)
+			continue
+		}
+		logger.Debug("Reopened log file")
+	}
+}
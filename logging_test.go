@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/config"
+	"github.com/sirupsen/logrus"
+)
+
+// TestLogFileReopen verifies the log file can be reopened after it got moved,
+// which is what happens when it gets rotated.
+func TestLogFileReopen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocker.log")
+	rotated := filepath.Join(dir, "blocker.log.1")
+
+	f, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// write a line and rotate the file
+	_, err = f.Write([]byte("before\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(path, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes before reopening end up in the rotated file
+	_, err = f.Write([]byte("still before\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen and write another line
+	err = f.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("after\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert both files have the expected contents
+	assertFileContents(t, rotated, "before\nstill before\n")
+	assertFileContents(t, path, "after\n")
+
+	// assert writing to a closed file fails
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("closed\n"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestReopenOnSignal verifies the log file gets reopened when a signal is
+// received.
+func TestReopenOnSignal(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocker.log")
+
+	f, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	go reopenOnSignal(ctx, f, sigs, logger)
+
+	// rotate the file and send the signal
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs <- syscall.SIGHUP
+
+	// assert the file gets recreated
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("log file was not reopened")
+		}
+	}
+}
+
+// TestConfigureLogger verifies the logger writes JSON to the configured log
+// file.
+func TestConfigureLogger(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "blocker.log")
+	logger := logrus.New()
+	f, err := configureLogger(logger, config.Config{
+		LogLevel:  logrus.DebugLevel,
+		LogFormat: config.LogFormatJSON,
+		LogFile:   path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	logger.WithField("skylink", "abc").Debug("some message")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "some message" || entry["level"] != "debug" || entry["skylink"] != "abc" {
+		t.Fatal("unexpected", entry)
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Fatal("missing time", entry)
+	}
+
+	// assert no file gets opened if none is configured
+	f, err = configureLogger(logrus.New(), config.Config{LogFormat: config.LogFormatText})
+	if err != nil || f != nil {
+		t.Fatal("unexpected", f, err)
+	}
+}
+
+// assertFileContents asserts the file at the given path has the given
+// contents.
+func assertFileContents(t *testing.T, path, expected string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Fatalf("unexpected contents %q, expected %q", string(b), expected)
+	}
+}
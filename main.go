@@ -3,31 +3,46 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/SkynetLabs/blocker/api"
 	"github.com/SkynetLabs/blocker/blocker"
+	"github.com/SkynetLabs/blocker/config"
 	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/events"
+	"github.com/SkynetLabs/blocker/pusher"
 	"github.com/SkynetLabs/blocker/syncer"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
-	// defaultSkydHost is where we connect to skyd unless overwritten by
-	// "API_HOST" environment variables.
-	defaultSkydHost = "sia"
+	// cmdExport is the command that exports the blocklist.
+	cmdExport = "export"
 
-	// defaultSkydPort is where we connect to skyd unless overwritten by
-	// "API_PORT" environment variables.
-	defaultSkydPort = 9980
+	// cmdHealthcheck is the command that checks the health of a running
+	// blocker.
+	cmdHealthcheck = "healthcheck"
+
+	// cmdImport is the command that imports an export of the blocklist.
+	cmdImport = "import"
+
+	// cmdRepair is the command that repairs a database of which the schema
+	// can't be ensured because of duplicate or legacy documents.
+	cmdRepair = "repair"
+
+	// cmdServe is the command that runs the blocker, it is the default.
+	cmdServe = "serve"
+
+	// shutdownTimeout is the amount of time we give the API to finish
+	// in-flight requests when shutting down.
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
@@ -35,174 +50,450 @@ func main() {
 	// Existing variables take precedence and won't be overwritten.
 	_ = godotenv.Load()
 
-	// Create a logger
-	logger := logrus.New()
-	logLevel, err := logrus.ParseLevel(os.Getenv("BLOCKER_LOG_LEVEL"))
-	if err != nil {
-		logLevel = logrus.InfoLevel
+	// Dispatch the command, we serve the blocker if no command is given.
+	cmd := cmdServe
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
 	}
-	logger.SetLevel(logLevel)
-
-	// Set the unique id of this server.
-	database.ServerUID = os.Getenv("SERVER_UID")
-	if database.ServerUID == "" {
-		log.Fatal("missing env var SERVER_UID")
+	switch cmd {
+	case cmdServe:
+		os.Exit(serve())
+	case cmdHealthcheck:
+		os.Exit(healthcheck())
+	case cmdExport:
+		os.Exit(export(os.Args[2:]))
+	case cmdImport:
+		os.Exit(importExport(os.Args[2:]))
+	case cmdRepair:
+		os.Exit(repair(os.Args[2:]))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s', usage: blocker [%s|%s|%s|%s|%s]\n", cmd, cmdServe, cmdHealthcheck, cmdExport, cmdImport, cmdRepair)
+		os.Exit(2)
 	}
+}
 
-	// Load the database credentials
-	uri, dbCreds, err := loadDBCredentials()
-	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to fetch db credentials"))
-	}
+// serve runs the blocker until it receives an exit signal and returns the exit
+// code of the process.
+func serve() int {
+	// Create a logger
+	logger := logrus.New()
 
-	// Create a connection to the database
-	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
-	defer cancel()
-	db, err := database.New(ctx, uri, dbCreds, logger)
+	// Load the config from the environment
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to connect to the db"))
+		logger.Errorf("Failed to load config: %v", err)
+		return 1
 	}
 
-	// Blocker env vars.
-	skydPort := defaultSkydPort
-	skydPortEnv, err := strconv.Atoi(os.Getenv("API_PORT"))
-	if err == nil && skydPortEnv > 0 {
-		skydPort = skydPortEnv
+	// Configure the log format and output
+	logFile, err := configureLogger(logger, cfg)
+	if err != nil {
+		logger.Errorf("Failed to configure logger: %v", err)
+		return 1
 	}
-	skydHost := defaultSkydHost
-	if skydHostEnv := os.Getenv("API_HOST"); skydHostEnv != "" {
-		skydHost = skydHostEnv
+	if logFile != nil {
+		defer logFile.Close()
 	}
-	skydAPIPassword := os.Getenv("SIA_API_PASSWORD")
-	if skydAPIPassword == "" {
-		log.Fatal(errors.New("SIA_API_PASSWORD is empty, exiting"))
+	logger.Infof("Loaded config: %v", cfg)
+	for _, warning := range cfg.Warnings {
+		logger.Warn(warning)
 	}
 
-	// Accounts.
-	if aHost := os.Getenv("SKYNET_ACCOUNTS_HOST"); aHost != "" {
-		api.AccountsHost = aHost
+	// Create a root context that gets cancelled on exit signals
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Reopen the log file on SIGHUP, this allows rotating it externally
+	if logFile != nil {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go reopenOnSignal(ctx, logFile, sighup, logger)
 	}
-	if aPort := os.Getenv("SKYNET_ACCOUNTS_PORT"); aPort != "" {
-		api.AccountsPort = aPort
+
+	// Run the blocker until the context gets cancelled
+	err = run(ctx, cfg, logger)
+	if err != nil {
+		logger.Errorf("Blocker terminated with error: %v", err)
+		return 1
 	}
+	logger.Info("Blocker Terminated.")
+	return 0
+}
+
+// run starts all components of the blocker using the given config and blocks
+// until the given context gets cancelled, after which it shuts down all
+// components. It returns an error if one of the components failed to start or
+// failed to cleanly stop.
+func run(ctx context.Context, cfg config.Config, logger *logrus.Logger) error {
+	// Tag all logs with the server's UID, every module gets its own logger
+	// so we can tell which one logged a message.
+	log := logger.WithField("server_uid", cfg.ServerUID)
 
-	// Create a skyd client
-	skydUrl := fmt.Sprintf("http://%s:%d", skydHost, skydPort)
-	skydClient := api.NewSkydClient(skydUrl, skydAPIPassword)
-	if !skydClient.DaemonReady() {
-		log.Fatal(errors.New("skyd down, exiting"))
+	// Use a random PoW secret if none was configured.
+	powSecret := cfg.PoWSecret
+	if len(powSecret) == 0 {
+		log.Warn("BLOCKER_POW_SECRET is empty, PoW challenges are signed with a random secret and are only valid on this instance")
+		powSecret = fastrand.Bytes(32)
 	}
 
-	// Create the blocker.
-	bl, err := blocker.New(skydClient, db, logger)
+	// Create a connection to the database
+	db, err := connectDB(ctx, cfg, log.WithField("module", "db"))
 	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to instantiate blocker"))
+		return err
 	}
 
-	// Start blocker.
-	err = bl.Start()
-	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to start blocker"))
+	// Make sure we close the database connection when we exit
+	defer func() {
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+		defer closeCancel()
+		if err := db.Close(closeCtx); err != nil {
+			log.Errorf("Failed to disconnect from the database, err: %v", err)
+		}
+	}()
+
+	// Log slow database operations
+	db.SetSlowQueryThreshold(cfg.DBSlowQueryThreshold)
+
+	// Retry the database operations of the loops during a primary failover
+	db.SetRetryWindow(cfg.DBRetryWindow)
+
+	// Split up large bulk inserts, e.g. when bootstrapping from a peer
+	db.SetInsertChunkSize(cfg.DBInsertChunkSize)
+
+	// Periodically verify the database schema
+	db.StartSchemaCheck(ctx)
+
+	// Create the event bus, the components publish what happens to the hashes
+	// they handle on it and the consumers registered below react to it.
+	bus := events.NewBus()
+
+	// Create a skyd client and the blocker, in aggregator mode we run without
+	// skyd so we don't block anything.
+	var skydClient *api.SkydClient
+	var bl *blocker.Blocker
+	var monitor *blocker.BacklogMonitor
+	var auditor *blocker.Auditor
+	var notifier *blocker.Notifier
+	var callbackDomains []string
+	aggregator := cfg.Mode == config.ModeAggregator
+	if aggregator {
+		log.Info("Running in aggregator mode, skyd and the blocker are disabled")
+	} else {
+		skydClient = api.NewSkydClient(cfg.SkydURL(), cfg.SkydAPIPassword)
+		err = skydClient.WaitForDaemonReady(ctx, cfg.SkydReadyTimeout, log.WithField("module", "api"))
+		if err != nil {
+			return errors.AddContext(err, "skyd down, exiting")
+		}
+		bl, err = blocker.New(skydClient, db, log.WithField("module", "blocker"),
+			blocker.WithBatchTimeout(cfg.SkydBatchTimeout),
+			blocker.WithMaxBatchBytes(cfg.SkydMaxBatchBytes),
+			blocker.WithRetryLimit(cfg.RetryLimit),
+			blocker.WithLagThreshold(cfg.LagThreshold),
+			blocker.WithSeverities(cfg.Severities),
+			blocker.WithStopTimeout(cfg.StopTimeout),
+			blocker.WithAllowListFailOpen(cfg.AllowListFailOpen),
+			blocker.WithServerUID(cfg.ServerUID),
+			blocker.WithBootstrapFromSkyd(cfg.BootstrapFromSkyd),
+			blocker.WithStaleServerAge(cfg.StaleServerAge),
+			blocker.WithEventBus(bus),
+		)
+		if err != nil {
+			return errors.AddContext(err, "failed to instantiate blocker")
+		}
+		monitor, err = blocker.NewBacklogMonitor(blocker.AlertConfig{
+			URL:              cfg.AlertURL,
+			Rules:            cfg.WebhookRules,
+			FailedThreshold:  cfg.AlertFailedThreshold,
+			InvalidThreshold: cfg.AlertInvalidThreshold,
+			CheckInterval:    cfg.AlertCheckInterval,
+			Cooldown:         cfg.AlertCooldown,
+		}, db, log.WithField("module", "blocker"))
+		if err != nil {
+			return errors.AddContext(err, "failed to instantiate backlog monitor")
+		}
+		if cfg.AuditInterval > 0 {
+			auditor, err = blocker.NewAuditor(skydClient, db, bl.Reblock, cfg.AuditInterval, log.WithField("module", "blocker"))
+			if err != nil {
+				return errors.AddContext(err, "failed to instantiate auditor")
+			}
+		}
+		if len(cfg.CallbackDomains) > 0 {
+			notifier, err = blocker.NewNotifier(blocker.NotifierConfig{
+				Secret:    cfg.CallbackSecret,
+				RateLimit: cfg.CallbackRateLimit,
+			}, db, log.WithField("module", "blocker"))
+			if err != nil {
+				return errors.AddContext(err, "failed to instantiate notifier")
+			}
+			callbackDomains = cfg.CallbackDomains
+		}
 	}
 
 	// Create the syncer.
-	portalURLs := loadPortalURLs()
-	sync, err := syncer.New(db, portalURLs, logger)
+	sync, err := syncer.New(db, cfg.PortalURLs, log.WithField("module", "syncer"),
+		syncer.WithStopTimeout(cfg.StopTimeout),
+		syncer.WithAllowListFailOpen(cfg.AllowListFailOpen),
+		syncer.WithPortalIdentities(cfg.PortalIdentities),
+		syncer.WithEventBus(bus),
+	)
 	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to instantiate syncer"))
+		return errors.AddContext(err, "failed to instantiate syncer")
 	}
 
-	// Start the syncer.
-	err = sync.Start()
+	// Create the pusher.
+	push, err := pusher.New(cfg.OwnPortalURL, cfg.PushPeers, log.WithField("module", "pusher"), pusher.WithStopTimeout(cfg.StopTimeout))
 	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to start syncer"))
+		return errors.AddContext(err, "failed to instantiate pusher")
 	}
 
 	// Initialise the server.
-	server, err := api.New(skydClient, db, logger)
+	server, err := api.New(api.Config{
+		AccountsHost:        cfg.AccountsHost,
+		AccountsPort:        cfg.AccountsPort,
+		MaxProofUses:        cfg.PoWMaxUses,
+		MaxDailyReports:     cfg.PoWMaxDailyReports,
+		TrustedMySkyIDs:     cfg.PoWTrustedMySkyIDs,
+		PoWSecret:           powSecret,
+		PoWV1Deadline:       cfg.PoWV1Deadline,
+		Severities:          cfg.Severities,
+		AnonymizeReporters:  cfg.AnonymizeReporters,
+		ReporterSalt:        cfg.ReporterSalt,
+		APIKeys:             cfg.APIKeys,
+		TLSCertFile:         cfg.TLSCertFile,
+		TLSKeyFile:          cfg.TLSKeyFile,
+		AggregatorMode:      aggregator,
+		AlertWebhook:        !aggregator && (cfg.AlertURL != "" || len(cfg.WebhookRules) > 0),
+		Push:                len(cfg.PushPeers) > 0,
+		ShedThreshold:       cfg.DBShedThreshold,
+		ShedAllThreshold:    cfg.DBShedAllThreshold,
+		AllowListFailOpen:   cfg.AllowListFailOpen,
+		PreflightCheck:      cfg.PreflightCheck,
+		Suspicion:           database.SuspicionThresholds{MinReports: cfg.SuspicionMinReports, BogusRatio: cfg.SuspicionBogusRatio},
+		ArchiveAge:          cfg.ArchiveAge,
+		CallbackDomains:     callbackDomains,
+		Role:                cfg.APIRole,
+		DisableListing:      cfg.APIDisableListing,
+		ListingCacheControl: cfg.APIListingCacheControl,
+		PublicResponseHash:  cfg.PoWResponseHash,
+		Debug:               cfg.Debug,
+	}, skydClient, db, log.WithField("module", "api"))
 	if err != nil {
-		log.Fatal(errors.AddContext(err, "failed to build the api"))
+		return errors.AddContext(err, "failed to build the api")
 	}
 
-	// Start the server
-	go func() {
-		err := server.ListenAndServe(4000)
+	// Expose the status of the blocker and syncer on the debug endpoint.
+	if bl != nil {
+		server.RegisterStatus("blocker", func() interface{} { return bl.Status() })
+		server.RegisterStatus("monitor", func() interface{} { return monitor.Status() })
+
+		// Expose the lag of the blocker, which is the time it takes for a
+		// report to get blocked.
+		server.RegisterHealthDetail("blockerLagSeconds", func() interface{} { return bl.Lag().Seconds() })
+		server.RegisterHealthCheck("blocker", api.HealthStatusDegraded, func(context.Context) error { return bl.CheckLag() })
+		server.RegisterGauge("blocker_lag_seconds", "Time between the start of the last sweep and the oldest report that wasn't blocked yet.", func() float64 { return bl.Lag().Seconds() })
+
+		// Expose when the blocker sweeps and retries next, so operators can
+		// tell whether a report missed the last sweep.
+		server.RegisterHealthDetail("blockerNextBlockRun", func() interface{} { return bl.Status().NextBlockRun })
+		server.RegisterHealthDetail("blockerNextRetryRun", func() interface{} { return bl.Status().NextRetryRun })
+
+		// Let admins replay the blocklist through the blocker.
+		server.RegisterReblockHook(bl.Reblock)
+
+		// Expose the report of the last audit.
+		if auditor != nil {
+			server.RegisterAuditHook(func() interface{} { return auditor.Status() })
+		}
+
+		// Expose the status of the callback deliveries.
+		if notifier != nil {
+			server.RegisterStatus("notifier", func() interface{} { return notifier.Status() })
+		}
+
+		// Block reports of critical severity immediately.
+		err = bus.Handle("trigger", events.DefaultBufferSize, func(e events.Event) {
+			for _, bs := range e.Skylinks {
+				if e.Publisher == events.PublisherAPI && bs.Severity == database.SeverityCritical {
+					bl.TriggerBlock()
+					return
+				}
+			}
+		}, events.BlockCreated)
 		if err != nil {
-			log.Fatal(errors.AddContext(err, "failed to start server"))
+			return errors.AddContext(err, "failed to subscribe the blocker to new reports")
 		}
-	}()
 
-	// Catch exit signals
-	exitSignal := make(chan os.Signal, 1)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
+		// Alert on new reports, the webhook rules decide where they go.
+		err = bus.Handle("alerts", events.DefaultBufferSize, func(e events.Event) {
+			if e.Publisher != events.PublisherAPI {
+				return
+			}
+			for _, bs := range e.Skylinks {
+				err := monitor.AlertReport(bs)
+				if err != nil {
+					log.WithError(err).Error("Failed to send report alert")
+				}
+			}
+		}, events.BlockCreated)
+		if err != nil {
+			return errors.AddContext(err, "failed to subscribe the alerts to new reports")
+		}
+	}
+	server.RegisterStatus("syncer", func() interface{} { return sync.Status() })
+	if len(cfg.PortalURLs) > 0 {
+		server.RegisterHealthCheck("syncer", api.HealthStatusDegraded, func(context.Context) error { return sync.CheckPortals() })
+		server.RegisterHealthDetail("syncerNextSyncRun", func() interface{} { return sync.Status().NextSyncRun })
+	}
+	server.RegisterStatus("pusher", func() interface{} { return push.Status() })
 
-	// Shut down all components
-	err = errors.Compose(
-		bl.Stop(),
-		sync.Stop(),
-	)
+	// Push new reports to our peers.
+	err = bus.Handle("pusher", events.DefaultBufferSize, func(e events.Event) {
+		if e.Publisher != events.PublisherAPI {
+			return
+		}
+		for _, bs := range e.Skylinks {
+			push.Push(bs)
+		}
+	}, events.BlockCreated)
 	if err != nil {
-		log.Fatal("Failed to cleanly stop all components, err: ", err)
+		return errors.AddContext(err, "failed to subscribe the pusher to new reports")
 	}
 
-	// Close the database connection
-	dbCtx, dbCancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
-	defer dbCancel()
-	err = db.Close(dbCtx)
+	// Publish new reports and reverts on the event bus and expose how many
+	// events its consumers dropped.
+	server.RegisterEventBus(bus)
+	server.RegisterStatus("events", func() interface{} { return bus.Status() })
+	server.RegisterGauge("blocker_events_dropped_total", "Number of events that were dropped because a consumer of the event bus fell behind.", func() float64 { return float64(bus.Dropped()) })
+	server.RegisterStatus("db", func() interface{} { return db.QueryStats() })
+
+	// Start blocker and the monitor of its backlog.
+	if bl != nil {
+		err = bl.Start()
+		if err != nil {
+			return errors.AddContext(err, "failed to start blocker")
+		}
+		err = monitor.Start()
+		if err != nil {
+			return errors.Compose(errors.AddContext(err, "failed to start backlog monitor"), bl.Stop())
+		}
+		if auditor != nil {
+			err = auditor.Start()
+			if err != nil {
+				return errors.Compose(errors.AddContext(err, "failed to start auditor"), bl.Stop(), monitor.Stop())
+			}
+		}
+		if notifier != nil {
+			err = notifier.Start()
+			if err != nil {
+				var auditorErr error
+				if auditor != nil {
+					auditorErr = auditor.Stop()
+				}
+				return errors.Compose(errors.AddContext(err, "failed to start notifier"), auditorErr, bl.Stop(), monitor.Stop())
+			}
+		}
+	}
+	stopBlocker := func() error {
+		if bl == nil {
+			return nil
+		}
+		var auditorErr, notifierErr error
+		if auditor != nil {
+			auditorErr = auditor.Stop()
+		}
+		if notifier != nil {
+			notifierErr = notifier.Stop()
+		}
+		return errors.Compose(auditorErr, notifierErr, bl.Stop(), monitor.Stop())
+	}
+
+	// Start the syncer, note that it only starts if portal URLs were defined.
+	err = sync.Start()
 	if err != nil {
-		log.Fatal("Failed to disconnect from the database, err: ", err)
+		return errors.Compose(errors.AddContext(err, "failed to start syncer"), stopBlocker())
 	}
+	syncStarted := len(cfg.PortalURLs) > 0
 
-	logger.Info("Blocker Terminated.")
-}
+	// Start the pusher, note that it only starts if peers were defined.
+	err = push.Start()
+	if err != nil {
+		return errors.Compose(errors.AddContext(err, "failed to start pusher"), stopBlocker())
+	}
+	pushStarted := len(cfg.PushPeers) > 0
+
+	// Start the server
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServeAddr(cfg.ListenAddr)
+	}()
 
-// loadDBCredentials creates a new db connection based on credentials found in
-// the environment variables.
-func loadDBCredentials() (string, options.Credential, error) {
-	var creds options.Credential
-	var ok bool
-	if creds.Username, ok = os.LookupEnv("SKYNET_DB_USER"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_USER")
+	// Block until the context gets cancelled or the server fails
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Info("Shutting down the blocker...")
+	case err := <-serverErr:
+		runErr = errors.AddContext(err, "failed to start server")
 	}
-	if creds.Password, ok = os.LookupEnv("SKYNET_DB_PASS"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_PASS")
+
+	// Shut down all components that publish on the event bus first, that's
+	// the server, which drains the requests in flight, the blocker, which
+	// finishes its sweep, and the syncer.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	shutdownErr := server.Shutdown(shutdownCtx)
+	blockerErr := stopBlocker()
+	var syncErr error
+	if syncStarted {
+		syncErr = sync.Stop()
 	}
-	var host, port string
-	if host, ok = os.LookupEnv("SKYNET_DB_HOST"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_HOST")
+
+	// Drain the event bus before stopping the pusher, so the reports that
+	// were queued on the bus still get pushed.
+	bus.Close()
+	var pushErr error
+	if pushStarted {
+		pushErr = push.Stop()
 	}
-	if port, ok = os.LookupEnv("SKYNET_DB_PORT"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_PORT")
+	err = errors.Compose(
+		runErr,
+		errors.AddContext(shutdownErr, "failed to shut down the server"),
+		errors.AddContext(blockerErr, "failed to stop the blocker"),
+		errors.AddContext(syncErr, "failed to stop the syncer"),
+		errors.AddContext(pushErr, "failed to stop the pusher"),
+	)
+	if err != nil {
+		return errors.AddContext(err, "failed to cleanly stop all components")
 	}
-	return fmt.Sprintf("mongodb://%v:%v", host, port), creds, nil
+	return nil
 }
 
-// loadPortalURLs returns a slice of portal urls, configured in the environment
-// under the key BLOCKER_SYNC_PORTALS. The blocker will keep in sync the
-// blocklist from these portals with the local skyd instance.
-func loadPortalURLs() (portalURLs []string) {
-	portalURLStr := os.Getenv("BLOCKER_PORTALS_SYNC")
-	for _, portalURL := range strings.Split(portalURLStr, ",") {
-		portalURL = sanitizePortalURL(portalURL)
-		if portalURL != "" {
-			portalURLs = append(portalURLs, portalURL)
-		}
+// connectDB creates a connection to the database using the given config.
+func connectDB(ctx context.Context, cfg config.Config, logger *logrus.Entry) (*database.DB, error) {
+	buildOpts := database.IndexBuildOptions{
+		Hidden:  cfg.DBIndexHidden,
+		Timeout: cfg.DBIndexBuildTimeout,
+		Resumes: cfg.DBIndexBuildResumes,
 	}
-	return
-}
 
-// sanitizePortalURL is a helper function that sanitizes the given input portal
-// URL, stripping away trailing slashes and ensuring it's prefixed with https.
-func sanitizePortalURL(portalURL string) string {
-	portalURL = strings.TrimSpace(portalURL)
-	portalURL = strings.TrimSuffix(portalURL, "/")
-	if strings.HasPrefix(portalURL, "https://") {
-		return portalURL
+	// leave room for index builds that get resumed when ensuring the schema
+	// and for the migrations that run on startup
+	dbCtx, dbCancel := context.WithTimeout(ctx, database.MongoDefaultTimeout+buildOpts.Budget()+database.MigrationTimeout)
+	defer dbCancel()
+	dbCreds := options.Credential{
+		Username: cfg.DBUser,
+		Password: cfg.DBPassword,
 	}
-	portalURL = strings.TrimPrefix(portalURL, "http://")
-	if portalURL == "" {
-		return portalURL
+	dbOpts := []database.Option{
+		database.WithNamespace(cfg.Namespace),
+		database.WithIndexBuildOptions(buildOpts),
+	}
+	if cfg.APIRole == api.RoleRead {
+		dbOpts = append(dbOpts, database.WithSecondaryPreferredReads())
+	}
+	db, err := database.New(dbCtx, cfg.DBURI(), dbCreds, logger, dbOpts...)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to connect to the db")
 	}
-	return fmt.Sprintf("https://%s", portalURL)
+	return db, nil
 }
@@ -1,203 +1,161 @@
 package main
 
 import (
-	"fmt"
-	"os"
-	"sort"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
-
-	"gitlab.com/NebulousLabs/errors"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/config"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.sia.tech/siad/build"
 )
 
-// TestSanitizePortalURL is a unit test for the sanitizePortalURL helper
-func TestSanitizePortalURL(t *testing.T) {
-	cases := []struct {
-		input  string
-		output string
-	}{
-		{"https://siasky.net", "https://siasky.net"},
-		{"https://siasky.net ", "https://siasky.net"},
-		{" https://siasky.net ", "https://siasky.net"},
-		{"https://siasky.net/", "https://siasky.net"},
-		{"http://siasky.net", "https://siasky.net"},
-		{"siasky.net", "https://siasky.net"},
+// TestRun verifies run starts all components against the test database and
+// cleanly stops all of them once its context gets cancelled.
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
 	}
 
-	// Test set cases to ensure known edge cases are always handled
-	for _, test := range cases {
-		res := sanitizePortalURL(test.input)
-		if res != test.output {
-			t.Fatalf("unexpected result, %v != %v", res, test.output)
-		}
-	}
-}
-
-// TestLoadPortalURLs is a unit test that covers the functionality of the
-// 'loadPortalURLs' helper.
-func TestLoadPortalURLs(t *testing.T) {
-	t.Parallel()
-
-	// create a function to restore the environment
-	restoreEnvFn := restoreEnv([]string{"BLOCKER_PORTALS_SYNC"})
-	defer func() {
-		err := restoreEnvFn()
-		if err != nil {
-			t.Error(err)
+	// mock skyd, it only has to report it's ready
+	skyd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/daemon/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
-	}()
-
-	// empty case
-	os.Setenv("BLOCKER_PORTALS_SYNC", "")
-	urls := loadPortalURLs()
-	if len(urls) != 0 {
-		t.Fatal("unexpected", urls)
-	}
-
-	// assert url is sanitized
-	os.Setenv("BLOCKER_PORTALS_SYNC", "siasky.net/")
-	urls = loadPortalURLs()
-	if len(urls) != 1 && urls[0] != "https://siasky.net" {
-		t.Fatal("unexpected", urls)
-	}
-
-	// assert it can handle multiple items and bad formatting
-	os.Setenv("BLOCKER_PORTALS_SYNC", "siasky.net/, skyportal.xyz,,")
-	urls = loadPortalURLs()
-	if len(urls) != 2 {
-		t.Fatal("unexpected", urls)
-	}
-	sort.Strings(urls)
-	if urls[0] != "https://siasky.net" || urls[1] != "https://skyportal.xyz" {
-		t.Fatal("unexpected", urls)
-	}
-}
-
-// TestLoadDBCredentials is a unit test that covers the functionality of the
-// 'loadDBCredentials' helper.
-func TestLoadDBCredentials(t *testing.T) {
-	t.Parallel()
-
-	variables := []string{
-		"SKYNET_DB_USER",
-		"SKYNET_DB_PASS",
-		"SKYNET_DB_HOST",
-		"SKYNET_DB_PORT",
-	}
-
-	// create a function to restore the environment
-	restoreEnvFn := restoreEnv(variables)
-	defer func() {
-		err := restoreEnvFn()
-		if err != nil {
-			t.Error(err)
-		}
-	}()
-
-	// set every env variable to its name
-	for _, variable := range variables {
-		os.Setenv(variable, variable)
+		_ = json.NewEncoder(w).Encode(api.DaemonReadyResponse{Ready: true, Consensus: true, Gateway: true, Renter: true})
+	}))
+	defer skyd.Close()
+	skydURL, err := url.Parse(skyd.URL)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// load db credentials and assert its output (happy case)
-	connstring, credentials, err := loadDBCredentials()
+	// connect to the test database through the config
+	uri, creds := database.TestDBConnection()
+	dbURL, err := url.Parse(uri)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if credentials.Username != "SKYNET_DB_USER" || credentials.Password != "SKYNET_DB_PASS" {
-		t.Fatal("unexpected", credentials)
-	}
-	if connstring != "mongodb://SKYNET_DB_HOST:SKYNET_DB_PORT" {
-		t.Fatal("unexpected", connstring)
-	}
 
-	// unset every env variable one by one and assert the helper indicates what
-	// environment variable is missing
-	for _, variable := range variables {
-		bkp := os.Getenv(variable)
-		err = os.Unsetenv(variable)
-		if err != nil {
-			t.Fatal(err)
-		}
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{"Full", config.ModeFull},
+		{"Aggregator", config.ModeAggregator},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			namespace := strings.ToLower(test.name) + "-run"
+			addr := freeAddr(t)
+			env := map[string]string{
+				"SERVER_UID":          "test-" + namespace,
+				"BLOCKER_MODE":        test.mode,
+				"BLOCKER_NAMESPACE":   namespace,
+				"BLOCKER_LISTEN_ADDR": addr,
+				"SKYNET_DB_USER":      creds.Username,
+				"SKYNET_DB_PASS":      creds.Password,
+				"SKYNET_DB_HOST":      dbURL.Hostname(),
+				"SKYNET_DB_PORT":      dbURL.Port(),
+				"API_HOST":            skydURL.Hostname(),
+				"API_PORT":            skydURL.Port(),
+				"SIA_API_PASSWORD":    "password",
+			}
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer purgeDB(t, uri, creds, namespace)
+
+			// run the blocker in the background
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runErr := make(chan error, 1)
+			go func() {
+				runErr <- run(ctx, cfg, logger)
+			}()
+
+			// wait until the API serves requests
+			health := "http://" + addr + "/health"
+			err = build.Retry(300, 100*time.Millisecond, func() error {
+				select {
+				case err := <-runErr:
+					t.Fatal("run returned before it got cancelled", err)
+				default:
+				}
+				res, err := http.Get(health)
+				if err != nil {
+					return err
+				}
+				return res.Body.Close()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
 
-		_, _, err := loadDBCredentials()
-		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("missing env var %v", variable)) {
-			t.Fatal("unexpected outcome", err)
-		}
+			// cancel the context and assert run stops all components cleanly
+			cancel()
+			select {
+			case err := <-runErr:
+				if err != nil {
+					t.Fatal("unexpected error", err)
+				}
+			case <-time.After(shutdownTimeout):
+				t.Fatal("run didn't return after its context got cancelled")
+			}
 
-		// put it back
-		err = os.Setenv(variable, bkp)
-		if err != nil {
-			t.Fatal(err)
-		}
+			// assert the API no longer accepts connections
+			if _, err := http.Get(health); err == nil {
+				t.Fatal("expected the API to be shut down")
+			}
+		})
 	}
 }
 
-// TestRestoreEnv is small unit test that covers the restoreEnv helper
-func TestRestoreEnv(t *testing.T) {
-	t.Parallel()
-
-	// assert it can handle nil
-	restoreFn := restoreEnv(nil)
-	err := restoreFn()
+// freeAddr returns a local address that's free to listen on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// set an env variable to some value
-	varName := "TestRestoreEnv"
-	err = os.Setenv(varName, "somevalue")
+	addr := l.Addr().String()
+	err = l.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
+	return addr
+}
 
-	// create the function
-	restoreFn = restoreEnv([]string{varName})
-
-	// update the env variable and assert it's set
-	os.Setenv(varName, "somenewvalue")
+// purgeDB purges the database run connected to, so the documents it stored
+// don't leak into the next run.
+func purgeDB(t *testing.T, uri string, creds options.Credential, namespace string) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	db, err := database.New(ctx, uri, creds, logrus.NewEntry(logger), database.WithNamespace(namespace))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if os.Getenv(varName) != "somenewvalue" {
-		t.Fatal("unexpected", os.Getenv(varName))
-	}
-
-	// restore the env and assert it got restored
-	err = restoreFn()
+	defer db.Close(ctx)
+	err = db.Purge(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if os.Getenv(varName) != "somevalue" {
-		t.Fatal("unexpected", os.Getenv(varName))
-	}
-}
-
-// restoreEnv is a helper function that returns a function that, when executed,
-// restores the environment to the point restoreEnv got called. It restores the
-// environment only for the given set of environment variable names.
-func restoreEnv(variables []string) func() error {
-	backup := make(map[string]string)
-	for _, variable := range variables {
-		value, exists := os.LookupEnv(variable)
-		if exists {
-			backup[variable] = value
-		}
-	}
-	return func() error {
-		var errs []error
-		for _, variable := range variables {
-			original, exists := backup[variable]
-			if !exists {
-				if err := os.Unsetenv(variable); err != nil {
-					errs = append(errs, err)
-				}
-				continue
-			}
-			if err := os.Setenv(variable, original); err != nil {
-				errs = append(errs, err)
-			}
-		}
-		return errors.Compose(errs...)
-	}
 }
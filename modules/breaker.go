@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// CircuitClosed is the state of a circuit breaker that lets all calls
+	// through.
+	CircuitClosed = "closed"
+
+	// CircuitOpen is the state of a circuit breaker that skips all calls
+	// until its cooldown elapsed.
+	CircuitOpen = "open"
+
+	// CircuitHalfOpen is the state of a circuit breaker that lets a single
+	// probe through after its cooldown elapsed, the outcome of the probe
+	// decides whether the circuit closes or opens again.
+	CircuitHalfOpen = "half-open"
+)
+
+var (
+	// ErrCircuitOpen is returned by CircuitBreaker.Do if the call was skipped
+	// because the circuit is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type (
+	// CircuitBreaker keeps track of the outcome of calls to a dependency. After
+	// a number of consecutive failures it opens and skips calls for a cooldown
+	// period, after which it lets a single probe through. A successful probe
+	// closes the circuit, a failed probe opens it again.
+	CircuitBreaker struct {
+		staticThreshold int
+		staticCooldown  time.Duration
+
+		failures int
+		openedAt time.Time
+		state    string
+
+		staticMu sync.Mutex
+	}
+
+	// CircuitBreakerStatus is a snapshot of the state of a circuit breaker.
+	CircuitBreakerStatus struct {
+		State               string     `json:"state"`
+		ConsecutiveFailures int        `json:"consecutiveFailures"`
+		OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	}
+)
+
+// NewCircuitBreaker returns a closed circuit breaker that opens after the
+// given number of consecutive failures and probes the dependency again after
+// the given cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) (*CircuitBreaker, error) {
+	if threshold <= 0 {
+		return nil, errors.New("threshold should be positive")
+	}
+	if cooldown <= 0 {
+		return nil, errors.New("cooldown should be positive")
+	}
+	return &CircuitBreaker{
+		staticThreshold: threshold,
+		staticCooldown:  cooldown,
+		state:           CircuitClosed,
+	}, nil
+}
+
+// Allow returns whether a call should be made. If the circuit is open and its
+// cooldown elapsed it transitions to half-open and allows a single probe, the
+// caller is expected to report the outcome of every allowed call through
+// Success or Failure.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.staticMu.Lock()
+	defer cb.staticMu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.staticCooldown {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// a probe is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// Do calls the given function if the circuit allows it and records its
+// outcome, it returns ErrCircuitOpen if the call was skipped. Only errors for
+// which the given function returns true count as failures, e.g. to ignore
+// errors that are caused by the caller rather than the dependency. If no
+// function is given every error counts as a failure.
+func (cb *CircuitBreaker) Do(fn func() error, isFailure func(error) bool) error {
+	if !cb.Allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	if err != nil && (isFailure == nil || isFailure(err)) {
+		cb.Failure()
+	} else {
+		cb.Success()
+	}
+	return err
+}
+
+// Failure records a failed call, it opens the circuit if the threshold of
+// consecutive failures is reached or if the call was a probe.
+func (cb *CircuitBreaker) Failure() {
+	cb.staticMu.Lock()
+	defer cb.staticMu.Unlock()
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.staticThreshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// Success records a successful call, it closes the circuit.
+func (cb *CircuitBreaker) Success() {
+	cb.staticMu.Lock()
+	defer cb.staticMu.Unlock()
+
+	cb.failures = 0
+	cb.openedAt = time.Time{}
+	cb.state = CircuitClosed
+}
+
+// Status returns a snapshot of the state of the circuit breaker.
+func (cb *CircuitBreaker) Status() CircuitBreakerStatus {
+	cb.staticMu.Lock()
+	defer cb.staticMu.Unlock()
+
+	status := CircuitBreakerStatus{
+		State:               cb.state,
+		ConsecutiveFailures: cb.failures,
+	}
+	if !cb.openedAt.IsZero() {
+		openedAt := cb.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if status.State == CircuitOpen && time.Since(cb.openedAt) >= cb.staticCooldown {
+		status.State = CircuitHalfOpen
+	}
+	return status
+}
@@ -0,0 +1,129 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestCircuitBreaker verifies the transitions between the closed, open and
+// half-open states of the circuit breaker.
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	// assert invalid breakers are rejected
+	_, err := NewCircuitBreaker(0, time.Second)
+	if err == nil {
+		t.Fatal("expected zero threshold to be rejected")
+	}
+	_, err = NewCircuitBreaker(1, 0)
+	if err == nil {
+		t.Fatal("expected zero cooldown to be rejected")
+	}
+
+	cooldown := 100 * time.Millisecond
+	cb, err := NewCircuitBreaker(3, cooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState := func(state string, failures int) {
+		t.Helper()
+		status := cb.Status()
+		if status.State != state || status.ConsecutiveFailures != failures {
+			t.Fatalf("unexpected status %+v, expected %v with %v failures", status, state, failures)
+		}
+	}
+	assertState(CircuitClosed, 0)
+
+	// assert the circuit stays closed below the threshold and a success resets
+	// the consecutive failures
+	cb.Failure()
+	cb.Failure()
+	assertState(CircuitClosed, 2)
+	cb.Success()
+	assertState(CircuitClosed, 0)
+	if !cb.Allow() {
+		t.Fatal("expected closed circuit to allow calls")
+	}
+
+	// assert the circuit opens at the threshold and skips calls
+	for i := 0; i < 3; i++ {
+		cb.Failure()
+	}
+	assertState(CircuitOpen, 3)
+	if cb.Status().OpenedAt == nil {
+		t.Fatal("expected the time the circuit opened")
+	}
+	if cb.Allow() {
+		t.Fatal("expected open circuit to skip calls")
+	}
+
+	// assert a single probe is let through after the cooldown
+	time.Sleep(cooldown)
+	assertState(CircuitHalfOpen, 3)
+	if !cb.Allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if cb.Allow() {
+		t.Fatal("expected only a single probe")
+	}
+
+	// assert a failed probe opens the circuit again
+	cb.Failure()
+	assertState(CircuitOpen, 4)
+	if cb.Allow() {
+		t.Fatal("expected open circuit to skip calls")
+	}
+
+	// assert a successful probe closes the circuit
+	time.Sleep(cooldown)
+	if !cb.Allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	cb.Success()
+	assertState(CircuitClosed, 0)
+	if cb.Status().OpenedAt != nil {
+		t.Fatal("unexpected opened at")
+	}
+}
+
+// TestCircuitBreakerDo verifies Do records the outcome of the calls it makes
+// and skips calls while the circuit is open.
+func TestCircuitBreakerDo(t *testing.T) {
+	t.Parallel()
+
+	cb, err := NewCircuitBreaker(2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert errors that aren't failures don't open the circuit
+	errCaller := errors.New("caller error")
+	errDependency := errors.New("dependency error")
+	isFailure := func(err error) bool {
+		return errors.Contains(err, errDependency)
+	}
+	for i := 0; i < 3; i++ {
+		err = cb.Do(func() error { return errCaller }, isFailure)
+		if err != errCaller {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	if cb.Status().State != CircuitClosed {
+		t.Fatal("unexpected state", cb.Status().State)
+	}
+
+	// assert failures open the circuit
+	for i := 0; i < 2; i++ {
+		err = cb.Do(func() error { return errDependency }, isFailure)
+		if err != errDependency {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	var called bool
+	err = cb.Do(func() error { called = true; return nil }, isFailure)
+	if err != ErrCircuitOpen || called {
+		t.Fatal("expected the call to be skipped", err, called)
+	}
+}
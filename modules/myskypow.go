@@ -2,15 +2,22 @@ package modules
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"sync"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/build"
 	"github.com/mimoo/GoKangarooTwelve/K12"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -32,9 +39,27 @@ const (
 	// the proof used for hashing and signing.
 	proofVersionV1Byte = mySkyProofVersion(1)
 
+	// proofVersionV2 is the string representation of the second version of
+	// the proof used in the API. Next to the MySkyID and nonce, this version
+	// of the proof includes a challenge issued by the server.
+	proofVersionV2 = "MySkyID-PoW-v2"
+
+	// proofVersionV2Byte is the byte representation of the second version of
+	// the proof used for hashing and signing.
+	proofVersionV2Byte = mySkyProofVersion(2)
+
 	// proofHashSize defines the size of the hash used for the pow
 	// algorithm.
 	proofHashSize = 32
+
+	// challengeSize defines the size of the random challenge value issued by
+	// the server.
+	challengeSize = 32
+
+	// challengeValidity defines how long a challenge remains valid after it
+	// was issued. It bounds the amount of time during which proofs can be
+	// mined in advance.
+	challengeValidity = time.Hour
 )
 
 var (
@@ -44,6 +69,25 @@ var (
 	// errInvalidVersion is returned if the proof has an unexpected version.
 	errInvalidVersion = errors.New("invalid version")
 
+	// errDeprecatedVersion is returned if the proof has a version that is no
+	// longer accepted.
+	errDeprecatedVersion = errors.New("deprecated version, please use " + proofVersionV2)
+
+	// errMissingChallenge is returned if a v2 proof doesn't contain a
+	// challenge.
+	errMissingChallenge = errors.New("missing challenge")
+
+	// errInvalidChallenge is returned if the challenge of a proof has an
+	// unexpected length or was not issued by the server.
+	errInvalidChallenge = errors.New("invalid challenge")
+
+	// errExpiredChallenge is returned if the challenge of a proof has expired.
+	errExpiredChallenge = errors.New("challenge expired")
+
+	// errNoSolution is returned if the solver exhausted all nonces without
+	// finding a proof that meets the target.
+	errNoSolution = errors.New("no solution found")
+
 	// errInsufficientWork is returned if the hash of the byte
 	// representation of the proof doesn't meet the difficulty target.
 	errInsufficientWork = errors.New("insufficient work")
@@ -91,11 +135,76 @@ type (
 //   "myskyid": "c95988a42db14ab3f8742980becfa2018132116d64b085004273de888ea6e44b",
 //   "signature": "cf45f2cf6ce78ae90fdd56e0b3845b977f2926107d5afb366f11e4882955f0f4d5065c7536fb1932fc00c7111c3dfd1a786d06e50b91fe828f05d0587ade990f"
 // }
+//
+// A v2 proof additionally contains the challenge that was issued by the
+// server, exactly as it was returned by the GET /powblock endpoint.
 type BlockPoW struct {
 	Version   mySkyProofVersion `json:"version"`
 	Nonce     mySkyProofNonce   `json:"nonce"`
 	MySkyID   mySkyID           `json:"myskyid"`
 	Signature hexBytes          `json:"signature"`
+	Challenge *PoWChallenge     `json:"challenge,omitempty"`
+}
+
+// PoWChallenge is a random value issued by the server that has to be included
+// in v2 proofs. The challenge expires, which prevents proofs from being mined
+// far in advance and stockpiled. The MAC allows the server to verify it issued
+// the challenge without having to keep track of it.
+type PoWChallenge struct {
+	Challenge hexBytes `json:"challenge"`
+	Expiry    int64    `json:"expiry"`
+	MAC       hexBytes `json:"mac"`
+}
+
+// NewBlockPoW returns an unsolved and unsigned proof for the given MySkyID. If
+// a challenge is given the proof is a v2 proof, otherwise it's a v1 proof.
+func NewBlockPoW(mySkyID ed25519.PublicKey, challenge *PoWChallenge) BlockPoW {
+	p := BlockPoW{
+		Version:   proofVersionV1Byte,
+		Challenge: challenge,
+	}
+	if challenge != nil {
+		p.Version = proofVersionV2Byte
+	}
+	copy(p.MySkyID[:], mySkyID)
+	return p
+}
+
+// NewPoWChallenge returns a new random challenge, signed with the given secret.
+func NewPoWChallenge(secret []byte) *PoWChallenge {
+	c := &PoWChallenge{
+		Challenge: fastrand.Bytes(challengeSize),
+		Expiry:    time.Now().Add(challengeValidity).Unix(),
+	}
+	c.MAC = c.computeMAC(secret)
+	return c
+}
+
+// computeMAC returns the HMAC of the challenge value and its expiry using the
+// given secret.
+func (c *PoWChallenge) computeMAC(secret []byte) []byte {
+	var expiry [8]byte
+	binary.LittleEndian.PutUint64(expiry[:], uint64(c.Expiry))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(c.Challenge)
+	mac.Write(expiry[:])
+	return mac.Sum(nil)
+}
+
+// verify verifies the challenge was signed using the given secret and has not
+// expired at the given time.
+func (c *PoWChallenge) verify(secret []byte, now time.Time) error {
+	if len(c.Challenge) != challengeSize {
+		return errors.AddContext(errInvalidChallenge, fmt.Sprintf("%v != %v", len(c.Challenge), challengeSize))
+	}
+	if !hmac.Equal(c.MAC, c.computeMAC(secret)) {
+		return errInvalidChallenge
+	}
+	if now.Unix() > c.Expiry {
+		return errExpiredChallenge
+	}
+	return nil
 }
 
 // MarshalJSON implements the json.Marshaler interface.
@@ -145,8 +254,10 @@ func (hb *hexBytes) UnmarshalJSON(b []byte) error {
 func (v mySkyProofVersion) MarshalJSON() ([]byte, error) {
 	var versionStr string
 	switch v {
-	case 1:
+	case proofVersionV1Byte:
 		versionStr = proofVersionV1
+	case proofVersionV2Byte:
+		versionStr = proofVersionV2
 	default:
 		return nil, errors.AddContext(errInvalidVersion, fmt.Sprint(v))
 	}
@@ -164,6 +275,8 @@ func (v *mySkyProofVersion) UnmarshalJSON(b []byte) error {
 	switch versionStr {
 	case proofVersionV1:
 		version = proofVersionV1Byte
+	case proofVersionV2:
+		version = proofVersionV2Byte
 	default:
 		return errors.AddContext(errInvalidVersion, fmt.Sprint(v))
 	}
@@ -192,9 +305,14 @@ func (msid *mySkyID) UnmarshalJSON(b []byte) error {
 }
 
 // ProofBytes returns a byte presentation of the MySkyProof which can be hashed
-// to compare to a target and hashed+signed for a signature.
+// to compare to a target and hashed+signed for a signature. For v2 proofs the
+// challenge and its expiry are part of the byte representation.
 func (p *BlockPoW) ProofBytes() []byte {
-	b := make([]byte, 1+len(p.Nonce)+ed25519.PublicKeySize)
+	size := 1 + len(p.Nonce) + ed25519.PublicKeySize
+	if p.hasChallenge() {
+		size += len(p.Challenge.Challenge) + 8
+	}
+	b := make([]byte, size)
 
 	// Set version
 	offset := 0
@@ -207,6 +325,14 @@ func (p *BlockPoW) ProofBytes() []byte {
 
 	// PublicKey
 	copy(b[offset:offset+len(p.MySkyID)], p.MySkyID[:])
+	offset += len(p.MySkyID)
+
+	// Set challenge and expiry
+	if p.hasChallenge() {
+		copy(b[offset:offset+len(p.Challenge.Challenge)], p.Challenge.Challenge)
+		offset += len(p.Challenge.Challenge)
+		binary.LittleEndian.PutUint64(b[offset:offset+8], uint64(p.Challenge.Expiry))
+	}
 
 	return b
 }
@@ -225,15 +351,108 @@ func (p *BlockPoW) PublicKey() ed25519.PublicKey {
 	return ed25519.PublicKey(p.MySkyID[:])
 }
 
-// Verify verifies the proof against the mySkyTarget.
-func (p BlockPoW) Verify() error {
-	return p.verify(MySkyTarget)
+// Sign signs the proof using the given secret key, which should correspond
+// with the proof's MySkyID. The proof should be signed after it was solved.
+func (p *BlockPoW) Sign(sk ed25519.PrivateKey) {
+	p.Signature = ed25519.Sign(sk, p.SignMessage())
+}
+
+// SolveProof solves the pow for the given proof by updating its nonce until
+// the proof meets the given target. It returns an error if the context is
+// cancelled before a solution was found.
+func SolveProof(ctx context.Context, p *BlockPoW, target [proofHashSize]byte) error {
+	return SolveProofParallel(ctx, p, target, 1)
 }
 
-// verify verifies the proof. This includes verifying the signature and then
-// verifying if the work used to create the proof is sufficient to meet the
-// given target.
-func (p BlockPoW) verify(target [proofHashSize]byte) error {
+// SolveProofParallel solves the pow for the given proof using the given
+// number of threads. Every thread tries a distinct set of nonces, the first
+// one to find a solution cancels the others.
+func SolveProofParallel(ctx context.Context, p *BlockPoW, target [proofHashSize]byte, threads int) error {
+	if threads < 1 {
+		threads = 1
+	}
+
+	// create a context that allows us to stop the other threads once a
+	// solution was found
+	solveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var found bool
+	var nonce mySkyProofNonce
+	var once sync.Once
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+
+			// every thread hashes its own copy of the proof bytes, the nonce
+			// directly follows the version byte
+			b := p.ProofBytes()
+			nonceBytes := b[1 : 1+len(nonce)]
+
+			// the loop ends if we run out of nonces and wrap around
+			step := uint64(threads)
+			for i := start; i >= start; i += step {
+				select {
+				case <-solveCtx.Done():
+					return
+				default:
+				}
+
+				binary.LittleEndian.PutUint64(nonceBytes, i)
+				work := hashMySkyProof(b)
+				if bytes.Compare(target[:], work[:]) > 0 {
+					once.Do(func() {
+						found = true
+						copy(nonce[:], nonceBytes)
+						cancel()
+					})
+					return
+				}
+			}
+		}(uint64(t))
+	}
+	wg.Wait()
+
+	if found {
+		p.Nonce = nonce
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errNoSolution
+}
+
+// Verify verifies the proof against the mySkyTarget. The secret is used to
+// verify the challenge of v2 proofs, acceptV1 indicates whether v1 proofs are
+// still accepted.
+func (p BlockPoW) Verify(secret []byte, acceptV1 bool) error {
+	return p.verify(MySkyTarget, secret, acceptV1, time.Now())
+}
+
+// verify verifies the proof. This includes verifying the version, the
+// challenge for v2 proofs, the signature and then verifying if the work used
+// to create the proof is sufficient to meet the given target.
+func (p BlockPoW) verify(target [proofHashSize]byte, secret []byte, acceptV1 bool, now time.Time) error {
+	// Verify the version and challenge.
+	switch p.Version {
+	case proofVersionV1Byte:
+		if !acceptV1 {
+			return errDeprecatedVersion
+		}
+	case proofVersionV2Byte:
+		if p.Challenge == nil {
+			return errMissingChallenge
+		}
+		if err := p.Challenge.verify(secret, now); err != nil {
+			return err
+		}
+	default:
+		return errInvalidVersion
+	}
+
 	// Get the message for signing.
 	msg := p.SignMessage()
 
@@ -252,6 +471,51 @@ func (p BlockPoW) verify(target [proofHashSize]byte) error {
 	return nil
 }
 
+// Difficulty returns the expected number of hash attempts required to find a
+// proof that meets the given target. A proof meets the target when its hash is
+// smaller than the target, so the difficulty is 2^256 divided by the target.
+func Difficulty(target [proofHashSize]byte) *big.Int {
+	space := new(big.Int).Lsh(big.NewInt(1), proofHashSize*8)
+	t := new(big.Int).SetBytes(target[:])
+	if t.Sign() == 0 {
+		// no proof can meet a zero target, return the size of the hash space
+		return space
+	}
+	return space.Div(space, t)
+}
+
+// MeasureHashRate measures the number of proofs that can be hashed per second
+// by hashing proofs for the given duration.
+func MeasureHashRate(d time.Duration) float64 {
+	var p BlockPoW
+	p.Version = proofVersionV1Byte
+	b := p.ProofBytes()
+
+	var hashes uint64
+	start := time.Now()
+	for time.Since(start) < d {
+		binary.LittleEndian.PutUint64(b[1:9], hashes)
+		hashMySkyProof(b)
+		hashes++
+	}
+	return float64(hashes) / time.Since(start).Seconds()
+}
+
+// ProofVersions returns the proof versions currently accepted, acceptV1
+// indicates whether v1 proofs are still accepted.
+func ProofVersions(acceptV1 bool) []string {
+	if acceptV1 {
+		return []string{proofVersionV1, proofVersionV2}
+	}
+	return []string{proofVersionV2}
+}
+
+// hasChallenge returns whether the proof is a v2 proof that contains a
+// challenge.
+func (p *BlockPoW) hasChallenge() bool {
+	return p.Version == proofVersionV2Byte && p.Challenge != nil
+}
+
 // hashMySkyProof is a helper to hash a proof which allows us to swap the
 // hashing algorithm by only updating one function instead of all the places
 // where we call it.
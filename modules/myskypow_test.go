@@ -2,14 +2,16 @@ package modules
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math"
+	"math/big"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
@@ -23,22 +25,6 @@ var (
 	minTarget = [proofHashSize]byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255}
 )
 
-// Solve solves the pow for a given proof.
-func (proof *BlockPoW) Solve(target []byte) {
-	for i := uint64(0); i < math.MaxUint64; i++ {
-		// Update the nonce.
-		binary.LittleEndian.PutUint64(proof.Nonce[:], i)
-
-		// Hash the proof.
-		work := hashMySkyProof(proof.ProofBytes())
-
-		// Compare it to the target.
-		if bytes.Compare(target, work[:]) > 0 {
-			break // done
-		}
-	}
-}
-
 // TestMySkyProof runs all tests related to MySkyProofs.
 func TestMySkyProof(t *testing.T) {
 	t.Parallel()
@@ -67,6 +53,26 @@ func TestMySkyProof(t *testing.T) {
 			name: "Verify",
 			t:    testMySkyProofVerify,
 		},
+		{
+			name: "Challenge",
+			t:    testPoWChallenge,
+		},
+		{
+			name: "MarshalV2",
+			t:    testMySkyProofMarshalV2,
+		},
+		{
+			name: "VerifyV2",
+			t:    testMySkyProofVerifyV2,
+		},
+		{
+			name: "Difficulty",
+			t:    testDifficulty,
+		},
+		{
+			name: "Solve",
+			t:    testSolveProof,
+		},
 	} {
 		t.Run(test.name, test.t)
 	}
@@ -141,6 +147,22 @@ func testMySkyProofVersion(t *testing.T) {
 		t.Fatal("wrong result", validVersion, validVersion2)
 	}
 
+	// Marshal and unmarshal v2.
+	b, err = json.Marshal(proofVersionV2Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != fmt.Sprintf("\"%s\"", proofVersionV2) {
+		t.Fatal("wrong result", string(b))
+	}
+	err = json.Unmarshal(b, &validVersion2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validVersion2 != proofVersionV2Byte {
+		t.Fatal("wrong result", validVersion2)
+	}
+
 	// Unmarshal invalid.
 	invalidVersionStr := "\"invalid\""
 	err = json.Unmarshal([]byte(invalidVersionStr), &validVersion2)
@@ -235,21 +257,268 @@ func testMySkyProofVerify(t *testing.T) {
 
 	// Verify the proof against the smallest target possible. Regardless of
 	// nonce this should always work.
-	if err := validProof.verify(minTarget); err != nil {
+	now := time.Now()
+	if err := validProof.verify(minTarget, nil, true, now); err != nil {
 		t.Fatal(err)
 	}
 
 	// Compare against the largest target. This should never work.
-	if err := validProof.verify(maxTarget); !errors.Contains(err, errInsufficientWork) {
+	if err := validProof.verify(maxTarget, nil, true, now); !errors.Contains(err, errInsufficientWork) {
 		t.Fatal(err)
 	}
 
 	// Compare against the min target but corrupt the signature.
 	invalidProof := validProof
 	invalidProof.Signature = fastrand.Bytes(len(invalidProof.Signature))
-	if err := invalidProof.verify(minTarget); !errors.Contains(err, errInvalidSignature) {
+	if err := invalidProof.verify(minTarget, nil, true, now); !errors.Contains(err, errInvalidSignature) {
+		t.Fatal(err)
+	}
+
+	// Verify the proof once v1 proofs are no longer accepted.
+	if err := validProof.verify(minTarget, nil, false, now); !errors.Contains(err, errDeprecatedVersion) {
+		t.Fatal(err)
+	}
+}
+
+// testPoWChallenge is a unit test for the challenge's verify method.
+func testPoWChallenge(t *testing.T) {
+	secret := fastrand.Bytes(32)
+	now := time.Now()
+
+	// Verify a new challenge.
+	c := NewPoWChallenge(secret)
+	if len(c.Challenge) != challengeSize {
+		t.Fatal("invalid challenge length", len(c.Challenge))
+	}
+	if err := c.verify(secret, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify it using another secret.
+	if err := c.verify(fastrand.Bytes(32), now); !errors.Contains(err, errInvalidChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Verify it after it expired.
+	if err := c.verify(secret, now.Add(challengeValidity+time.Minute)); !errors.Contains(err, errExpiredChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Tamper with the expiry.
+	tampered := *c
+	tampered.Expiry += int64(challengeValidity.Seconds())
+	if err := tampered.verify(secret, now); !errors.Contains(err, errInvalidChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Tamper with the challenge value.
+	tampered = *c
+	tampered.Challenge = fastrand.Bytes(challengeSize)
+	if err := tampered.verify(secret, now); !errors.Contains(err, errInvalidChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Use a challenge with an invalid length.
+	tampered = *c
+	tampered.Challenge = fastrand.Bytes(challengeSize - 1)
+	if err := tampered.verify(secret, now); !errors.Contains(err, errInvalidChallenge) {
+		t.Fatal("should fail", err)
+	}
+}
+
+// testMySkyProofMarshalV2 tests marshaling/unmarshaling a v2 proof to/from
+// json and verifies the challenge is part of the proof bytes.
+func testMySkyProofMarshalV2(t *testing.T) {
+	proof := BlockPoW{
+		Version:   proofVersionV2Byte,
+		Nonce:     mySkyProofNonce{1, 2, 3, 4, 5, 6, 7, 8},
+		Signature: fastrand.Bytes(ed25519.SignatureSize),
+		Challenge: NewPoWChallenge(fastrand.Bytes(32)),
+	}
+	fastrand.Read(proof.MySkyID[:])
+
+	// Marshal
+	b, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), proofVersionV2) || !strings.Contains(string(b), "challenge") {
+		t.Fatal("unexpected json", string(b))
+	}
+
+	// Unmarshal
+	var proof2 BlockPoW
+	err = json.Unmarshal(b, &proof2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare
+	if !bytes.Equal(proof.ProofBytes(), proof2.ProofBytes()) {
+		t.Fatal("proof bytes mismatch")
+	}
+	if !bytes.Equal(proof.Challenge.MAC, proof2.Challenge.MAC) {
+		t.Fatal("mac mismatch")
+	}
+
+	// Check the proof bytes contain the challenge and expiry.
+	proofBytes := proof.ProofBytes()
+	if len(proofBytes) != 41+challengeSize+8 {
+		t.Fatal("invalid length", len(proofBytes))
+	}
+	if !bytes.Equal(proofBytes[41:41+challengeSize], proof.Challenge.Challenge) {
+		t.Fatal("challenge not part of the proof bytes")
+	}
+	if binary.LittleEndian.Uint64(proofBytes[41+challengeSize:]) != uint64(proof.Challenge.Expiry) {
+		t.Fatal("expiry not part of the proof bytes")
+	}
+
+	// Assert v1 proofs don't marshal a challenge.
+	proof.Version = proofVersionV1Byte
+	proof.Challenge = nil
+	b, err = json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "challenge") {
+		t.Fatal("unexpected json", string(b))
+	}
+}
+
+// testMySkyProofVerifyV2 is a unit test for the Verify method of v2 proofs.
+func testMySkyProofVerifyV2(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(fastrand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msid mySkyID
+	copy(msid[:], pk)
+
+	// Create a signed proof with a challenge.
+	secret := fastrand.Bytes(32)
+	proof := BlockPoW{
+		Version:   proofVersionV2Byte,
+		MySkyID:   msid,
+		Challenge: NewPoWChallenge(secret),
+	}
+	proof.Signature = ed25519.Sign(sk, proof.SignMessage())
+
+	// Verify the proof, v2 proofs should be accepted regardless of whether v1
+	// proofs are accepted.
+	now := time.Now()
+	if err := proof.verify(minTarget, secret, false, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.verify(minTarget, secret, true, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify it using another secret.
+	if err := proof.verify(minTarget, fastrand.Bytes(32), false, now); !errors.Contains(err, errInvalidChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Verify it after the challenge expired.
+	if err := proof.verify(minTarget, secret, false, now.Add(2*challengeValidity)); !errors.Contains(err, errExpiredChallenge) {
+		t.Fatal("should fail", err)
+	}
+
+	// Swap the challenge for another valid one, the signature should no
+	// longer match since the challenge is part of the proof bytes.
+	swapped := proof
+	swapped.Challenge = NewPoWChallenge(secret)
+	if err := swapped.verify(minTarget, secret, false, now); !errors.Contains(err, errInvalidSignature) {
+		t.Fatal("should fail", err)
+	}
+
+	// Remove the challenge.
+	swapped.Challenge = nil
+	if err := swapped.verify(minTarget, secret, false, now); !errors.Contains(err, errMissingChallenge) {
+		t.Fatal("should fail", err)
+	}
+}
+
+// testDifficulty is a unit test for the Difficulty helper.
+func testDifficulty(t *testing.T) {
+	// shiftedTarget returns a target with a single bit set at the given
+	// position counting from the most significant bit.
+	shiftedTarget := func(bit int) (target [proofHashSize]byte) {
+		target[bit/8] = 0x80 >> (bit % 8)
+		return
+	}
+
+	tests := []struct {
+		target   [proofHashSize]byte
+		expected string
+	}{
+		// a target of 2^255 is met by half the hashes
+		{shiftedTarget(0), "2"},
+		// a target of 2^231 requires 2^25 attempts
+		{shiftedTarget(24), "33554432"},
+		// the lowest difficulty
+		{minTarget, "1"},
+		// a zero target can never be met, we return the size of the hash space
+		{maxTarget, new(big.Int).Lsh(big.NewInt(1), 256).String()},
+		// the testing target requires about 2^16 attempts
+		{[proofHashSize]byte{0, 0, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255}, "65536"},
+		// the standard target requires about 7 million attempts
+		{[proofHashSize]byte{0, 0, 2, 85, 134, 217, 6, 168, 28, 68, 106, 164, 207, 53, 55, 178, 24, 81, 162, 117, 144, 30, 90, 200, 147, 120, 124, 181, 32, 216, 184, 223}, "7187907"},
+	}
+	for _, test := range tests {
+		d := Difficulty(test.target)
+		if d.String() != test.expected {
+			t.Fatalf("unexpected difficulty for target %x, %v != %v", test.target, d, test.expected)
+		}
+	}
+
+	// assert a lower target means a higher difficulty
+	if Difficulty(shiftedTarget(10)).Cmp(Difficulty(shiftedTarget(9))) <= 0 {
+		t.Fatal("expected difficulty to increase when the target decreases")
+	}
+}
+
+// testSolveProof is a unit test for the SolveProof and SolveProofParallel
+// helpers.
+func testSolveProof(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(fastrand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// trivialTarget is met by roughly 1 in 256 hashes
+	var trivialTarget [proofHashSize]byte
+	trivialTarget[0] = 1
+
+	// solve a v1 proof, sign it and assert it verifies
+	proof := NewBlockPoW(pk, nil)
+	err = SolveProof(context.Background(), &proof, trivialTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof.Sign(sk)
+	if err := proof.verify(trivialTarget, nil, true, time.Now()); err != nil {
 		t.Fatal(err)
 	}
+
+	// solve a v2 proof using multiple threads and assert it verifies
+	secret := fastrand.Bytes(32)
+	proof = NewBlockPoW(pk, NewPoWChallenge(secret))
+	err = SolveProofParallel(context.Background(), &proof, trivialTarget, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof.Sign(sk)
+	if err := proof.verify(trivialTarget, secret, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the solver respects cancellation, the max target can't be met
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = SolveProofParallel(ctx, &proof, maxTarget, 2)
+	if !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error", err)
+	}
 }
 
 // TestFindTarget is a test that can be run to identify a good target on a given
@@ -270,7 +539,7 @@ func testMySkyProofVerify(t *testing.T) {
 //	maxDiffDecrease := big.NewRat(9998, 10000)  // 0.02%
 //	for {
 //		start := time.Now()
-//		proof.Solve(target[:])
+//		SolveProof(context.Background(), &proof, target)
 //		d := time.Since(start)
 //		fmt.Println("duration", d, target)
 //
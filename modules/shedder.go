@@ -0,0 +1,141 @@
+package modules
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// ShedNone is the tier of a load shedder that admits all requests.
+	ShedNone = "none"
+
+	// ShedNonCritical is the tier of a load shedder that rejects non-critical
+	// requests, e.g. listing the blocklist, but still admits critical ones,
+	// e.g. reports.
+	ShedNonCritical = "noncritical"
+
+	// ShedAll is the tier of a load shedder that rejects all requests.
+	ShedAll = "all"
+
+	// minShedSamples is the minimum number of latencies a load shedder needs
+	// within its window before it starts shedding, this prevents a single
+	// slow operation from shedding load.
+	minShedSamples = 5
+)
+
+type (
+	// LoadShedder keeps track of the latency of database operations within a
+	// rolling window and decides which requests to admit based on its 95th
+	// percentile. Above the first threshold non-critical requests are shed,
+	// above the second threshold all requests are. Latencies that fall out
+	// of the window are forgotten, so the shedder recovers once the database
+	// does, even if no requests are admitted in the meantime.
+	LoadShedder struct {
+		staticNonCriticalThreshold time.Duration
+		staticAllThreshold         time.Duration
+		staticWindow               time.Duration
+
+		// samples is a ring buffer of the most recent latencies, next is the
+		// index the next latency gets written to.
+		samples []latencySample
+		next    int
+
+		staticMu sync.Mutex
+	}
+
+	// LoadShedderStatus is a snapshot of the state of a load shedder.
+	LoadShedderStatus struct {
+		Tier       string  `json:"tier"`
+		P95Seconds float64 `json:"p95Seconds"`
+		Samples    int     `json:"samples"`
+	}
+
+	// latencySample is a latency along with the time it was observed.
+	latencySample struct {
+		staticAt      time.Time
+		staticLatency time.Duration
+	}
+)
+
+// NewLoadShedder returns a load shedder that sheds non-critical requests when
+// the 95th percentile of the latencies observed within the given window
+// exceeds the first threshold, and all requests when it exceeds the second
+// one. At most maxSamples latencies are kept.
+func NewLoadShedder(nonCriticalThreshold, allThreshold, window time.Duration, maxSamples int) (*LoadShedder, error) {
+	if nonCriticalThreshold <= 0 {
+		return nil, errors.New("threshold should be positive")
+	}
+	if allThreshold <= nonCriticalThreshold {
+		return nil, errors.New("threshold to shed all requests should exceed the threshold to shed non-critical ones")
+	}
+	if window <= 0 {
+		return nil, errors.New("window should be positive")
+	}
+	if maxSamples < minShedSamples {
+		return nil, errors.New("too few samples")
+	}
+	return &LoadShedder{
+		staticNonCriticalThreshold: nonCriticalThreshold,
+		staticAllThreshold:         allThreshold,
+		staticWindow:               window,
+		samples:                    make([]latencySample, 0, maxSamples),
+	}, nil
+}
+
+// Observe records the latency of a database operation.
+func (ls *LoadShedder) Observe(latency time.Duration) {
+	ls.staticMu.Lock()
+	defer ls.staticMu.Unlock()
+
+	sample := latencySample{staticAt: time.Now(), staticLatency: latency}
+	if len(ls.samples) < cap(ls.samples) {
+		ls.samples = append(ls.samples, sample)
+		return
+	}
+	ls.samples[ls.next] = sample
+	ls.next = (ls.next + 1) % len(ls.samples)
+}
+
+// Tier returns the current tier of the load shedder, which is one of ShedNone,
+// ShedNonCritical and ShedAll.
+func (ls *LoadShedder) Tier() string {
+	return ls.Status().Tier
+}
+
+// Status returns a snapshot of the state of the load shedder.
+func (ls *LoadShedder) Status() LoadShedderStatus {
+	ls.staticMu.Lock()
+	defer ls.staticMu.Unlock()
+
+	// collect the latencies within the window
+	cutoff := time.Now().Add(-ls.staticWindow)
+	latencies := make([]time.Duration, 0, len(ls.samples))
+	for _, sample := range ls.samples {
+		if sample.staticAt.After(cutoff) {
+			latencies = append(latencies, sample.staticLatency)
+		}
+	}
+	status := LoadShedderStatus{Tier: ShedNone, Samples: len(latencies)}
+	if len(latencies) == 0 {
+		return status
+	}
+
+	// compute the 95th percentile
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	p95 := latencies[(len(latencies)*95+99)/100-1]
+	status.P95Seconds = p95.Seconds()
+
+	switch {
+	case len(latencies) < minShedSamples:
+	case p95 > ls.staticAllThreshold:
+		status.Tier = ShedAll
+	case p95 > ls.staticNonCriticalThreshold:
+		status.Tier = ShedNonCritical
+	}
+	return status
+}
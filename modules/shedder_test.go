@@ -0,0 +1,89 @@
+package modules
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLoadShedder verifies the load shedder moves between its tiers based on
+// the 95th percentile of the latencies within its window.
+func TestLoadShedder(t *testing.T) {
+	t.Parallel()
+
+	// assert invalid shedders are rejected
+	tests := []struct {
+		name        string
+		nonCritical time.Duration
+		all         time.Duration
+		window      time.Duration
+		samples     int
+	}{
+		{"NoThreshold", 0, time.Second, time.Second, 100},
+		{"AllBelowNonCritical", time.Second, time.Second, time.Second, 100},
+		{"NoWindow", time.Second, 2 * time.Second, 0, 100},
+		{"TooFewSamples", time.Second, 2 * time.Second, time.Second, minShedSamples - 1},
+	}
+	for _, test := range tests {
+		_, err := NewLoadShedder(test.nonCritical, test.all, test.window, test.samples)
+		if err == nil {
+			t.Fatalf("%v: expected error", test.name)
+		}
+	}
+
+	window := 200 * time.Millisecond
+	ls, err := NewLoadShedder(time.Second, 5*time.Second, window, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTier := func(tier string) {
+		t.Helper()
+		if status := ls.Status(); status.Tier != tier {
+			t.Fatalf("unexpected status %+v, expected tier %v", status, tier)
+		}
+	}
+	observe := func(latency time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			ls.Observe(latency)
+		}
+	}
+	assertTier(ShedNone)
+
+	// assert a single slow operation doesn't shed load
+	observe(10*time.Second, 1)
+	assertTier(ShedNone)
+
+	// assert fast operations outweigh the slow one below the 95th percentile
+	observe(10*time.Millisecond, 19)
+	assertTier(ShedNone)
+	if ls.Status().Samples != 20 {
+		t.Fatal("unexpected number of samples", ls.Status().Samples)
+	}
+
+	// assert slow operations that push the 95th percentile above the first
+	// threshold shed non-critical requests, the ring buffer holds the last 20
+	// latencies so the oldest ones get overwritten
+	observe(2*time.Second, 5)
+	assertTier(ShedNonCritical)
+	if p95 := ls.Status().P95Seconds; p95 != 2 {
+		t.Fatal("unexpected p95", p95)
+	}
+
+	// assert operations above the second threshold shed everything
+	observe(6*time.Second, 10)
+	assertTier(ShedAll)
+
+	// assert the shedder recovers once the latencies fall out of the window
+	time.Sleep(window)
+	assertTier(ShedNone)
+	if ls.Status().Samples != 0 {
+		t.Fatal("unexpected number of samples", ls.Status().Samples)
+	}
+
+	// assert it recovers as fast operations replace the slow ones
+	observe(6*time.Second, 10)
+	assertTier(ShedAll)
+	observe(time.Millisecond, 9)
+	assertTier(ShedAll)
+	observe(time.Millisecond, 10)
+	assertTier(ShedNone)
+}
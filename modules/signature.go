@@ -0,0 +1,103 @@
+package modules
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// SignatureHeader is the header that holds the hex encoded HMAC-SHA256
+	// signature of a signed request.
+	SignatureHeader = "X-Blocker-Signature"
+
+	// SignatureKeyIDHeader is the header that holds the id of the API key of
+	// which the secret signed the request.
+	SignatureKeyIDHeader = "X-Blocker-Key-Id"
+
+	// SignatureTimestampHeader is the header that holds the unix timestamp, in
+	// seconds, at which the request was signed.
+	SignatureTimestampHeader = "X-Blocker-Timestamp"
+
+	// SignatureWindow is the maximum difference between the time a request
+	// was signed and the time it's verified, in either direction. Signatures
+	// outside of the window are rejected to prevent replaying requests.
+	SignatureWindow = 5 * time.Minute
+)
+
+var (
+	// ErrSignatureExpired is returned when the timestamp of a signed request
+	// is outside of the signature window.
+	ErrSignatureExpired = errors.New("signature timestamp is outside of the allowed window")
+
+	// ErrSignatureInvalid is returned when the signature of a request doesn't
+	// match the signature computed over the request.
+	ErrSignatureInvalid = errors.New("invalid signature")
+)
+
+// Signature returns the hex encoded HMAC-SHA256 signature, using the given
+// secret, over the timestamp, method, target and body of a request. The target
+// is the path of the request, followed by its query if it has one, see
+// SignatureTarget. The fields are separated by a newline so they can't be
+// shifted into one another.
+func Signature(secret string, timestamp int64, method, target string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	_, _ = mac.Write([]byte("\n" + method + "\n" + target + "\n"))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureTarget returns the target of the given url that gets signed, that's
+// its path followed by its raw query if it has one. The query is signed so
+// query parameters, e.g. the sub of the reporter, can't be altered.
+func SignatureTarget(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// SignRequest signs the given request with the secret of the API key with the
+// given id, the body has to be the body of the request. It sets the signature,
+// key id and timestamp headers.
+func SignRequest(req *http.Request, keyID, secret string, body []byte, now time.Time) {
+	timestamp := now.Unix()
+	req.Header.Set(SignatureKeyIDHeader, keyID)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Signature(secret, timestamp, req.Method, SignatureTarget(req.URL), body))
+}
+
+// VerifySignature verifies the signature of the given request, which has to be
+// signed with the given secret at most SignatureWindow away from the given
+// time. The body has to be the body of the request.
+func VerifySignature(req *http.Request, secret string, body []byte, now time.Time) error {
+	timestamp, err := strconv.ParseInt(req.Header.Get(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return errors.AddContext(ErrSignatureInvalid, "invalid timestamp")
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > SignatureWindow || skew < -SignatureWindow {
+		return ErrSignatureExpired
+	}
+	expected, err := hex.DecodeString(Signature(secret, timestamp, req.Method, SignatureTarget(req.URL), body))
+	if err != nil {
+		return errors.AddContext(err, "failed to decode expected signature")
+	}
+	actual, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil || !hmac.Equal(actual, expected) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// IsSigned returns true if the given request carries a signature.
+func IsSigned(req *http.Request) bool {
+	return req.Header.Get(SignatureHeader) != ""
+}
@@ -0,0 +1,68 @@
+package modules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestVerifySignature verifies signed requests are only accepted with the
+// secret they were signed with, within the signature window and if they
+// weren't altered after they were signed.
+func TestVerifySignature(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	body := []byte(`{"hash":"abc"}`)
+	sign := func(signedAt time.Time) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/block?sub=alice", nil)
+		SignRequest(req, "scanner", "secret", body, signedAt)
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		mutate func(req *http.Request) []byte
+		secret string
+		err    error
+	}{
+		{"Valid", sign(now), nil, "secret", nil},
+		{"SkewWithinWindow", sign(now.Add(SignatureWindow - time.Second)), nil, "secret", nil},
+		{"Expired", sign(now.Add(-SignatureWindow - time.Second)), nil, "secret", ErrSignatureExpired},
+		{"Future", sign(now.Add(SignatureWindow + time.Second)), nil, "secret", ErrSignatureExpired},
+		{"WrongSecret", sign(now), nil, "other", ErrSignatureInvalid},
+		{"TamperedBody", sign(now), func(*http.Request) []byte { return []byte(`{"hash":"abd"}`) }, "secret", ErrSignatureInvalid},
+		{"TamperedMethod", sign(now), func(req *http.Request) []byte { req.Method = http.MethodPut; return body }, "secret", ErrSignatureInvalid},
+		{"TamperedPath", sign(now), func(req *http.Request) []byte { req.URL.Path = "/powblock"; return body }, "secret", ErrSignatureInvalid},
+		{"TamperedQuery", sign(now), func(req *http.Request) []byte { req.URL.RawQuery = "sub=bob"; return body }, "secret", ErrSignatureInvalid},
+		{"DroppedQuery", sign(now), func(req *http.Request) []byte { req.URL.RawQuery = ""; return body }, "secret", ErrSignatureInvalid},
+		{"TamperedTimestamp", sign(now.Add(-time.Minute)), func(req *http.Request) []byte {
+			req.Header.Set(SignatureTimestampHeader, req.Header.Get(SignatureTimestampHeader)+"0")
+			return body
+		}, "secret", ErrSignatureExpired},
+		{"NoTimestamp", sign(now), func(req *http.Request) []byte { req.Header.Del(SignatureTimestampHeader); return body }, "secret", ErrSignatureInvalid},
+		{"NotHex", sign(now), func(req *http.Request) []byte { req.Header.Set(SignatureHeader, "signature"); return body }, "secret", ErrSignatureInvalid},
+	}
+	for _, test := range tests {
+		b := body
+		if test.mutate != nil {
+			b = test.mutate(test.req)
+		}
+		err := VerifySignature(test.req, test.secret, b, now)
+		if test.err == nil && err != nil {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		if test.err != nil && !errors.Contains(err, test.err) {
+			t.Fatalf("%v: unexpected error %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	// assert unsigned requests are recognized
+	if IsSigned(httptest.NewRequest(http.MethodPost, "/block", nil)) || !IsSigned(sign(now)) {
+		t.Fatal("unexpected")
+	}
+}
@@ -0,0 +1,190 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+const (
+	// MaxSkylinkInputSize is the maximum size, in bytes, of the strings we
+	// extract skylinks from. A url containing a skylink is far smaller, this
+	// bounds the work done for every report.
+	MaxSkylinkInputSize = 2 << 10
+
+	// base32SkylinkSize is the length of a base32 encoded skylink.
+	base32SkylinkSize = 55
+
+	// base64SkylinkSize is the length of a base64 encoded skylink.
+	base64SkylinkSize = 46
+)
+
+const (
+	// SkylinkFormHash is the form of a report that carries the hash of the
+	// skylink rather than the skylink itself.
+	SkylinkFormHash = "hash"
+
+	// SkylinkFormMerkleRoot is the form of a report that carries the merkle
+	// root of the content rather than a skylink.
+	SkylinkFormMerkleRoot = "merkleroot"
+
+	// SkylinkFormSkylink is the form of a bare skylink, optionally prefixed
+	// with the 'sia://' protocol.
+	SkylinkFormSkylink = "skylink"
+
+	// SkylinkFormURL is the form of a url that carries the skylink in its
+	// path, query or fragment.
+	SkylinkFormURL = "url"
+
+	// SkylinkFormSubdomain is the form of a url that carries a base32 skylink
+	// in its subdomain.
+	SkylinkFormSubdomain = "subdomain"
+)
+
+// SkylinkForms are all the forms in which a hash or skylink can be reported.
+var SkylinkForms = []string{
+	SkylinkFormHash,
+	SkylinkFormMerkleRoot,
+	SkylinkFormSkylink,
+	SkylinkFormURL,
+	SkylinkFormSubdomain,
+}
+
+// NormalizeSkylink extracts the skylink from the given string, which might be
+// a url containing the skylink, and returns it in its base64 encoding. This
+// ensures the same skylink is always represented the same way, regardless of
+// whether it was reported in base32 or base64.
+func NormalizeSkylink(str string) (string, error) {
+	link, _, err := NormalizeSkylinkForm(str)
+	return link, err
+}
+
+// NormalizeSkylinkForm is NormalizeSkylink but it also returns the form the
+// skylink was found in, see SkylinkForms. If the skylink fails to decode the
+// error describes what the value looked like.
+func NormalizeSkylinkForm(str string) (string, string, error) {
+	link, form, err := ExtractSkylinkForm(str)
+	if err != nil {
+		return "", "", err
+	}
+	var sl skymodules.Skylink
+	err = sl.LoadString(link)
+	if err != nil {
+		return "", "", errors.AddContext(err, fmt.Sprintf("invalid skylink provided, the value looked like %v but failed to decode", describeSkylinkForm(link, form)))
+	}
+	return sl.String(), form, nil
+}
+
+// ExtractSkylink extracts the skylink from the given string, which might
+// contain a protocol, a portal domain, a path, etc. A base32 skylink takes
+// precedence over a base64 one, e.g. when it's used as the subdomain of a url
+// of which the path looks like a base64 skylink. The string is scanned once
+// per encoding, strings that exceed MaxSkylinkInputSize are rejected.
+func ExtractSkylink(str string) (string, error) {
+	link, _, err := ExtractSkylinkForm(str)
+	return link, err
+}
+
+// ExtractSkylinkForm is ExtractSkylink but it also returns the form the
+// skylink was found in, see SkylinkForms.
+func ExtractSkylinkForm(str string) (string, string, error) {
+	if len(str) > MaxSkylinkInputSize {
+		return "", "", fmt.Errorf("string exceeds the maximum size of %d bytes", MaxSkylinkInputSize)
+	}
+
+	// the last base32 skylink wins, this matches urls that carry it in the
+	// subdomain
+	var base32 string
+	scanRuns(str, isBase32Char, func(run string) bool {
+		if len(run) >= base32SkylinkSize {
+			base32 = run[len(run)-base32SkylinkSize:]
+		}
+		return true
+	})
+	if base32 != "" {
+		return base32, skylinkForm(str, base32), nil
+	}
+
+	// the first base64 skylink wins, this matches urls that carry it in the
+	// path
+	var base64 string
+	scanRuns(str, isBase64Char, func(run string) bool {
+		if len(run) >= base64SkylinkSize {
+			base64 = run[:base64SkylinkSize]
+			return false
+		}
+		return true
+	})
+	if base64 != "" {
+		return base64, skylinkForm(str, base64), nil
+	}
+	return "", "", errors.New("no valid skylink found in string " + str)
+}
+
+// skylinkForm returns the form of the given string the given skylink was
+// extracted from. A base32 skylink that's followed by a dot is considered to
+// be the subdomain of a url.
+func skylinkForm(str, link string) string {
+	if strings.TrimPrefix(strings.TrimSpace(str), "sia://") == link {
+		return SkylinkFormSkylink
+	}
+	if len(link) == base32SkylinkSize {
+		end := strings.LastIndex(str, link) + len(link)
+		if end < len(str) && str[end] == '.' {
+			return SkylinkFormSubdomain
+		}
+	}
+	return SkylinkFormURL
+}
+
+// describeSkylinkForm returns a human readable description of the given
+// skylink and the form it was found in, it's used in validation errors.
+func describeSkylinkForm(link, form string) string {
+	encoding := "base64"
+	if len(link) == base32SkylinkSize {
+		encoding = "base32"
+	}
+	switch form {
+	case SkylinkFormSubdomain:
+		return fmt.Sprintf("a url with a %v skylink as subdomain", encoding)
+	case SkylinkFormURL:
+		return fmt.Sprintf("a url containing a %v skylink", encoding)
+	default:
+		return fmt.Sprintf("a %v skylink", encoding)
+	}
+}
+
+// scanRuns calls the given function for every maximal run of consecutive
+// characters in the given string that satisfy the given predicate, in order,
+// until the function returns false.
+func scanRuns(str string, valid func(c byte) bool, fn func(run string) bool) {
+	start := -1
+	for i := 0; i <= len(str); i++ {
+		if i < len(str) && valid(str[i]) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			if !fn(str[start:i]) {
+				return
+			}
+			start = -1
+		}
+	}
+}
+
+// isBase32Char returns whether the given character can be part of a base32
+// encoded skylink.
+func isBase32Char(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+}
+
+// isBase64Char returns whether the given character can be part of a base64
+// encoded skylink, which uses the url safe alphabet.
+func isBase64Char(c byte) bool {
+	return isBase32Char(c) || (c >= 'A' && c <= 'Z') || c == '-' || c == '_'
+}
@@ -0,0 +1,151 @@
+package modules
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	// legacyExtractSkylinkRE is the regular expression ExtractSkylink used
+	// before it scanned the string itself, it's kept to verify the behavior
+	// didn't change and to compare the performance.
+	legacyExtractSkylinkRE = regexp.MustCompile("^.*([a-z0-9]{55})|([a-zA-Z0-9-_]{46}).*$")
+)
+
+// TestNormalizeSkylink is a unit test for NormalizeSkylink.
+func TestNormalizeSkylink(t *testing.T) {
+	t.Parallel()
+
+	base64 := "BAAWi3ou51qCH24Im0ESS-5_gKg60qGIYtta-ryrl1kBnQ"
+	base32 := "0g01d2rq5rjll0gvdo49mg8i9fn7v0587b9a3232rddflf5bitcg378"
+	tests := []struct {
+		name     string
+		skylink  string
+		expected string
+		form     string
+		valid    bool
+	}{
+		{"Base64", base64, base64, SkylinkFormSkylink, true},
+		{"Base64URL", "https://siasky.net/" + base64 + "/index.html", base64, SkylinkFormURL, true},
+		{"Base32", base32, base64, SkylinkFormSkylink, true},
+		{"Base32Subdomain", "https://" + base32 + ".siasky.net/index.html", base64, SkylinkFormSubdomain, true},
+		{"Base64Path", "/" + base64, base64, SkylinkFormURL, true},
+		{"Base64Query", "https://siasky.net/?skylink=" + base64 + "&foo=bar", base64, SkylinkFormURL, true},
+		{"Base64Fragment", "https://siasky.net/#/" + base64, base64, SkylinkFormURL, true},
+		{"Base64Sia", "sia://" + base64, base64, SkylinkFormSkylink, true},
+		{"Base64Whitespace", " \t" + base64 + "\n", base64, SkylinkFormSkylink, true},
+		{"Base32URL", "https://siasky.net/" + base32, base64, SkylinkFormURL, true},
+		{"Base32Sia", "sia://" + base32, base64, SkylinkFormSkylink, true},
+		{"Base32OverBase64", "https://" + base32 + ".siasky.net/" + base64, base64, SkylinkFormSubdomain, true},
+		{"Invalid", "not a skylink", "", "", false},
+		{"Empty", "", "", "", false},
+		{"TooLarge", "https://siasky.net/" + base64 + "/" + strings.Repeat("a", MaxSkylinkInputSize), "", "", false},
+		{"InvalidBase64", "https://siasky.net/" + base64[:45] + "!", "", "", false},
+	}
+	for _, test := range tests {
+		skylink, form, err := NormalizeSkylinkForm(test.skylink)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		if skylink != test.expected {
+			t.Fatalf("%v: unexpected skylink, %v != %v", test.name, skylink, test.expected)
+		}
+		if form != test.form {
+			t.Fatalf("%v: unexpected form, %v != %v", test.name, form, test.form)
+		}
+		normalized, err := NormalizeSkylink(test.skylink)
+		if (err == nil) != test.valid || normalized != skylink {
+			t.Fatalf("%v: unexpected skylink %v, err: %v", test.name, normalized, err)
+		}
+	}
+}
+
+// TestNormalizeSkylinkError verifies the error of a skylink that fails to
+// decode describes what the value looked like.
+func TestNormalizeSkylinkError(t *testing.T) {
+	t.Parallel()
+
+	// 'z' is not part of the base32 alphabet, a bitfield of all ones is not a
+	// valid skylink version
+	base32 := strings.Repeat("z", base32SkylinkSize)
+	base64 := strings.Repeat("_", base64SkylinkSize)
+	tests := []struct {
+		name     string
+		skylink  string
+		expected string
+	}{
+		{"Base32", base32, "the value looked like a base32 skylink but failed to decode"},
+		{"Base64", "sia://" + base64, "the value looked like a base64 skylink but failed to decode"},
+		{"Base32URL", "https://siasky.net/" + base32, "the value looked like a url containing a base32 skylink but failed to decode"},
+		{"Base64URL", "https://siasky.net/" + base64, "the value looked like a url containing a base64 skylink but failed to decode"},
+		{"Base32Subdomain", "https://" + base32 + ".siasky.net", "the value looked like a url with a base32 skylink as subdomain but failed to decode"},
+	}
+	for _, test := range tests {
+		_, _, err := NormalizeSkylinkForm(test.skylink)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// TestExtractSkylink verifies ExtractSkylink extracts the same skylink as the
+// regular expression it replaced.
+func TestExtractSkylink(t *testing.T) {
+	t.Parallel()
+
+	base64 := "BAAWi3ou51qCH24Im0ESS-5_gKg60qGIYtta-ryrl1kBnQ"
+	base32 := "0g01d2rq5rjll0gvdo49mg8i9fn7v0587b9a3232rddflf5bitcg378"
+	inputs := []string{
+		base64,
+		base32,
+		"https://siasky.net/" + base64 + "/index.html",
+		"https://" + base32 + ".siasky.net/index.html",
+		"https://" + base32 + ".siasky.net/" + base64,
+		base64 + base64,
+		base32 + base32,
+		"x" + base32 + "x",
+		strings.ToUpper(base32),
+		base64[:45],
+		base32[:54],
+		"not a skylink",
+		"",
+	}
+	for _, input := range inputs {
+		var expected string
+		m := legacyExtractSkylinkRE.FindStringSubmatch(input)
+		if len(m) == 3 && m[1] != "" {
+			expected = m[1]
+		} else if len(m) == 3 {
+			expected = m[2]
+		}
+		skylink, err := ExtractSkylink(input)
+		if (err == nil) != (expected != "") || skylink != expected {
+			t.Fatalf("unexpected skylink for '%v', %v != %v, err: %v", input, skylink, expected, err)
+		}
+	}
+}
+
+// BenchmarkExtractSkylink compares ExtractSkylink to the regular expression it
+// replaced on pathological inputs of the maximum size.
+func BenchmarkExtractSkylink(b *testing.B) {
+	inputs := map[string]string{
+		"Lowercase":  strings.Repeat("a", MaxSkylinkInputSize),
+		"ShortRuns":  strings.Repeat(strings.Repeat("a", 54)+".", MaxSkylinkInputSize/55),
+		"Separators": strings.Repeat("/", MaxSkylinkInputSize),
+	}
+	for name, input := range inputs {
+		b.Run(name+"/Scan", func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				_, _ = ExtractSkylink(input)
+			}
+		})
+		b.Run(name+"/Regexp", func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				_ = legacyExtractSkylinkRE.FindStringSubmatch(input)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+// Package pusher implements the push mode of the blocker. Where the syncer
+// periodically pulls the blocklists of other portals, the pusher actively
+// pushes every new report to a set of peer blockers, which cuts the time it
+// takes for critical content to be blocked across portals.
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/blocker/client"
+	"github.com/SkynetLabs/blocker/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+const (
+	// maxDeadLetters is the maximum number of dead letters we keep per peer,
+	// when it's exceeded the oldest ones are dropped.
+	maxDeadLetters = 1000
+
+	// queueSize is the number of reports that can be queued per peer, when
+	// the queue is full new reports end up in the dead letters.
+	queueSize = 1000
+
+	// stopTimeoutDuration is the default amount of time we wait when stop is
+	// called before cancelling out and returning with an error indicating an
+	// unclean shutdown.
+	stopTimeoutDuration = time.Minute
+)
+
+var (
+	// pushRetries is the default number of times a push is retried when the
+	// peer responds with a server error or is unreachable.
+	pushRetries = build.Select(
+		build.Var{
+			Dev:      3,
+			Testing:  1,
+			Standard: 5,
+		},
+	).(int)
+
+	// pushRetryBackoff is the default amount of time we wait before retrying
+	// a push, it doubles after every attempt.
+	pushRetryBackoff = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  10 * time.Millisecond,
+			Standard: 2 * time.Second,
+		},
+	).(time.Duration)
+
+	// errQueueFull is the error recorded on dead letters of reports that
+	// couldn't be queued because the peer's queue was full.
+	errQueueFull = errors.New("push queue is full")
+)
+
+type (
+	// Peer is a blocker we push our reports to.
+	Peer struct {
+		URL    string `json:"url"`
+		APIKey string `json:"apiKey"`
+	}
+
+	// Pusher pushes newly reported hashes to a configured set of peer
+	// blockers. Reports that were pushed to us, or synced from another
+	// portal, are never pushed to avoid them echoing between blockers.
+	Pusher struct {
+		started bool
+
+		// deadLetters holds the reports that could not be pushed, per peer.
+		deadLetters map[string][]DeadLetter
+
+		// pushed is the number of successful pushes, per peer.
+		pushed map[string]uint64
+
+		staticLogger       *logrus.Entry
+		staticMu           sync.Mutex
+		staticOwnPortalURL string
+		staticPeers        []*peer
+		staticRetries      int
+		staticRetryBackoff time.Duration
+
+		staticStopChan    chan struct{}
+		staticStopTimeout time.Duration
+		staticWaitGroup   sync.WaitGroup
+	}
+
+	// Option configures a Pusher.
+	Option func(*Pusher)
+
+	// DeadLetter is a report that could not be pushed to a peer.
+	DeadLetter struct {
+		Hash      string    `json:"hash"`
+		Error     string    `json:"error"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// Status is a snapshot of the pusher's state.
+	Status struct {
+		Started     bool                    `json:"started"`
+		PeerURLs    []string                `json:"peerurls"`
+		Pushed      map[string]uint64       `json:"pushed"`
+		Queued      map[string]int          `json:"queued"`
+		DeadLetters map[string][]DeadLetter `json:"deadletters"`
+	}
+
+	// peer is a peer blocker along with its queue of reports to push.
+	peer struct {
+		staticClient *client.Client
+		staticQueue  chan database.BlockedSkylink
+		staticURL    string
+	}
+)
+
+// WithRetries sets the number of times a push is retried when the peer is
+// down, and the initial amount of time we wait before retrying. The backoff
+// doubles after every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(p *Pusher) {
+		p.staticRetries = retries
+		p.staticRetryBackoff = backoff
+	}
+}
+
+// WithStopTimeout sets the amount of time Stop waits for the push loops to
+// exit before it gives up, it defaults to one minute.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(p *Pusher) {
+		p.staticStopTimeout = timeout
+	}
+}
+
+// New returns a new Pusher that pushes reports to the given peers on behalf of
+// the portal with the given url. The portal url is sent along with every push
+// so the peers know where the report came from.
+func New(ownPortalURL string, peers []Peer, logger *logrus.Entry, opts ...Option) (*Pusher, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+	if len(peers) > 0 && ownPortalURL == "" {
+		return nil, errors.New("pushing to peers requires the url of our own portal")
+	}
+	p := &Pusher{
+		deadLetters: make(map[string][]DeadLetter),
+		pushed:      make(map[string]uint64),
+
+		staticLogger:       logger,
+		staticOwnPortalURL: ownPortalURL,
+		staticRetries:      pushRetries,
+		staticRetryBackoff: pushRetryBackoff,
+		staticStopChan:     make(chan struct{}),
+		staticStopTimeout:  stopTimeoutDuration,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.staticStopTimeout <= 0 {
+		return nil, errors.New("stop timeout has to be positive")
+	}
+	if p.staticRetries < 0 {
+		return nil, errors.New("number of retries can't be negative")
+	}
+	if p.staticRetryBackoff < 0 {
+		return nil, errors.New("retry backoff can't be negative")
+	}
+	for _, pc := range peers {
+		c, err := client.New(pc.URL, client.WithAPIKey(pc.APIKey), client.WithRetries(0, 0))
+		if err != nil {
+			return nil, errors.AddContext(err, "invalid peer "+pc.URL)
+		}
+		p.staticPeers = append(p.staticPeers, &peer{
+			staticClient: c,
+			staticQueue:  make(chan database.BlockedSkylink, queueSize),
+			staticURL:    pc.URL,
+		})
+	}
+	return p, nil
+}
+
+// Start launches a push loop for every peer.
+func (p *Pusher) Start() error {
+	p.staticMu.Lock()
+	defer p.staticMu.Unlock()
+
+	// escape early if the pusher has no peers configured
+	if len(p.staticPeers) == 0 {
+		p.staticLogger.Info("pusher is not being started because no peers have been defined")
+		return nil
+	}
+
+	// assert 'Start' is only called once
+	if p.started {
+		return errors.New("pusher already started")
+	}
+	p.started = true
+
+	// start the push loops
+	for _, pr := range p.staticPeers {
+		p.staticWaitGroup.Add(1)
+		go func(pr *peer) {
+			p.threadedPushLoop(pr)
+			p.staticWaitGroup.Done()
+		}(pr)
+	}
+	return nil
+}
+
+// Stop waits for the push loops to exit and times out after the configured
+// stop timeout. Reports that are still queued are not pushed.
+func (p *Pusher) Stop() error {
+	// check whether the pusher was started
+	p.staticMu.Lock()
+	if !p.started {
+		p.staticMu.Unlock()
+		return errors.New("pusher not started")
+	}
+	p.started = false
+	p.staticMu.Unlock()
+
+	// stop the pusher by closing the stop channel
+	close(p.staticStopChan)
+
+	// wait for the waitgroup, timeout and signal unclean shutdown
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		p.staticWaitGroup.Wait()
+	}()
+	select {
+	case <-c:
+		return nil
+	case <-time.After(p.staticStopTimeout):
+		var goroutines bytes.Buffer
+		_ = pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+		p.staticLogger.WithFields(logrus.Fields{
+			"status":     p.Status(),
+			"goroutines": goroutines.String(),
+		}).Error("Pusher failed to stop in time")
+		return errors.New("unclean pusher shutdown")
+	}
+}
+
+// Push queues the given report to be pushed to all peers. Reports that
+// originate from another portal are ignored, they were either pushed to us or
+// synced, so the portal they originate from takes care of them. It never
+// blocks, if a peer's queue is full the report ends up in its dead letters.
+func (p *Pusher) Push(bs database.BlockedSkylink) {
+	if bs.Origin.Type == database.OriginTypePortal {
+		return
+	}
+	for _, peer := range p.staticPeers {
+		select {
+		case peer.staticQueue <- bs:
+		default:
+			p.managedDeadLetter(peer.staticURL, bs, errQueueFull)
+		}
+	}
+}
+
+// Status returns a snapshot of the pusher's state.
+func (p *Pusher) Status() Status {
+	p.staticMu.Lock()
+	defer p.staticMu.Unlock()
+	status := Status{
+		Started:     p.started,
+		Pushed:      make(map[string]uint64, len(p.pushed)),
+		Queued:      make(map[string]int, len(p.staticPeers)),
+		DeadLetters: make(map[string][]DeadLetter, len(p.deadLetters)),
+	}
+	for _, peer := range p.staticPeers {
+		status.PeerURLs = append(status.PeerURLs, peer.staticURL)
+		status.Queued[peer.staticURL] = len(peer.staticQueue)
+	}
+	for peerURL, pushed := range p.pushed {
+		status.Pushed[peerURL] = pushed
+	}
+	for peerURL, letters := range p.deadLetters {
+		status.DeadLetters[peerURL] = append([]DeadLetter{}, letters...)
+	}
+	return status
+}
+
+// threadedPushLoop pushes the reports queued for the given peer until the
+// pusher is stopped.
+func (p *Pusher) threadedPushLoop(peer *peer) {
+	// cancel in-flight pushes when the pusher is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.staticStopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-p.staticStopChan:
+			return
+		case bs := <-peer.staticQueue:
+			err := p.managedPush(ctx, peer, bs)
+			if err != nil {
+				p.managedDeadLetter(peer.staticURL, bs, err)
+			}
+		}
+	}
+}
+
+// managedPush pushes the given report to the given peer. Pushes that fail
+// because the peer is unreachable or responds with a server error are retried
+// with an exponential backoff, pushes the peer rejects are not.
+func (p *Pusher) managedPush(ctx context.Context, peer *peer, bs database.BlockedSkylink) error {
+	req := client.BlockRequest{
+		Hash:   bs.Hash.Hash,
+		Tags:   bs.Tags,
+		Portal: p.staticOwnPortalURL,
+	}
+
+	backoff := p.staticRetryBackoff
+	for attempt := 0; ; attempt++ {
+		status, err := peer.staticClient.Block(ctx, req)
+		if err == nil {
+			p.staticLogger.WithFields(logrus.Fields{
+				"peer":   peer.staticURL,
+				"hash":   bs.Hash.String(),
+				"status": status,
+			}).Debug("pushed hash")
+
+			p.staticMu.Lock()
+			p.pushed[peer.staticURL]++
+			p.staticMu.Unlock()
+			return nil
+		}
+		if attempt >= p.staticRetries || !retryable(err) {
+			return err
+		}
+
+		// wait before retrying
+		select {
+		case <-ctx.Done():
+			return errors.Compose(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// managedDeadLetter records the given report could not be pushed to the peer
+// with the given url.
+func (p *Pusher) managedDeadLetter(peerURL string, bs database.BlockedSkylink, err error) {
+	p.staticLogger.WithError(err).WithFields(logrus.Fields{
+		"peer": peerURL,
+		"hash": bs.Hash.String(),
+		"tags": bs.Tags,
+	}).Error("failed to push hash, added it to the dead letters")
+
+	p.staticMu.Lock()
+	defer p.staticMu.Unlock()
+	letters := append(p.deadLetters[peerURL], DeadLetter{
+		Hash:      bs.Hash.String(),
+		Error:     err.Error(),
+		Timestamp: time.Now().UTC(),
+	})
+	if len(letters) > maxDeadLetters {
+		letters = letters[len(letters)-maxDeadLetters:]
+	}
+	p.deadLetters[peerURL] = letters
+}
+
+// retryable returns whether a push that failed with the given error should be
+// retried. Pushes the peer rejected as invalid, or that were rate limited,
+// won't succeed by retrying them right away.
+func retryable(err error) bool {
+	return !errors.Contains(err, client.ErrInvalidRequest) &&
+		!errors.Contains(err, client.ErrForbidden) &&
+		!errors.Contains(err, client.ErrNotFound) &&
+		!errors.Contains(err, client.ErrTooManyRequests) &&
+		!errors.Contains(err, client.ErrUnexpectedStatus)
+}
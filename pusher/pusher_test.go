@@ -0,0 +1,232 @@
+package pusher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/blocker/api"
+	"github.com/SkynetLabs/blocker/client"
+	"github.com/SkynetLabs/blocker/database"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+)
+
+// testBlocker is a blocker API that is served by a test server, along with
+// the pusher that pushes its reports.
+type testBlocker struct {
+	db     *database.DB
+	pusher *Pusher
+	url    string
+}
+
+// TestPusher runs two blockers that push to each other and verifies reports
+// propagate in one hop without echoing back.
+func TestPusher(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create two blockers that push to each other
+	a := newTestBlocker(t, "a")
+	b := newTestBlocker(t, "b")
+	a.connect(t, b)
+	b.connect(t, a)
+
+	// report a hash to the first blocker
+	ctx := context.Background()
+	c, err := client.New(a.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := randomHash()
+	status, err := c.Block(ctx, client.BlockRequest{
+		Hash:     hash,
+		Reporter: client.Reporter{Name: "scanner"},
+		Tags:     []string{"malware"},
+	})
+	if err != nil || status != client.StatusReported {
+		t.Fatal("unexpected", status, err)
+	}
+
+	// assert it got pushed to the second blocker, with the first blocker's
+	// portal as its origin
+	var bsl *database.BlockedSkylink
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		bsl, err = b.db.FindByHash(ctx, database.Hash{Hash: hash})
+		if err != nil {
+			return err
+		}
+		if bsl == nil {
+			return errors.New("hash not pushed yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bsl.Origin.Type != database.OriginTypePortal || bsl.Origin.URL != a.url {
+		t.Fatal("unexpected origin", bsl.Origin)
+	}
+	if bsl.Source != database.SourceSync || len(bsl.Tags) != 1 || bsl.Tags[0] != "malware" {
+		t.Fatal("unexpected report", bsl.Source, bsl.Tags)
+	}
+
+	// assert the second blocker did not echo the report back
+	time.Sleep(100 * time.Millisecond)
+	if pushed := a.pusher.Status().Pushed[b.url]; pushed != 1 {
+		t.Fatal("unexpected number of pushes", pushed)
+	}
+	if pushed := b.pusher.Status().Pushed[a.url]; pushed != 0 {
+		t.Fatal("expected the report not to be pushed back", pushed)
+	}
+}
+
+// TestPusherDeadLetters verifies reports that can't be pushed to a peer that
+// stays down end up in the dead letters after being retried.
+func TestPusherDeadLetters(t *testing.T) {
+	t.Parallel()
+
+	// create a peer that is down
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logger, _ := logtest.NewNullLogger()
+	p, err := New("https://portal.example.com", []Peer{{URL: server.URL}}, logger.WithField("module", "pusher"), WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := p.Stop(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// push a report and a report synced from another portal
+	hash := database.Hash{Hash: randomHash()}
+	p.Push(database.BlockedSkylink{Hash: hash})
+	p.Push(database.BlockedSkylink{
+		Hash:   database.Hash{Hash: randomHash()},
+		Origin: database.Origin{Type: database.OriginTypePortal, URL: "https://siasky.net"},
+	})
+
+	// assert the first one ends up in the dead letters after 3 attempts and
+	// the synced one was not pushed
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		if len(p.Status().DeadLetters[server.URL]) == 0 {
+			return errors.New("no dead letters yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := p.Status().DeadLetters[server.URL]
+	if len(letters) != 1 || letters[0].Hash != hash.String() {
+		t.Fatal("unexpected dead letters", letters)
+	}
+	if n := atomic.LoadUint64(&requests); n != 3 {
+		t.Fatal("unexpected number of requests", n)
+	}
+}
+
+// TestNew verifies the options passed to New are validated.
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	logger, _ := logtest.NewNullLogger()
+	log := logger.WithField("module", "pusher")
+	peers := []Peer{{URL: "https://blocker.siasky.net"}}
+
+	tests := []struct {
+		name  string
+		own   string
+		peers []Peer
+		opts  []Option
+		valid bool
+	}{
+		{"Valid", "https://portal.example.com", peers, nil, true},
+		{"NoPeers", "", nil, nil, true},
+		{"NoOwnPortal", "", peers, nil, false},
+		{"InvalidPeer", "https://portal.example.com", []Peer{{URL: "blocker.siasky.net"}}, nil, false},
+		{"InvalidRetries", "https://portal.example.com", peers, []Option{WithRetries(-1, time.Second)}, false},
+		{"InvalidStopTimeout", "https://portal.example.com", peers, []Option{WithStopTimeout(0)}, false},
+	}
+	for _, test := range tests {
+		_, err := New(test.own, test.peers, log, test.opts...)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+// newTestBlocker returns a blocker API in aggregator mode that is served by a
+// test server and backed by a test database. Its reports are pushed by a
+// pusher that has no peers until it gets connected.
+func newTestBlocker(t *testing.T, name string) *testBlocker {
+	db := database.NewTestDB(context.Background(), t.Name()+"_"+name, database.WithCleanup(t))
+	logger, _ := logtest.NewNullLogger()
+	a, err := api.New(api.Config{
+		AccountsHost:    "localhost",
+		AccountsPort:    "3000",
+		MaxProofUses:    50,
+		MaxDailyReports: 100,
+		TrustedMySkyIDs: make(map[string]struct{}),
+		PoWSecret:       fastrand.Bytes(32),
+		AggregatorMode:  true,
+	}, nil, db, logger.WithField("module", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(a)
+	t.Cleanup(server.Close)
+
+	tb := &testBlocker{db: db, url: server.URL}
+	a.RegisterReportHook(func(bs database.BlockedSkylink) {
+		if tb.pusher != nil {
+			tb.pusher.Push(bs)
+		}
+	})
+	return tb
+}
+
+// connect starts a pusher that pushes the blocker's reports to the given peer.
+func (tb *testBlocker) connect(t *testing.T, peer *testBlocker) {
+	logger, _ := logtest.NewNullLogger()
+	p, err := New(tb.url, []Peer{{URL: peer.url}}, logger.WithField("module", "pusher"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := p.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	tb.pusher = p
+}
+
+// randomHash returns a random hash.
+func randomHash() crypto.Hash {
+	var h crypto.Hash
+	fastrand.Read(h[:])
+	return h
+}
@@ -42,7 +42,7 @@ type (
 		staticSkydAPIPassword string
 
 		staticDB     *database.DB
-		staticLogger *logrus.Logger
+		staticLogger *logrus.Entry
 	}
 
 	// blockResponse is the response object returned by the Skyd API's block
@@ -68,10 +68,9 @@ func (br *blockResponse) InvalidHashes() ([]database.Hash, error) {
 
 	hashes := make([]database.Hash, len(br.Invalids))
 	for i, invalid := range br.Invalids {
-		var h database.Hash
-		err := h.LoadString(invalid.Input)
+		h, err := database.HashFromString(invalid.Input)
 		if err != nil {
-			return nil, err
+			return nil, errors.AddContext(err, "invalid hash in response")
 		}
 		hashes[i] = h
 	}
@@ -79,7 +78,7 @@ func (br *blockResponse) InvalidHashes() ([]database.Hash, error) {
 }
 
 // NewAPI creates a new API instance.
-func NewAPI(skydHost, skydPassword string, skydPort int, db *database.DB, logger *logrus.Logger) (API, error) {
+func NewAPI(skydHost, skydPassword string, skydPort int, db *database.DB, logger *logrus.Entry) (API, error) {
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
@@ -101,7 +100,7 @@ func NewAPI(skydHost, skydPassword string, skydPort int, db *database.DB, logger
 // returns which hashes were blocked, which hashes were invalid and potentially
 // an error.
 func (api *api) BlockHashes(hashes []database.Hash) ([]database.Hash, []database.Hash, error) {
-	api.staticLogger.Debugf("blocking %v hashes", len(hashes))
+	api.staticLogger.WithField("batch_size", len(hashes)).Debug("blocking hashes")
 
 	// convert the hashes to strings
 	adds := make([]string, len(hashes))
@@ -224,13 +223,13 @@ func (api *api) IsSkydUp() bool {
 	r.Header.Set("User-Agent", "Sia-Agent")
 	resp, err := http.DefaultClient.Do(r)
 	if err != nil {
-		api.staticLogger.Warnf("Failed to query skyd: %s", err.Error())
+		api.staticLogger.WithError(err).Warn("Failed to query skyd")
 		return false
 	}
 	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(&status)
 	if err != nil {
-		api.staticLogger.Warnf("Bad body from skyd's /daemon/ready: %s", err.Error())
+		api.staticLogger.WithError(err).Warn("Bad body from skyd's /daemon/ready")
 		return false
 	}
 	return status.Ready && status.Consensus && status.Gateway && status.Renter
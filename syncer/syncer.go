@@ -1,29 +1,37 @@
 package syncer
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/SkynetLabs/blocker/api"
 	"github.com/SkynetLabs/blocker/database"
+	"github.com/SkynetLabs/blocker/events"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 	"go.sia.tech/siad/build"
 )
 
 const (
-	// stopTimeoutDuration is the amount of time we wait when stop is called
-	// before cancelling out and returning with an error indicating an unclean
-	// shutdown.
+	// stopTimeoutDuration is the default amount of time we wait when stop is
+	// called before cancelling out and returning with an error indicating an
+	// unclean shutdown.
 	stopTimeoutDuration = time.Minute
+
+	// maxPortalErrors is the number of sync errors we keep per portal.
+	maxPortalErrors = 10
 )
 
 var (
-	// syncInterval defines the amount of time between syncs of external
-	// portal's blocklists, which can be defined in the environment using the
-	// key BLOCKER_SYNC_LIST
+	// syncInterval defines the default amount of time between syncs of
+	// external portal's blocklists, which can be defined in the environment
+	// using the key BLOCKER_SYNC_LIST
 	syncInterval = build.Select(
 		build.Var{
 			Dev:      time.Minute,
@@ -31,9 +39,26 @@ var (
 			Standard: 15 * time.Minute,
 		},
 	).(time.Duration)
+
+	// syncBatchSize is the number of hashes we fetch from a portal before we
+	// store them, which bounds the memory a portal with a large blocklist
+	// takes up while it's synced.
+	syncBatchSize = build.Select(
+		build.Var{
+			Dev:      1000,
+			Testing:  10,
+			Standard: 1000,
+		},
+	).(int)
 )
 
 type (
+	// allowLister looks up which hashes are on the allow list, it's
+	// implemented by the database.
+	allowLister interface {
+		AllowListedHashes(ctx context.Context, hashes []database.Hash) ([]database.Hash, error)
+	}
+
 	// Syncer periodically fetches the latest blocklist additions from a
 	// configured set of portals, adding them the local blocklist database.
 	Syncer struct {
@@ -42,20 +67,125 @@ type (
 		// lastSyncedHash is a map that keeps track of the last synced hash per
 		// portal URL, when that hash is encountered in consecutive calls to
 		// fetch that portal's blocklist, we know we can stop paging
-		lastSyncedHash map[string]string
+		lastSyncedHash map[string]database.Hash
+
+		// syncing is the url of the portal that is currently being synced,
+		// it helps diagnosing a syncer that fails to stop.
+		syncing string
+
+		// portalErrs holds the error of the last sync per portal URL, portals
+		// that synced successfully are removed from it.
+		portalErrs map[string]error
+
+		// portalErrHistory holds the most recent sync errors per portal URL.
+		portalErrHistory map[string]*errorHistory
+
+		// nextSync is the time the sync loop is scheduled to wake up and
+		// sync all portals, it's recorded when the loop goes to sleep and
+		// is zero until the first sync completed.
+		nextSync time.Time
+
+		// portalURLs are the portals we sync with and clients are their
+		// clients by url, portals with an identity get a client that verifies
+		// it. The state of portals that are removed is dropped at the start of
+		// the next sync.
+		portalURLs []string
+		clients    map[string]*api.SkydClient
+
+		// staticAllowList is used to skip allowlisted hashes, if it fails
+		// nothing is imported unless staticAllowListFailOpen is set.
+		staticAllowList         allowLister
+		staticAllowListFailOpen bool
+
+		staticIdentities []api.PortalIdentity
+
+		// staticBus is the event bus inserted skylinks are published on,
+		// it's nil if no bus was configured.
+		staticBus *events.Bus
+
+		staticDB     database.Store
+		staticLogger *logrus.Entry
+		staticMu     sync.Mutex
+
+		staticStopChan     chan struct{}
+		staticStopTimeout  time.Duration
+		staticSyncInterval time.Duration
+		staticWaitGroup    sync.WaitGroup
+	}
 
-		staticDB         *database.DB
-		staticLogger     *logrus.Logger
-		staticMu         sync.Mutex
-		staticPortalURLs []string
+	// Option configures a Syncer.
+	Option func(*Syncer)
+
+	// Status is a snapshot of the syncer's state.
+	Status struct {
+		Started        bool                     `json:"started"`
+		PortalURLs     []string                 `json:"portalurls"`
+		LastSyncedHash map[string]string        `json:"lastsyncedhash"`
+		Syncing        string                   `json:"syncing"`
+		FailingPortals map[string]string        `json:"failingportals,omitempty"`
+		PortalErrors   map[string][]PortalError `json:"portalerrors,omitempty"`
+		NextSyncRun    map[string]time.Time     `json:"nextsyncrun,omitempty"`
+	}
+
+	// PortalError is an error that occurred while syncing a portal.
+	PortalError struct {
+		Error string    `json:"error"`
+		Time  time.Time `json:"time"`
+	}
 
-		staticStopChan  chan struct{}
-		staticWaitGroup sync.WaitGroup
+	// errorHistory is a ring buffer that holds the most recent sync errors of
+	// a portal, it holds at most maxPortalErrors errors.
+	errorHistory struct {
+		errs []PortalError
+		next int
 	}
 )
 
+// WithAllowListFailOpen sets whether hashes are imported when the allow list
+// can't be checked, by default they are not, which prevents importing
+// allowlisted content while the database is unavailable.
+func WithAllowListFailOpen(failOpen bool) Option {
+	return func(s *Syncer) {
+		s.staticAllowListFailOpen = failOpen
+	}
+}
+
+// WithEventBus sets the event bus the syncer publishes the skylinks it inserts
+// on.
+func WithEventBus(bus *events.Bus) Option {
+	return func(s *Syncer) {
+		s.staticBus = bus
+	}
+}
+
+// WithPortalIdentities sets the identities of the portals, which pin their
+// TLS certificate or require them to sign their blocklist. Pages of a portal's
+// blocklist that fail verification are dropped, and the portal is reported as
+// failing.
+func WithPortalIdentities(identities []api.PortalIdentity) Option {
+	return func(s *Syncer) {
+		s.staticIdentities = identities
+	}
+}
+
+// WithStopTimeout sets the amount of time Stop waits for the sync loop to exit
+// before it gives up, it defaults to one minute.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(s *Syncer) {
+		s.staticStopTimeout = timeout
+	}
+}
+
+// WithSyncInterval sets the amount of time between syncs of the portals'
+// blocklists.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(s *Syncer) {
+		s.staticSyncInterval = interval
+	}
+}
+
 // New returns a new Syncer with the given parameters.
-func New(db *database.DB, portalURLs []string, logger *logrus.Logger) (*Syncer, error) {
+func New(db database.Store, portalURLs []string, logger *logrus.Entry, opts ...Option) (*Syncer, error) {
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
@@ -63,16 +193,69 @@ func New(db *database.DB, portalURLs []string, logger *logrus.Logger) (*Syncer,
 		return nil, errors.New("no logger provided")
 	}
 	s := &Syncer{
-		lastSyncedHash: make(map[string]string),
+		lastSyncedHash:   make(map[string]database.Hash),
+		portalErrs:       make(map[string]error),
+		portalErrHistory: make(map[string]*errorHistory),
+
+		staticAllowList:    db,
+		staticDB:           db,
+		staticLogger:       logger,
+		staticStopChan:     make(chan struct{}),
+		staticStopTimeout:  stopTimeoutDuration,
+		staticSyncInterval: syncInterval,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.staticStopTimeout <= 0 {
+		return nil, errors.New("stop timeout has to be positive")
+	}
+	if s.staticSyncInterval <= 0 {
+		return nil, errors.New("sync interval has to be positive")
+	}
 
-		staticDB:         db,
-		staticLogger:     logger,
-		staticPortalURLs: portalURLs,
-		staticStopChan:   make(chan struct{}),
+	// create the clients of the portals
+	known := make(map[string]struct{}, len(portalURLs))
+	for _, portalURL := range portalURLs {
+		known[portalURL] = struct{}{}
+	}
+	for _, identity := range s.staticIdentities {
+		if _, exists := known[identity.URL]; !exists {
+			return nil, fmt.Errorf("identity of unknown portal '%v'", identity.URL)
+		}
+	}
+	err := s.SetPortalURLs(portalURLs)
+	if err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// SetPortalURLs replaces the portals the syncer syncs with. The state the
+// syncer keeps for portals that are removed is dropped at the start of the
+// next sync.
+func (s *Syncer) SetPortalURLs(portalURLs []string) error {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+
+	// reuse the clients of the portals we know already
+	clients := make(map[string]*api.SkydClient, len(portalURLs))
+	for _, portalURL := range portalURLs {
+		if client, exists := s.clients[portalURL]; exists {
+			clients[portalURL] = client
+			continue
+		}
+		client, err := s.newClient(portalURL)
+		if err != nil {
+			return err
+		}
+		clients[portalURL] = client
+	}
+	s.portalURLs = append([]string(nil), portalURLs...)
+	s.clients = clients
+	return nil
+}
+
 // Start launches a background task that periodically syncs the blocklists of
 // the preconfigured portals with the blocklist of the local skyd instance.
 func (s *Syncer) Start() error {
@@ -83,7 +266,7 @@ func (s *Syncer) Start() error {
 	logger := s.staticLogger
 
 	// escape early if the syncer has no portal urls configured
-	if len(s.staticPortalURLs) == 0 {
+	if len(s.portalURLs) == 0 {
 		logger.Infof("syncer is not being started because no portal URLs have been defined")
 		return nil
 	}
@@ -104,7 +287,9 @@ func (s *Syncer) Start() error {
 	return nil
 }
 
-// Stop waits for the syncer's waitgroup and times out after one minute.
+// Stop waits for the syncer's waitgroup and times out after the configured stop
+// timeout. On timeout it logs the syncer's state and a dump of all goroutines,
+// to help figuring out what prevented it from stopping.
 func (s *Syncer) Stop() error {
 	// check whether the syncer was started
 	s.staticMu.Lock()
@@ -127,7 +312,13 @@ func (s *Syncer) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(stopTimeoutDuration):
+	case <-time.After(s.staticStopTimeout):
+		var goroutines bytes.Buffer
+		_ = pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+		s.staticLogger.WithFields(logrus.Fields{
+			"status":     s.Status(),
+			"goroutines": goroutines.String(),
+		}).Error("Syncer failed to stop in time")
 		return errors.New("unclean syncer shutdown")
 	}
 }
@@ -140,23 +331,82 @@ func (s *Syncer) threadedSyncLoop() {
 	for {
 		err := s.managedSyncPortals()
 		if err != nil {
-			logger.Errorf("failed to sync portals with skyd, error %v", err)
+			logger.WithError(err).Error("failed to sync portals with skyd")
 		}
 
+		timer := time.NewTimer(s.managedScheduleSync())
 		select {
 		case <-s.staticStopChan:
+			timer.Stop()
 			return
-		case <-time.After(syncInterval):
+		case <-timer.C:
 		}
 	}
 }
 
-// managedLastSyncedHash returns the last synced hash, as a string, for the
-// given portal URL
-func (s *Syncer) managedLastSyncedHash(portalURL string) string {
+// Status returns a snapshot of the syncer's state.
+func (s *Syncer) Status() Status {
 	s.staticMu.Lock()
-	s.staticMu.Unlock()
-	return s.lastSyncedHash[portalURL]
+	defer s.staticMu.Unlock()
+	lastSyncedHash := make(map[string]string, len(s.lastSyncedHash))
+	for portalURL, hash := range s.lastSyncedHash {
+		lastSyncedHash[portalURL] = hash.String()
+	}
+	var failingPortals map[string]string
+	if len(s.portalErrs) > 0 {
+		failingPortals = make(map[string]string, len(s.portalErrs))
+		for portalURL, err := range s.portalErrs {
+			failingPortals[portalURL] = err.Error()
+		}
+	}
+	var portalErrors map[string][]PortalError
+	if len(s.portalErrHistory) > 0 {
+		portalErrors = make(map[string][]PortalError, len(s.portalErrHistory))
+		for portalURL, history := range s.portalErrHistory {
+			portalErrors[portalURL] = history.recent()
+		}
+	}
+	var nextSyncRun map[string]time.Time
+	if !s.nextSync.IsZero() {
+		nextSyncRun = make(map[string]time.Time, len(s.portalURLs))
+		for _, portalURL := range s.portalURLs {
+			nextSyncRun[portalURL] = s.nextSync
+		}
+	}
+	return Status{
+		Started:        s.started,
+		PortalURLs:     s.portalURLs,
+		LastSyncedHash: lastSyncedHash,
+		Syncing:        s.syncing,
+		FailingPortals: failingPortals,
+		PortalErrors:   portalErrors,
+		NextSyncRun:    nextSyncRun,
+	}
+}
+
+// CheckPortals returns an error if the last sync of any of the portals failed,
+// it's used as a health check.
+func (s *Syncer) CheckPortals() error {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	if len(s.portalErrs) == 0 {
+		return nil
+	}
+	portalURLs := make([]string, 0, len(s.portalErrs))
+	for portalURL := range s.portalErrs {
+		portalURLs = append(portalURLs, portalURL)
+	}
+	sort.Strings(portalURLs)
+	return fmt.Errorf("failed to sync %d of %d portals: %s", len(portalURLs), len(s.portalURLs), strings.Join(portalURLs, ", "))
+}
+
+// managedLastSyncedHash returns the last synced hash for the given portal URL
+// and whether the portal was synced before.
+func (s *Syncer) managedLastSyncedHash(portalURL string) (database.Hash, bool) {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	hash, exists := s.lastSyncedHash[portalURL]
+	return hash, exists
 }
 
 // managedSyncPortals will sync the blocklist of all portals defined on the
@@ -164,29 +414,60 @@ func (s *Syncer) managedLastSyncedHash(portalURL string) string {
 func (s *Syncer) managedSyncPortals() error {
 	// convenience variables
 	logger := s.staticLogger
+	defer s.managedSetSyncing("")
+
+	// drop the state of the portals that were removed since the last sync
+	portalURLs, clients := s.managedPrunePortals()
 
 	// sync all portals one by one
 	var errs []error
-	for _, portalURL := range s.staticPortalURLs {
-		logger.Infof("syncing blocklist for portal '%s'", portalURL)
+	for _, portalURL := range portalURLs {
+		logger := logger.WithField("portal", portalURL)
+		logger.Info("syncing blocklist")
+		s.managedSetSyncing(portalURL)
 
-		// create a client and fetch the last synced hash
-		client := api.NewSkydClient(portalURL, "")
-		lastSynced := s.managedLastSyncedHash(portalURL)
-		reporter := database.Reporter{Name: portalURL}
+		// fetch the last synced hash
+		client := clients[portalURL]
+		lastSynced, synced := s.managedLastSyncedHash(portalURL)
+		origin := database.Origin{Type: database.OriginTypePortal, URL: portalURL}
 
 		// define loop variables
 		offset := 0
 		hasMore := true
 		seen := false
 
-		// fetch all entries
-		var hashes []database.BlockedSkylink
-		for hasMore && !seen {
+		// store is a helper that stores the current batch of hashes, it keeps
+		// track of the last hash that got stored
+		var batch []database.BlockedSkylink
+		var last database.Hash
+		var fetched, added, existing int
+		store := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+			defer cancel()
+			batchAdded, batchExisting, err := s.managedStoreHashes(ctx, portalURL, batch)
+			if err != nil {
+				logger.WithError(err).WithField("batch_size", len(batch)).Error("failed inserting hashes into our database")
+				return err
+			}
+			added += batchAdded
+			existing += batchExisting
+			last = batch[len(batch)-1].Hash
+			batch = batch[:0]
+			return nil
+		}
+
+		// fetch all entries, storing them in batches rather than holding
+		// the portal's entire blocklist in memory
+		var fetchErr, storeErr error
+		for hasMore && !seen && storeErr == nil {
 			// fetch at current offset
 			blg, err := client.BlocklistGET(offset)
 			if err != nil {
-				errs = append(errs, errors.AddContext(err, fmt.Sprintf("could not get blocklist for portal %s", portalURL)))
+				fetchErr = errors.AddContext(err, fmt.Sprintf("could not get blocklist for portal %s", portalURL))
+				errs = append(errs, fetchErr)
 				break
 			}
 
@@ -196,53 +477,308 @@ func (s *Syncer) managedSyncPortals() error {
 
 			// check whether we're seeing entries we know already
 			for _, entry := range blg.Entries {
-				hash := database.Hash{entry.Hash}
-				if lastSynced != "" && hash.String() == lastSynced {
+				hash := entry.Hash
+				if synced && hash == lastSynced {
 					seen = true
 					break
 				}
 
-				hashes = append(hashes, database.BlockedSkylink{
+				fetched++
+				batch = append(batch, database.BlockedSkylink{
 					Hash:           hash,
-					Reporter:       reporter,
-					Tags:           entry.Tags,
-					TimestampAdded: time.Now().UTC(),
+					Origin:         origin,
+					SeenOnPortals:  []string{portalURL},
+					Source:         database.SourceSync,
+					Tags:           syncedTags(entry.Tags),
+					TimestampAdded: database.Now(),
 				})
 			}
+			if len(batch) >= syncBatchSize {
+				storeErr = store()
+			}
+		}
+		if storeErr == nil {
+			storeErr = store()
 		}
 
-		// continue if no hashes were found
-		if len(hashes) == 0 {
-			logger.Infof("could not find any hashes for portal '%s'", portalURL)
+		// the last synced hash is only updated once all hashes are stored,
+		// batches that got stored already are seen again on the next sync
+		if storeErr != nil {
+			s.managedSetPortalError(portalURL, storeErr)
 			continue
 		}
+		s.managedSetPortalError(portalURL, fetchErr)
 
-		// create context
-		ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
-
-		// bulk insert all of the hashes into the database
-		added, err := s.staticDB.CreateBlockedSkylinkBulk(ctx, hashes)
-		if err != nil {
-			cancel()
-			logger.Errorf("failed inserting hashes from '%s' into our database, err '%v'", portalURL, err)
+		// continue if no hashes were found
+		if fetched == 0 {
+			logger.Info("could not find any hashes")
 			continue
 		}
 
-		cancel()
-		logger.Infof("added %v hashes from portal '%s'", added, portalURL)
+		logger.WithFields(logrus.Fields{
+			"added": added,
+			"seen":  existing,
+		}).Info("added hashes")
 
 		// update the last synced hash to avoid paging through the entire
 		// blocklist in consecutive syncs
-		last := hashes[len(hashes)-1]
-		s.managedUpdateLastSyncedHash(portalURL, last.Hash.String())
+		s.managedUpdateLastSyncedHash(portalURL, last)
 	}
 
 	return errors.Compose(errs...)
 }
 
+// managedPrunePortals drops the state of the portals that are no longer
+// configured, it returns the portals to sync and their clients.
+func (s *Syncer) managedPrunePortals() ([]string, map[string]*api.SkydClient) {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	for portalURL := range s.lastSyncedHash {
+		if _, exists := s.clients[portalURL]; !exists {
+			delete(s.lastSyncedHash, portalURL)
+		}
+	}
+	for portalURL := range s.portalErrs {
+		if _, exists := s.clients[portalURL]; !exists {
+			delete(s.portalErrs, portalURL)
+		}
+	}
+	for portalURL := range s.portalErrHistory {
+		if _, exists := s.clients[portalURL]; !exists {
+			delete(s.portalErrHistory, portalURL)
+		}
+	}
+	return s.portalURLs, s.clients
+}
+
+// managedStoreHashes inserts the given skylinks, synced from the portal with
+// the given url, into the database. Skylinks that exist already are not
+// inserted, instead we record that they appeared on the portal's blocklist.
+// Skylinks that are on the allow list are skipped, if the allow list can't be
+// checked nothing is inserted unless the syncer is configured to fail open.
+// It returns the number of inserted skylinks and the number of existing ones.
+func (s *Syncer) managedStoreHashes(ctx context.Context, portalURL string, skylinks []database.BlockedSkylink) (int, int, error) {
+	// find the skylinks that exist already, including deleted ones as they
+	// still occupy the hash
+	hashes := make([]database.Hash, len(skylinks))
+	for i, skylink := range skylinks {
+		hashes[i] = skylink.Hash
+	}
+	var existing []database.Hash
+	err := s.staticDB.Retry(ctx, func() (err error) {
+		existing, err = s.staticDB.ExistingHashes(ctx, hashes, database.IncludeDeleted())
+		return err
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to find existing hashes")
+	}
+	exists := make(map[database.Hash]struct{}, len(existing))
+	for _, hash := range existing {
+		exists[hash] = struct{}{}
+	}
+
+	// split the skylinks into new and existing ones
+	var toInsert []database.BlockedSkylink
+	var seen []database.Hash
+	for _, skylink := range skylinks {
+		if _, found := exists[skylink.Hash]; found {
+			seen = append(seen, skylink.Hash)
+			continue
+		}
+		toInsert = append(toInsert, skylink)
+	}
+
+	// skip the new skylinks that are allowlisted
+	toInsert, err = s.managedSkipAllowListed(ctx, portalURL, toInsert)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// insert the new skylinks, skylinks that got inserted in the meantime
+	// are treated as existing ones
+	var duplicates []int
+	err = s.staticDB.Retry(ctx, func() (err error) {
+		duplicates, err = s.staticDB.CreateBlockedSkylinkBatch(ctx, toInsert)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, i := range duplicates {
+		seen = append(seen, toInsert[i].Hash)
+	}
+	s.managedPublishInserted(toInsert, duplicates)
+
+	// record the existing skylinks appeared on the portal's blocklist
+	err = s.staticDB.Retry(ctx, func() error {
+		return s.staticDB.AddSeenOnPortal(ctx, seen, portalURL)
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to record the portal on existing hashes")
+	}
+	return len(toInsert) - len(duplicates), len(seen), nil
+}
+
+// managedPublishInserted publishes the given skylinks, except for the
+// duplicates at the given indices, on the event bus.
+func (s *Syncer) managedPublishInserted(skylinks []database.BlockedSkylink, duplicates []int) {
+	isDuplicate := make(map[int]struct{}, len(duplicates))
+	for _, i := range duplicates {
+		isDuplicate[i] = struct{}{}
+	}
+	var inserted []database.BlockedSkylink
+	var hashes []database.Hash
+	for i, skylink := range skylinks {
+		if _, exists := isDuplicate[i]; !exists {
+			inserted = append(inserted, skylink)
+			hashes = append(hashes, skylink.Hash)
+		}
+	}
+	if len(inserted) == 0 {
+		return
+	}
+	s.staticBus.Publish(events.Event{
+		Type:      events.BlockCreated,
+		Publisher: events.PublisherSyncer,
+		Hashes:    hashes,
+		Skylinks:  inserted,
+	})
+}
+
+// managedSkipAllowListed returns the given skylinks without the ones that are
+// on the allow list. If the allow list can't be checked an error is returned,
+// unless the syncer is configured to fail open, in which case all skylinks are
+// returned.
+func (s *Syncer) managedSkipAllowListed(ctx context.Context, portalURL string, skylinks []database.BlockedSkylink) ([]database.BlockedSkylink, error) {
+	if len(skylinks) == 0 {
+		return skylinks, nil
+	}
+	hashes := make([]database.Hash, len(skylinks))
+	for i, skylink := range skylinks {
+		hashes[i] = skylink.Hash
+	}
+	var allowlisted []database.Hash
+	err := s.staticDB.Retry(ctx, func() (err error) {
+		allowlisted, err = s.staticAllowList.AllowListedHashes(ctx, hashes)
+		return err
+	})
+	if err != nil && s.staticAllowListFailOpen {
+		s.staticLogger.WithError(err).WithField("portal", portalURL).Warn("failed to look up allowlisted hashes, importing all hashes")
+		return skylinks, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to look up allowlisted hashes")
+	}
+	if len(allowlisted) == 0 {
+		return skylinks, nil
+	}
+	s.staticLogger.WithField("portal", portalURL).WithField("skipped", len(allowlisted)).Info("skipped allowlisted hashes")
+
+	skip := make(map[database.Hash]struct{}, len(allowlisted))
+	for _, hash := range allowlisted {
+		skip[hash] = struct{}{}
+	}
+	filtered := make([]database.BlockedSkylink, 0, len(skylinks))
+	for _, skylink := range skylinks {
+		if _, exists := skip[skylink.Hash]; !exists {
+			filtered = append(filtered, skylink)
+		}
+	}
+	return filtered, nil
+}
+
+// managedScheduleSync records the time the sync loop wakes up when it goes to
+// sleep and returns the amount of time it sleeps for. The portals are synced
+// one by one, so they're all scheduled for the next sync.
+func (s *Syncer) managedScheduleSync() time.Duration {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	s.nextSync = database.Now().Add(s.staticSyncInterval)
+	return s.staticSyncInterval
+}
+
+// managedSetSyncing sets the url of the portal that is currently being synced.
+func (s *Syncer) managedSetSyncing(portalURL string) {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	s.syncing = portalURL
+}
+
+// managedSetPortalError records the error of the last sync of the given
+// portal, a nil error marks the portal as healthy. Errors are added to the
+// portal's error history.
+func (s *Syncer) managedSetPortalError(portalURL string, err error) {
+	s.staticMu.Lock()
+	defer s.staticMu.Unlock()
+	if err == nil {
+		delete(s.portalErrs, portalURL)
+		return
+	}
+	s.portalErrs[portalURL] = err
+	history, exists := s.portalErrHistory[portalURL]
+	if !exists {
+		history = &errorHistory{}
+		s.portalErrHistory[portalURL] = history
+	}
+	history.add(err)
+}
+
 // managedUpdateLastSyncedHash updates the last synced hash for the given portal
-func (s *Syncer) managedUpdateLastSyncedHash(portalURL string, hash string) {
+func (s *Syncer) managedUpdateLastSyncedHash(portalURL string, hash database.Hash) {
 	s.staticMu.Lock()
 	defer s.staticMu.Unlock()
 	s.lastSyncedHash[portalURL] = hash
 }
+
+// newClient returns the client of the given portal, if the portal has an
+// identity the client verifies it.
+func (s *Syncer) newClient(portalURL string) (*api.SkydClient, error) {
+	for _, identity := range s.staticIdentities {
+		if identity.URL != portalURL {
+			continue
+		}
+		client, err := api.NewPortalClient(identity)
+		if err != nil {
+			return nil, errors.AddContext(err, "invalid portal identity")
+		}
+		return client, nil
+	}
+	return api.NewSkydClient(portalURL, ""), nil
+}
+
+// add adds the given error to the history, overwriting the oldest error if the
+// history is full.
+func (h *errorHistory) add(err error) {
+	pe := PortalError{Error: err.Error(), Time: time.Now().UTC()}
+	if len(h.errs) < maxPortalErrors {
+		h.errs = append(h.errs, pe)
+		return
+	}
+	h.errs[h.next] = pe
+	h.next = (h.next + 1) % maxPortalErrors
+}
+
+// recent returns the errors in the history, oldest first.
+func (h *errorHistory) recent() []PortalError {
+	recent := make([]PortalError, 0, len(h.errs))
+	recent = append(recent, h.errs[h.next:]...)
+	return append(recent, h.errs[:h.next]...)
+}
+
+// syncedTags returns the normalized form of the given tags of a synced entry,
+// see database.NormalizeTags. Other portals might not enforce the same limits,
+// rather than skipping the entry we drop the tags that are too long and keep
+// at most the maximum number of tags.
+func syncedTags(tags []string) []string {
+	normalized := database.NormalizeTags(tags)
+	synced := normalized[:0]
+	for _, tag := range normalized {
+		if len(synced) == database.MaxTags {
+			break
+		}
+		if database.ValidateTags([]string{tag}) == nil {
+			synced = append(synced, tag)
+		}
+	}
+	return synced
+}
@@ -3,19 +3,27 @@ package syncer
 import (
 	"context"
 	"crypto/rand"
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/SkynetLabs/blocker/api"
 	"github.com/SkynetLabs/blocker/database"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"gitlab.com/NebulousLabs/errors"
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
 	"go.sia.tech/siad/build"
 	"go.sia.tech/siad/crypto"
+	"golang.org/x/crypto/ed25519"
 )
 
 // TestSyncer is a collection of unit tests to verify the functionality of the
@@ -29,6 +37,61 @@ func TestSyncer(t *testing.T) {
 	t.Run("lastSyncedHash", testLastSyncedHash)
 	t.Run("randomHash", testRandomHash)
 	t.Run("syncer", testSyncer)
+	t.Run("seenOnPortals", testSeenOnPortals)
+	t.Run("allowList", testAllowList)
+	t.Run("stopTimeout", testStopTimeout)
+	t.Run("failingPortals", testFailingPortals)
+	t.Run("portalIdentity", testPortalIdentity)
+	t.Run("prunePortals", testPrunePortals)
+	t.Run("nextSyncRun", testNextSyncRun)
+}
+
+// TestErrorHistory verifies the error history of a portal keeps the most
+// recent errors, oldest first.
+func TestErrorHistory(t *testing.T) {
+	t.Parallel()
+
+	var h errorHistory
+	for i := 0; i < maxPortalErrors+3; i++ {
+		h.add(fmt.Errorf("error %d", i))
+	}
+	recent := h.recent()
+	if len(recent) != maxPortalErrors {
+		t.Fatal("unexpected number of errors", len(recent))
+	}
+	for i, pe := range recent {
+		if pe.Error != fmt.Sprintf("error %d", i+3) {
+			t.Fatal("unexpected error", i, pe.Error)
+		}
+	}
+}
+
+// TestSyncedTags is a unit test for syncedTags.
+func TestSyncedTags(t *testing.T) {
+	t.Parallel()
+
+	// assert tags get normalized
+	tags := syncedTags([]string{"Phishing", " phishing ", "Child  Abuse", " "})
+	if !reflect.DeepEqual(tags, []string{"phishing", "child-abuse"}) {
+		t.Fatal("unexpected tags", tags)
+	}
+
+	// assert tags that are too long get dropped
+	long := strings.Repeat("a", database.MaxTagLength+1)
+	tags = syncedTags([]string{long, "malware"})
+	if !reflect.DeepEqual(tags, []string{"malware"}) {
+		t.Fatal("unexpected tags", tags)
+	}
+
+	// assert at most the max number of tags are kept
+	tags = nil
+	for i := 0; i < database.MaxTags+5; i++ {
+		tags = append(tags, fmt.Sprintf("tag-%d", i))
+	}
+	tags = syncedTags(tags)
+	if len(tags) != database.MaxTags || tags[0] != "tag-0" {
+		t.Fatal("unexpected tags", tags)
+	}
 }
 
 // testLastSyncedHash is a unit test that verifies the last synced hash setter
@@ -37,23 +100,23 @@ func testLastSyncedHash(t *testing.T) {
 	t.Parallel()
 
 	// create a test syncer
-	s, err := newTestSyncer(t.Name(), nil)
+	s, _, err := newTestSyncer(t, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// basic case
 	portalURL := "https://siasky.net"
-	lastSynced := s.managedLastSyncedHash(portalURL)
-	if lastSynced != "" {
+	lastSynced, synced := s.managedLastSyncedHash(portalURL)
+	if synced || lastSynced != (database.Hash{}) {
 		t.Fatal("unexpected", lastSynced)
 	}
 
 	// update and check
-	hash := randomHash()
-	s.managedUpdateLastSyncedHash(portalURL, hash.String())
-	lastSynced = s.managedLastSyncedHash(portalURL)
-	if lastSynced != hash.String() {
+	hash := database.Hash{Hash: randomHash()}
+	s.managedUpdateLastSyncedHash(portalURL, hash)
+	lastSynced, synced = s.managedLastSyncedHash(portalURL)
+	if !synced || lastSynced != hash {
 		t.Fatal("unexpected", lastSynced)
 	}
 }
@@ -78,8 +141,8 @@ func testSyncer(t *testing.T) {
 	hash2 := randomHash()
 	blg := api.BlocklistGET{
 		Entries: []api.BlockedHash{
-			{Hash: hash1, Tags: []string{"tag_1"}},
-			{Hash: hash2, Tags: []string{"tag_2"}},
+			{Hash: database.Hash{Hash: hash1}, Tags: []string{"tag_1"}},
+			{Hash: database.Hash{Hash: hash2}, Tags: []string{"tag_2"}},
 		},
 		HasMore: false,
 	}
@@ -93,7 +156,7 @@ func testSyncer(t *testing.T) {
 	defer server.Close()
 
 	// create a test syncer that syncs from our server
-	s, err := newTestSyncer(t.Name(), []string{server.URL})
+	s, hook, err := newTestSyncer(t, []string{server.URL})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -101,8 +164,8 @@ func testSyncer(t *testing.T) {
 	// insert one hash manually, this will assert that our insert ignores
 	// duplicate entries
 	err = s.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
-		Hash:           database.Hash{hash1},
-		TimestampAdded: time.Now().UTC(),
+		Hash:           database.Hash{Hash: hash1},
+		TimestampAdded: database.Now(),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -166,9 +229,12 @@ func testSyncer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// asser the reporter is properly filled
-	if bsl.Reporter.Name != server.URL {
-		t.Fatalf("unexpected reporter '%v'", bsl.Reporter.Name)
+	// assert the origin is properly filled and the reporter is left empty
+	if bsl.Origin.Type != database.OriginTypePortal || bsl.Origin.URL != server.URL {
+		t.Fatalf("unexpected origin '%v'", bsl.Origin)
+	}
+	if bsl.Reporter != (database.Reporter{}) {
+		t.Fatalf("unexpected reporter '%v'", bsl.Reporter)
 	}
 
 	// assert the tags are filled
@@ -178,23 +244,340 @@ func testSyncer(t *testing.T) {
 	if bsl.Tags[0] != "tag_2" {
 		t.Fatalf("unexpected tag, %v != tag_2", bsl.Tags[0])
 	}
+
+	// assert the sync got logged with the module and portal
+	var logged bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "added hashes" {
+			logged = entry.Data["module"] == "syncer" && entry.Data["portal"] == server.URL
+			break
+		}
+	}
+	if !logged {
+		t.Fatal("expected the sync to be logged with its context")
+	}
 }
 
-// newTestSyncer returns a test syncer object.
-func newTestSyncer(dbName string, portalURLs []string) (*Syncer, error) {
-	// create a nil logger
-	logger := logrus.New()
-	logger.Out = ioutil.Discard
+// testSeenOnPortals verifies the syncer records on which portals' blocklists a
+// hash appeared, also for hashes that exist already.
+func testSeenOnPortals(t *testing.T) {
+	// create context
+	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
+	defer cancel()
 
-	// create a context
+	// create two portals that share a hash, the second portal also has a
+	// hash that got reported locally
+	shared := randomHash()
+	onlyFirst := randomHash()
+	onlySecond := randomHash()
+	local := randomHash()
+	newPortal := func(hashes ...crypto.Hash) *httptest.Server {
+		var blg api.BlocklistGET
+		for _, hash := range hashes {
+			blg.Entries = append(blg.Entries, api.BlockedHash{Hash: database.Hash{Hash: hash}})
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/skynet/portal/blocklist", func(w http.ResponseWriter, r *http.Request) {
+			skyapi.WriteJSON(w, blg)
+		})
+		return httptest.NewServer(mux)
+	}
+	first := newPortal(onlyFirst, shared)
+	defer first.Close()
+	second := newPortal(shared, onlySecond, local)
+	defer second.Close()
+
+	// create a test syncer that syncs from both portals
+	s, _, err := newTestSyncer(t, []string{first.URL, second.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// report the local hash
+	err = s.staticDB.CreateBlockedSkylink(ctx, &database.BlockedSkylink{
+		Hash:           database.Hash{Hash: local},
+		Origin:         database.Origin{Type: database.OriginTypeUser, Identifier: "sub"},
+		Reporter:       database.Reporter{Name: "reporter", Sub: "sub"},
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sync twice, the second sync should not change anything
+	for i := 0; i < 2; i++ {
+		err = s.managedSyncPortals()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the portals every hash was seen on
+	tests := []struct {
+		hash    crypto.Hash
+		portals []string
+		origin  string
+	}{
+		{onlyFirst, []string{first.URL}, first.URL},
+		{shared, []string{first.URL, second.URL}, first.URL},
+		{onlySecond, []string{second.URL}, second.URL},
+		{local, []string{second.URL}, ""},
+	}
+	for _, test := range tests {
+		bsl, err := s.staticDB.FindByHash(ctx, database.Hash{Hash: test.hash})
+		if err != nil || bsl == nil {
+			t.Fatal("unexpected", bsl, err)
+		}
+		if !reflect.DeepEqual(bsl.SeenOnPortals, test.portals) {
+			t.Fatalf("unexpected portals, %v != %v", bsl.SeenOnPortals, test.portals)
+		}
+		if bsl.Origin.URL != test.origin {
+			t.Fatalf("unexpected origin, %v != %v", bsl.Origin.URL, test.origin)
+		}
+	}
+}
+
+// faultyAllowList is an allow lister that fails every lookup, it simulates the
+// database being unavailable.
+type faultyAllowList struct{}
+
+// AllowListedHashes implements the allowLister interface.
+func (faultyAllowList) AllowListedHashes(context.Context, []database.Hash) ([]database.Hash, error) {
+	return nil, errors.New("database unavailable")
+}
+
+// testAllowList verifies allowlisted hashes are not imported and that nothing
+// is imported while the allow list can't be checked, unless the syncer is
+// configured to fail open.
+func testAllowList(t *testing.T) {
+	// create context
 	ctx, cancel := context.WithTimeout(context.Background(), database.MongoDefaultTimeout)
 	defer cancel()
 
+	// create a portal with an allowlisted hash
+	allowlisted := database.Hash{Hash: randomHash()}
+	blocked := database.Hash{Hash: randomHash()}
+	var blg api.BlocklistGET
+	for _, hash := range []database.Hash{allowlisted, blocked} {
+		blg.Entries = append(blg.Entries, api.BlockedHash{Hash: hash})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/skynet/portal/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteJSON(w, blg)
+	})
+	portal := httptest.NewServer(mux)
+	defer portal.Close()
+
+	// create a test syncer and break its allow list
+	s, _, err := newTestSyncer(t, []string{portal.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+		Hash:           allowlisted,
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.staticAllowList = faultyAllowList{}
+
+	// imported is a helper that returns whether the given hash got imported
+	imported := func(hash database.Hash) bool {
+		t.Helper()
+		doc, err := s.staticDB.FindByHash(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc != nil
+	}
+
+	// assert nothing gets imported and the portal is synced again next time
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported(allowlisted) || imported(blocked) {
+		t.Fatal("expected no hashes to be imported")
+	}
+	if _, synced := s.managedLastSyncedHash(portal.URL); synced {
+		t.Fatal("expected the portal not to be synced")
+	}
+
+	// assert everything gets imported if the syncer fails open
+	s.staticAllowListFailOpen = true
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imported(allowlisted) || !imported(blocked) {
+		t.Fatal("expected all hashes to be imported")
+	}
+
+	// assert allowlisted hashes are skipped once the allow list is back
+	s, _, err = newTestSyncer(t, []string{portal.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.staticDB.CreateAllowListedSkylink(ctx, &database.AllowListedSkylink{
+		Hash:           allowlisted,
+		TimestampAdded: database.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported(allowlisted) || !imported(blocked) {
+		t.Fatal("expected only the blocked hash to be imported")
+	}
+}
+
+// testStopTimeout verifies Stop gives up after the configured stop timeout and
+// logs the syncer's state and a goroutine dump when a portal hangs.
+func testStopTimeout(t *testing.T) {
+	// create a portal that hangs until it gets released
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		skyapi.WriteJSON(w, api.BlocklistGET{})
+	}))
+	defer server.Close()
+
+	// create a syncer with a short stop timeout
+	logger, hook := logtest.NewNullLogger()
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	s, err := New(db, []string{server.URL}, logger.WithField("module", "syncer"), WithStopTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait until the portal received the request
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("portal never received a request")
+	}
+
+	// assert stopping the syncer times out
+	err = s.Stop()
+	if err == nil || !strings.Contains(err.Error(), "unclean syncer shutdown") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// release the portal and wait for the loop to exit
+	close(release)
+	s.staticWaitGroup.Wait()
+
+	// assert the state and goroutines got logged
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Syncer failed to stop in time" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("expected the failed stop to be logged")
+	}
+	status, ok := entry.Data["status"].(Status)
+	if !ok || status.Syncing != server.URL {
+		t.Fatal("unexpected status", entry.Data["status"])
+	}
+	goroutines, ok := entry.Data["goroutines"].(string)
+	if !ok || !strings.Contains(goroutines, "threadedSyncLoop") {
+		t.Fatal("unexpected goroutines", entry.Data["goroutines"])
+	}
+	if s.Status().Syncing != "" {
+		t.Fatal("expected syncing to be reset")
+	}
+}
+
+// testNextSyncRun verifies the syncer reports when it syncs the portals next,
+// once it went to sleep after a sync.
+func testNextSyncRun(t *testing.T) {
+	// create a portal with an empty blocklist
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteJSON(w, api.BlocklistGET{})
+	}))
+	defer server.Close()
+
+	// create a syncer with a sync interval that exceeds the test's runtime
+	logger, _ := logtest.NewNullLogger()
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	s, err := New(db, []string{server.URL}, logger.WithField("module", "syncer"), WithSyncInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the next sync isn't reported before the first sync
+	if status := s.Status(); status.NextSyncRun != nil {
+		t.Fatal("unexpected next sync run", status.NextSyncRun)
+	}
+
+	// start the syncer and wait for the next sync to be scheduled
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	var next time.Time
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		var ok bool
+		next, ok = s.Status().NextSyncRun[server.URL]
+		if !ok {
+			return errors.New("next sync not scheduled")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(next); until < 59*time.Minute || until > time.Hour {
+		t.Fatal("unexpected next sync run", next)
+	}
+
+	// assert a portal that gets added is synced on the next sync
+	other := "https://other.portal"
+	err = s.SetPortalURLs([]string{server.URL, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := s.Status()
+	if len(status.NextSyncRun) != 2 || !status.NextSyncRun[other].Equal(next) {
+		t.Fatal("unexpected next sync run", status.NextSyncRun)
+	}
+}
+
+// newTestSyncer returns a test syncer object, alongside a hook that records
+// everything it logs.
+func newTestSyncer(t *testing.T, portalURLs []string) (*Syncer, *logtest.Hook, error) {
+	// create a nil logger
+	logger, hook := logtest.NewNullLogger()
+
 	// create database
-	db := database.NewTestDB(ctx, dbName)
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
 
 	// create a syncer
-	return New(db, portalURLs, logger)
+	s, err := New(db, portalURLs, logger.WithField("module", "syncer"))
+	return s, hook, err
 }
 
 // randomHash returns a random hash
@@ -206,3 +589,223 @@ func randomHash() crypto.Hash {
 	}
 	return h
 }
+
+// testFailingPortals verifies the syncer keeps track of the portals that failed
+// to sync, and that they're considered healthy again once they sync.
+func testFailingPortals(t *testing.T) {
+	// create a portal that fails until it's fixed
+	var mu sync.Mutex
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		skyapi.WriteJSON(w, api.BlocklistGET{})
+	}))
+	defer server.Close()
+
+	// create a syncer, it's not started so we control when it syncs
+	s, _, err := newTestSyncer(t, []string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckPortals(); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the portal is reported as failing
+	err = s.managedSyncPortals()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	err = s.CheckPortals()
+	if err == nil || !strings.Contains(err.Error(), server.URL) {
+		t.Fatal("unexpected error", err)
+	}
+	if _, ok := s.Status().FailingPortals[server.URL]; !ok {
+		t.Fatal("expected portal to be failing", s.Status())
+	}
+
+	// fix the portal and assert it's healthy after the next sync
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckPortals(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Status().FailingPortals) != 0 {
+		t.Fatal("unexpected failing portals", s.Status())
+	}
+}
+
+// testPortalIdentity verifies the syncer drops the blocklist of a portal that
+// fails to prove its identity, and reports the portal as failing.
+func testPortalIdentity(t *testing.T) {
+	// create a portal that signs its blocklist with its key
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := database.Hash{Hash: randomHash()}
+	page, err := json.Marshal(api.BlocklistGET{Entries: []api.BlockedHash{{Hash: hash}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(api.BlocklistSignatureHeader, hex.EncodeToString(ed25519.Sign(sk, page)))
+		w.Write(page)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// newSyncer is a helper that creates a syncer for the portal with the
+	// given identity
+	logger, _ := logtest.NewNullLogger()
+	db := database.NewTestDB(context.Background(), t.Name(), database.WithCleanup(t))
+	newSyncer := func(publicKey ed25519.PublicKey) *Syncer {
+		identity := api.PortalIdentity{
+			URL:            server.URL,
+			TLSFingerprint: fingerprint,
+			PublicKey:      hex.EncodeToString(publicKey),
+		}
+		s, err := New(db, []string{server.URL}, logger.WithField("module", "syncer"), WithPortalIdentities([]api.PortalIdentity{identity}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// assert the blocklist is dropped if it's not signed by the portal's
+	// configured key
+	otherPK, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSyncer(otherPK)
+	err = s.managedSyncPortals()
+	if !errors.Contains(err, api.ErrInvalidBlocklistSignature) {
+		t.Fatal("unexpected error", err)
+	}
+	if err := s.CheckPortals(); err == nil {
+		t.Fatal("expected the portal to be failing")
+	}
+	doc, err := db.FindByHash(context.Background(), hash)
+	if err != nil || doc != nil {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert the blocklist is imported if it's signed by the portal's key
+	s = newSyncer(pk)
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckPortals(); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = db.FindByHash(context.Background(), hash)
+	if err != nil || doc == nil {
+		t.Fatal("unexpected", doc, err)
+	}
+
+	// assert identities of unknown portals are rejected
+	identity := api.PortalIdentity{URL: "https://siasky.net", TLSFingerprint: fingerprint}
+	_, err = New(db, []string{server.URL}, logger.WithField("module", "syncer"), WithPortalIdentities([]api.PortalIdentity{identity}))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testPrunePortals verifies the syncer drops the state of portals that are
+// removed, that it stores a large blocklist in batches and that it bounds the
+// error history of a failing portal.
+func testPrunePortals(t *testing.T) {
+	// create a portal with a blocklist that spans multiple batches, and a
+	// portal that fails
+	var hashes []database.Hash
+	var blg api.BlocklistGET
+	for i := 0; i < 2*syncBatchSize+5; i++ {
+		hash := database.Hash{Hash: randomHash()}
+		hashes = append(hashes, hash)
+		blg.Entries = append(blg.Entries, api.BlockedHash{Hash: hash})
+	}
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		skyapi.WriteJSON(w, blg)
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	// create a syncer for both portals
+	s, _, err := newTestSyncer(t, []string{healthy.URL, failing.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sync more often than the error history holds
+	for i := 0; i < maxPortalErrors+2; i++ {
+		err = s.managedSyncPortals()
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	// assert every hash got stored
+	for _, hash := range hashes {
+		doc, err := s.staticDB.FindByHash(context.Background(), hash)
+		if err != nil || doc == nil {
+			t.Fatal("unexpected", doc, err)
+		}
+	}
+
+	// assert the state of both portals is tracked
+	status := s.Status()
+	if lsh, ok := status.LastSyncedHash[healthy.URL]; !ok || lsh != hashes[len(hashes)-1].String() {
+		t.Fatal("unexpected last synced hash", status.LastSyncedHash)
+	}
+	if len(status.FailingPortals) != 1 || len(status.PortalErrors[failing.URL]) != maxPortalErrors {
+		t.Fatal("unexpected portal errors", status.PortalErrors)
+	}
+
+	// remove the failing portal, its state is dropped on the next sync
+	err = s.SetPortalURLs([]string{healthy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.managedSyncPortals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = s.Status()
+	if len(status.PortalURLs) != 1 || len(status.LastSyncedHash) != 1 {
+		t.Fatal("unexpected status", status)
+	}
+	if len(status.FailingPortals) != 0 || len(status.PortalErrors) != 0 {
+		t.Fatal("unexpected portal errors", status.PortalErrors)
+	}
+	if err := s.CheckPortals(); err != nil {
+		t.Fatal(err)
+	}
+
+	// swap the healthy portal for the failing one, which drops the state of
+	// the healthy portal
+	err = s.SetPortalURLs([]string{failing.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.managedSyncPortals()
+	status = s.Status()
+	if len(status.LastSyncedHash) != 0 || len(status.PortalErrors[failing.URL]) != 1 {
+		t.Fatal("unexpected status", status)
+	}
+}